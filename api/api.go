@@ -0,0 +1,710 @@
+// Package api defines the types exchanged between the metcd HTTP server
+// and its clients.
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EventType is the kind of change carried by a watch event.
+type EventType string
+
+const (
+	EventPut    EventType = "PUT"
+	EventDelete EventType = "DELETE"
+)
+
+// Event is a single key change streamed to watchers, with the metadata of
+// the key after the change: a put carries the revisions the key was created
+// and changed at and its version, a delete the revision it was deleted at.
+// Time is when the change was made, by the clock of the leader; it never
+// goes back within a keyspace and is nil for changes older than its
+// recording.
+type Event struct {
+	Type           EventType  `json:"type"`
+	Key            string     `json:"key"`
+	Value          string     `json:"value,omitempty"`
+	CreateRevision int64      `json:"createRevision,omitempty"`
+	ModRevision    int64      `json:"modRevision,omitempty"`
+	Version        int64      `json:"version,omitempty"`
+	Time           *time.Time `json:"time,omitempty"`
+}
+
+// HistoryResponse is the body of GET /history/<key>: the changes of the key
+// after CompactRevision, oldest first. Older changes were compacted or
+// dropped from the watch history. More is set if ?limit= left some out,
+// those of the next page read with the Continue token.
+type HistoryResponse struct {
+	Header          ResponseHeader `json:"header"`
+	Key             string         `json:"key"`
+	CompactRevision int64          `json:"compactRevision"`
+	Revisions       []Event        `json:"revisions"`
+	More            bool           `json:"more,omitempty"`
+	Continue        string         `json:"continue,omitempty"`
+}
+
+// KeyValue is a key and its value in an export of GET /snapshot?format=json.
+// The /v1/kv endpoints add the revisions the key was created and last
+// changed at, 0 for keys older than the tracking of revisions, and its
+// version, the number of puts since it was created, and ModTime the time of
+// its last change like the Time of an Event.
+type KeyValue struct {
+	Key            string     `json:"key"`
+	Value          string     `json:"value"`
+	CreateRevision int64      `json:"createRevision,omitempty"`
+	ModRevision    int64      `json:"modRevision,omitempty"`
+	Version        int64      `json:"version,omitempty"`
+	ModTime        *time.Time `json:"modTime,omitempty"`
+}
+
+// ResponseHeader is the part of every /v1 response describing the store.
+type ResponseHeader struct {
+	// Revision is the revision of the keyspace when the request was served.
+	Revision int64 `json:"revision"`
+}
+
+// KVPutRequest is the body of PUT /v1/kv/<key>.
+type KVPutRequest struct {
+	Value string `json:"value"`
+	// PrevKV returns the replaced pair in KVResponse.PrevKV.
+	PrevKV bool `json:"prevKv,omitempty"`
+}
+
+// KVResponse is the body of every response of /v1/kv/<key>: GET returns
+// KV, PUT the written KV and DELETE the number of deleted keys. Failed
+// requests have Error set instead.
+type KVResponse struct {
+	Header  ResponseHeader `json:"header"`
+	KV      *KeyValue      `json:"kv,omitempty"`
+	PrevKV  *KeyValue      `json:"prevKv,omitempty"`
+	Deleted int64          `json:"deleted,omitempty"`
+	Error   *Error         `json:"error,omitempty"`
+}
+
+// Error is a failure of a /v1 request, Code is one of the ErrCode
+// constants and does not change between releases, unlike Message.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes of /v1 responses.
+const (
+	ErrCodeInvalidArgument  = "INVALID_ARGUMENT"
+	ErrCodeKeyNotFound      = "KEY_NOT_FOUND"
+	ErrCodeKeyspaceNotFound = "KEYSPACE_NOT_FOUND"
+	ErrCodeQuotaExceeded    = "QUOTA_EXCEEDED"
+	ErrCodeNoSpace          = "NO_SPACE"
+	ErrCodeValidationFailed = "VALIDATION_FAILED"
+	ErrCodeMemberRemoved    = "MEMBER_REMOVED"
+	ErrCodeUnavailable      = "UNAVAILABLE"
+	ErrCodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	ErrCodeInternal         = "INTERNAL"
+)
+
+// Member is a raft member of the cluster.
+type Member struct {
+	ID        uint64 `json:"id"`
+	PeerURL   string `json:"peerURL"`
+	IsLeader  bool   `json:"isLeader"`
+	IsLearner bool   `json:"isLearner,omitempty"`
+	// IsObserver is set on the learners that are never promoted
+	IsObserver bool `json:"isObserver,omitempty"`
+	// Snapshot is the snapshot the leader is sending the member, set in
+	// the response of the leader only
+	Snapshot *SnapshotTransfer `json:"snapshot,omitempty"`
+}
+
+// SnapshotTransfer is the progress of a snapshot the leader sends a
+// follower in chunks.
+type SnapshotTransfer struct {
+	Index uint64 `json:"index"`
+	Size  int    `json:"size"`
+	// Sent is the bytes the follower received, Attempts more than 1 when
+	// the transfer resumed after a failure
+	Sent     int       `json:"sent"`
+	Attempts int       `json:"attempts"`
+	Started  time.Time `json:"started"`
+}
+
+// MemberAddRequest is the body of POST /cluster/members.
+type MemberAddRequest struct {
+	ID        uint64 `json:"id"`
+	PeerURL   string `json:"peerURL"`
+	IsLearner bool   `json:"isLearner,omitempty"`
+	// IsObserver adds the member as a learner that is never promoted
+	IsObserver bool `json:"isObserver,omitempty"`
+}
+
+// MemberUpdateRequest is the body of PATCH /cluster/members/<id>.
+type MemberUpdateRequest struct {
+	PeerURL string `json:"peerURL"`
+}
+
+// DecommissionResult is the body of POST /admin/decommission/<id>.
+type DecommissionResult struct {
+	ID uint64 `json:"id"`
+	// Leader is the leader once the member was removed, another member if
+	// it led
+	Leader uint64 `json:"leader"`
+	// DataDirMarked is set when the member removed itself, its data
+	// directory is marked and deleted when it joins again
+	DataDirMarked bool `json:"dataDirMarked,omitempty"`
+}
+
+// Health is the body of GET /health.
+type Health struct {
+	Health bool `json:"health"`
+	// Status is the health of the ?service of the request in the terms of
+	// grpc.health.v1: SERVING, NOT_SERVING or SERVICE_UNKNOWN
+	Status string `json:"status,omitempty"`
+	Leader uint64 `json:"leader,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// AppliedIndex is the last raft index applied by the member and
+	// DurableIndex the last one known to be fsynced to its WAL. With
+	// --wal-sync=interval or none the durable index lags behind.
+	AppliedIndex uint64 `json:"appliedIndex,omitempty"`
+	DurableIndex uint64 `json:"durableIndex,omitempty"`
+	// ClockSkew is the estimated offset of the clock of each peer, and
+	// ClockSkewExceeded reports an offset past --clock-skew-bound, which
+	// disables the lease of the bounded staleness reads.
+	ClockSkew         []ClockSkew `json:"clockSkew,omitempty"`
+	ClockSkewExceeded bool        `json:"clockSkewExceeded,omitempty"`
+}
+
+// ClockSkew is the offset of the clock of a peer from the clock of the
+// member, within half the round trip time of the probe.
+type ClockSkew struct {
+	MemberID uint64        `json:"memberID"`
+	Offset   time.Duration `json:"offset"`
+	RTT      time.Duration `json:"rtt"`
+}
+
+// The statuses of Health.
+const (
+	HealthServing        = "SERVING"
+	HealthNotServing     = "NOT_SERVING"
+	HealthServiceUnknown = "SERVICE_UNKNOWN"
+)
+
+// CompareTarget is the part of a key a Compare looks at.
+type CompareTarget string
+
+const (
+	CompareValue  CompareTarget = "value"
+	CompareExists CompareTarget = "exists"
+	// CompareCreate, CompareMod and CompareVersion compare the revisions a
+	// key was created and last changed at and its version as integers, 0
+	// for a missing key.
+	CompareCreate  CompareTarget = "create"
+	CompareMod     CompareTarget = "mod"
+	CompareVersion CompareTarget = "version"
+)
+
+// CompareResult is the relation a Compare checks.
+type CompareResult string
+
+const (
+	CompareEqual    CompareResult = "="
+	CompareNotEqual CompareResult = "!="
+	CompareGreater  CompareResult = ">"
+	CompareLess     CompareResult = "<"
+)
+
+// Compare is a condition evaluated against the store when a Txn is applied.
+// For CompareExists, Value is "true" or "false"; for CompareCreate,
+// CompareMod and CompareVersion it is an integer.
+type Compare struct {
+	Target CompareTarget `json:"target"`
+	Result CompareResult `json:"result"`
+	Key    string        `json:"key"`
+	Value  string        `json:"value"`
+}
+
+// OpType is the kind of operation inside a Txn.
+type OpType string
+
+const (
+	OpGet    OpType = "get"
+	OpPut    OpType = "put"
+	OpDelete OpType = "delete"
+)
+
+// Op is a single operation executed by a Txn.
+type Op struct {
+	Type  OpType `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// TxnRequest is the body of POST /txn. If all Compare conditions hold the
+// Success ops are executed, otherwise the Failure ops are.
+type TxnRequest struct {
+	Compare []Compare `json:"compare,omitempty"`
+	Success []Op      `json:"success,omitempty"`
+	Failure []Op      `json:"failure,omitempty"`
+}
+
+// OpResponse is the result of a single Op.
+type OpResponse struct {
+	Type  OpType `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	// Found reports whether a get found the key or a delete removed it.
+	Found bool `json:"found,omitempty"`
+}
+
+// TxnResponse is the result of a Txn.
+type TxnResponse struct {
+	Succeeded bool         `json:"succeeded"`
+	Responses []OpResponse `json:"responses,omitempty"`
+}
+
+// AlarmType is the condition an alarm reports.
+type AlarmType string
+
+const (
+	// AlarmUnreachable is raised by the leader for a member it could not
+	// reach for longer than the dead member timeout.
+	AlarmUnreachable AlarmType = "UNREACHABLE"
+	// AlarmNoSpace is raised by a member whose data directory is short of
+	// space; the cluster refuses the writes adding data while it is active.
+	AlarmNoSpace AlarmType = "NOSPACE"
+)
+
+// Alarm is an active alarm on a member.
+type Alarm struct {
+	MemberID uint64    `json:"memberID"`
+	Alarm    AlarmType `json:"alarm"`
+}
+
+// AlarmAction is what an AlarmRequest does.
+type AlarmAction string
+
+const (
+	AlarmActivate   AlarmAction = "activate"
+	AlarmDeactivate AlarmAction = "deactivate"
+)
+
+// AlarmRequest is the body of POST /alarms. Deactivating with a zero
+// MemberID or an empty Alarm matches every member or alarm type.
+type AlarmRequest struct {
+	Action   AlarmAction `json:"action"`
+	MemberID uint64      `json:"memberID,omitempty"`
+	Alarm    AlarmType   `json:"alarm,omitempty"`
+}
+
+// LogLevel is the level of a member's structured logs and of its raft
+// library.
+type LogLevel struct {
+	Level string `json:"level"`
+	Raft  string `json:"raft"`
+}
+
+// LogLevelRequest changes the log levels of a member. An empty Level keeps
+// the current one, an empty Raft follows Level. With a Duration such as
+// "10m" the previous levels are restored after it.
+type LogLevelRequest struct {
+	Level    string `json:"level,omitempty"`
+	Raft     string `json:"raft,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// DefragResponse reports what POST /admin/defrag reclaimed on a member.
+type DefragResponse struct {
+	SnapshotIndex    uint64 `json:"snapshotIndex"`
+	CompactIndex     uint64 `json:"compactIndex"`
+	RemovedWALs      int    `json:"removedWALs"`
+	RemovedSnapshots int    `json:"removedSnapshots"`
+	ReclaimedBytes   int64  `json:"reclaimedBytes"`
+}
+
+// ImportProgress is a line of the response of POST /admin/import, sent
+// after every batch of imported keys. The last line has Done set, or Error
+// if the import stopped; the keys imported until then stay in the store.
+type ImportProgress struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+	Rev   int64 `json:"rev"`
+	// Latency is the time the last batch took to commit, ApplyLag the
+	// entries the member had committed but not applied after it, and
+	// Delay the wait before the next batch, all paced to keep Latency
+	// under the target of the import. Durations are in nanoseconds.
+	Latency  time.Duration `json:"latency,omitempty"`
+	ApplyLag uint64        `json:"applyLag,omitempty"`
+	Delay    time.Duration `json:"delay,omitempty"`
+	Done     bool          `json:"done,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// KeyHash is a line of the state POST /admin/verify sends to a verifier:
+// a key and the hex SHA-256 of its value, in the order of the keys.
+type KeyHash struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+}
+
+// VerifyResponse reports the state POST /admin/verify sent to a verifier
+// that accepted it. Digest is the hex SHA-256 of the lines sent, empty if
+// the verifier answered before reading them all; Response is the start of
+// its answer.
+type VerifyResponse struct {
+	Rev      int64  `json:"rev"`
+	Keys     int64  `json:"keys"`
+	Digest   string `json:"digest,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+// EncryptionKey is an encrypted prefix of a keyspace and the current
+// version of its data key, see /admin/encryption.
+type EncryptionKey struct {
+	Prefix  string `json:"prefix"`
+	Version uint32 `json:"version"`
+}
+
+// Redaction is a prefix of a keyspace whose values are replaced by
+// "[REDACTED]" in the snapshots and exports of GET /snapshot, see
+// /admin/redaction.
+type Redaction struct {
+	Keyspace string `json:"keyspace,omitempty"`
+	Prefix   string `json:"prefix"`
+}
+
+// Retention is a prefix of a keyspace whose deleted keys are kept as
+// tombstones until the history is compacted past their deletion, see
+// /admin/retention.
+type Retention struct {
+	Keyspace string `json:"keyspace,omitempty"`
+	Prefix   string `json:"prefix"`
+}
+
+// Schema is the JSON Schema the values written under a prefix of a
+// keyspace are validated against, see /admin/schema.
+type Schema struct {
+	Keyspace string          `json:"keyspace,omitempty"`
+	Prefix   string          `json:"prefix"`
+	Schema   json.RawMessage `json:"schema"`
+}
+
+// Transform is the transformer attached to a prefix of a keyspace, see
+// /admin/transform.
+type Transform struct {
+	Keyspace    string `json:"keyspace,omitempty"`
+	Prefix      string `json:"prefix"`
+	Transformer string `json:"transformer"`
+}
+
+// MoveRequest is the body of POST /move: the key From is renamed To, or
+// if Prefix is set every key with the prefix From gets the prefix To
+// instead. The move fails if a destination exists, unless Overwrite is
+// set.
+type MoveRequest struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Prefix    bool   `json:"prefix,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+}
+
+// MoveResponse is the response of POST /move, with the revision of the
+// move and the number of keys moved.
+type MoveResponse struct {
+	Revision int64 `json:"revision"`
+	Moved    int   `json:"moved"`
+}
+
+// Tombstone is a deleted key kept by a retention, which POST
+// /tombstones/<key> restores with its last value.
+type Tombstone struct {
+	Key            string     `json:"key"`
+	CreateRevision int64      `json:"createRevision,omitempty"`
+	ModRevision    int64      `json:"modRevision,omitempty"`
+	Version        int64      `json:"version,omitempty"`
+	DeleteRevision int64      `json:"deleteRevision"`
+	DeleteTime     *time.Time `json:"deleteTime,omitempty"`
+}
+
+// RecordedOp is a client operation captured by metcd --record-traffic, one
+// JSON object per line. Keys are replaced by a salted hash that is stable
+// within a recording, values by their size.
+type RecordedOp struct {
+	// Op is get, put, delete, append, patch or txn.
+	Op      string `json:"op"`
+	KeyHash string `json:"keyHash,omitempty"`
+	// Size is the size of the written value, or of the read one.
+	Size int64 `json:"size"`
+	// Offset is the time since the recording started, Duration the time
+	// the request took, both in nanoseconds.
+	Offset   time.Duration `json:"offset"`
+	Duration time.Duration `json:"duration"`
+	Status   int           `json:"status"`
+}
+
+// HotKey is the access statistics of a key or a prefix in GET
+// /admin/hotkeys, since the member started or they were reset. They are
+// approximate: only the keys accessed most are tracked, and a key that
+// started being tracked late may have its accesses short by Error.
+type HotKey struct {
+	Keyspace string `json:"keyspace,omitempty"`
+	// Key is the key, or the prefix ending with a slash.
+	Key        string    `json:"key"`
+	Reads      uint64    `json:"reads"`
+	Writes     uint64    `json:"writes"`
+	ReadBytes  uint64    `json:"readBytes"`
+	WriteBytes uint64    `json:"writeBytes"`
+	LastRead   time.Time `json:"lastRead"`
+	LastWrite  time.Time `json:"lastWrite"`
+	// Error is how many accesses of the keys replaced by this one it may
+	// be counted with.
+	Error uint64 `json:"error,omitempty"`
+}
+
+// AuditRecord is a mutating operation written by metcd --audit-log, one
+// JSON object per line. Values are never recorded.
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Member uint64    `json:"member"`
+	// RequestID is the X-Request-Id of the HTTP request, generated if the
+	// client sent none, shared by the operations of a WebSocket.
+	RequestID string `json:"requestId,omitempty"`
+	// Protocol is http, ws or resp.
+	Protocol string `json:"protocol"`
+	// Client is the address of the client, ForwardedFor the
+	// X-Forwarded-For header it sent, UserAgent its User-Agent.
+	Client       string `json:"client"`
+	ForwardedFor string `json:"forwardedFor,omitempty"`
+	UserAgent    string `json:"userAgent,omitempty"`
+	// Op is the HTTP method, the WebSocket op or the Redis command.
+	Op       string   `json:"op"`
+	Path     string   `json:"path,omitempty"`
+	Keyspace string   `json:"keyspace,omitempty"`
+	Keys     []string `json:"keys,omitempty"`
+	// Status is the HTTP status of the response, Error why a WebSocket op
+	// or a Redis command failed.
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Keyspace is a named set of keys with its own revisions, watches and
+// quota, selected with the X-Metcd-Keyspace header or a /ks/<name> path
+// prefix. The default keyspace has an empty name.
+type Keyspace struct {
+	Name string `json:"name"`
+	// Quota is the maximum size of the keys and values in bytes, 0 is
+	// unlimited. Size is their current size.
+	Quota int64 `json:"quota,omitempty"`
+	Size  int64 `json:"size"`
+	Keys  int   `json:"keys"`
+	Rev   int64 `json:"rev"`
+}
+
+// Stats is the body of GET /admin/stats: the number and size of the keys
+// and the watchers of a member, in total and by keyspace.
+type Stats struct {
+	Keys      int             `json:"keys"`
+	Size      int64           `json:"size"`
+	Watchers  int             `json:"watchers"`
+	Keyspaces []KeyspaceStats `json:"keyspaces"`
+}
+
+// KeyspaceStats are the statistics of a keyspace. Its revisions go from
+// CompactRevision, the last compaction, to Rev; watches resume after
+// HistoryRevision at the earliest. Prefixes are the top-level prefixes
+// holding the most keys, the keys without a slash after the first
+// character are in none.
+type KeyspaceStats struct {
+	Name            string        `json:"name"`
+	Keys            int           `json:"keys"`
+	Size            int64         `json:"size"`
+	Watchers        int           `json:"watchers"`
+	Rev             int64         `json:"rev"`
+	CompactRevision int64         `json:"compactRevision"`
+	HistoryRevision int64         `json:"historyRevision"`
+	Prefixes        []PrefixStats `json:"prefixes,omitempty"`
+}
+
+// PrefixStats are the number and size of the keys with Prefix, a first
+// path segment ending with a slash.
+type PrefixStats struct {
+	Prefix string `json:"prefix"`
+	Keys   int    `json:"keys"`
+	Size   int64  `json:"size"`
+}
+
+// Webhook is a URL the leader POSTs the changes of the keys with Prefix in
+// Keyspace to, a JSON {"keyspace", "rev", "events"} per revision. PUT
+// /webhooks/<id> registers it, GET /webhooks lists them.
+type Webhook struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Keyspace string `json:"keyspace,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	// Authorization is sent as the Authorization header of the requests;
+	// it is never listed
+	Authorization string `json:"authorization,omitempty"`
+}
+
+// Group is a raft group of a member, listed by GET /groups and selected
+// with the X-Metcd-Group header or a /groups/<name> path prefix. The
+// default group has an empty name.
+type Group struct {
+	Name         string `json:"name"`
+	Leader       uint64 `json:"leader"`
+	IsLeader     bool   `json:"isLeader,omitempty"`
+	Rev          int64  `json:"rev"`
+	AppliedIndex uint64 `json:"appliedIndex"`
+}
+
+// Shard is a range of keys of the default keyspace placed on a raft
+// group, listed by GET /admin/shards. The shards of a placement cover every
+// key, the /kv and /v1/kv requests for a key are served by the group of its
+// shard.
+type Shard struct {
+	ID uint64 `json:"id"`
+	// Start is the first key of the shard, End the first key after it,
+	// empty for the last shard
+	Start string `json:"start"`
+	End   string `json:"end,omitempty"`
+	Group string `json:"group"`
+	// MovingTo is the group the shard is migrating to, its keys cannot be
+	// written meanwhile
+	MovingTo string `json:"movingTo,omitempty"`
+	// Requests is the number of requests this member routed to the shard
+	// since it started, to find hot shards
+	Requests uint64 `json:"requests,omitempty"`
+}
+
+// ShardSplit is the body of POST /admin/shards/<id>/split, Key becomes the
+// start of the new shard.
+type ShardSplit struct {
+	Key string `json:"key"`
+}
+
+// ShardMove is the body of POST /admin/shards/<id>/move.
+type ShardMove struct {
+	Group string `json:"group"`
+}
+
+// KeyspaceRequest is the body of PUT /keyspaces/<name>.
+type KeyspaceRequest struct {
+	Quota int64 `json:"quota,omitempty"`
+}
+
+// StorageStatus is the body of GET /debug/storage on the debug listener.
+type StorageStatus struct {
+	Keys int `json:"keys"`
+	// Size is the size of the keys and values of every keyspace;
+	// MemoryEstimate adds an estimate of the maps holding them
+	Size           int64      `json:"size"`
+	MemoryEstimate int64      `json:"memoryEstimate"`
+	Keyspaces      []Keyspace `json:"keyspaces"`
+	// WAL and Snapshots are the files of the data directory, WALSize and
+	// SnapshotSize their total size
+	WALSize      int64      `json:"walSize"`
+	WAL          []DataFile `json:"wal"`
+	SnapshotSize int64      `json:"snapshotSize"`
+	Snapshots    []DataFile `json:"snapshots"`
+}
+
+// View is a read-only copy of a keyspace frozen at Rev on one member,
+// created by POST /views, which analytical reads run against without
+// holding up the writes. It is released after some time without reads.
+type View struct {
+	ID       string    `json:"id"`
+	Keyspace string    `json:"keyspace"`
+	Rev      int64     `json:"rev"`
+	Keys     int       `json:"keys"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+}
+
+// ViewRange is the body of GET /views/<id>/kv/<key>: the pairs read from
+// the view at Rev, Count the number of pairs in the range and More whether
+// the limit left some out, those of the next page read with the Continue
+// token.
+type ViewRange struct {
+	Rev      int64      `json:"rev"`
+	KVs      []KeyValue `json:"kvs"`
+	Count    int        `json:"count"`
+	More     bool       `json:"more,omitempty"`
+	Continue string     `json:"continue,omitempty"`
+}
+
+// Ring is the body of GET /ring/<prefix>: the consistent hash ring, as
+// metcd/hashring computes it, of the nodes registered as keys under Prefix
+// at Rev. With ?key= Owners are the nodes of the key, its owner first.
+type Ring struct {
+	Prefix string     `json:"prefix"`
+	Rev    int64      `json:"rev"`
+	VNodes int        `json:"vnodes"`
+	Nodes  []RingNode `json:"nodes"`
+	Owners []string   `json:"owners,omitempty"`
+}
+
+// RingNode is a node of a Ring, registered by the key of its name under the
+// prefix of the ring.
+type RingNode struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// DataFile is a file of the data directory of a member.
+type DataFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// WSOp is the operation of a WSRequest.
+type WSOp string
+
+const (
+	WSGet    WSOp = "get"
+	WSPut    WSOp = "put"
+	WSDelete WSOp = "delete"
+	WSTxn    WSOp = "txn"
+	WSWatch  WSOp = "watch"
+	// WSCancel cancels the watch started by the request with the same ID.
+	WSCancel WSOp = "cancel"
+)
+
+// WSRequest is a message sent to /ws. The requests of a connection are
+// executed in order, each answered by a WSResponse with its ID; a watch is
+// answered by a WSResponse per event until it is canceled.
+type WSRequest struct {
+	ID    int64       `json:"id"`
+	Op    WSOp        `json:"op"`
+	Key   string      `json:"key,omitempty"`
+	Value string      `json:"value,omitempty"`
+	Txn   *TxnRequest `json:"txn,omitempty"`
+	// Serializable gets are served from the store of the member, maybe
+	// stale.
+	Serializable bool `json:"serializable,omitempty"`
+	// Prefix, Since, KeysOnly, NoPut and NoDelete are the options of a
+	// watch, as the query parameters of GET /watch/<key>. A nil Since
+	// starts with the next change.
+	Prefix   bool   `json:"prefix,omitempty"`
+	Since    *int64 `json:"since,omitempty"`
+	KeysOnly bool   `json:"keysOnly,omitempty"`
+	NoPut    bool   `json:"noPut,omitempty"`
+	NoDelete bool   `json:"noDelete,omitempty"`
+}
+
+// WSResponse is a message sent by /ws for the request with ID. A get
+// returns KV, nil for a missing key, and the revision of the keyspace in
+// Rev; a put returns the written KV, a delete whether it Found the key, a
+// txn its result and a watch an Event per change. Canceled ends a watch,
+// canceled by the client, fallen behind or failed; a watch starting at a
+// compacted Since fails with the CompactRevision the kept events start
+// after. Failed requests have Error set.
+type WSResponse struct {
+	ID              int64        `json:"id"`
+	KV              *KeyValue    `json:"kv,omitempty"`
+	Rev             int64        `json:"rev,omitempty"`
+	Found           bool         `json:"found,omitempty"`
+	Txn             *TxnResponse `json:"txn,omitempty"`
+	Event           *Event       `json:"event,omitempty"`
+	Canceled        bool         `json:"canceled,omitempty"`
+	CompactRevision int64        `json:"compactRevision,omitempty"`
+	Error           string       `json:"error,omitempty"`
+}
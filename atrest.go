@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"metcd/encryption"
+	"metcd/raftnode"
+	"os"
+	"path/filepath"
+)
+
+// atRest encrypts the WAL and snapshots of the member, set from
+// --encryption-at-rest. Nil stores them in plaintext and refuses to read
+// encrypted ones.
+var atRest *encryption.AtRest
+
+func openAtRest(uri string) (*encryption.AtRest, error) {
+	kms, err := encryption.OpenKMS(uri)
+	if err != nil {
+		return nil, err
+	}
+	return encryption.NewAtRest(kms)
+}
+
+// decrypter opens the data sealed by an AtRest and writes it back in
+// plaintext.
+type decrypter struct{ *encryption.AtRest }
+
+func (decrypter) Seal(data []byte) ([]byte, error) { return data, nil }
+
+// reencryptDataDir implements `metcd reencrypt-datadir`: it rewrites the
+// WAL and snapshot of a stopped member, and of its raft groups, with the
+// current key of --encryption-at-rest. Data written in plaintext or with a
+// previous key of the KMS is encrypted again, after which the previous keys
+// may be removed. With --decrypt the data is written in plaintext.
+func reencryptDataDir(args []string) error {
+	fset := flag.NewFlagSet("reencrypt-datadir", flag.ExitOnError)
+	dataDir := fset.String("data-dir", ".", "data directory of the member")
+	id := fset.Int("id", 0, "member to re-encrypt, needed when --data-dir holds the data of several members")
+	uri := fset.String("encryption-at-rest", "", "KMS of the member, as <scheme>:<target>")
+	decrypt := fset.Bool("decrypt", false, "write the data in plaintext, to disable encryption at rest")
+	fset.Parse(args)
+	if *uri == "" && !*decrypt {
+		return errors.New("reencrypt-datadir needs --encryption-at-rest")
+	}
+	var (
+		a   *encryption.AtRest
+		err error
+	)
+	if *uri != "" {
+		if a, err = openAtRest(*uri); err != nil {
+			return err
+		}
+	}
+	var s raftnode.Sealer = a
+	if *decrypt {
+		s = decrypter{a}
+	}
+	if *id == 0 {
+		if *id, err = findDataDirMember(*dataDir); err != nil {
+			return err
+		}
+	}
+
+	dirs := []string{*dataDir}
+	groups, _ := filepath.Glob(raftnode.GroupDir(*dataDir, "*"))
+	for _, g := range groups {
+		if _, err := os.Stat(filepath.Join(g, raftnode.WALDir(*id))); err == nil {
+			dirs = append(dirs, g)
+		}
+	}
+	for _, dir := range dirs {
+		if err := checkStopped(filepath.Join(dir, raftnode.WALDir(*id))); err != nil {
+			return err
+		}
+	}
+	for _, dir := range dirs {
+		if err := raftnode.VerifyDataDir(dir, *id); err != nil {
+			return fmt.Errorf("%s is damaged, not re-encrypting: %v", dir, err)
+		}
+		if err := raftnode.ReencryptDataDir(dir, *id, s); err != nil {
+			return fmt.Errorf("re-encrypting %s: %v", dir, err)
+		}
+		if err := raftnode.VerifyDataDir(dir, *id); err != nil {
+			return fmt.Errorf("re-encrypted %s is damaged: %v", dir, err)
+		}
+		if *decrypt {
+			fmt.Printf("decrypted member %d in %s\n", *id, dir)
+		} else {
+			fmt.Printf("re-encrypted member %d in %s\n", *id, dir)
+		}
+	}
+	return nil
+}
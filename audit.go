@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"metcd/api"
+	"metcd/resp"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// auditQueueSize is how many records wait to be written at most; a
+	// request finding the queue full waits up to auditQueueTimeout before
+	// its record is dropped.
+	auditQueueSize    = 4096
+	auditQueueTimeout = time.Second
+	// auditBatchSize is how many records are written or forwarded at once.
+	auditBatchSize = 256
+	// auditTimeout bounds forwarding a batch to syslog or HTTP, and
+	// auditAttempts is how many times it is tried before it is dropped.
+	auditTimeout  = 10 * time.Second
+	auditAttempts = 3
+)
+
+var auditDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "metcd",
+	Subsystem: "server",
+	Name:      "audit_records_dropped_total",
+	Help:      "Number of audit records dropped because the audit log could not keep up or failed.",
+})
+
+func init() {
+	prometheus.MustRegister(auditDropped)
+}
+
+// requestIDHeader carries the ID of a request, recorded in the audit log.
+const requestIDHeader = "X-Request-Id"
+
+// auditLog writes a record of every mutating client operation, as JSON
+// lines, to a file rotated by size, a syslog server or an HTTP endpoint.
+// Records are queued and written in the background, so that a slow
+// destination only delays requests once the queue is full.
+type auditLog struct {
+	member uint64
+	sink   auditSink
+	queue  chan []byte
+	donec  chan struct{}
+}
+
+// auditSink is where the records go, write gets whole JSON lines.
+type auditSink interface {
+	write(lines []byte) error
+	Close() error
+}
+
+// newAuditLog opens the audit log dest of member, a file, or
+// syslog+udp://host:port, syslog+tcp://host:port or an http(s) URL the
+// records are POSTed to. The file is rotated to dest.1, dest.2, ... once
+// it grows past maxSize bytes, keeping maxBackups of them; 0 never
+// rotates.
+func newAuditLog(dest string, member uint64, maxSize int64, maxBackups int) (*auditLog, error) {
+	var (
+		sink auditSink
+		err  error
+	)
+	switch {
+	case strings.HasPrefix(dest, "syslog+udp://"), strings.HasPrefix(dest, "syslog+tcp://"):
+		network, addr, _ := strings.Cut(strings.TrimPrefix(dest, "syslog+"), "://")
+		sink, err = newSyslogSink(network, addr)
+	case strings.HasPrefix(dest, "http://"), strings.HasPrefix(dest, "https://"):
+		sink = &httpAuditSink{url: dest, client: &http.Client{Timeout: auditTimeout}}
+	default:
+		sink, err = openAuditFile(dest, maxSize, maxBackups)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{member: member, sink: sink, queue: make(chan []byte, auditQueueSize), donec: make(chan struct{})}
+	go a.run()
+	return a, nil
+}
+
+func (a *auditLog) run() {
+	defer close(a.donec)
+	var batch []byte
+	for line := range a.queue {
+		batch = append(batch[:0], line...)
+	drain:
+		for n := 1; n < auditBatchSize; n++ {
+			select {
+			case line, ok := <-a.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, line...)
+			default:
+				break drain
+			}
+		}
+		var err error
+		for attempt := 1; attempt <= auditAttempts; attempt++ {
+			if err = a.sink.write(batch); err == nil {
+				break
+			}
+			if attempt < auditAttempts {
+				time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+			}
+		}
+		if err != nil {
+			n := bytes.Count(batch, []byte("\n"))
+			auditDropped.Add(float64(n))
+			log.Printf("Failed to write %d audit records, dropping them (%v)\n", n, err)
+		}
+	}
+}
+
+// Close writes the queued records and closes the destination.
+func (a *auditLog) Close() error {
+	close(a.queue)
+	<-a.donec
+	return a.sink.Close()
+}
+
+// record queues rec.
+func (a *auditLog) record(rec api.AuditRecord) {
+	rec.Member = a.member
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Failed to encode audit record (%v)\n", err)
+		return
+	}
+	line = append(line, '\n')
+	select {
+	case a.queue <- line:
+		return
+	default:
+	}
+	t := time.NewTimer(auditQueueTimeout)
+	defer t.Stop()
+	select {
+	case a.queue <- line:
+	case <-t.C:
+		auditDropped.Inc()
+	}
+}
+
+type auditCtx struct{}
+
+// auditClient returns the record of the client of the request of ctx,
+// set by handler; the zero record if there is none.
+func auditClient(ctx context.Context) api.AuditRecord {
+	rec, _ := ctx.Value(auditCtx{}).(api.AuditRecord)
+	return rec
+}
+
+// handler records the requests to next other than GET, HEAD and OPTIONS,
+// and answers every request with its X-Request-Id, generated if the client
+// sent none.
+func (a *auditLog) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		client := api.AuditRecord{
+			RequestID:    id,
+			Protocol:     "http",
+			Client:       r.RemoteAddr,
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			UserAgent:    r.UserAgent(),
+		}
+		r = r.WithContext(context.WithValue(r.Context(), auditCtx{}, client))
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		rec := client
+		rec.Time, rec.Duration = start, time.Since(start)
+		rec.Op, rec.Path, rec.Keyspace, rec.Status = r.Method, r.URL.Path, r.Header.Get(keyspaceHeader), rw.status
+		a.record(rec)
+	})
+}
+
+// ws records a put, delete or txn of a WebSocket, whose upgrade request
+// carried ctx.
+func (a *auditLog) ws(ctx context.Context, keyspace string, req api.WSRequest, start time.Time, err error) {
+	rec := auditClient(ctx)
+	rec.Protocol, rec.Time, rec.Duration = "ws", start, time.Since(start)
+	rec.Op, rec.Keyspace = string(req.Op), keyspace
+	if req.Txn != nil {
+		for _, ops := range [][]api.Op{req.Txn.Success, req.Txn.Failure} {
+			for _, op := range ops {
+				rec.Keys = append(rec.Keys, op.Key)
+			}
+		}
+	} else {
+		rec.Keys = []string{req.Key}
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	a.record(rec)
+}
+
+// resp records a Redis command writing keys, see resp.Server.Audit.
+func (a *auditLog) resp(remote, command string, keys []string, err error) {
+	rec := api.AuditRecord{Time: time.Now(), Protocol: "resp", Client: remote, Op: command}
+	for _, k := range keys {
+		rec.Keys = append(rec.Keys, resp.KeyPrefix+k)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	a.record(rec)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// auditFile is an append-only file rotated by size.
+type auditFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openAuditFile(path string, maxSize int64, maxBackups int) (*auditFile, error) {
+	af := &auditFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	return af, af.open()
+}
+
+func (af *auditFile) open() error {
+	f, err := os.OpenFile(af.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	af.f, af.size = f, info.Size()
+	return nil
+}
+
+func (af *auditFile) write(lines []byte) error {
+	if af.f == nil {
+		// reopening failed after the last rotation
+		if err := af.open(); err != nil {
+			return err
+		}
+	}
+	if af.maxSize > 0 && af.size > 0 && af.size+int64(len(lines)) > af.maxSize {
+		if err := af.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := af.f.Write(lines)
+	af.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return af.f.Sync()
+}
+
+// rotate renames the file to path.1 after shifting the older ones, and
+// starts a new one.
+func (af *auditFile) rotate() error {
+	if err := af.f.Close(); err != nil {
+		return err
+	}
+	af.f = nil
+	if af.maxBackups <= 0 {
+		os.Remove(af.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", af.path, af.maxBackups))
+		for i := af.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", af.path, i), fmt.Sprintf("%s.%d", af.path, i+1))
+		}
+		if err := os.Rename(af.path, af.path+".1"); err != nil {
+			return err
+		}
+	}
+	return af.open()
+}
+
+func (af *auditFile) Close() error {
+	if af.f == nil {
+		return nil
+	}
+	return af.f.Close()
+}
+
+// syslogSink sends every record as an RFC 5424 message of facility local0,
+// framed by octet counting over TCP.
+type syslogSink struct {
+	network, addr string
+	hostname      string
+	conn          net.Conn
+}
+
+func newSyslogSink(network, addr string) (*syslogSink, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid syslog address %q (%v)", addr, err)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	return &syslogSink{network: network, addr: addr, hostname: hostname}, nil
+}
+
+// syslogPriority is facility local0 (16) and severity informational (6).
+const syslogPriority = 16*8 + 6
+
+func (s *syslogSink) write(lines []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.addr, auditTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(auditTimeout))
+	var buf []byte
+	for len(lines) > 0 {
+		var line []byte
+		line, lines, _ = bytes.Cut(lines, []byte("\n"))
+		msg := fmt.Appendf(nil, "<%d>1 %s %s metcd %d - - %s", syslogPriority, time.Now().UTC().Format(time.RFC3339Nano), s.hostname, os.Getpid(), line)
+		if s.network == "udp" {
+			if _, err := s.conn.Write(msg); err != nil {
+				s.Close()
+				return err
+			}
+			continue
+		}
+		buf = fmt.Appendf(buf, "%d ", len(msg))
+		buf = append(buf, msg...)
+	}
+	if len(buf) > 0 {
+		if _, err := s.conn.Write(buf); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// httpAuditSink POSTs the records as application/x-ndjson.
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpAuditSink) write(lines []byte) error {
+	resp, err := s.client.Post(s.url, "application/x-ndjson", bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("audit endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *httpAuditSink) Close() error { return nil }
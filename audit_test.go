@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"metcd/api"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAuditRecords(t *testing.T, path string) []api.AuditRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []api.AuditRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec api.AuditRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestAuditHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := newAuditLog(path, 7, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(a.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			http.Error(w, "Failed on DELETE", http.StatusInternalServerError)
+		}
+	})))
+	defer srv.Close()
+
+	for _, c := range []struct{ method, path, id string }{
+		{http.MethodGet, "/kv/a", ""},
+		{http.MethodPut, "/kv/a", "req-1"},
+		{http.MethodDelete, "/kv/secret", ""},
+	} {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, strings.NewReader("hunter2"))
+		if c.id != "" {
+			req.Header.Set(requestIDHeader, c.id)
+		}
+		req.Header.Set(keyspaceHeader, "app")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if id := resp.Header.Get(requestIDHeader); id == "" || (c.id != "" && id != c.id) {
+			t.Fatalf("expected the request ID %q to be answered, got %q", c.id, id)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs := readAuditRecords(t, path)
+	if len(recs) != 2 {
+		t.Fatalf("expected the PUT and the DELETE to be recorded, got %+v", recs)
+	}
+	put, del := recs[0], recs[1]
+	if put.Op != http.MethodPut || put.Path != "/kv/a" || put.RequestID != "req-1" || put.Status != http.StatusOK ||
+		put.Member != 7 || put.Keyspace != "app" || put.Protocol != "http" || put.Client == "" || put.Time.IsZero() {
+		t.Fatalf("unexpected record of the PUT %+v", put)
+	}
+	if del.Op != http.MethodDelete || del.Status != http.StatusInternalServerError || del.RequestID == "" {
+		t.Fatalf("unexpected record of the DELETE %+v", del)
+	}
+	if b, _ := os.ReadFile(path); strings.Contains(string(b), "hunter2") {
+		t.Fatal("expected the values not to be recorded")
+	}
+}
+
+func TestAuditFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	af, err := openAuditFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if err := af.write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		if b, err := os.ReadFile(name); err != nil || string(b) != want {
+			t.Fatalf("expected %s to hold %q, got %q, %v", name, want, b, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 rotated files, got %v", err)
+	}
+}
+
+func TestAuditForwarding(t *testing.T) {
+	// syslog over TCP frames the messages by octet counting
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(length))
+		msg := make([]byte, n)
+		io.ReadFull(r, msg)
+		received <- string(msg)
+	}()
+	a, err := newAuditLog("syslog+tcp://"+ln.Addr().String(), 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.resp("127.0.0.1:5000", "SET", []string{"a"}, nil)
+	select {
+	case msg := <-received:
+		if !strings.HasPrefix(msg, "<134>1 ") || !strings.Contains(msg, ` metcd `) || !strings.Contains(msg, `"keys":["/a"]`) {
+			t.Fatalf("unexpected syslog message %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the syslog message")
+	}
+	a.Close()
+
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		bodies <- string(b)
+	}))
+	defer srv.Close()
+	a, err = newAuditLog(srv.URL, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	ctx := context.WithValue(context.Background(), auditCtx{}, api.AuditRecord{RequestID: "ws-1", Client: "10.0.0.1:1234"})
+	a.ws(ctx, "", api.WSRequest{Op: api.WSDelete, Key: "/b"}, time.Now(), nil)
+	select {
+	case body := <-bodies:
+		var rec api.AuditRecord
+		if err := json.Unmarshal([]byte(body), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Protocol != "ws" || rec.Op != "delete" || rec.RequestID != "ws-1" || len(rec.Keys) != 1 || rec.Keys[0] != "/b" {
+			t.Fatalf("unexpected record %+v", rec)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the record")
+	}
+}
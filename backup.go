@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"metcd/codec"
+	"metcd/encryption"
+	"metcd/objstore"
+	"metcd/raftnode"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The names of the backed up snapshots, snapshotBackupPrefix followed by
+// the UTC time of the backup, so that they sort oldest first, and the raft
+// index of the snapshot in hex.
+const (
+	snapshotBackupPrefix = "metcd-snapshot-"
+	snapshotBackupTime   = "20060102T150405Z"
+	// snapshotRestoreLatest is the --snapshot-restore of the newest backup
+	snapshotRestoreLatest = "latest"
+)
+
+var (
+	snapshotBackups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "snapshot_backups_total",
+		Help:      "Number of snapshots backed up to --snapshot-backup by result: success or failure.",
+	}, []string{"result"})
+
+	snapshotBackupTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "snapshot_backup_last_success_timestamp_seconds",
+		Help:      "Unix time of the last snapshot backed up to --snapshot-backup.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(snapshotBackups, snapshotBackupTimestamp)
+}
+
+// snapshotBackup uploads a snapshot of the store to an object store every
+// interval while this member leads, and removes the oldest ones past
+// retain. The snapshots are those raft stores, compressed with
+// --snapshot-compression and encrypted with --encryption-at-rest.
+type snapshotBackup struct {
+	s        *kvstore
+	store    objstore.ObjectStore
+	isLeader func() bool
+	interval time.Duration
+	retain   int
+
+	stopc chan struct{}
+	donec chan struct{}
+}
+
+func newSnapshotBackup(s *kvstore, store objstore.ObjectStore, isLeader func() bool, interval time.Duration, retain int) *snapshotBackup {
+	return &snapshotBackup{
+		s:        s,
+		store:    store,
+		isLeader: isLeader,
+		interval: interval,
+		retain:   retain,
+		stopc:    make(chan struct{}),
+		donec:    make(chan struct{}),
+	}
+}
+
+func (b *snapshotBackup) Run() {
+	go func() {
+		defer close(b.donec)
+		t := time.NewTicker(b.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-b.stopc:
+				return
+			}
+			if !b.isLeader() {
+				continue
+			}
+			if err := b.backup(time.Now()); err != nil {
+				snapshotBackups.WithLabelValues("failure").Inc()
+				log.Printf("Failed to back up the snapshot (%v)\n", err)
+			}
+		}
+	}()
+}
+
+func (b *snapshotBackup) Stop() {
+	close(b.stopc)
+	<-b.donec
+}
+
+// backup uploads the snapshot of now, then removes the backups past retain.
+func (b *snapshotBackup) backup(now time.Time) error {
+	// the snapshot may be a little newer, never older
+	b.s.mu.RLock()
+	index := b.s.raftIndex
+	b.s.mu.RUnlock()
+	data, err := b.s.storedSnapshot()
+	if err != nil {
+		return err
+	}
+	if data, err = atRest.Seal(data); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.interval)
+	defer cancel()
+	name := snapshotBackupName(now, index)
+	if err := b.store.Put(ctx, name, data); err != nil {
+		return err
+	}
+	snapshotBackups.WithLabelValues("success").Inc()
+	snapshotBackupTimestamp.Set(float64(now.Unix()))
+	log.Printf("backed up the snapshot to %s (%d bytes)", name, len(data))
+
+	names, err := snapshotBackupNames(ctx, b.store)
+	if err != nil {
+		return err
+	}
+	for len(names) > b.retain {
+		if err := b.store.Delete(ctx, names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	// the shipped WAL before the oldest snapshot kept cannot be replayed
+	_, oldest, _ := parseSnapshotBackupName(names[0])
+	return pruneShippedWAL(ctx, b.store, oldest)
+}
+
+// snapshotBackupName is the name of the backup at now of the snapshot at
+// raft index.
+func snapshotBackupName(now time.Time, index uint64) string {
+	return fmt.Sprintf("%s%s-%016x", snapshotBackupPrefix, now.UTC().Format(snapshotBackupTime), index)
+}
+
+// parseSnapshotBackupName returns the time and raft index of the backup
+// called name, ok is false if it is not a backup.
+func parseSnapshotBackupName(name string) (t time.Time, index uint64, ok bool) {
+	rest, found := strings.CutPrefix(name, snapshotBackupPrefix)
+	ts, hex, found2 := strings.Cut(rest, "-")
+	if !found || !found2 || len(hex) != 16 {
+		return time.Time{}, 0, false
+	}
+	t, err := time.Parse(snapshotBackupTime, ts)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	if index, err = strconv.ParseUint(hex, 16, 64); err != nil {
+		return time.Time{}, 0, false
+	}
+	return t, index, true
+}
+
+// snapshotBackupNames returns the names of the backups in store, oldest
+// first. The other objects are left alone.
+func snapshotBackupNames(ctx context.Context, store objstore.ObjectStore) ([]string, error) {
+	objs, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, o := range objs {
+		if _, _, ok := parseSnapshotBackupName(o.Name); ok {
+			names = append(names, o.Name)
+		}
+	}
+	return names, nil
+}
+
+// restoreTarget is where a restore stops replaying the shipped WAL, from
+// --restore-to.
+type restoreTarget struct {
+	latest bool      // every shipped entry
+	index  uint64    // the entries up to this raft index
+	time   time.Time // the entries proposed up to this time
+}
+
+// parseRestoreTarget parses --restore-to: empty for the snapshot alone,
+// "latest", a raft index or an RFC 3339 time.
+func parseRestoreTarget(s string) (restoreTarget, error) {
+	switch {
+	case s == "":
+		return restoreTarget{}, nil
+	case s == snapshotRestoreLatest:
+		return restoreTarget{latest: true}, nil
+	}
+	if index, err := strconv.ParseUint(s, 10, 64); err == nil && index > 0 {
+		return restoreTarget{index: index}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return restoreTarget{}, fmt.Errorf("invalid --restore-to %q, want latest, a raft index or an RFC 3339 time", s)
+	}
+	return restoreTarget{time: t}, nil
+}
+
+// replays reports whether the shipped WAL is replayed.
+func (to restoreTarget) replays() bool {
+	return to.latest || to.index > 0 || !to.time.IsZero()
+}
+
+// admits reports whether the backup of time t at raft index is not past
+// the target.
+func (to restoreTarget) admits(t time.Time, index uint64) bool {
+	return (to.index == 0 || index <= to.index) && (to.time.IsZero() || !t.After(to.time))
+}
+
+// restoreSnapshotBackup creates the data directory of member id of a new
+// cluster of voters from the backup called name in store, the newest one
+// not past to for snapshotRestoreLatest, and returns the name restored.
+// If to replays the shipped WAL, its committed entries after the backup
+// are applied up to the target. Like `metcd bootstrap`, every member
+// starts from the resulting snapshot at index 1.
+func restoreSnapshotBackup(store objstore.ObjectStore, name string, to restoreTarget, dataDir string, id int, token string, voters []uint64, keyring *encryption.Keyring) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	if name == snapshotRestoreLatest {
+		names, err := snapshotBackupNames(ctx, store)
+		if err != nil {
+			return "", err
+		}
+		name = ""
+		for i := len(names) - 1; i >= 0 && name == ""; i-- {
+			if t, index, _ := parseSnapshotBackupName(names[i]); to.admits(t, index) {
+				name = names[i]
+			}
+		}
+		if name == "" {
+			return "", errors.New("no snapshot backed up before the --restore-to target")
+		}
+	}
+	backup, err := store.Get(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	data, err := openSnapshotBackup(backup)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	if to.replays() {
+		s := newOfflineKVStore(keyring)
+		if err := s.recoverFromSnapshot(data); err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		if to.index > 0 && s.raftIndex > to.index {
+			return "", fmt.Errorf("%s is at raft index %d, past the --restore-to target", name, s.raftIndex)
+		}
+		from := s.raftIndex
+		ents, err := shippedEntries(ctx, store, from)
+		if err != nil {
+			return "", err
+		}
+		n, err := s.replay(ents, to)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("snapshot restore: replayed %d entries of the shipped WAL after %s, from raft index %d to %d", n, name, from, s.raftIndex)
+		if data, err = s.getSnapshot(); err != nil {
+			return "", err
+		}
+	}
+	if data, err = restoredSnapshot(data); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	if data, err = atRest.Seal(data); err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(dataDir)
+	if err != nil {
+		return "", err
+	}
+	return name, raftnode.BootstrapDataDir(dir, id, token, voters, data)
+}
+
+// openSnapshotBackup returns the JSON snapshot of backup.
+func openSnapshotBackup(backup []byte) ([]byte, error) {
+	data, err := atRest.Open(backup)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = codec.Decode(data); err != nil {
+		return nil, fmt.Errorf("cannot decode the snapshot: %w", err)
+	}
+	return data, nil
+}
+
+// restoredSnapshot returns the snapshot of a new cluster from data: the
+// raft index of the old cluster is reset to the first entry of the new
+// log, whose entries would otherwise be skipped as applied.
+func restoredSnapshot(data []byte) ([]byte, error) {
+	var st storeSnapshot
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	st.RaftIndex = 1
+	return json.Marshal(st)
+}
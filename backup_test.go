@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"metcd/codec"
+	"metcd/objstore"
+	"metcd/raftnode"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
+	"go.uber.org/zap"
+)
+
+func TestSnapshotBackup(t *testing.T) {
+	gzip, err := codec.Get(codec.Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(c codec.Codec) { snapshotCodec = c }(snapshotCodec)
+	snapshotCodec = gzip
+
+	store, err := objstore.Open("file:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(context.Background(), "other", nil); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestKVStore(nil)
+	b := newSnapshotBackup(s, store, func() bool { return true }, time.Minute, 2)
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		s.apply(kv{Op: opPut, Key: "/a", Val: string(rune('1' + i))})
+		s.raftIndex = uint64(10 + i)
+		if err := b.backup(start.Add(time.Duration(i) * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := snapshotBackupNames(context.Background(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"metcd-snapshot-20261014T130000Z-000000000000000b", "metcd-snapshot-20261014T140000Z-000000000000000c"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected the newest 2 backups %v, got %v", want, names)
+	}
+	if _, err := store.Get(context.Background(), "other"); err != nil {
+		t.Fatalf("expected the other objects to be kept, got %v", err)
+	}
+
+	dir := t.TempDir()
+	name, err := restoreSnapshotBackup(store, snapshotRestoreLatest, restoreTarget{}, dir, 1, "", []uint64{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != names[1] {
+		t.Fatalf("expected the latest backup %s restored, got %s", names[1], name)
+	}
+	if _, err := restoreSnapshotBackup(store, name, restoreTarget{}, dir, 1, "", []uint64{1}, nil); err == nil {
+		t.Fatal("expected restoring over a data directory to fail")
+	}
+	snapshot, err := snap.New(zap.NewNop(), filepath.Join(dir, raftnode.SnapDir(1))).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st storeSnapshot
+	if err := json.Unmarshal(snapshot.Data, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.RaftIndex != 1 || st.KVs["/a"] != "3" || st.Rev != 3 {
+		t.Fatalf("expected the keys of the latest backup at raft index 1, got %+v", st)
+	}
+
+	if _, err := restoreSnapshotBackup(store, "nosuch", restoreTarget{}, t.TempDir(), 1, "", []uint64{1}, nil); err == nil {
+		t.Fatal("expected restoring a missing backup to fail")
+	}
+}
+
+func TestParseRestoreTarget(t *testing.T) {
+	at := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	for in, want := range map[string]restoreTarget{
+		"":                     {},
+		"latest":               {latest: true},
+		"42":                   {index: 42},
+		"2026-10-14T12:00:00Z": {time: at},
+	} {
+		got, err := parseRestoreTarget(in)
+		if err != nil || !got.time.Equal(want.time) || got.index != want.index || got.latest != want.latest {
+			t.Errorf("%q: expected %+v, got %+v (%v)", in, want, got, err)
+		}
+	}
+	for _, in := range []string{"0", "yesterday", "2026-10-14"} {
+		if _, err := parseRestoreTarget(in); err == nil {
+			t.Errorf("expected %q to be refused", in)
+		}
+	}
+}
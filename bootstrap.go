@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"metcd/api"
+	"metcd/encryption"
+	"metcd/raftnode"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestConfigFile is the configuration file bootstrap writes into the
+// data directory of each member.
+const manifestConfigFile = "metcd.json"
+
+// manifest describes a whole cluster for `metcd bootstrap`.
+type manifest struct {
+	// Token is the --initial-cluster-token of the cluster.
+	Token string `json:"token"`
+	// DataDir holds the data directories of the members without one,
+	// member-<id>; the current directory by default.
+	DataDir string `json:"dataDir"`
+	// Options are configuration file options of every member.
+	Options   map[string]interface{} `json:"options"`
+	Members   []manifestMember       `json:"members"`
+	Keyspaces []manifestKeyspace     `json:"keyspaces"`
+	Keys      []manifestKey          `json:"keys"`
+
+	// metcd serves plain HTTP without users; manifests configuring them
+	// are refused rather than bootstrapping an unprotected cluster.
+	TLS   json.RawMessage `json:"tls"`
+	Users json.RawMessage `json:"users"`
+}
+
+type manifestMember struct {
+	ID      int    `json:"id"`
+	PeerURL string `json:"peerURL"`
+	Port    int    `json:"port"`
+	DataDir string `json:"dataDir"`
+	// Options override the options of the manifest for this member.
+	Options map[string]interface{} `json:"options"`
+}
+
+type manifestKeyspace struct {
+	Name  string `json:"name"`
+	Quota int64  `json:"quota,omitempty"`
+}
+
+// manifestKey is a key seeded into the keyspace called Keyspace, the
+// default one if empty.
+type manifestKey struct {
+	Keyspace string `json:"keyspace,omitempty"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+}
+
+// manifestOptions are set by bootstrap from the manifest, not by options.
+var manifestOptions = []string{"id", "cluster", "port", "data-dir", "initial-cluster-token", "initial-cluster-state", "join", "join-endpoint", configFileFlag}
+
+// bootstrap implements `metcd bootstrap --manifest cluster.json`: it
+// creates the data directories of the members of the manifest, or of
+// --member only, starting from a snapshot of the seeded keys, and writes
+// their configuration files. Every member started with its configuration
+// file then joins the same cluster with the same keys.
+func bootstrap(args []string) error {
+	fset := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	path := fset.String("manifest", "", "JSON manifest of the members, options and seeded keys of the cluster")
+	member := fset.Int("member", 0, "bootstrap only this member, on its host; all of them by default")
+	fset.Parse(args)
+	if *path == "" {
+		return errors.New("bootstrap needs --manifest")
+	}
+	m, err := readManifest(*path)
+	if err != nil {
+		return err
+	}
+	members := m.Members
+	if *member != 0 {
+		members = nil
+		for _, mm := range m.Members {
+			if mm.ID == *member {
+				members = append(members, mm)
+			}
+		}
+		if members == nil {
+			return fmt.Errorf("%s: no member %d", *path, *member)
+		}
+	}
+	data, err := seedSnapshot(m)
+	if err != nil {
+		return err
+	}
+	var voters []uint64
+	for _, mm := range m.Members {
+		voters = append(voters, uint64(mm.ID))
+	}
+	for _, mm := range members {
+		dir, err := filepath.Abs(m.memberDir(mm))
+		if err != nil {
+			return err
+		}
+		if err := raftnode.BootstrapDataDir(dir, mm.ID, m.Token, voters, data); err != nil {
+			return fmt.Errorf("member %d: %v", mm.ID, err)
+		}
+		config, err := json.MarshalIndent(m.config(mm, dir), "", "  ")
+		if err != nil {
+			return err
+		}
+		configPath := filepath.Join(dir, manifestConfigFile)
+		if err := os.WriteFile(configPath, append(config, '\n'), 0640); err != nil {
+			return err
+		}
+		log.Printf("bootstrapped member %d in %s, start it with: metcd --config-file %s", mm.ID, dir, configPath)
+	}
+	return nil
+}
+
+// readManifest reads and validates the manifest at path.
+func readManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %v (the manifest is JSON)", path, err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &m, nil
+}
+
+func (m *manifest) validate() error {
+	switch {
+	case len(m.TLS) > 0 && string(m.TLS) != "null":
+		return errors.New("tls: metcd serves plain HTTP, terminate TLS in front of it")
+	case len(m.Users) > 0 && string(m.Users) != "null":
+		return errors.New("users: metcd has no users to seed")
+	case len(m.Members) == 0:
+		return errors.New("no members")
+	}
+	ids := make(map[int]bool)
+	for _, mm := range m.Members {
+		if mm.ID < 1 || ids[mm.ID] {
+			return fmt.Errorf("member IDs must be unique and positive, got %d", mm.ID)
+		}
+		ids[mm.ID] = true
+		if u, err := url.Parse(mm.PeerURL); err != nil || u.Host == "" {
+			return fmt.Errorf("member %d: invalid peerURL %q", mm.ID, mm.PeerURL)
+		}
+		if mm.Port <= 0 {
+			return fmt.Errorf("member %d: no port", mm.ID)
+		}
+	}
+	for _, opts := range append([]map[string]interface{}{m.Options}, memberOptions(m.Members)...) {
+		for _, name := range manifestOptions {
+			if _, ok := opts[name]; ok {
+				return fmt.Errorf("option %q is set from the members of the manifest", name)
+			}
+		}
+	}
+	spaces := map[string]bool{"": true}
+	for _, ks := range m.Keyspaces {
+		if !keyspaceName.MatchString(ks.Name) || spaces[ks.Name] {
+			return fmt.Errorf("invalid or duplicate keyspace %q", ks.Name)
+		}
+		spaces[ks.Name] = true
+	}
+	for _, k := range m.Keys {
+		if !spaces[k.Keyspace] {
+			return fmt.Errorf("key %q: keyspace %q is not in keyspaces", k.Key, k.Keyspace)
+		}
+	}
+	return nil
+}
+
+func memberOptions(members []manifestMember) []map[string]interface{} {
+	opts := make([]map[string]interface{}, len(members))
+	for i, mm := range members {
+		opts[i] = mm.Options
+	}
+	return opts
+}
+
+func (m *manifest) memberDir(mm manifestMember) string {
+	if mm.DataDir != "" {
+		return mm.DataDir
+	}
+	return filepath.Join(m.DataDir, fmt.Sprintf("member-%d", mm.ID))
+}
+
+// config returns the configuration file of member mm, whose data directory
+// is dir.
+func (m *manifest) config(mm manifestMember, dir string) map[string]interface{} {
+	config := make(map[string]interface{})
+	for k, v := range m.Options {
+		config[k] = v
+	}
+	for k, v := range mm.Options {
+		config[k] = v
+	}
+	// --cluster lists the peer URLs by member ID, from 1
+	members := append([]manifestMember(nil), m.Members...)
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	peers := make([]string, members[len(members)-1].ID)
+	for _, p := range members {
+		peers[p.ID-1] = p.PeerURL
+	}
+	config["id"] = mm.ID
+	config["cluster"] = strings.Join(peers, ",")
+	config["port"] = mm.Port
+	config["data-dir"] = dir
+	if m.Token != "" {
+		config["initial-cluster-token"] = m.Token
+	}
+	return config
+}
+
+// seedSnapshot returns the snapshot the members of m start from: the
+// keyspaces of m and its keys, each keyspace written in one revision.
+func seedSnapshot(m *manifest) ([]byte, error) {
+	keyring, err := encryption.NewKeyring(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := newOfflineKVStore(keyring)
+	for _, ks := range m.Keyspaces {
+		if res := s.apply(kv{Op: opKeyspacePut, Keyspace: ks.Name, Quota: ks.Quota}); res.err != nil {
+			return nil, fmt.Errorf("keyspace %q: %v", ks.Name, res.err)
+		}
+	}
+	ops := make(map[string][]api.Op)
+	for _, k := range m.Keys {
+		ops[k.Keyspace] = append(ops[k.Keyspace], api.Op{Type: api.OpPut, Key: k.Key, Value: k.Value})
+	}
+	for name, ops := range ops {
+		r := kv{Op: opTxn, Keyspace: name, Txn: &api.TxnRequest{Success: ops}}
+		if err := s.sealProposal(&r); err != nil {
+			return nil, err
+		}
+		if res := s.apply(r); res.err != nil {
+			return nil, fmt.Errorf("keyspace %q: %v", name, res.err)
+		}
+	}
+	// the snapshot is the first entry of the log
+	s.raftIndex = 1
+	return s.getSnapshot()
+}
+
+// newOfflineKVStore returns a store applying proposals outside of raft, to
+// build the snapshot the members of a new cluster start from.
+func newOfflineKVStore(keyring *encryption.Keyring) *kvstore {
+	return &kvstore{
+		keyspace:   newKeyspace(nil),
+		keyspaces:  make(map[string]*keyspace),
+		alarms:     make(map[api.Alarm]struct{}),
+		observers:  make(map[uint64]struct{}),
+		webhooks:   make(map[string]api.Webhook),
+		redactions: make(map[api.Redaction]struct{}),
+		keyring:    keyring,
+	}
+}
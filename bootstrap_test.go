@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeManifest(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "cluster.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBootstrap(t *testing.T) {
+	dir := t.TempDir()
+	path := writeManifest(t, `{
+		"token": "prod",
+		"dataDir": "`+dir+`",
+		"options": {"wal-sync": "interval"},
+		"members": [
+			{"id": 1, "peerURL": "http://10.0.0.1:2380", "port": 2379},
+			{"id": 3, "peerURL": "http://10.0.0.3:2380", "port": 2379, "options": {"wal-sync": "always"}}
+		],
+		"keyspaces": [{"name": "app", "quota": 1024}],
+		"keys": [{"key": "/config", "value": "v"}, {"keyspace": "app", "key": "/a", "value": "1"}]
+	}`)
+	if err := bootstrap([]string{"--manifest", path}); err != nil {
+		t.Fatal(err)
+	}
+	values, err := readConfigFile(filepath.Join(dir, "member-3", manifestConfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"id":                    "3",
+		"cluster":               "http://10.0.0.1:2380,,http://10.0.0.3:2380",
+		"port":                  "2379",
+		"data-dir":              filepath.Join(dir, "member-3"),
+		"initial-cluster-token": "prod",
+		"wal-sync":              "always",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("expected %v, got %v", want, values)
+	}
+	if err := bootstrap([]string{"--manifest", path, "--member", "1"}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected bootstrapping a member twice to fail, got %v", err)
+	}
+}
+
+func TestSeedSnapshot(t *testing.T) {
+	m, err := readManifest(writeManifest(t, `{
+		"members": [{"id": 1, "peerURL": "http://127.0.0.1:2380", "port": 2379}],
+		"keyspaces": [{"name": "app"}],
+		"keys": [{"key": "/a", "value": "1"}, {"key": "/b", "value": "2"}, {"keyspace": "app", "key": "/x", "value": "y"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := seedSnapshot(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestKVStore(nil)
+	if err := s.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Lookup("/b"); v != "2" || s.Rev() != 1 {
+		t.Fatalf("expected /b = 2 at revision 1, got %q at %d", v, s.Rev())
+	}
+	if v, _, _ := s.LookupIn("app", "/x"); v != "y" {
+		t.Fatalf("expected /x = y in app, got %q", v)
+	}
+}
+
+func TestReadManifestInvalid(t *testing.T) {
+	member := `"members": [{"id": 1, "peerURL": "http://127.0.0.1:2380", "port": 2379}]`
+	for _, data := range []string{
+		`members: []`,
+		`{"members": []}`,
+		`{"unknown": 1, ` + member + `}`,
+		`{"members": [{"id": 1, "peerURL": "x", "port": 2379}]}`,
+		`{"members": [{"id": 1, "peerURL": "http://a:1", "port": 1}, {"id": 1, "peerURL": "http://b:1", "port": 1}]}`,
+		`{"options": {"id": 2}, ` + member + `}`,
+		`{"tls": {"cert": "a.pem"}, ` + member + `}`,
+		`{"users": [{"name": "root"}], ` + member + `}`,
+		`{"keys": [{"keyspace": "missing", "key": "/a"}], ` + member + `}`,
+	} {
+		if _, err := readManifest(writeManifest(t, data)); err == nil {
+			t.Errorf("expected an error for %s", data)
+		}
+	}
+}
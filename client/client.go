@@ -0,0 +1,896 @@
+// Package client is a Go client for the metcd HTTP API.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"metcd/api"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrKeyNotFound = errors.New("client: key not found")
+	// ErrKeyspaceNotFound is returned by calls made WithKeyspace of a
+	// keyspace that does not exist.
+	ErrKeyspaceNotFound = errors.New("client: keyspace not found")
+	ErrNoEndpoints      = errors.New("client: no endpoints available")
+	// ErrCompacted is returned by a watch made WithSince of a revision
+	// whose following events are no longer kept, and by a page of History
+	// whose changes are not.
+	ErrCompacted = errors.New("client: revision compacted")
+	// ErrPreconditionFailed is returned by a Put or a Delete made
+	// WithIfMatch of a key changed since, or missing.
+	ErrPreconditionFailed = errors.New("client: precondition failed")
+)
+
+// Config configures a Client.
+type Config struct {
+	// Endpoints are the client URLs of the cluster members, e.g.
+	// http://127.0.0.1:12380. They are tried in order.
+	Endpoints []string
+	// TLS is used for https endpoints. Nil means the system defaults.
+	TLS *tls.Config
+	// DialTimeout bounds establishing a connection to a single endpoint.
+	DialTimeout time.Duration
+	// OnWarning, if set, is called with the warnings the server attaches to
+	// a response, e.g. about a membership change leaving an even number of
+	// voters.
+	OnWarning func(warning string)
+	// Hooks, if set, observe every call, see the metrics package for a
+	// Prometheus collector.
+	Hooks Hooks
+}
+
+// Client talks to a metcd cluster. It is safe for concurrent use.
+type Client struct {
+	endpoints []*url.URL
+	hc        *http.Client
+	onWarning func(string)
+	hooks     Hooks
+
+	lastMu       sync.Mutex
+	lastEndpoint string // endpoint that served the previous call
+}
+
+// New creates a client for the endpoints in cfg.
+func New(cfg Config) (*Client, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	c := &Client{onWarning: cfg.OnWarning, hooks: cfg.Hooks}
+	if c.hooks == nil {
+		c.hooks = NopHooks{}
+	}
+	for _, ep := range cfg.Endpoints {
+		u, err := url.Parse(ep)
+		if err != nil {
+			return nil, fmt.Errorf("client: invalid endpoint %q (%v)", ep, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("client: invalid endpoint %q", ep)
+		}
+		c.endpoints = append(c.endpoints, u)
+	}
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+	c.hc = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			DialContext:     dialer.DialContext,
+			TLSClientConfig: cfg.TLS,
+		},
+	}
+	return c, nil
+}
+
+// Close releases idle connections held by the client.
+func (c *Client) Close() error {
+	c.hc.CloseIdleConnections()
+	return nil
+}
+
+// Get returns the value of key. It returns ErrKeyNotFound if key does not exist.
+func (c *Client) Get(ctx context.Context, key string, opts ...CallOption) (string, error) {
+	kv, err := c.GetKV(ctx, key, opts...)
+	if err != nil {
+		return "", err
+	}
+	return kv.Value, nil
+}
+
+// GetKV returns the value of key with its metadata: the revisions it was
+// created and last changed at, its version and the time of its last change.
+func (c *Client) GetKV(ctx context.Context, key string, opts ...CallOption) (*api.KeyValue, error) {
+	resp, err := c.do(ctx, http.MethodGet, keyPath("/kv", key), nil, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, notFound(resp)
+	}
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	v, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	kv := &api.KeyValue{Key: key, Value: string(v)}
+	kv.CreateRevision, _ = strconv.ParseInt(resp.Header.Get("X-Metcd-Create-Revision"), 10, 64)
+	kv.ModRevision, _ = strconv.ParseInt(resp.Header.Get("X-Metcd-Mod-Revision"), 10, 64)
+	kv.Version, _ = strconv.ParseInt(resp.Header.Get("X-Metcd-Version"), 10, 64)
+	if t, err := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Metcd-Mod-Time")); err == nil {
+		kv.ModTime = &t
+	}
+	return kv, nil
+}
+
+// Put sets key to value.
+func (c *Client) Put(ctx context.Context, key, value string, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodPut, keyPath("/kv", key), nil, []byte(value), opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return ErrPreconditionFailed
+	}
+	return checkStatus(resp)
+}
+
+// Append appends value to the value of key, creating key if it does not
+// exist. The value is computed by the cluster, concurrent appends all take
+// effect.
+func (c *Client) Append(ctx context.Context, key, value string, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodPatch, keyPath("/kv", key), url.Values{"append": {"true"}}, []byte(value), opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
+
+// Patch merges the JSON merge patch (RFC 7396) into the value of key, a
+// missing key being null. Like Append it is computed by the cluster.
+func (c *Client) Patch(ctx context.Context, key string, patch []byte, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodPatch, keyPath("/kv", key), nil, patch, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
+
+// Delete removes key. It returns ErrKeyNotFound if key does not exist.
+func (c *Client) Delete(ctx context.Context, key string, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodDelete, keyPath("/kv", key), nil, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return notFound(resp)
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return ErrPreconditionFailed
+	}
+	return checkStatus(resp)
+}
+
+// Txn executes txn atomically.
+func (c *Client) Txn(ctx context.Context, txn *api.TxnRequest, opts ...CallOption) (*api.TxnResponse, error) {
+	var out api.TxnResponse
+	if err := c.doJSON(ctx, http.MethodPost, "/txn", txn, &out, opts); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Watch streams changes of key, or of every key with that prefix, until ctx
+// is done. The returned channel is closed when the stream ends. A watch made
+// WithSince the ModRevision of the last event received minus one resumes
+// it, with the events of that revision again, since a transaction changing
+// several keys is as many events of one revision.
+func (c *Client) Watch(ctx context.Context, key string, prefix bool, opts ...CallOption) (<-chan api.Event, error) {
+	var query url.Values
+	if prefix {
+		query = url.Values{"prefix": {"true"}}
+	}
+	resp, err := c.do(ctx, http.MethodGet, keyPath("/watch", key), query, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, ErrCompacted
+	}
+	if err := checkStatus(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	ch := make(chan api.Event)
+	go func() {
+		defer close(ch)
+		defer resp.Body.Close()
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			var ev api.Event
+			if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+				return
+			}
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// History returns the changes of key the member c sends the request to
+// still keeps, oldest first, with their values and times. WithLimit and
+// WithContinue list them a page at a time; a page whose changes are no
+// longer kept fails with ErrCompacted.
+func (c *Client) History(ctx context.Context, key string, opts ...CallOption) (*api.HistoryResponse, error) {
+	resp, err := c.do(ctx, http.MethodGet, keyPath("/history", key), nil, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return nil, ErrCompacted
+	}
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	var out api.HistoryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Move renames req.From to req.To, or every key with the prefix req.From
+// if req.Prefix is set, atomically. It returns ErrKeyNotFound if there is
+// nothing to move and a *StatusError of code 409 if a destination exists
+// and req.Overwrite is not set.
+func (c *Client) Move(ctx context.Context, req api.MoveRequest, opts ...CallOption) (*api.MoveResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/move", nil, body, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, notFound(resp)
+	}
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	var out api.MoveResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// MemberList returns the members of the cluster.
+func (c *Client) MemberList(ctx context.Context, opts ...CallOption) ([]api.Member, error) {
+	var members []api.Member
+	if err := c.doJSON(ctx, http.MethodGet, "/cluster/members", nil, &members, opts); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// MemberAdd proposes adding member id reachable at peerURL.
+func (c *Client) MemberAdd(ctx context.Context, id uint64, peerURL string, opts ...CallOption) error {
+	return c.doJSON(ctx, http.MethodPost, "/cluster/members", api.MemberAddRequest{ID: id, PeerURL: peerURL}, nil, opts)
+}
+
+// MemberAddLearner proposes adding member id as a non-voting learner.
+func (c *Client) MemberAddLearner(ctx context.Context, id uint64, peerURL string, opts ...CallOption) error {
+	return c.doJSON(ctx, http.MethodPost, "/cluster/members", api.MemberAddRequest{ID: id, PeerURL: peerURL, IsLearner: true}, nil, opts)
+}
+
+// MemberAddObserver proposes adding member id as an observer, a learner
+// that is never promoted.
+func (c *Client) MemberAddObserver(ctx context.Context, id uint64, peerURL string, opts ...CallOption) error {
+	return c.doJSON(ctx, http.MethodPost, "/cluster/members", api.MemberAddRequest{ID: id, PeerURL: peerURL, IsObserver: true}, nil, opts)
+}
+
+// MemberPromote proposes promoting learner id to a voter.
+func (c *Client) MemberPromote(ctx context.Context, id uint64, opts ...CallOption) error {
+	return c.doJSON(ctx, http.MethodPost, "/cluster/members/"+strconv.FormatUint(id, 10)+"/promote", nil, nil, opts)
+}
+
+// Decommission moves the leadership away from member id if it leads,
+// removes it and waits for the removal to commit.
+func (c *Client) Decommission(ctx context.Context, id uint64, opts ...CallOption) (*api.DecommissionResult, error) {
+	var res api.DecommissionResult
+	if err := c.doJSON(ctx, http.MethodPost, "/admin/decommission/"+strconv.FormatUint(id, 10), nil, &res, opts); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// MemberUpdate proposes moving member id to peerURL.
+func (c *Client) MemberUpdate(ctx context.Context, id uint64, peerURL string, opts ...CallOption) error {
+	return c.doJSON(ctx, http.MethodPatch, "/cluster/members/"+strconv.FormatUint(id, 10), api.MemberUpdateRequest{PeerURL: peerURL}, nil, opts)
+}
+
+// Health returns the health of the first reachable endpoint. An unhealthy
+// member is reported through Health.Health, not as an error.
+func (c *Client) Health(ctx context.Context, opts ...CallOption) (*api.Health, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/health", nil, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, checkStatus(resp)
+	}
+	var h api.Health
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// MemberRemove proposes removing member id.
+func (c *Client) MemberRemove(ctx context.Context, id uint64, opts ...CallOption) error {
+	return c.doJSON(ctx, http.MethodDelete, "/cluster/members/"+strconv.FormatUint(id, 10), nil, nil, opts)
+}
+
+// AlarmList returns the active alarms.
+func (c *Client) AlarmList(ctx context.Context, opts ...CallOption) ([]api.Alarm, error) {
+	var alarms []api.Alarm
+	if err := c.doJSON(ctx, http.MethodGet, "/alarms", nil, &alarms, opts); err != nil {
+		return nil, err
+	}
+	return alarms, nil
+}
+
+// AlarmDisarm deactivates the alarms of memberID (0 for every member) of
+// type alarm (empty for every type).
+func (c *Client) AlarmDisarm(ctx context.Context, memberID uint64, alarm api.AlarmType, opts ...CallOption) error {
+	req := api.AlarmRequest{Action: api.AlarmDeactivate, MemberID: memberID, Alarm: alarm}
+	return c.doJSON(ctx, http.MethodPost, "/alarms", req, nil, opts)
+}
+
+// KeyspaceList returns the keyspaces, the default one first.
+func (c *Client) KeyspaceList(ctx context.Context, opts ...CallOption) ([]api.Keyspace, error) {
+	var spaces []api.Keyspace
+	if err := c.doJSON(ctx, http.MethodGet, "/keyspaces", nil, &spaces, opts); err != nil {
+		return nil, err
+	}
+	return spaces, nil
+}
+
+// KeyspacePut creates the keyspace called name, or changes its quota in
+// bytes (0 is unlimited) if it exists.
+func (c *Client) KeyspacePut(ctx context.Context, name string, quota int64, opts ...CallOption) error {
+	return c.doJSON(ctx, http.MethodPut, "/keyspaces/"+url.PathEscape(name), api.KeyspaceRequest{Quota: quota}, nil, opts)
+}
+
+// KeyspaceDelete deletes the keyspace called name with all its keys.
+func (c *Client) KeyspaceDelete(ctx context.Context, name string, opts ...CallOption) error {
+	return c.doJSON(ctx, http.MethodDelete, "/keyspaces/"+url.PathEscape(name), nil, nil, opts)
+}
+
+// WebhookList returns the webhooks, without their authorization.
+func (c *Client) WebhookList(ctx context.Context, opts ...CallOption) ([]api.Webhook, error) {
+	var hooks []api.Webhook
+	if err := c.doJSON(ctx, http.MethodGet, "/webhooks", nil, &hooks, opts); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// WebhookPut registers wh, replacing the webhook with its ID.
+func (c *Client) WebhookPut(ctx context.Context, wh api.Webhook, opts ...CallOption) error {
+	return c.doJSON(ctx, http.MethodPut, "/webhooks/"+url.PathEscape(wh.ID), wh, nil, opts)
+}
+
+// WebhookDelete removes the webhook id.
+func (c *Client) WebhookDelete(ctx context.Context, id string, opts ...CallOption) error {
+	return c.doJSON(ctx, http.MethodDelete, "/webhooks/"+url.PathEscape(id), nil, nil, opts)
+}
+
+// Defrag snapshots the first reachable endpoint and removes the WAL
+// segments and snapshot files it no longer needs. Only that member is
+// affected.
+func (c *Client) Defrag(ctx context.Context, opts ...CallOption) (*api.DefragResponse, error) {
+	var out api.DefragResponse
+	if err := c.doJSON(ctx, http.MethodPost, "/admin/defrag", nil, &out, opts); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Snapshot returns a consistent copy of the store. The caller must close it.
+func (c *Client) Snapshot(ctx context.Context, opts ...CallOption) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/snapshot", nil, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStatus(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Export formats, see Export.
+const (
+	ExportJSON  = "json"
+	ExportProto = "proto"
+)
+
+// Export streams the keys and values of a keyspace at a linearizable
+// revision, which it returns. With ExportJSON every line is an api.KeyValue,
+// with ExportProto the stream is a sequence of etcd mvccpb.KeyValue
+// messages, each preceded by its size as a varint. The caller must close
+// the stream.
+func (c *Client) Export(ctx context.Context, format string, opts ...CallOption) (io.ReadCloser, int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/snapshot", url.Values{"format": {format}}, nil, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkStatus(resp); err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+	rev, _ := strconv.ParseInt(resp.Header.Get("X-Metcd-Revision"), 10, 64)
+	return resp.Body, rev, nil
+}
+
+// Import puts the keys and values read from r, in an Export format, into a
+// keyspace. The server imports them in batches and progress, if not nil,
+// is called after each one. Import returns the progress of the last batch;
+// if it fails, the keys imported until then stay in the store.
+func (c *Client) Import(ctx context.Context, r io.Reader, format string, progress func(api.ImportProgress), opts ...CallOption) (*api.ImportProgress, error) {
+	resp, err := c.doStream(ctx, http.MethodPost, "/admin/import", url.Values{"format": {format}}, r, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(resp.Body)
+	var p api.ImportProgress
+	for {
+		if err := dec.Decode(&p); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return &p, err
+		}
+		switch {
+		case p.Error != "":
+			return &p, fmt.Errorf("client: import failed: %s", p.Error)
+		case p.Done:
+			return &p, nil
+		case progress != nil:
+			progress(p)
+		}
+	}
+}
+
+// Verify sends the keys of a keyspace with the hashes of their values, at a
+// single revision, to the verifier at verifierURL, which the server posts
+// them to. It fails if the verifier does not accept them.
+func (c *Client) Verify(ctx context.Context, verifierURL string, opts ...CallOption) (*api.VerifyResponse, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/admin/verify", url.Values{"url": {verifierURL}}, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	var out api.VerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// EncryptionList returns the encrypted prefixes of a keyspace with the
+// current version of their data key.
+func (c *Client) EncryptionList(ctx context.Context, opts ...CallOption) ([]api.EncryptionKey, error) {
+	var keys []api.EncryptionKey
+	if err := c.doJSON(ctx, http.MethodGet, "/admin/encryption", nil, &keys, opts); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// EncryptionRotate creates the data key of prefix, or its next version, so
+// the values written under prefix from then on are encrypted with it. The
+// server needs a master key.
+func (c *Client) EncryptionRotate(ctx context.Context, prefix string, opts ...CallOption) (*api.EncryptionKey, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/admin/encryption", url.Values{"prefix": {prefix}}, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	var out api.EncryptionKey
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// EncryptionDestroy destroys every version of the data key of prefix and
+// deletes the values encrypted with it.
+func (c *Client) EncryptionDestroy(ctx context.Context, prefix string, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/admin/encryption", url.Values{"prefix": {prefix}}, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
+
+// RedactionList returns the prefixes of a keyspace whose values GET
+// /snapshot redacts.
+func (c *Client) RedactionList(ctx context.Context, opts ...CallOption) ([]api.Redaction, error) {
+	var rds []api.Redaction
+	if err := c.doJSON(ctx, http.MethodGet, "/admin/redaction", nil, &rds, opts); err != nil {
+		return nil, err
+	}
+	return rds, nil
+}
+
+// RedactionPut redacts the values under prefix from the snapshots and
+// exports.
+func (c *Client) RedactionPut(ctx context.Context, prefix string, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodPut, "/admin/redaction", url.Values{"prefix": {prefix}}, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
+
+// RedactionDelete stops redacting prefix.
+func (c *Client) RedactionDelete(ctx context.Context, prefix string, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/admin/redaction", url.Values{"prefix": {prefix}}, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
+
+// RetentionList returns the prefixes of a keyspace whose deleted keys are
+// kept as tombstones.
+func (c *Client) RetentionList(ctx context.Context, opts ...CallOption) ([]api.Retention, error) {
+	var rts []api.Retention
+	if err := c.doJSON(ctx, http.MethodGet, "/admin/retention", nil, &rts, opts); err != nil {
+		return nil, err
+	}
+	return rts, nil
+}
+
+// RetentionPut keeps the keys deleted under prefix as tombstones until the
+// history is compacted past their deletion.
+func (c *Client) RetentionPut(ctx context.Context, prefix string, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodPut, "/admin/retention", url.Values{"prefix": {prefix}}, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
+
+// RetentionDelete stops retaining prefix and drops its tombstones.
+func (c *Client) RetentionDelete(ctx context.Context, prefix string, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/admin/retention", url.Values{"prefix": {prefix}}, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
+
+// Tombstones returns the tombstones of the deleted keys with prefix.
+func (c *Client) Tombstones(ctx context.Context, prefix string, opts ...CallOption) ([]api.Tombstone, error) {
+	var ts []api.Tombstone
+	if err := c.doJSON(ctx, http.MethodGet, keyPath("/tombstones", prefix), nil, &ts, opts); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// Undelete restores the deleted key with its last value and returns the
+// revision it is restored at. It returns ErrKeyNotFound if key has no
+// tombstone.
+func (c *Client) Undelete(ctx context.Context, key string, opts ...CallOption) (int64, error) {
+	resp, err := c.do(ctx, http.MethodPost, keyPath("/tombstones", key), nil, nil, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, notFound(resp)
+	}
+	if err := checkStatus(resp); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(resp.Header.Get("X-Metcd-Revision"), 10, 64)
+}
+
+// SchemaList returns the JSON Schemas the values of a keyspace are
+// validated against, by prefix.
+func (c *Client) SchemaList(ctx context.Context, opts ...CallOption) ([]api.Schema, error) {
+	var schemas []api.Schema
+	if err := c.doJSON(ctx, http.MethodGet, "/admin/schema", nil, &schemas, opts); err != nil {
+		return nil, err
+	}
+	return schemas, nil
+}
+
+// SchemaPut makes the values written under prefix be validated against the
+// JSON Schema doc. The writes of values that do not match it fail with a
+// *StatusError of code 422.
+func (c *Client) SchemaPut(ctx context.Context, prefix string, doc []byte, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodPut, "/admin/schema", url.Values{"prefix": {prefix}}, doc, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
+
+// SchemaDelete stops validating the values under prefix.
+func (c *Client) SchemaDelete(ctx context.Context, prefix string, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/admin/schema", url.Values{"prefix": {prefix}}, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
+
+// TransformList returns the transformers attached to the prefixes of a
+// keyspace.
+func (c *Client) TransformList(ctx context.Context, opts ...CallOption) ([]api.Transform, error) {
+	var ts []api.Transform
+	if err := c.doJSON(ctx, http.MethodGet, "/admin/transform", nil, &ts, opts); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// TransformPut attaches the transformer called name to prefix, replacing
+// the one attached to it.
+func (c *Client) TransformPut(ctx context.Context, prefix, name string, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodPut, "/admin/transform", url.Values{"prefix": {prefix}, "name": {name}}, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
+
+// TransformDelete detaches the transformer of prefix.
+func (c *Client) TransformDelete(ctx context.Context, prefix string, opts ...CallOption) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/admin/transform", url.Values{"prefix": {prefix}}, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp)
+}
+
+// HotKeys returns the keys the member c sends the request to accessed most,
+// or with depth the prefixes of that many path segments, sorted by all
+// accesses.
+func (c *Client) HotKeys(ctx context.Context, depth int, opts ...CallOption) ([]api.HotKey, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/admin/hotkeys", url.Values{"depth": {strconv.Itoa(depth)}}, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	var keys []api.HotKey
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Stats returns the number and size of the keys and the watchers of the
+// member c sends the request to, by keyspace and top-level prefix.
+// WithLimit caps the prefixes listed of each keyspace, 100 by default.
+func (c *Client) Stats(ctx context.Context, opts ...CallOption) (*api.Stats, error) {
+	var st api.Stats
+	if err := c.doJSON(ctx, http.MethodGet, "/admin/stats", nil, &st, opts); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// doJSON sends in (if not nil) as a JSON body and decodes the response into
+// out (if not nil).
+func (c *Client) doJSON(ctx context.Context, method, path string, in, out interface{}, opts []CallOption) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	resp, err := c.do(ctx, method, path, nil, body, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// do sends the request to the first endpoint that accepts the connection.
+// The context of the call is released when the response body is closed.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte, opts []CallOption) (*http.Response, error) {
+	return c.doStream(ctx, method, path, query, bytes.NewReader(body), opts)
+}
+
+// doStream is do with a body read while it is sent. A body that is not an
+// io.Seeker is sent to the next endpoint only while none of it was read.
+func (c *Client) doStream(ctx context.Context, method, path string, query url.Values, body io.Reader, opts []CallOption) (*http.Response, error) {
+	o := newCallOptions(opts)
+	seeker, _ := body.(io.Seeker)
+	var sent *readCounter
+	if seeker == nil {
+		sent = &readCounter{r: body}
+		body = sent
+	}
+	ctx, cancel := o.context(ctx)
+	query = o.query(query)
+	info := RequestInfo{Method: method, Path: path, Route: route(path)}
+	start := time.Now()
+	c.hooks.RequestStart(ctx, info)
+	var lastErr error = ErrNoEndpoints
+	attempts := 0
+	for i, ep := range c.endpoints {
+		if i > 0 {
+			if sent != nil && sent.n > 0 {
+				break
+			}
+			c.hooks.Retry(ctx, info, i+1, lastErr)
+		}
+		if seeker != nil {
+			seeker.Seek(0, io.SeekStart)
+		}
+		u := *ep
+		u.Path = strings.TrimSuffix(u.Path, "/") + path
+		u.RawQuery = query.Encode()
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		o.header(req.Header)
+		attempts++
+		resp, err := c.hc.Do(req)
+		if err == nil {
+			c.served(ctx, ep.String())
+			c.hooks.RequestEnd(ctx, info, RequestResult{Endpoint: ep.String(), StatusCode: resp.StatusCode, Attempts: i + 1, Duration: time.Since(start)})
+			c.warn(resp)
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			cancel()
+			c.hooks.RequestEnd(ctx, info, RequestResult{Err: ctx.Err(), Attempts: i + 1, Duration: time.Since(start)})
+			return nil, ctx.Err()
+		}
+		lastErr = err
+	}
+	cancel()
+	c.hooks.RequestEnd(ctx, info, RequestResult{Err: lastErr, Attempts: attempts, Duration: time.Since(start)})
+	return nil, lastErr
+}
+
+type readCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (r *readCounter) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// served records that endpoint served a call and reports a switch.
+func (c *Client) served(ctx context.Context, endpoint string) {
+	c.lastMu.Lock()
+	from := c.lastEndpoint
+	c.lastEndpoint = endpoint
+	c.lastMu.Unlock()
+	if from != "" && from != endpoint {
+		c.hooks.EndpointSwitch(ctx, from, endpoint)
+	}
+}
+
+// warn passes the Warning headers of resp to the OnWarning callback.
+func (c *Client) warn(resp *http.Response) {
+	if c.onWarning == nil {
+		return
+	}
+	for _, v := range resp.Header.Values("Warning") {
+		// 299 <agent> "<text>"
+		if i := strings.IndexByte(v, '"'); i >= 0 {
+			if text, err := strconv.Unquote(v[i:]); err == nil {
+				v = text
+			}
+		}
+		c.onWarning(v)
+	}
+}
+
+// keyPath maps key to its URL path under base. Keys always start with "/".
+func keyPath(base, key string) string {
+	if !strings.HasPrefix(key, "/") {
+		key = "/" + key
+	}
+	return base + key
+}
+
+// StatusError is returned when the server answers with an unexpected status.
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("client: unexpected status %d: %s", e.Code, e.Body)
+}
+
+// notFound returns the error of a 404 response to a key-value call.
+func notFound(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if strings.TrimSpace(string(b)) == "Keyspace not found" {
+		return ErrKeyspaceNotFound
+	}
+	return ErrKeyNotFound
+}
+
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &StatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+}
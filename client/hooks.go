@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Hooks observe the requests of a Client, e.g. to export metrics or traces.
+// Hooks are called synchronously from the calling goroutine and must not
+// block. Embed NopHooks to implement only some of them.
+type Hooks interface {
+	// RequestStart is called before the first attempt of a call.
+	RequestStart(ctx context.Context, info RequestInfo)
+	// RequestEnd is called once the call got a response or failed. For a
+	// streamed response such as a watch it is called when the headers
+	// arrived.
+	RequestEnd(ctx context.Context, info RequestInfo, res RequestResult)
+	// Retry is called before attempt (counting from 2) of a call, after the
+	// previous endpoint failed with err.
+	Retry(ctx context.Context, info RequestInfo, attempt int, err error)
+	// EndpointSwitch is called when a call was served by a different
+	// endpoint than the previous call.
+	EndpointSwitch(ctx context.Context, from, to string)
+}
+
+// RequestInfo describes a call.
+type RequestInfo struct {
+	Method string
+	// Path is the request path, e.g. /kv/foo.
+	Path string
+	// Route is Path without keys and IDs, e.g. /kv or /cluster/members,
+	// suitable as a metric label.
+	Route string
+}
+
+// RequestResult is the outcome of a call.
+type RequestResult struct {
+	// Endpoint served the call, empty if every endpoint failed.
+	Endpoint string
+	// StatusCode is the HTTP status, 0 if no response was received.
+	StatusCode int
+	Err        error
+	Attempts   int
+	Duration   time.Duration
+}
+
+// NopHooks implements Hooks doing nothing.
+type NopHooks struct{}
+
+func (NopHooks) RequestStart(context.Context, RequestInfo)              {}
+func (NopHooks) RequestEnd(context.Context, RequestInfo, RequestResult) {}
+func (NopHooks) Retry(context.Context, RequestInfo, int, error)         {}
+func (NopHooks) EndpointSwitch(ctx context.Context, from, to string)    {}
+
+// route strips keys and member IDs from path.
+func route(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if parts[0] == "cluster" && len(parts) > 1 {
+		return "/cluster/" + parts[1]
+	}
+	return "/" + parts[0]
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type recordHooks struct {
+	NopHooks
+	events []string
+}
+
+func (h *recordHooks) RequestStart(_ context.Context, info RequestInfo) {
+	h.events = append(h.events, "start "+info.Route)
+}
+
+func (h *recordHooks) RequestEnd(_ context.Context, info RequestInfo, res RequestResult) {
+	h.events = append(h.events, fmt.Sprintf("end %s %d attempts=%d", info.Route, res.StatusCode, res.Attempts))
+}
+
+func (h *recordHooks) Retry(_ context.Context, info RequestInfo, attempt int, _ error) {
+	h.events = append(h.events, fmt.Sprintf("retry %s %d", info.Route, attempt))
+}
+
+func (h *recordHooks) EndpointSwitch(context.Context, string, string) {
+	h.events = append(h.events, "switch")
+}
+
+func TestHooks(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("bar"))
+	})
+	first, second := httptest.NewServer(ok), httptest.NewServer(ok)
+	defer first.Close()
+	defer second.Close()
+	down := httptest.NewServer(ok)
+	down.Close()
+
+	h := &recordHooks{}
+	c, err := New(Config{Endpoints: []string{first.URL}, Hooks: h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Get(context.Background(), "foo"); err != nil {
+		t.Fatal(err)
+	}
+	// the first endpoint went away and the next one is down as well
+	other, err := New(Config{Endpoints: []string{down.URL, second.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.endpoints = other.endpoints
+	if err := c.MemberPromote(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"start /kv", "end /kv 200 attempts=1",
+		"start /cluster/members", "retry /cluster/members 2", "switch", "end /cluster/members 200 attempts=2",
+	}
+	if fmt.Sprint(h.events) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, h.events)
+	}
+}
@@ -0,0 +1,101 @@
+// Package metrics exports the requests of a metcd client as Prometheus
+// metrics.
+//
+//	m := metrics.New()
+//	prometheus.MustRegister(m)
+//	c, err := client.New(client.Config{Endpoints: eps, Hooks: m})
+package metrics
+
+import (
+	"context"
+	"strconv"
+
+	"metcd/client"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements client.Hooks and prometheus.Collector. One Collector
+// may be shared by several clients.
+type Collector struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inflight *prometheus.GaugeVec
+	retries  *prometheus.CounterVec
+	switches *prometheus.CounterVec
+}
+
+var _ client.Hooks = (*Collector)(nil)
+
+// New creates a Collector. Its metrics are named metcd_client_*.
+func New() *Collector {
+	return &Collector{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "metcd",
+			Subsystem: "client",
+			Name:      "requests_total",
+			Help:      "Total number of calls by route, method and HTTP status code, 0 if no endpoint answered.",
+		}, []string{"route", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "metcd",
+			Subsystem: "client",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of calls until the response headers arrived.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"route", "method"}),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "metcd",
+			Subsystem: "client",
+			Name:      "requests_in_flight",
+			Help:      "Number of calls waiting for a response.",
+		}, []string{"route"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "metcd",
+			Subsystem: "client",
+			Name:      "retries_total",
+			Help:      "Total number of calls retried on another endpoint.",
+		}, []string{"route"}),
+		switches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "metcd",
+			Subsystem: "client",
+			Name:      "endpoint_switches_total",
+			Help:      "Total number of times calls moved to another endpoint, by new endpoint.",
+		}, []string{"endpoint"}),
+	}
+}
+
+func (m *Collector) RequestStart(_ context.Context, info client.RequestInfo) {
+	m.inflight.WithLabelValues(info.Route).Inc()
+}
+
+func (m *Collector) RequestEnd(_ context.Context, info client.RequestInfo, res client.RequestResult) {
+	m.inflight.WithLabelValues(info.Route).Dec()
+	m.requests.WithLabelValues(info.Route, info.Method, strconv.Itoa(res.StatusCode)).Inc()
+	m.duration.WithLabelValues(info.Route, info.Method).Observe(res.Duration.Seconds())
+}
+
+func (m *Collector) Retry(_ context.Context, info client.RequestInfo, _ int, _ error) {
+	m.retries.WithLabelValues(info.Route).Inc()
+}
+
+func (m *Collector) EndpointSwitch(_ context.Context, _, to string) {
+	m.switches.WithLabelValues(to).Inc()
+}
+
+// Describe implements prometheus.Collector.
+func (m *Collector) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.duration.Describe(ch)
+	m.inflight.Describe(ch)
+	m.retries.Describe(ch)
+	m.switches.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Collector) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.duration.Collect(ch)
+	m.inflight.Collect(ch)
+	m.retries.Collect(ch)
+	m.switches.Collect(ch)
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"metcd/client"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	m := New()
+	c, err := client.New(client.Config{Endpoints: []string{srv.URL}, Hooks: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(context.Background(), "foo"); err != client.ErrKeyNotFound {
+			t.Fatalf("expected ErrKeyNotFound, got %v", err)
+		}
+	}
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("/kv", http.MethodGet, "404")); got != 2 {
+		t.Fatalf("expected 2 requests, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.inflight.WithLabelValues("/kv")); got != 0 {
+		t.Fatalf("expected no request in flight, got %v", got)
+	}
+	if n := testutil.CollectAndCount(m); n == 0 {
+		t.Fatal("expected the collector to export metrics")
+	}
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// CallOption configures a single call. Options that do not apply to a call
+// are ignored.
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	timeout        time.Duration
+	serializable   bool
+	leaseRead      bool
+	maxStaleness   time.Duration
+	minRev         int64
+	idempotencyKey string
+	ifMatch        string
+	force          bool
+	keyspace       string
+	since          int64
+	sinceSet       bool
+	keysOnly       bool
+	filterPut      bool
+	filterDelete   bool
+	rate           float64
+	limit          int
+	continueToken  string
+}
+
+// WithTimeout bounds the call, including reading a streamed response such
+// as a watch, in addition to the deadline of its context.
+func WithTimeout(d time.Duration) CallOption {
+	return func(o *callOptions) { o.timeout = d }
+}
+
+// WithSerializable makes a read be served from the local store of the
+// endpoint without confirming with the leader. It is faster and works
+// without a quorum, but may return stale data.
+func WithSerializable() CallOption {
+	return func(o *callOptions) { o.serializable = true }
+}
+
+// WithLeaseRead makes a read be served from the local store of the
+// endpoint once it has every change committed more than maxStaleness ago,
+// the server's default bound if 0. Reads within maxStaleness of a previous
+// confirmation with the leader do not wait for another, so it is between a
+// serializable and a linearizable read in cost and freshness.
+func WithLeaseRead(maxStaleness time.Duration) CallOption {
+	return func(o *callOptions) { o.leaseRead, o.maxStaleness = true, maxStaleness }
+}
+
+// WithMinRev makes a read wait until the endpoint applied revision rev, so
+// a serializable read observes at least the changes up to rev.
+func WithMinRev(rev int64) CallOption {
+	return func(o *callOptions) { o.minRev = rev }
+}
+
+// WithIdempotencyKey tags a write with key. A retried write with a key the
+// cluster has already applied returns the first result and is not applied
+// again, so a write may safely be retried after an ambiguous failure.
+func WithIdempotencyKey(key string) CallOption {
+	return func(o *callOptions) { o.idempotencyKey = key }
+}
+
+// WithIfMatch makes a Put or a Delete happen only if the key was last
+// changed at modRev, its ModRevision read with GetKV, or only if the key
+// exists if modRev is 0. The call returns ErrPreconditionFailed otherwise.
+func WithIfMatch(modRev int64) CallOption {
+	return func(o *callOptions) {
+		o.ifMatch = "*"
+		if modRev != 0 {
+			o.ifMatch = `"` + strconv.FormatInt(modRev, 10) + `"`
+		}
+	}
+}
+
+// WithKeyspace makes a key-value call, a transaction or a watch use the
+// keyspace called name instead of the default one.
+func WithKeyspace(name string) CallOption {
+	return func(o *callOptions) { o.keyspace = name }
+}
+
+// WithSince makes a watch start with the events after revision rev, those
+// missed since a previous watch saw rev. The watch fails with ErrCompacted
+// if the endpoint no longer keeps them.
+func WithSince(rev int64) CallOption {
+	return func(o *callOptions) { o.since, o.sinceSet = rev, true }
+}
+
+// WithKeysOnly makes a watch leave the values out of its events, for
+// watchers that only care about which keys change.
+func WithKeysOnly() CallOption {
+	return func(o *callOptions) { o.keysOnly = true }
+}
+
+// WithFilterPut makes a watch skip the put events, on the server.
+func WithFilterPut() CallOption {
+	return func(o *callOptions) { o.filterPut = true }
+}
+
+// WithFilterDelete makes a watch skip the delete events, on the server.
+func WithFilterDelete() CallOption {
+	return func(o *callOptions) { o.filterDelete = true }
+}
+
+// WithRateLimit makes the server send at most perSecond events of a watch
+// per second. A watch limited below the rate of changes falls behind and
+// ends, to be resumed WithSince.
+func WithRateLimit(perSecond float64) CallOption {
+	return func(o *callOptions) { o.rate = perSecond }
+}
+
+// WithLimit makes a listing such as History return at most n entries, the
+// response then carrying the continue token of the next page if any, and
+// Stats list the n prefixes of each keyspace holding the most keys.
+func WithLimit(n int) CallOption {
+	return func(o *callOptions) { o.limit = n }
+}
+
+// WithContinue makes a listing return the page after the one whose
+// continue token is token, consistent with the first page: the changes
+// since are not listed.
+func WithContinue(token string) CallOption {
+	return func(o *callOptions) { o.continueToken = token }
+}
+
+// WithForce makes a membership change go ahead even if it violates the
+// server's resizing guardrails.
+func WithForce() CallOption {
+	return func(o *callOptions) { o.force = true }
+}
+
+func newCallOptions(opts []CallOption) *callOptions {
+	o := &callOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// context returns the context of the call and the function releasing it.
+func (o *callOptions) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.timeout > 0 {
+		return context.WithTimeout(ctx, o.timeout)
+	}
+	return ctx, func() {}
+}
+
+// query returns a copy of query with the options added.
+func (o *callOptions) query(query url.Values) url.Values {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	if o.serializable {
+		q.Set("serializable", "true")
+	}
+	if o.leaseRead {
+		q.Set("leaseRead", "true")
+		if o.maxStaleness > 0 {
+			q.Set("maxStaleness", o.maxStaleness.String())
+		}
+	}
+	if o.minRev > 0 {
+		q.Set("minRev", strconv.FormatInt(o.minRev, 10))
+	}
+	if o.force {
+		q.Set("force", "true")
+	}
+	if o.sinceSet {
+		q.Set("since", strconv.FormatInt(o.since, 10))
+	}
+	if o.keysOnly {
+		q.Set("keysOnly", "true")
+	}
+	if o.filterPut {
+		q.Set("noPut", "true")
+	}
+	if o.filterDelete {
+		q.Set("noDelete", "true")
+	}
+	if o.rate > 0 {
+		q.Set("rate", strconv.FormatFloat(o.rate, 'g', -1, 64))
+	}
+	if o.limit > 0 {
+		q.Set("limit", strconv.Itoa(o.limit))
+	}
+	if o.continueToken != "" {
+		q.Set("continue", o.continueToken)
+	}
+	return q
+}
+
+func (o *callOptions) header(h http.Header) {
+	if o.idempotencyKey != "" {
+		h.Set("Idempotency-Key", o.idempotencyKey)
+	}
+	if o.ifMatch != "" {
+		h.Set("If-Match", o.ifMatch)
+	}
+	if o.keyspace != "" {
+		h.Set("X-Metcd-Keyspace", o.keyspace)
+	}
+}
+
+// cancelBody releases the context of a call once its response is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
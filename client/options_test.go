@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCallOptions(t *testing.T) {
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		if r.URL.Query().Get("slow") != "" {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("bar"))
+	}))
+	defer srv.Close()
+	c, err := New(Config{Endpoints: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "foo", WithSerializable(), WithMinRev(7)); err != nil {
+		t.Fatal(err)
+	}
+	if q := got.URL.Query(); q.Get("serializable") != "true" || q.Get("minRev") != "7" {
+		t.Fatalf("unexpected query %q", got.URL.RawQuery)
+	}
+	if _, err := c.Get(ctx, "foo", WithLeaseRead(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if q := got.URL.Query(); q.Get("leaseRead") != "true" || q.Get("maxStaleness") != "50ms" {
+		t.Fatalf("unexpected query %q", got.URL.RawQuery)
+	}
+	if err := c.Put(ctx, "foo", "bar", WithIdempotencyKey("req-1")); err != nil {
+		t.Fatal(err)
+	}
+	if key := got.Header.Get("Idempotency-Key"); key != "req-1" {
+		t.Fatalf("expected idempotency key req-1, got %q", key)
+	}
+	if err := c.Delete(ctx, "foo", WithIfMatch(5)); err != nil {
+		t.Fatal(err)
+	}
+	if tag := got.Header.Get("If-Match"); tag != `"5"` {
+		t.Fatalf("expected If-Match \"5\", got %q", tag)
+	}
+	if err := c.Put(ctx, "foo", "bar", WithIfMatch(0)); err != nil {
+		t.Fatal(err)
+	}
+	if tag := got.Header.Get("If-Match"); tag != "*" {
+		t.Fatalf("expected If-Match *, got %q", tag)
+	}
+	if err := c.MemberRemove(ctx, 3, WithForce()); err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.Query().Get("force") != "true" {
+		t.Fatalf("unexpected query %q", got.URL.RawQuery)
+	}
+	if _, err := c.Watch(ctx, "foo", true); err != nil {
+		t.Fatal(err)
+	}
+	if q := got.URL.Query(); q.Get("prefix") != "true" || len(q) != 1 {
+		t.Fatalf("unexpected query %q", got.URL.RawQuery)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/history/foo", nil, nil, []CallOption{WithLimit(10), WithContinue("tok")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if q := got.URL.Query(); q.Get("limit") != "10" || q.Get("continue") != "tok" {
+		t.Fatalf("unexpected query %q", got.URL.RawQuery)
+	}
+
+	start := time.Now()
+	_, err = c.do(ctx, http.MethodGet, "/kv/foo", map[string][]string{"slow": {"true"}}, nil, []CallOption{WithTimeout(50 * time.Millisecond)})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("timeout was not applied")
+	}
+}
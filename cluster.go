@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"metcd/raftnode"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+// raftCluster is the raft node as seen by the membership controllers.
+type raftCluster struct {
+	*raftnode.RaftNode
+	confChangeC chan<- raftpb.ConfChange
+}
+
+func (c raftCluster) RemoveMember(ctx context.Context, id uint64) error {
+	select {
+	case c.confChangeC <- raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: id}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c raftCluster) PromoteMember(ctx context.Context, id uint64) error {
+	url, ok := c.PeerURL(id)
+	if !ok {
+		return fmt.Errorf("member %d not found", id)
+	}
+	// adding a learner as a voter promotes it
+	select {
+	case c.confChangeC <- raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: id, Context: []byte(url)}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,225 @@
+// Package codec is the registry of the compression codecs used for
+// snapshots, values at rest and exports. Codecs are named after their HTTP
+// content coding, so the same names select them in the configuration and
+// negotiate them with Accept-Encoding and Content-Encoding.
+//
+// Identity, gzip, snappy and zstd are built in. Other codecs are added by a
+// package registering them from its init function; every member must then
+// be built with it, or it cannot read what the others wrote.
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	Identity = "identity"
+	Gzip     = "gzip"
+	Snappy   = "snappy"
+	Zstd     = "zstd"
+)
+
+// magic starts the data framed by Encode.
+const magic = "\x00metcd-z\x00"
+
+var ErrUnknown = errors.New("codec: unknown codec")
+
+// Codec compresses and decompresses streams.
+type Codec interface {
+	// Name is the name of the codec, its HTTP content coding.
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	mu     sync.RWMutex
+	codecs = make(map[string]Codec)
+)
+
+func init() {
+	Register(identity{})
+	Register(gzipCodec{})
+	Register(snappyCodec{})
+	Register(zstdCodec{})
+}
+
+// Register makes c available by its name. It panics if a codec with that
+// name is registered already.
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := codecs[c.Name()]; dup {
+		panic("codec: Register called twice for " + c.Name())
+	}
+	codecs[c.Name()] = c
+}
+
+// Get returns the codec called name.
+func Get(name string) (Codec, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q, registered are %s", ErrUnknown, name, strings.Join(names(), ", "))
+	}
+	return c, nil
+}
+
+// Names returns the names of the registered codecs, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return names()
+}
+
+func names() []string {
+	var ns []string
+	for n := range codecs {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// Negotiate returns the registered codec an Accept-Encoding header prefers,
+// identity if it accepts none of them.
+func Negotiate(acceptEncoding string) Codec {
+	best, bestQ := Codec(identity{}), 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		c, err := Get(strings.ToLower(strings.TrimSpace(name)))
+		if err != nil || q <= bestQ {
+			continue
+		}
+		best, bestQ = c, q
+	}
+	return best
+}
+
+// Encode compresses data with c and frames it with the name of c, so Decode
+// needs no configuration to read it back.
+func Encode(c Codec, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(c.Name())))])
+	buf.WriteString(c.Name())
+	w, err := c.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// IsEncoded reports whether data was returned by Encode.
+func IsEncoded(data []byte) bool { return bytes.HasPrefix(data, []byte(magic)) }
+
+// CodecOf returns the name of the codec data is encoded with.
+func CodecOf(data []byte) (string, error) {
+	name, _, err := split(data)
+	return name, err
+}
+
+func split(data []byte) (name string, payload []byte, err error) {
+	rest := data[len(magic):]
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || n > uint64(len(rest)-size) {
+		return "", nil, errors.New("codec: corrupt frame")
+	}
+	rest = rest[size:]
+	return string(rest[:n]), rest[n:], nil
+}
+
+// Decode returns the data framed by Encode decompressed, other data as is.
+func Decode(data []byte) ([]byte, error) {
+	if !IsEncoded(data) {
+		return data, nil
+	}
+	name, payload, err := split(data)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type identity struct{}
+
+func (identity) Name() string { return Identity }
+
+func (identity) NewWriter(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }
+
+func (identity) NewReader(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(r), nil }
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return Gzip }
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+
+// snappyCodec writes the snappy framing format, which s2 reads as well.
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return Snappy }
+
+func (snappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return s2.NewWriter(w, s2.WriterSnappyCompat()), nil
+}
+
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(s2.NewReader(r)), nil
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return Zstd }
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
@@ -0,0 +1,99 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	data := []byte(strings.Repeat("metcd ", 100))
+	for _, name := range Names() {
+		c, err := Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc, err := Encode(c, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsEncoded(enc) {
+			t.Fatalf("%s: expected the data to be framed", name)
+		}
+		if got, err := CodecOf(enc); err != nil || got != name {
+			t.Fatalf("expected %s, got %q, %v", name, got, err)
+		}
+		dec, err := Decode(enc)
+		if err != nil || !bytes.Equal(dec, data) {
+			t.Fatalf("%s: expected the data back, got %q, %v", name, dec, err)
+		}
+	}
+	// data Encode did not return reads as is
+	if dec, err := Decode([]byte("plain")); err != nil || string(dec) != "plain" {
+		t.Fatalf("expected plain, got %q, %v", dec, err)
+	}
+}
+
+type testCodec struct{ identity }
+
+func (testCodec) Name() string { return "test" }
+
+func TestUnknownCodec(t *testing.T) {
+	enc, _ := Encode(testCodec{}, []byte("v"))
+	if _, err := Decode(enc); !errors.Is(err, ErrUnknown) {
+		t.Fatalf("expected ErrUnknown, got %v", err)
+	}
+	if _, err := Get("test"); !errors.Is(err, ErrUnknown) {
+		t.Fatalf("expected ErrUnknown, got %v", err)
+	}
+	if _, err := Decode([]byte(magic + "\x7f")); err == nil {
+		t.Fatal("expected an error for a corrupt frame")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering gzip twice to panic")
+		}
+	}()
+	Register(gzipCodec{})
+}
+
+func TestNegotiate(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                         Identity,
+		"br, deflate":              Identity,
+		"gzip":                     Gzip,
+		"GZIP;q=0.5, identity;q=1": Identity,
+		"identity;q=0.2, gzip":     Gzip,
+		"gzip;q=0":                 Identity,
+		"gzip;q=x":                 Identity,
+		"gzip;q=0.8, zstd":         Zstd,
+		"snappy, zstd;q=0.5":       Snappy,
+	} {
+		if got := Negotiate(accept).Name(); got != want {
+			t.Errorf("Negotiate(%q) = %s, expected %s", accept, got, want)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	for _, name := range []string{Gzip, Snappy, Zstd} {
+		c, _ := Get(name)
+		var buf bytes.Buffer
+		w, _ := c.NewWriter(&buf)
+		io.WriteString(w, "streamed")
+		w.Close()
+		r, err := c.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := io.ReadAll(r); string(b) != "streamed" {
+			t.Fatalf("%s: expected streamed, got %q", name, b)
+		}
+		r.Close()
+	}
+}
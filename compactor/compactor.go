@@ -0,0 +1,175 @@
+// Package compactor proposes history compactions on the leader according to
+// a retention policy.
+package compactor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	ModePeriodic = "periodic"
+	ModeRevision = "revision"
+)
+
+// RevGetter returns the revisions of the store.
+type RevGetter interface {
+	// Rev returns the current revision.
+	Rev() int64
+	// CompactRev returns the revision the history was last compacted at.
+	CompactRev() int64
+}
+
+// Compactable compacts the history at or below rev.
+type Compactable interface {
+	Compact(ctx context.Context, rev int64) error
+}
+
+// Compactor runs a compaction policy until it is stopped.
+type Compactor interface {
+	// Run starts the compactor in the background.
+	Run()
+	// Stop stops the compactor and waits for it to exit.
+	Stop()
+}
+
+// compactTimeout bounds a single compaction proposal.
+const compactTimeout = 5 * time.Second
+
+// Pacing splits a compaction into batches so that compacting a long history
+// does not hold up the applies of other proposals.
+type Pacing struct {
+	// BatchLimit is the maximum number of revisions compacted by one
+	// proposal, 0 compacts to the target at once.
+	BatchLimit int64
+	// BatchInterval is the pause between two batches.
+	BatchInterval time.Duration
+}
+
+// DefaultPacing is used when no pacing is configured.
+var DefaultPacing = Pacing{BatchLimit: 1000, BatchInterval: 10 * time.Millisecond}
+
+// New creates a compactor for mode. For ModePeriodic retention is a duration
+// ("72h", or a bare number of hours); for ModeRevision it is a number of
+// revisions. Compactions are only proposed while isLeader returns true and are
+// paced by pacing.
+func New(mode, retention string, pacing Pacing, rg RevGetter, c Compactable, isLeader func() bool) (Compactor, error) {
+	if pacing.BatchLimit < 0 || pacing.BatchInterval < 0 {
+		return nil, fmt.Errorf("compactor: invalid pacing %+v", pacing)
+	}
+	switch mode {
+	case ModePeriodic:
+		d, err := parsePeriod(retention)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("compactor: invalid periodic retention %q", retention)
+		}
+		return newPeriodic(d, pacing, rg, c, isLeader), nil
+	case ModeRevision:
+		n, err := strconv.ParseInt(retention, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("compactor: invalid revision retention %q", retention)
+		}
+		return newRevision(n, pacing, rg, c, isLeader), nil
+	}
+	return nil, fmt.Errorf("compactor: unknown mode %q", mode)
+}
+
+func parsePeriod(retention string) (time.Duration, error) {
+	if h, err := strconv.ParseInt(retention, 10, 64); err == nil {
+		return time.Duration(h) * time.Hour, nil
+	}
+	d, err := time.ParseDuration(retention)
+	if err != nil {
+		return 0, fmt.Errorf("compactor: invalid periodic retention %q (%v)", retention, err)
+	}
+	return d, nil
+}
+
+// runner calls step every interval until stopped.
+type runner struct {
+	interval time.Duration
+	step     func()
+	pacing   Pacing
+	stopc    chan struct{}
+	donec    chan struct{}
+}
+
+func newRunner(interval time.Duration, pacing Pacing, step func()) *runner {
+	return &runner{
+		interval: interval,
+		step:     step,
+		pacing:   pacing,
+		stopc:    make(chan struct{}),
+		donec:    make(chan struct{}),
+	}
+}
+
+func (r *runner) Run() {
+	go func() {
+		defer close(r.donec)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.step()
+			case <-r.stopc:
+				return
+			}
+		}
+	}()
+}
+
+func (r *runner) Stop() {
+	close(r.stopc)
+	<-r.donec
+}
+
+// compact compacts the history of the store up to rev in batches of at most
+// pacing.BatchLimit revisions. It returns the revision compacted so far.
+func (r *runner) compact(rg RevGetter, c Compactable, rev int64) int64 {
+	// start from the store, it may have been compacted by a previous leader
+	last := rg.CompactRev()
+	for last < rev {
+		next := rev
+		if r.pacing.BatchLimit > 0 && rev-last > r.pacing.BatchLimit {
+			next = last + r.pacing.BatchLimit
+		}
+		if !compactBatch(c, next) {
+			return last
+		}
+		last = next
+		if last == rev || r.pacing.BatchInterval <= 0 {
+			continue
+		}
+		select {
+		case <-time.After(r.pacing.BatchInterval):
+		case <-r.stopc:
+			return last
+		}
+	}
+	log.Printf("compactor: compacted at revision %d", rev)
+	return last
+}
+
+func compactBatch(c Compactable, rev int64) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), compactTimeout)
+	defer cancel()
+	start := time.Now()
+	err := c.Compact(ctx, rev)
+	batchDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		batchesTotal.WithLabelValues("failed").Inc()
+		log.Printf("compactor: failed to compact at revision %d (%v)", rev, err)
+		return false
+	}
+	batchesTotal.WithLabelValues("succeeded").Inc()
+	compactedRevision.Set(float64(rev))
+	return true
+}
@@ -0,0 +1,122 @@
+package compactor
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeStore struct {
+	rev        int64
+	compactRev int64
+	compacted  []int64
+}
+
+func (f *fakeStore) Rev() int64 { return f.rev }
+
+func (f *fakeStore) CompactRev() int64 { return f.compactRev }
+
+func (f *fakeStore) Compact(_ context.Context, rev int64) error {
+	f.compacted = append(f.compacted, rev)
+	f.compactRev = rev
+	return nil
+}
+
+func TestPeriodic(t *testing.T) {
+	fs := &fakeStore{}
+	leader := true
+	p := newPeriodic(time.Hour, Pacing{}, fs, fs, func() bool { return leader })
+
+	for i := 0; i < periodicSamples; i++ {
+		fs.rev += 10
+		p.step()
+	}
+	if len(fs.compacted) != 0 {
+		t.Fatalf("compacted before a retention period passed: %v", fs.compacted)
+	}
+	fs.rev += 10
+	p.step()
+	fs.rev += 10
+	p.step()
+	if want := []int64{10, 20}; !reflect.DeepEqual(fs.compacted, want) {
+		t.Fatalf("expected compactions at %v, got %v", want, fs.compacted)
+	}
+
+	// losing leadership restarts the retention period
+	leader = false
+	p.step()
+	leader = true
+	for i := 0; i < periodicSamples; i++ {
+		p.step()
+	}
+	if len(fs.compacted) != 2 {
+		t.Fatalf("compacted right after regaining leadership: %v", fs.compacted)
+	}
+}
+
+func TestRevision(t *testing.T) {
+	fs := &fakeStore{rev: 5}
+	leader := false
+	r := newRevision(10, Pacing{}, fs, fs, func() bool { return leader })
+
+	r.step()
+	fs.rev = 30
+	r.step()
+	if len(fs.compacted) != 0 {
+		t.Fatalf("follower compacted: %v", fs.compacted)
+	}
+	leader = true
+	r.step()
+	r.step()
+	fs.rev = 35
+	r.step()
+	if want := []int64{20, 25}; !reflect.DeepEqual(fs.compacted, want) {
+		t.Fatalf("expected compactions at %v, got %v", want, fs.compacted)
+	}
+}
+
+func TestPacing(t *testing.T) {
+	// the store was already compacted at 5 by a previous leader
+	fs := &fakeStore{rev: 3000, compactRev: 5}
+	r := newRevision(500, Pacing{BatchLimit: 1000, BatchInterval: time.Millisecond}, fs, fs, func() bool { return true })
+
+	r.step()
+	if want := []int64{1005, 2005, 2500}; !reflect.DeepEqual(fs.compacted, want) {
+		t.Fatalf("expected compactions at %v, got %v", want, fs.compacted)
+	}
+	if r.last != 2500 {
+		t.Fatalf("expected last compaction at 2500, got %d", r.last)
+	}
+
+	// a stopped compactor gives up between batches
+	fs.rev = 10000
+	r.pacing.BatchInterval = time.Hour
+	close(r.stopc)
+	r.step()
+	if want := []int64{1005, 2005, 2500, 3500}; !reflect.DeepEqual(fs.compacted, want) {
+		t.Fatalf("expected compactions at %v, got %v", want, fs.compacted)
+	}
+}
+
+func TestNew(t *testing.T) {
+	fs := &fakeStore{}
+	isLeader := func() bool { return true }
+	for _, tc := range []struct {
+		mode, retention string
+		ok              bool
+	}{
+		{ModePeriodic, "1", true},
+		{ModePeriodic, "30m", true},
+		{ModePeriodic, "0", false},
+		{ModePeriodic, "soon", false},
+		{ModeRevision, "1000", true},
+		{ModeRevision, "1h", false},
+		{"daily", "1", false},
+	} {
+		_, err := New(tc.mode, tc.retention, DefaultPacing, fs, fs, isLeader)
+		if (err == nil) != tc.ok {
+			t.Errorf("New(%q, %q) error = %v, expected ok %v", tc.mode, tc.retention, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package compactor
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	batchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "compactor",
+		Name:      "batches_total",
+		Help:      "Total number of compaction batches proposed by result.",
+	}, []string{"result"})
+
+	batchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "metcd",
+		Subsystem: "compactor",
+		Name:      "batch_duration_seconds",
+		Help:      "Latency of a compaction batch from proposal to apply.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+
+	compactedRevision = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metcd",
+		Subsystem: "compactor",
+		Name:      "compacted_revision",
+		Help:      "Revision of the last compaction batch proposed by this member.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(batchesTotal, batchDuration, compactedRevision)
+}
@@ -0,0 +1,48 @@
+package compactor
+
+import "time"
+
+// periodicSamples is the number of revision samples taken per retention
+// period.
+const periodicSamples = 10
+
+// periodic keeps roughly the last retention worth of history. It samples the
+// revision every retention/periodicSamples and compacts to the sample taken
+// one retention period ago.
+type periodic struct {
+	*runner
+	rg       RevGetter
+	c        Compactable
+	isLeader func() bool
+
+	samples []int64
+	last    int64
+}
+
+func newPeriodic(retention time.Duration, pacing Pacing, rg RevGetter, c Compactable, isLeader func() bool) *periodic {
+	p := &periodic{rg: rg, c: c, isLeader: isLeader}
+	interval := retention / periodicSamples
+	if interval <= 0 {
+		interval = retention
+	}
+	p.runner = newRunner(interval, pacing, p.step)
+	return p
+}
+
+func (p *periodic) step() {
+	if !p.isLeader() {
+		// a new leader starts measuring the retention from scratch
+		p.samples = p.samples[:0]
+		return
+	}
+	p.samples = append(p.samples, p.rg.Rev())
+	if len(p.samples) <= periodicSamples {
+		return
+	}
+	rev := p.samples[0]
+	p.samples = p.samples[1:]
+	if rev <= p.last {
+		return
+	}
+	p.last = p.compact(p.rg, p.c, rev)
+}
@@ -0,0 +1,35 @@
+package compactor
+
+import "time"
+
+// revisionCheckInterval is how often the revision compactor looks at the
+// current revision.
+const revisionCheckInterval = 5 * time.Minute
+
+// revision keeps the last retention revisions.
+type revision struct {
+	*runner
+	retention int64
+	rg        RevGetter
+	c         Compactable
+	isLeader  func() bool
+
+	last int64
+}
+
+func newRevision(retention int64, pacing Pacing, rg RevGetter, c Compactable, isLeader func() bool) *revision {
+	r := &revision{retention: retention, rg: rg, c: c, isLeader: isLeader}
+	r.runner = newRunner(revisionCheckInterval, pacing, r.step)
+	return r
+}
+
+func (r *revision) step() {
+	if !r.isLeader() {
+		return
+	}
+	rev := r.rg.Rev() - r.retention
+	if rev <= 0 || rev <= r.last {
+		return
+	}
+	r.last = r.compact(r.rg, r.c, rev)
+}
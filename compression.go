@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"metcd/codec"
+	"metcd/encryption"
+	"net/http"
+)
+
+var (
+	// valueCodec compresses the values of at least valueCodecMinSize bytes
+	// on the proposing member, nil keeps them as they are. Every member
+	// reads the codec from the value.
+	valueCodec        codec.Codec
+	valueCodecMinSize = 1024
+	// snapshotCodec compresses the snapshots stored by raft and sent to
+	// followers, nil keeps them JSON.
+	snapshotCodec codec.Codec
+)
+
+// encodeValue compresses a value about to be proposed if it is large enough
+// and gets smaller. Values that would read as compressed or encrypted by
+// metcd are framed with the identity codec, so they read back as written.
+func encodeValue(v string) (string, error) {
+	if valueCodec != nil && len(v) >= valueCodecMinSize {
+		enc, err := codec.Encode(valueCodec, []byte(v))
+		if err != nil {
+			return "", err
+		}
+		if len(enc) < len(v) {
+			return string(enc), nil
+		}
+	}
+	return frameValue(v)
+}
+
+// frameValue frames v with the identity codec if it would read as
+// compressed or encrypted by metcd, and returns it as is otherwise.
+func frameValue(v string) (string, error) {
+	if codec.IsEncoded([]byte(v)) || encryption.IsSealed(v) {
+		id, _ := codec.Get(codec.Identity)
+		enc, err := codec.Encode(id, []byte(v))
+		return string(enc), err
+	}
+	return v, nil
+}
+
+func decodeValue(v string) (string, error) {
+	if !codec.IsEncoded([]byte(v)) {
+		return v, nil
+	}
+	dec, err := codec.Decode([]byte(v))
+	return string(dec), err
+}
+
+// openCompared opens a value a transaction compares. A member without the
+// codec of a value must not evaluate the comparison differently from the
+// others, it stops instead.
+func (s *kvstore) openCompared(key, value string) (string, error) {
+	v, err := s.open(key, value)
+	if errors.Is(err, codec.ErrUnknown) {
+		log.Fatalf("metcd: cannot compare the value of %q (%v), every member needs the codecs of the others", key, err)
+	}
+	return v, err
+}
+
+// storedSnapshot returns the snapshot for raft, compressed with
+// snapshotCodec. recoverFromSnapshot reads either.
+func (s *kvstore) storedSnapshot() ([]byte, error) {
+	data, err := s.getSnapshot()
+	if err != nil || snapshotCodec == nil || snapshotCodec.Name() == codec.Identity {
+		return data, err
+	}
+	return codec.Encode(snapshotCodec, data)
+}
+
+// compressResponse compresses the body of the response to r with the codec
+// its Accept-Encoding prefers. The returned function flushes the
+// compressed body.
+func compressResponse(w http.ResponseWriter, r *http.Request) (io.Writer, func() error) {
+	c := codec.Negotiate(r.Header.Get("Accept-Encoding"))
+	w.Header().Add("Vary", "Accept-Encoding")
+	if c.Name() == codec.Identity {
+		return w, func() error { return nil }
+	}
+	cw, err := c.NewWriter(w)
+	if err != nil {
+		log.Printf("Failed to compress with %s (%v)\n", c.Name(), err)
+		return w, func() error { return nil }
+	}
+	w.Header().Set("Content-Encoding", c.Name())
+	return cw, cw.Close
+}
+
+// decompressRequest returns the body of r decoded with the codec of its
+// Content-Encoding.
+func decompressRequest(r *http.Request) (io.ReadCloser, error) {
+	name := r.Header.Get("Content-Encoding")
+	if name == "" {
+		return r.Body, nil
+	}
+	c, err := codec.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewReader(r.Body)
+}
+
+// responseCodecMinSize is the size from which compressed handlers compress
+// a response, smaller ones gain little over the cost.
+var responseCodecMinSize = 1024
+
+// compressed decodes the body of a request to next with the codec of its
+// Content-Encoding, and compresses responses of at least
+// responseCodecMinSize bytes with the codec its Accept-Encoding prefers.
+// next must not stream, the start of the body is held until the size is
+// known.
+func compressed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if enc := r.Header.Get("Content-Encoding"); enc != "" && enc != codec.Identity {
+			body, err := decompressRequest(r)
+			if errors.Is(err, codec.ErrUnknown) {
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			} else if err != nil {
+				http.Error(w, "Invalid "+enc+" body", http.StatusBadRequest)
+				return
+			}
+			defer body.Close()
+			r.Body, r.ContentLength = body, -1
+			r.Header.Del("Content-Encoding")
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		c := codec.Negotiate(r.Header.Get("Accept-Encoding"))
+		if c.Name() == codec.Identity {
+			next(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, c: c}
+		next(cw, r)
+		if err := cw.close(); err != nil {
+			log.Printf("Failed to compress with %s (%v)\n", c.Name(), err)
+		}
+	}
+}
+
+// compressWriter holds the start of a response until it has
+// responseCodecMinSize bytes or ends, then sends it compressed with c if it
+// is large enough, a 200 and not encoded by the handler already.
+type compressWriter struct {
+	http.ResponseWriter
+	c      codec.Codec
+	status int
+	buf    []byte
+	// started once the header went out, with cw set if compressing
+	started bool
+	cw      io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.started {
+		if w.cw != nil {
+			return w.cw.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= responseCodecMinSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start sends the header and the held body.
+func (w *compressWriter) start(compress bool) error {
+	w.started = true
+	h := w.Header()
+	if compress && w.status == http.StatusOK && h.Get("Content-Encoding") == "" {
+		cw, err := w.c.NewWriter(w.ResponseWriter)
+		if err != nil {
+			return err
+		}
+		h.Set("Content-Encoding", w.c.Name())
+		h.Del("Content-Length")
+		w.cw = cw
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.cw != nil {
+		_, err := w.cw.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// close sends what the handler left, the whole response if it was small.
+func (w *compressWriter) close() error {
+	switch {
+	case w.cw != nil:
+		return w.cw.Close()
+	case !w.started && w.status != 0:
+		return w.start(false)
+	}
+	return nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *compressWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
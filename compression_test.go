@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressed(t *testing.T) {
+	large := strings.Repeat("metcd ", responseCodecMinSize)
+	h := compressed(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed on PUT", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/missing":
+			http.Error(w, large, http.StatusNotFound)
+		case "/echo":
+			w.Write(body)
+		default:
+			w.Write([]byte(large))
+		}
+	})
+	serve := func(path, acceptEncoding string, body io.Reader, contentEncoding string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, path, body)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		req.Header.Set("Content-Encoding", contentEncoding)
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+
+	w := serve("/large", "gzip", nil, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("expected a gzip response, got %d %v", w.Code, w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != large {
+		t.Fatalf("expected the body back, got %d bytes", len(got))
+	}
+	// zstd is negotiated, and read on PUT, the same way
+	w = serve("/large", "zstd", nil, "")
+	if w.Header().Get("Content-Encoding") != "zstd" {
+		t.Fatalf("expected a zstd response, got %d %v", w.Code, w.Header())
+	}
+	if w := serve("/echo", "", w.Body, "zstd"); w.Code != http.StatusOK || w.Body.String() != large {
+		t.Fatalf("expected the zstd body decoded, got %d %v", w.Code, w.Header())
+	}
+	if w := serve("/large", "", nil, ""); w.Header().Get("Content-Encoding") != "" || w.Body.String() != large {
+		t.Fatalf("expected a plain response without Accept-Encoding, got %v", w.Header())
+	}
+	if w := serve("/missing", "gzip", nil, ""); w.Code != http.StatusNotFound || w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("expected errors kept plain, got %d %v", w.Code, w.Header())
+	}
+
+	// a small body gains nothing from compression
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("small"))
+	gw.Close()
+	w = serve("/echo", "gzip", &buf, "gzip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "" || w.Body.String() != "small" {
+		t.Fatalf("expected the decoded body back plain, got %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	if w := serve("/echo", "", strings.NewReader("x"), "br"); w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected an unknown Content-Encoding refused, got %d", w.Code)
+	}
+	if w := serve("/echo", "", strings.NewReader("not gzip"), "gzip"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a corrupt body refused, got %d", w.Code)
+	}
+}
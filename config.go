@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// envPrefix starts the environment variables configuring metcd. Every flag
+// has one: --data-dir is METCD_DATA_DIR.
+const envPrefix = "METCD_"
+
+// configFileFlag names the flag of the configuration file.
+const configFileFlag = "config-file"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyConfig sets the flags of fs that are not on the command line from
+// the METCD_* environment variables, and the remaining ones from the
+// configuration file of --config-file or METCD_CONFIG_FILE. Command line
+// flags win over environment variables, which win over the file, which
+// wins over the defaults. environ is the environment as of os.Environ.
+func applyConfig(fs *flag.FlagSet, environ []string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, envPrefix) {
+			env[k] = v
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		v, ok := env[name]
+		delete(env, name)
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		if serr := fs.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, name, serr)
+		}
+		set[f.Name] = true
+	})
+	if err != nil {
+		return err
+	}
+	unknown := make([]string, 0, len(env))
+	for name := range env {
+		unknown = append(unknown, name)
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		log.Printf("Ignoring unknown environment variable %s", name)
+	}
+
+	f := fs.Lookup(configFileFlag)
+	if f == nil || f.Value.String() == "" {
+		return nil
+	}
+	values, err := readConfigFile(f.Value.String())
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch {
+		case fs.Lookup(name) == nil || name == configFileFlag:
+			return fmt.Errorf("%s: unknown option %q", f.Value, name)
+		case set[name]:
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("%s: invalid value %q for %s: %v", f.Value, values[name], name, err)
+		}
+	}
+	return nil
+}
+
+// readConfigFile reads a configuration file: a JSON object whose keys are
+// flag names, with strings, numbers, booleans or, for comma separated
+// flags such as cluster, lists of strings as values.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values[name] = v
+		case json.Number:
+			values[name] = v.String()
+		case bool:
+			values[name] = fmt.Sprint(v)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: %s must be a list of strings", path, name)
+				}
+				items[i] = s
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("%s: unsupported value for %s", path, name)
+		}
+	}
+	return values, nil
+}
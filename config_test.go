@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApplyConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metcd.json")
+	if err := os.WriteFile(file, []byte(`{
+		"cluster": ["http://a:2380", "http://b:2380"],
+		"port": 1000,
+		"data-dir": "/from/file",
+		"learner-auto-promote": true,
+		"wal-sync-interval": "1s"
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("metcd", flag.ContinueOnError)
+	cluster := fs.String("cluster", "", "")
+	port := fs.Int("port", 9121, "")
+	dataDir := fs.String("data-dir", "", "")
+	promote := fs.Bool("learner-auto-promote", false, "")
+	interval := fs.Duration("wal-sync-interval", 0, "")
+	id := fs.Int("id", 1, "")
+	fs.String(configFileFlag, "", "")
+	if err := fs.Parse([]string{"--port", "2000"}); err != nil {
+		t.Fatal(err)
+	}
+	err := applyConfig(fs, []string{
+		"METCD_PORT=3000", "METCD_DATA_DIR=/from/env", "METCD_CONFIG_FILE=" + file, "METCD_UNKNOWN=1", "PATH=/bin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *port != 2000 || *dataDir != "/from/env" || *cluster != "http://a:2380,http://b:2380" ||
+		!*promote || *interval != time.Second || *id != 1 {
+		t.Fatalf("unexpected configuration port=%d data-dir=%s cluster=%s promote=%v interval=%v id=%d",
+			*port, *dataDir, *cluster, *promote, *interval, *id)
+	}
+
+	fs = flag.NewFlagSet("metcd", flag.ContinueOnError)
+	fs.Int("port", 9121, "")
+	if err := applyConfig(fs, []string{"METCD_PORT=x"}); err == nil {
+		t.Fatal("expected an invalid value to fail")
+	}
+	if err := os.WriteFile(file, []byte(`{"typo": 1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs.String(configFileFlag, file, "")
+	if err := applyConfig(fs, nil); err == nil {
+		t.Fatal("expected an unknown option to fail")
+	}
+}
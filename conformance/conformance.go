@@ -0,0 +1,545 @@
+// Package conformance tests that an HTTP endpoint behaves like the metcd
+// API: key-value access, revisions, transactions, idempotent and
+// conditional writes, appends and merge patches, watches, the WebSocket
+// endpoint, health and membership. Alternative frontends and forks run it
+// from their own tests against a running endpoint:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, conformance.Config{Endpoint: "http://127.0.0.1:12380"})
+//	}
+//
+// Every test writes below Config.Prefix only, so it can run against a
+// cluster that holds other data.
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"metcd/api"
+	"metcd/websocket"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Config is the endpoint under test.
+type Config struct {
+	// Endpoint is the client URL, e.g. http://127.0.0.1:12380.
+	Endpoint string
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+	// Prefix is the key prefix the tests write below, /conformance/<time>/
+	// if empty.
+	Prefix string
+	// Timeout bounds every request and the wait for a watch event, 5s if
+	// zero.
+	Timeout time.Duration
+}
+
+// Run runs every conformance test as a subtest of t.
+func Run(t *testing.T, cfg Config) {
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = fmt.Sprintf("/conformance/%d/", time.Now().UnixNano())
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, &suite{Config: cfg, t: t, prefix: cfg.Prefix + tt.name + "/"})
+		})
+	}
+}
+
+var tests = []struct {
+	name string
+	fn   func(*testing.T, *suite)
+}{
+	{"PutGet", testPutGet},
+	{"GetMissing", testGetMissing},
+	{"Delete", testDelete},
+	{"Revision", testRevision},
+	{"MethodNotAllowed", testMethodNotAllowed},
+	{"TxnSuccess", testTxnSuccess},
+	{"TxnFailure", testTxnFailure},
+	{"TxnBadRequest", testTxnBadRequest},
+	{"Idempotency", testIdempotency},
+	{"IfMatch", testIfMatch},
+	{"AppendPatch", testAppendPatch},
+	{"Watch", testWatch},
+	{"WatchPrefix", testWatchPrefix},
+	{"WebSocket", testWebSocket},
+	{"Health", testHealth},
+	{"Members", testMembers},
+}
+
+func testPutGet(t *testing.T, s *suite) {
+	key := s.key("foo")
+	s.put(key, "bar")
+	if v := s.mustGet(key); v != "bar" {
+		t.Fatalf("GET %s = %q, want %q", key, v, "bar")
+	}
+	s.put(key, "")
+	if v := s.mustGet(key); v != "" {
+		t.Fatalf("GET %s = %q after writing an empty value", key, v)
+	}
+}
+
+func testGetMissing(t *testing.T, s *suite) {
+	resp := s.do(http.MethodGet, "/kv"+s.key("missing"), nil, nil)
+	s.expectStatus(resp, http.StatusNotFound)
+}
+
+func testDelete(t *testing.T, s *suite) {
+	key := s.key("foo")
+	s.put(key, "bar")
+	s.expectStatus(s.do(http.MethodDelete, "/kv"+key, nil, nil), http.StatusNoContent)
+	s.expectStatus(s.do(http.MethodGet, "/kv"+key, nil, nil), http.StatusNotFound)
+	s.expectStatus(s.do(http.MethodDelete, "/kv"+key, nil, nil), http.StatusNotFound)
+}
+
+func testRevision(t *testing.T, s *suite) {
+	key := s.key("foo")
+	s.put(key, "1")
+	rev1 := s.rev(key)
+	s.put(key, "2")
+	rev2 := s.rev(key)
+	if rev2 <= rev1 {
+		t.Fatalf("revision did not grow with a write: %d then %d", rev1, rev2)
+	}
+	// the member already applied rev2, minRev does not wait
+	resp := s.do(http.MethodGet, "/kv"+key+"?minRev="+strconv.FormatInt(rev2, 10), nil, nil)
+	if v := s.expectStatus(resp, http.StatusOK); v != "2" {
+		t.Fatalf("GET ?minRev=%d = %q, want %q", rev2, v, "2")
+	}
+	resp = s.do(http.MethodGet, "/kv"+key+"?serializable=true", nil, nil)
+	if v := s.expectStatus(resp, http.StatusOK); v != "2" {
+		t.Fatalf("GET ?serializable=true = %q, want %q", v, "2")
+	}
+	s.expectStatus(s.do(http.MethodGet, "/kv"+key+"?minRev=x", nil, nil), http.StatusBadRequest)
+}
+
+func testMethodNotAllowed(t *testing.T, s *suite) {
+	s.expectStatus(s.do(http.MethodPost, "/kv"+s.key("foo"), nil, nil), http.StatusMethodNotAllowed)
+	s.expectStatus(s.do(http.MethodGet, "/txn", nil, nil), http.StatusMethodNotAllowed)
+	s.expectStatus(s.do(http.MethodPost, "/watch"+s.key("foo"), nil, nil), http.StatusMethodNotAllowed)
+}
+
+func testTxnSuccess(t *testing.T, s *suite) {
+	key, other := s.key("foo"), s.key("other")
+	s.put(key, "bar")
+	resp := s.txn(&api.TxnRequest{
+		Compare: []api.Compare{{Target: api.CompareValue, Result: api.CompareEqual, Key: key, Value: "bar"}},
+		Success: []api.Op{{Type: api.OpPut, Key: key, Value: "baz"}, {Type: api.OpGet, Key: key}, {Type: api.OpPut, Key: other, Value: "x"}},
+		Failure: []api.Op{{Type: api.OpDelete, Key: key}},
+	})
+	if !resp.Succeeded {
+		t.Fatal("txn failed although its compare holds")
+	}
+	if len(resp.Responses) != 3 {
+		t.Fatalf("txn returned %d responses, want one per success op", len(resp.Responses))
+	}
+	if r := resp.Responses[1]; r.Type != api.OpGet || !r.Found || r.Value != "baz" {
+		t.Fatalf("get inside txn = %+v, want the value written before it", r)
+	}
+	if v := s.mustGet(other); v != "x" {
+		t.Fatalf("GET %s = %q after txn", other, v)
+	}
+}
+
+func testTxnFailure(t *testing.T, s *suite) {
+	key := s.key("foo")
+	s.put(key, "bar")
+	resp := s.txn(&api.TxnRequest{
+		Compare: []api.Compare{
+			{Target: api.CompareValue, Result: api.CompareEqual, Key: key, Value: "bar"},
+			{Target: api.CompareExists, Result: api.CompareEqual, Key: s.key("missing"), Value: "true"},
+		},
+		Success: []api.Op{{Type: api.OpPut, Key: key, Value: "baz"}},
+		Failure: []api.Op{{Type: api.OpDelete, Key: key}},
+	})
+	if resp.Succeeded {
+		t.Fatal("txn succeeded although one of its compares fails")
+	}
+	if len(resp.Responses) != 1 || !resp.Responses[0].Found {
+		t.Fatalf("txn responses = %+v, want the failure delete to find the key", resp.Responses)
+	}
+	s.expectStatus(s.do(http.MethodGet, "/kv"+key, nil, nil), http.StatusNotFound)
+}
+
+func testTxnBadRequest(t *testing.T, s *suite) {
+	s.expectStatus(s.do(http.MethodPost, "/txn", strings.NewReader("{"), nil), http.StatusBadRequest)
+}
+
+func testIdempotency(t *testing.T, s *suite) {
+	key := s.key("foo")
+	header := http.Header{"Idempotency-Key": {strings.TrimSuffix(s.prefix, "/")}}
+	s.expectStatus(s.do(http.MethodPut, "/kv"+key, strings.NewReader("first"), header), http.StatusNoContent)
+	s.expectStatus(s.do(http.MethodPut, "/kv"+key, strings.NewReader("retry"), header), http.StatusNoContent)
+	if v := s.mustGet(key); v != "first" {
+		t.Fatalf("GET %s = %q, a retry with the same Idempotency-Key must not be applied", key, v)
+	}
+
+	// a retried update answers the pair the first one wrote
+	appended, patched := s.key("log"), s.key("doc")
+	for _, u := range []struct{ path, body string }{
+		{"/kv" + appended + "?append=true", "a"},
+		{"/kv" + patched, `{"a":1}`},
+	} {
+		header := http.Header{"Idempotency-Key": {strings.TrimSuffix(s.prefix, "/") + u.path}}
+		first := s.do(http.MethodPatch, u.path, strings.NewReader(u.body), header)
+		s.expectStatus(first, http.StatusNoContent)
+		retry := s.do(http.MethodPatch, u.path, strings.NewReader(u.body), header)
+		s.expectStatus(retry, http.StatusNoContent)
+		if got, want := retry.Header.Get("ETag"), first.Header.Get("ETag"); got != want {
+			t.Fatalf("PATCH %s retried: ETag %q, want %q", u.path, got, want)
+		}
+	}
+	if v := s.mustGet(appended); v != "a" {
+		t.Fatalf("GET %s = %q, a retried append must not be applied", appended, v)
+	}
+}
+
+func testIfMatch(t *testing.T, s *suite) {
+	key := s.key("foo")
+	ifMatch := func(tag string) http.Header { return http.Header{"If-Match": {tag}} }
+	s.expectStatus(s.do(http.MethodPut, "/kv"+key, strings.NewReader("x"), ifMatch("*")), http.StatusPreconditionFailed)
+	s.put(key, "1")
+	resp := s.do(http.MethodGet, "/kv"+key, nil, nil)
+	s.expectStatus(resp, http.StatusOK)
+	tag := resp.Header.Get("ETag")
+	if tag != `"`+resp.Header.Get("X-Metcd-Mod-Revision")+`"` {
+		t.Fatalf("GET %s: ETag %q, want the quoted mod revision", key, tag)
+	}
+
+	resp = s.do(http.MethodPut, "/kv"+key, strings.NewReader("2"), ifMatch(tag))
+	s.expectStatus(resp, http.StatusNoContent)
+	newTag := resp.Header.Get("ETag")
+	if newTag == "" || newTag == tag {
+		t.Fatalf("PUT %s: ETag %q, want the tag of the new value", key, newTag)
+	}
+	// the key changed since tag was read
+	s.expectStatus(s.do(http.MethodPut, "/kv"+key, strings.NewReader("3"), ifMatch(tag)), http.StatusPreconditionFailed)
+	s.expectStatus(s.do(http.MethodDelete, "/kv"+key, nil, ifMatch(tag)), http.StatusPreconditionFailed)
+	s.expectStatus(s.do(http.MethodPut, "/kv"+key, strings.NewReader("3"), ifMatch("W/"+newTag)), http.StatusPreconditionFailed)
+	s.expectStatus(s.do(http.MethodPut, "/kv"+key, strings.NewReader("3"), ifMatch(tag+", "+newTag)), http.StatusBadRequest)
+	if v := s.mustGet(key); v != "2" {
+		t.Fatalf("GET %s = %q, a write whose If-Match fails must not be applied", key, v)
+	}
+	s.expectStatus(s.do(http.MethodDelete, "/kv"+key, nil, ifMatch(newTag)), http.StatusNoContent)
+	s.expectStatus(s.do(http.MethodGet, "/kv"+key, nil, nil), http.StatusNotFound)
+}
+
+func testAppendPatch(t *testing.T, s *suite) {
+	key, doc := s.key("log"), s.key("doc")
+	s.expectStatus(s.do(http.MethodPatch, "/kv"+key+"?append=true", strings.NewReader("a"), nil), http.StatusNoContent)
+	resp := s.do(http.MethodPatch, "/kv"+key+"?append=true", strings.NewReader("b"), nil)
+	s.expectStatus(resp, http.StatusNoContent)
+	if v := resp.Header.Get("X-Metcd-Version"); v != "2" {
+		t.Fatalf("PATCH %s?append=true: X-Metcd-Version %q, want 2", key, v)
+	}
+	if v := s.mustGet(key); v != "ab" {
+		t.Fatalf("GET %s = %q, want %q", key, v, "ab")
+	}
+
+	s.put(doc, `{"a":1,"b":{"c":2}}`)
+	s.expectStatus(s.do(http.MethodPatch, "/kv"+doc, strings.NewReader(`{"a":null,"b":{"d":3}}`), nil), http.StatusNoContent)
+	if v := s.mustGet(doc); v != `{"b":{"c":2,"d":3}}` {
+		t.Fatalf("GET %s = %q, want the merge patch applied", doc, v)
+	}
+	s.expectStatus(s.do(http.MethodPatch, "/kv"+doc, strings.NewReader("{"), nil), http.StatusBadRequest)
+	s.expectStatus(s.do(http.MethodPatch, "/kv"+key, strings.NewReader("{}"), nil), http.StatusConflict)
+}
+
+func testWatch(t *testing.T, s *suite) {
+	key := s.key("foo")
+	events := s.watch("/watch" + key)
+	s.put(s.key("foo2"), "ignored")
+	s.put(key, "bar")
+	put := s.expectEvent(events, api.Event{Type: api.EventPut, Key: key, Value: "bar"})
+	if put.Version != 1 || put.ModRevision <= 0 || put.CreateRevision != put.ModRevision {
+		t.Fatalf("watch event %+v, want a new key at version 1 created at its mod revision", put)
+	}
+	s.expectStatus(s.do(http.MethodDelete, "/kv"+key, nil, nil), http.StatusNoContent)
+	if del := s.expectEvent(events, api.Event{Type: api.EventDelete, Key: key}); del.ModRevision <= put.ModRevision {
+		t.Fatalf("delete event at revision %d, want after the put at %d", del.ModRevision, put.ModRevision)
+	}
+}
+
+func testWatchPrefix(t *testing.T, s *suite) {
+	events := s.watch("/watch" + s.key("dir/") + "?prefix=true")
+	s.put(s.key("other"), "ignored")
+	s.put(s.key("dir/a"), "1")
+	s.put(s.key("dir/b"), "2")
+	s.expectEvent(events, api.Event{Type: api.EventPut, Key: s.key("dir/a"), Value: "1"})
+	s.expectEvent(events, api.Event{Type: api.EventPut, Key: s.key("dir/b"), Value: "2"})
+}
+
+func testWebSocket(t *testing.T, s *suite) {
+	conn, err := websocket.Dial(s.Endpoint+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	responses := make(chan api.WSResponse, 16)
+	go func() {
+		defer close(responses)
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var res api.WSResponse
+			if json.Unmarshal(msg, &res) == nil {
+				responses <- res
+			}
+		}
+	}()
+	key := s.key("foo")
+	// pipelined, answered in order
+	for _, req := range []api.WSRequest{
+		{ID: 1, Op: api.WSWatch, Key: key},
+		{ID: 2, Op: api.WSPut, Key: key, Value: "bar"},
+		{ID: 3, Op: api.WSGet, Key: key},
+		{ID: 4, Op: api.WSTxn, Txn: &api.TxnRequest{Success: []api.Op{{Type: api.OpDelete, Key: key}}}},
+		{ID: 5, Op: api.WSCancel},
+		{ID: 1, Op: api.WSCancel},
+	} {
+		data, _ := json.Marshal(req)
+		if err := conn.WriteMessage(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var replies []api.WSResponse
+	var events []api.Event
+	for len(replies) < 4 || len(events) < 2 {
+		var res api.WSResponse
+		select {
+		case r, ok := <-responses:
+			if !ok {
+				t.Fatalf("connection closed after %+v and events %+v", replies, events)
+			}
+			res = r
+		case <-time.After(s.Timeout):
+			t.Fatalf("no response within %v after %+v and events %+v", s.Timeout, replies, events)
+		}
+		if res.ID == 1 && res.Event != nil {
+			events = append(events, *res.Event)
+		} else {
+			replies = append(replies, res)
+		}
+	}
+	switch {
+	case replies[0].ID != 2 || replies[0].KV == nil || replies[0].KV.Version != 1:
+		t.Fatalf("put answered %+v, want the written key", replies[0])
+	case replies[1].ID != 3 || replies[1].KV == nil || replies[1].KV.Value != "bar":
+		t.Fatalf("get answered %+v, want bar", replies[1])
+	case replies[2].ID != 4 || replies[2].Txn == nil || !replies[2].Txn.Succeeded:
+		t.Fatalf("txn answered %+v, want a success", replies[2])
+	case replies[3].ID != 5 || replies[3].Error == "":
+		t.Fatalf("cancel of no watch answered %+v, want an error", replies[3])
+	case events[0].Type != api.EventPut || events[0].Value != "bar" || events[1].Type != api.EventDelete:
+		t.Fatalf("watch events %+v, want the put and delete of %s", events, key)
+	}
+	select {
+	case res := <-responses:
+		if res.ID != 1 || !res.Canceled {
+			t.Fatalf("cancel answered %+v, want the watch canceled", res)
+		}
+	case <-time.After(s.Timeout):
+		t.Fatalf("watch not canceled within %v", s.Timeout)
+	}
+}
+
+func testHealth(t *testing.T, s *suite) {
+	var health api.Health
+	s.getJSON("/health", &health)
+	if !health.Health || health.Leader == 0 {
+		t.Fatalf("health = %+v, want healthy with a leader", health)
+	}
+}
+
+func testMembers(t *testing.T, s *suite) {
+	var members []api.Member
+	s.getJSON("/cluster/members", &members)
+	leaders := 0
+	for _, m := range members {
+		if m.ID == 0 || m.PeerURL == "" {
+			t.Fatalf("member without ID or peer URL: %+v", m)
+		}
+		if m.IsLeader {
+			leaders++
+		}
+	}
+	if len(members) == 0 || leaders != 1 {
+		t.Fatalf("members = %+v, want one leader", members)
+	}
+	// a page at a time
+	var page []api.Member
+	path := "/cluster/members?limit=1"
+	for i := 0; ; i++ {
+		var got []api.Member
+		resp := s.do(http.MethodGet, path, nil, nil)
+		if err := json.Unmarshal([]byte(s.expectStatus(resp, http.StatusOK)), &got); err != nil || len(got) != 1 {
+			t.Fatalf("GET %s = %+v (%v), want one member", path, got, err)
+		}
+		page = append(page, got...)
+		next := resp.Header.Get("X-Metcd-Continue")
+		if next == "" || i == len(members) {
+			break
+		}
+		path = "/cluster/members?limit=1&continue=" + next
+	}
+	if len(page) != len(members) {
+		t.Fatalf("paginated members = %+v, want %+v", page, members)
+	}
+	s.expectStatus(s.do(http.MethodPost, "/cluster/members", strings.NewReader("{}"), nil), http.StatusBadRequest)
+}
+
+// suite is the state of a single conformance test.
+type suite struct {
+	Config
+	t      *testing.T
+	prefix string
+}
+
+// key returns name below the prefix of the test.
+func (s *suite) key(name string) string { return s.prefix + name }
+
+// do sends a request and closes the response body when the test ends.
+func (s *suite) do(method, path string, body io.Reader, header http.Header) *http.Response {
+	s.t.Helper()
+	req, err := http.NewRequest(method, s.Endpoint+path, body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	client := *s.Client
+	client.Timeout = s.Timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		s.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	s.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// expectStatus fails the test unless resp has the status code, and returns
+// the body.
+func (s *suite) expectStatus(resp *http.Response, code int) string {
+	s.t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatalf("%s %s: reading the body: %v", resp.Request.Method, resp.Request.URL.Path, err)
+	}
+	if resp.StatusCode != code {
+		s.t.Fatalf("%s %s: status %d (%s), want %d", resp.Request.Method, resp.Request.URL.RequestURI(),
+			resp.StatusCode, bytes.TrimSpace(b), code)
+	}
+	return string(b)
+}
+
+func (s *suite) put(key, value string) {
+	s.t.Helper()
+	s.expectStatus(s.do(http.MethodPut, "/kv"+key, strings.NewReader(value), nil), http.StatusNoContent)
+}
+
+func (s *suite) mustGet(key string) string {
+	s.t.Helper()
+	return s.expectStatus(s.do(http.MethodGet, "/kv"+key, nil, nil), http.StatusOK)
+}
+
+// rev returns the revision a linearizable read of key reports.
+func (s *suite) rev(key string) int64 {
+	s.t.Helper()
+	resp := s.do(http.MethodGet, "/kv"+key, nil, nil)
+	s.expectStatus(resp, http.StatusOK)
+	rev, err := strconv.ParseInt(resp.Header.Get("X-Metcd-Revision"), 10, 64)
+	if err != nil {
+		s.t.Fatalf("GET %s: bad X-Metcd-Revision header (%v)", key, err)
+	}
+	return rev
+}
+
+func (s *suite) txn(txn *api.TxnRequest) *api.TxnResponse {
+	s.t.Helper()
+	b, err := json.Marshal(txn)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp := s.do(http.MethodPost, "/txn", bytes.NewReader(b), http.Header{"Content-Type": {"application/json"}})
+	var tr api.TxnResponse
+	if err := json.Unmarshal([]byte(s.expectStatus(resp, http.StatusOK)), &tr); err != nil {
+		s.t.Fatalf("POST /txn: decoding the response: %v", err)
+	}
+	return &tr
+}
+
+func (s *suite) getJSON(path string, v interface{}) {
+	s.t.Helper()
+	if err := json.Unmarshal([]byte(s.expectStatus(s.do(http.MethodGet, path, nil, nil), http.StatusOK)), v); err != nil {
+		s.t.Fatalf("GET %s: decoding the response: %v", path, err)
+	}
+}
+
+// watch opens a watch and returns its events. The watch is registered once
+// the response headers arrived, and ends with the test.
+func (s *suite) watch(path string) <-chan api.Event {
+	s.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.Endpoint+path, nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	// the stream outlives a request timeout
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		s.t.Fatalf("GET %s: %v", path, err)
+	}
+	s.t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("GET %s: status %d, want %d", path, resp.StatusCode, http.StatusOK)
+	}
+	events := make(chan api.Event, 16)
+	go func() {
+		defer close(events)
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			var ev api.Event
+			if json.Unmarshal(sc.Bytes(), &ev) == nil {
+				events <- ev
+			}
+		}
+	}()
+	return events
+}
+
+// expectEvent reads the next event, which must have the type, key and value
+// of want, and returns it with its metadata.
+func (s *suite) expectEvent(events <-chan api.Event, want api.Event) api.Event {
+	s.t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			s.t.Fatalf("watch ended, want %+v", want)
+		}
+		if ev.Type != want.Type || ev.Key != want.Key || ev.Value != want.Value {
+			s.t.Fatalf("watch event %+v, want %+v", ev, want)
+		}
+		return ev
+	case <-time.After(s.Timeout):
+		s.t.Fatalf("no watch event within %v, want %+v", s.Timeout, want)
+	}
+	return api.Event{}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"metcd/conformance"
+	"metcd/raftnode"
+	"net"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+// TestConformance runs the conformance suite against a single member.
+func TestConformance(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := fmt.Sprintf("http://%s", ln.Addr())
+	ln.Close()
+	dir, err := os.MkdirTemp("", "metcd-conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	proposePipe := &raftnode.ProposePipe{ProposeC: make(chan []byte)}
+	defer proposePipe.Close()
+	confChangeC := make(chan raftpb.ConfChange)
+	defer close(confChangeC)
+
+	var kvs *kvstore
+	getSnapshot := func() ([]byte, error) { return kvs.getSnapshot() }
+	rc := raftnode.NewRaftNode(1, []string{peer}, false, getSnapshot, proposePipe, confChangeC, raftnode.WithDataDir(dir))
+	kvs = newKVStore(rc.ID(), <-rc.SnapshotterReady(), proposePipe, rc.CommitC(), rc.ErrorC(), nil)
+
+	srv := httptest.NewServer(newHTTPHandler(&httpKVAPI{
+		store:       kvs,
+		rc:          rc,
+		confChangeC: confChangeC,
+		requests:    newRequestTracker(),
+	}))
+	defer srv.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for rc.LeaderID() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader elected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conformance.Run(t, conformance.Config{Endpoint: srv.URL, Client: srv.Client()})
+}
@@ -0,0 +1,86 @@
+// Package controller runs membership controllers on the leader.
+package controller
+
+import (
+	"context"
+	"metcd/api"
+	"metcd/raftnode"
+	"time"
+)
+
+// Cluster is the view of the local raft member the controllers act on.
+type Cluster interface {
+	ID() uint64
+	IsLeader() bool
+	Members() []raftnode.Member
+	// ActiveSince returns when the connection to member id was established,
+	// the zero time if it is not connected.
+	ActiveSince(id uint64) time.Time
+	// Progress returns the index replicated to each member as known by the
+	// leader, nil on a follower.
+	Progress() map[uint64]uint64
+	// RemoveMember proposes removing member id.
+	RemoveMember(ctx context.Context, id uint64) error
+	// PromoteMember proposes promoting learner id to a voter.
+	PromoteMember(ctx context.Context, id uint64) error
+}
+
+// Alarms activates and lists the cluster alarms.
+type Alarms interface {
+	Alarm(ctx context.Context, req api.AlarmRequest) error
+	Alarms() []api.Alarm
+}
+
+// Observers tells the learners that are never promoted.
+type Observers interface {
+	IsObserver(id uint64) bool
+}
+
+// Controller runs until it is stopped.
+type Controller interface {
+	// Run starts the controller in the background.
+	Run()
+	// Stop stops the controller and waits for it to exit.
+	Stop()
+}
+
+// proposeTimeout bounds a single proposal of a controller.
+const proposeTimeout = 5 * time.Second
+
+// runner calls step every interval until stopped.
+type runner struct {
+	interval time.Duration
+	step     func(now time.Time)
+	stopc    chan struct{}
+	donec    chan struct{}
+}
+
+func newRunner(interval time.Duration, step func(now time.Time)) *runner {
+	return &runner{
+		interval: interval,
+		step:     step,
+		stopc:    make(chan struct{}),
+		donec:    make(chan struct{}),
+	}
+}
+
+func (r *runner) Run() {
+	go func() {
+		defer close(r.donec)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				r.step(now)
+			case <-r.stopc:
+				return
+			}
+		}
+	}()
+}
+
+func (r *runner) Stop() {
+	close(r.stopc)
+	<-r.donec
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"metcd/api"
+	"metcd/raftnode"
+	"time"
+)
+
+// maxDeadMemberCheckInterval caps how often the dead member controller
+// looks at the connections.
+const maxDeadMemberCheckInterval = 5 * time.Second
+
+// deadMember raises an UNREACHABLE alarm for members the leader could not
+// reach for longer than timeout and optionally removes them.
+type deadMember struct {
+	*runner
+	timeout time.Duration
+	remove  bool
+	cluster Cluster
+	alarms  Alarms
+
+	// down records since when a member was seen disconnected
+	down map[uint64]time.Time
+}
+
+// NewDeadMember creates the dead member controller. With remove set a dead
+// member is also removed from the cluster, as long as the remaining members
+// keep a quorum.
+func NewDeadMember(timeout time.Duration, remove bool, cluster Cluster, alarms Alarms) (Controller, error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("controller: invalid dead member timeout %v", timeout)
+	}
+	return newDeadMember(timeout, remove, cluster, alarms), nil
+}
+
+func newDeadMember(timeout time.Duration, remove bool, cluster Cluster, alarms Alarms) *deadMember {
+	d := &deadMember{
+		timeout: timeout,
+		remove:  remove,
+		cluster: cluster,
+		alarms:  alarms,
+		down:    make(map[uint64]time.Time),
+	}
+	interval := timeout / 2
+	if interval > maxDeadMemberCheckInterval {
+		interval = maxDeadMemberCheckInterval
+	}
+	d.runner = newRunner(interval, d.step)
+	return d
+}
+
+func (d *deadMember) step(now time.Time) {
+	if !d.cluster.IsLeader() {
+		// a new leader measures the timeout from scratch
+		clear(d.down)
+		return
+	}
+	members := d.cluster.Members()
+	alarmed := make(map[uint64]bool)
+	for _, a := range d.alarms.Alarms() {
+		if a.Alarm == api.AlarmUnreachable {
+			alarmed[a.MemberID] = true
+		}
+	}
+
+	var voters, activeVoters int
+	isMember := make(map[uint64]bool, len(members))
+	var dead []raftnode.Member
+	for _, m := range members {
+		isMember[m.ID] = true
+		active := m.ID == d.cluster.ID() || !d.cluster.ActiveSince(m.ID).IsZero()
+		if !m.IsLearner {
+			voters++
+			if active {
+				activeVoters++
+			}
+		}
+		if active {
+			delete(d.down, m.ID)
+			if alarmed[m.ID] {
+				log.Printf("controller: member %d is reachable again", m.ID)
+				d.alarm(api.AlarmDeactivate, m.ID)
+			}
+			continue
+		}
+		since, ok := d.down[m.ID]
+		if !ok {
+			d.down[m.ID] = now
+			continue
+		}
+		if now.Sub(since) < d.timeout {
+			continue
+		}
+		if !alarmed[m.ID] {
+			log.Printf("controller: member %d has been unreachable since %v", m.ID, since.Format(time.RFC3339))
+			d.alarm(api.AlarmActivate, m.ID)
+		}
+		dead = append(dead, m)
+	}
+	// forget members removed in the meantime
+	for id := range d.down {
+		if !isMember[id] {
+			delete(d.down, id)
+		}
+	}
+	for id := range alarmed {
+		if !isMember[id] {
+			d.alarm(api.AlarmDeactivate, id)
+		}
+	}
+
+	if !d.remove || len(dead) == 0 {
+		return
+	}
+	// remove one member per step, the membership is re-read before the next.
+	// Removing a dead voter must leave a quorum of the remaining voters.
+	var id uint64
+	for _, m := range dead {
+		if m.IsLearner || activeVoters >= (voters-1)/2+1 {
+			id = m.ID
+			break
+		}
+	}
+	if id == 0 {
+		log.Printf("controller: not removing dead members, the remaining members would lose quorum")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+	defer cancel()
+	if err := d.cluster.RemoveMember(ctx, id); err != nil {
+		log.Printf("controller: failed to remove dead member %d (%v)", id, err)
+		return
+	}
+	log.Printf("controller: removed dead member %d", id)
+	delete(d.down, id)
+}
+
+func (d *deadMember) alarm(action api.AlarmAction, id uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+	defer cancel()
+	req := api.AlarmRequest{Action: action, MemberID: id, Alarm: api.AlarmUnreachable}
+	if err := d.alarms.Alarm(ctx, req); err != nil {
+		log.Printf("controller: failed to %s alarm of member %d (%v)", action, id, err)
+	}
+}
@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"context"
+	"metcd/api"
+	"metcd/raftnode"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeCluster struct {
+	leader   bool
+	members  []raftnode.Member
+	active   map[uint64]bool
+	progress map[uint64]uint64
+	removed  []uint64
+	promoted []uint64
+}
+
+func (f *fakeCluster) ID() uint64                 { return 1 }
+func (f *fakeCluster) IsLeader() bool             { return f.leader }
+func (f *fakeCluster) Members() []raftnode.Member { return f.members }
+
+func (f *fakeCluster) ActiveSince(id uint64) time.Time {
+	if f.active[id] {
+		return time.Unix(1, 0)
+	}
+	return time.Time{}
+}
+
+func (f *fakeCluster) Progress() map[uint64]uint64 {
+	if !f.leader {
+		return nil
+	}
+	return f.progress
+}
+
+func (f *fakeCluster) PromoteMember(_ context.Context, id uint64) error {
+	f.promoted = append(f.promoted, id)
+	for i := range f.members {
+		if f.members[i].ID == id {
+			f.members[i].IsLearner = false
+		}
+	}
+	return nil
+}
+
+func (f *fakeCluster) RemoveMember(_ context.Context, id uint64) error {
+	f.removed = append(f.removed, id)
+	for i, m := range f.members {
+		if m.ID == id {
+			f.members = append(f.members[:i:i], f.members[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+type fakeAlarms map[api.Alarm]bool
+
+func (f fakeAlarms) Alarm(_ context.Context, req api.AlarmRequest) error {
+	a := api.Alarm{MemberID: req.MemberID, Alarm: req.Alarm}
+	if req.Action == api.AlarmActivate {
+		f[a] = true
+	} else {
+		delete(f, a)
+	}
+	return nil
+}
+
+func (f fakeAlarms) Alarms() []api.Alarm {
+	var alarms []api.Alarm
+	for a := range f {
+		alarms = append(alarms, a)
+	}
+	return alarms
+}
+
+func TestDeadMember(t *testing.T) {
+	fc := &fakeCluster{
+		leader:  true,
+		members: []raftnode.Member{{ID: 1}, {ID: 2}, {ID: 3}},
+		active:  map[uint64]bool{2: true},
+	}
+	alarms := fakeAlarms{}
+	d := newDeadMember(time.Minute, false, fc, alarms)
+	unreachable := api.Alarm{MemberID: 3, Alarm: api.AlarmUnreachable}
+
+	now := time.Unix(100, 0)
+	d.step(now)
+	d.step(now.Add(30 * time.Second))
+	if len(alarms) != 0 {
+		t.Fatalf("alarm raised before the timeout: %v", alarms)
+	}
+	d.step(now.Add(time.Minute))
+	if !alarms[unreachable] || len(alarms) != 1 {
+		t.Fatalf("expected alarm %v, got %v", unreachable, alarms)
+	}
+	if len(fc.removed) != 0 {
+		t.Fatalf("removed members with removal disabled: %v", fc.removed)
+	}
+
+	// the alarm is cleared once the member is back
+	fc.active[3] = true
+	d.step(now.Add(2 * time.Minute))
+	if len(alarms) != 0 {
+		t.Fatalf("expected no alarm, got %v", alarms)
+	}
+}
+
+func TestDeadMemberRemoval(t *testing.T) {
+	fc := &fakeCluster{
+		leader:  true,
+		members: []raftnode.Member{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4, IsLearner: true}},
+		active:  map[uint64]bool{},
+	}
+	alarms := fakeAlarms{}
+	d := newDeadMember(time.Minute, true, fc, alarms)
+
+	now := time.Unix(100, 0)
+	d.step(now)
+	// 2 and 3 are down: removing a voter would leave 1 of 2 voters, but the
+	// learner can go
+	d.step(now.Add(time.Minute))
+	if want := []uint64{4}; !reflect.DeepEqual(fc.removed, want) {
+		t.Fatalf("expected removal of %v, got %v", want, fc.removed)
+	}
+	d.step(now.Add(2 * time.Minute))
+	if want := []uint64{4}; !reflect.DeepEqual(fc.removed, want) {
+		t.Fatalf("expected removal of %v, got %v", want, fc.removed)
+	}
+	if _, ok := alarms[api.Alarm{MemberID: 4, Alarm: api.AlarmUnreachable}]; ok {
+		t.Fatal("alarm of the removed member was not cleared")
+	}
+
+	// with 2 back, 3 can be removed keeping 2 of 2 voters
+	fc.active[2] = true
+	d.step(now.Add(3 * time.Minute))
+	if want := []uint64{4, 3}; !reflect.DeepEqual(fc.removed, want) {
+		t.Fatalf("expected removal of %v, got %v", want, fc.removed)
+	}
+
+	// followers do nothing
+	fc.leader = false
+	fc.members = append(fc.members, raftnode.Member{ID: 5})
+	d.step(now.Add(4 * time.Minute))
+	d.step(now.Add(10 * time.Minute))
+	if len(fc.removed) != 2 {
+		t.Fatalf("follower removed members: %v", fc.removed)
+	}
+}
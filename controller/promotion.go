@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// promotionCheckInterval is how often the promotion controller looks at the
+// progress of the learners.
+const promotionCheckInterval = time.Second
+
+// learnerPromotion promotes a learner whose log stayed within threshold
+// entries of the leader's for at least sustain, unless it is an observer.
+type learnerPromotion struct {
+	*runner
+	threshold uint64
+	sustain   time.Duration
+	cluster   Cluster
+	observers Observers // nil if there are none
+
+	// caughtUp records since when a learner was seen within the threshold
+	caughtUp map[uint64]time.Time
+}
+
+// NewLearnerPromotion creates the learner promotion controller, leaving
+// alone the observers, which may be nil.
+func NewLearnerPromotion(threshold uint64, sustain time.Duration, cluster Cluster, observers Observers) (Controller, error) {
+	if sustain < 0 {
+		return nil, fmt.Errorf("controller: invalid learner promotion delay %v", sustain)
+	}
+	return newLearnerPromotion(threshold, sustain, cluster, observers), nil
+}
+
+func newLearnerPromotion(threshold uint64, sustain time.Duration, cluster Cluster, observers Observers) *learnerPromotion {
+	p := &learnerPromotion{
+		threshold: threshold,
+		sustain:   sustain,
+		cluster:   cluster,
+		observers: observers,
+		caughtUp:  make(map[uint64]time.Time),
+	}
+	p.runner = newRunner(promotionCheckInterval, p.step)
+	return p
+}
+
+func (p *learnerPromotion) step(now time.Time) {
+	var progress map[uint64]uint64
+	if p.cluster.IsLeader() {
+		progress = p.cluster.Progress()
+	}
+	if progress == nil {
+		clear(p.caughtUp)
+		return
+	}
+	leaderMatch := progress[p.cluster.ID()]
+
+	var ready []uint64
+	learners := make(map[uint64]bool)
+	for _, m := range p.cluster.Members() {
+		if !m.IsLearner || (p.observers != nil && p.observers.IsObserver(m.ID)) {
+			continue
+		}
+		learners[m.ID] = true
+		match, ok := progress[m.ID]
+		if !ok || match+p.threshold < leaderMatch {
+			delete(p.caughtUp, m.ID)
+			continue
+		}
+		since, ok := p.caughtUp[m.ID]
+		if !ok {
+			p.caughtUp[m.ID] = now
+			since = now
+		}
+		if now.Sub(since) >= p.sustain {
+			ready = append(ready, m.ID)
+		}
+	}
+	for id := range p.caughtUp {
+		if !learners[id] {
+			delete(p.caughtUp, id)
+		}
+	}
+	if len(ready) == 0 {
+		return
+	}
+
+	// promote one learner per step, the membership is re-read before the next
+	id := ready[0]
+	ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+	defer cancel()
+	if err := p.cluster.PromoteMember(ctx, id); err != nil {
+		log.Printf("controller: failed to promote learner %d (%v)", id, err)
+		return
+	}
+	log.Printf("controller: promoted learner %d, it stayed within %d entries of the leader for %v", id, p.threshold, p.sustain)
+	delete(p.caughtUp, id)
+}
@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"metcd/raftnode"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLearnerPromotion(t *testing.T) {
+	fc := &fakeCluster{
+		leader:   true,
+		members:  []raftnode.Member{{ID: 1}, {ID: 2}, {ID: 3, IsLearner: true}, {ID: 4, IsLearner: true}},
+		progress: map[uint64]uint64{1: 1000, 2: 1000, 3: 500, 4: 950},
+	}
+	p := newLearnerPromotion(100, 10*time.Second, fc, nil)
+
+	now := time.Unix(100, 0)
+	p.step(now)
+	p.step(now.Add(5 * time.Second))
+	if len(fc.promoted) != 0 {
+		t.Fatalf("promoted before the delay: %v", fc.promoted)
+	}
+	// 4 falls behind and starts over
+	fc.progress[4] = 800
+	p.step(now.Add(8 * time.Second))
+	fc.progress[4] = 2000
+	fc.progress[1] = 2000
+	p.step(now.Add(10 * time.Second))
+	if len(fc.promoted) != 0 {
+		t.Fatalf("promoted a learner that fell behind: %v", fc.promoted)
+	}
+	p.step(now.Add(20 * time.Second))
+	if want := []uint64{4}; !reflect.DeepEqual(fc.promoted, want) {
+		t.Fatalf("expected promotion of %v, got %v", want, fc.promoted)
+	}
+
+	// leadership is needed to see the progress at all
+	fc.progress[3] = 2000
+	fc.leader = false
+	p.step(now.Add(30 * time.Second))
+	fc.leader = true
+	p.step(now.Add(31 * time.Second))
+	if want := []uint64{4}; !reflect.DeepEqual(fc.promoted, want) {
+		t.Fatalf("expected promotion of %v, got %v", want, fc.promoted)
+	}
+	p.step(now.Add(41 * time.Second))
+	if want := []uint64{4, 3}; !reflect.DeepEqual(fc.promoted, want) {
+		t.Fatalf("expected promotion of %v, got %v", want, fc.promoted)
+	}
+}
+
+type observerSet map[uint64]bool
+
+func (o observerSet) IsObserver(id uint64) bool { return o[id] }
+
+func TestLearnerPromotionSkipsObservers(t *testing.T) {
+	fc := &fakeCluster{
+		leader:   true,
+		members:  []raftnode.Member{{ID: 1}, {ID: 2, IsLearner: true}, {ID: 3, IsLearner: true}},
+		progress: map[uint64]uint64{1: 1000, 2: 1000, 3: 1000},
+	}
+	p := newLearnerPromotion(100, 0, fc, observerSet{2: true})
+	now := time.Unix(100, 0)
+	p.step(now)
+	p.step(now.Add(time.Second))
+	if want := []uint64{3}; !reflect.DeepEqual(fc.promoted, want) {
+		t.Fatalf("expected only learner 3 to be promoted, got %v", fc.promoted)
+	}
+}
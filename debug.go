@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"metcd/api"
+	"metcd/failpoint"
+	"metcd/raftnode"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	runtimepprof "runtime/pprof"
+	"strings"
+)
+
+// mapEntryOverhead estimates the memory a key takes besides its key and
+// value: the entries of the value and revision maps and their buckets.
+const mapEntryOverhead = 128
+
+// debugAPI serves the profiling and runtime endpoints, on a listener of
+// their own since they expose the internals of the member.
+type debugAPI struct {
+	store *kvstore
+	// files lists the files of the WAL and snapshot directories
+	files func() (wal, snaps []raftnode.FileSize, err error)
+	// token, if set, is the bearer token every request must carry
+	token string
+}
+
+// newDebugHandler routes the debug endpoints.
+func newDebugHandler(h *debugAPI) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", serveGoroutines)
+	mux.HandleFunc("/debug/storage", h.serveStorage)
+	mux.HandleFunc("/debug/failpoints", serveFailpoints)
+	mux.HandleFunc("/debug/failpoints/", serveFailpoints)
+	if h.token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serveDebug serves the debug endpoints on addr, requiring the token read
+// from tokenFile if set.
+func serveDebug(addr, tokenFile string, tuning httpServerConfig, s *kvstore, rc *raftnode.RaftNode) error {
+	var token string
+	if tokenFile != "" {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return err
+		}
+		if token = strings.TrimSpace(string(b)); token == "" {
+			return errors.New("--debug-token-file is empty")
+		}
+	}
+	ln, err := tuning.listen(addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving the debug endpoints on %s", ln.Addr())
+	srv := tuning.server(newDebugHandler(&debugAPI{store: s, files: rc.DataFiles, token: token}))
+	go func() {
+		if err := tuning.serve(srv, ln); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return nil
+}
+
+// serveGoroutines handles GET /debug/goroutines, the stacks of every
+// goroutine with their pprof labels.
+func serveGoroutines(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// serveStorage handles GET /debug/storage.
+func (h *debugAPI) serveStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st := api.StorageStatus{Keyspaces: h.store.Keyspaces()}
+	for _, ks := range st.Keyspaces {
+		st.Keys += ks.Keys
+		st.Size += ks.Size
+	}
+	st.MemoryEstimate = st.Size + int64(st.Keys)*mapEntryOverhead
+	wal, snaps, err := h.files()
+	if err != nil {
+		log.Printf("Failed to list the data directory (%v)\n", err)
+		http.Error(w, "Failed to list the data directory", http.StatusInternalServerError)
+		return
+	}
+	st.WAL, st.WALSize = dataFiles(wal)
+	st.Snapshots, st.SnapshotSize = dataFiles(snaps)
+	writeJSON(w, st)
+}
+
+// serveFailpoints handles GET /debug/failpoints, the enabled failpoints, and
+// PUT and DELETE /debug/failpoints/<name>, which enable the failpoint with
+// the spec in the body and disable it.
+func serveFailpoints(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/debug/failpoints"), "/")
+	if name == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, failpoint.List())
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("Failed to read the failpoint spec (%v)\n", err)
+			http.Error(w, "Failed to read the failpoint spec", http.StatusBadRequest)
+			return
+		}
+		if err := failpoint.Enable(name, strings.TrimSpace(string(b))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("failpoint %s set to %q", name, strings.TrimSpace(string(b)))
+	case http.MethodDelete:
+		failpoint.Disable(name)
+		log.Printf("failpoint %s disabled", name)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func dataFiles(files []raftnode.FileSize) ([]api.DataFile, int64) {
+	out := make([]api.DataFile, len(files))
+	var total int64
+	for i, f := range files {
+		out[i] = api.DataFile{Name: f.Name, Size: f.Size}
+		total += f.Size
+	}
+	return out, total
+}
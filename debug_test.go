@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"metcd/api"
+	"metcd/failpoint"
+	"metcd/raftnode"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	s := newTestKVStore(map[string]string{"/a": "1", "/bb": "22"})
+	s.apply(kv{Op: opKeyspacePut, Keyspace: "app"})
+	s.apply(kv{Op: opPut, Keyspace: "app", Key: "/x", Val: "y"})
+	files := func() ([]raftnode.FileSize, []raftnode.FileSize, error) {
+		return []raftnode.FileSize{{Name: "0.wal", Size: 100}, {Name: "1.wal", Size: 50}},
+			[]raftnode.FileSize{{Name: "1.snap", Size: 7}}, nil
+	}
+	srv := httptest.NewServer(newDebugHandler(&debugAPI{store: s, files: files, token: "secret"}))
+	defer srv.Close()
+
+	get := func(path, token string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+	for _, token := range []string{"", "wrong"} {
+		if resp, _ := get("/debug/storage", token); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected 401 with token %q, got %d", token, resp.StatusCode)
+		}
+	}
+
+	resp, body := get("/debug/storage", "secret")
+	var st api.StorageStatus
+	if err := json.Unmarshal([]byte(body), &st); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("expected the storage status, got %d %s", resp.StatusCode, body)
+	}
+	switch {
+	case st.Keys != 3 || st.Size != 11 || len(st.Keyspaces) != 2:
+		t.Fatalf("expected 3 keys of 11 bytes in 2 keyspaces, got %+v", st)
+	case st.MemoryEstimate != 11+3*mapEntryOverhead:
+		t.Fatalf("expected the memory estimate, got %d", st.MemoryEstimate)
+	case st.WALSize != 150 || len(st.WAL) != 2 || st.SnapshotSize != 7 || st.Snapshots[0].Name != "1.snap":
+		t.Fatalf("expected the data files, got %+v", st)
+	}
+
+	if resp, body := get("/debug/goroutines", "secret"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "goroutine ") {
+		t.Fatalf("expected the goroutine dump, got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := get("/debug/pprof/", "secret"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "heap") {
+		t.Fatalf("expected the pprof index, got %d", resp.StatusCode)
+	}
+	if resp, body := get("/debug/vars", "secret"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "memstats") {
+		t.Fatalf("expected the expvars, got %d", resp.StatusCode)
+	}
+}
+
+func TestDebugFailpoints(t *testing.T) {
+	defer failpoint.Disable("raft/send@2")
+	srv := httptest.NewServer(newDebugHandler(&debugAPI{}))
+	defer srv.Close()
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	if code, _ := do(http.MethodPut, "/debug/failpoints/raft/send@2", "crash"); code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid spec to be rejected, got %d", code)
+	}
+	if code, _ := do(http.MethodPut, "/debug/failpoints/raft/send@2", "drop\n"); code != http.StatusNoContent {
+		t.Fatalf("expected the failpoint enabled, got %d", code)
+	}
+	var specs map[string]string
+	if _, body := do(http.MethodGet, "/debug/failpoints", ""); json.Unmarshal([]byte(body), &specs) != nil || specs["raft/send@2"] != "drop" {
+		t.Fatalf("expected the failpoint listed, got %s", body)
+	}
+	if code, _ := do(http.MethodDelete, "/debug/failpoints/raft/send@2", ""); code != http.StatusNoContent {
+		t.Fatalf("expected the failpoint disabled, got %d", code)
+	}
+	if _, body := do(http.MethodGet, "/debug/failpoints", ""); strings.TrimSpace(body) != "{}" {
+		t.Fatalf("expected no failpoint, got %s", body)
+	}
+	if code, _ := do(http.MethodPost, "/debug/failpoints", ""); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", code)
+	}
+}
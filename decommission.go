@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"metcd/api"
+	"metcd/raftnode"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+// decommissionTimeout bounds the leadership transfer and the removal of
+// POST /admin/decommission/<id>.
+var decommissionTimeout = 30 * time.Second
+
+// serveDecommission handles POST /admin/decommission/<id>: it moves the
+// leadership away from member id if it leads, removes it, and waits for the
+// removal to commit. The removed member marks its data directory, which is
+// deleted when it joins again; called on the member itself, the response
+// says so before it stops.
+func (h *httpKVAPI) serveDecommission(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/decommission/"), 0, 64)
+	if err != nil {
+		http.Error(w, "Failed to convert ID", http.StatusBadRequest)
+		return
+	}
+	members := h.rc.Members()
+	if findRaftMember(members, id) == nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if !h.guardResize(w, r, id, -1) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), decommissionTimeout)
+	defer cancel()
+
+	res := api.DecommissionResult{ID: id, Leader: h.rc.LeaderID()}
+	if res.Leader == id {
+		to := decommissionTransferee(members, h.rc.Progress(), h.rc.ID(), id)
+		if to == 0 {
+			http.Error(w, "No other voter to transfer the leadership to", http.StatusConflict)
+			return
+		}
+		log.Printf("decommission: transferring the leadership from %d to %d", id, to)
+		if err := h.rc.TransferLeadership(ctx, to); err != nil {
+			log.Printf("Failed to transfer the leadership away from %d (%v)\n", id, err)
+			http.Error(w, "Failed to transfer the leadership", http.StatusGatewayTimeout)
+			return
+		}
+		res.Leader = h.rc.LeaderID()
+	}
+
+	self := id == h.rc.ID()
+	setPhase(r.Context(), phaseProposing)
+	select {
+	case h.confChangeC <- raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: id}:
+	case <-ctx.Done():
+		http.Error(w, "Timed out proposing the removal", http.StatusGatewayTimeout)
+		return
+	}
+	if h.store.IsObserver(id) {
+		// a member added again with the same ID starts unmarked
+		if err := h.store.MarkObserver(ctx, id, false); err != nil {
+			log.Printf("Failed to unmark removed observer %d (%v)\n", id, err)
+		}
+	}
+	if self {
+		select {
+		case <-h.rc.Removed():
+			res.DataDirMarked = true
+		case <-ctx.Done():
+			http.Error(w, "Timed out waiting for the removal to commit", http.StatusGatewayTimeout)
+			return
+		}
+	} else {
+		for findRaftMember(h.rc.Members(), id) != nil {
+			select {
+			case <-time.After(raftnode.TickInterval):
+			case <-ctx.Done():
+				http.Error(w, "Timed out waiting for the removal to commit", http.StatusGatewayTimeout)
+				return
+			}
+		}
+	}
+	log.Printf("decommission: member %d removed", id)
+	writeJSON(w, res)
+}
+
+func findRaftMember(members []raftnode.Member, id uint64) *raftnode.Member {
+	for i := range members {
+		if members[i].ID == id {
+			return &members[i]
+		}
+	}
+	return nil
+}
+
+// decommissionTransferee returns the voter to move the leadership of id
+// to: the one the leader matched the most entries of when progress is
+// known, this member otherwise, 0 if there is no other voter.
+func decommissionTransferee(members []raftnode.Member, progress map[uint64]uint64, self, id uint64) uint64 {
+	var to, match uint64
+	for _, m := range members {
+		if m.IsLearner || m.ID == id {
+			continue
+		}
+		if progress == nil && m.ID == self {
+			return self
+		}
+		if to == 0 || progress[m.ID] > match {
+			to, match = m.ID, progress[m.ID]
+		}
+	}
+	return to
+}
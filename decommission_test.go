@@ -0,0 +1,48 @@
+package main
+
+import (
+	"metcd/raftnode"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecommissionTransferee(t *testing.T) {
+	members := []raftnode.Member{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4, IsLearner: true}}
+	for _, c := range []struct {
+		progress map[uint64]uint64
+		self, id uint64
+		want     uint64
+	}{
+		// on the leader, the voter it matched the most entries of
+		{map[uint64]uint64{1: 10, 2: 7, 3: 9, 4: 10}, 1, 1, 3},
+		// elsewhere, this member
+		{nil, 2, 1, 2},
+		// decommissioning this member, another voter
+		{nil, 1, 1, 2},
+	} {
+		if got := decommissionTransferee(members, c.progress, c.self, c.id); got != c.want {
+			t.Fatalf("%+v: expected %d, got %d", c, c.want, got)
+		}
+	}
+	if got := decommissionTransferee(members[:1], nil, 1, 1); got != 0 {
+		t.Fatalf("expected no voter to transfer to, got %d", got)
+	}
+}
+
+func TestServeDecommissionErrors(t *testing.T) {
+	h := &httpKVAPI{store: newTestKVStore(nil)}
+	for _, c := range []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodGet, "/admin/decommission/1", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/admin/decommission/x", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		h.serveDecommission(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.code, w.Code)
+		}
+	}
+}
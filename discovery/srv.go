@@ -0,0 +1,72 @@
+// Package discovery resolves the initial peer list of a cluster.
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrNoSRVRecords is returned when neither the TLS nor the plain SRV
+// service is published for the domain.
+var ErrNoSRVRecords = errors.New("discovery: no SRV records found")
+
+// lookupSRV is net.LookupSRV, replaced in tests.
+var lookupSRV = net.LookupSRV
+
+// SRVPeers returns the peer URLs published under
+// _metcd-server-ssl._tcp.<domain> (https) and _metcd-server._tcp.<domain>
+// (http). A non-empty serviceName is appended to the service as etcd does,
+// e.g. _metcd-server-<name>._tcp.
+//
+// The URLs are sorted so that every member resolving the same records
+// agrees on them; peer i of the result has node ID i+1.
+func SRVPeers(domain, serviceName string) ([]string, error) {
+	var urls []string
+	for _, svc := range []struct{ service, scheme string }{
+		{"metcd-server-ssl", "https"},
+		{"metcd-server", "http"},
+	} {
+		service := svc.service
+		if serviceName != "" {
+			service += "-" + serviceName
+		}
+		_, addrs, err := lookupSRV(service, "tcp", domain)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				continue
+			}
+			return nil, fmt.Errorf("discovery: lookup _%s._tcp.%s (%v)", service, domain, err)
+		}
+		for _, srv := range addrs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			u := url.URL{Scheme: svc.scheme, Host: net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))}
+			urls = append(urls, u.String())
+		}
+	}
+	if len(urls) == 0 {
+		return nil, ErrNoSRVRecords
+	}
+	sort.Strings(urls)
+	for i := 1; i < len(urls); i++ {
+		if urls[i] == urls[i-1] {
+			return nil, fmt.Errorf("discovery: duplicate peer %s", urls[i])
+		}
+	}
+	return urls, nil
+}
+
+// MemberID returns the node ID of peerURL in peers.
+func MemberID(peers []string, peerURL string) (int, error) {
+	for i, p := range peers {
+		if p == peerURL {
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("discovery: %s is not one of the discovered peers %v", peerURL, peers)
+}
@@ -0,0 +1,51 @@
+package discovery
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSRVPeers(t *testing.T) {
+	defer func() { lookupSRV = net.LookupSRV }()
+	records := map[string][]*net.SRV{
+		"_metcd-server._tcp.example.com": {
+			{Target: "node3.example.com.", Port: 2380},
+			{Target: "node1.example.com.", Port: 2380},
+		},
+		"_metcd-server-ssl._tcp.example.com": {
+			{Target: "node2.example.com.", Port: 2380},
+		},
+	}
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		fqdn := "_" + service + "._" + proto + "." + name
+		addrs, ok := records[fqdn]
+		if !ok {
+			return "", nil, &net.DNSError{Err: "no such host", Name: fqdn, IsNotFound: true}
+		}
+		return fqdn, addrs, nil
+	}
+
+	peers, err := SRVPeers("example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"http://node1.example.com:2380",
+		"http://node3.example.com:2380",
+		"https://node2.example.com:2380",
+	}
+	if !reflect.DeepEqual(peers, want) {
+		t.Fatalf("expected %v, got %v", want, peers)
+	}
+	if id, err := MemberID(peers, "http://node3.example.com:2380"); err != nil || id != 2 {
+		t.Fatalf("expected ID 2, got %d (%v)", id, err)
+	}
+	if _, err := MemberID(peers, "http://node4.example.com:2380"); err == nil {
+		t.Fatal("expected error for unknown peer")
+	}
+
+	if _, err := SRVPeers("example.org", ""); err != ErrNoSRVRecords {
+		t.Fatalf("expected %v, got %v", ErrNoSRVRecords, err)
+	}
+}
@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookupHost is net.DefaultResolver.LookupHost, replaced in tests.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// StatefulSet derives the members of a cluster run as a Kubernetes
+// StatefulSet: pod <Name>-<ordinal> is member ordinal+1, reached at
+// <Name>-<ordinal>.<Service>.<Namespace>.svc.<ClusterDomain> through the
+// headless service of the set.
+type StatefulSet struct {
+	Name          string
+	Service       string
+	Namespace     string
+	ClusterDomain string
+	Scheme        string // of the peer and client URLs, http by default
+	PeerPort      int
+	ClientPort    int
+}
+
+// ParsePodName splits the name of a StatefulSet pod into the name of the
+// set and the ordinal of the pod.
+func ParsePodName(pod string) (set string, ordinal int, err error) {
+	i := strings.LastIndexByte(pod, '-')
+	if i > 0 && strings.Trim(pod[i+1:], "0123456789") == "" {
+		if ordinal, err = strconv.Atoi(pod[i+1:]); err == nil {
+			return pod[:i], ordinal, nil
+		}
+	}
+	return "", 0, fmt.Errorf("discovery: %q is not the name of a StatefulSet pod, <set>-<ordinal>", pod)
+}
+
+// Host returns the DNS name of pod ordinal.
+func (s StatefulSet) Host(ordinal int) string {
+	domain := s.ClusterDomain
+	if domain == "" {
+		domain = "cluster.local"
+	}
+	return fmt.Sprintf("%s-%d.%s.%s.svc.%s", s.Name, ordinal, s.Service, s.Namespace, domain)
+}
+
+func (s StatefulSet) url(ordinal, port int) string {
+	scheme := s.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	u := url.URL{Scheme: scheme, Host: net.JoinHostPort(s.Host(ordinal), strconv.Itoa(port))}
+	return u.String()
+}
+
+// PeerURL returns the peer URL of pod ordinal.
+func (s StatefulSet) PeerURL(ordinal int) string {
+	return s.url(ordinal, s.PeerPort)
+}
+
+// ClientURL returns the client URL of pod ordinal.
+func (s StatefulSet) ClientURL(ordinal int) string {
+	return s.url(ordinal, s.ClientPort)
+}
+
+// Peers returns the peer URLs of the first n pods; peer i has node ID i+1.
+func (s StatefulSet) Peers(n int) []string {
+	peers := make([]string, n)
+	for i := range peers {
+		peers[i] = s.PeerURL(i)
+	}
+	return peers
+}
+
+// WaitResolve waits until host resolves, retrying every interval until ctx
+// is done: the headless service of a StatefulSet publishes the name of a
+// pod only some time after it started.
+func WaitResolve(ctx context.Context, host string, interval time.Duration) error {
+	for {
+		_, err := lookupHost(ctx, host)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return fmt.Errorf("discovery: %s does not resolve (%v)", host, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatefulSet(t *testing.T) {
+	for pod, want := range map[string]struct {
+		set     string
+		ordinal int
+	}{
+		"metcd-0":      {"metcd", 0},
+		"my-metcd-12":  {"my-metcd", 12},
+		"metcd":        {"", -1},
+		"metcd-x":      {"", -1},
+		"-1":           {"", -1},
+		"metcd-+1":     {"", -1},
+		"metcd-":       {"", -1},
+		"metcd-prod-2": {"metcd-prod", 2},
+	} {
+		set, ordinal, err := ParsePodName(pod)
+		if want.ordinal < 0 {
+			if err == nil {
+				t.Fatalf("expected %q not to be a StatefulSet pod, got %s %d", pod, set, ordinal)
+			}
+			continue
+		}
+		if err != nil || set != want.set || ordinal != want.ordinal {
+			t.Fatalf("%s: expected %s %d, got %s %d (%v)", pod, want.set, want.ordinal, set, ordinal, err)
+		}
+	}
+
+	s := StatefulSet{Name: "metcd", Service: "peers", Namespace: "db", PeerPort: 2380, ClientPort: 2379}
+	want := []string{"http://metcd-0.peers.db.svc.cluster.local:2380", "http://metcd-1.peers.db.svc.cluster.local:2380"}
+	if peers := s.Peers(2); !reflect.DeepEqual(peers, want) {
+		t.Fatalf("expected %v, got %v", want, peers)
+	}
+	s.Scheme, s.ClusterDomain = "https", "k8s.example"
+	if u := s.ClientURL(3); u != "https://metcd-3.peers.db.svc.k8s.example:2379" {
+		t.Fatalf("unexpected client URL %s", u)
+	}
+}
+
+func TestWaitResolve(t *testing.T) {
+	defer func() { lookupHost = net.DefaultResolver.LookupHost }()
+	var lookups atomic.Int32
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if lookups.Add(1) < 3 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []string{"10.0.0.1"}, nil
+	}
+	if err := WaitResolve(context.Background(), "metcd-0.metcd", time.Millisecond); err != nil || lookups.Load() != 3 {
+		t.Fatalf("expected the name to resolve on the third lookup, got %d lookups (%v)", lookups.Load(), err)
+	}
+
+	lookups.Store(-1000)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := WaitResolve(ctx, "metcd-0.metcd", time.Millisecond); err == nil {
+		t.Fatal("expected an error once the context is done")
+	}
+}
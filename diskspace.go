@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"metcd/api"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// diskCheckInterval is how often the disk monitor checks the free space of
+// the data directory.
+var diskCheckInterval = 5 * time.Second
+
+// ErrNoSpace is the error of the writes refused while the data directory of
+// a member is short of space, see diskMonitor.
+var ErrNoSpace = errors.New("metcd: no space left on the data directory of a member, writes are refused")
+
+var diskFreeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "metcd",
+	Subsystem: "server",
+	Name:      "disk_free_bytes",
+	Help:      "Space available to the member on the file system of its data directory.",
+})
+
+func init() {
+	prometheus.MustRegister(diskFreeBytes)
+}
+
+// spaceGuard is a store whose writes the disk monitor stops.
+type spaceGuard interface {
+	Alarm(ctx context.Context, req api.AlarmRequest) error
+	Alarms() []api.Alarm
+	// setLowSpace refuses the writes of this member at once, before the
+	// NOSPACE alarm commits
+	setLowSpace(low bool)
+}
+
+// diskMonitor checks the free space of the data directory. Below minFree
+// it raises a NOSPACE alarm for the member, which makes the cluster refuse
+// the writes adding data, so a full disk does not tear a WAL write; reads
+// and deletes are still served. The alarm is cleared once there is
+// enough space again.
+type diskMonitor struct {
+	dir     string
+	minFree uint64
+	id      uint64
+	stores  []spaceGuard
+	free    func(dir string) (uint64, error) // diskFree, replaced in tests
+	low     bool
+	failed  bool // the last check failed, logged once
+
+	stopc chan struct{}
+	donec chan struct{}
+}
+
+func newDiskMonitor(dir string, minFree uint64, id uint64, stores ...spaceGuard) *diskMonitor {
+	if dir == "" {
+		dir = "."
+	}
+	return &diskMonitor{
+		dir:     dir,
+		minFree: minFree,
+		id:      id,
+		stores:  stores,
+		free:    diskFree,
+		stopc:   make(chan struct{}),
+		donec:   make(chan struct{}),
+	}
+}
+
+func (m *diskMonitor) Run() {
+	go func() {
+		defer close(m.donec)
+		t := time.NewTicker(diskCheckInterval)
+		defer t.Stop()
+		for {
+			m.check()
+			select {
+			case <-t.C:
+			case <-m.stopc:
+				return
+			}
+		}
+	}()
+}
+
+func (m *diskMonitor) Stop() {
+	close(m.stopc)
+	<-m.donec
+}
+
+func (m *diskMonitor) check() {
+	free, err := m.free(m.dir)
+	if err != nil {
+		if !m.failed {
+			log.Printf("disk: cannot check the free space of %s (%v)", m.dir, err)
+		}
+		m.failed = true
+		return
+	}
+	m.failed = false
+	diskFreeBytes.Set(float64(free))
+	low := free < m.minFree
+	if low != m.low {
+		if low {
+			log.Printf("disk: %d bytes free on %s, less than --disk-min-free %d, refusing writes", free, m.dir, m.minFree)
+		} else {
+			log.Printf("disk: %d bytes free on %s, accepting writes again", free, m.dir)
+		}
+		m.low = low
+	}
+	for _, s := range m.stores {
+		s.setLowSpace(low)
+		alarmed := false
+		for _, a := range s.Alarms() {
+			if a.MemberID == m.id && a.Alarm == api.AlarmNoSpace {
+				alarmed = true
+			}
+		}
+		switch {
+		case low && !alarmed:
+			m.alarm(s, api.AlarmActivate)
+		case !low && alarmed:
+			m.alarm(s, api.AlarmDeactivate)
+		}
+	}
+}
+
+func (m *diskMonitor) alarm(s spaceGuard, action api.AlarmAction) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req := api.AlarmRequest{Action: action, MemberID: m.id, Alarm: api.AlarmNoSpace}
+	if err := s.Alarm(ctx, req); err != nil {
+		log.Printf("disk: failed to %s the NOSPACE alarm of member %d (%v)", action, m.id, err)
+	}
+}
+
+func (s *kvstore) setLowSpace(low bool) {
+	s.lowSpace.Store(low)
+}
+
+// noSpace reports whether the writes adding data are refused: the data
+// directory of this member or another one is short of space.
+func (s *kvstore) noSpace() bool {
+	if s.lowSpace.Load() {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for a := range s.alarms {
+		if a.Alarm == api.AlarmNoSpace {
+			return true
+		}
+	}
+	return false
+}
+
+// addsData reports whether the client write r stores data. Deletes still
+// go through while there is no space, to make room.
+func addsData(r kv) bool {
+	switch r.Op {
+	case opPut, opUndelete, opAppend, opPatch:
+		return true
+	case opTxn:
+		if r.Txn == nil {
+			return false
+		}
+		for _, ops := range [][]api.Op{r.Txn.Success, r.Txn.Failure} {
+			for _, op := range ops {
+				if op.Type == api.OpPut {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
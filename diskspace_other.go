@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// diskFree is only implemented on linux, elsewhere the disk monitor does
+// nothing.
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
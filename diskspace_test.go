@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"metcd/api"
+	"reflect"
+	"testing"
+)
+
+type fakeSpaceGuard struct {
+	alarms   map[api.Alarm]bool
+	lowSpace bool
+}
+
+func (f *fakeSpaceGuard) Alarm(_ context.Context, req api.AlarmRequest) error {
+	a := api.Alarm{MemberID: req.MemberID, Alarm: req.Alarm}
+	if req.Action == api.AlarmActivate {
+		f.alarms[a] = true
+	} else {
+		delete(f.alarms, a)
+	}
+	return nil
+}
+
+func (f *fakeSpaceGuard) Alarms() []api.Alarm {
+	var alarms []api.Alarm
+	for a := range f.alarms {
+		alarms = append(alarms, a)
+	}
+	return alarms
+}
+
+func (f *fakeSpaceGuard) setLowSpace(low bool) { f.lowSpace = low }
+
+func TestDiskMonitor(t *testing.T) {
+	g := &fakeSpaceGuard{alarms: map[api.Alarm]bool{{MemberID: 2, Alarm: api.AlarmUnreachable}: true}}
+	m := newDiskMonitor("", 100, 1, g)
+	var free uint64 = 1000
+	var err error
+	m.free = func(string) (uint64, error) { return free, err }
+
+	m.check()
+	if g.lowSpace || len(g.alarms) != 1 {
+		t.Fatalf("expected writes accepted with enough space, got %v %v", g.lowSpace, g.alarms)
+	}
+	free = 99
+	m.check()
+	m.check()
+	noSpace := api.Alarm{MemberID: 1, Alarm: api.AlarmNoSpace}
+	if !g.lowSpace || !g.alarms[noSpace] || len(g.alarms) != 2 {
+		t.Fatalf("expected a NOSPACE alarm below the minimum, got %v %v", g.lowSpace, g.alarms)
+	}
+	// an operator clearing the alarm does not make room
+	delete(g.alarms, noSpace)
+	m.check()
+	if !g.alarms[noSpace] {
+		t.Fatalf("expected the NOSPACE alarm raised again, got %v", g.alarms)
+	}
+	err = errors.New("statfs failed")
+	m.check()
+	if !g.lowSpace || !g.alarms[noSpace] {
+		t.Fatalf("expected a failed check to change nothing, got %v %v", g.lowSpace, g.alarms)
+	}
+	free, err = 100, nil
+	m.check()
+	if g.lowSpace || !reflect.DeepEqual(g.alarms, map[api.Alarm]bool{{MemberID: 2, Alarm: api.AlarmUnreachable}: true}) {
+		t.Fatalf("expected the NOSPACE alarm cleared, got %v %v", g.lowSpace, g.alarms)
+	}
+}
+
+func TestNoSpace(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.alarms[api.Alarm{MemberID: 2, Alarm: api.AlarmNoSpace}] = struct{}{}
+	if err := s.Put(context.Background(), "/foo", "bar"); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("expected a put refused while another member is short of space, got %v", err)
+	}
+	s.alarms = make(map[api.Alarm]struct{})
+	s.setLowSpace(true)
+	if err := s.Put(context.Background(), "/foo", "bar"); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("expected a put refused before the alarm commits, got %v", err)
+	}
+
+	for _, c := range []struct {
+		r    kv
+		want bool
+	}{
+		{kv{Op: opPut}, true},
+		{kv{Op: opDelete}, false},
+		{kv{Op: opDeleteRange}, false},
+		{kv{Op: opAlarm}, false},
+		{kv{Op: opTxn, Txn: &api.TxnRequest{Success: []api.Op{{Type: api.OpGet}}, Failure: []api.Op{{Type: api.OpDelete}}}}, false},
+		{kv{Op: opTxn, Txn: &api.TxnRequest{Failure: []api.Op{{Type: api.OpPut}}}}, true},
+	} {
+		if got := addsData(c.r); got != c.want {
+			t.Fatalf("%v %+v: expected adds data %v, got %v", c.r.Op, c.r.Txn, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"metcd/dns"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// dnsStore serves the DNS front-end the instances registered under prefix
+// in the default keyspace, the nodes of GET /ring/<prefix><service>/. It
+// reads the local store, like serializable reads.
+type dnsStore struct {
+	kvs    *kvstore
+	prefix string
+}
+
+// Instances returns the instances registered as keys
+// <prefix><service>/<host>:<port>, whose value is empty or
+// {"weight":<n>,"healthy":<bool>}. Those with "healthy":false are left out.
+func (s dnsStore) Instances(service string) ([]dns.Instance, bool) {
+	prefix := s.prefix + service + "/"
+	kvs, _, _, err := s.kvs.RangeIn("", prefix, string(prefixEnd([]byte(prefix))), 0)
+	if err != nil || len(kvs) == 0 {
+		return nil, false
+	}
+	var instances []dns.Instance
+	for _, kv := range kvs {
+		name := strings.TrimPrefix(kv.Key, prefix)
+		var reg struct {
+			Weight  int   `json:"weight"`
+			Healthy *bool `json:"healthy"`
+		}
+		json.Unmarshal([]byte(kv.Value), &reg)
+		if reg.Healthy != nil && !*reg.Healthy {
+			continue
+		}
+		in := dns.Instance{Host: name, Weight: 1}
+		if host, port, err := net.SplitHostPort(name); err == nil {
+			if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+				in.Host, in.Port = host, uint16(p)
+			}
+		}
+		if reg.Weight > 0 && reg.Weight <= 0xffff {
+			in.Weight = uint16(reg.Weight)
+		}
+		instances = append(instances, in)
+	}
+	return instances, true
+}
@@ -0,0 +1,237 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Types and classes of the records the server answers.
+const (
+	typeA    uint16 = 1
+	typeAAAA uint16 = 28
+	typeSRV  uint16 = 33
+	typeANY  uint16 = 255
+
+	classIN  uint16 = 1
+	classANY uint16 = 255
+)
+
+// Response codes.
+const (
+	rcodeSuccess  = 0
+	rcodeFormErr  = 1
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+)
+
+// Bits of the flags of the header.
+const (
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+
+	opcodeMask = 0xf << 11
+	rcodeMask  = 0xf
+)
+
+const (
+	headerLen = 12
+	// maxUDPSize is the largest response sent over UDP, clients without
+	// EDNS(0) accept no more.
+	maxUDPSize = 512
+	// maxTCPSize is the largest message over TCP.
+	maxTCPSize = 65535
+	maxNameLen = 255
+	maxLabel   = 63
+)
+
+var errFormat = errors.New("dns: malformed message")
+
+type question struct {
+	name   string // lowercase, with the trailing dot
+	qtype  uint16
+	qclass uint16
+}
+
+type record struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+// message is a DNS message. Records of the authority section are counted
+// as extra ones when parsing and are never sent.
+type message struct {
+	id       uint16
+	flags    uint16
+	question []question
+	answer   []record
+	extra    []record
+}
+
+func (m *message) rcode() int { return int(m.flags & rcodeMask) }
+
+// unpack parses a DNS message.
+func unpack(b []byte) (*message, error) {
+	if len(b) < headerLen {
+		return nil, errFormat
+	}
+	m := &message{id: binary.BigEndian.Uint16(b), flags: binary.BigEndian.Uint16(b[2:])}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(b[4+2*i:]))
+	}
+	off := headerLen
+	for i := 0; i < counts[0]; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if off = n; off+4 > len(b) {
+			return nil, errFormat
+		}
+		m.question = append(m.question, question{name, binary.BigEndian.Uint16(b[off:]), binary.BigEndian.Uint16(b[off+2:])})
+		off += 4
+	}
+	for i := 0; i < counts[1]+counts[2]+counts[3]; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if off = n; off+10 > len(b) {
+			return nil, errFormat
+		}
+		r := record{name: name, rtype: binary.BigEndian.Uint16(b[off:]), ttl: binary.BigEndian.Uint32(b[off+4:])}
+		size := int(binary.BigEndian.Uint16(b[off+8:]))
+		if off += 10; off+size > len(b) {
+			return nil, errFormat
+		}
+		r.data = b[off : off+size]
+		off += size
+		if i < counts[1] {
+			m.answer = append(m.answer, r)
+		} else {
+			m.extra = append(m.extra, r)
+		}
+	}
+	return m, nil
+}
+
+// readName reads the name at off, following compression pointers, and
+// returns it lowercase with the offset after it.
+func readName(b []byte, off int) (string, int, error) {
+	var sb strings.Builder
+	end, jumps := -1, 0
+	for {
+		if off >= len(b) {
+			return "", 0, errFormat
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			if sb.Len() == 0 {
+				return ".", end, nil
+			}
+			return strings.ToLower(sb.String()), end, nil
+		case n&0xc0 == 0xc0:
+			if jumps++; off+1 >= len(b) || jumps > 32 {
+				return "", 0, errFormat
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		case n > maxLabel || off+1+n > len(b):
+			return "", 0, errFormat
+		default:
+			sb.Write(b[off+1 : off+1+n])
+			sb.WriteByte('.')
+			if sb.Len() > maxNameLen {
+				return "", 0, errFormat
+			}
+			off += 1 + n
+		}
+	}
+}
+
+// appendName appends name, which has the trailing dot, uncompressed as SRV
+// targets must be.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// validName reports whether name can be encoded.
+func validName(name string) bool {
+	if len(name) > maxNameLen {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > maxLabel {
+			return false
+		}
+	}
+	return true
+}
+
+func appendRecord(b []byte, r record) []byte {
+	b = appendName(b, r.name)
+	b = binary.BigEndian.AppendUint16(b, r.rtype)
+	b = binary.BigEndian.AppendUint16(b, classIN)
+	b = binary.BigEndian.AppendUint32(b, r.ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.data)))
+	return append(b, r.data...)
+}
+
+// pack encodes m in at most max bytes. The records that do not fit are left
+// out: the extra ones first, then answers, which sets the TC bit so that
+// the client asks again over TCP.
+func (m *message) pack(max int) []byte {
+	b := make([]byte, headerLen, maxUDPSize)
+	binary.BigEndian.PutUint16(b, m.id)
+	for _, q := range m.question {
+		b = appendName(b, q.name)
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, q.qclass)
+	}
+	flags := m.flags
+	answers, extra := 0, 0
+	for _, r := range m.answer {
+		next := appendRecord(b, r)
+		if len(next) > max {
+			flags |= flagTC
+			break
+		}
+		b = next
+		answers++
+	}
+	for _, r := range m.extra {
+		if flags&flagTC != 0 {
+			break
+		}
+		next := appendRecord(b, r)
+		if len(next) > max {
+			break
+		}
+		b = next
+		extra++
+	}
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.question)))
+	binary.BigEndian.PutUint16(b[6:], uint16(answers))
+	binary.BigEndian.PutUint16(b[10:], uint16(extra))
+	return b
+}
@@ -0,0 +1,324 @@
+// Package dns answers DNS queries for the services registered in metcd, in
+// the style of the DNS interface of Consul, so that clients that only know
+// DNS can discover them.
+//
+// The server answers for three kinds of names under its domain:
+//
+//	<service>.service.<domain>
+//	_<service>._tcp.service.<domain>
+//	<hex>.addr.<domain>
+//
+// The first two have the A and AAAA records of the instances of the service
+// whose host is an IP, and the SRV records of the instances with a port.
+// The SRV target of an IP is its <hex>.addr name, the IP in hex, whose A or
+// AAAA record is added to the response. Names outside the domain are
+// refused, the server does not recurse.
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TCPIdleTimeout is how long a TCP connection stays open without a query.
+var TCPIdleTimeout = 10 * time.Second
+
+// Instance is an instance of a service.
+type Instance struct {
+	Host   string // IP or host name
+	Port   uint16 // 0 if unknown, the instance has no SRV record
+	Weight uint16 // the weight of its SRV record
+}
+
+// Store is the part of the key-value store used by the server.
+type Store interface {
+	// Instances returns the healthy instances of service, and false if no
+	// instance of it is registered at all.
+	Instances(service string) ([]Instance, bool)
+}
+
+// Server serves DNS over UDP and TCP.
+type Server struct {
+	store  Store
+	domain string
+	ttl    uint32
+
+	mu     sync.Mutex
+	pcs    map[net.PacketConn]struct{}
+	lns    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	closed bool
+
+	stopc chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewServer creates a server answering for the names under domain, e.g.
+// "metcd", with records living ttl.
+func NewServer(store Store, domain string, ttl time.Duration) *Server {
+	return &Server{
+		store:  store,
+		domain: strings.ToLower(strings.Trim(domain, ".")) + ".",
+		ttl:    uint32(ttl / time.Second),
+		pcs:    make(map[net.PacketConn]struct{}),
+		lns:    make(map[net.Listener]struct{}),
+		conns:  make(map[net.Conn]struct{}),
+		stopc:  make(chan struct{}),
+	}
+}
+
+// ServeUDP answers the queries received on pc until the server is closed.
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		pc.Close()
+		return net.ErrClosed
+	}
+	s.pcs[pc] = struct{}{}
+	s.mu.Unlock()
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.stopc:
+				return net.ErrClosed
+			default:
+			}
+			return err
+		}
+		if res := s.answer(buf[:n], maxUDPSize); res != nil {
+			if _, err := pc.WriteTo(res, addr); err != nil {
+				log.Printf("dns: failed to answer %s (%v)", addr, err)
+			}
+		}
+	}
+}
+
+// Serve accepts TCP connections on ln until the server is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	s.lns[ln] = struct{}{}
+	s.mu.Unlock()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.stopc:
+				return net.ErrClosed
+			default:
+			}
+			return err
+		}
+		if !s.track(c) {
+			c.Close()
+			return net.ErrClosed
+		}
+		s.wg.Add(1)
+		go s.serveConn(c)
+	}
+}
+
+// Close stops the listeners and the connections, and waits for them.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stopc)
+	for pc := range s.pcs {
+		pc.Close()
+	}
+	for ln := range s.lns {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) track(c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+// serveConn answers the queries of a TCP connection, each prefixed with its
+// length.
+func (s *Server) serveConn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		c.SetReadDeadline(time.Now().Add(TCPIdleTimeout))
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				var ne net.Error
+				if !errors.As(err, &ne) || !ne.Timeout() {
+					log.Printf("dns: failed to read from %s (%v)", c.RemoteAddr(), err)
+				}
+			}
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(r, query); err != nil {
+			return
+		}
+		res := s.answer(query, maxTCPSize)
+		if res == nil {
+			return
+		}
+		if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(res))), res...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the response to query in at most max bytes, or nil if
+// query is not even a DNS query.
+func (s *Server) answer(query []byte, max int) []byte {
+	q, err := unpack(query)
+	if err != nil || q.flags&flagQR != 0 {
+		if len(query) < headerLen || q != nil {
+			return nil
+		}
+		// answer what is at least a header, so the client does not wait
+		res := &message{id: binary.BigEndian.Uint16(query), flags: flagQR | rcodeFormErr}
+		return res.pack(max)
+	}
+	res := &message{id: q.id, question: q.question, flags: flagQR | q.flags&(opcodeMask|flagRD)}
+	switch {
+	case q.flags&opcodeMask != 0:
+		res.flags |= rcodeNotImp
+	case len(q.question) != 1:
+		res.flags |= rcodeFormErr
+	default:
+		res.flags |= s.resolve(q.question[0], res)
+	}
+	return res.pack(max)
+}
+
+// resolve adds the records of q to res and returns the response code.
+func (s *Server) resolve(q question, res *message) uint16 {
+	if q.qclass != classIN && q.qclass != classANY {
+		return rcodeNotImp
+	}
+	if q.name == s.domain {
+		res.flags |= flagAA
+		return rcodeSuccess
+	}
+	rest, ok := strings.CutSuffix(q.name, "."+s.domain)
+	if !ok {
+		return rcodeRefused
+	}
+	res.flags |= flagAA
+	labels := strings.Split(rest, ".")
+	switch n := len(labels); {
+	case n == 2 && labels[1] == "addr":
+		ip := parseAddr(labels[0])
+		if ip == nil {
+			return rcodeNXDomain
+		}
+		if rr, ok := s.addrRecord(q.name, ip); ok && (q.qtype == rr.rtype || q.qtype == typeANY) {
+			res.answer = append(res.answer, rr)
+		}
+		return rcodeSuccess
+	case n == 2 && labels[1] == "service":
+		return s.service(q, labels[0], res)
+	case n == 3 && labels[2] == "service" && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_"):
+		return s.service(q, labels[0][1:], res)
+	}
+	return rcodeNXDomain
+}
+
+// service adds the records of the instances of service to res.
+func (s *Server) service(q question, service string, res *message) uint16 {
+	instances, ok := s.store.Instances(service)
+	if !ok {
+		return rcodeNXDomain
+	}
+	// spread the clients taking the first record over the instances
+	rand.Shuffle(len(instances), func(i, j int) { instances[i], instances[j] = instances[j], instances[i] })
+	for _, in := range instances {
+		ip := net.ParseIP(in.Host)
+		if q.qtype == typeA || q.qtype == typeAAAA || q.qtype == typeANY {
+			if rr, ok := s.addrRecord(q.name, ip); ok && (q.qtype == rr.rtype || q.qtype == typeANY) {
+				res.answer = append(res.answer, rr)
+			}
+		}
+		if (q.qtype == typeSRV || q.qtype == typeANY) && in.Port != 0 {
+			target := strings.ToLower(strings.TrimSuffix(in.Host, ".")) + "."
+			if ip != nil {
+				target = formatAddr(ip) + ".addr." + s.domain
+				if rr, ok := s.addrRecord(target, ip); ok {
+					res.extra = append(res.extra, rr)
+				}
+			}
+			if !validName(target) {
+				continue
+			}
+			data := binary.BigEndian.AppendUint16(nil, 1) // priority
+			data = binary.BigEndian.AppendUint16(data, in.Weight)
+			data = binary.BigEndian.AppendUint16(data, in.Port)
+			res.answer = append(res.answer, record{name: q.name, rtype: typeSRV, ttl: s.ttl, data: appendName(data, target)})
+		}
+	}
+	return rcodeSuccess
+}
+
+// addrRecord returns the A or AAAA record of ip, false if ip is nil.
+func (s *Server) addrRecord(name string, ip net.IP) (record, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return record{name: name, rtype: typeA, ttl: s.ttl, data: ip4}, true
+	} else if ip != nil {
+		return record{name: name, rtype: typeAAAA, ttl: s.ttl, data: ip.To16()}, true
+	}
+	return record{}, false
+}
+
+// formatAddr returns the label of ip under addr, its bytes in hex as Consul
+// names them.
+func formatAddr(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return hex.EncodeToString(ip4)
+	}
+	return hex.EncodeToString(ip.To16())
+}
+
+func parseAddr(label string) net.IP {
+	b, err := hex.DecodeString(label)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil
+	}
+	return net.IP(b)
+}
@@ -0,0 +1,147 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeStore map[string][]Instance
+
+func (f fakeStore) Instances(service string) ([]Instance, bool) {
+	instances, ok := f[service]
+	return append([]Instance{}, instances...), ok
+}
+
+func query(id uint16, name string, qtype uint16) []byte {
+	m := &message{id: id, flags: flagRD, question: []question{{name, qtype, classIN}}}
+	return m.pack(maxUDPSize)
+}
+
+// answers returns the answers of res as sorted strings.
+func answers(t *testing.T, res []byte) (*message, []string) {
+	t.Helper()
+	m, err := unpack(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range m.answer {
+		switch r.rtype {
+		case typeA, typeAAAA:
+			got = append(got, net.IP(r.data).String())
+		case typeSRV:
+			target, _, err := readName(r.data, 6)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprintf("%s %d %d", target, binary.BigEndian.Uint16(r.data[4:]), binary.BigEndian.Uint16(r.data[2:])))
+		}
+	}
+	sort.Strings(got)
+	return m, got
+}
+
+func TestServer(t *testing.T) {
+	store := fakeStore{
+		"cache": {{Host: "10.0.0.1", Port: 11211, Weight: 2}, {Host: "node2.example.com", Port: 11212, Weight: 1}, {Host: "::1"}},
+		"down":  nil,
+	}
+	s := NewServer(store, "metcd", 5*time.Second)
+	for _, c := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+		want  string
+	}{
+		{"cache.service.metcd.", typeA, rcodeSuccess, "10.0.0.1"},
+		{"CACHE.service.metcd.", typeAAAA, rcodeSuccess, "::1"},
+		{"cache.service.metcd.", typeSRV, rcodeSuccess, "0a000001.addr.metcd. 11211 2,node2.example.com. 11212 1"},
+		{"_cache._tcp.service.metcd.", typeSRV, rcodeSuccess, "0a000001.addr.metcd. 11211 2,node2.example.com. 11212 1"},
+		{"0a000001.addr.metcd.", typeA, rcodeSuccess, "10.0.0.1"},
+		{"down.service.metcd.", typeA, rcodeSuccess, ""},
+		{"other.service.metcd.", typeA, rcodeNXDomain, ""},
+		{"zz.addr.metcd.", typeA, rcodeNXDomain, ""},
+		{"example.com.", typeA, rcodeRefused, ""},
+	} {
+		m, got := answers(t, s.answer(query(7, c.name, c.qtype), maxUDPSize))
+		if m.id != 7 || m.flags&flagQR == 0 || m.rcode() != c.rcode || strings.Join(got, ",") != c.want {
+			t.Fatalf("%s %d: expected %d %q, got %d %q", c.name, c.qtype, c.rcode, c.want, m.rcode(), strings.Join(got, ","))
+		}
+	}
+	m, _ := answers(t, s.answer(query(1, "cache.service.metcd.", typeSRV), maxUDPSize))
+	if len(m.extra) != 1 || m.extra[0].name != "0a000001.addr.metcd." || m.answer[0].ttl != 5 {
+		t.Fatalf("expected the A record of the IP target as extra, got %+v", m.extra)
+	}
+}
+
+func TestServerTruncates(t *testing.T) {
+	var instances []Instance
+	for i := 0; i < 100; i++ {
+		instances = append(instances, Instance{Host: net.IPv4(10, 0, 0, byte(i)).String(), Port: 80})
+	}
+	s := NewServer(fakeStore{"web": instances}, "metcd.", 0)
+	res := s.answer(query(1, "web.service.metcd.", typeA), maxUDPSize)
+	m, _ := answers(t, res)
+	if len(res) > maxUDPSize || m.flags&flagTC == 0 || len(m.answer) == 0 {
+		t.Fatalf("expected a truncated response with some answers, got %d bytes, flags %x", len(res), m.flags)
+	}
+	if m, _ := answers(t, s.answer(query(1, "web.service.metcd.", typeA), maxTCPSize)); m.flags&flagTC != 0 || len(m.answer) != 100 {
+		t.Fatalf("expected the 100 answers over TCP, got %d", len(m.answer))
+	}
+}
+
+func TestServerListeners(t *testing.T) {
+	s := NewServer(fakeStore{"cache": {{Host: "10.0.0.1", Port: 11211}}}, "metcd", 0)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeUDP(pc)
+	go s.Serve(ln)
+	defer s.Close()
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(query(3, "cache.service.metcd.", typeA))
+	buf := make([]byte, maxUDPSize)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, got := answers(t, buf[:n]); len(got) != 1 || got[0] != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1 over UDP, got %v", got)
+	}
+
+	tc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	q := query(4, "cache.service.metcd.", typeSRV)
+	tc.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(q))), q...))
+	tc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(tc, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, binary.BigEndian.Uint16(buf))
+	if _, err := io.ReadFull(tc, res); err != nil {
+		t.Fatal(err)
+	}
+	if _, got := answers(t, res); len(got) != 1 || !strings.HasPrefix(got[0], "0a000001.addr.metcd.") {
+		t.Fatalf("expected the SRV record over TCP, got %v", got)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"metcd/dns"
+	"reflect"
+	"testing"
+)
+
+func TestDNSStore(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.apply(kv{Op: opPut, Key: "/services/cache/10.0.0.1:11211", Val: `{"weight":2}`})
+	s.apply(kv{Op: opPut, Key: "/services/cache/10.0.0.2:11211", Val: `{"healthy":false}`})
+	s.apply(kv{Op: opPut, Key: "/services/cache/node3", Val: ""})
+	s.apply(kv{Op: opPut, Key: "/services/down/10.0.0.4:80", Val: `{"healthy":false}`})
+	store := dnsStore{s, "/services/"}
+
+	instances, ok := store.Instances("cache")
+	want := []dns.Instance{{Host: "10.0.0.1", Port: 11211, Weight: 2}, {Host: "node3", Weight: 1}}
+	if !ok || !reflect.DeepEqual(instances, want) {
+		t.Fatalf("expected %+v, got %+v (%v)", want, instances, ok)
+	}
+	if instances, ok := store.Instances("down"); !ok || len(instances) != 0 {
+		t.Fatalf("expected a registered service without healthy instances, got %+v (%v)", instances, ok)
+	}
+	if _, ok := store.Instances("other"); ok {
+		t.Fatal("expected an unknown service")
+	}
+}
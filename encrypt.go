@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"metcd/api"
+	"metcd/encryption"
+	"net/http"
+	"strings"
+)
+
+var ErrDataKeyNotFound = errors.New("metcd: no data key for the prefix")
+
+// seal compresses value of key in the keyspace called name, see
+// encodeValue, and encrypts it if key is under an encrypted prefix.
+func (s *kvstore) seal(name, key, value string) (string, error) {
+	value, err := encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+	return s.keyring.Seal(name, key, value)
+}
+
+// open decrypts and decompresses the stored value of key.
+func (s *kvstore) open(key, value string) (string, error) {
+	value, err := s.keyring.Open(key, value)
+	if err != nil {
+		return "", err
+	}
+	return decodeValue(value)
+}
+
+// sealProposal compresses the values r writes and encrypts those under
+// encrypted prefixes, so that they are replicated and stored that way. The
+// values compared by a transaction are not, the members compare them with
+// the decrypted values.
+func (s *kvstore) sealProposal(r *kv) error {
+	var err error
+	switch r.Op {
+	case opPut:
+		r.Val, err = s.seal(r.Keyspace, r.Key, r.Val)
+	case opTxn:
+		if r.Txn == nil {
+			return nil
+		}
+		txn := *r.Txn
+		for _, ops := range []*[]api.Op{&txn.Success, &txn.Failure} {
+			sealed := append([]api.Op(nil), *ops...)
+			for i := range sealed {
+				if sealed[i].Type != api.OpPut {
+					continue
+				}
+				if sealed[i].Value, err = s.seal(r.Keyspace, sealed[i].Key, sealed[i].Value); err != nil {
+					return err
+				}
+			}
+			*ops = sealed
+		}
+		r.Txn = &txn
+	}
+	return err
+}
+
+// openKV returns a copy of kv with its value decrypted, kv may be nil.
+func (s *kvstore) openKV(kv *api.KeyValue) (*api.KeyValue, error) {
+	if kv == nil {
+		return nil, nil
+	}
+	opened := *kv
+	var err error
+	opened.Value, err = s.open(kv.Key, kv.Value)
+	return &opened, err
+}
+
+// openTxn returns a copy of resp with the values read decrypted.
+func (s *kvstore) openTxn(resp *api.TxnResponse) (*api.TxnResponse, error) {
+	if resp == nil {
+		return nil, nil
+	}
+	opened := *resp
+	opened.Responses = append([]api.OpResponse(nil), resp.Responses...)
+	for i, r := range opened.Responses {
+		var err error
+		if opened.Responses[i].Value, err = s.open(r.Key, r.Value); err != nil {
+			return nil, err
+		}
+	}
+	return &opened, nil
+}
+
+// applyDataKey adds or destroys the data key of the prefix r.Key. All
+// members must have the master key the data key is wrapped with, or they
+// could not evaluate the comparisons of transactions on its values like the
+// others. It must be called with s.mu held.
+func (s *kvstore) applyDataKey(ks *keyspace, r kv, res *applyResult) []api.Event {
+	if r.Op == opDataKeyPut {
+		res.version = s.keyring.Add(r.Keyspace, r.Key, r.Wrapped)
+		if err := s.keyring.Check(); err != nil {
+			log.Fatalf("metcd: cannot use the data key of %q (%v), every member needs the same --encryption-key-file", r.Key, err)
+		}
+		return nil
+	}
+	if !s.keyring.Destroy(r.Keyspace, r.Key) {
+		res.err = ErrDataKeyNotFound
+		return nil
+	}
+	// the values sealed with the key cannot be read anymore
+	var events []api.Event
+	for k, v := range ks.kvStore {
+		if space, prefix, ok := encryption.SealedWith(v); ok && space == r.Keyspace && prefix == r.Key {
+			_, ev := ks.del(k)
+			events = append(events, *ev)
+		}
+	}
+	for k, t := range ks.tombstones {
+		if space, prefix, ok := encryption.SealedWith(t.Value); ok && space == r.Keyspace && prefix == r.Key {
+			delete(ks.tombstones, k)
+		}
+	}
+	res.found = len(events) > 0
+	return events
+}
+
+// PutDataKey generates a data key for prefix in the keyspace of ctx, or a
+// new version of it, and returns its version. The values written under
+// prefix from then on are encrypted with it.
+func (s *kvstore) PutDataKey(ctx context.Context, prefix string) (uint32, error) {
+	wrapped, err := s.keyring.NewDataKey()
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.propose(ctx, kv{Op: opDataKeyPut, Key: prefix, Wrapped: wrapped})
+	if err != nil {
+		return 0, err
+	}
+	return res.version, res.err
+}
+
+// DestroyDataKey forgets every version of the data key of prefix in the
+// keyspace of ctx and deletes the values encrypted with it.
+func (s *kvstore) DestroyDataKey(ctx context.Context, prefix string) error {
+	res, err := s.propose(ctx, kv{Op: opDataKeyDestroy, Key: prefix})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// DataKeys returns the encrypted prefixes of the keyspace called name with
+// the current version of their data key.
+func (s *kvstore) DataKeys(name string) ([]api.EncryptionKey, error) {
+	s.mu.RLock()
+	_, err := s.space(name)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	keys := []api.EncryptionKey{}
+	for _, wk := range s.keyring.List() {
+		if wk.Keyspace != name {
+			continue
+		}
+		// versions are listed from the oldest
+		if n := len(keys); n > 0 && keys[n-1].Prefix == wk.Prefix {
+			keys[n-1].Version = wk.Version
+			continue
+		}
+		keys = append(keys, api.EncryptionKey{Prefix: wk.Prefix, Version: wk.Version})
+	}
+	return keys, nil
+}
+
+// serveEncryption handles /admin/encryption: GET lists the encrypted
+// prefixes of the keyspace of the request, POST ?prefix=<prefix> creates or
+// rotates the data key of a prefix and DELETE ?prefix=<prefix> destroys it
+// with the values it encrypts.
+func (h *httpKVAPI) serveEncryption(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if r.Method != http.MethodGet && (prefix == "" || !strings.HasPrefix(prefix, "/")) {
+		http.Error(w, "Invalid prefix", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := h.store.DataKeys(keyspaceOf(r.Context()))
+		if keyspaceError(w, err) {
+			return
+		}
+		writeJSON(w, keys)
+	case http.MethodPost:
+		version, err := h.store.PutDataKey(r.Context(), prefix)
+		if errors.Is(err, encryption.ErrNoMasterKey) {
+			http.Error(w, "No --encryption-key-file on this member", http.StatusPreconditionFailed)
+			return
+		} else if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to create data key (%v)\n", err)
+			http.Error(w, "Failed on POST", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, api.EncryptionKey{Prefix: prefix, Version: version})
+	case http.MethodDelete:
+		err := h.store.DestroyDataKey(r.Context(), prefix)
+		if errors.Is(err, ErrDataKeyNotFound) {
+			http.Error(w, "No data key for the prefix", http.StatusNotFound)
+			return
+		} else if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to destroy data key (%v)\n", err)
+			http.Error(w, "Failed on DELETE", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPost)
+		w.Header().Add("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
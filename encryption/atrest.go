@@ -0,0 +1,282 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// atRestMagic starts the data sealed by AtRest.
+const atRestMagic = "\x00metcd-ar1\x00"
+
+var ErrNotAtRest = errors.New("encryption: data is encrypted at rest, no key is configured to open it")
+
+// KMS wraps the data keys of AtRest with a key encryption key it holds,
+// such as a key file or a key management service. Keys are named, so that
+// the key wrapping new data keys can be rotated while the data keys wrapped
+// by the previous ones still unwrap.
+type KMS interface {
+	// KeyID names the key wrapping the data keys from now on.
+	KeyID() string
+	Wrap(dataKey []byte) ([]byte, error)
+	// Unwrap returns the data key wrapped by the key keyID.
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// KMSOpener opens the KMS of target, the URI without its scheme.
+type KMSOpener func(target string) (KMS, error)
+
+var (
+	kmsMu      sync.RWMutex
+	kmsOpeners = map[string]KMSOpener{"file": OpenKeyFile}
+)
+
+// RegisterKMS makes the KMS of scheme available to OpenKMS. It panics if
+// the scheme is already registered.
+func RegisterKMS(scheme string, open KMSOpener) {
+	kmsMu.Lock()
+	defer kmsMu.Unlock()
+	if _, ok := kmsOpeners[scheme]; ok {
+		panic("encryption: KMS " + scheme + " registered twice")
+	}
+	kmsOpeners[scheme] = open
+}
+
+// KMSSchemes returns the registered KMS schemes, sorted.
+func KMSSchemes() []string {
+	kmsMu.RLock()
+	defer kmsMu.RUnlock()
+	schemes := make([]string, 0, len(kmsOpeners))
+	for s := range kmsOpeners {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// OpenKMS opens the KMS of uri, "<scheme>:<target>".
+func OpenKMS(uri string) (KMS, error) {
+	scheme, target, ok := strings.Cut(uri, ":")
+	kmsMu.RLock()
+	open := kmsOpeners[scheme]
+	kmsMu.RUnlock()
+	if !ok || open == nil {
+		return nil, fmt.Errorf("encryption: unknown KMS %q, want one of %s followed by :<target>", uri, strings.Join(KMSSchemes(), ", "))
+	}
+	return open(target)
+}
+
+// keyFile is the KMS of a key file.
+type keyFile struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// OpenKeyFile opens the KMS "file:<path>". The file has a key per line,
+// "<id>:<32 bytes in hex>", the first one wrapping the new data keys; the
+// others only unwrap, until the data they protect is re-encrypted. A file
+// of a single raw or hex key, as --encryption-key-file holds, is the key
+// "0".
+func OpenKeyFile(path string) (KMS, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kf := &keyFile{keys: make(map[string]cipher.AEAD)}
+	if !bytes.Contains(data, []byte(":")) {
+		key, err := LoadMasterKey(path)
+		if err != nil {
+			return nil, err
+		}
+		kf.current = "0"
+		kf.keys["0"], err = newAEAD(key)
+		return kf, err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, hexKey, _ := strings.Cut(line, ":")
+		key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+		if id = strings.TrimSpace(id); id == "" || len(id) > 255 || err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("encryption: line %d of %s is not <id>:<%d bytes in hex>", i+1, path, keySize)
+		}
+		if _, ok := kf.keys[id]; ok {
+			return nil, fmt.Errorf("encryption: key %q is twice in %s", id, path)
+		}
+		if kf.keys[id], err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		if kf.current == "" {
+			kf.current = id
+		}
+	}
+	if kf.current == "" {
+		return nil, fmt.Errorf("encryption: no key in %s", path)
+	}
+	return kf, nil
+}
+
+func (kf *keyFile) KeyID() string { return kf.current }
+
+func (kf *keyFile) Wrap(dataKey []byte) ([]byte, error) {
+	aead := kf.keys[kf.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func (kf *keyFile) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := kf.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption: key %q is not in the key file", keyID)
+	}
+	n := aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, ErrCorrupt
+	}
+	return aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+}
+
+// AtRest encrypts the WAL records and snapshots of a member with envelope
+// encryption: data is sealed with AES-256-GCM by a data key generated when
+// AtRest is created, and each sealed record carries that key wrapped by
+// the KMS. Unlike the Keyring it is local to the member: every member may
+// use keys of its own, peers receive plaintext.
+type AtRest struct {
+	kms KMS
+
+	mu        sync.Mutex
+	header    []byte // the magic, the key ID and the wrapped data key
+	aead      cipher.AEAD
+	unwrapped map[string]cipher.AEAD // by header
+}
+
+// NewAtRest returns an AtRest wrapping its data keys with kms.
+func NewAtRest(kms KMS) (*AtRest, error) {
+	a := &AtRest{kms: kms, unwrapped: make(map[string]cipher.AEAD)}
+	return a, a.Rotate()
+}
+
+// Rotate generates a new data key for the data sealed from now on, wrapped
+// by the current key of the KMS.
+func (a *AtRest) Rotate() error {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	id := a.kms.KeyID()
+	wrapped, err := a.kms.Wrap(key)
+	if err != nil {
+		return fmt.Errorf("encryption: cannot wrap the data key with %q: %w", id, err)
+	}
+	if len(id) > 255 || len(wrapped) > 0xffff {
+		return errors.New("encryption: key ID or wrapped key too long")
+	}
+	h := append([]byte(atRestMagic), byte(len(id)))
+	h = append(h, id...)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(wrapped)))
+	h = append(h, wrapped...)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.header, a.aead = h, aead
+	a.unwrapped[string(h)] = aead
+	return nil
+}
+
+// Seal encrypts data. A nil AtRest returns data as is.
+func (a *AtRest) Seal(data []byte) ([]byte, error) {
+	if a == nil {
+		return data, nil
+	}
+	a.mu.Lock()
+	h, aead := a.header, a.aead
+	a.mu.Unlock()
+	out := make([]byte, len(h), len(h)+aead.NonceSize()+len(data)+aead.Overhead())
+	copy(out, h)
+	nonce := out[len(h) : len(h)+aead.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out[:len(h)+len(nonce)], nonce, data, h), nil
+}
+
+// IsSealedAtRest reports whether data was sealed by an AtRest.
+func IsSealedAtRest(data []byte) bool { return bytes.HasPrefix(data, []byte(atRestMagic)) }
+
+// Open decrypts data sealed with any key of the KMS. Data that is not
+// sealed is returned as is, it was written before encryption at rest was
+// enabled. A nil AtRest fails with ErrNotAtRest on sealed data.
+func (a *AtRest) Open(data []byte) ([]byte, error) {
+	if !IsSealedAtRest(data) {
+		return data, nil
+	}
+	if a == nil {
+		return nil, ErrNotAtRest
+	}
+	h, keyID, wrapped, rest, err := splitAtRest(data)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	aead, ok := a.unwrapped[string(h)]
+	a.mu.Unlock()
+	if !ok {
+		key, err := a.kms.Unwrap(keyID, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: cannot unwrap a data key with %q: %w", keyID, err)
+		}
+		if aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		a.unwrapped[string(h)] = aead
+		a.mu.Unlock()
+	}
+	n := aead.NonceSize()
+	if len(rest) < n {
+		return nil, ErrCorrupt
+	}
+	plain, err := aead.Open(nil, rest[:n], rest[n:], h)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return plain, nil
+}
+
+// splitAtRest splits sealed data into its header, with the ID of the key
+// wrapping its data key and the wrapped key, and the nonce and ciphertext.
+func splitAtRest(data []byte) (h []byte, keyID string, wrapped, rest []byte, err error) {
+	off := len(atRestMagic)
+	if len(data) < off+1 {
+		return nil, "", nil, nil, ErrCorrupt
+	}
+	n := int(data[off])
+	off++
+	if len(data) < off+n+2 {
+		return nil, "", nil, nil, ErrCorrupt
+	}
+	keyID = string(data[off : off+n])
+	off += n
+	m := int(binary.BigEndian.Uint16(data[off:]))
+	off += 2
+	if len(data) < off+m {
+		return nil, "", nil, nil, ErrCorrupt
+	}
+	return data[:off+m], keyID, data[off : off+m], data[off+m:], nil
+}
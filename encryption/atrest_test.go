@@ -0,0 +1,104 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeKeyFile(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func hexKey(b byte) string { return hex.EncodeToString(bytes.Repeat([]byte{b}, keySize)) }
+
+func newTestAtRest(t *testing.T, uri string) *AtRest {
+	kms, err := OpenKMS(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAtRest(kms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAtRest(t *testing.T) {
+	a := newTestAtRest(t, "file:"+writeKeyFile(t, "# current key first", "k1:"+hexKey(1)))
+	sealed, err := a.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealedAtRest(sealed) || bytes.Contains(sealed, []byte("secret")) {
+		t.Fatalf("expected sealed data, got %q", sealed)
+	}
+	if plain, err := a.Open(sealed); err != nil || string(plain) != "secret" {
+		t.Fatalf("expected secret, got %q, %v", plain, err)
+	}
+	if plain, err := a.Open([]byte("plain")); err != nil || string(plain) != "plain" {
+		t.Fatalf("expected plaintext to open as is, got %q, %v", plain, err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := a.Open(sealed); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	sealed[len(sealed)-1] ^= 1
+
+	// a new key wraps the new data keys, the previous one still unwraps
+	rotated := newTestAtRest(t, "file:"+writeKeyFile(t, "k2:"+hexKey(2), "k1:"+hexKey(1)))
+	if plain, err := rotated.Open(sealed); err != nil || string(plain) != "secret" {
+		t.Fatalf("expected the data of the previous key to open, got %q, %v", plain, err)
+	}
+	resealed, err := rotated.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, keyID, _, _, err := splitAtRest(resealed); err != nil || keyID != "k2" {
+		t.Fatalf("expected the data key to be wrapped by k2, got %q, %v", keyID, err)
+	}
+	removed := newTestAtRest(t, "file:"+writeKeyFile(t, "k2:"+hexKey(2)))
+	if _, err := removed.Open(sealed); err == nil {
+		t.Fatal("expected the data of a removed key not to open")
+	}
+	if plain, err := removed.Open(resealed); err != nil || string(plain) != "secret" {
+		t.Fatalf("expected secret, got %q, %v", plain, err)
+	}
+
+	var none *AtRest
+	if out, err := none.Seal([]byte("plain")); err != nil || string(out) != "plain" {
+		t.Fatalf("expected a nil AtRest not to encrypt, got %q, %v", out, err)
+	}
+	if _, err := none.Open(sealed); !errors.Is(err, ErrNotAtRest) {
+		t.Fatalf("expected ErrNotAtRest, got %v", err)
+	}
+}
+
+func TestOpenKMS(t *testing.T) {
+	// a single key, as --encryption-key-file holds
+	kms, err := OpenKMS("file:" + writeKeyFile(t, hexKey(3)))
+	if err != nil || kms.KeyID() != "0" {
+		t.Fatalf("expected the key 0, got %v", err)
+	}
+	for _, lines := range [][]string{
+		{"k1:" + hexKey(1), "k1:" + hexKey(2)},
+		{"k1:1234"},
+		{":" + hexKey(1)},
+		{"# no key", ":"},
+	} {
+		if _, err := OpenKMS("file:" + writeKeyFile(t, lines...)); err == nil {
+			t.Fatalf("expected %q to be refused", lines)
+		}
+	}
+	if _, err := OpenKMS("vault:secret/metcd"); err == nil {
+		t.Fatal("expected an unknown KMS to be refused")
+	}
+}
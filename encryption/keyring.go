@@ -0,0 +1,370 @@
+// Package encryption encrypts values under key prefixes with data keys of
+// their own, wrapped by a master key, so the data of each prefix can be
+// rotated and destroyed on its own.
+//
+// The wrapped data keys are replicated with the store and every member
+// unwraps them with the same master key. A value is sealed with AES-256-GCM
+// by the member proposing it, so the WAL, snapshots and peer messages only
+// hold ciphertext; it names the prefix and version of its data key and is
+// bound to its key, so it cannot be moved to another key.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// magic starts every sealed value.
+const magic = "\x00metcd-enc1\x00"
+
+const keySize = 32 // AES-256
+
+var (
+	ErrNoMasterKey  = errors.New("encryption: no master key configured")
+	ErrKeyDestroyed = errors.New("encryption: data key not found, it may have been destroyed")
+	ErrCorrupt      = errors.New("encryption: corrupt sealed value")
+)
+
+// WrappedKey is a version of the data key of a prefix, encrypted with the
+// master key. It is replicated and part of the snapshots.
+type WrappedKey struct {
+	Keyspace string `json:"keyspace,omitempty"`
+	Prefix   string `json:"prefix"`
+	Version  uint32 `json:"version"`
+	Wrapped  []byte `json:"wrapped"`
+}
+
+type scope struct {
+	keyspace, prefix string
+}
+
+// dataKey is a WrappedKey with its cipher once unwrapped.
+type dataKey struct {
+	WrappedKey
+	aead cipher.AEAD
+}
+
+// Keyring holds the data keys of the prefixes. Without a master key it
+// still tracks the wrapped keys, but cannot seal or open values.
+type Keyring struct {
+	master cipher.AEAD
+
+	mu   sync.RWMutex
+	keys map[scope][]*dataKey // by version, the current one last
+}
+
+// NewKeyring creates a keyring with master, a 32 byte key, or without a
+// master key if master is nil.
+func NewKeyring(master []byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[scope][]*dataKey)}
+	if master == nil {
+		return k, nil
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	k.master = aead
+	return k, nil
+}
+
+// LoadMasterKey reads a master key from path, holding either the 32 bytes
+// of the key or their hex encoding.
+func LoadMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == keySize {
+		return data, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("encryption: %s does not hold a %d byte key, raw or hex", path, keySize)
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("encryption: key of %d bytes, expected %d", len(key), keySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// HasMasterKey reports whether values can be sealed and opened.
+func (k *Keyring) HasMasterKey() bool { return k.master != nil }
+
+// NewDataKey generates a data key and returns it wrapped by the master key,
+// for Add on every member.
+func (k *Keyring) NewDataKey() ([]byte, error) {
+	if k.master == nil {
+		return nil, ErrNoMasterKey
+	}
+	key := make([]byte, keySize)
+	nonce := make([]byte, k.master.NonceSize())
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.master.Seal(nonce, nonce, key, nil), nil
+}
+
+// Add makes wrapped the next version of the data key of prefix in
+// keyspace and returns its version. Values are sealed with the newest
+// version from then on.
+func (k *Keyring) Add(keyspace, prefix string, wrapped []byte) uint32 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s := scope{keyspace, prefix}
+	version := uint32(1)
+	if versions := k.keys[s]; len(versions) > 0 {
+		version = versions[len(versions)-1].Version + 1
+	}
+	k.keys[s] = append(k.keys[s], &dataKey{WrappedKey: WrappedKey{Keyspace: keyspace, Prefix: prefix, Version: version, Wrapped: wrapped}})
+	return version
+}
+
+// Destroy forgets every version of the data key of prefix in keyspace, and
+// reports whether there was one. Values sealed with it cannot be opened
+// anymore.
+func (k *Keyring) Destroy(keyspace, prefix string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s := scope{keyspace, prefix}
+	_, ok := k.keys[s]
+	delete(k.keys, s)
+	return ok
+}
+
+// DestroyKeyspace forgets the data keys of every prefix in keyspace.
+func (k *Keyring) DestroyKeyspace(keyspace string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for s := range k.keys {
+		if s.keyspace == keyspace {
+			delete(k.keys, s)
+		}
+	}
+}
+
+// List returns the data keys, sorted by keyspace, prefix and version.
+func (k *Keyring) List() []WrappedKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var keys []WrappedKey
+	for _, versions := range k.keys {
+		for _, dk := range versions {
+			keys = append(keys, dk.WrappedKey)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Keyspace != b.Keyspace {
+			return a.Keyspace < b.Keyspace
+		}
+		if a.Prefix != b.Prefix {
+			return a.Prefix < b.Prefix
+		}
+		return a.Version < b.Version
+	})
+	return keys
+}
+
+// Restore replaces the data keys with keys, as returned by List.
+func (k *Keyring) Restore(keys []WrappedKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = make(map[scope][]*dataKey)
+	for _, wk := range keys {
+		s := scope{wk.Keyspace, wk.Prefix}
+		k.keys[s] = append(k.keys[s], &dataKey{WrappedKey: wk})
+	}
+	for _, versions := range k.keys {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	}
+}
+
+// Encrypted returns the prefix whose data key seals key in keyspace, the
+// longest one.
+func (k *Keyring) Encrypted(keyspace, key string) (string, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.scopeOf(keyspace, key)
+}
+
+// scopeOf must be called with k.mu held.
+func (k *Keyring) scopeOf(keyspace, key string) (string, bool) {
+	best, found := "", false
+	for s := range k.keys {
+		if s.keyspace == keyspace && strings.HasPrefix(key, s.prefix) && (!found || len(s.prefix) > len(best)) {
+			best, found = s.prefix, true
+		}
+	}
+	return best, found
+}
+
+// cipherOf returns the cipher of dk, unwrapping it on first use. It must be
+// called with k.mu held.
+func (k *Keyring) cipherOf(dk *dataKey) (cipher.AEAD, error) {
+	if dk.aead != nil {
+		return dk.aead, nil
+	}
+	if k.master == nil {
+		return nil, ErrNoMasterKey
+	}
+	n := k.master.NonceSize()
+	if len(dk.Wrapped) < n {
+		return nil, ErrCorrupt
+	}
+	key, err := k.master.Open(nil, dk.Wrapped[:n], dk.Wrapped[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: cannot unwrap the data key of %q, version %d, with the master key: %w", dk.Prefix, dk.Version, err)
+	}
+	if dk.aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+	return dk.aead, nil
+}
+
+// header is the start of a value sealed for keyspace and prefix with a data
+// key version, also authenticated with the key of the value.
+func header(keyspace, prefix string, version uint32) []byte {
+	h := []byte(magic)
+	h = binary.AppendUvarint(h, uint64(len(keyspace)))
+	h = append(h, keyspace...)
+	h = binary.AppendUvarint(h, uint64(len(prefix)))
+	h = append(h, prefix...)
+	return binary.AppendUvarint(h, uint64(version))
+}
+
+// Seal encrypts value of key in keyspace with the current data key of its
+// prefix. Values of keys under no encrypted prefix are returned as is.
+func (k *Keyring) Seal(keyspace, key, value string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	prefix, ok := k.scopeOf(keyspace, key)
+	if !ok {
+		return value, nil
+	}
+	versions := k.keys[scope{keyspace, prefix}]
+	dk := versions[len(versions)-1]
+	aead, err := k.cipherOf(dk)
+	if err != nil {
+		return "", err
+	}
+	h := header(keyspace, prefix, dk.Version)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	aad := append(append([]byte(nil), h...), key...)
+	out := append(h, nonce...)
+	return string(aead.Seal(out, nonce, []byte(value), aad)), nil
+}
+
+// IsSealed reports whether value was returned by Seal.
+func IsSealed(value string) bool { return strings.HasPrefix(value, magic) }
+
+// parseHeader splits a sealed value into its header, the scope and version
+// of its data key, and the rest.
+func parseHeader(value string) (h string, s scope, version uint32, rest string, err error) {
+	r := bytes.NewReader([]byte(value[len(magic):]))
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return "", ErrCorrupt
+		}
+		b := make([]byte, n)
+		r.Read(b)
+		return string(b), nil
+	}
+	if s.keyspace, err = readString(); err != nil {
+		return
+	}
+	if s.prefix, err = readString(); err != nil {
+		return
+	}
+	v, err := binary.ReadUvarint(r)
+	if err != nil || v > 1<<32-1 {
+		return "", scope{}, 0, "", ErrCorrupt
+	}
+	n := len(value) - r.Len()
+	return value[:n], s, uint32(v), value[n:], nil
+}
+
+// SealedWith returns the keyspace and prefix of the data key value is
+// sealed with.
+func SealedWith(value string) (keyspace, prefix string, ok bool) {
+	if !IsSealed(value) {
+		return "", "", false
+	}
+	_, s, _, _, err := parseHeader(value)
+	return s.keyspace, s.prefix, err == nil
+}
+
+// Open decrypts a value of key sealed by Seal. Values that are not sealed
+// are returned as is.
+func (k *Keyring) Open(key, value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	h, s, version, rest, err := parseHeader(value)
+	if err != nil {
+		return "", err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var dk *dataKey
+	for _, v := range k.keys[s] {
+		if v.Version == version {
+			dk = v
+		}
+	}
+	if dk == nil {
+		return "", ErrKeyDestroyed
+	}
+	aead, err := k.cipherOf(dk)
+	if err != nil {
+		return "", err
+	}
+	if len(rest) < aead.NonceSize() {
+		return "", ErrCorrupt
+	}
+	plain, err := aead.Open(nil, []byte(rest[:aead.NonceSize()]), []byte(rest[aead.NonceSize():]), []byte(h+key))
+	if err != nil {
+		return "", ErrCorrupt
+	}
+	return string(plain), nil
+}
+
+// Check unwraps every data key, failing if the master key is missing or
+// is not the one they were wrapped with.
+func (k *Keyring) Check() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, versions := range k.keys {
+		for _, dk := range versions {
+			if _, err := k.cipherOf(dk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
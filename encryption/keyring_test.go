@@ -0,0 +1,154 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T, master byte) *Keyring {
+	k, err := NewKeyring(bytes.Repeat([]byte{master}, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func addKey(t *testing.T, k *Keyring, keyspace, prefix string) uint32 {
+	wrapped, err := k.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.Add(keyspace, prefix, wrapped)
+}
+
+func TestSealOpen(t *testing.T) {
+	k := newTestKeyring(t, 1)
+	addKey(t, k, "", "/tenant/a/")
+
+	plain, err := k.Seal("", "/other", "v")
+	if err != nil || plain != "v" {
+		t.Fatalf("expected keys under no encrypted prefix to stay plain, got %q, %v", plain, err)
+	}
+	sealed, err := k.Seal("", "/tenant/a/x", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || strings.Contains(sealed, "secret") {
+		t.Fatalf("expected a sealed value, got %q", sealed)
+	}
+	if space, prefix, ok := SealedWith(sealed); !ok || space != "" || prefix != "/tenant/a/" {
+		t.Fatalf("expected the value to be sealed for /tenant/a/, got %q %q %v", space, prefix, ok)
+	}
+	if v, err := k.Open("/tenant/a/x", sealed); err != nil || v != "secret" {
+		t.Fatalf("expected secret, got %q, %v", v, err)
+	}
+	// the value is bound to its key
+	if _, err := k.Open("/tenant/a/y", sealed); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt opening the value under another key, got %v", err)
+	}
+	// and to its keyspace
+	if v, err := k.Seal("app", "/tenant/a/x", "v"); err != nil || v != "v" {
+		t.Fatalf("expected the prefix of another keyspace to stay plain, got %q, %v", v, err)
+	}
+}
+
+func TestLongestPrefix(t *testing.T) {
+	k := newTestKeyring(t, 1)
+	addKey(t, k, "", "/a/")
+	addKey(t, k, "", "/a/b/")
+	if prefix, ok := k.Encrypted("", "/a/b/c"); !ok || prefix != "/a/b/" {
+		t.Fatalf("expected /a/b/, got %q %v", prefix, ok)
+	}
+	if prefix, ok := k.Encrypted("", "/a/c"); !ok || prefix != "/a/" {
+		t.Fatalf("expected /a/, got %q %v", prefix, ok)
+	}
+}
+
+func TestRotateDestroy(t *testing.T) {
+	k := newTestKeyring(t, 1)
+	if v := addKey(t, k, "", "/p/"); v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+	old, _ := k.Seal("", "/p/k", "old")
+	if v := addKey(t, k, "", "/p/"); v != 2 {
+		t.Fatalf("expected version 2, got %d", v)
+	}
+	cur, _ := k.Seal("", "/p/k", "new")
+	for sealed, want := range map[string]string{old: "old", cur: "new"} {
+		if v, err := k.Open("/p/k", sealed); err != nil || v != want {
+			t.Fatalf("expected %q after a rotation, got %q, %v", want, v, err)
+		}
+	}
+
+	if !k.Destroy("", "/p/") || k.Destroy("", "/p/") {
+		t.Fatal("expected Destroy to report the key once")
+	}
+	if _, err := k.Open("/p/k", cur); !errors.Is(err, ErrKeyDestroyed) {
+		t.Fatalf("expected ErrKeyDestroyed, got %v", err)
+	}
+	if v, _ := k.Seal("", "/p/k", "v"); v != "v" {
+		t.Fatalf("expected the prefix to be plain once its key is destroyed, got %q", v)
+	}
+}
+
+func TestMasterKey(t *testing.T) {
+	k := newTestKeyring(t, 1)
+	addKey(t, k, "", "/p/")
+	sealed, _ := k.Seal("", "/p/k", "v")
+
+	// a member without the master key tracks the keys but cannot use them
+	none, _ := NewKeyring(nil)
+	if _, err := none.NewDataKey(); !errors.Is(err, ErrNoMasterKey) {
+		t.Fatalf("expected ErrNoMasterKey, got %v", err)
+	}
+	none.Restore(k.List())
+	if _, err := none.Open("/p/k", sealed); !errors.Is(err, ErrNoMasterKey) {
+		t.Fatalf("expected ErrNoMasterKey, got %v", err)
+	}
+	if err := none.Check(); !errors.Is(err, ErrNoMasterKey) {
+		t.Fatalf("expected ErrNoMasterKey from Check, got %v", err)
+	}
+
+	other := newTestKeyring(t, 2)
+	other.Restore(k.List())
+	if err := other.Check(); err == nil {
+		t.Fatal("expected Check to fail with another master key")
+	}
+
+	same := newTestKeyring(t, 1)
+	same.Restore(k.List())
+	if err := same.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := same.Open("/p/k", sealed); err != nil || v != "v" {
+		t.Fatalf("expected v, got %q, %v", v, err)
+	}
+	if !reflect.DeepEqual(same.List(), k.List()) {
+		t.Fatalf("expected %v, got %v", k.List(), same.List())
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	raw := bytes.Repeat([]byte{0xab}, keySize)
+	for name, data := range map[string][]byte{
+		"raw": raw,
+		"hex": []byte(strings.Repeat("ab", keySize) + "\n"),
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, data, 0600)
+		if key, err := LoadMasterKey(path); err != nil || !bytes.Equal(key, raw) {
+			t.Fatalf("%s: expected the key, got %x, %v", name, key, err)
+		}
+	}
+	path := filepath.Join(dir, "short")
+	os.WriteFile(path, []byte("abcd"), 0600)
+	if _, err := LoadMasterKey(path); err == nil {
+		t.Fatal("expected an error for a short key")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"metcd/api"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errInvalidIfMatch = errors.New("invalid If-Match")
+
+// etag returns the entity tag of a key last changed at rev, its mod
+// revision quoted, a strong tag since a revision names one value.
+func etag(rev int64) string {
+	return `"` + strconv.FormatInt(rev, 10) + `"`
+}
+
+// ifMatch returns the compare the If-Match header of r asks for on key, nil
+// without the header: "*" holds if key exists, an entity tag of GET if key
+// was not changed since. ok is false for a tag no revision matches, weak
+// ones included, so the request fails without a proposal. A list of tags
+// is not supported, the compares of a txn all have to hold.
+func ifMatch(r *http.Request, key string) (*api.Compare, bool, error) {
+	v := strings.TrimSpace(r.Header.Get("If-Match"))
+	if v == "" {
+		return nil, true, nil
+	}
+	if v == "*" {
+		return &api.Compare{Target: api.CompareExists, Result: api.CompareEqual, Key: key, Value: "true"}, true, nil
+	}
+	if strings.Contains(v, ",") {
+		return nil, false, errInvalidIfMatch
+	}
+	weak := strings.HasPrefix(v, "W/")
+	v = strings.TrimPrefix(v, "W/")
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return nil, false, errInvalidIfMatch
+	}
+	rev, err := strconv.ParseInt(v[1:len(v)-1], 10, 64)
+	if err != nil || rev <= 0 || weak {
+		// a tag of another kind names no revision, and matches none
+		return nil, false, nil
+	}
+	return &api.Compare{Target: api.CompareMod, Result: api.CompareEqual, Key: key, Value: strconv.FormatInt(rev, 10)}, true, nil
+}
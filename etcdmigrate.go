@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"metcd/api"
+	"metcd/client"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// migrateFromEtcd implements `metcd migrate-from-etcd`: it reads the keys
+// of an etcd v3 snapshot file or of a live etcd and imports them into a
+// metcd cluster through POST /admin/import.
+func migrateFromEtcd(args []string) error {
+	fset := flag.NewFlagSet("migrate-from-etcd", flag.ExitOnError)
+	snapshot := fset.String("snapshot", "", "etcd v3 snapshot (etcdctl snapshot save) or member bbolt db to read")
+	etcd := fset.String("etcd", "", "comma separated client URLs of a live etcd to read at one revision instead")
+	endpoints := fset.String("endpoints", "http://127.0.0.1:9121", "comma separated metcd endpoints")
+	keyspace := fset.String("keyspace", "", "metcd keyspace to import into")
+	prefix := fset.String("prefix", "", "migrate only the etcd keys with this prefix")
+	leased := fset.Bool("leased-keys", false, "also migrate keys attached to a lease; metcd has no leases, they are copied without expiry")
+	slash := fset.Bool("add-slash", true, "prefix keys that do not start with / with one, as /kv/<key> addresses them")
+	fset.Parse(args)
+	if (*snapshot == "") == (*etcd == "") {
+		return errors.New("migrate-from-etcd needs one of --snapshot or --etcd")
+	}
+
+	var kvs []*mvccpb.KeyValue
+	var rev int64
+	var err error
+	if *snapshot != "" {
+		kvs, rev, err = readEtcdSnapshot(*snapshot)
+	} else {
+		kvs, rev, err = readEtcdRange(http.DefaultClient, strings.Split(*etcd, ","), *prefix)
+	}
+	if err != nil {
+		return err
+	}
+	pairs, skipped := etcdKeyValues(kvs, *prefix, *leased, *slash)
+	log.Printf("read %d keys at etcd revision %d, skipping %d attached to leases", len(pairs), rev, skipped)
+
+	c, err := client.New(client.Config{Endpoints: strings.Split(*endpoints, ",")})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var opts []client.CallOption
+	if *keyspace != "" {
+		opts = append(opts, client.WithKeyspace(*keyspace))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	pr, pw := io.Pipe()
+	// the proto format keeps binary values intact
+	go func() { pw.CloseWithError(writeExport(pw, exportProto, pairs)) }()
+	res, err := c.Import(ctx, pr, client.ExportProto, func(p api.ImportProgress) {
+		log.Printf("imported %d of %d keys", p.Keys, len(pairs))
+	}, opts...)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("migrated %d keys (%d bytes) from etcd revision %d, metcd is at revision %d", res.Keys, res.Bytes, rev, res.Rev)
+	return nil
+}
+
+// etcdKeyValues returns the keys of kvs with prefix sorted by key, without
+// those attached to a lease unless leased is set, and the number of keys
+// skipped for their lease. With slash, keys get a leading / if they lack
+// one.
+func etcdKeyValues(kvs []*mvccpb.KeyValue, prefix string, leased, slash bool) ([]api.KeyValue, int) {
+	pairs := make([]api.KeyValue, 0, len(kvs))
+	skipped := 0
+	for _, kv := range kvs {
+		key := string(kv.Key)
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if kv.Lease != 0 && !leased {
+			skipped++
+			continue
+		}
+		if slash && !strings.HasPrefix(key, "/") {
+			key = "/" + key
+		}
+		pairs = append(pairs, api.KeyValue{Key: key, Value: string(kv.Value)})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs, skipped
+}
+
+// readEtcdSnapshot returns the current keys of an etcd v3 snapshot, with
+// the revision of the last change. The keys bucket of the bbolt file holds
+// every revision not yet compacted, keyed by revision, so the last one of
+// each key wins and tombstones delete it.
+func readEtcdSnapshot(path string) ([]*mvccpb.KeyValue, int64, error) {
+	db, err := openBolt(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer db.f.Close()
+	latest := make(map[string]*mvccpb.KeyValue)
+	var rev int64
+	found, err := db.forEach(db.root, []byte("key"), func(k, v []byte) error {
+		// an 8 byte main revision, '_', an 8 byte sub revision and a 't' for
+		// tombstones
+		if len(k) < 17 || k[8] != '_' {
+			return fmt.Errorf("%s: invalid revision key %x", path, k)
+		}
+		rev = int64(binary.BigEndian.Uint64(k[:8]))
+		kv := &mvccpb.KeyValue{}
+		if err := kv.Unmarshal(v); err != nil {
+			return fmt.Errorf("%s: revision %d: %v", path, rev, err)
+		}
+		if len(k) > 17 && k[17] == 't' {
+			delete(latest, string(kv.Key))
+		} else {
+			latest[string(kv.Key)] = kv
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if !found {
+		return nil, 0, fmt.Errorf("%s: no key bucket, not an etcd v3 database", path)
+	}
+	kvs := make([]*mvccpb.KeyValue, 0, len(latest))
+	for _, kv := range latest {
+		kvs = append(kvs, kv)
+	}
+	return kvs, rev, nil
+}
+
+// Layout of a bbolt file, which stores every value in the byte order of the
+// machine that wrote it, little endian in practice.
+const (
+	boltMagic         = 0xED0CDAED
+	boltPageHeader    = 16
+	boltElementSize   = 16
+	boltBranchPage    = 0x01
+	boltLeafPage      = 0x02
+	boltBucketElement = 0x01
+	boltMetaChecksum  = 56
+	boltMetaSize      = 64
+)
+
+// boltDB reads the B+trees of a bbolt file without locking it; the file
+// must not change while it is read.
+type boltDB struct {
+	f        *os.File
+	pageSize int
+	root     []byte // root page of the root bucket
+}
+
+func openBolt(path string) (*boltDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	db := &boltDB{f: f}
+	if err := db.readMeta(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return db, nil
+}
+
+// readMeta loads the root bucket of the newest of the two meta pages with a
+// valid checksum.
+func (db *boltDB) readMeta() error {
+	var root, txid uint64
+	pageSize := uint32(os.Getpagesize()) // where bbolt puts the second meta page
+	for i := 0; i < 2; i++ {
+		var buf [boltPageHeader + boltMetaSize]byte
+		if _, err := db.f.ReadAt(buf[:], int64(i)*int64(pageSize)); err != nil {
+			continue
+		}
+		m := buf[boltPageHeader:]
+		h := fnv.New64a()
+		h.Write(m[:boltMetaChecksum])
+		if binary.LittleEndian.Uint32(m) != boltMagic || h.Sum64() != binary.LittleEndian.Uint64(m[boltMetaChecksum:]) {
+			continue
+		}
+		size := binary.LittleEndian.Uint32(m[8:])
+		if i == 0 {
+			pageSize = size
+		}
+		if tx := binary.LittleEndian.Uint64(m[48:]); root == 0 || tx > txid {
+			root, txid, db.pageSize = binary.LittleEndian.Uint64(m[16:]), tx, int(size)
+		}
+	}
+	if root == 0 || db.pageSize < boltPageHeader+boltMetaSize {
+		return errors.New("not a bbolt database")
+	}
+	var err error
+	db.root, err = db.page(root)
+	return err
+}
+
+// page reads the page id with its overflow pages.
+func (db *boltDB) page(id uint64) ([]byte, error) {
+	hdr := make([]byte, boltPageHeader)
+	if _, err := db.f.ReadAt(hdr, int64(id)*int64(db.pageSize)); err != nil {
+		return nil, fmt.Errorf("page %d: %v", id, err)
+	}
+	overflow := binary.LittleEndian.Uint32(hdr[12:])
+	p := make([]byte, (int(overflow)+1)*db.pageSize)
+	if _, err := db.f.ReadAt(p, int64(id)*int64(db.pageSize)); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("page %d: %v", id, err)
+	}
+	return p, nil
+}
+
+// walk calls fn for the elements of the B+tree at page p in key order.
+func (db *boltDB) walk(p []byte, fn func(k, v []byte, flags uint32) error) error {
+	if len(p) < boltPageHeader {
+		return errors.New("truncated page")
+	}
+	flags, count := binary.LittleEndian.Uint16(p[8:]), int(binary.LittleEndian.Uint16(p[10:]))
+	if boltPageHeader+count*boltElementSize > len(p) {
+		return errors.New("corrupted page")
+	}
+	for i := 0; i < count; i++ {
+		e := boltPageHeader + i*boltElementSize
+		switch {
+		case flags&boltLeafPage != 0:
+			eflags := binary.LittleEndian.Uint32(p[e:])
+			pos, ksize, vsize := int(binary.LittleEndian.Uint32(p[e+4:])), int(binary.LittleEndian.Uint32(p[e+8:])), int(binary.LittleEndian.Uint32(p[e+12:]))
+			if e+pos+ksize+vsize > len(p) {
+				return errors.New("corrupted leaf element")
+			}
+			k := p[e+pos : e+pos+ksize]
+			if err := fn(k, p[e+pos+ksize:e+pos+ksize+vsize], eflags); err != nil {
+				return err
+			}
+		case flags&boltBranchPage != 0:
+			child, err := db.page(binary.LittleEndian.Uint64(p[e+8:]))
+			if err != nil {
+				return err
+			}
+			if err := db.walk(child, fn); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected page flags %#x", flags)
+		}
+	}
+	return nil
+}
+
+// forEach calls fn for the keys and values of the bucket name in the tree
+// at page p, reporting whether the bucket exists.
+func (db *boltDB) forEach(p, name []byte, fn func(k, v []byte) error) (bool, error) {
+	var bucket []byte
+	err := db.walk(p, func(k, v []byte, flags uint32) error {
+		if flags&boltBucketElement != 0 && bytes.Equal(k, name) {
+			bucket = v
+		}
+		return nil
+	})
+	if err != nil || bucket == nil {
+		return false, err
+	}
+	if len(bucket) < 16 {
+		return true, errors.New("corrupted bucket")
+	}
+	root := bucket[16:] // an inline bucket follows its header
+	if id := binary.LittleEndian.Uint64(bucket); id != 0 {
+		if root, err = db.page(id); err != nil {
+			return true, err
+		}
+	}
+	return true, db.walk(root, func(k, v []byte, flags uint32) error {
+		if flags&boltBucketElement != 0 {
+			return nil
+		}
+		return fn(k, v)
+	})
+}
+
+// etcdRangeLimit is the number of keys read from a live etcd per request.
+var etcdRangeLimit = 1000
+
+// etcdRangeResponse is the JSON of the etcd v3 gateway, which encodes bytes
+// in base64 and 64-bit integers as strings.
+type etcdRangeResponse struct {
+	Header struct {
+		Revision int64 `json:"revision,string"`
+	} `json:"header"`
+	KVs []struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+		Lease int64  `json:"lease,string"`
+	} `json:"kvs"`
+	More bool `json:"more"`
+}
+
+// readEtcdRange reads the keys with prefix, or every key, from the JSON
+// gateway of a live etcd at the revision of the first request, so the copy
+// is consistent however long it takes.
+func readEtcdRange(hc *http.Client, endpoints []string, prefix string) ([]*mvccpb.KeyValue, int64, error) {
+	key, end := []byte(prefix), prefixEnd([]byte(prefix))
+	if len(key) == 0 {
+		key = []byte{0}
+	}
+	var kvs []*mvccpb.KeyValue
+	var rev int64
+	for {
+		req := map[string]interface{}{
+			"key":       base64.StdEncoding.EncodeToString(key),
+			"range_end": base64.StdEncoding.EncodeToString(end),
+			"limit":     etcdRangeLimit,
+		}
+		if rev != 0 {
+			req["revision"] = rev
+		}
+		body, _ := json.Marshal(req)
+		var resp etcdRangeResponse
+		if err := postEtcd(hc, endpoints, "/v3/kv/range", body, &resp); err != nil {
+			return nil, 0, err
+		}
+		if rev == 0 {
+			rev = resp.Header.Revision
+		}
+		for _, kv := range resp.KVs {
+			kvs = append(kvs, &mvccpb.KeyValue{Key: kv.Key, Value: kv.Value, Lease: kv.Lease})
+		}
+		if !resp.More || len(resp.KVs) == 0 {
+			return kvs, rev, nil
+		}
+		key = append(append([]byte(nil), resp.KVs[len(resp.KVs)-1].Key...), 0)
+	}
+}
+
+// prefixEnd returns the end of the range of keys with prefix, "\x00" for
+// every key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// postEtcd posts body to the first endpoint that answers.
+func postEtcd(hc *http.Client, endpoints []string, path string, body []byte, out interface{}) error {
+	var lastErr error
+	for _, ep := range endpoints {
+		resp, err := hc.Post(strings.TrimSuffix(ep, "/")+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return fmt.Errorf("etcd %s: %s: %s", ep, resp.Status, strings.TrimSpace(string(b)))
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return lastErr
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"metcd/api"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// boltElem is an element of a page written by boltPage.
+type boltElem struct {
+	flags uint32
+	key   []byte
+	value []byte
+	pgid  uint64 // of a branch element
+}
+
+// boltPage lays out a bbolt page in pages pages of size.
+func boltPage(size, pages int, id uint64, flags uint16, elems []boltElem) []byte {
+	p := make([]byte, size*pages)
+	binary.LittleEndian.PutUint64(p, id)
+	binary.LittleEndian.PutUint16(p[8:], flags)
+	binary.LittleEndian.PutUint16(p[10:], uint16(len(elems)))
+	binary.LittleEndian.PutUint32(p[12:], uint32(pages-1))
+	data := boltPageHeader + len(elems)*boltElementSize
+	for i, el := range elems {
+		e := boltPageHeader + i*boltElementSize
+		if flags == boltBranchPage {
+			binary.LittleEndian.PutUint32(p[e:], uint32(data-e))
+			binary.LittleEndian.PutUint32(p[e+4:], uint32(len(el.key)))
+			binary.LittleEndian.PutUint64(p[e+8:], el.pgid)
+		} else {
+			binary.LittleEndian.PutUint32(p[e:], el.flags)
+			binary.LittleEndian.PutUint32(p[e+4:], uint32(data-e))
+			binary.LittleEndian.PutUint32(p[e+8:], uint32(len(el.key)))
+			binary.LittleEndian.PutUint32(p[e+12:], uint32(len(el.value)))
+		}
+		data += copy(p[data:], el.key)
+		data += copy(p[data:], el.value)
+	}
+	return p
+}
+
+func boltMeta(size int, id, root, txid uint64, valid bool) []byte {
+	p := make([]byte, size)
+	binary.LittleEndian.PutUint64(p, id)
+	binary.LittleEndian.PutUint16(p[8:], 0x04)
+	m := p[boltPageHeader:]
+	binary.LittleEndian.PutUint32(m, boltMagic)
+	binary.LittleEndian.PutUint32(m[4:], 2)
+	binary.LittleEndian.PutUint32(m[8:], uint32(size))
+	binary.LittleEndian.PutUint64(m[16:], root)
+	binary.LittleEndian.PutUint64(m[48:], txid)
+	h := fnv.New64a()
+	h.Write(m[:boltMetaChecksum])
+	sum := h.Sum64()
+	if !valid {
+		sum++
+	}
+	binary.LittleEndian.PutUint64(m[boltMetaChecksum:], sum)
+	return p
+}
+
+func etcdRev(main int64, tombstone bool) []byte {
+	k := make([]byte, 17, 18)
+	binary.BigEndian.PutUint64(k, uint64(main))
+	k[8] = '_'
+	if tombstone {
+		k = append(k, 't')
+	}
+	return k
+}
+
+func etcdValue(t *testing.T, key, value string, lease int64) []byte {
+	data, err := (&mvccpb.KeyValue{Key: []byte(key), Value: []byte(value), Lease: lease}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReadEtcdSnapshot(t *testing.T) {
+	size := os.Getpagesize()
+	bucket := func(root uint64, inline []byte) []byte {
+		v := make([]byte, 16)
+		binary.LittleEndian.PutUint64(v, root)
+		return append(v, inline...)
+	}
+	meta := boltPage(size, 1, 0, boltLeafPage, []boltElem{{key: []byte("consistent_index"), value: []byte{1}}})
+	var file bytes.Buffer
+	file.Write(boltMeta(size, 0, 3, 2, true))
+	// newer, but torn
+	file.Write(boltMeta(size, 1, 9, 3, false))
+	file.Write(make([]byte, size)) // freelist
+	file.Write(boltPage(size, 1, 3, boltLeafPage, []boltElem{
+		{flags: boltBucketElement, key: []byte("key"), value: bucket(4, nil)},
+		{flags: boltBucketElement, key: []byte("meta"), value: bucket(0, meta[:64])},
+	}))
+	file.Write(boltPage(size, 1, 4, boltBranchPage, []boltElem{{key: etcdRev(2, false), pgid: 5}, {key: etcdRev(4, false), pgid: 6}}))
+	file.Write(boltPage(size, 1, 5, boltLeafPage, []boltElem{
+		{key: etcdRev(2, false), value: etcdValue(t, "/a", "1", 0)},
+		{key: etcdRev(3, false), value: etcdValue(t, "b", "2", 5)},
+	}))
+	// a leaf with an overflow page
+	file.Write(boltPage(size, 2, 6, boltLeafPage, []boltElem{
+		{key: etcdRev(4, false), value: etcdValue(t, "/a", strings.Repeat("3", size), 0)},
+		{key: etcdRev(5, false), value: etcdValue(t, "/c", "x", 0)},
+		{key: etcdRev(6, true), value: etcdValue(t, "/c", "", 0)},
+	}))
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	if err := os.WriteFile(path, file.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kvs, rev, err := readEtcdSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev != 6 || len(kvs) != 2 {
+		t.Fatalf("expected 2 keys at revision 6, got %v at %d", kvs, rev)
+	}
+	pairs, skipped := etcdKeyValues(kvs, "", false, true)
+	if want := []api.KeyValue{{Key: "/a", Value: strings.Repeat("3", size)}}; skipped != 1 || !reflect.DeepEqual(pairs, want) {
+		t.Fatalf("expected %v, skipping 1 leased key, got %v, skipping %d", want, pairs, skipped)
+	}
+	pairs, _ = etcdKeyValues(kvs, "b", true, true)
+	if want := []api.KeyValue{{Key: "/b", Value: "2"}}; !reflect.DeepEqual(pairs, want) {
+		t.Fatalf("expected %v, got %v", want, pairs)
+	}
+
+	if err := os.WriteFile(path, make([]byte, 2*size), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readEtcdSnapshot(path); err == nil {
+		t.Fatal("expected an error reading a file that is not a bbolt database")
+	}
+}
+
+func TestReadEtcdRange(t *testing.T) {
+	defer func(n int) { etcdRangeLimit = n }(etcdRangeLimit)
+	etcdRangeLimit = 1
+	keys := []string{"/a", "/b"}
+	var revs []int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/kv/range" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+			Revision int64  `json:"revision"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		revs = append(revs, req.Revision)
+		resp := map[string]interface{}{"header": map[string]string{"revision": "7"}}
+		for i, k := range keys {
+			if k >= string(req.Key) && k < string(req.RangeEnd) {
+				resp["kvs"] = []map[string]string{{"key": base64.StdEncoding.EncodeToString([]byte(k)), "value": "dg==", "lease": "0"}}
+				resp["more"] = i < len(keys)-1
+				break
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	kvs, rev, err := readEtcdRange(srv.Client(), []string{"http://127.0.0.1:1", srv.URL}, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev != 7 || len(kvs) != 2 || string(kvs[1].Key) != "/b" || string(kvs[1].Value) != "v" {
+		t.Fatalf("expected /a and /b at 7, got %v at %d", kvs, rev)
+	}
+	// the pages after the first are read at its revision
+	if !reflect.DeepEqual(revs, []int64{0, 7}) {
+		t.Fatalf("expected the requested revisions to be [0 7], got %v", revs)
+	}
+}
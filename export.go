@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"metcd/api"
+	"sort"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// Formats of the logical export of GET /snapshot?format=.
+const (
+	// exportJSON is one api.KeyValue JSON object per line.
+	exportJSON = "json"
+	// exportProto is a sequence of etcd mvccpb.KeyValue messages, each
+	// preceded by its size as a varint.
+	exportProto = "proto"
+)
+
+// Export returns the keys and values of the keyspace called name sorted by
+// key, and its revision, the values under redacted prefixes replaced. The store is locked only while the pairs are
+// copied, so writes go on while the export is written out.
+func (s *kvstore) Export(name string) ([]api.KeyValue, int64, error) {
+	s.mu.RLock()
+	ks, err := s.space(name)
+	if err != nil {
+		s.mu.RUnlock()
+		return nil, 0, err
+	}
+	kvs := make([]api.KeyValue, 0, len(ks.kvStore))
+	for k, v := range ks.kvStore {
+		kvs = append(kvs, api.KeyValue{Key: k, Value: v})
+	}
+	rev, prefixes := ks.rev, s.redactedPrefixes(name)
+	s.mu.RUnlock()
+	for i, kv := range kvs {
+		if hasAnyPrefix(kv.Key, prefixes) {
+			kvs[i].Value = redactedValue
+		} else if kvs[i].Value, err = s.open(kv.Key, kv.Value); err != nil {
+			return nil, 0, err
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, rev, nil
+}
+
+// writeExport writes kvs to w in format.
+func writeExport(w io.Writer, format string, kvs []api.KeyValue) error {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case exportJSON:
+		enc := json.NewEncoder(bw)
+		for i := range kvs {
+			if err := enc.Encode(&kvs[i]); err != nil {
+				return err
+			}
+		}
+	case exportProto:
+		var size []byte
+		for _, kv := range kvs {
+			m := mvccpb.KeyValue{Key: []byte(kv.Key), Value: []byte(kv.Value)}
+			data, err := m.Marshal()
+			if err != nil {
+				return err
+			}
+			size = binary.AppendUvarint(size[:0], uint64(len(data)))
+			bw.Write(size)
+			if _, err := bw.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
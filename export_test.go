@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"metcd/api"
+	"reflect"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestExport(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.apply(kv{Op: opPut, Key: "/b", Val: "2"})
+	s.apply(kv{Op: opPut, Key: "/a", Val: "1"})
+	s.apply(kv{Op: opKeyspacePut, Keyspace: "app"})
+	s.apply(kv{Op: opPut, Keyspace: "app", Key: "/c", Val: "\x00\xff"})
+
+	kvs, rev, err := s.Export("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []api.KeyValue{{Key: "/a", Value: "1"}, {Key: "/b", Value: "2"}}; rev != 2 || !reflect.DeepEqual(kvs, want) {
+		t.Fatalf("expected %v at 2, got %v at %d", want, kvs, rev)
+	}
+	var buf bytes.Buffer
+	if err := writeExport(&buf, exportJSON, kvs); err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(&buf)
+	for _, want := range kvs {
+		var got api.KeyValue
+		if err := dec.Decode(&got); err != nil || got != want {
+			t.Fatalf("expected %v, got %v, %v", want, got, err)
+		}
+	}
+
+	// the proto format is binary safe
+	kvs, rev, err = s.Export("app")
+	if err != nil || rev != 1 {
+		t.Fatalf("expected revision 1, got %d, %v", rev, err)
+	}
+	buf.Reset()
+	if err := writeExport(&buf, exportProto, kvs); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(&buf)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	var m mvccpb.KeyValue
+	if err := m.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Key) != "/c" || string(m.Value) != "\x00\xff" {
+		t.Fatalf("unexpected message %v", m)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the end of the export, got %v", err)
+	}
+
+	if _, _, err := s.Export("missing"); err != ErrKeyspaceNotFound {
+		t.Fatalf("expected %v, got %v", ErrKeyspaceNotFound, err)
+	}
+}
@@ -0,0 +1,205 @@
+// Package failpoint injects delays and errors at named points of metcd, so
+// tests and operators can reproduce slow disks, crashes and partitions.
+//
+// A failpoint is enabled with a spec, "[<count>*]<action>":
+//
+//	off            disabled
+//	sleep(<d>)     waits for the time.Duration d
+//	error(<msg>)   fails with msg
+//	panic(<msg>)   panics with msg, a crash
+//	drop           fails with ErrDrop, a lost message
+//
+// A count limits the action to the next count evaluations. Failpoints are
+// enabled with Enable or, at startup, with the METCD_FAILPOINTS environment
+// variable, "<name>=<spec>;<name>=<spec>". A name with an "@<member>"
+// suffix only applies to that member, e.g. "raft/send@2=drop".
+package failpoint
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The failpoints of metcd.
+const (
+	// WALSave is evaluated before the raft loop writes a Ready to the WAL;
+	// an error stops the member as a failed write would
+	WALSave = "raft/walSave"
+	// SnapshotSave is evaluated before a snapshot is written to disk; an
+	// error fails the write, which stops or crashes the member
+	SnapshotSave = "raft/snapshotSave"
+	// Send is evaluated before the messages of a Ready are sent to the
+	// peers; drop or an error loses them
+	Send = "raft/send"
+	// Receive is evaluated for every message received from a peer; drop or
+	// an error loses it. With Send, it partitions the member
+	Receive = "raft/receive"
+	// Apply is evaluated before committed entries are handed to the state
+	// machine, which cannot skip them: an error crashes the member
+	Apply = "raft/apply"
+)
+
+// EnvVar is the environment variable read at startup.
+const EnvVar = "METCD_FAILPOINTS"
+
+// ErrDrop is returned by the drop action.
+var ErrDrop = errors.New("failpoint: dropped")
+
+// rule is an enabled failpoint.
+type rule struct {
+	spec   string
+	action string
+	arg    string
+	sleep  time.Duration
+	count  int64 // remaining evaluations, -1 is unlimited
+}
+
+var (
+	mu    sync.RWMutex
+	rules = make(map[string]*rule)
+	// active is the number of enabled failpoints, so Inject costs a load
+	// when none is
+	active atomic.Int32
+)
+
+func init() {
+	if err := EnableAll(os.Getenv(EnvVar)); err != nil {
+		fmt.Fprintf(os.Stderr, "ignoring %s: %v\n", EnvVar, err)
+	}
+}
+
+// EnableAll enables the failpoints of specs, "<name>=<spec>;...".
+func EnableAll(specs string) error {
+	for _, s := range strings.Split(specs, ";") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("failpoint: want <name>=<spec>, got %q", s)
+		}
+		if err := Enable(strings.TrimSpace(name), strings.TrimSpace(spec)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enable sets the failpoint name to spec; "off" disables it.
+func Enable(name, spec string) error {
+	if name == "" {
+		return errors.New("failpoint: empty name")
+	}
+	r, err := parse(spec)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	delete(rules, name)
+	if r != nil {
+		rules[name] = r
+	}
+	active.Store(int32(len(rules)))
+	return nil
+}
+
+// Disable disables the failpoint name.
+func Disable(name string) {
+	Enable(name, "off")
+}
+
+// List returns the specs of the enabled failpoints by name.
+func List() map[string]string {
+	mu.RLock()
+	defer mu.RUnlock()
+	specs := make(map[string]string, len(rules))
+	for name, r := range rules {
+		specs[name] = r.spec
+	}
+	return specs
+}
+
+func parse(spec string) (*rule, error) {
+	r := &rule{spec: spec, count: -1}
+	if n, rest, ok := strings.Cut(spec, "*"); ok && !strings.Contains(n, "(") {
+		count, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("failpoint: invalid count in %q", spec)
+		}
+		r.count, spec = count, rest
+	}
+	action, arg := spec, ""
+	if i := strings.IndexByte(spec, '('); i >= 0 && strings.HasSuffix(spec, ")") {
+		action, arg = spec[:i], spec[i+1:len(spec)-1]
+	}
+	r.action, r.arg = action, arg
+	switch action {
+	case "off":
+		return nil, nil
+	case "sleep":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, fmt.Errorf("failpoint: invalid sleep in %q", spec)
+		}
+		r.sleep = d
+	case "error", "panic":
+		if arg == "" {
+			r.arg = "failpoint"
+		}
+	case "drop":
+	default:
+		return nil, fmt.Errorf("failpoint: unknown action in %q, want off, sleep(d), error(msg), panic(msg) or drop", spec)
+	}
+	return r, nil
+}
+
+// Inject evaluates the failpoint name for member: it sleeps, returns an
+// error or panics as enabled, and returns nil if it is not.
+func Inject(name string, member uint64) error {
+	if active.Load() == 0 {
+		return nil
+	}
+	r := take(name+"@"+strconv.FormatUint(member, 10), name)
+	if r == nil {
+		return nil
+	}
+	switch r.action {
+	case "sleep":
+		time.Sleep(r.sleep)
+	case "error":
+		return fmt.Errorf("failpoint %s: %s", name, r.arg)
+	case "panic":
+		panic(fmt.Sprintf("failpoint %s: %s", name, r.arg))
+	case "drop":
+		return ErrDrop
+	}
+	return nil
+}
+
+// take returns the rule of the first enabled name, counting the
+// evaluation.
+func take(names ...string) *rule {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range names {
+		r, ok := rules[name]
+		if !ok {
+			continue
+		}
+		if r.count > 0 {
+			if r.count--; r.count == 0 {
+				delete(rules, name)
+				active.Store(int32(len(rules)))
+			}
+		}
+		return r
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package failpoint
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		spec   string
+		action string
+		arg    string
+		count  int64
+	}{
+		{"drop", "drop", "", -1},
+		{"error(disk full)", "error", "disk full", -1},
+		{"error(a*b)", "error", "a*b", -1},
+		{"panic", "panic", "failpoint", -1},
+		{"2*sleep(10ms)", "sleep", "10ms", 2},
+	} {
+		r, err := parse(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.spec, err)
+		}
+		if r.action != tt.action || r.arg != tt.arg || r.count != tt.count {
+			t.Fatalf("%s: got %+v", tt.spec, r)
+		}
+	}
+	if r, err := parse("off"); r != nil || err != nil {
+		t.Fatalf("expected off to disable, got %+v %v", r, err)
+	}
+	for _, spec := range []string{"", "crash", "sleep(soon)", "0*drop", "x*drop"} {
+		if _, err := parse(spec); err == nil {
+			t.Fatalf("expected %q to be invalid", spec)
+		}
+	}
+}
+
+func TestInject(t *testing.T) {
+	defer EnableAll("a=off;b=off;b@2=off;c=off;d=off")
+	if err := Inject("a", 1); err != nil {
+		t.Fatalf("expected nothing enabled, got %v", err)
+	}
+	if err := EnableAll("a=2*error(boom); b@2=drop; c=sleep(20ms)"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := Inject("a", 1); err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Fatalf("expected the error, got %v", err)
+		}
+	}
+	if err := Inject("a", 1); err != nil {
+		t.Fatalf("expected the count to be used up, got %v", err)
+	}
+	if err := Inject("b", 1); err != nil {
+		t.Fatalf("expected b to only apply to member 2, got %v", err)
+	}
+	if err := Inject("b", 2); !errors.Is(err, ErrDrop) {
+		t.Fatalf("expected a drop, got %v", err)
+	}
+	start := time.Now()
+	if err := Inject("c", 1); err != nil || time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("expected a sleep, got %v after %v", err, time.Since(start))
+	}
+	if specs := List(); len(specs) != 2 || specs["b@2"] != "drop" {
+		t.Fatalf("expected b@2 and c enabled, got %v", specs)
+	}
+
+	Enable("d", "panic(crash)")
+	func() {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(r.(string), "crash") {
+				t.Fatalf("expected a panic, got %v", r)
+			}
+		}()
+		Inject("d", 1)
+	}()
+	if err := EnableAll("a"); err == nil {
+		t.Fatal("expected a spec without = to be invalid")
+	}
+}
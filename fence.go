@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"metcd/api"
+	"metcd/raftnode"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// What a member removed from the cluster does, --on-removal.
+const (
+	// onRemovalExit stops the member once the responses in flight are sent
+	onRemovalExit = "exit"
+	// onRemovalFence keeps its client API up until it is stopped, refusing
+	// writes and, unless --removed-stale-reads, reads
+	onRemovalFence = "fence"
+)
+
+// removalConfig is what the member does once removed, from the
+// --on-removal and --removed-* flags.
+type removalConfig struct {
+	mode       string
+	staleReads bool
+}
+
+// removedWarning is the Warning header of the stale reads a removed member
+// serves.
+const removedWarning = `199 metcd "member removed from the cluster, the read may be stale"`
+
+// fenceRemoved answers the requests a removed member can no longer serve:
+// its store does not follow the cluster anymore, so writes, and reads
+// unless staleReads, fail at once with "member removed" instead of
+// waiting for a raft node that stopped. The stale reads are served from the
+// local store with a Warning header. /metrics and /debug stay available.
+func fenceRemoved(next http.Handler, removed <-chan struct{}, staleReads bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-removed:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == "/metrics" || strings.HasPrefix(r.URL.Path, "/debug/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if staleReads && (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.URL.Path != "/health" {
+			w.Header().Set("Warning", removedWarning)
+			r2 := r.Clone(r.Context())
+			q := r2.URL.Query()
+			q.Set("serializable", "true")
+			r2.URL.RawQuery = q.Encode()
+			next.ServeHTTP(w, r2)
+			return
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/"):
+			v1Error(w, http.StatusGone, api.ErrCodeMemberRemoved, "member removed from the cluster")
+		case strings.HasPrefix(r.URL.Path, "/v3/"):
+			writeV3Error(w, http.StatusGone, v3CodeUnavailable, "etcdserver: the member has been permanently removed from the cluster")
+		default:
+			http.Error(w, "Member removed from the cluster", http.StatusGone)
+		}
+	})
+}
+
+// waitFenced keeps the client API of removed member rc fenced until the
+// process is asked to stop.
+func waitFenced(rc *raftnode.RaftNode) {
+	log.Printf("Member %d removed from the cluster, fencing its client API until it is stopped", rc.ID())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	signal.Stop(c)
+}
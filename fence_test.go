@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"metcd/api"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFenceRemoved(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("serializable=" + r.URL.Query().Get("serializable")))
+	})
+	removed := make(chan struct{})
+	h := fenceRemoved(next, removed, true)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	if rec := serve(http.MethodPut, "/kv/foo"); rec.Code != http.StatusOK {
+		t.Fatalf("expected a member of the cluster to serve writes, got %d", rec.Code)
+	}
+	close(removed)
+	if rec := serve(http.MethodPut, "/kv/foo"); rec.Code != http.StatusGone {
+		t.Fatalf("expected a write on a removed member to fail with 410, got %d", rec.Code)
+	}
+	rec := serve(http.MethodPut, "/v1/kv/foo")
+	var resp api.KVResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusGone || resp.Error == nil || resp.Error.Code != api.ErrCodeMemberRemoved {
+		t.Fatalf("expected a MEMBER_REMOVED error, got %d %+v", rec.Code, resp.Error)
+	}
+	rec = serve(http.MethodGet, "/kv/foo?leaseRead=true")
+	if rec.Code != http.StatusOK || rec.Body.String() != "serializable=true" || rec.Header().Get("Warning") != removedWarning {
+		t.Fatalf("expected a stale read with a warning, got %d %q %q", rec.Code, rec.Body, rec.Header().Get("Warning"))
+	}
+	if rec := serve(http.MethodGet, "/health"); rec.Code != http.StatusGone {
+		t.Fatalf("expected a removed member to be unhealthy, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodGet, "/metrics"); rec.Code != http.StatusOK || rec.Header().Get("Warning") != "" {
+		t.Fatalf("expected the metrics to stay available, got %d", rec.Code)
+	}
+
+	h = fenceRemoved(next, removed, false)
+	if rec := serve(http.MethodGet, "/kv/foo"); rec.Code != http.StatusGone {
+		t.Fatalf("expected reads refused without stale reads, got %d", rec.Code)
+	}
+}
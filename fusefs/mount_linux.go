@@ -0,0 +1,513 @@
+//go:build linux
+
+package fusefs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FUSE opcodes, from linux/fuse.h
+const (
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opSetattr     = 4
+	opSymlink     = 6
+	opMknod       = 8
+	opMkdir       = 9
+	opUnlink      = 10
+	opRmdir       = 11
+	opRename      = 12
+	opLink        = 13
+	opOpen        = 14
+	opRead        = 15
+	opWrite       = 16
+	opStatfs      = 17
+	opRelease     = 18
+	opFsync       = 20
+	opSetxattr    = 21
+	opRemovexattr = 24
+	opFlush       = 25
+	opInit        = 26
+	opOpendir     = 27
+	opReaddir     = 28
+	opReleasedir  = 29
+	opFsyncdir    = 30
+	opAccess      = 34
+	opCreate      = 35
+	opInterrupt   = 36
+	opDestroy     = 38
+	opBatchForget = 42
+	opFallocate   = 43
+	opRename2     = 45
+)
+
+const (
+	protoMajor = 7
+	protoMinor = 31
+
+	inHeaderSize  = 40
+	outHeaderSize = 16
+
+	maxWrite = 128 << 10
+	// the kernel refuses reads into buffers smaller than a request
+	bufSize = maxWrite + 4096
+
+	fopenDirectIO = 1 << 0
+
+	// the kernel caches names and attributes this long, so changes show
+	// within a second
+	entryTimeout = time.Second
+)
+
+var order = binary.NativeEndian
+
+// Server serves a Tree at a mount point.
+type Server struct {
+	tree   *Tree
+	dir    string
+	fd     int
+	helper string // fusermount if it mounted dir
+	uid    uint32
+	gid    uint32
+
+	// handles of open files and directories, only used by serve
+	nextFh  uint64
+	files   map[uint64][]byte
+	dirs    map[uint64][]dirent
+	unmount sync.Once
+	donec   chan struct{}
+	err     error
+}
+
+// Mount mounts tree read-only at dir and serves it until Close, or until
+// dir is unmounted. Mounting takes root privileges or a fusermount helper.
+// The tree is meant to be read by other processes: opening its files with
+// package os from the serving process can block the server.
+func Mount(dir string, tree *Tree) (*Server, error) {
+	s := &Server{
+		tree:  tree,
+		dir:   dir,
+		uid:   uint32(os.Getuid()),
+		gid:   uint32(os.Getgid()),
+		files: make(map[uint64][]byte),
+		dirs:  make(map[uint64][]dirent),
+		donec: make(chan struct{}),
+	}
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("fusefs: open /dev/fuse: %w", err)
+	}
+	opts := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d,default_permissions,allow_other", fd, s.uid, s.gid)
+	err = syscall.Mount("metcd", dir, "fuse.metcd", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, opts)
+	if errors.Is(err, syscall.EPERM) {
+		syscall.Close(fd)
+		fd, s.helper, err = fusermount(dir)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("fusefs: mount %s: %w", dir, err)
+	}
+	s.fd = fd
+	go s.serve()
+	return s, nil
+}
+
+// fusermount mounts dir with the setuid fusermount helper of libfuse, which
+// passes the FUSE device back over a socket.
+func fusermount(dir string) (int, string, error) {
+	helper, err := exec.LookPath("fusermount3")
+	if err != nil {
+		if helper, err = exec.LookPath("fusermount"); err != nil {
+			return -1, "", syscall.EPERM
+		}
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", err
+	}
+	local, remote := os.NewFile(uintptr(fds[0]), "fusermount"), os.NewFile(uintptr(fds[1]), "fusermount")
+	defer local.Close()
+	cmd := exec.Command(helper, "-o", "ro,nosuid,nodev,default_permissions,fsname=metcd,subtype=metcd", "--", dir)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	remote.Close()
+	if err != nil {
+		return -1, "", fmt.Errorf("%s: %w", helper, err)
+	}
+
+	conn, err := net.FileConn(local)
+	if err != nil {
+		return -1, "", err
+	}
+	defer conn.Close()
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.(*net.UnixConn).ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return -1, "", err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return -1, "", fmt.Errorf("%s passed no file descriptor", helper)
+	}
+	rights, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(rights) == 0 {
+		return -1, "", fmt.Errorf("%s passed no file descriptor", helper)
+	}
+	return rights[0], helper, nil
+}
+
+// Close unmounts the tree and waits until the server stopped.
+func (s *Server) Close() error {
+	err := s.doUnmount()
+	<-s.donec
+	if err != nil {
+		return err
+	}
+	return s.err
+}
+
+func (s *Server) doUnmount() error {
+	var err error
+	s.unmount.Do(func() {
+		if s.helper != "" {
+			if out, cerr := exec.Command(s.helper, "-u", s.dir).CombinedOutput(); cerr != nil {
+				err = fmt.Errorf("fusefs: %s -u %s: %v: %s", s.helper, s.dir, cerr, out)
+			}
+			return
+		}
+		if uerr := syscall.Unmount(s.dir, 0); uerr != nil {
+			err = fmt.Errorf("fusefs: unmount %s: %w", s.dir, uerr)
+		}
+	})
+	return err
+}
+
+// Done is closed when the tree is no longer served, after Close or once dir
+// was unmounted from outside.
+func (s *Server) Done() <-chan struct{} { return s.donec }
+
+func (s *Server) serve() {
+	defer close(s.donec)
+	defer syscall.Close(s.fd)
+	buf := make([]byte, bufSize)
+	for {
+		n, err := syscall.Read(s.fd, buf)
+		switch {
+		case err == syscall.EINTR || err == syscall.EAGAIN || err == syscall.ENOENT:
+			// ENOENT: the request was interrupted before it was read
+			continue
+		case err == syscall.ENODEV:
+			// unmounted
+			return
+		case err != nil:
+			s.err = fmt.Errorf("fusefs: read request: %w", err)
+			return
+		case n < inHeaderSize:
+			s.err = fmt.Errorf("fusefs: short request of %d bytes", n)
+			return
+		}
+		if !s.handle(buf[:n]) {
+			return
+		}
+	}
+}
+
+// request is a FUSE request.
+type request struct {
+	opcode uint32
+	unique uint64
+	nodeid uint64
+	body   []byte
+}
+
+// handle answers a request, reporting whether to go on serving.
+func (s *Server) handle(b []byte) bool {
+	r := request{
+		opcode: order.Uint32(b[4:]),
+		unique: order.Uint64(b[8:]),
+		nodeid: order.Uint64(b[16:]),
+		body:   b[inHeaderSize:],
+	}
+	if n := order.Uint32(b); int(n) <= len(b) {
+		r.body = b[inHeaderSize:n]
+	}
+	switch r.opcode {
+	case opInit:
+		s.init(r)
+	case opLookup:
+		s.lookup(r)
+	case opForget:
+		if len(r.body) >= 8 {
+			s.tree.forget(r.nodeid, order.Uint64(r.body))
+		}
+	case opBatchForget:
+		if len(r.body) >= 8 {
+			count := order.Uint32(r.body)
+			for i := 0; i < int(count) && 8+16*(i+1) <= len(r.body); i++ {
+				e := r.body[8+16*i:]
+				s.tree.forget(order.Uint64(e), order.Uint64(e[8:]))
+			}
+		}
+	case opGetattr:
+		n, ok := s.tree.stat(r.nodeid)
+		if !ok {
+			s.reply(r, syscall.ENOENT, nil)
+			return true
+		}
+		out := make([]byte, 16, 16+attrSize)
+		putTimeout(out, 0, 8, entryTimeout)
+		s.reply(r, 0, s.appendAttr(out, &n))
+	case opOpen:
+		s.open(r)
+	case opRead:
+		s.read(r)
+	case opRelease:
+		if len(r.body) >= 8 {
+			delete(s.files, order.Uint64(r.body))
+		}
+		s.reply(r, 0, nil)
+	case opOpendir:
+		ents, ok := s.tree.list(r.nodeid)
+		if !ok {
+			s.reply(r, syscall.ENOTDIR, nil)
+			return true
+		}
+		s.nextFh++
+		s.dirs[s.nextFh] = ents
+		s.reply(r, 0, openOut(s.nextFh, 0))
+	case opReaddir:
+		s.readdir(r)
+	case opReleasedir:
+		if len(r.body) >= 8 {
+			delete(s.dirs, order.Uint64(r.body))
+		}
+		s.reply(r, 0, nil)
+	case opStatfs:
+		s.statfs(r)
+	case opAccess:
+		if len(r.body) >= 4 && order.Uint32(r.body)&2 != 0 {
+			s.reply(r, syscall.EROFS, nil)
+		} else {
+			s.reply(r, 0, nil)
+		}
+	case opFlush, opFsync, opFsyncdir:
+		s.reply(r, 0, nil)
+	case opSetattr, opSymlink, opMknod, opMkdir, opUnlink, opRmdir, opRename, opLink,
+		opWrite, opSetxattr, opRemovexattr, opCreate, opFallocate, opRename2:
+		s.reply(r, syscall.EROFS, nil)
+	case opInterrupt:
+		// requests are answered right away, there is nothing to interrupt
+	case opDestroy:
+		s.reply(r, 0, nil)
+		return false
+	default:
+		s.reply(r, syscall.ENOSYS, nil)
+	}
+	return true
+}
+
+func (s *Server) init(r request) {
+	if len(r.body) < 16 {
+		s.reply(r, syscall.EPROTO, nil)
+		return
+	}
+	major, minor, readahead := order.Uint32(r.body), order.Uint32(r.body[4:]), order.Uint32(r.body[8:])
+	out := make([]byte, 64)
+	order.PutUint32(out, protoMajor)
+	switch {
+	case major < protoMajor:
+		s.reply(r, syscall.EPROTO, nil)
+		return
+	case major > protoMajor:
+		// the kernel sends INIT again with our major version
+		s.reply(r, 0, out[:8])
+		return
+	}
+	if minor > protoMinor {
+		minor = protoMinor
+	}
+	order.PutUint32(out[4:], minor)
+	order.PutUint32(out[8:], readahead)
+	order.PutUint16(out[16:], 16) // max_background
+	order.PutUint16(out[18:], 12) // congestion_threshold
+	order.PutUint32(out[20:], maxWrite)
+	order.PutUint32(out[24:], 1) // time_gran
+	if minor < 23 {
+		out = out[:24]
+	}
+	s.reply(r, 0, out)
+}
+
+func (s *Server) lookup(r request) {
+	name := r.body
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	n, ok := s.tree.lookup(r.nodeid, string(name))
+	if !ok {
+		s.reply(r, syscall.ENOENT, nil)
+		return
+	}
+	out := make([]byte, 40, 40+attrSize)
+	order.PutUint64(out, n.ino)
+	putTimeout(out, 16, 32, entryTimeout)
+	putTimeout(out, 24, 36, entryTimeout)
+	s.reply(r, 0, s.appendAttr(out, &n))
+}
+
+func (s *Server) open(r request) {
+	if len(r.body) < 4 {
+		s.reply(r, syscall.EINVAL, nil)
+		return
+	}
+	if order.Uint32(r.body)&syscall.O_ACCMODE != syscall.O_RDONLY {
+		s.reply(r, syscall.EROFS, nil)
+		return
+	}
+	n, ok := s.tree.stat(r.nodeid)
+	switch {
+	case !ok:
+		s.reply(r, syscall.ENOENT, nil)
+		return
+	case n.dir:
+		s.reply(r, syscall.EISDIR, nil)
+		return
+	}
+	// reads see the contents at the time of the open; direct I/O keeps the
+	// kernel from cutting them to a cached size
+	s.nextFh++
+	s.files[s.nextFh] = n.data
+	s.reply(r, 0, openOut(s.nextFh, fopenDirectIO))
+}
+
+func (s *Server) read(r request) {
+	if len(r.body) < 20 {
+		s.reply(r, syscall.EINVAL, nil)
+		return
+	}
+	fh, off, size := order.Uint64(r.body), order.Uint64(r.body[8:]), order.Uint32(r.body[16:])
+	data, ok := s.files[fh]
+	if !ok {
+		s.reply(r, syscall.EBADF, nil)
+		return
+	}
+	if off >= uint64(len(data)) {
+		s.reply(r, 0, nil)
+		return
+	}
+	data = data[off:]
+	if uint64(len(data)) > uint64(size) {
+		data = data[:size]
+	}
+	s.reply(r, 0, data)
+}
+
+func (s *Server) readdir(r request) {
+	if len(r.body) < 20 {
+		s.reply(r, syscall.EINVAL, nil)
+		return
+	}
+	fh, off, size := order.Uint64(r.body), order.Uint64(r.body[8:]), order.Uint32(r.body[16:])
+	ents, ok := s.dirs[fh]
+	if !ok {
+		s.reply(r, syscall.EBADF, nil)
+		return
+	}
+	var out []byte
+	for i := off; i < uint64(len(ents)); i++ {
+		e := ents[i]
+		recLen := (24 + len(e.name) + 7) &^ 7
+		if len(out)+recLen > int(size) {
+			break
+		}
+		typ := uint32(syscall.DT_REG)
+		if e.dir {
+			typ = syscall.DT_DIR
+		}
+		rec := make([]byte, recLen)
+		order.PutUint64(rec, e.ino)
+		order.PutUint64(rec[8:], i+1) // offset of the next entry
+		order.PutUint32(rec[16:], uint32(len(e.name)))
+		order.PutUint32(rec[20:], typ)
+		copy(rec[24:], e.name)
+		out = append(out, rec...)
+	}
+	s.reply(r, 0, out)
+}
+
+func (s *Server) statfs(r request) {
+	s.tree.mu.RLock()
+	files := uint64(len(s.tree.inodes))
+	s.tree.mu.RUnlock()
+	out := make([]byte, 80)
+	order.PutUint64(out[24:], files) // files
+	order.PutUint32(out[40:], 4096)  // bsize
+	order.PutUint32(out[44:], 255)   // namelen
+	order.PutUint32(out[48:], 4096)  // frsize
+	s.reply(r, 0, out)
+}
+
+// attrSize is the size of struct fuse_attr.
+const attrSize = 88
+
+func (s *Server) appendAttr(b []byte, n *node) []byte {
+	a := make([]byte, attrSize)
+	size := uint64(len(n.data))
+	mode, nlink := uint32(syscall.S_IFREG|0444), uint32(1)
+	if n.dir {
+		mode, nlink, size = syscall.S_IFDIR|0555, 2, 0
+	}
+	sec, nsec := uint64(n.mtime.Unix()), uint32(n.mtime.Nanosecond())
+	order.PutUint64(a, n.ino)
+	order.PutUint64(a[8:], size)
+	order.PutUint64(a[16:], (size+511)/512)
+	for i := 0; i < 3; i++ { // atime, mtime, ctime
+		order.PutUint64(a[24+8*i:], sec)
+		order.PutUint32(a[48+4*i:], nsec)
+	}
+	order.PutUint32(a[60:], mode)
+	order.PutUint32(a[64:], nlink)
+	order.PutUint32(a[68:], s.uid)
+	order.PutUint32(a[72:], s.gid)
+	order.PutUint32(a[80:], 4096) // blksize
+	return append(b, a...)
+}
+
+// putTimeout stores d as the seconds at b[sec:] and nanoseconds at b[nsec:]
+// of a FUSE timeout.
+func putTimeout(b []byte, sec, nsec int, d time.Duration) {
+	order.PutUint64(b[sec:], uint64(d/time.Second))
+	order.PutUint32(b[nsec:], uint32(d%time.Second))
+}
+
+func openOut(fh uint64, flags uint32) []byte {
+	out := make([]byte, 16)
+	order.PutUint64(out, fh)
+	order.PutUint32(out[8:], flags)
+	return out
+}
+
+func (s *Server) reply(r request, errno syscall.Errno, data []byte) {
+	out := make([]byte, outHeaderSize, outHeaderSize+len(data))
+	order.PutUint32(out, uint32(outHeaderSize+len(data)))
+	order.PutUint32(out[4:], uint32(-int32(errno)))
+	order.PutUint64(out[8:], r.unique)
+	out = append(out, data...)
+	if _, err := syscall.Write(s.fd, out); err != nil && err != syscall.ENOENT {
+		// ENOENT: the request was interrupted
+		log.Printf("fusefs: reply to request %d: %v", r.unique, err)
+	}
+}
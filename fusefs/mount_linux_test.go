@@ -0,0 +1,70 @@
+//go:build linux
+
+package fusefs
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// run runs a command in its own process: the Go poller of the test process
+// would wait for the server it runs itself.
+func run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	return string(out), err
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestMount(t *testing.T) {
+	dir := t.TempDir()
+	tree := NewTree()
+	tree.Put("/etc/app.conf", []byte("x=1"))
+	s, err := Mount(dir, tree)
+	if err != nil {
+		t.Skipf("cannot mount FUSE here: %v", err)
+	}
+	defer s.Close()
+
+	conf := filepath.Join(dir, "etc/app.conf")
+	if out, err := run("cat", conf); err != nil || out != "x=1" {
+		t.Fatalf("expected x=1, got %q, %v", out, err)
+	}
+	if _, err := run("touch", conf); err == nil {
+		t.Fatal("the mount should be read-only")
+	}
+
+	tree.Put("/etc/app.conf", []byte("x=22"))
+	tree.Put("/etc/other", []byte("y"))
+	eventually(t, "the changes", func() bool {
+		out, _ := run("cat", conf)
+		ls, _ := run("ls", filepath.Join(dir, "etc"))
+		return out == "x=22" && strings.Join(strings.Fields(ls), " ") == "app.conf other"
+	})
+	tree.Delete("/etc/other")
+	eventually(t, "the deletion", func() bool {
+		_, err := run("stat", filepath.Join(dir, "etc/other"))
+		return err != nil
+	})
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("server still running after Close")
+	}
+}
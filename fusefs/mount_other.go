@@ -0,0 +1,19 @@
+//go:build !linux
+
+package fusefs
+
+import "errors"
+
+// Server serves a Tree at a mount point.
+type Server struct{}
+
+// Mount mounts tree read-only at dir. FUSE is only supported on Linux.
+func Mount(dir string, tree *Tree) (*Server, error) {
+	return nil, errors.New("fusefs: mounting is only supported on Linux")
+}
+
+// Close unmounts the tree and waits until the server stopped.
+func (s *Server) Close() error { return nil }
+
+// Done is closed when the tree is no longer served.
+func (s *Server) Done() <-chan struct{} { return nil }
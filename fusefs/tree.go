@@ -0,0 +1,292 @@
+// Package fusefs serves a read-only tree of files over FUSE, without cgo or
+// a FUSE library. The tree maps slash separated paths to file contents and
+// may change while it is mounted; directories exist while they contain a
+// file.
+package fusefs
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rootIno = 1
+
+type node struct {
+	ino      uint64
+	name     string
+	parent   *node
+	dir      bool
+	children map[string]*node // of a directory
+	data     []byte           // of a file
+	mtime    time.Time
+	lookups  uint64 // references held by the kernel
+	removed  bool
+}
+
+func (n *node) path() string {
+	if n.parent == nil {
+		return ""
+	}
+	if p := n.parent.path(); p != "" {
+		return p + "/" + n.name
+	}
+	return n.name
+}
+
+// Tree is a tree of files. All methods may be called concurrently, also
+// while the tree is mounted.
+type Tree struct {
+	mu sync.RWMutex
+	// files holds the contents of every path, including files hidden by a
+	// directory of the same name
+	files   map[string][]byte
+	root    *node
+	inodes  map[uint64]*node
+	nextIno uint64
+}
+
+// NewTree returns an empty tree.
+func NewTree() *Tree {
+	root := &node{ino: rootIno, dir: true, children: make(map[string]*node), mtime: time.Now()}
+	return &Tree{
+		files:   make(map[string][]byte),
+		root:    root,
+		inodes:  map[uint64]*node{rootIno: root},
+		nextIno: rootIno + 1,
+	}
+}
+
+// splitPath returns the components of path, reporting whether it is a
+// valid file name: no empty, "." or ".." components.
+func splitPath(path string) ([]string, bool) {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return nil, false
+	}
+	names := strings.Split(path, "/")
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." || len(name) > 255 || strings.IndexByte(name, 0) >= 0 {
+			return nil, false
+		}
+	}
+	return names, true
+}
+
+// Put sets the contents of the file at path, creating its directories. It
+// reports whether path is a valid file name. A file with the name of a
+// directory is hidden until the directory is empty.
+func (t *Tree) Put(path string, data []byte) bool {
+	names, ok := splitPath(path)
+	if !ok {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.put(names, data)
+	return true
+}
+
+// put must be called with t.mu held.
+func (t *Tree) put(names []string, data []byte) {
+	now := time.Now()
+	t.files[strings.Join(names, "/")] = data
+	cur := t.root
+	for i, name := range names {
+		child := cur.children[name]
+		if i == len(names)-1 {
+			switch {
+			case child == nil:
+				t.newNode(cur, name, false, now).data = data
+			case !child.dir:
+				child.data, child.mtime = data, now
+			}
+			// a file with the name of a directory stays hidden
+			return
+		}
+		if child == nil || !child.dir {
+			if child != nil {
+				// the file is hidden by the new directory
+				t.unlink(child)
+			}
+			child = t.newNode(cur, name, true, now)
+		}
+		cur = child
+	}
+}
+
+// Delete removes the file at path and the directories it leaves empty.
+func (t *Tree) Delete(path string) {
+	names, ok := splitPath(path)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	full := strings.Join(names, "/")
+	if _, ok := t.files[full]; !ok {
+		return
+	}
+	delete(t.files, full)
+	cur := t.root
+	for _, name := range names {
+		if cur = cur.children[name]; cur == nil {
+			return
+		}
+	}
+	if cur.dir {
+		// the file was hidden
+		return
+	}
+	parent := cur.parent
+	t.unlink(cur)
+	t.prune(parent)
+}
+
+// prune removes dir and its parents while they are empty, uncovering the
+// files they hid. It must be called with t.mu held.
+func (t *Tree) prune(dir *node) {
+	for dir != t.root && len(dir.children) == 0 {
+		parent := dir.parent
+		t.unlink(dir)
+		if data, ok := t.files[dir.path()]; ok {
+			t.newNode(parent, dir.name, false, time.Now()).data = data
+			return
+		}
+		dir = parent
+	}
+}
+
+// Reset replaces the contents of the tree with files.
+func (t *Tree) Reset(files map[string][]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, n := range t.root.children {
+		t.unlink(n)
+	}
+	t.files = make(map[string][]byte, len(files))
+	t.root.mtime = time.Now()
+	for path, data := range files {
+		if names, ok := splitPath(path); ok {
+			t.put(names, data)
+		}
+	}
+}
+
+func (t *Tree) newNode(parent *node, name string, dir bool, mtime time.Time) *node {
+	n := &node{ino: t.nextIno, name: name, parent: parent, dir: dir, mtime: mtime}
+	if dir {
+		n.children = make(map[string]*node)
+	}
+	t.nextIno++
+	t.inodes[n.ino] = n
+	parent.children[name] = n
+	parent.mtime = mtime
+	return n
+}
+
+// unlink removes n and its children from the tree. Nodes the kernel still
+// references are forgotten once it releases them.
+func (t *Tree) unlink(n *node) {
+	for _, child := range n.children {
+		t.unlink(child)
+	}
+	if n.parent.children[n.name] == n {
+		delete(n.parent.children, n.name)
+		n.parent.mtime = time.Now()
+	}
+	n.removed = true
+	if n.lookups == 0 {
+		delete(t.inodes, n.ino)
+	}
+}
+
+// Read returns the contents of the file at path.
+func (t *Tree) Read(path string) ([]byte, bool) {
+	names, ok := splitPath(path)
+	if !ok {
+		return nil, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	cur := t.root
+	for _, name := range names {
+		if cur = cur.children[name]; cur == nil {
+			return nil, false
+		}
+	}
+	return cur.data, !cur.dir
+}
+
+// lookup returns the child called name of the directory ino and records a
+// kernel reference to it.
+func (t *Tree) lookup(ino uint64, name string) (node, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dir := t.inodes[ino]
+	if dir == nil || !dir.dir {
+		return node{}, false
+	}
+	n := dir.children[name]
+	if n == nil {
+		return node{}, false
+	}
+	n.lookups++
+	return *n, true
+}
+
+// forget releases k kernel references to ino.
+func (t *Tree) forget(ino, k uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.inodes[ino]
+	if n == nil || ino == rootIno {
+		return
+	}
+	if k > n.lookups {
+		k = n.lookups
+	}
+	n.lookups -= k
+	if n.lookups == 0 && n.removed {
+		delete(t.inodes, ino)
+	}
+}
+
+// stat returns a copy of the node ino.
+func (t *Tree) stat(ino uint64) (node, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := t.inodes[ino]
+	if n == nil || n.removed {
+		return node{}, false
+	}
+	return *n, true
+}
+
+// dirent is an entry of a directory listing.
+type dirent struct {
+	ino  uint64
+	name string
+	dir  bool
+}
+
+// list returns the entries of the directory ino sorted by name.
+func (t *Tree) list(ino uint64) ([]dirent, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	dir := t.inodes[ino]
+	if dir == nil || !dir.dir || dir.removed {
+		return nil, false
+	}
+	parent := dir.parent
+	if parent == nil {
+		parent = dir
+	}
+	ents := []dirent{{dir.ino, ".", true}, {parent.ino, "..", true}}
+	for _, n := range dir.children {
+		ents = append(ents, dirent{n.ino, n.name, n.dir})
+	}
+	sort.Slice(ents[2:], func(i, j int) bool { return ents[2+i].name < ents[2+j].name })
+	return ents, true
+}
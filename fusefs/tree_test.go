@@ -0,0 +1,83 @@
+package fusefs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func names(t *testing.T, tree *Tree, ino uint64) []string {
+	t.Helper()
+	ents, ok := tree.list(ino)
+	if !ok {
+		t.Fatalf("%d is not a directory", ino)
+	}
+	var names []string
+	for _, e := range ents[2:] {
+		names = append(names, e.name)
+	}
+	return names
+}
+
+func TestTree(t *testing.T) {
+	tree := NewTree()
+	for _, path := range []string{"", "/", "a//b", "a/../b", "a/./b"} {
+		if tree.Put(path, nil) {
+			t.Fatalf("put %q should fail", path)
+		}
+	}
+	tree.Put("/etc/app.conf", []byte("x=1"))
+	tree.Put("/etc/db/url", []byte("postgres://"))
+	if got := names(t, tree, rootIno); !reflect.DeepEqual(got, []string{"etc"}) {
+		t.Fatalf("unexpected root entries %v", got)
+	}
+	etc, ok := tree.lookup(rootIno, "etc")
+	if !ok || !etc.dir {
+		t.Fatal("expected directory etc")
+	}
+	if got := names(t, tree, etc.ino); !reflect.DeepEqual(got, []string{"app.conf", "db"}) {
+		t.Fatalf("unexpected etc entries %v", got)
+	}
+	if v, ok := tree.Read("etc/db/url"); !ok || string(v) != "postgres://" {
+		t.Fatalf("unexpected etc/db/url %q", v)
+	}
+
+	// a file is hidden by a directory of the same name until it is empty
+	tree.Put("/etc/db", []byte("hidden"))
+	if _, ok := tree.Read("etc/db"); ok {
+		t.Fatal("etc/db should be a directory")
+	}
+	tree.Delete("/etc/db/url")
+	if v, ok := tree.Read("etc/db"); !ok || string(v) != "hidden" {
+		t.Fatalf("expected the uncovered file etc/db, got %q, %v", v, ok)
+	}
+	tree.Delete("/etc/db")
+	tree.Delete("/etc/app.conf")
+	if got := names(t, tree, rootIno); len(got) != 0 {
+		t.Fatalf("empty directories should be removed, got %v", got)
+	}
+
+	// removed nodes stay known while the kernel references them
+	if _, ok := tree.stat(etc.ino); ok {
+		t.Fatal("etc should be removed")
+	}
+	if tree.inodes[etc.ino] == nil {
+		t.Fatal("referenced etc was forgotten")
+	}
+	tree.forget(etc.ino, 1)
+	if tree.inodes[etc.ino] != nil {
+		t.Fatal("released etc was not forgotten")
+	}
+
+	tree.Put("/old", []byte("1"))
+	tree.Reset(map[string][]byte{"a/b": []byte("2"), "a": []byte("3"), "../bad": nil})
+	if _, ok := tree.Read("old"); ok {
+		t.Fatal("old should be removed by the reset")
+	}
+	if v, ok := tree.Read("a/b"); !ok || string(v) != "2" {
+		t.Fatalf("unexpected a/b %q", v)
+	}
+	tree.Delete("a/b")
+	if v, ok := tree.Read("a"); !ok || string(v) != "3" {
+		t.Fatalf("unexpected a %q", v)
+	}
+}
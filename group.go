@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"metcd/api"
+	"metcd/encryption"
+	"metcd/raftnode"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+// groupHeader selects the raft group of a request, as does a
+// /groups/<name> path prefix.
+const groupHeader = "X-Metcd-Group"
+
+var ErrGroupNotFound = errors.New("metcd: raft group not found")
+
+var groupName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// raftGroup is a raft group the member runs besides the default one, with
+// its own store, log and snapshots. Writes to different groups are
+// ordered and replicated independently, so they are not limited by the
+// throughput of a single log.
+type raftGroup struct {
+	name        string
+	store       *kvstore
+	rc          *raftnode.RaftNode
+	proposePipe *raftnode.ProposePipe
+	confChangeC chan raftpb.ConfChange
+	handler     http.Handler
+}
+
+// groupConfig is what the groups of a member share with its default group.
+type groupConfig struct {
+	id      int
+	peers   []string
+	dataDir string
+	master  []byte // master key of the keyrings, nil without encryption
+	opts    []raftnode.Option
+}
+
+// groupManager runs the raft groups of a member. The groups have the same
+// members and peer URLs as the default group, their rafthttp requests are
+// told apart by cluster ID on the shared peer listener, and their data
+// directories are under <data-dir>/groups/<name>.
+type groupManager struct {
+	groups map[string]*raftGroup
+	names  []string // sorted
+}
+
+// parseGroupNames parses the comma separated --raft-groups.
+func parseGroupNames(list string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !groupName.MatchString(name) {
+			return nil, fmt.Errorf("invalid raft group name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate raft group %q", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// startGroups starts the raft groups called names.
+func startGroups(names []string, cfg groupConfig) (*groupManager, error) {
+	m := &groupManager{groups: make(map[string]*raftGroup), names: names}
+	for _, name := range names {
+		keyring, err := encryption.NewKeyring(cfg.master)
+		if err != nil {
+			return nil, err
+		}
+		g := &raftGroup{name: name, proposePipe: raftnode.NewProposePipe(), confChangeC: make(chan raftpb.ConfChange)}
+		opts := append([]raftnode.Option{}, cfg.opts...)
+		opts = append(opts, raftnode.WithGroup(name), raftnode.WithDataDir(raftnode.GroupDir(cfg.dataDir, name)))
+		getSnapshot := func() ([]byte, error) { return g.store.storedSnapshot() }
+		g.rc = raftnode.NewRaftNode(cfg.id, cfg.peers, false, getSnapshot, g.proposePipe, g.confChangeC, opts...)
+		g.store = newKVStore(g.rc.ID(), <-g.rc.SnapshotterReady(), g.proposePipe, g.rc.CommitC(), g.rc.ErrorC(), keyring)
+		m.groups[name] = g
+	}
+	return m, nil
+}
+
+// stop stops the raft groups.
+func (m *groupManager) stop() {
+	if m == nil {
+		return
+	}
+	for _, g := range m.groups {
+		g.proposePipe.Close()
+		close(g.confChangeC)
+	}
+}
+
+// group returns the raft group called name.
+func (m *groupManager) group(name string) (*raftGroup, error) {
+	if m != nil {
+		if g, ok := m.groups[name]; ok {
+			return g, nil
+		}
+	}
+	return nil, ErrGroupNotFound
+}
+
+// list describes the raft groups, the default one first.
+func (m *groupManager) list(def *raftGroup) []api.Group {
+	groups := []api.Group{def.info()}
+	if m != nil {
+		for _, name := range m.names {
+			groups = append(groups, m.groups[name].info())
+		}
+	}
+	return groups
+}
+
+func (g *raftGroup) info() api.Group {
+	return api.Group{Name: g.name, Leader: g.rc.LeaderID(), IsLeader: g.rc.IsLeader(), Rev: g.store.Rev(), AppliedIndex: g.rc.AppliedIndex()}
+}
+
+// routeGroups serves the requests of a raft group, selected by the
+// X-Metcd-Group header or a /groups/<name> path prefix, by the handler of
+// the group, the requests for keys by the group of their shard and the rest
+// by def. GET /groups lists the groups, /admin/shards manages the shards.
+func routeGroups(def *raftGroup, m *groupManager) http.Handler {
+	sr := newShardRouter(def, m)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, path := r.Header.Get(groupHeader), r.URL.Path
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/groups"); ok && (rest == "" || rest == "/") {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, m.list(def))
+			return
+		} else if ok && strings.HasPrefix(rest, "/") {
+			var sub string
+			name, sub, _ = strings.Cut(rest[1:], "/")
+			if h := r.Header.Get(groupHeader); h != "" && h != name {
+				http.Error(w, "Conflicting raft groups", http.StatusBadRequest)
+				return
+			}
+			path = "/" + sub
+		}
+		if name == "" && path == r.URL.Path {
+			if strings.HasPrefix(path, "/admin/shards") {
+				sr.serveShards(w, r)
+				return
+			}
+			var ok bool
+			if name, ok = sr.route(w, r); !ok {
+				return
+			}
+		}
+		if name == "" {
+			def.handler.ServeHTTP(w, r)
+			return
+		}
+		g, err := m.group(name)
+		if err != nil {
+			http.Error(w, "Raft group not found", http.StatusNotFound)
+			return
+		}
+		r2 := r
+		if path != r.URL.Path {
+			r2 = r.Clone(r.Context())
+			r2.URL.Path, r2.URL.RawPath = path, ""
+			// the legacy handler keys on the request URI
+			r2.RequestURI = path
+			if r.URL.RawQuery != "" {
+				r2.RequestURI += "?" + r.URL.RawQuery
+			}
+		}
+		g.handler.ServeHTTP(w, r2)
+	})
+}
+
+// watchGroups exits when the raft of a group goes down, as
+// serveHTTPKVAPI does for the default group.
+func (m *groupManager) watchGroups() {
+	if m == nil {
+		return
+	}
+	for _, g := range m.groups {
+		go func(g *raftGroup) {
+			if err, ok := <-g.rc.ErrorC(); ok {
+				log.Fatalf("raft group %s: %v", g.name, err)
+			}
+		}(g)
+	}
+}
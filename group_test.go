@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseGroupNames(t *testing.T) {
+	names, err := parseGroupNames(" b,a,, c")
+	if err != nil || len(names) != 3 || names[0] != "a" || names[2] != "c" {
+		t.Fatalf("expected a, b and c, got %v (%v)", names, err)
+	}
+	for _, list := range []string{"a,a", "a/b"} {
+		if _, err := parseGroupNames(list); err == nil {
+			t.Fatalf("expected %q to be refused", list)
+		}
+	}
+}
+
+func TestRouteGroups(t *testing.T) {
+	newGroup := func(name, val string) *raftGroup {
+		s := newTestKVStore(nil)
+		s.apply(kv{Op: opPut, Key: "/k", Val: val})
+		return &raftGroup{name: name, store: s, handler: newHTTPHandler(&httpKVAPI{store: s, requests: newRequestTracker()})}
+	}
+	def := newGroup("", "default")
+	m := &groupManager{groups: map[string]*raftGroup{"a": newGroup("a", "in a")}, names: []string{"a"}}
+	srv := httptest.NewServer(routeGroups(def, m))
+	defer srv.Close()
+
+	get := func(path, group string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if group != "" {
+			req.Header.Set(groupHeader, group)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	for _, c := range []struct {
+		path, group string
+		code        int
+		body        string
+	}{
+		{"/kv/k?serializable=true", "", http.StatusOK, "default"},
+		{"/groups/a/kv/k?serializable=true", "", http.StatusOK, "in a"},
+		{"/kv/k?serializable=true", "a", http.StatusOK, "in a"},
+		{"/groups/a/kv/k?serializable=true", "b", http.StatusBadRequest, ""},
+		{"/groups/b/kv/k", "", http.StatusNotFound, ""},
+	} {
+		code, body := get(c.path, c.group)
+		if code != c.code || (c.body != "" && body != c.body) {
+			t.Fatalf("%s (group %q): expected %d %q, got %d %q", c.path, c.group, c.code, c.body, code, body)
+		}
+	}
+}
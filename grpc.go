@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"metcd/api"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+// grpcHealthInterval is how often the gRPC health service checks the
+// services of healthServices.
+var grpcHealthInterval = time.Second
+
+// grpcServer serves the grpc.health.v1 Health service, whose services are
+// those of GET /health?service=<name>, and server reflection, so that load
+// balancers and grpcurl work against --grpc-port.
+type grpcServer struct {
+	*grpc.Server
+	health *health.Server
+	id     uint64
+	leader func() uint64
+	read   func(context.Context) error
+	stopc  chan struct{}
+	donec  chan struct{}
+}
+
+// newGRPCServer returns the gRPC server of the member id, whose leader is
+// leader() and read the linearizable read, its health checked already.
+func newGRPCServer(id uint64, leader func() uint64, read func(context.Context) error) *grpcServer {
+	s := &grpcServer{
+		Server: grpc.NewServer(),
+		health: health.NewServer(),
+		id:     id,
+		leader: leader,
+		read:   read,
+		stopc:  make(chan struct{}),
+		donec:  make(chan struct{}),
+	}
+	healthpb.RegisterHealthServer(s.Server, s.health)
+	reflection.Register(s.Server)
+	s.check()
+	go s.run()
+	return s
+}
+
+func (s *grpcServer) run() {
+	defer close(s.donec)
+	ticker := time.NewTicker(grpcHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.check()
+		case <-s.stopc:
+			return
+		}
+	}
+}
+
+// check sets the serving status of every service like checkHealth does for
+// GET /health, with one read for all of them.
+func (s *grpcServer) check() {
+	leader := s.leader()
+	var readErr error
+	if leader != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), healthReadTimeout)
+		readErr = s.read(ctx)
+		cancel()
+	}
+	for service := range healthServices {
+		health := api.Health{Leader: leader}
+		checkHealth(&health, service, s.id, func() error { return readErr })
+		status := healthpb.HealthCheckResponse_NOT_SERVING
+		if health.Health {
+			status = healthpb.HealthCheckResponse_SERVING
+		}
+		s.health.SetServingStatus(service, status)
+	}
+}
+
+// Stop stops checking the health, answers NOT_SERVING to the health
+// watches and closes the connections.
+func (s *grpcServer) Stop() {
+	close(s.stopc)
+	<-s.donec
+	s.health.Shutdown()
+	s.Server.Stop()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCHealth(t *testing.T) {
+	// the test checks the health itself
+	defer func(d time.Duration) { grpcHealthInterval = d }(grpcHealthInterval)
+	grpcHealthInterval = time.Hour
+	var leader atomic.Uint64
+	var quorum atomic.Bool
+	srv := newGRPCServer(1, leader.Load, func(context.Context) error {
+		if !quorum.Load() {
+			return errors.New("no quorum")
+		}
+		return nil
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Stop()
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	expect := func(service string, want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil || resp.Status != want {
+			t.Fatalf("Check(%q) = %v, %v, expected %v", service, resp.GetStatus(), err, want)
+		}
+	}
+
+	expect("kv", healthpb.HealthCheckResponse_NOT_SERVING)
+	leader.Store(2)
+	srv.check()
+	expect("kv", healthpb.HealthCheckResponse_NOT_SERVING)
+	quorum.Store(true)
+	srv.check()
+	expect("", healthpb.HealthCheckResponse_SERVING)
+	expect("kv", healthpb.HealthCheckResponse_SERVING)
+	expect("leader", healthpb.HealthCheckResponse_NOT_SERVING)
+	leader.Store(1)
+	srv.check()
+	expect("leader", healthpb.HealthCheckResponse_SERVING)
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "nosuch"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected an unknown service not found, got %v", err)
+	}
+
+	// reflection lists the health service
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		found = found || s.Name == "grpc.health.v1.Health"
+	}
+	if !found {
+		t.Fatalf("expected grpc.health.v1.Health listed, got %v", resp)
+	}
+}
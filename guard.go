@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	resizeGuardOff    = "off"
+	resizeGuardWarn   = "warn"
+	resizeGuardRefuse = "refuse"
+)
+
+// resizeGuard checks membership changes against the resizing guardrails: an
+// even number of voters tolerates no more failures than one voter less, and
+// the cluster should tolerate at least minFaultTolerance failures.
+type resizeGuard struct {
+	mode              string // one of the resizeGuard* modes, empty warns
+	minFaultTolerance int
+}
+
+func newResizeGuard(mode string, minFaultTolerance int) (resizeGuard, error) {
+	switch mode {
+	case resizeGuardOff, resizeGuardWarn, resizeGuardRefuse:
+	default:
+		return resizeGuard{}, fmt.Errorf("invalid resize guard %q", mode)
+	}
+	if minFaultTolerance < 0 {
+		return resizeGuard{}, fmt.Errorf("invalid minimum fault tolerance %d", minFaultTolerance)
+	}
+	return resizeGuard{mode: mode, minFaultTolerance: minFaultTolerance}, nil
+}
+
+// check returns the guardrails violated by a change leaving voters voting
+// members.
+func (g resizeGuard) check(voters int) []string {
+	if g.mode == resizeGuardOff {
+		return nil
+	}
+	var problems []string
+	if voters > 0 && voters%2 == 0 {
+		problems = append(problems, fmt.Sprintf("%d voters tolerate no more failures than %d", voters, voters-1))
+	}
+	if ft := (voters - 1) / 2; ft < g.minFaultTolerance {
+		problems = append(problems, fmt.Sprintf("%d voters tolerate %d failures, below the minimum of %d", voters, ft, g.minFaultTolerance))
+	}
+	return problems
+}
+
+// guardResize applies the guardrails to a change that adds (delta 1) or
+// removes (delta -1) member id as a voter. It adds the problems as Warning
+// headers and reports whether the change may go ahead; a refused change was
+// answered with 409 unless the request has ?force=true.
+func (h *httpKVAPI) guardResize(w http.ResponseWriter, r *http.Request, id uint64, delta int) bool {
+	voters, isVoter := 0, false
+	for _, m := range h.rc.Members() {
+		if !m.IsLearner {
+			voters++
+			isVoter = isVoter || m.ID == id
+		}
+	}
+	if (delta > 0 && isVoter) || (delta < 0 && !isVoter) {
+		// the number of voters does not change
+		return true
+	}
+	problems := h.guard.check(voters + delta)
+	if len(problems) == 0 {
+		return true
+	}
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	if h.guard.mode == resizeGuardRefuse && !force {
+		log.Printf("Refused conf change of member %d (%v)\n", id, problems)
+		http.Error(w, fmt.Sprintf("Refused membership change: %v, use force to override", problems), http.StatusConflict)
+		return false
+	}
+	for _, p := range problems {
+		log.Printf("Warning on conf change of member %d: %s\n", id, p)
+		w.Header().Add("Warning", "299 metcd "+strconv.Quote(p))
+	}
+	return true
+}
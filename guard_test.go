@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func Test_resizeGuard_check(t *testing.T) {
+	for _, tc := range []struct {
+		guard    resizeGuard
+		voters   int
+		problems int
+	}{
+		{resizeGuard{}, 3, 0},
+		{resizeGuard{}, 4, 1},
+		{resizeGuard{mode: resizeGuardOff}, 4, 0},
+		{resizeGuard{mode: resizeGuardRefuse, minFaultTolerance: 1}, 3, 0},
+		{resizeGuard{mode: resizeGuardRefuse, minFaultTolerance: 1}, 1, 1},
+		{resizeGuard{mode: resizeGuardRefuse, minFaultTolerance: 2}, 4, 2},
+	} {
+		if got := tc.guard.check(tc.voters); len(got) != tc.problems {
+			t.Errorf("%+v.check(%d) = %v, expected %d problems", tc.guard, tc.voters, got, tc.problems)
+		}
+	}
+	if _, err := newResizeGuard("never", 0); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
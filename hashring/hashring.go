@@ -0,0 +1,107 @@
+// Package hashring is a consistent hash ring: keys map to the node owning
+// the first point of the ring at or after their hash, so adding or removing
+// a node only moves the keys of its points.
+//
+// A node of weight w has w*vnodes points, the hashes of "<name>#<i>" for i
+// from 0. A hash is the first 8 bytes of the SHA-256 of its input as a big
+// endian integer, which clients in any language can reproduce from the list
+// of nodes metcd serves on /ring.
+package hashring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// DefaultVNodes is the number of points of a node of weight 1.
+const DefaultVNodes = 100
+
+// Node is a member of a ring.
+type Node struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+type point struct {
+	hash uint64
+	node int // index in nodes
+}
+
+// Ring maps keys to nodes. It is immutable, safe for concurrent use.
+type Ring struct {
+	nodes  []Node
+	points []point
+}
+
+// New returns the ring of nodes with vnodes points per unit of weight,
+// DefaultVNodes if vnodes is 0. Nodes of weight 0 or less count as 1.
+func New(nodes []Node, vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVNodes
+	}
+	r := &Ring{nodes: make([]Node, len(nodes))}
+	copy(r.nodes, nodes)
+	sort.Slice(r.nodes, func(i, j int) bool { return r.nodes[i].Name < r.nodes[j].Name })
+	for i, n := range r.nodes {
+		if n.Weight <= 0 {
+			r.nodes[i].Weight = 1
+		}
+		for v := 0; v < r.nodes[i].Weight*vnodes; v++ {
+			r.points = append(r.points, point{hash: Hash(n.Name + "#" + strconv.Itoa(v)), node: i})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		// equal hashes are owned by the first node by name
+		return r.points[i].node < r.points[j].node
+	})
+	return r
+}
+
+// Hash returns the position of s on a ring.
+func Hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Nodes returns the nodes of r sorted by name.
+func (r *Ring) Nodes() []Node {
+	nodes := make([]Node, len(r.nodes))
+	copy(nodes, r.nodes)
+	return nodes
+}
+
+// Get returns the node owning key, "" if r is empty.
+func (r *Ring) Get(key string) string {
+	if owners := r.GetN(key, 1); len(owners) > 0 {
+		return owners[0]
+	}
+	return ""
+}
+
+// GetN returns the n distinct nodes following key on r, the owner first,
+// for keys replicated on n nodes. It returns every node if r has fewer.
+func (r *Ring) GetN(key string, n int) []string {
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n <= 0 {
+		return nil
+	}
+	h := Hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	owners := make([]string, 0, n)
+	seen := make(map[int]bool, n)
+	for j := 0; len(owners) < n; j++ {
+		p := r.points[(i+j)%len(r.points)]
+		if !seen[p.node] {
+			seen[p.node] = true
+			owners = append(owners, r.nodes[p.node].Name)
+		}
+	}
+	return owners
+}
@@ -0,0 +1,57 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	if owner := New(nil, 0).Get("k"); owner != "" {
+		t.Fatalf("expected no owner on an empty ring, got %q", owner)
+	}
+	nodes := []Node{{Name: "c"}, {Name: "a"}, {Name: "b"}}
+	r := New(nodes, 0)
+	if got := r.Nodes(); got[0].Name != "a" || got[2].Weight != 1 {
+		t.Fatalf("expected the nodes sorted with weight 1, got %+v", got)
+	}
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key] = r.Get(key)
+		counts[owners[key]]++
+	}
+	for _, n := range nodes {
+		if counts[n.Name] < 700 {
+			t.Fatalf("expected the keys spread over the nodes, got %v", counts)
+		}
+	}
+
+	// adding a node only moves keys to it
+	r2 := New(append(nodes, Node{Name: "d"}), 0)
+	moved := 0
+	for key, owner := range owners {
+		if o := r2.Get(key); o != owner {
+			if o != "d" {
+				t.Fatalf("expected %s to stay on %s or move to d, got %s", key, owner, o)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 1200 {
+		t.Fatalf("expected about a quarter of the keys moved, got %d", moved)
+	}
+
+	if got := r.GetN("k", 5); len(got) != 3 || got[0] != r.Get("k") || got[1] == got[0] || got[2] == got[1] {
+		t.Fatalf("expected 3 distinct owners, got %v", got)
+	}
+
+	heavy := New([]Node{{Name: "a", Weight: 3}, {Name: "b"}}, 0)
+	counts = make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[heavy.Get(fmt.Sprint(i))]++
+	}
+	if counts["a"] < 2*counts["b"] {
+		t.Fatalf("expected the weight 3 node to own more keys, got %v", counts)
+	}
+}
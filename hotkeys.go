@@ -0,0 +1,263 @@
+package main
+
+import (
+	"container/heap"
+	"metcd/api"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// hotKeysCapacity is how many keys, and how many prefixes of every
+	// depth, the access statistics track at most. Once they are full a new
+	// key replaces the least accessed one, so that the keys accessed most
+	// stay tracked whatever the number of keys.
+	hotKeysCapacity = 1024
+	// hotKeysDepth is the number of path segments of the deepest prefix
+	// tracked, /a/b/c/d counts for /a/, /a/b/ and /a/b/c/.
+	hotKeysDepth = 3
+	// hotKeysSampleEvery makes the access statistics count one access out
+	// of every hotKeysSampleEvery, for that many; 1 counts every access.
+	hotKeysSampleEvery = 1
+)
+
+// hotKeys approximates the reads and writes of the keys and prefixes
+// accessed most on this member, for GET /admin/hotkeys. The reads are the
+// ones this member served, the writes the ones it applied. The zero value
+// tracks nothing until the first access.
+type hotKeys struct {
+	n atomic.Uint64 // accesses, to sample them
+
+	mu       sync.Mutex
+	keys     accessSummary
+	prefixes []accessSummary // by depth - 1
+}
+
+type accessKey struct{ keyspace, key string }
+
+// accessSummary is a Space-Saving summary: it tracks hotKeysCapacity keys
+// at most, a key accessed while it is full replaces the key with the
+// fewest accesses and inherits them as its error.
+type accessSummary struct {
+	entries map[accessKey]*accessEntry
+	heap    accessHeap // by total, the least accessed first
+}
+
+type accessEntry struct {
+	api.HotKey
+	total uint64 // error, reads and writes
+	index int    // in the heap
+}
+
+type accessHeap []*accessEntry
+
+func (h accessHeap) Len() int           { return len(h) }
+func (h accessHeap) Less(i, j int) bool { return h[i].total < h[j].total }
+func (h accessHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *accessHeap) Push(x interface{}) {
+	e := x.(*accessEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *accessHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func (a *accessSummary) access(k accessKey, write bool, n, size uint64, now time.Time) {
+	if a.entries == nil {
+		a.entries = make(map[accessKey]*accessEntry)
+	}
+	e, ok := a.entries[k]
+	if !ok {
+		if len(a.heap) < hotKeysCapacity {
+			e = &accessEntry{}
+			heap.Push(&a.heap, e)
+		} else {
+			// replace the least accessed key
+			e = a.heap[0]
+			delete(a.entries, accessKey{e.Keyspace, e.Key})
+			*e = accessEntry{HotKey: api.HotKey{Error: e.total}, total: e.total, index: e.index}
+		}
+		e.Keyspace, e.Key = k.keyspace, k.key
+		a.entries[k] = e
+	}
+	if write {
+		e.Writes += n
+		e.WriteBytes += n * size
+		e.LastWrite = now
+	} else {
+		e.Reads += n
+		e.ReadBytes += n * size
+		e.LastRead = now
+	}
+	e.total += n
+	heap.Fix(&a.heap, e.index)
+}
+
+func (a *accessSummary) drop(keyspace string) {
+	kept := a.heap[:0]
+	for _, e := range a.heap {
+		if e.Keyspace == keyspace {
+			delete(a.entries, accessKey{e.Keyspace, e.Key})
+			continue
+		}
+		e.index = len(kept)
+		kept = append(kept, e)
+	}
+	a.heap = kept
+	heap.Init(&a.heap)
+}
+
+func (h *hotKeys) read(keyspace, key string, size int) {
+	h.access(keyspace, key, false, size)
+}
+
+func (h *hotKeys) write(keyspace, key string, size int) {
+	h.access(keyspace, key, true, size)
+}
+
+func (h *hotKeys) access(keyspace, key string, write bool, size int) {
+	every := uint64(hotKeysSampleEvery)
+	if every > 1 && h.n.Add(1)%every != 0 {
+		return
+	}
+	if every < 1 {
+		every = 1
+	}
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keys.access(accessKey{keyspace, key}, write, every, uint64(size), now)
+	for depth := 1; depth <= hotKeysDepth; depth++ {
+		prefix, ok := keyPrefix(key, depth)
+		if !ok {
+			break
+		}
+		if len(h.prefixes) < depth {
+			h.prefixes = append(h.prefixes, accessSummary{})
+		}
+		h.prefixes[depth-1].access(accessKey{keyspace, prefix}, write, every, uint64(size), now)
+	}
+}
+
+// keyPrefix returns the first depth path segments of key with their
+// trailing slash, false if key has fewer.
+func keyPrefix(key string, depth int) (string, bool) {
+	i := 0
+	if strings.HasPrefix(key, "/") {
+		i = 1
+	}
+	for ; depth > 0; depth-- {
+		j := strings.IndexByte(key[i:], '/')
+		if j < 0 {
+			return "", false
+		}
+		i += j + 1
+	}
+	return key[:i], true
+}
+
+// top returns the limit keys of the keyspace called keyspace with the most
+// accesses by sortBy, or its prefixes of depth if depth is not 0.
+func (h *hotKeys) top(keyspace string, depth int, sortBy string, limit int) []api.HotKey {
+	h.mu.Lock()
+	a := &h.keys
+	if depth > 0 {
+		a = nil
+		if depth <= len(h.prefixes) {
+			a = &h.prefixes[depth-1]
+		}
+	}
+	out := []api.HotKey{}
+	if a != nil {
+		for _, e := range a.heap {
+			if e.Keyspace == keyspace {
+				out = append(out, e.HotKey)
+			}
+		}
+	}
+	h.mu.Unlock()
+	by := func(k api.HotKey) uint64 { return k.Error + k.Reads + k.Writes }
+	switch sortBy {
+	case "reads":
+		by = func(k api.HotKey) uint64 { return k.Reads }
+	case "writes":
+		by = func(k api.HotKey) uint64 { return k.Writes }
+	case "bytes":
+		by = func(k api.HotKey) uint64 { return k.ReadBytes + k.WriteBytes }
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if bi, bj := by(out[i]), by(out[j]); bi != bj {
+			return bi > bj
+		}
+		return out[i].Key < out[j].Key
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// reset forgets the accesses of the keyspace called keyspace.
+func (h *hotKeys) reset(keyspace string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keys.drop(keyspace)
+	for i := range h.prefixes {
+		h.prefixes[i].drop(keyspace)
+	}
+}
+
+// serveHotKeys handles /admin/hotkeys: GET lists the keys of the keyspace
+// of the request accessed most on this member, or with ?depth=<n> the
+// prefixes of n path segments, sorted by ?sort=reads, writes or bytes,
+// by all accesses otherwise, the first ?limit=<n> (100) of them. DELETE
+// resets the statistics of the keyspace.
+func (h *httpKVAPI) serveHotKeys(w http.ResponseWriter, r *http.Request) {
+	name := keyspaceOf(r.Context())
+	if _, err := h.store.RevIn(name); keyspaceError(w, err) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		depth, limit := 0, 100
+		var err error
+		if s := q.Get("depth"); s != "" {
+			if depth, err = strconv.Atoi(s); err != nil || depth < 0 || depth > hotKeysDepth {
+				http.Error(w, "Invalid depth", http.StatusBadRequest)
+				return
+			}
+		}
+		if s := q.Get("limit"); s != "" {
+			if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+		switch sortBy := q.Get("sort"); sortBy {
+		case "", "reads", "writes", "bytes":
+			writeJSON(w, h.store.hotKeys.top(name, depth, sortBy, limit))
+		default:
+			http.Error(w, "Invalid sort", http.StatusBadRequest)
+		}
+	case http.MethodDelete:
+		h.store.hotKeys.reset(name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
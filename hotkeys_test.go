@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"metcd/api"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHotKeys(t *testing.T) {
+	s := newTestKVStore(map[string]string{"/users/1/name": "ada", "/users/2/name": "bob", "/config": "x"})
+	for i := 0; i < 3; i++ {
+		s.Lookup("/users/1/name")
+	}
+	s.GetIn("", "/users/2/name")
+	s.RangeIn("", "/users/", "/users0", 0)
+	s.apply(kv{Op: opPut, Key: "/users/2/name", Val: "robert"})
+	s.apply(kv{Op: opPut, Key: "/config", Val: "y"})
+
+	keys := s.hotKeys.top("", 0, "", 0)
+	if len(keys) != 3 || keys[0].Key != "/users/1/name" || keys[0].Reads != 4 || keys[0].ReadBytes != 12 || keys[0].LastRead.IsZero() {
+		t.Fatalf("expected /users/1/name to be read most, got %+v", keys)
+	}
+	if k := keys[1]; k.Key != "/users/2/name" || k.Reads != 2 || k.Writes != 1 || k.WriteBytes != 6 || k.LastWrite.IsZero() {
+		t.Fatalf("unexpected statistics of /users/2/name %+v", k)
+	}
+	if keys := s.hotKeys.top("", 0, "writes", 1); len(keys) != 1 || keys[0].Key != "/config" {
+		t.Fatalf("expected /config first by writes, got %+v", keys)
+	}
+	if prefixes := s.hotKeys.top("", 1, "", 0); len(prefixes) != 1 || prefixes[0].Key != "/users/" || prefixes[0].Reads != 6 || prefixes[0].Writes != 1 {
+		t.Fatalf("expected the accesses of /users/, got %+v", prefixes)
+	}
+	if prefixes := s.hotKeys.top("", 2, "", 0); len(prefixes) != 2 || prefixes[0].Key != "/users/1/" || prefixes[1].Key != "/users/2/" {
+		t.Fatalf("expected /users/1/ then /users/2/, got %+v", prefixes)
+	}
+
+	s.apply(kv{Op: opKeyspacePut, Keyspace: "app"})
+	s.apply(kv{Op: opPut, Keyspace: "app", Key: "/a", Val: "1"})
+	if keys := s.hotKeys.top("app", 0, "", 0); len(keys) != 1 || keys[0].Keyspace != "app" {
+		t.Fatalf("expected the write of app, got %+v", keys)
+	}
+	s.apply(kv{Op: opKeyspaceDelete, Keyspace: "app"})
+	if keys := s.hotKeys.top("app", 0, "", 0); len(keys) != 0 {
+		t.Fatalf("expected the statistics of a deleted keyspace to be dropped, got %+v", keys)
+	}
+	s.hotKeys.reset("")
+	if keys := s.hotKeys.top("", 0, "", 0); len(keys) != 0 {
+		t.Fatalf("expected no statistics after a reset, got %+v", keys)
+	}
+}
+
+func TestHotKeysCapacity(t *testing.T) {
+	defer func(capacity int) { hotKeysCapacity = capacity }(hotKeysCapacity)
+	hotKeysCapacity = 4
+
+	var h hotKeys
+	for i := 0; i < 20; i++ {
+		h.read("", "/hot", 1)
+	}
+	// a key read more than a quarter of the time stays tracked however
+	// many other keys are read
+	for i := 0; i < 30; i++ {
+		h.read("", fmt.Sprintf("/cold/%d", i), 1)
+	}
+	keys := h.top("", 0, "", 0)
+	if len(keys) != 4 || keys[0].Key != "/hot" || keys[0].Reads != 20 || keys[0].Error != 0 {
+		t.Fatalf("expected /hot to stay tracked, got %+v", keys)
+	}
+	if k := keys[1]; k.Error == 0 || k.Reads != 1 {
+		t.Fatalf("expected a replaced key to carry an error, got %+v", k)
+	}
+	if prefixes := h.top("", 1, "", 0); len(prefixes) != 1 || prefixes[0].Key != "/cold/" || prefixes[0].Reads != 30 {
+		t.Fatalf("expected the reads of /cold/, got %+v", prefixes)
+	}
+}
+
+func TestServeHotKeys(t *testing.T) {
+	s := newTestKVStore(map[string]string{"/a/b": "1"})
+	s.Lookup("/a/b")
+	srv := httptest.NewServer(newHTTPHandler(&httpKVAPI{store: s, requests: newRequestTracker()}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/admin/hotkeys?depth=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []api.HotKey
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(keys) != 1 || keys[0].Key != "/a/" || keys[0].Reads != 1 {
+		t.Fatalf("expected /a/, got %+v", keys)
+	}
+	for _, c := range []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodGet, "/admin/hotkeys?depth=9", http.StatusBadRequest},
+		{http.MethodGet, "/admin/hotkeys?sort=size", http.StatusBadRequest},
+		{http.MethodGet, "/ks/nosuch/admin/hotkeys", http.StatusNotFound},
+		{http.MethodPut, "/admin/hotkeys", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/admin/hotkeys", http.StatusNoContent},
+	} {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.code, resp.StatusCode)
+		}
+	}
+	if keys := s.hotKeys.top("", 0, "", 0); len(keys) != 0 {
+		t.Fatalf("expected DELETE to reset the statistics, got %+v", keys)
+	}
+}
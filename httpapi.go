@@ -15,21 +15,43 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"metcd/api"
 	"metcd/raftnode"
+	"metcd/tracing"
+	"metcd/transform"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.etcd.io/etcd/raft/v3/raftpb"
 )
 
+// healthReadTimeout bounds the linearizable read done by /health.
+const healthReadTimeout = time.Second
+
+// shutdownTimeout bounds the wait for the requests in flight once raft
+// stopped.
+const shutdownTimeout = 5 * time.Second
+
 // Handler for a http based key-value store backed by raft
 type httpKVAPI struct {
 	store       *kvstore
 	rc          *raftnode.RaftNode
 	confChangeC chan<- raftpb.ConfChange
+	guard       resizeGuard
+	requests    *requestTracker
+	logs        *logLevels
+	recorder    *trafficRecorder // nil unless --record-traffic is set
+	audit       *auditLog        // nil unless --audit-log is set
 }
 
 func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -44,10 +66,17 @@ func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		h.store.Propose(key, string(v))
+		if err := h.store.Put(r.Context(), key, string(v)); proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose on PUT (%v)\n", err)
+			http.Error(w, "Failed on PUT", http.StatusInternalServerError)
+			return
+		}
 
 		w.WriteHeader(http.StatusNoContent)
 	case http.MethodGet:
+		setPhase(r.Context(), phaseReadIndex)
 		err := h.rc.LinearizableReadNotify(r.Context())
 		if err != nil {
 			log.Printf("Failed to read on GET (%v)\n", err)
@@ -73,12 +102,16 @@ func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed on POST", http.StatusBadRequest)
 			return
 		}
+		if !h.guardResize(w, r, nodeID, 1) {
+			return
+		}
 
 		cc := raftpb.ConfChange{
 			Type:    raftpb.ConfChangeAddNode,
 			NodeID:  nodeID,
 			Context: url,
 		}
+		setPhase(r.Context(), phaseProposing)
 		h.confChangeC <- cc
 		// As above, optimistic that raft will apply the conf change
 		w.WriteHeader(http.StatusNoContent)
@@ -89,11 +122,15 @@ func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed on DELETE", http.StatusBadRequest)
 			return
 		}
+		if !h.guardResize(w, r, nodeID, -1) {
+			return
+		}
 
 		cc := raftpb.ConfChange{
 			Type:   raftpb.ConfChangeRemoveNode,
 			NodeID: nodeID,
 		}
+		setPhase(r.Context(), phaseProposing)
 		h.confChangeC <- cc
 
 		// As above, optimistic that raft will apply the conf change
@@ -111,18 +148,790 @@ func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// serveHTTPKVAPI starts a key-value server with a GET/PUT API and listens.
-func serveHTTPKVAPI(kv *kvstore, port int, confChangeC chan<- raftpb.ConfChange, rc *raftnode.RaftNode) {
-	srv := http.Server{
-		Addr: ":" + strconv.Itoa(port),
-		Handler: &httpKVAPI{
-			store:       kv,
-			confChangeC: confChangeC,
-			rc:          rc,
-		},
+// serveKV handles /kv/<key>. The key is the path after /kv, so /kv/foo
+// addresses the same key as the legacy /foo endpoint. GET
+// /kv/<key>?history=true lists the changes of <key> like /history/<key>.
+func (h *httpKVAPI) serveKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/kv")
+	space := keyspaceOf(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if q.Get("history") == "true" {
+			h.history(w, r, key)
+			return
+		}
+		if minRev := q.Get("minRev"); minRev != "" {
+			rev, err := strconv.ParseInt(minRev, 10, 64)
+			if err != nil {
+				http.Error(w, "Failed to parse minRev", http.StatusBadRequest)
+				return
+			}
+			setPhase(r.Context(), phaseWaitRev)
+			if err := h.store.WaitRevIn(r.Context(), space, rev); keyspaceError(w, err) {
+				return
+			} else if err != nil {
+				log.Printf("Failed to wait for revision %d on GET (%v)\n", rev, err)
+				http.Error(w, "Failed on GET", http.StatusGatewayTimeout)
+				return
+			}
+		}
+		if err := h.readBarrier(w, r); errors.Is(err, errInvalidStaleness) {
+			http.Error(w, "Invalid maxStaleness", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("Failed to read on GET (%v)\n", err)
+			http.Error(w, "Failed on GET", http.StatusBadRequest)
+			return
+		}
+		kv, rev, err := h.store.GetIn(space, key)
+		if keyspaceError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to decrypt on GET (%v)\n", err)
+			http.Error(w, "Failed on GET", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Metcd-Revision", strconv.FormatInt(rev, 10))
+		if kv == nil {
+			http.Error(w, "Failed to GET", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Metcd-Create-Revision", strconv.FormatInt(kv.CreateRevision, 10))
+		w.Header().Set("X-Metcd-Mod-Revision", strconv.FormatInt(kv.ModRevision, 10))
+		w.Header().Set("X-Metcd-Version", strconv.FormatInt(kv.Version, 10))
+		w.Header().Set("ETag", etag(kv.ModRevision))
+		if kv.ModTime != nil {
+			w.Header().Set("X-Metcd-Mod-Time", kv.ModTime.Format(time.RFC3339Nano))
+		}
+		w.Write([]byte(kv.Value))
+	case http.MethodPut:
+		v, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("Failed to read on PUT (%v)\n", err)
+			http.Error(w, "Failed on PUT", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("If-Match") != "" {
+			h.changeIf(w, r, api.Op{Type: api.OpPut, Key: key, Value: string(v)})
+			return
+		}
+		if err := h.store.Put(proposalCtx(r), key, string(v)); keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose on PUT (%v)\n", err)
+			http.Error(w, "Failed on PUT", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if r.Header.Get("If-Match") != "" {
+			h.changeIf(w, r, api.Op{Type: api.OpDelete, Key: key})
+			return
+		}
+		found, err := h.store.Delete(proposalCtx(r), key)
+		if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose on DELETE (%v)\n", err)
+			http.Error(w, "Failed on DELETE", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Failed to DELETE", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		h.serveUpdate(w, r, key)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPut)
+		w.Header().Add("Allow", http.MethodPatch)
+		w.Header().Add("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// changeIf applies op, the PUT or DELETE of r, only if its If-Match header
+// matches the key, in one txn so no change can come between the check and
+// op. A PUT returns the entity tag of the new value.
+func (h *httpKVAPI) changeIf(w http.ResponseWriter, r *http.Request, op api.Op) {
+	cmp, ok, err := ifMatch(r, op.Key)
+	if err != nil {
+		http.Error(w, "Invalid If-Match", http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	ok, rev, err := h.store.ChangeIf(proposalCtx(r), *cmp, op)
+	if keyspaceError(w, err) || proposalError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to propose on %s (%v)\n", r.Method, err)
+		http.Error(w, "Failed on "+r.Method, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	if op.Type == api.OpPut {
+		w.Header().Set("ETag", etag(rev))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveHistory lists the changes of /history/<key>, see history.
+func (h *httpKVAPI) serveHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.history(w, r, strings.TrimPrefix(r.URL.Path, "/history"))
+}
+
+// history lists the changes of key still kept, with their
+// values and the time they were proposed at, as an api.HistoryResponse.
+// The changes start after the last compaction and the oldest event of the
+// watch history, --watch-history-size and --watch-history-disk-size.
+// ?limit= caps the number of changes, and the continue token of a limited
+// listing reads the next page, up to the revision of the first one.
+func (h *httpKVAPI) history(w http.ResponseWriter, r *http.Request, key string) {
+	limit, token, err := pageQuery(r.URL.Query())
+	if pageError(w, err) {
+		return
+	}
+	var after, upTo int64
+	if token != nil {
+		if after, err = strconv.ParseInt(token.Next, 10, 64); err != nil || after <= 0 || token.Rev < after {
+			http.Error(w, "Invalid continue token", http.StatusBadRequest)
+			return
+		}
+		upTo = token.Rev
+	}
+	if err := h.readBarrier(w, r); errors.Is(err, errInvalidStaleness) {
+		http.Error(w, "Invalid maxStaleness", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Failed to read on GET (%v)\n", err)
+		http.Error(w, "Failed on GET", http.StatusBadRequest)
+		return
+	}
+	resp, err := h.store.HistoryIn(keyspaceOf(r.Context()), key, after, upTo, limit)
+	var compacted *compactedError
+	if keyspaceError(w, err) {
+		return
+	} else if errors.As(err, &compacted) {
+		// the changes of the next page are gone, the listing has to restart
+		w.Header().Set("X-Metcd-Compact-Revision", strconv.FormatInt(compacted.rev, 10))
+		http.Error(w, "Revision compacted", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Printf("Failed to read the history on GET (%v)\n", err)
+		http.Error(w, "Failed on GET", http.StatusInternalServerError)
+		return
+	}
+	if resp.More {
+		if upTo == 0 {
+			upTo = resp.Header.Revision
+		}
+		last := resp.Revisions[len(resp.Revisions)-1].ModRevision
+		resp.Continue = pageToken{Rev: upTo, Next: strconv.FormatInt(last, 10)}.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveWatch streams the changes of /watch/<key> as newline delimited JSON
+// events until the client goes away. ?prefix=true watches every key
+// starting with <key>, ?since=<rev> starts with the events after revision
+// rev still kept, or answers 410 Gone with the X-Metcd-Compact-Revision the
+// kept events start after. ?keysOnly=true leaves the values out,
+// ?noPut=true and ?noDelete=true drop the events of that type, and
+// ?rate=<n> sends at most n events per second.
+func (h *httpKVAPI) serveWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/watch")
+	query := r.URL.Query()
+	opts := watchOptions{since: noSince}
+	opts.prefix, _ = strconv.ParseBool(query.Get("prefix"))
+	opts.keysOnly, _ = strconv.ParseBool(query.Get("keysOnly"))
+	opts.noPut, _ = strconv.ParseBool(query.Get("noPut"))
+	opts.noDelete, _ = strconv.ParseBool(query.Get("noDelete"))
+	if v := query.Get("since"); v != "" {
+		var err error
+		if opts.since, err = strconv.ParseInt(v, 10, 64); err != nil || opts.since < 0 {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	var interval time.Duration
+	if v := query.Get("rate"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate <= 0 {
+			http.Error(w, "Invalid rate", http.StatusBadRequest)
+			return
+		}
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	events, cancel, err := h.store.WatchIn(keyspaceOf(r.Context()), key, opts)
+	var compacted *compactedError
+	if keyspaceError(w, err) {
+		return
+	} else if errors.As(err, &compacted) {
+		w.Header().Set("X-Metcd-Compact-Revision", strconv.FormatInt(compacted.rev, 10))
+		http.Error(w, "Revision compacted", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Printf("Failed to watch (%v)\n", err)
+		http.Error(w, "Failed on GET", http.StatusInternalServerError)
+		return
+	}
+	setPhase(r.Context(), phaseStreaming)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
 	}
+	enc := json.NewEncoder(w)
+	var next time.Time
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				// watcher fell behind and was dropped; the client has to re-watch
+				return
+			}
+			if interval > 0 {
+				// events queue up meanwhile, a watcher limited below the
+				// rate of changes falls behind
+				if wait := time.Until(next); wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-r.Context().Done():
+						return
+					}
+				}
+				next = time.Now().Add(interval)
+			}
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (h *httpKVAPI) serveTxn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var txn api.TxnRequest
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		log.Printf("Failed to decode txn (%v)\n", err)
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+	resp, err := h.store.Txn(proposalCtx(r), &txn)
+	if keyspaceError(w, err) || proposalError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to propose txn (%v)\n", err)
+		http.Error(w, "Failed on POST", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// serveMembers handles /cluster/members, /cluster/members/<id> and
+// /cluster/members/<id>/promote. PATCH /cluster/members/<id> moves a member
+// to a new peer URL. A member added with isObserver is a learner marked as
+// an observer first, which is never promoted. GET /cluster/members?limit=
+// lists the members by ID a page at a time, the X-Metcd-Continue header
+// holding the continue token of the next page.
+func (h *httpKVAPI) serveMembers(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/cluster/members"), "/")
+	idStr, promote := strings.CutSuffix(idStr, "/promote")
+	var nodeID uint64
+	if idStr != "" {
+		var err error
+		if nodeID, err = strconv.ParseUint(idStr, 0, 64); err != nil {
+			log.Printf("Failed to convert ID for conf change (%v)\n", err)
+			http.Error(w, "Failed to convert ID", http.StatusBadRequest)
+			return
+		}
+	}
+	switch {
+	case idStr == "" && r.Method == http.MethodGet:
+		limit, token, err := pageQuery(r.URL.Query())
+		if pageError(w, err) {
+			return
+		}
+		var from uint64
+		if token != nil {
+			if from, err = strconv.ParseUint(token.Next, 10, 64); err != nil {
+				http.Error(w, "Invalid continue token", http.StatusBadRequest)
+				return
+			}
+		}
+		lead := h.rc.LeaderID()
+		snapshots := h.rc.SnapshotTransfers()
+		var members []api.Member
+		for _, m := range h.rc.Members() {
+			if m.ID < from {
+				continue
+			}
+			if limit > 0 && len(members) == limit {
+				w.Header().Set("X-Metcd-Continue", pageToken{Next: strconv.FormatUint(m.ID, 10)}.String())
+				break
+			}
+			member := api.Member{ID: m.ID, PeerURL: m.PeerURL, IsLeader: m.ID == lead, IsLearner: m.IsLearner, IsObserver: h.store.IsObserver(m.ID)}
+			if st, ok := snapshots[m.ID]; ok {
+				member.Snapshot = &api.SnapshotTransfer{Index: st.Index, Size: st.Size, Sent: st.Sent, Attempts: st.Attempts, Started: st.Started}
+			}
+			members = append(members, member)
+		}
+		writeJSON(w, members)
+	case idStr == "" && r.Method == http.MethodPost:
+		var req api.MemberAddRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 || req.PeerURL == "" {
+			http.Error(w, "Failed on POST", http.StatusBadRequest)
+			return
+		}
+		cc := raftpb.ConfChange{
+			Type:    raftpb.ConfChangeAddNode,
+			NodeID:  req.ID,
+			Context: []byte(req.PeerURL),
+		}
+		if req.IsLearner || req.IsObserver {
+			cc.Type = raftpb.ConfChangeAddLearnerNode
+		} else if !h.guardResize(w, r, req.ID, 1) {
+			return
+		}
+		setPhase(r.Context(), phaseProposing)
+		if req.IsObserver {
+			// marked before it is added, so it is never seen as a learner
+			// to promote
+			if err := h.store.MarkObserver(r.Context(), req.ID, true); err != nil {
+				if !proposalError(w, err) {
+					log.Printf("Failed to mark member %d as an observer (%v)\n", req.ID, err)
+					http.Error(w, "Failed on POST", http.StatusInternalServerError)
+				}
+				return
+			}
+		}
+		h.confChangeC <- cc
+		// As above, optimistic that raft will apply the conf change
+		w.WriteHeader(http.StatusNoContent)
+	case promote && r.Method == http.MethodPost:
+		url, ok := h.rc.PeerURL(nodeID)
+		if !ok {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return
+		}
+		if h.store.IsObserver(nodeID) {
+			http.Error(w, "Member is an observer, which is never promoted", http.StatusConflict)
+			return
+		}
+		if !h.guardResize(w, r, nodeID, 1) {
+			return
+		}
+		setPhase(r.Context(), phaseProposing)
+		// adding a learner as a voter promotes it
+		h.confChangeC <- raftpb.ConfChange{
+			Type:    raftpb.ConfChangeAddNode,
+			NodeID:  nodeID,
+			Context: []byte(url),
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case idStr != "" && !promote && r.Method == http.MethodPatch:
+		var req api.MemberUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PeerURL == "" {
+			http.Error(w, "Failed on PATCH", http.StatusBadRequest)
+			return
+		}
+		if _, ok := h.rc.PeerURL(nodeID); !ok {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return
+		}
+		setPhase(r.Context(), phaseProposing)
+		h.confChangeC <- raftpb.ConfChange{
+			Type:    raftpb.ConfChangeUpdateNode,
+			NodeID:  nodeID,
+			Context: []byte(req.PeerURL),
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case idStr != "" && !promote && r.Method == http.MethodDelete:
+		if !h.guardResize(w, r, nodeID, -1) {
+			return
+		}
+		setPhase(r.Context(), phaseProposing)
+		h.confChangeC <- raftpb.ConfChange{
+			Type:   raftpb.ConfChangeRemoveNode,
+			NodeID: nodeID,
+		}
+		if h.store.IsObserver(nodeID) {
+			// a member added again with the same ID starts unmarked
+			if err := h.store.MarkObserver(r.Context(), nodeID, false); err != nil {
+				log.Printf("Failed to unmark removed observer %d (%v)\n", nodeID, err)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveAlarms lists the active alarms on GET and activates or deactivates
+// one on POST.
+func (h *httpKVAPI) serveAlarms(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, h.store.Alarms())
+	case http.MethodPost:
+		var req api.AlarmRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("Failed to decode alarm request (%v)\n", err)
+			http.Error(w, "Failed on POST", http.StatusBadRequest)
+			return
+		}
+		if err := h.store.Alarm(r.Context(), req); err != nil {
+			log.Printf("Failed to propose alarm (%v)\n", err)
+			code := http.StatusInternalServerError
+			if err == ErrInvalidAlarm {
+				code = http.StatusBadRequest
+			}
+			http.Error(w, "Failed on POST", code)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveKeyspaces lists the keyspaces on GET /keyspaces, creates one or
+// changes its quota on PUT /keyspaces/<name> and deletes one with its keys on
+// DELETE /keyspaces/<name>.
+func (h *httpKVAPI) serveKeyspaces(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/keyspaces"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		writeJSON(w, h.store.Keyspaces())
+	case name != "" && r.Method == http.MethodPut:
+		var req api.KeyspaceRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Quota < 0 {
+				http.Error(w, "Failed on PUT", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := h.store.PutKeyspace(r.Context(), name, req.Quota); keyspaceError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose keyspace (%v)\n", err)
+			http.Error(w, "Failed on PUT", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case name != "" && r.Method == http.MethodDelete:
+		if err := h.store.DeleteKeyspace(r.Context(), name); keyspaceError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose keyspace deletion (%v)\n", err)
+			http.Error(w, "Failed on DELETE", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// healthServices are the services GET /health?service=<name> and the
+// grpc.health.v1 Health service of --grpc-port report on: "" and "kv" serve
+// when a leader is known and a linearizable read succeeds, "leader" only on
+// the leader besides.
+var healthServices = map[string]bool{"": true, "kv": true, "leader": true}
+
+// serveHealth reports the member healthy when it knows a leader and can
+// serve a linearizable read, along with the skew of the clocks of its
+// peers.
+func (h *httpKVAPI) serveHealth(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+	if !healthServices[service] {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(api.Health{Status: api.HealthServiceUnknown, Reason: "unknown service"})
+		return
+	}
+	health := api.Health{Leader: h.rc.LeaderID(), AppliedIndex: h.rc.AppliedIndex(), DurableIndex: h.rc.DurableIndex(),
+		ClockSkewExceeded: h.rc.ClockSkewExceeded()}
+	for _, s := range h.rc.ClockSkews() {
+		health.ClockSkew = append(health.ClockSkew, api.ClockSkew{MemberID: s.ID, Offset: s.Offset, RTT: s.RTT})
+	}
+	checkHealth(&health, service, h.rc.ID(), func() error {
+		ctx, cancel := context.WithTimeout(r.Context(), healthReadTimeout)
+		defer cancel()
+		setPhase(r.Context(), phaseReadIndex)
+		return h.rc.LinearizableReadNotify(ctx)
+	})
+	if !health.Health {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(health)
+		return
+	}
+	writeJSON(w, health)
+}
+
+// checkHealth sets the health of service on the member id, whose leader is
+// health.Leader; read is the linearizable read, done once a leader is known.
+func checkHealth(health *api.Health, service string, id uint64, read func() error) {
+	switch {
+	case health.Leader == 0:
+		health.Reason = "no leader"
+	case service == "leader" && health.Leader != id:
+		health.Reason = "not the leader"
+	default:
+		if err := read(); err != nil {
+			health.Reason = err.Error()
+		} else {
+			health.Health = true
+		}
+	}
+	health.Status = api.HealthNotServing
+	if health.Health {
+		health.Status = api.HealthServing
+	}
+}
+
+// serveSnapshot writes a linearizable copy of the whole store, or with
+// ?format=json|proto an export of the keys of a keyspace, compressed with
+// the codec Accept-Encoding prefers. Both redact the values of the redacted
+// prefixes.
+func (h *httpKVAPI) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != exportJSON && format != exportProto {
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+		return
+	}
+	setPhase(r.Context(), phaseReadIndex)
+	if err := h.rc.LinearizableReadNotify(r.Context()); err != nil {
+		log.Printf("Failed to read on snapshot (%v)\n", err)
+		http.Error(w, "Failed on GET", http.StatusBadRequest)
+		return
+	}
+	if format != "" {
+		h.serveExport(w, r, format)
+		return
+	}
+	data, err := h.store.snapshot(true)
+	if err != nil {
+		log.Printf("Failed to get snapshot (%v)\n", err)
+		http.Error(w, "Failed on GET", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	body, done := compressResponse(w, r)
+	body.Write(data)
+	if err := done(); err != nil {
+		log.Printf("Failed to write snapshot (%v)\n", err)
+	}
+}
+
+// serveExport streams the keys of the keyspace of r at the revision of the
+// X-Metcd-Revision header.
+func (h *httpKVAPI) serveExport(w http.ResponseWriter, r *http.Request, format string) {
+	kvs, rev, err := h.store.Export(keyspaceOf(r.Context()))
+	if keyspaceError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to export (%v)\n", err)
+		http.Error(w, "Failed on GET", http.StatusInternalServerError)
+		return
+	}
+	if format == exportProto {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("X-Metcd-Revision", strconv.FormatInt(rev, 10))
+	setPhase(r.Context(), phaseStreaming)
+	body, done := compressResponse(w, r)
+	err = writeExport(body, format, kvs)
+	if err == nil {
+		err = done()
+	}
+	if err != nil {
+		log.Printf("Failed to write export (%v)\n", err)
+	}
+}
+
+// serveDefrag handles POST /admin/defrag, snapshotting this member and
+// removing the WAL segments and snapshot files it no longer needs.
+func (h *httpKVAPI) serveDefrag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res, err := h.rc.Defrag(r.Context())
+	if err != nil {
+		log.Printf("Failed to defrag (%v)\n", err)
+		http.Error(w, "Failed on POST", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, api.DefragResponse{
+		SnapshotIndex:    res.SnapshotIndex,
+		CompactIndex:     res.CompactIndex,
+		RemovedWALs:      res.RemovedWALs,
+		RemovedSnapshots: res.RemovedSnapshots,
+		ReclaimedBytes:   res.ReclaimedBytes,
+	})
+}
+
+// proposalCtx returns the context of the proposals made for r, carrying its
+// Idempotency-Key header.
+func proposalCtx(r *http.Request) context.Context {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return withIdempotencyKey(r.Context(), key)
+	}
+	return r.Context()
+}
+
+// proposalError answers a write whose proposal the admission control
+// deferred, or that a router with an outdated shard placement sent to the
+// raft group its shard moved away from, with 503 and a Retry-After header,
+// a write refused for lack of disk space with 507 and one whose value does
+// not match the schema of its prefix, or its transformer rejects, with 422,
+// reporting whether it did.
+func proposalError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, ErrNoSpace):
+		http.Error(w, "No space left on the data directory of a member", http.StatusInsufficientStorage)
+	case errors.Is(err, raftnode.ErrProposalDeferred):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Proposal deferred, WAL appends are slow", http.StatusServiceUnavailable)
+	case errors.Is(err, raftnode.ErrApplyBacklog):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Proposal rejected, applying the committed entries lags behind", http.StatusServiceUnavailable)
+	case errors.Is(err, ErrShardMoved):
+		// the router of the request had an outdated placement
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Shard moved to another raft group", http.StatusServiceUnavailable)
+	case errors.Is(err, ErrValidationFailed), errors.Is(err, transform.ErrRejected):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response (%v)\n", err)
+	}
+}
+
+// newHTTPHandler routes the API endpoints; every other path is served by
+// the legacy key-value handler.
+func newHTTPHandler(h *httpKVAPI) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/kv/", selectKeyspace(compressed(h.serveKV)))
+	mux.Handle("/v1/kv/", selectKeyspace(compressed(h.serveV1KV)))
+	mux.Handle("/v3/", selectKeyspace(h.serveV3))
+	mux.Handle("/watch/", selectKeyspace(h.serveWatch))
+	mux.Handle("/history/", selectKeyspace(h.serveHistory))
+	mux.Handle("/txn", selectKeyspace(h.serveTxn))
+	mux.Handle("/move", selectKeyspace(h.serveMove))
+	mux.Handle("/ws", selectKeyspace(h.serveWS))
+	mux.Handle("/ks/", keyspacePath(mux))
+	mux.HandleFunc("/cluster/members", h.serveMembers)
+	mux.HandleFunc("/cluster/members/", h.serveMembers)
+	mux.Handle("/snapshot", selectKeyspace(h.serveSnapshot))
+	mux.HandleFunc("/health", h.serveHealth)
+	mux.HandleFunc("/alarms", h.serveAlarms)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/requests", h.requests.serveRequests)
+	mux.HandleFunc("/admin/loglevel", h.serveLogLevel)
+	mux.HandleFunc("/admin/defrag", h.serveDefrag)
+	mux.HandleFunc("/admin/decommission/", h.serveDecommission)
+	mux.Handle("/admin/import", selectKeyspace(h.serveImport))
+	mux.Handle("/admin/verify", selectKeyspace(h.serveVerify))
+	mux.Handle("/admin/encryption", selectKeyspace(h.serveEncryption))
+	mux.Handle("/admin/redaction", selectKeyspace(h.serveRedaction))
+	mux.Handle("/admin/retention", selectKeyspace(h.serveRetention))
+	mux.Handle("/admin/schema", selectKeyspace(h.serveSchema))
+	mux.Handle("/admin/transform", selectKeyspace(h.serveTransform))
+	mux.Handle("/admin/hotkeys", selectKeyspace(h.serveHotKeys))
+	mux.HandleFunc("/admin/stats", h.serveStats)
+	mux.HandleFunc("/keyspaces", h.serveKeyspaces)
+	mux.HandleFunc("/webhooks", h.serveWebhooks)
+	mux.HandleFunc("/webhooks/", h.serveWebhooks)
+	mux.Handle("/views", selectKeyspace(compressed(h.serveViews)))
+	mux.Handle("/ring/", selectKeyspace(h.serveRing))
+	mux.Handle("/tombstones/", selectKeyspace(h.serveTombstones))
+	mux.HandleFunc("/views/", compressed(h.serveViews))
+	mux.HandleFunc("/keyspaces/", h.serveKeyspaces)
+	mux.Handle("/", h)
+	var handler http.Handler = mux
+	if h.recorder != nil {
+		handler = h.recorder.record(handler)
+	}
+	if h.audit != nil {
+		handler = h.audit.handler(handler)
+	}
+	return tracing.Handler(h.requests.track(handler))
+}
+
+// serveHTTPKVAPI starts a key-value server with a GET/PUT API on ln.
+// The requests of the raft groups are routed to their own handler.
+func serveHTTPKVAPI(kv *kvstore, ln net.Listener, tuning httpServerConfig, confChangeC chan<- raftpb.ConfChange, rc *raftnode.RaftNode, guard resizeGuard, logs *logLevels, recorder *trafficRecorder, audit *auditLog, requests *requestTracker, groups *groupManager, removal removalConfig) {
+	def := &raftGroup{store: kv, rc: rc, handler: newHTTPHandler(&httpKVAPI{
+		store:       kv,
+		confChangeC: confChangeC,
+		rc:          rc,
+		guard:       guard,
+		requests:    requests,
+		logs:        logs,
+		recorder:    recorder,
+		audit:       audit,
+	})}
+	if groups != nil {
+		for _, g := range groups.groups {
+			g.handler = newHTTPHandler(&httpKVAPI{store: g.store, confChangeC: g.confChangeC, rc: g.rc, guard: guard, requests: requests, logs: logs, audit: audit})
+		}
+	}
+	srv := tuning.server(fenceRemoved(routeGroups(def, groups), rc.Removed(), removal.staleReads))
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		if err := tuning.serve(srv, ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal(err)
 		}
 	}()
@@ -131,4 +940,16 @@ func serveHTTPKVAPI(kv *kvstore, port int, confChangeC chan<- raftpb.ConfChange,
 	if err, ok := <-rc.ErrorC(); ok {
 		log.Fatal(err)
 	}
+	select {
+	case <-rc.Removed():
+		if removal.mode == onRemovalFence {
+			waitFenced(rc)
+		}
+	default:
+	}
+	// let the responses in flight finish, the one of a decommission of
+	// this member among them
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	srv.Shutdown(ctx)
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"metcd/api"
+)
+
+// maxIdempotencyKeys is the number of idempotency keys remembered by the
+// store. It has to be the same on every member, the oldest key is forgotten
+// first.
+var maxIdempotencyKeys = 10000
+
+type idempotencyKeyCtx struct{}
+
+// withIdempotencyKey makes the proposals of ctx carry key; a proposal with a
+// key already applied is not applied again and returns the first result.
+func withIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtx{}, key)
+}
+
+func idempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyCtx{}).(string)
+	return key
+}
+
+// idempotentResult is the remembered result of a proposal with an
+// idempotency key. It is part of the snapshot so that all members skip the
+// same retries.
+type idempotentResult struct {
+	Key   string           `json:"key"`
+	Found bool             `json:"found,omitempty"`
+	Txn   *api.TxnResponse `json:"txn,omitempty"`
+	Rev   int64            `json:"rev,omitempty"`
+	Time  int64            `json:"time,omitempty"`
+	Prev  *api.KeyValue    `json:"prev,omitempty"`
+	Prevs []*api.KeyValue  `json:"prevs,omitempty"`
+	Put   *api.KeyValue    `json:"put,omitempty"`
+}
+
+func (r *idempotentResult) result() *applyResult {
+	return &applyResult{found: r.Found, txn: r.Txn, rev: r.Rev, time: r.Time, prev: r.Prev, prevs: r.Prevs, put: r.Put}
+}
+
+// idempotencyCache remembers the results of the last maxIdempotencyKeys
+// keys. The zero value is an empty cache.
+type idempotencyCache struct {
+	results map[string]*idempotentResult
+	order   []string // keys from the oldest
+}
+
+func (c *idempotencyCache) get(key string) (*applyResult, bool) {
+	r, ok := c.results[key]
+	if !ok {
+		return nil, false
+	}
+	return r.result(), true
+}
+
+func (c *idempotencyCache) put(key string, res *applyResult) {
+	if _, ok := c.results[key]; ok {
+		return
+	}
+	if c.results == nil {
+		c.results = make(map[string]*idempotentResult)
+	}
+	c.results[key] = &idempotentResult{Key: key, Found: res.found, Txn: res.txn, Rev: res.rev, Time: res.time, Prev: res.prev, Prevs: res.prevs, Put: res.put}
+	c.order = append(c.order, key)
+	for len(c.order) > maxIdempotencyKeys {
+		delete(c.results, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+func (c *idempotencyCache) list() []*idempotentResult {
+	rs := make([]*idempotentResult, 0, len(c.order))
+	for _, key := range c.order {
+		rs = append(rs, c.results[key])
+	}
+	return rs
+}
+
+func (c *idempotencyCache) restore(rs []*idempotentResult) {
+	c.results = make(map[string]*idempotentResult, len(rs))
+	c.order = nil
+	for _, r := range rs {
+		c.put(r.Key, r.result())
+	}
+}
@@ -0,0 +1,117 @@
+// Package idgen generates the revisions of the store. Every member applies
+// the committed changes on its own, so a Generator has to derive the same
+// revision from the same inputs on all of them.
+package idgen
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	FormatMonotonic = "monotonic"
+	FormatSnowflake = "snowflake"
+)
+
+// Entry describes the change a revision is generated for. It is carried by
+// the replicated proposal, so every member sees the same Entry.
+type Entry struct {
+	// Member is the ID of the member that proposed the change.
+	Member uint64
+	// Time is the clock of the leader when the change reached it. It is
+	// zero for changes proposed before it was recorded.
+	Time time.Time
+}
+
+// Generator generates revisions.
+type Generator interface {
+	// Next returns the revision of the change e applied after the one at
+	// revision prev. It must be greater than prev and depend on nothing but
+	// its arguments.
+	Next(prev int64, e Entry) int64
+}
+
+// New returns the Generator of a format: FormatMonotonic or
+// FormatSnowflake with the default layout.
+func New(format string) (Generator, error) {
+	switch format {
+	case FormatMonotonic, "":
+		return Monotonic{}, nil
+	case FormatSnowflake:
+		return Snowflake{}, nil
+	default:
+		return nil, fmt.Errorf("idgen: unknown revision format %q", format)
+	}
+}
+
+// Monotonic numbers the changes 1, 2, 3, ...
+type Monotonic struct{}
+
+func (Monotonic) Next(prev int64, _ Entry) int64 { return prev + 1 }
+
+// DefaultEpoch is the epoch of a Snowflake with a zero Epoch.
+var DefaultEpoch = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	// DefaultNodeBits is the number of member bits of a Snowflake with zero
+	// NodeBits, 1024 members.
+	DefaultNodeBits = 10
+	// timeBits milliseconds last for about 69 years after the epoch.
+	timeBits = 41
+)
+
+// Snowflake generates revisions that embed when and where a change was
+// proposed. From the high bits down a revision is
+//
+//	| 41 bits milliseconds since Epoch | sequence | NodeBits bits member |
+//
+// with 22-NodeBits sequence bits numbering the changes proposed in the same
+// millisecond. A change proposed by a member whose clock is behind gets the
+// time of the previous revision, so revisions keep increasing; the member
+// ID is truncated to NodeBits.
+type Snowflake struct {
+	Epoch    time.Time
+	NodeBits uint
+}
+
+func (s Snowflake) layout() (epoch time.Time, nodeBits, seqBits uint) {
+	epoch, nodeBits = s.Epoch, s.NodeBits
+	if epoch.IsZero() {
+		epoch = DefaultEpoch
+	}
+	if nodeBits == 0 || nodeBits > 63-timeBits-1 {
+		nodeBits = DefaultNodeBits
+	}
+	return epoch, nodeBits, 63 - timeBits - nodeBits
+}
+
+func (s Snowflake) Next(prev int64, e Entry) int64 {
+	epoch, nodeBits, seqBits := s.layout()
+	shift := seqBits + nodeBits
+	ms := int64(0)
+	if !e.Time.IsZero() && e.Time.After(epoch) {
+		ms = e.Time.Sub(epoch).Milliseconds()
+	}
+	prevMS, prevSeq := prev>>shift, prev>>nodeBits&(1<<seqBits-1)
+	seq := int64(0)
+	if ms <= prevMS {
+		ms, seq = prevMS, prevSeq+1
+		if seq == 1<<seqBits {
+			ms, seq = ms+1, 0
+		}
+	}
+	node := int64(e.Member) & (1<<nodeBits - 1)
+	return ms<<shift | seq<<nodeBits | node
+}
+
+// Time returns the time embedded in a revision generated by s.
+func (s Snowflake) Time(rev int64) time.Time {
+	epoch, nodeBits, seqBits := s.layout()
+	return epoch.Add(time.Duration(rev>>(seqBits+nodeBits)) * time.Millisecond)
+}
+
+// Member returns the member ID embedded in a revision generated by s.
+func (s Snowflake) Member(rev int64) uint64 {
+	_, nodeBits, _ := s.layout()
+	return uint64(rev & (1<<nodeBits - 1))
+}
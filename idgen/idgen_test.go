@@ -0,0 +1,58 @@
+package idgen
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnowflake(t *testing.T) {
+	s := Snowflake{}
+	now := DefaultEpoch.Add(1000 * time.Hour)
+
+	rev := s.Next(0, Entry{Member: 3, Time: now})
+	if got := s.Time(rev); !got.Equal(now.Truncate(time.Millisecond)) {
+		t.Fatalf("expected the revision to embed %v, got %v", now, got)
+	}
+	if got := s.Member(rev); got != 3 {
+		t.Fatalf("expected the revision to embed member 3, got %d", got)
+	}
+
+	// the same millisecond, a member whose clock is behind and a change
+	// without a time all follow the previous revision
+	for _, e := range []Entry{{Member: 1, Time: now}, {Member: 2, Time: now.Add(-time.Minute)}, {Member: 1}} {
+		next := s.Next(rev, e)
+		if next <= rev {
+			t.Fatalf("revision %d after %d for %+v", next, rev, e)
+		}
+		if got := s.Time(next); !got.Equal(now.Truncate(time.Millisecond)) {
+			t.Fatalf("expected %+v to get the time of the previous revision, got %v", e, got)
+		}
+		if got := s.Member(next); got != e.Member {
+			t.Fatalf("expected the revision to embed member %d, got %d", e.Member, got)
+		}
+		rev = next
+	}
+
+	// a full sequence moves on to the next millisecond
+	seqBits := 63 - timeBits - DefaultNodeBits
+	full := rev | (1<<seqBits-1)<<DefaultNodeBits
+	if next := s.Next(full, Entry{Time: now}); next <= full || !s.Time(next).Equal(s.Time(full).Add(time.Millisecond)) {
+		t.Fatalf("revision %d after the full sequence %d", next, full)
+	}
+
+	// switching from monotonic revisions keeps them increasing
+	if next := s.Next(42, Entry{}); next <= 42 {
+		t.Fatalf("revision %d after monotonic revision 42", next)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for format, want := range map[string]Generator{"": Monotonic{}, FormatMonotonic: Monotonic{}, FormatSnowflake: Snowflake{}} {
+		if g, err := New(format); err != nil || g != want {
+			t.Fatalf("New(%q) = %v, %v", format, g, err)
+		}
+	}
+	if _, err := New("uuid"); err == nil {
+		t.Fatal("expected an unknown format to fail")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"metcd/api"
+	"metcd/raftnode"
+	"net/http"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// Imported keys are proposed in transactions of up to importBatchOps puts
+// and importBatchBytes of keys and values, well below the limits of raft
+// on the size of an entry.
+var (
+	importBatchOps   = 10000
+	importBatchBytes = 512 * 1024
+)
+
+// importRetryDelay is the wait before proposing a deferred batch again.
+var importRetryDelay = 100 * time.Millisecond
+
+var (
+	// importTargetLatency is the commit latency of its batches an import
+	// is paced to stay under, unless it sets ?targetLatency=.
+	importTargetLatency = 250 * time.Millisecond
+	// importMaxApplyLag is the number of committed entries the member has
+	// not applied yet above which an import slows down too.
+	importMaxApplyLag uint64 = 64
+	// importMaxDelay bounds the wait between two batches.
+	importMaxDelay = 2 * time.Second
+)
+
+// importPacer spaces the batches of an import to keep their commit latency
+// under target: the wait between batches doubles while a batch takes
+// longer or the apply falls behind, and halves once they are back under.
+type importPacer struct {
+	target time.Duration // 0 disables pacing
+	delay  time.Duration
+}
+
+// observe sets the delay before the next batch from the latency of the
+// last one and the apply lag after it.
+func (p *importPacer) observe(latency time.Duration, lag uint64) {
+	switch {
+	case p.target <= 0:
+	case latency > p.target || lag > importMaxApplyLag:
+		if p.delay *= 2; p.delay < 10*time.Millisecond {
+			p.delay = 10 * time.Millisecond
+		}
+		if p.delay > importMaxDelay {
+			p.delay = importMaxDelay
+		}
+	case p.delay > 0:
+		if p.delay /= 2; p.delay < time.Millisecond {
+			p.delay = 0
+		}
+	}
+}
+
+// maxImportMessage bounds the size of a message of an import in the proto
+// format.
+const maxImportMessage = 64 << 20
+
+// importReader returns the next key and value of an import in format, one
+// of the export formats, or io.EOF at its end.
+func importReader(r io.Reader, format string) func() (api.KeyValue, error) {
+	br := bufio.NewReader(r)
+	if format == exportProto {
+		return func() (api.KeyValue, error) {
+			size, err := binary.ReadUvarint(br)
+			if err != nil {
+				return api.KeyValue{}, err
+			}
+			if size > maxImportMessage {
+				return api.KeyValue{}, fmt.Errorf("message of %d bytes is too large", size)
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return api.KeyValue{}, io.ErrUnexpectedEOF
+			}
+			var m mvccpb.KeyValue
+			if err := m.Unmarshal(data); err != nil {
+				return api.KeyValue{}, err
+			}
+			return api.KeyValue{Key: string(m.Key), Value: string(m.Value)}, nil
+		}
+	}
+	dec := json.NewDecoder(br)
+	return func() (api.KeyValue, error) {
+		var kv api.KeyValue
+		err := dec.Decode(&kv)
+		return kv, err
+	}
+}
+
+// importBatches reads the pairs of next into batches of puts and passes
+// them to propose with the size of their keys and values. It stops at the
+// first error other than the io.EOF ending next.
+func importBatches(next func() (api.KeyValue, error), propose func(ops []api.Op, size int) error) error {
+	var ops []api.Op
+	size := 0
+	for {
+		kv, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if kv.Key == "" {
+			return errors.New("empty key")
+		}
+		ops = append(ops, api.Op{Type: api.OpPut, Key: kv.Key, Value: kv.Value})
+		size += len(kv.Key) + len(kv.Value)
+		if len(ops) >= importBatchOps || size >= importBatchBytes {
+			if err := propose(ops, size); err != nil {
+				return err
+			}
+			ops, size = nil, 0
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return propose(ops, size)
+}
+
+// serveImport handles POST /admin/import, putting the keys and values of
+// the body, in a format of GET /snapshot?format=json|proto, into the
+// keyspace of the request, decompressed with the codec of its
+// Content-Encoding. The response is a line of api.ImportProgress
+// per batch, sent while the body is still being read. The batches are paced
+// to commit within ?targetLatency=<duration>, importTargetLatency by
+// default, 0 disables it.
+func (h *httpKVAPI) serveImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportJSON
+	}
+	if format != exportJSON && format != exportProto {
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+		return
+	}
+	pacer := importPacer{target: importTargetLatency}
+	if v := r.URL.Query().Get("targetLatency"); v != "" {
+		var err error
+		if pacer.target, err = time.ParseDuration(v); err != nil || pacer.target < 0 {
+			http.Error(w, "Invalid targetLatency", http.StatusBadRequest)
+			return
+		}
+	}
+	name := keyspaceOf(r.Context())
+	if _, err := h.store.RevIn(name); keyspaceError(w, err) {
+		return
+	}
+	body, err := decompressRequest(r)
+	if err != nil {
+		log.Printf("Failed to read import (%v)\n", err)
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	defer body.Close()
+	rc := http.NewResponseController(w)
+	// HTTP/2 is always full duplex
+	rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	setPhase(r.Context(), phaseStreaming)
+
+	enc := json.NewEncoder(w)
+	var progress api.ImportProgress
+	report := func() {
+		if err := enc.Encode(&progress); err != nil {
+			log.Printf("Failed to write import progress (%v)\n", err)
+		}
+		rc.Flush()
+	}
+	err = importBatches(importReader(body, format), func(ops []api.Op, size int) error {
+		select {
+		case <-time.After(pacer.delay):
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+		// batches are the largest proposals, the admission control defers
+		// them first while the WAL is slow; the apply throttle rejects them
+		// too while the applies lag behind
+		start := time.Now()
+		for {
+			_, err := h.store.Txn(r.Context(), &api.TxnRequest{Success: ops})
+			if err == nil {
+				break
+			} else if !errors.Is(err, raftnode.ErrProposalDeferred) && !errors.Is(err, raftnode.ErrApplyBacklog) {
+				return err
+			}
+			select {
+			case <-time.After(importRetryDelay):
+			case <-r.Context().Done():
+				return r.Context().Err()
+			}
+		}
+		progress.Latency = time.Since(start)
+		progress.ApplyLag = h.rc.ApplyLag()
+		pacer.observe(progress.Latency, progress.ApplyLag)
+		progress.Delay = pacer.delay
+		progress.Keys += int64(len(ops))
+		progress.Bytes += int64(size)
+		progress.Rev, _ = h.store.RevIn(name)
+		report()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to import (%v)\n", err)
+		progress.Error = err.Error()
+	} else {
+		progress.Done = true
+	}
+	report()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"metcd/api"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportBatches(t *testing.T) {
+	defer func(ops, size int) { importBatchOps, importBatchBytes = ops, size }(importBatchOps, importBatchBytes)
+	importBatchOps, importBatchBytes = 2, 1<<20
+
+	kvs := []api.KeyValue{{Key: "/a", Value: "1"}, {Key: "/b", Value: "\x00"}, {Key: "/c", Value: ""}}
+	for _, format := range []string{exportJSON, exportProto} {
+		var buf bytes.Buffer
+		if err := writeExport(&buf, format, kvs); err != nil {
+			t.Fatal(err)
+		}
+		var batches [][]api.Op
+		sizes := 0
+		err := importBatches(importReader(&buf, format), func(ops []api.Op, size int) error {
+			batches = append(batches, ops)
+			sizes += size
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		want := [][]api.Op{
+			{{Type: api.OpPut, Key: "/a", Value: "1"}, {Type: api.OpPut, Key: "/b", Value: "\x00"}},
+			{{Type: api.OpPut, Key: "/c"}},
+		}
+		if !reflect.DeepEqual(batches, want) || sizes != 8 {
+			t.Fatalf("%s: expected %v of 8 bytes, got %v of %d", format, want, batches, sizes)
+		}
+	}
+
+	// a batch is cut once it reaches importBatchBytes
+	importBatchOps, importBatchBytes = 100, 4
+	n := 0
+	err := importBatches(importReader(strings.NewReader(`{"key":"/a","value":"12"}{"key":"/b"}{"key":"/c"}`), exportJSON),
+		func(ops []api.Op, size int) error { n++; return nil })
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 batches, got %d, %v", n, err)
+	}
+
+	for _, body := range []string{`{"key":"/a"} {"key":`, `{"key":""}`} {
+		if err := importBatches(importReader(strings.NewReader(body), exportJSON), func([]api.Op, int) error { return nil }); err == nil {
+			t.Fatalf("expected an error importing %q", body)
+		}
+	}
+	if err := importBatches(importReader(strings.NewReader("\x05\x0a"), exportProto), func([]api.Op, int) error { return nil }); err == nil {
+		t.Fatal("expected an error importing a truncated message")
+	}
+}
+
+func TestImportPacer(t *testing.T) {
+	p := importPacer{target: 100 * time.Millisecond}
+	p.observe(50*time.Millisecond, 0)
+	if p.delay != 0 {
+		t.Fatalf("expected no delay under the target, got %v", p.delay)
+	}
+	p.observe(200*time.Millisecond, 0)
+	p.observe(200*time.Millisecond, 0)
+	if p.delay != 20*time.Millisecond {
+		t.Fatalf("expected the delay to double, got %v", p.delay)
+	}
+	p.observe(50*time.Millisecond, importMaxApplyLag+1)
+	if p.delay != 40*time.Millisecond {
+		t.Fatalf("expected the apply lag to slow down the import, got %v", p.delay)
+	}
+	for i := 0; i < 20; i++ {
+		p.observe(time.Second, 0)
+	}
+	if p.delay != importMaxDelay {
+		t.Fatalf("expected the delay capped, got %v", p.delay)
+	}
+	for i := 0; i < 20; i++ {
+		p.observe(time.Millisecond, 0)
+	}
+	if p.delay != 0 {
+		t.Fatalf("expected the delay to go back to 0, got %v", p.delay)
+	}
+	off := importPacer{}
+	if off.observe(time.Hour, 1000); off.delay != 0 {
+		t.Fatal("expected no pacing without a target")
+	}
+}
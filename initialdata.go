@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"metcd/api"
+	"os"
+	"strings"
+	"time"
+)
+
+// systemPrefix holds the keys metcd writes for itself in the default
+// keyspace.
+const systemPrefix = "/_metcd/"
+
+// initialDataKey records the SHA-256 of the --initial-data applied to the
+// cluster, so that it is applied once.
+const initialDataKey = systemPrefix + "initial-data"
+
+// initialDataRetry is the wait between attempts to seed the initial data.
+var initialDataRetry = 500 * time.Millisecond
+
+// readInitialData reads the --initial-data file at path, a line of
+// {"key": ..., "value": ...} per key as GET /snapshot?format=json exports
+// them, and returns the transaction applying it once.
+func readInitialData(path string) (*api.TxnRequest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	var ops []api.Op
+	next := importReader(bytes.NewReader(data), exportJSON)
+	for line := 1; ; line++ {
+		kv, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v (the initial data is NDJSON)", path, line, err)
+		}
+		switch {
+		case kv.Key == "":
+			return nil, fmt.Errorf("%s: line %d: no key, metcd has no users or roles to seed", path, line)
+		case strings.HasPrefix(kv.Key, systemPrefix):
+			return nil, fmt.Errorf("%s: line %d: %s is reserved", path, line, systemPrefix)
+		}
+		ops = append(ops, api.Op{Type: api.OpPut, Key: kv.Key, Value: kv.Value})
+	}
+	return initialDataTxn(ops, hex.EncodeToString(sum[:])), nil
+}
+
+// initialDataTxn puts ops and records sum under initialDataKey unless some
+// initial data was applied already, whose sum it then reads.
+func initialDataTxn(ops []api.Op, sum string) *api.TxnRequest {
+	return &api.TxnRequest{
+		Compare: []api.Compare{{Target: api.CompareVersion, Result: api.CompareEqual, Key: initialDataKey, Value: "0"}},
+		Success: append(ops, api.Op{Type: api.OpPut, Key: initialDataKey, Value: sum}),
+		Failure: []api.Op{{Type: api.OpGet, Key: initialDataKey}},
+	}
+}
+
+// seedInitialData applies txn, from readInitialData, once the new cluster
+// has elected its first leader, if it is this member. The other members
+// leave it to the leader, and the transaction does nothing on a cluster
+// seeded already, by an earlier leader or start.
+func seedInitialData(s *kvstore, rc interface {
+	LeaderID() uint64
+	IsLeader() bool
+}, txn *api.TxnRequest) {
+	sum := txn.Success[len(txn.Success)-1].Value
+	for ; ; time.Sleep(initialDataRetry) {
+		if rc.LeaderID() == 0 {
+			continue
+		}
+		if !rc.IsLeader() {
+			log.Printf("initial data: seeded by the leader %d", rc.LeaderID())
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*initialDataRetry)
+		res, err := s.Txn(ctx, txn)
+		cancel()
+		if err != nil {
+			log.Printf("initial data: not seeded yet (%v)", err)
+			continue
+		}
+		switch {
+		case res.Succeeded:
+			log.Printf("initial data: seeded %d keys", len(txn.Success)-1)
+		case len(res.Responses) > 0 && res.Responses[0].Value != sum:
+			log.Printf("initial data: the cluster was seeded with different initial data, ignoring it")
+		default:
+			log.Printf("initial data: seeded already")
+		}
+		return
+	}
+}
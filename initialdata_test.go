@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeInitialData(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "seed.ndjson")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestInitialData(t *testing.T) {
+	txn, err := readInitialData(writeInitialData(t, `{"key":"/a","value":"1"}
+{"key":"/b","value":"2","modRevision":7}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestKVStore(nil)
+	for i := 0; i < 2; i++ {
+		r := kv{Op: opTxn, Txn: txn}
+		if err := s.sealProposal(&r); err != nil {
+			t.Fatal(err)
+		}
+		res := s.apply(r)
+		if res.err != nil || res.txn.Succeeded != (i == 0) {
+			t.Fatalf("expected the initial data to be applied once, got %+v at attempt %d", res, i)
+		}
+	}
+	if v, _ := s.Lookup("/b"); v != "2" || s.Rev() != 1 {
+		t.Fatalf("expected /b = 2 at revision 1, got %q at %d", v, s.Rev())
+	}
+	if v, _ := s.Lookup(initialDataKey); v != txn.Success[2].Value {
+		t.Fatalf("expected the sum of the initial data under %s, got %q", initialDataKey, v)
+	}
+
+	for _, data := range []string{
+		`/a=1`,
+		`{"user":"root"}`,
+		`{"key":"/_metcd/initial-data","value":"x"}`,
+	} {
+		if _, err := readInitialData(writeInitialData(t, data)); err == nil {
+			t.Errorf("expected an error for %s", data)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package integration
+
+import (
+	"metcd/raftnode"
+	"sync"
+	"time"
+)
+
+// Clock is a fake clock driving the raft ticks of the members of a cluster,
+// so elections and heartbeats happen when a test advances it rather than
+// after real time.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	pending time.Duration // advanced since the last tick
+	tickers map[*ticker]struct{}
+}
+
+// ticker is the tick channel of a member.
+type ticker struct {
+	c     chan time.Time
+	stopc chan struct{}
+}
+
+// NewClock returns a fake clock set to start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start, tickers: make(map[*ticker]struct{})}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d and ticks every member once per
+// raftnode.TickInterval elapsed. It returns once the members took the ticks.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.pending += d
+	var ticks int
+	for ; c.pending >= raftnode.TickInterval; c.pending -= raftnode.TickInterval {
+		ticks++
+	}
+	now := c.now
+	tickers := make([]*ticker, 0, len(c.tickers))
+	for t := range c.tickers {
+		tickers = append(tickers, t)
+	}
+	c.mu.Unlock()
+	for i := 0; i < ticks; i++ {
+		for _, t := range tickers {
+			select {
+			case t.c <- now:
+			case <-t.stopc:
+			}
+		}
+	}
+}
+
+// newTicker returns the tick channel of a new member.
+func (c *Clock) newTicker() *ticker {
+	t := &ticker{c: make(chan time.Time), stopc: make(chan struct{})}
+	c.mu.Lock()
+	c.tickers[t] = struct{}{}
+	c.mu.Unlock()
+	return t
+}
+
+// stop stops ticking t, whose member stopped.
+func (c *Clock) stop(t *ticker) {
+	c.mu.Lock()
+	delete(c.tickers, t)
+	c.mu.Unlock()
+	close(t.stopc)
+}
@@ -0,0 +1,268 @@
+// Package integration runs metcd raft clusters inside a test process. The
+// members of a cluster are raftnode.Node instances with their own data
+// directory, connected over rafthttp on loopback ports or, with
+// Config.InMemory, in memory without binding any port; with Config.Clock a
+// fake clock drives their elections and heartbeats:
+//
+//	clock := integration.NewClock(time.Now())
+//	c := integration.NewCluster(t, integration.Config{Size: 3, InMemory: true, Clock: clock})
+//	leader := c.WaitLeader()
+//	if err := leader.Put(ctx, "/foo", "bar"); err != nil {
+//		t.Fatal(err)
+//	}
+//	c.Eventually("replication", func() bool { return c.Members[2].KV().Len() == 1 })
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"metcd/api"
+	"metcd/raftnode"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// WaitTimeout bounds the waits of WaitLeader and Eventually.
+var WaitTimeout = 10 * time.Second
+
+// Config configures a cluster.
+type Config struct {
+	// Size is the number of members, 3 if 0.
+	Size int
+	// InMemory connects the members in memory instead of over rafthttp on
+	// loopback ports.
+	InMemory bool
+	// Clock, if set, drives the raft ticks of the members instead of the
+	// wall clock.
+	Clock *Clock
+	// StateMachine returns the state machine of member id, a new KV if
+	// nil. It is called again when the member restarts.
+	StateMachine func(id uint64) raftnode.StateMachine
+	// Options are passed to every member after those of the cluster, the
+	// logs are discarded unless they set raftnode.WithLogger.
+	Options []raftnode.Option
+}
+
+// Cluster is a running cluster.
+type Cluster struct {
+	t       testing.TB
+	cfg     Config
+	dir     string
+	peers   []string
+	net     *raftnode.MemoryNetwork
+	Members []*Member
+}
+
+// Member is a member of a cluster.
+type Member struct {
+	ID uint64
+	c  *Cluster
+
+	mu     sync.RWMutex
+	node   *raftnode.Node // nil while stopped
+	sm     raftnode.StateMachine
+	ticker *ticker
+}
+
+// NewCluster starts a cluster, terminated when the test ends.
+func NewCluster(t testing.TB, cfg Config) *Cluster {
+	t.Helper()
+	if cfg.Size == 0 {
+		cfg.Size = 3
+	}
+	c := &Cluster{t: t, cfg: cfg, dir: t.TempDir(), peers: make([]string, cfg.Size)}
+	if cfg.InMemory {
+		c.net = raftnode.NewMemoryNetwork()
+	}
+	for i := range c.peers {
+		if cfg.InMemory {
+			c.peers[i] = fmt.Sprintf("memory://%d", i+1)
+		} else {
+			c.peers[i] = freePeerURL(t)
+		}
+	}
+	t.Cleanup(c.Terminate)
+	for i := range c.peers {
+		m := &Member{ID: uint64(i + 1), c: c}
+		c.Members = append(c.Members, m)
+		if err := m.Start(); err != nil {
+			t.Fatalf("starting member %d: %v", m.ID, err)
+		}
+	}
+	return c
+}
+
+func freePeerURL(t testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return fmt.Sprintf("http://%s", ln.Addr())
+}
+
+// Member returns the member id.
+func (c *Cluster) Member(id uint64) *Member {
+	return c.Members[id-1]
+}
+
+// Network returns the network connecting the members with Config.InMemory,
+// nil without.
+func (c *Cluster) Network() *raftnode.MemoryNetwork {
+	return c.net
+}
+
+// Leader returns the leader the running members agree on, nil if they do
+// not.
+func (c *Cluster) Leader() *Member {
+	var lead uint64
+	for _, m := range c.Members {
+		n := m.Node()
+		if n == nil {
+			continue
+		}
+		l := n.Status().Leader
+		if l == 0 || (lead != 0 && l != lead) {
+			return nil
+		}
+		lead = l
+	}
+	if lead == 0 || c.Member(lead).Node() == nil {
+		return nil
+	}
+	return c.Member(lead)
+}
+
+// WaitLeader waits until the running members agree on a leader, advancing
+// the fake clock if there is one, and returns it.
+func (c *Cluster) WaitLeader() *Member {
+	c.t.Helper()
+	var lead *Member
+	c.Eventually("a leader", func() bool {
+		lead = c.Leader()
+		return lead != nil
+	})
+	return lead
+}
+
+// Eventually waits until cond holds, failing the test after WaitTimeout.
+// With a fake clock, it advances the clock by a tick between checks so
+// heartbeats go on.
+func (c *Cluster) Eventually(what string, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(WaitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		if c.cfg.Clock != nil {
+			c.cfg.Clock.Advance(raftnode.TickInterval)
+			time.Sleep(time.Millisecond)
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// Terminate stops every running member.
+func (c *Cluster) Terminate() {
+	for _, m := range c.Members {
+		if err := m.Stop(); err != nil && err != raftnode.ErrStopped {
+			c.t.Errorf("stopping member %d: %v", m.ID, err)
+		}
+	}
+}
+
+// Start starts the member, restarting it from its data directory if it ran
+// before.
+func (m *Member) Start() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.node != nil {
+		return nil
+	}
+	cfg := m.c.cfg
+	if cfg.StateMachine != nil {
+		m.sm = cfg.StateMachine(m.ID)
+	} else {
+		m.sm = NewKV()
+	}
+	opts := []raftnode.Option{
+		raftnode.WithDataDir(filepath.Join(m.c.dir, fmt.Sprint(m.ID))),
+		raftnode.WithLogger(zap.NewNop(), zap.NewNop()),
+	}
+	if m.c.net != nil {
+		opts = append(opts, raftnode.WithMemoryNetwork(m.c.net))
+	}
+	if cfg.Clock != nil {
+		m.ticker = cfg.Clock.newTicker()
+		opts = append(opts, raftnode.WithTicks(m.ticker.c))
+	}
+	n, err := raftnode.StartNode(int(m.ID), m.c.peers, false, m.sm, append(opts, cfg.Options...)...)
+	if err != nil {
+		m.stopTicker()
+		return err
+	}
+	m.node = n
+	return nil
+}
+
+// Stop stops the member, keeping its data directory so Start restarts it.
+func (m *Member) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.node == nil {
+		return nil
+	}
+	// the raft loop takes the ticks until it stops
+	err := m.node.Stop()
+	m.stopTicker()
+	m.node = nil
+	return err
+}
+
+func (m *Member) stopTicker() {
+	if m.ticker != nil {
+		m.c.cfg.Clock.stop(m.ticker)
+		m.ticker = nil
+	}
+}
+
+// Node returns the raft node of the member, nil while it is stopped.
+func (m *Member) Node() *raftnode.Node {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.node
+}
+
+// StateMachine returns the state machine of the member.
+func (m *Member) StateMachine() raftnode.StateMachine {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sm
+}
+
+// KV returns the state machine of the member if it is a KV, nil otherwise.
+func (m *Member) KV() *KV {
+	kv, _ := m.StateMachine().(*KV)
+	return kv
+}
+
+// Put proposes to set key to value in the KV state machines.
+func (m *Member) Put(ctx context.Context, key, value string) error {
+	n := m.Node()
+	if n == nil {
+		return raftnode.ErrStopped
+	}
+	data, err := json.Marshal(api.KeyValue{Key: key, Value: value})
+	if err != nil {
+		return err
+	}
+	return n.Propose(ctx, data)
+}
@@ -0,0 +1,64 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInMemoryCluster(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	c := NewCluster(t, Config{Size: 3, InMemory: true, Clock: clock})
+	ctx, cancel := context.WithTimeout(context.Background(), WaitTimeout)
+	defer cancel()
+
+	start := time.Now()
+	leader := c.WaitLeader()
+	if err := leader.Put(ctx, "/foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	c.Eventually("replication", func() bool {
+		for _, m := range c.Members {
+			if v, _ := m.KV().Get("/foo"); v != "bar" {
+				return false
+			}
+		}
+		return true
+	})
+	if clock.Now().Equal(time.Unix(0, 0)) {
+		t.Fatal("expected the election to advance the clock")
+	}
+	t.Logf("elected and replicated in %v", time.Since(start))
+
+	// the others elect a new leader, and the old one catches up on restart
+	if err := leader.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	next := c.WaitLeader()
+	if next == leader {
+		t.Fatal("expected a new leader")
+	}
+	for i := 0; i < 10; i++ {
+		if err := next.Put(ctx, fmt.Sprintf("/k%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.Eventually("the restarted member to catch up", func() bool { return leader.KV().Len() == 11 })
+}
+
+func TestCluster(t *testing.T) {
+	c := NewCluster(t, Config{Size: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), WaitTimeout)
+	defer cancel()
+	if err := c.WaitLeader().Put(ctx, "/foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	c.Eventually("the put", func() bool { v, _ := c.Member(1).KV().Get("/foo"); return v == "bar" })
+	if err := c.Member(1).Node().LinearizableRead(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
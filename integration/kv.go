@@ -0,0 +1,65 @@
+package integration
+
+import (
+	"encoding/json"
+	"metcd/api"
+	"sync"
+)
+
+// KV is a map of keys and values, the default state machine of the members
+// of a cluster. Member.Put proposes its changes.
+type KV struct {
+	mu  sync.RWMutex
+	kvs map[string]string
+}
+
+// NewKV returns an empty KV.
+func NewKV() *KV {
+	return &KV{kvs: make(map[string]string)}
+}
+
+// Get returns the value of key.
+func (kv *KV) Get(key string) (string, bool) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	v, ok := kv.kvs[key]
+	return v, ok
+}
+
+// Len returns the number of keys.
+func (kv *KV) Len() int {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return len(kv.kvs)
+}
+
+// Apply puts the api.KeyValue of every entry.
+func (kv *KV) Apply(data [][]byte) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for _, d := range data {
+		var p api.KeyValue
+		if err := json.Unmarshal(d, &p); err != nil {
+			return err
+		}
+		kv.kvs[p.Key] = p.Value
+	}
+	return nil
+}
+
+func (kv *KV) Snapshot() ([]byte, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return json.Marshal(kv.kvs)
+}
+
+func (kv *KV) Restore(snapshot []byte) error {
+	kvs := make(map[string]string)
+	if err := json.Unmarshal(snapshot, &kvs); err != nil {
+		return err
+	}
+	kv.mu.Lock()
+	kv.kvs = kvs
+	kv.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"metcd/api"
+	"metcd/client"
+	"metcd/raftnode"
+	"time"
+)
+
+const (
+	joinTimeout       = 30 * time.Second
+	joinRetryInterval = time.Second
+)
+
+// joinCluster adds this member as a learner through the API of an existing
+// member, as an observer if observer is true, and returns its ID and the
+// peer list, indexed by ID-1, to start raft with. An ID of 0 picks the next
+// free one. Joining again with the same peer URL reuses the member added
+// before.
+func joinCluster(c *client.Client, id uint64, peerURL string, observer bool) (uint64, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), joinTimeout)
+	defer cancel()
+
+	members, err := c.MemberList(ctx)
+	if err != nil {
+		return 0, nil, fmt.Errorf("join: listing members (%v)", err)
+	}
+	var maxID uint64
+	var self *api.Member
+	for i, m := range members {
+		if m.ID > maxID {
+			maxID = m.ID
+		}
+		if m.PeerURL == peerURL {
+			self = &members[i]
+		}
+		if m.ID == id && m.PeerURL != peerURL {
+			return 0, nil, fmt.Errorf("join: member %d already exists with peer URL %s", id, m.PeerURL)
+		}
+	}
+
+	switch {
+	case self != nil && id != 0 && self.ID != id:
+		return 0, nil, fmt.Errorf("join: peer URL %s already belongs to member %d", peerURL, self.ID)
+	case self != nil:
+		id = self.ID
+		log.Printf("join: already a member of the cluster as %d", id)
+	default:
+		if id == 0 {
+			id = maxID + 1
+		}
+		add, as := c.MemberAddLearner, "learner"
+		if observer {
+			add, as = c.MemberAddObserver, "observer"
+		}
+		log.Printf("join: adding member %d with peer URL %s as %s", id, peerURL, as)
+		if err := add(ctx, id, peerURL); err != nil {
+			return 0, nil, fmt.Errorf("join: adding learner (%v)", err)
+		}
+		if members, err = waitMember(ctx, c, id); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if id > maxID {
+		maxID = id
+	}
+	peers := make([]string, maxID)
+	for _, m := range members {
+		peers[m.ID-1] = m.PeerURL
+	}
+	peers[id-1] = peerURL
+	return id, peers, nil
+}
+
+func waitMember(ctx context.Context, c *client.Client, id uint64) ([]api.Member, error) {
+	for {
+		members, err := c.MemberList(ctx)
+		if err == nil {
+			for _, m := range members {
+				if m.ID == id {
+					return members, nil
+				}
+			}
+		}
+		select {
+		case <-time.After(joinRetryInterval):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("join: waiting for member %d to be added (%v)", id, ctx.Err())
+		}
+	}
+}
+
+// promoteWhenCaughtUp promotes this member once the cluster lists it as a
+// voter. A learner serving a linearizable read has applied everything the
+// leader committed when the read started, so it is caught up.
+func promoteWhenCaughtUp(c *client.Client, rc *raftnode.RaftNode) {
+	for ; ; time.Sleep(joinRetryInterval) {
+		ctx, cancel := context.WithTimeout(context.Background(), joinRetryInterval)
+		members, err := c.MemberList(ctx)
+		cancel()
+		if err != nil {
+			continue
+		}
+		self := findMember(members, rc.ID())
+		if self == nil {
+			log.Printf("join: member %d is not part of the cluster anymore", rc.ID())
+			return
+		}
+		if !self.IsLearner {
+			log.Printf("join: member %d is a voter", rc.ID())
+			return
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), joinRetryInterval)
+		err = rc.LinearizableReadNotify(ctx)
+		if err == nil {
+			log.Printf("join: learner %d caught up, promoting", rc.ID())
+			err = c.MemberPromote(ctx, rc.ID())
+		}
+		cancel()
+		if err != nil {
+			log.Printf("join: learner %d not promoted yet (%v)", rc.ID(), err)
+		}
+	}
+}
+
+func findMember(members []api.Member, id uint64) *api.Member {
+	for i := range members {
+		if members[i].ID == id {
+			return &members[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"metcd/api"
+	"metcd/wait"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// keyspaceHeader selects the keyspace of a request, as does a /ks/<name>
+// path prefix.
+const keyspaceHeader = "X-Metcd-Keyspace"
+
+var (
+	ErrKeyspaceNotFound = errors.New("metcd: keyspace not found")
+	ErrInvalidKeyspace  = errors.New("metcd: invalid keyspace name")
+	ErrQuotaExceeded    = errors.New("metcd: keyspace quota exceeded")
+)
+
+var keyspaceName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// keyspace is a set of keys with its own revisions, watchers and quota. The
+// default keyspace, named "", holds the keys of requests without one.
+type keyspace struct {
+	kvStore    map[string]string // current committed key-value pairs
+	revs       map[string]keyRevs
+	rev        int64 // revision of the last applied change
+	next       int64 // revision of the proposal being applied
+	time       int64 // time of the last applied change, see changeTime
+	nextTime   int64 // time of the proposal being applied
+	compactRev int64 // history at or below this revision may be discarded
+	sinkRev    int64 // changes up to this revision are written to the sink
+	quota      int64 // maximum size of the keys and values, 0 is unlimited
+	size       int64 // size of the keys and values
+	prefixes   map[string]prefixStats
+	retain     map[string]struct{}  // prefixes whose deleted keys are kept, see retention.go
+	tombstones map[string]tombstone // deleted keys kept until compaction
+	schemas    map[string]keySchema // by prefix, see validate.go
+	transforms map[string]string    // transformer names by prefix, see transformer.go
+	revWait    wait.WaitTime        // waits for a revision to be applied
+	watchers   *watchHub
+}
+
+// keyRevs are the revisions a key was created and last changed at, its
+// version, the number of puts since it was created, and the time of its
+// last change. Keys restored from snapshots taken before they were tracked
+// have none, a zero revision or time is unknown and their version counts
+// from their next put.
+type keyRevs struct {
+	Create  int64 `json:"create,omitempty"`
+	Mod     int64 `json:"mod,omitempty"`
+	Version int64 `json:"version,omitempty"`
+	ModTime int64 `json:"modTime,omitempty"`
+}
+
+// changeTime returns the time of a change kept as Unix nanoseconds, nil for
+// 0, the changes older than the recording of times.
+func changeTime(nanos int64) *time.Time {
+	if nanos == 0 {
+		return nil
+	}
+	t := time.Unix(0, nanos).UTC()
+	return &t
+}
+
+func newKeyspace(kvs map[string]string) *keyspace {
+	ks := &keyspace{revWait: wait.NewTimeList(), watchers: newWatchHub(),
+		retain: make(map[string]struct{}), tombstones: make(map[string]tombstone), schemas: make(map[string]keySchema),
+		transforms: make(map[string]string)}
+	ks.setKVs(kvs)
+	return ks
+}
+
+// openKeyspace returns a new empty keyspace called name, logging its watch
+// events to disk if watchHistoryDir is set.
+func openKeyspace(name string) *keyspace {
+	ks := newKeyspace(nil)
+	if dir := historyDir(name); dir != "" {
+		if err := ks.watchers.loadHistory(dir); err != nil {
+			log.Printf("cannot read the watch events of %s, keeping them in memory only (%v)", dir, err)
+		}
+	}
+	return ks
+}
+
+// setKVs replaces the keys and values, without revisions, and recomputes the
+// size.
+func (ks *keyspace) setKVs(kvs map[string]string) {
+	if kvs == nil {
+		kvs = make(map[string]string)
+	}
+	ks.kvStore, ks.revs, ks.size = kvs, make(map[string]keyRevs), 0
+	ks.prefixes = make(map[string]prefixStats)
+	for k, v := range kvs {
+		ks.size += entrySize(k, v)
+		ks.countPrefix(k, 1, entrySize(k, v))
+	}
+}
+
+func entrySize(k, v string) int64 { return int64(len(k) + len(v)) }
+
+// put must be called with s.mu held, the change gets the revision ks.next.
+func (ks *keyspace) put(k, v string) api.Event {
+	revs := ks.revs[k]
+	if old, ok := ks.kvStore[k]; ok {
+		ks.size -= entrySize(k, old)
+		ks.countPrefix(k, -1, -entrySize(k, old))
+	} else {
+		revs.Create = ks.next
+	}
+	revs.Mod, revs.ModTime = ks.next, ks.nextTime
+	revs.Version++
+	delete(ks.tombstones, k)
+	ks.kvStore[k] = v
+	ks.revs[k] = revs
+	ks.size += entrySize(k, v)
+	ks.countPrefix(k, 1, entrySize(k, v))
+	return api.Event{Type: api.EventPut, Key: k, Value: v, CreateRevision: revs.Create, ModRevision: revs.Mod, Version: revs.Version,
+		Time: changeTime(revs.ModTime)}
+}
+
+// del must be called with s.mu held.
+func (ks *keyspace) del(k string) (bool, *api.Event) {
+	v, ok := ks.kvStore[k]
+	if !ok {
+		return false, nil
+	}
+	delete(ks.kvStore, k)
+	delete(ks.revs, k)
+	ks.size -= entrySize(k, v)
+	ks.countPrefix(k, -1, -entrySize(k, v))
+	return true, &api.Event{Type: api.EventDelete, Key: k, ModRevision: ks.next, Time: changeTime(ks.nextTime)}
+}
+
+// get returns the pair of k with its revisions, nil if k does not exist.
+// It must be called with s.mu held.
+func (ks *keyspace) get(k string) *api.KeyValue {
+	v, ok := ks.kvStore[k]
+	if !ok {
+		return nil
+	}
+	revs := ks.revs[k]
+	return &api.KeyValue{Key: k, Value: v, CreateRevision: revs.Create, ModRevision: revs.Mod, Version: revs.Version,
+		ModTime: changeTime(revs.ModTime)}
+}
+
+// admit reports whether ops fit into the quota. Ops that do not grow the
+// keyspace are always admitted, so a full keyspace can be cleaned up. It
+// must be called with s.mu held.
+func (ks *keyspace) admit(ops []api.Op) bool {
+	if ks.quota <= 0 {
+		return true
+	}
+	pending := make(map[string]int64) // size of the keys written by ops so far
+	var growth int64
+	for _, op := range ops {
+		var next int64
+		switch op.Type {
+		case api.OpPut:
+			next = entrySize(op.Key, op.Value)
+		case api.OpDelete:
+		default:
+			continue
+		}
+		cur, ok := pending[op.Key]
+		if !ok {
+			if v, found := ks.kvStore[op.Key]; found {
+				cur = entrySize(op.Key, v)
+			}
+		}
+		growth += next - cur
+		pending[op.Key] = next
+	}
+	return growth <= 0 || ks.size+growth <= ks.quota
+}
+
+// info must be called with s.mu held.
+func (ks *keyspace) info(name string) api.Keyspace {
+	return api.Keyspace{Name: name, Quota: ks.quota, Size: ks.size, Keys: len(ks.kvStore), Rev: ks.rev}
+}
+
+// space returns the keyspace called name. It must be called with s.mu held.
+func (s *kvstore) space(name string) (*keyspace, error) {
+	if name == "" {
+		return s.keyspace, nil
+	}
+	ks, ok := s.keyspaces[name]
+	if !ok {
+		return nil, ErrKeyspaceNotFound
+	}
+	return ks, nil
+}
+
+// LookupIn returns the value of key in the keyspace called name.
+func (s *kvstore) LookupIn(name, key string) (string, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(name)
+	if err != nil {
+		return "", false, err
+	}
+	v, ok := ks.kvStore[key]
+	s.hotKeys.read(name, key, len(v))
+	if !ok {
+		return "", false, nil
+	}
+	if v, err = s.open(key, v); err == nil {
+		v, err = s.transformRead(ks, key, v)
+	}
+	return v, err == nil, err
+}
+
+// GetIn returns the pair of key in the keyspace called name, nil if key
+// does not exist, with the revision of the keyspace.
+func (s *kvstore) GetIn(name, key string) (*api.KeyValue, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	kv, err := s.openKV(ks.get(key))
+	if kv != nil && err == nil {
+		kv.Value, err = s.transformRead(ks, key, kv.Value)
+	}
+	s.hotKeys.read(name, key, len(ks.kvStore[key]))
+	return kv, ks.rev, err
+}
+
+// RevIn returns the revision of the last change applied to the keyspace
+// called name.
+func (s *kvstore) RevIn(name string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(name)
+	if err != nil {
+		return 0, err
+	}
+	return ks.rev, nil
+}
+
+// SinkRevIn returns the revision of the keyspace called name the sink has
+// the changes up to.
+func (s *kvstore) SinkRevIn(name string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(name)
+	if err != nil {
+		return 0, err
+	}
+	return ks.sinkRev, nil
+}
+
+// SinkCheckpoint replicates that the sink has the changes of the keyspace
+// called name up to rev; checkpoints never go back.
+func (s *kvstore) SinkCheckpoint(ctx context.Context, name string, rev int64) error {
+	res, err := s.propose(ctx, kv{Op: opSinkCheckpoint, Keyspace: name, Rev: rev})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// WaitRevIn waits until the change at rev is applied to the keyspace called
+// name.
+func (s *kvstore) WaitRevIn(ctx context.Context, name string, rev int64) error {
+	s.mu.RLock()
+	ks, err := s.space(name)
+	s.mu.RUnlock()
+	if err != nil || rev <= 0 {
+		return err
+	}
+	select {
+	case <-ks.revWait.Wait(uint64(rev)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WatchIn watches key, or every key with that prefix, in the keyspace called
+// name, with the events opts selects. The events end when the keyspace is
+// deleted.
+func (s *kvstore) WatchIn(name, key string, opts watchOptions) (<-chan api.Event, func(), error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ks.watchers.watchWith(key, opts, s.open)
+}
+
+// HistoryIn returns the changes of key in the keyspace called name still
+// in the watch history and after the last compaction of the keyspace. A
+// page of a paginated listing starts after the revision after, and ends at
+// upTo, that of its first page, and with limit changes, 0 for all of them.
+// It fails with a *compactedError if changes after after are gone since.
+func (s *kvstore) HistoryIn(name, key string, after, upTo int64, limit int) (*api.HistoryResponse, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(name)
+	if err != nil {
+		return nil, err
+	}
+	rev := ks.compactRev
+	if after > 0 {
+		if after < ks.compactRev {
+			return nil, &compactedError{rev: ks.compactRev}
+		}
+		rev = after
+	}
+	evs, from, err := ks.watchers.keyHistory(key, rev)
+	if err != nil {
+		return nil, err
+	}
+	if after > 0 && from > after {
+		return nil, &compactedError{rev: from}
+	}
+	resp := &api.HistoryResponse{Header: api.ResponseHeader{Revision: ks.rev}, Key: key, CompactRevision: from}
+	for _, ev := range evs {
+		if upTo > 0 && ev.ModRevision > upTo {
+			break
+		}
+		if limit > 0 && len(resp.Revisions) == limit {
+			resp.More = true
+			break
+		}
+		if ev.Type == api.EventPut {
+			// served like a GET of the key would have served the value
+			if ev.Value, err = s.transformRead(ks, key, openEvent(ev.Key, ev.Value, s.open)); err != nil {
+				return nil, err
+			}
+		}
+		resp.Revisions = append(resp.Revisions, ev)
+	}
+	return resp, nil
+}
+
+// Keyspaces returns the keyspaces sorted by name, the default one first.
+func (s *kvstore) Keyspaces() []api.Keyspace {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spaces := []api.Keyspace{s.keyspace.info("")}
+	for name, ks := range s.keyspaces {
+		spaces = append(spaces, ks.info(name))
+	}
+	sort.Slice(spaces, func(i, j int) bool { return spaces[i].Name < spaces[j].Name })
+	return spaces
+}
+
+// PutKeyspace creates the keyspace called name or changes its quota.
+func (s *kvstore) PutKeyspace(ctx context.Context, name string, quota int64) error {
+	if !keyspaceName.MatchString(name) {
+		return ErrInvalidKeyspace
+	}
+	res, err := s.propose(ctx, kv{Op: opKeyspacePut, Keyspace: name, Quota: quota})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// DeleteKeyspace deletes the keyspace called name with its keys, and ends
+// its watches.
+func (s *kvstore) DeleteKeyspace(ctx context.Context, name string) error {
+	if !keyspaceName.MatchString(name) {
+		return ErrInvalidKeyspace
+	}
+	res, err := s.propose(ctx, kv{Op: opKeyspaceDelete, Keyspace: name})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// applyKeyspace must be called with s.mu held.
+func (s *kvstore) applyKeyspace(r kv) error {
+	if !keyspaceName.MatchString(r.Keyspace) {
+		return ErrInvalidKeyspace
+	}
+	ks, ok := s.keyspaces[r.Keyspace]
+	switch {
+	case r.Op == opKeyspaceDelete && !ok:
+		return ErrKeyspaceNotFound
+	case r.Op == opKeyspaceDelete:
+		keysDeleted.WithLabelValues(deleteKeyspace).Add(float64(len(ks.kvStore)))
+		delete(s.keyspaces, r.Keyspace)
+		s.keyring.DestroyKeyspace(r.Keyspace)
+		for id, wh := range s.webhooks {
+			if wh.Keyspace == r.Keyspace {
+				delete(s.webhooks, id)
+			}
+		}
+		for rd := range s.redactions {
+			if rd.Keyspace == r.Keyspace {
+				delete(s.redactions, rd)
+			}
+		}
+		s.hotKeys.reset(r.Keyspace)
+		ks.watchers.closeAll()
+		ks.watchers.dropHistory()
+	case !ok:
+		ks = openKeyspace(r.Keyspace)
+		s.keyspaces[r.Keyspace] = ks
+		fallthrough
+	default:
+		ks.quota = r.Quota
+	}
+	return nil
+}
+
+type keyspaceCtx struct{}
+
+// withKeyspace makes the reads and proposals of ctx use the keyspace called
+// name.
+func withKeyspace(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, keyspaceCtx{}, name)
+}
+
+func keyspaceOf(ctx context.Context) string {
+	name, _ := ctx.Value(keyspaceCtx{}).(string)
+	return name
+}
+
+// selectKeyspace takes the keyspace of a /kv, /watch, /txn, /ws, /snapshot,
+// /admin/import, /views or /ring request from the X-Metcd-Keyspace header.
+func selectKeyspace(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(keyspaceHeader)
+		switch cur := keyspaceOf(r.Context()); {
+		case name == "" || name == cur:
+			next(w, r)
+		case cur != "":
+			http.Error(w, "Conflicting keyspaces", http.StatusBadRequest)
+		case !keyspaceName.MatchString(name):
+			http.Error(w, "Invalid keyspace", http.StatusBadRequest)
+		default:
+			next(w, r.WithContext(withKeyspace(r.Context(), name)))
+		}
+	})
+}
+
+// keyspacePaths are the paths served below /ks/<name>.
+var keyspacePaths = []string{"/kv/", "/v1/kv/", "/v3/", "/watch/", "/history/", "/txn", "/ws", "/snapshot", "/admin/import", "/admin/verify", "/admin/encryption", "/admin/redaction", "/admin/retention", "/admin/schema", "/admin/transform", "/admin/hotkeys", "/views", "/ring/", "/tombstones/", "/move"}
+
+// keyspacePath serves /ks/<name>/kv/<key>, /ks/<name>/v1/kv/<key>,
+// /ks/<name>/v3/kv/<method>, /ks/<name>/watch/<key>,
+// /ks/<name>/history/<key>, /ks/<name>/txn,
+// /ks/<name>/ws, /ks/<name>/snapshot, /ks/<name>/admin/import,
+// /ks/<name>/admin/verify, /ks/<name>/admin/encryption,
+// /ks/<name>/admin/redaction, /ks/<name>/admin/retention,
+// /ks/<name>/admin/schema, /ks/<name>/admin/transform,
+// /ks/<name>/admin/hotkeys, /ks/<name>/views, /ks/<name>/ring/<prefix>,
+// /ks/<name>/tombstones/<key> and /ks/<name>/move by mux, in the keyspace
+// called name.
+func keyspacePath(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/ks/"), "/")
+		path = "/" + path
+		if !keyspaceName.MatchString(name) {
+			http.Error(w, "Invalid keyspace", http.StatusBadRequest)
+			return
+		}
+		found := false
+		for _, p := range keyspacePaths {
+			if strings.HasSuffix(p, "/") {
+				found = found || strings.HasPrefix(path, p) || path == strings.TrimSuffix(p, "/")
+			} else {
+				found = found || path == p
+			}
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := r.WithContext(withKeyspace(r.Context(), name))
+		u := *r.URL
+		u.Path, u.RawPath = path, ""
+		r2.URL = &u
+		mux.ServeHTTP(w, r2)
+	})
+}
+
+// keyspaceError answers a request that failed with err, reporting whether
+// err is a keyspace error.
+func keyspaceError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, ErrKeyspaceNotFound):
+		http.Error(w, "Keyspace not found", http.StatusNotFound)
+	case errors.Is(err, ErrInvalidKeyspace):
+		http.Error(w, "Invalid keyspace", http.StatusBadRequest)
+	case errors.Is(err, ErrQuotaExceeded):
+		http.Error(w, "Keyspace quota exceeded", http.StatusInsufficientStorage)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKeyspaceRouting(t *testing.T) {
+	mux := http.NewServeMux()
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", keyspaceOf(r.Context()), r.URL.Path)
+	}
+	mux.Handle("/kv/", selectKeyspace(echo))
+	mux.Handle("/txn", selectKeyspace(echo))
+	mux.Handle("/ks/", keyspacePath(mux))
+
+	for _, tt := range []struct {
+		path, header string
+		code         int
+		body         string
+	}{
+		{path: "/kv/foo", code: http.StatusOK, body: " /kv/foo"},
+		{path: "/kv/foo", header: "app", code: http.StatusOK, body: "app /kv/foo"},
+		{path: "/ks/app/kv/foo", code: http.StatusOK, body: "app /kv/foo"},
+		{path: "/ks/app/txn", code: http.StatusOK, body: "app /txn"},
+		{path: "/ks/app/kv/foo", header: "app", code: http.StatusOK, body: "app /kv/foo"},
+		{path: "/ks/app/kv/foo", header: "other", code: http.StatusBadRequest},
+		{path: "/kv/foo", header: "bad name", code: http.StatusBadRequest},
+		{path: "/ks/bad.name/kv/foo", code: http.StatusBadRequest},
+		{path: "/ks/app/cluster/members", code: http.StatusNotFound},
+		{path: "/ks/app/txnfoo", code: http.StatusNotFound},
+		{path: "/ks/app/ks/other/kv/foo", code: http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set(keyspaceHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s (%q): expected status %d, got %d", tt.path, tt.header, tt.code, w.Code)
+		} else if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s (%q): expected %q, got %q", tt.path, tt.header, tt.body, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"metcd/discovery"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccountNamespace holds the namespace of the pod in Kubernetes.
+const serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// kubernetesDNSRetry is the interval between two lookups of the name of
+// the pod while the headless service does not publish it yet.
+const kubernetesDNSRetry = 2 * time.Second
+
+// kubernetesConfig is the StatefulSet a member runs in, from the
+// --kubernetes-* flags.
+type kubernetesConfig struct {
+	pod        string // POD_NAME or the hostname, <set>-<ordinal>
+	replicas   int    // pods forming the initial cluster
+	set        discovery.StatefulSet
+	dnsTimeout time.Duration
+}
+
+// kubernetesMember is the member a pod of a StatefulSet runs.
+type kubernetesMember struct {
+	id      int
+	peerURL string
+	// peers are the initial members, and the pods up to this one when it
+	// is past them; join the client URLs of the initial members to join
+	// through then
+	peers []string
+	join  []string
+}
+
+// member derives the member of the pod: the pods of ordinal below
+// replicas form the cluster, the next ones, added by scaling the set up,
+// join it as learners.
+func (c kubernetesConfig) member() (kubernetesMember, error) {
+	name, ordinal, err := discovery.ParsePodName(c.pod)
+	if err != nil {
+		return kubernetesMember{}, err
+	}
+	if c.replicas < 1 {
+		return kubernetesMember{}, fmt.Errorf("invalid --kubernetes-replicas %d", c.replicas)
+	}
+	set := c.set
+	set.Name = name
+	if set.Service == "" {
+		set.Service = name
+	}
+	m := kubernetesMember{id: ordinal + 1, peerURL: set.PeerURL(ordinal), peers: set.Peers(c.replicas)}
+	if ordinal >= c.replicas {
+		// joining replaces the peers, they are the ones of a restart
+		// without a reachable initial member
+		m.peers = set.Peers(ordinal + 1)
+		for i := 0; i < c.replicas; i++ {
+			m.join = append(m.join, set.ClientURL(i))
+		}
+	}
+	return m, nil
+}
+
+// waitDNS waits for the name of the pod to resolve, which the peer
+// listener binds to.
+func (c kubernetesConfig) waitDNS(peerURL string) error {
+	u, err := url.Parse(peerURL)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	ctx, cancel := context.WithTimeout(context.Background(), c.dnsTimeout)
+	defer cancel()
+	log.Printf("kubernetes: waiting for %s to resolve", host)
+	return discovery.WaitResolve(ctx, host, kubernetesDNSRetry)
+}
+
+// podNamespace returns the namespace of the pod, from POD_NAMESPACE or the
+// service account, "default" otherwise.
+func podNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if b, err := os.ReadFile(serviceAccountNamespace); err == nil {
+		if ns := strings.TrimSpace(string(b)); ns != "" {
+			return ns
+		}
+	}
+	return "default"
+}
+
+// podName returns the name of the pod, from POD_NAME or the hostname.
+func podName() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
+}
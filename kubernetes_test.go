@@ -0,0 +1,42 @@
+package main
+
+import (
+	"metcd/discovery"
+	"reflect"
+	"testing"
+)
+
+func TestKubernetesMember(t *testing.T) {
+	c := kubernetesConfig{pod: "metcd-1", replicas: 3, set: discovery.StatefulSet{Namespace: "db", PeerPort: 2380, ClientPort: 2379}}
+	m, err := c.member()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := []string{
+		"http://metcd-0.metcd.db.svc.cluster.local:2380",
+		"http://metcd-1.metcd.db.svc.cluster.local:2380",
+		"http://metcd-2.metcd.db.svc.cluster.local:2380",
+	}
+	if m.id != 2 || m.peerURL != peers[1] || !reflect.DeepEqual(m.peers, peers) || m.join != nil {
+		t.Fatalf("expected member 2 of the initial cluster, got %+v", m)
+	}
+
+	// scaled up past the initial pods
+	c.pod = "metcd-4"
+	if m, err = c.member(); err != nil {
+		t.Fatal(err)
+	}
+	join := []string{
+		"http://metcd-0.metcd.db.svc.cluster.local:2379",
+		"http://metcd-1.metcd.db.svc.cluster.local:2379",
+		"http://metcd-2.metcd.db.svc.cluster.local:2379",
+	}
+	if m.id != 5 || m.peerURL != "http://metcd-4.metcd.db.svc.cluster.local:2380" || len(m.peers) != 5 || !reflect.DeepEqual(m.join, join) {
+		t.Fatalf("expected member 5 joining through the initial pods, got %+v", m)
+	}
+
+	c.pod = "metcd"
+	if _, err := c.member(); err == nil {
+		t.Fatal("expected an error for a pod outside a StatefulSet")
+	}
+}
@@ -16,32 +16,269 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"metcd/api"
+	"metcd/codec"
+	"metcd/encryption"
+	"metcd/idgen"
 	"metcd/raftnode"
-	"strings"
+	"metcd/tracing"
+	"metcd/wait"
+	"runtime/pprof"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"go.etcd.io/etcd/raft/v3/raftpb"
 	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
 )
 
+// revisions generates the revision of every change. It has to be the same
+// on every member.
+var revisions idgen.Generator = idgen.Monotonic{}
+
 // a key-value store backed by raft
 type kvstore struct {
+	id          uint64
 	proposePipe *raftnode.ProposePipe
 	mu          sync.RWMutex
-	kvStore     map[string]string // current committed key-value pairs
+	*keyspace                        // the default keyspace
+	keyspaces   map[string]*keyspace // the named keyspaces
+	alarms      map[api.Alarm]struct{}
+	raftIndex   uint64 // raft index of the last applied commit
 	snapshotter *snap.Snapshotter
+
+	idGen       *raftnode.Generator // generates request IDs of proposals
+	w           wait.Wait           // waits for the apply result of local proposals
+	idempotency idempotencyCache
+	keyring     *encryption.Keyring        // data keys of the encrypted prefixes
+	views       viewRegistry               // the snapshot views of the member
+	placement   placement                  // the shards of the default keyspace, see shard.go
+	observers   map[uint64]struct{}        // the learners never promoted, see observer.go
+	webhooks    map[string]api.Webhook     // by ID, see webhook.go
+	redactions  map[api.Redaction]struct{} // see redact.go
+	hotKeys     hotKeys                    // the access statistics of the member
+	lowSpace    atomic.Bool                // the data directory is short of space, see diskspace.go
+	// applyLabels are the profiler labels of the apply goroutine by op
+	applyLabels [len(opTypeNames)]context.Context
+}
+
+var (
+	ErrCompacted    = errors.New("metcd: revision has been compacted")
+	ErrFutureRev    = errors.New("metcd: revision is a future revision")
+	ErrInvalidAlarm = errors.New("metcd: invalid alarm request")
+)
+
+type opType int
+
+const (
+	opPut opType = iota
+	opDelete
+	opTxn
+	opCompact
+	opAlarm
+	opKeyspacePut
+	opKeyspaceDelete
+	opDataKeyPut
+	opDataKeyDestroy
+	opDeleteRange
+	opSinkCheckpoint
+	opShards
+	opFence
+	opUnfence
+	opObserverAdd
+	opObserverRemove
+	opWebhookPut
+	opWebhookDelete
+	opRedactionPut
+	opRedactionDelete
+	opRetentionPut
+	opRetentionDelete
+	opUndelete
+	opSchemaPut
+	opSchemaDelete
+	opTransformPut
+	opTransformDelete
+	opMove
+	opAppend
+	opPatch
+)
+
+var opTypeNames = [...]string{"put", "delete", "txn", "compact", "alarm", "keyspace_put", "keyspace_delete", "data_key_put", "data_key_destroy", "delete_range", "sink_checkpoint", "shards", "fence", "unfence", "observer_add", "observer_remove", "webhook_put", "webhook_delete", "redaction_put", "redaction_delete", "retention_put", "retention_delete", "undelete", "schema_put", "schema_delete", "transform_put", "transform_delete", "move", "append", "patch"}
+
+func (op opType) String() string {
+	if op >= 0 && int(op) < len(opTypeNames) {
+		return opTypeNames[op]
+	}
+	return fmt.Sprintf("op(%d)", int(op))
 }
 
+// kv is the proposal replicated through raft. The zero Op is a put so
+// entries written before ID and Op existed still decode as puts.
 type kv struct {
-	Key string
-	Val string
+	ID    uint64
+	Op    opType
+	Key   string
+	Val   string
+	Txn   *api.TxnRequest
+	Rev   int64 // compaction target of opCompact, checkpoint of opSinkCheckpoint
+	Alarm *api.AlarmRequest
+	// IdempotencyKey, if set, makes a retried proposal return the result of
+	// the first one instead of being applied again
+	IdempotencyKey string
+	// Member is the proposing member and Time the clock of the leader,
+	// set by the proposing member and again by the leader if it is another
+	// member, see stampProposal. They are the input of the revision
+	// generator, and Time that of the time of the change
+	Member uint64
+	Time   time.Time
+	// Keyspace is the keyspace the proposal applies to, "" is the default
+	// one; for opKeyspacePut Quota is its quota
+	Keyspace string
+	Quota    int64
+	// Wrapped is the data key of opDataKeyPut for the prefix Key, wrapped
+	// by the master key
+	Wrapped []byte
+	// RangeEnd is the end of the keys removed by opDeleteRange, see inRange
+	RangeEnd string
+	// Reason is why the proposal deletes keys, for the keys_deleted_total
+	// metric; empty for explicit deletes
+	Reason string
+	// Trace is the traceparent of the span proposing it, the parent of the
+	// spans applying it
+	Trace string
+	// Shards is the placement of opShards, replacing the one at version Rev;
+	// opFence and opUnfence refuse or allow again the writes from Key up to
+	// RangeEnd, to the last key if empty
+	Shards []api.Shard
+	// Observer is the member opObserverAdd marks as an observer and
+	// opObserverRemove unmarks
+	Observer uint64
+	// Webhook is the webhook opWebhookPut registers, opWebhookDelete
+	// removes the one with the ID Key
+	Webhook *api.Webhook
+	// MoveTo is where opMove moves the key Key, or the keys with the
+	// prefix Key if MovePrefix is set, replacing the keys there if
+	// MoveOverwrite is set
+	MoveTo        string
+	MovePrefix    bool
+	MoveOverwrite bool
 }
 
-func newKVStore(snapshotter *snap.Snapshotter, proposePipe *raftnode.ProposePipe, commitC <-chan *raftnode.Commit, errorC <-chan error) *kvstore {
-	s := &kvstore{proposePipe: proposePipe, kvStore: make(map[string]string), snapshotter: snapshotter}
+// applyResult is handed to the proposer once its proposal is applied.
+type applyResult struct {
+	err   error
+	found bool
+	txn   *api.TxnResponse
+	rev   int64         // revision of the keyspace after the proposal
+	time  int64         // time of the last change of the keyspace, see changeTime
+	prev  *api.KeyValue // pair replaced by a put or removed by a delete
+	// version is the version of the data key added by opDataKeyPut
+	version uint32
+	prevs   []*api.KeyValue // pairs removed by opDeleteRange
+	put     *api.KeyValue   // pair written by opAppend or opPatch
+	// took is how long applying the proposal took, for slow request logs
+	took time.Duration
+}
+
+// storeSnapshot is the snapshot format. Snapshots taken before revisions
+// existed are a bare key-value map.
+type storeSnapshot struct {
+	Rev        int64              `json:"rev"`
+	CompactRev int64              `json:"compactRev"`
+	SinkRev    int64              `json:"sinkRev,omitempty"`
+	Time       int64              `json:"time,omitempty"`
+	KVs        map[string]string  `json:"kvs"`
+	Revs       map[string]keyRevs `json:"revs,omitempty"`
+	Alarms     []api.Alarm        `json:"alarms,omitempty"`
+	// Idempotency is the idempotency cache from the oldest key
+	Idempotency []*idempotentResult `json:"idempotency,omitempty"`
+	// Binary holds the pairs whose key or value is not valid UTF-8, JSON
+	// strings cannot carry them
+	Binary     []binaryKV         `json:"binary,omitempty"`
+	BinaryRevs []binaryRevs       `json:"binaryRevs,omitempty"`
+	Keyspaces  []keyspaceSnapshot `json:"keyspaces,omitempty"`
+	// DataKeys are the wrapped data keys of the encrypted prefixes
+	DataKeys []encryption.WrappedKey `json:"dataKeys,omitempty"`
+	// RaftIndex is the raft index of the last commit in the snapshot
+	RaftIndex uint64 `json:"raftIndex,omitempty"`
+	// Shards, ShardsVersion and Fences are the placement, see shard.go
+	Shards        []api.Shard `json:"shards,omitempty"`
+	ShardsVersion int64       `json:"shardsVersion,omitempty"`
+	Fences        []keyRange  `json:"fences,omitempty"`
+	// Observers are the members never promoted
+	Observers []uint64      `json:"observers,omitempty"`
+	Webhooks  []api.Webhook `json:"webhooks,omitempty"`
+	// Redactions are the prefixes redacted from exports, see redact.go
+	Redactions []api.Redaction `json:"redactions,omitempty"`
+	// Retain and Tombstones are the retained prefixes and deleted keys of
+	// the default keyspace, see retention.go
+	Retain     []string   `json:"retain,omitempty"`
+	Tombstones []buriedKV `json:"tombstones,omitempty"`
+	// Schemas are the JSON Schemas of the default keyspace by prefix, see
+	// validate.go
+	Schemas map[string]string `json:"schemas,omitempty"`
+	// Transforms are the transformers of the default keyspace by prefix,
+	// see transformer.go
+	Transforms map[string]string `json:"transforms,omitempty"`
+}
+
+// keyspaceSnapshot is a named keyspace in a snapshot, the default one is
+// stored in the top-level fields.
+type keyspaceSnapshot struct {
+	Name       string             `json:"name"`
+	Quota      int64              `json:"quota,omitempty"`
+	Rev        int64              `json:"rev"`
+	CompactRev int64              `json:"compactRev"`
+	SinkRev    int64              `json:"sinkRev,omitempty"`
+	Time       int64              `json:"time,omitempty"`
+	KVs        map[string]string  `json:"kvs"`
+	Revs       map[string]keyRevs `json:"revs,omitempty"`
+	Binary     []binaryKV         `json:"binary,omitempty"`
+	BinaryRevs []binaryRevs       `json:"binaryRevs,omitempty"`
+	Retain     []string           `json:"retain,omitempty"`
+	Tombstones []buriedKV         `json:"tombstones,omitempty"`
+	Schemas    map[string]string  `json:"schemas,omitempty"`
+	Transforms map[string]string  `json:"transforms,omitempty"`
+}
+
+// binaryKV is a key-value pair encoded as base64 by JSON.
+type binaryKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// binaryRevs are the revisions of a key that is not valid UTF-8.
+type binaryRevs struct {
+	Key []byte `json:"key"`
+	keyRevs
+}
+
+func newKVStore(id uint64, snapshotter *snap.Snapshotter, proposePipe *raftnode.ProposePipe, commitC <-chan *raftnode.Commit, errorC <-chan error, keyring *encryption.Keyring) *kvstore {
+	if keyring == nil {
+		keyring, _ = encryption.NewKeyring(nil)
+	}
+	s := &kvstore{
+		id:          id,
+		proposePipe: proposePipe,
+		keyspace:    openKeyspace(""),
+		keyspaces:   make(map[string]*keyspace),
+		alarms:      make(map[api.Alarm]struct{}),
+		observers:   make(map[uint64]struct{}),
+		webhooks:    make(map[string]api.Webhook),
+		redactions:  make(map[api.Redaction]struct{}),
+		snapshotter: snapshotter,
+		idGen:       raftnode.NewGenerator(uint16(id), time.Now()),
+		w:           wait.New(),
+		keyring:     keyring,
+	}
 	snapshot, err := s.loadSnapshot()
 	if err != nil {
 		log.Panic(err)
@@ -53,33 +290,252 @@ func newKVStore(snapshotter *snap.Snapshotter, proposePipe *raftnode.ProposePipe
 		}
 	}
 	// read commits from raft into kvStore map until error
+	for op := range s.applyLabels {
+		s.applyLabels[op] = raftnode.ProfileLabels(id, raftnode.SubsystemApply, raftnode.LabelEntry, opType(op).String())
+	}
 	go s.readCommits(commitC, errorC)
 	return s
 }
 
+// Lookup returns the value of key in the default keyspace. A value that
+// cannot be decrypted, or transformed, is reported as missing.
 func (s *kvstore) Lookup(key string) (string, bool) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
 	v, ok := s.kvStore[key]
-	return v, ok
+	s.mu.RUnlock()
+	s.hotKeys.read("", key, len(v))
+	if !ok {
+		return "", false
+	}
+	v, err := s.open(key, v)
+	if err != nil {
+		log.Printf("cannot decrypt the value of %q (%v)", key, err)
+		return "", false
+	}
+	s.mu.RLock()
+	v, err = s.transformRead(s.keyspace, key, v)
+	s.mu.RUnlock()
+	if err != nil {
+		log.Printf("cannot serve the value of %q (%v)", key, err)
+		return "", false
+	}
+	return v, true
+}
+
+// Put sets k to v and waits until the change is applied locally.
+func (s *kvstore) Put(ctx context.Context, k string, v string) error {
+	res, err := s.propose(ctx, kv{Op: opPut, Key: k, Val: v})
+	if err != nil {
+		return err
+	}
+	return res.err
 }
 
-func (s *kvstore) Propose(k string, v string) error {
-	var buf strings.Builder
-	if err := gob.NewEncoder(&buf).Encode(kv{k, v}); err != nil {
+// Delete removes k and reports whether it existed.
+func (s *kvstore) Delete(ctx context.Context, k string) (bool, error) {
+	res, err := s.propose(ctx, kv{Op: opDelete, Key: k})
+	if err != nil {
+		return false, err
+	}
+	return res.found, res.err
+}
+
+// PutKV sets k to v like Put and returns the written pair with its
+// metadata and the pair it replaced, nil if k did not exist.
+func (s *kvstore) PutKV(ctx context.Context, k string, v string) (*api.KeyValue, *api.KeyValue, error) {
+	res, err := s.propose(ctx, kv{Op: opPut, Key: k, Val: v})
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.err != nil {
+		return nil, nil, res.err
+	}
+	prev, err := s.openKV(res.prev)
+	if err != nil {
+		return nil, nil, err
+	}
+	put := &api.KeyValue{Key: k, Value: v, CreateRevision: res.rev, ModRevision: res.rev, Version: 1, ModTime: changeTime(res.time)}
+	if prev != nil {
+		put.CreateRevision, put.Version = prev.CreateRevision, prev.Version+1
+	}
+	return put, prev, nil
+}
+
+// DeleteKV removes k like Delete and returns the removed pair, nil if k did
+// not exist, and the revision of the keyspace after the delete.
+func (s *kvstore) DeleteKV(ctx context.Context, k string) (*api.KeyValue, int64, error) {
+	res, err := s.propose(ctx, kv{Op: opDelete, Key: k})
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.err != nil {
+		return nil, 0, res.err
+	}
+	prev, err := s.openKV(res.prev)
+	return prev, res.rev, err
+}
+
+// Txn applies txn atomically.
+func (s *kvstore) Txn(ctx context.Context, txn *api.TxnRequest) (*api.TxnResponse, error) {
+	res, err := s.propose(ctx, kv{Op: opTxn, Txn: txn})
+	if err != nil {
+		return nil, err
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	return s.openTxn(res.txn)
+}
+
+// ChangeIf applies op, a put or a delete, only if cmp holds, and reports
+// whether it did with the revision of the keyspace after it.
+func (s *kvstore) ChangeIf(ctx context.Context, cmp api.Compare, op api.Op) (bool, int64, error) {
+	res, err := s.propose(ctx, kv{Op: opTxn, Txn: &api.TxnRequest{Compare: []api.Compare{cmp}, Success: []api.Op{op}}})
+	if err != nil {
+		return false, 0, err
+	}
+	if res.err != nil {
+		return false, 0, res.err
+	}
+	return res.txn.Succeeded, res.rev, nil
+}
+
+// Compact discards the history at or below rev.
+func (s *kvstore) Compact(ctx context.Context, rev int64) error {
+	res, err := s.propose(ctx, kv{Op: opCompact, Rev: rev})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// Alarm activates or deactivates an alarm.
+func (s *kvstore) Alarm(ctx context.Context, req api.AlarmRequest) error {
+	res, err := s.propose(ctx, kv{Op: opAlarm, Alarm: &req})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// Alarms returns the active alarms sorted by member.
+func (s *kvstore) Alarms() []api.Alarm {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.alarmList()
+}
+
+// WaitRev waits until the change at rev is applied locally.
+func (s *kvstore) WaitRev(ctx context.Context, rev int64) error {
+	if rev <= 0 {
+		return nil
+	}
+	select {
+	case <-s.revWait.Wait(uint64(rev)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Rev returns the revision of the last applied change.
+func (s *kvstore) Rev() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rev
+}
+
+// CompactRev returns the revision the history was last compacted at.
+func (s *kvstore) CompactRev() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.compactRev
+}
+
+func (s *kvstore) propose(ctx context.Context, r kv) (*applyResult, error) {
+	if addsData(r) && s.noSpace() {
+		return nil, ErrNoSpace
+	}
+	ctx, span := tracing.Start(ctx, "propose")
+	defer span.End()
+	r.Trace = span.SpanContext().TraceParent()
+	r.ID = s.idGen.Next()
+	r.IdempotencyKey = idempotencyKey(ctx)
+	r.Reason = deleteReason(ctx)
+	r.Member, r.Time = s.id, time.Now()
+	if r.Keyspace == "" {
+		r.Keyspace = keyspaceOf(ctx)
+	}
+	span.SetAttr("metcd.op", r.Op.String())
+	span.SetAttr("metcd.keyspace", r.Keyspace)
+	if err := s.transformProposal(&r); err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	if err := s.validateProposal(r); err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	if err := s.sealProposal(&r); err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
 		log.Fatal(err)
 	}
-	s.proposePipe.ProposeC <- buf.String()
+	span.SetAttr("metcd.proposal.bytes", buf.Len())
+	ch := s.w.Register(r.ID)
 
-	// if ErrorC != nil, waiting propose result
-	if s.proposePipe.ErrorC != nil {
-		err := <-s.proposePipe.ErrorC
-		if err != nil {
-			log.Printf("propose error: %v", err)
-			return err
+	setPhase(ctx, phaseProposing)
+	_, enqueue := tracing.Start(ctx, "enqueue")
+	priority := proposalPriority(r)
+	enqueue.SetAttr("metcd.priority", priority.String())
+	err := s.proposePipe.Propose(raftnode.WithPriority(ctx, priority), buf.Bytes())
+	enqueue.SetError(err)
+	enqueue.End()
+	if err != nil {
+		log.Printf("propose error: %v", err)
+		span.SetError(err)
+		s.w.Trigger(r.ID, nil)
+		return nil, err
+	}
+
+	setPhase(ctx, phaseWaitApply)
+	// committed by raft, then applied by this member
+	_, commit := tracing.Start(ctx, "commit")
+	defer commit.End()
+	select {
+	case x := <-ch:
+		if x == nil {
+			return nil, raftnode.ErrStopped
 		}
+		res := x.(*applyResult)
+		span.SetError(res.err)
+		addApplyTime(ctx, res.took)
+		return res, nil
+	case <-ctx.Done():
+		span.SetError(ctx.Err())
+		s.w.Trigger(r.ID, nil)
+		return nil, ctx.Err()
 	}
-	return nil
+}
+
+// proposalPriority returns the priority r waits for raft with: the
+// proposals of the cluster itself are never queued behind client writes,
+// and neither are for long the deletions of expired keys and the changes
+// of the keyspaces, shards and webhooks an operator makes.
+func proposalPriority(r kv) raftnode.Priority {
+	switch r.Op {
+	case opAlarm, opCompact, opSinkCheckpoint, opFence, opUnfence, opObserverAdd, opObserverRemove:
+		return raftnode.PrioritySystem
+	case opKeyspacePut, opKeyspaceDelete, opShards, opWebhookPut, opWebhookDelete, opRedactionPut, opRedactionDelete, opRetentionPut, opRetentionDelete, opSchemaPut, opSchemaDelete, opTransformPut, opTransformDelete:
+		return raftnode.PriorityHigh
+	}
+	if r.Reason == deleteExpired || r.Reason == deleteMoved {
+		return raftnode.PriorityHigh
+	}
+	return raftnode.PriorityNormal
 }
 
 func (s *kvstore) readCommits(commitC <-chan *raftnode.Commit, errorC <-chan error) {
@@ -99,16 +555,7 @@ func (s *kvstore) readCommits(commitC <-chan *raftnode.Commit, errorC <-chan err
 			continue
 		}
 
-		for _, data := range commit.Data {
-			var dataKv kv
-			dec := gob.NewDecoder(bytes.NewBufferString(data))
-			if err := dec.Decode(&dataKv); err != nil {
-				log.Fatalf("raftexample: could not decode message (%v)", err)
-			}
-			s.mu.Lock()
-			s.kvStore[dataKv.Key] = dataKv.Val
-			s.mu.Unlock()
-		}
+		s.applyCommit(commit)
 		close(commit.ApplyDoneC)
 	}
 	if err, ok := <-errorC; ok {
@@ -116,10 +563,334 @@ func (s *kvstore) readCommits(commitC <-chan *raftnode.Commit, errorC <-chan err
 	}
 }
 
+// applyCommit applies the entries of commit that are newer than the store,
+// so replayed entries are applied once.
+func (s *kvstore) applyCommit(commit *raftnode.Commit) {
+	s.mu.RLock()
+	applied := s.raftIndex
+	s.mu.RUnlock()
+	for _, ent := range commit.Entries {
+		if ent.Index <= applied {
+			continue
+		}
+		var dataKv kv
+		dec := gob.NewDecoder(bytes.NewReader(ent.Data))
+		if err := dec.Decode(&dataKv); err != nil {
+			log.Fatalf("raftexample: could not decode message (%v)", err)
+		}
+		if op := int(dataKv.Op); op >= 0 && op < len(s.applyLabels) && s.applyLabels[op] != nil {
+			pprof.SetGoroutineLabels(s.applyLabels[op])
+		}
+		span := s.applySpan(dataKv.Trace, ent.Index)
+		start := time.Now()
+		res := s.apply(dataKv)
+		span.SetError(res.err)
+		span.End()
+		if dataKv.ID != 0 && s.w.IsRegistered(dataKv.ID) {
+			// a retried proposal returns the cached result, which is shared
+			timed := *res
+			timed.took = time.Since(start)
+			s.w.Trigger(dataKv.ID, &timed)
+		}
+	}
+	s.mu.Lock()
+	if commit.Index > s.raftIndex {
+		s.raftIndex = commit.Index
+	}
+	s.mu.Unlock()
+}
+
+// applySpan starts the span applying the entry at index, of the proposal
+// traced by traceparent, nil if it is not traced.
+func (s *kvstore) applySpan(traceparent string, index uint64) *tracing.Span {
+	if traceparent == "" {
+		return nil
+	}
+	parent, ok := tracing.ParseTraceParent(traceparent)
+	if !ok {
+		return nil
+	}
+	_, span := tracing.Start(tracing.ContextWithSpanContext(context.Background(), parent), "apply")
+	span.SetAttr("metcd.member", s.id)
+	span.SetAttr("raft.index", index)
+	return span
+}
+
+// apply executes a committed proposal against the store and notifies watchers.
+func (s *kvstore) apply(r kv) *applyResult {
+	var (
+		res    applyResult
+		events []api.Event
+	)
+	s.mu.Lock()
+	if r.IdempotencyKey != "" {
+		if cached, ok := s.idempotency.get(r.IdempotencyKey); ok {
+			s.mu.Unlock()
+			return cached
+		}
+	}
+	ks, err := s.space(r.Keyspace)
+	if ks != nil {
+		ks.next = revisions.Next(ks.rev, idgen.Entry{Member: r.Member, Time: r.Time})
+		ks.nextTime = nextChangeTime(ks.time, r.Time)
+	}
+	switch {
+	case r.Op == opAlarm:
+		res.err = s.alarm(r.Alarm)
+	case r.Op == opKeyspacePut || r.Op == opKeyspaceDelete:
+		res.err = s.applyKeyspace(r)
+	case r.Op == opShards || r.Op == opFence || r.Op == opUnfence:
+		res.err = s.placement.apply(r)
+	case r.Op == opObserverAdd || r.Op == opObserverRemove:
+		s.observer(r)
+	case r.Op == opWebhookPut || r.Op == opWebhookDelete:
+		res.err = s.applyWebhook(r)
+	case err != nil:
+		res.err = err
+	case r.Op == opRedactionPut || r.Op == opRedactionDelete:
+		res.err = s.applyRedaction(r)
+	case r.Op == opRetentionPut || r.Op == opRetentionDelete:
+		res.err = ks.applyRetention(r)
+	case r.Op == opSchemaPut || r.Op == opSchemaDelete:
+		res.err = ks.applySchema(r)
+	case r.Op == opTransformPut || r.Op == opTransformDelete:
+		res.err = ks.applyTransform(r)
+	case r.Keyspace == "" && s.placement.fenced(r):
+		res.err = ErrShardMoved
+	case r.Op == opDataKeyPut || r.Op == opDataKeyDestroy:
+		events = s.applyDataKey(ks, r, &res)
+	case r.Op == opPut:
+		if !ks.admit([]api.Op{{Type: api.OpPut, Key: r.Key, Value: r.Val}}) {
+			res.err = ErrQuotaExceeded
+			break
+		}
+		res.prev = ks.get(r.Key)
+		events = append(events, ks.put(r.Key, r.Val))
+	case r.Op == opDelete:
+		var ev *api.Event
+		res.prev = ks.get(r.Key)
+		res.found, ev = ks.del(r.Key)
+		if ev != nil {
+			events = append(events, *ev)
+		}
+		if r.Reason == "" {
+			ks.bury(res.prev)
+		}
+	case r.Op == opTxn:
+		res.txn, events, res.err = ks.applyTxn(r.Txn, s.openCompared)
+	case r.Op == opDeleteRange:
+		for _, k := range ks.rangeKeys(r.Key, r.RangeEnd) {
+			res.prevs = append(res.prevs, ks.get(k))
+			_, ev := ks.del(k)
+			events = append(events, *ev)
+			if r.Reason == "" {
+				ks.bury(res.prevs[len(res.prevs)-1])
+			}
+		}
+	case r.Op == opUndelete:
+		var ev *api.Event
+		ev, res.err = ks.undelete(r.Key)
+		if ev != nil {
+			events = append(events, *ev)
+		}
+	case r.Op == opMove:
+		events, res.err = s.applyMove(ks, r, &res)
+	case r.Op == opAppend || r.Op == opPatch:
+		events, res.err = s.applyUpdate(ks, r, &res)
+	case r.Op == opCompact:
+		res.err = ks.compact(r.Rev)
+	case r.Op == opSinkCheckpoint:
+		if r.Rev > ks.sinkRev {
+			ks.sinkRev = r.Rev
+		}
+	default:
+		log.Printf("ignoring proposal with unknown op %d", r.Op)
+	}
+	countApplied(r, &res, events)
+	if len(events) > 0 {
+		// every proposal that changes a keyspace is one revision of it
+		ks.rev, ks.time = ks.next, ks.nextTime
+	}
+	if ks != nil {
+		res.rev, res.time = ks.rev, ks.time
+	}
+	if r.IdempotencyKey != "" && res.err == nil {
+		s.idempotency.put(r.IdempotencyKey, &res)
+	}
+	if ks == nil {
+		s.mu.Unlock()
+		return &res
+	}
+	rev := ks.rev
+	s.mu.Unlock()
+	ks.revWait.Trigger(uint64(rev))
+
+	for _, ev := range events {
+		s.hotKeys.write(r.Keyspace, ev.Key, len(ev.Value))
+		ks.watchers.notify(ev, s.open)
+	}
+	return &res
+}
+
+// compact must be called with s.mu held.
+func (ks *keyspace) compact(rev int64) error {
+	if rev > ks.rev {
+		return ErrFutureRev
+	}
+	if rev <= ks.compactRev {
+		return ErrCompacted
+	}
+	ks.compactRev = rev
+	for k, t := range ks.tombstones {
+		if t.DeleteRev <= rev {
+			delete(ks.tombstones, k)
+		}
+	}
+	log.Printf("compacted history at revision %d", rev)
+	return nil
+}
+
+// alarm must be called with s.mu held.
+func (s *kvstore) alarm(req *api.AlarmRequest) error {
+	switch req.Action {
+	case api.AlarmActivate:
+		if req.MemberID == 0 || req.Alarm == "" {
+			return ErrInvalidAlarm
+		}
+		a := api.Alarm{MemberID: req.MemberID, Alarm: req.Alarm}
+		if _, ok := s.alarms[a]; !ok {
+			s.alarms[a] = struct{}{}
+			log.Printf("alarm %s raised on member %d", a.Alarm, a.MemberID)
+		}
+	case api.AlarmDeactivate:
+		for a := range s.alarms {
+			if (req.MemberID == 0 || req.MemberID == a.MemberID) && (req.Alarm == "" || req.Alarm == a.Alarm) {
+				delete(s.alarms, a)
+				log.Printf("alarm %s cleared on member %d", a.Alarm, a.MemberID)
+			}
+		}
+	default:
+		return ErrInvalidAlarm
+	}
+	return nil
+}
+
+// alarmList must be called with s.mu held.
+func (s *kvstore) alarmList() []api.Alarm {
+	alarms := make([]api.Alarm, 0, len(s.alarms))
+	for a := range s.alarms {
+		alarms = append(alarms, a)
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		if alarms[i].MemberID != alarms[j].MemberID {
+			return alarms[i].MemberID < alarms[j].MemberID
+		}
+		return alarms[i].Alarm < alarms[j].Alarm
+	})
+	return alarms
+}
+
 func (s *kvstore) getSnapshot() ([]byte, error) {
+	return s.snapshot(false)
+}
+
+// snapshot returns the snapshot of the store, with the values under the
+// redacted prefixes replaced if redact is set.
+func (s *kvstore) snapshot(redact bool) ([]byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return json.Marshal(s.kvStore)
+	st := storeSnapshot{Rev: s.rev, CompactRev: s.compactRev, SinkRev: s.sinkRev, Time: s.time,
+		Alarms: s.alarmList(), Idempotency: s.idempotency.list(), DataKeys: s.keyring.List(), RaftIndex: s.raftIndex,
+		Shards: s.placement.shards, ShardsVersion: s.placement.version, Fences: s.placement.fences, Observers: s.observerList(), Webhooks: s.webhookList(),
+		Redactions: s.redactionList()}
+	if redact && len(s.redactions) > 0 {
+		// the cached results hold the values of the keys they replaced
+		st.Idempotency = nil
+	}
+	st.KVs, st.Binary = splitBinary(s.redactKVs("", s.kvStore, redact))
+	st.Revs, st.BinaryRevs = splitRevs(s.revs)
+	st.Retain, st.Tombstones = s.keyspace.retainedPrefixes(), s.keyspace.tombstoneList(s.redactedIf("", redact))
+	st.Schemas, st.Transforms = s.keyspace.schemaList(), s.keyspace.transformList()
+	for name, ks := range s.keyspaces {
+		kss := keyspaceSnapshot{Name: name, Quota: ks.quota, Rev: ks.rev, CompactRev: ks.compactRev, SinkRev: ks.sinkRev, Time: ks.time}
+		kss.KVs, kss.Binary = splitBinary(s.redactKVs(name, ks.kvStore, redact))
+		kss.Revs, kss.BinaryRevs = splitRevs(ks.revs)
+		kss.Retain, kss.Tombstones = ks.retainedPrefixes(), ks.tombstoneList(s.redactedIf(name, redact))
+		kss.Schemas, kss.Transforms = ks.schemaList(), ks.transformList()
+		st.Keyspaces = append(st.Keyspaces, kss)
+	}
+	sort.Slice(st.Keyspaces, func(i, j int) bool { return st.Keyspaces[i].Name < st.Keyspaces[j].Name })
+	return json.Marshal(st)
+}
+
+// splitBinary splits kvs into the pairs JSON strings can carry and the
+// others. kvs itself is returned when all pairs are valid UTF-8.
+func splitBinary(kvs map[string]string) (map[string]string, []binaryKV) {
+	valid := true
+	for k, v := range kvs {
+		if !utf8.ValidString(k) || !utf8.ValidString(v) {
+			valid = false
+			break
+		}
+	}
+	if valid {
+		return kvs, nil
+	}
+	text := make(map[string]string, len(kvs))
+	var binary []binaryKV
+	for k, v := range kvs {
+		if utf8.ValidString(k) && utf8.ValidString(v) {
+			text[k] = v
+		} else {
+			binary = append(binary, binaryKV{Key: []byte(k), Value: []byte(v)})
+		}
+	}
+	sort.Slice(binary, func(i, j int) bool { return bytes.Compare(binary[i].Key, binary[j].Key) < 0 })
+	return text, binary
+}
+
+// joinBinary adds the binary pairs to kvs, which may be nil.
+func joinBinary(kvs map[string]string, binary []binaryKV) map[string]string {
+	if kvs == nil {
+		kvs = make(map[string]string)
+	}
+	for _, kv := range binary {
+		kvs[string(kv.Key)] = string(kv.Value)
+	}
+	return kvs
+}
+
+// splitRevs splits revs like splitBinary splits pairs, by whether the key is
+// valid UTF-8.
+func splitRevs(revs map[string]keyRevs) (map[string]keyRevs, []binaryRevs) {
+	var binary []binaryRevs
+	for k, r := range revs {
+		if !utf8.ValidString(k) {
+			binary = append(binary, binaryRevs{[]byte(k), r})
+		}
+	}
+	if len(binary) == 0 {
+		return revs, nil
+	}
+	text := make(map[string]keyRevs, len(revs)-len(binary))
+	for k, r := range revs {
+		if utf8.ValidString(k) {
+			text[k] = r
+		}
+	}
+	sort.Slice(binary, func(i, j int) bool { return bytes.Compare(binary[i].Key, binary[j].Key) < 0 })
+	return text, binary
+}
+
+// joinRevs adds the binary revisions to revs, which may be nil.
+func joinRevs(revs map[string]keyRevs, binary []binaryRevs) map[string]keyRevs {
+	if revs == nil {
+		revs = make(map[string]keyRevs)
+	}
+	for _, r := range binary {
+		revs[string(r.Key)] = r.keyRevs
+	}
+	return revs
 }
 
 func (s *kvstore) loadSnapshot() (*raftpb.Snapshot, error) {
@@ -130,16 +901,93 @@ func (s *kvstore) loadSnapshot() (*raftpb.Snapshot, error) {
 	if err != nil {
 		return nil, err
 	}
+	if snapshot.Data, err = atRest.Open(snapshot.Data); err != nil {
+		return nil, err
+	}
 	return snapshot, nil
 }
 
 func (s *kvstore) recoverFromSnapshot(snapshot []byte) error {
-	var store map[string]string
-	if err := json.Unmarshal(snapshot, &store); err != nil {
+	snapshot, err := codec.Decode(snapshot)
+	if err != nil {
+		return fmt.Errorf("cannot decode the snapshot: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(snapshot, &fields); err != nil {
+		return err
+	}
+	var st storeSnapshot
+	if _, ok := fields["kvs"]; ok {
+		if err := json.Unmarshal(snapshot, &st); err != nil {
+			return err
+		}
+	} else if err := json.Unmarshal(snapshot, &st.KVs); err != nil {
 		return err
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.kvStore = store
+	s.setKVs(joinBinary(st.KVs, st.Binary))
+	s.revs = joinRevs(st.Revs, st.BinaryRevs)
+	s.keyspace.restoreRetention(st.Retain, st.Tombstones)
+	if err := s.keyspace.restoreSchemas(st.Schemas); err != nil {
+		return err
+	}
+	s.keyspace.restoreTransforms(st.Transforms)
+	s.rev = st.Rev
+	s.compactRev = st.CompactRev
+	s.sinkRev = st.SinkRev
+	s.time = st.Time
+	s.alarms = make(map[api.Alarm]struct{}, len(st.Alarms))
+	for _, a := range st.Alarms {
+		s.alarms[a] = struct{}{}
+	}
+	s.observers = make(map[uint64]struct{}, len(st.Observers))
+	for _, id := range st.Observers {
+		s.observers[id] = struct{}{}
+	}
+	s.webhooks = make(map[string]api.Webhook, len(st.Webhooks))
+	for _, wh := range st.Webhooks {
+		s.webhooks[wh.ID] = wh
+	}
+	s.redactions = make(map[api.Redaction]struct{}, len(st.Redactions))
+	for _, rd := range st.Redactions {
+		s.redactions[rd] = struct{}{}
+	}
+	s.idempotency.restore(st.Idempotency)
+	s.keyring.Restore(st.DataKeys)
+	if err := s.keyring.Check(); err != nil {
+		return fmt.Errorf("cannot use the data keys of the snapshot, every member needs the same --encryption-key-file: %w", err)
+	}
+	s.raftIndex = st.RaftIndex
+	s.placement.restore(st.Shards, st.ShardsVersion, st.Fences)
+	s.revWait.Trigger(uint64(s.rev))
+	s.watchers.resetHistory(s.rev)
+
+	// keep the keyspaces that still exist, with their watchers
+	spaces := make(map[string]*keyspace, len(st.Keyspaces))
+	for _, kss := range st.Keyspaces {
+		ks, ok := s.keyspaces[kss.Name]
+		if !ok {
+			ks = openKeyspace(kss.Name)
+		}
+		ks.setKVs(joinBinary(kss.KVs, kss.Binary))
+		ks.revs = joinRevs(kss.Revs, kss.BinaryRevs)
+		ks.restoreRetention(kss.Retain, kss.Tombstones)
+		if err := ks.restoreSchemas(kss.Schemas); err != nil {
+			return err
+		}
+		ks.restoreTransforms(kss.Transforms)
+		ks.rev, ks.compactRev, ks.sinkRev, ks.quota, ks.time = kss.Rev, kss.CompactRev, kss.SinkRev, kss.Quota, kss.Time
+		ks.revWait.Trigger(uint64(ks.rev))
+		ks.watchers.resetHistory(ks.rev)
+		spaces[kss.Name] = ks
+	}
+	for name, ks := range s.keyspaces {
+		if _, ok := spaces[name]; !ok {
+			ks.watchers.closeAll()
+			ks.watchers.dropHistory()
+		}
+	}
+	s.keyspaces = spaces
 	return nil
 }
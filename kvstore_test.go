@@ -15,13 +15,37 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"metcd/api"
+	"metcd/codec"
+	"metcd/encryption"
+	"metcd/raftnode"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
+// newTestKVStore returns a store applying proposals without raft.
+func newTestKVStore(kvs map[string]string) *kvstore {
+	keyring, _ := encryption.NewKeyring(nil)
+	return &kvstore{
+		keyring:    keyring,
+		keyspace:   newKeyspace(kvs),
+		keyspaces:  make(map[string]*keyspace),
+		alarms:     make(map[api.Alarm]struct{}),
+		observers:  make(map[uint64]struct{}),
+		webhooks:   make(map[string]api.Webhook),
+		redactions: make(map[api.Redaction]struct{}),
+	}
+}
+
 func Test_kvstore_snapshot(t *testing.T) {
-	tm := map[string]string{"foo": "bar"}
-	s := &kvstore{kvStore: tm}
+	// JSON strings cannot carry the binary key and value
+	tm := map[string]string{"foo": "bar", "bin": "\x00\xff\xfe", "\xffkey": "v"}
+	s := newTestKVStore(tm)
 
 	v, _ := s.Lookup("foo")
 	if v != "bar" {
@@ -45,3 +69,456 @@ func Test_kvstore_snapshot(t *testing.T) {
 		t.Fatalf("store expected %+v, got %+v", tm, s.kvStore)
 	}
 }
+
+func Test_kvstore_applyTxn(t *testing.T) {
+	s := newTestKVStore(map[string]string{"/foo": "bar"})
+	events, cancel := s.watchers.watch("/", true)
+	defer cancel()
+
+	res := s.apply(kv{Op: opTxn, Txn: &api.TxnRequest{
+		Compare: []api.Compare{{Target: api.CompareValue, Result: api.CompareEqual, Key: "/foo", Value: "bar"}},
+		Success: []api.Op{{Type: api.OpPut, Key: "/foo", Value: "baz"}, {Type: api.OpGet, Key: "/foo"}},
+		Failure: []api.Op{{Type: api.OpDelete, Key: "/foo"}},
+	}})
+	want := &api.TxnResponse{Succeeded: true, Responses: []api.OpResponse{
+		{Type: api.OpPut, Key: "/foo"},
+		{Type: api.OpGet, Key: "/foo", Value: "baz", Found: true},
+	}}
+	if !reflect.DeepEqual(res.txn, want) {
+		t.Fatalf("txn expected %+v, got %+v", want, res.txn)
+	}
+	if ev := <-events; ev != (api.Event{Type: api.EventPut, Key: "/foo", Value: "baz", ModRevision: 1, Version: 1}) {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	res = s.apply(kv{Op: opTxn, Txn: &api.TxnRequest{
+		Compare: []api.Compare{{Target: api.CompareExists, Result: api.CompareEqual, Key: "/missing", Value: "true"}},
+		Failure: []api.Op{{Type: api.OpDelete, Key: "/foo"}},
+	}})
+	if res.txn.Succeeded || !res.txn.Responses[0].Found {
+		t.Fatalf("expected failed txn deleting /foo, got %+v", res.txn)
+	}
+	if _, ok := s.Lookup("/foo"); ok {
+		t.Fatalf("/foo should be deleted")
+	}
+	if ev := <-events; ev != (api.Event{Type: api.EventDelete, Key: "/foo", ModRevision: 2}) {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+}
+
+func Test_kvstore_compact(t *testing.T) {
+	s := newTestKVStore(map[string]string{})
+	s.apply(kv{Op: opPut, Key: "/a", Val: "1"})
+	s.apply(kv{Op: opPut, Key: "/b", Val: "2"})
+	s.apply(kv{Op: opDelete, Key: "/missing"})
+	if rev := s.Rev(); rev != 2 {
+		t.Fatalf("expected revision 2, got %d", rev)
+	}
+
+	if err := s.apply(kv{Op: opCompact, Rev: 3}).err; err != ErrFutureRev {
+		t.Fatalf("expected %v, got %v", ErrFutureRev, err)
+	}
+	if err := s.apply(kv{Op: opCompact, Rev: 1}).err; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.apply(kv{Op: opCompact, Rev: 1}).err; err != ErrCompacted {
+		t.Fatalf("expected %v, got %v", ErrCompacted, err)
+	}
+
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.rev != 2 || restored.compactRev != 1 {
+		t.Fatalf("expected rev 2 and compactRev 1, got %d and %d", restored.rev, restored.compactRev)
+	}
+}
+
+func Test_kvstore_alarm(t *testing.T) {
+	s := newTestKVStore(map[string]string{})
+	for _, req := range []api.AlarmRequest{
+		{Action: api.AlarmActivate, MemberID: 3, Alarm: api.AlarmUnreachable},
+		{Action: api.AlarmActivate, MemberID: 2, Alarm: api.AlarmUnreachable},
+		{Action: api.AlarmActivate, MemberID: 2, Alarm: api.AlarmUnreachable},
+	} {
+		if res := s.apply(kv{Op: opAlarm, Alarm: &req}); res.err != nil {
+			t.Fatal(res.err)
+		}
+	}
+	if res := s.apply(kv{Op: opAlarm, Alarm: &api.AlarmRequest{Action: api.AlarmActivate}}); res.err != ErrInvalidAlarm {
+		t.Fatalf("expected %v, got %v", ErrInvalidAlarm, res.err)
+	}
+	want := []api.Alarm{{MemberID: 2, Alarm: api.AlarmUnreachable}, {MemberID: 3, Alarm: api.AlarmUnreachable}}
+	if got := s.Alarms(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected alarms %v, got %v", want, got)
+	}
+	if s.Rev() != 0 {
+		t.Fatalf("alarms changed the revision to %d", s.Rev())
+	}
+
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apply(kv{Op: opAlarm, Alarm: &api.AlarmRequest{Action: api.AlarmDeactivate, MemberID: 2}})
+	if got := s.Alarms(); !reflect.DeepEqual(got, want[1:]) {
+		t.Fatalf("expected alarms %v, got %v", want[1:], got)
+	}
+	if err := s.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Alarms(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected recovered alarms %v, got %v", want, got)
+	}
+}
+
+func Test_kvstore_idempotency(t *testing.T) {
+	defer func(n int) { maxIdempotencyKeys = n }(maxIdempotencyKeys)
+	maxIdempotencyKeys = 2
+	s := newTestKVStore(map[string]string{"/foo": "bar"})
+
+	if res := s.apply(kv{Op: opDelete, Key: "/foo", IdempotencyKey: "a"}); !res.found {
+		t.Fatal("expected /foo to be deleted")
+	}
+	// the retry returns the first result and is not applied
+	s.apply(kv{Op: opPut, Key: "/foo", Val: "baz"})
+	if res := s.apply(kv{Op: opDelete, Key: "/foo", IdempotencyKey: "a"}); !res.found {
+		t.Fatal("expected the result of the first delete")
+	}
+	if v, ok := s.Lookup("/foo"); !ok || v != "baz" {
+		t.Fatalf("retried delete was applied, /foo = %q, %v", v, ok)
+	}
+	if s.Rev() != 2 {
+		t.Fatalf("expected revision 2, got %d", s.Rev())
+	}
+
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if res := restored.apply(kv{Op: opDelete, Key: "/foo", IdempotencyKey: "a"}); !res.found {
+		t.Fatal("idempotency key was lost in the snapshot")
+	}
+	if _, ok := restored.Lookup("/foo"); !ok {
+		t.Fatal("retried delete was applied after recovery")
+	}
+
+	// the oldest key is forgotten first
+	restored.apply(kv{Op: opPut, Key: "/b", IdempotencyKey: "b"})
+	restored.apply(kv{Op: opPut, Key: "/c", IdempotencyKey: "c"})
+	if res := restored.apply(kv{Op: opDelete, Key: "/foo", IdempotencyKey: "a"}); !res.found {
+		t.Fatal("expected /foo to be deleted")
+	}
+	if _, ok := restored.Lookup("/foo"); ok {
+		t.Fatal("forgotten key was not applied")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := restored.WaitRev(context.Background(), restored.Rev()); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.WaitRev(ctx, restored.Rev()+1); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func Test_kvstore_keyspace(t *testing.T) {
+	s := newTestKVStore(map[string]string{"/foo": "default"})
+	if err := s.apply(kv{Op: opKeyspacePut, Keyspace: "app", Quota: 10}).err; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.apply(kv{Op: opKeyspacePut, Keyspace: "bad/name"}).err; err != ErrInvalidKeyspace {
+		t.Fatalf("expected %v, got %v", ErrInvalidKeyspace, err)
+	}
+	events, cancel, err := s.WatchIn("app", "/", watchOptions{prefix: true, since: noSince})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	// keys and revisions are isolated from the default keyspace
+	s.apply(kv{Op: opPut, Keyspace: "app", Key: "/foo", Val: "app"})
+	if v, _, _ := s.LookupIn("app", "/foo"); v != "app" {
+		t.Fatalf("expected app, got %q", v)
+	}
+	if v, _ := s.Lookup("/foo"); v != "default" {
+		t.Fatalf("expected default, got %q", v)
+	}
+	if rev, _ := s.RevIn("app"); rev != 1 || s.Rev() != 0 {
+		t.Fatalf("expected revisions 1 and 0, got %d and %d", rev, s.Rev())
+	}
+	if ev := <-events; ev != (api.Event{Type: api.EventPut, Key: "/foo", Value: "app", CreateRevision: 1, ModRevision: 1, Version: 1}) {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if _, _, err := s.LookupIn("missing", "/foo"); err != ErrKeyspaceNotFound {
+		t.Fatalf("expected %v, got %v", ErrKeyspaceNotFound, err)
+	}
+
+	// the quota refuses growth but admits shrinking writes
+	if err := s.apply(kv{Op: opPut, Keyspace: "app", Key: "/bar", Val: "toolong"}).err; err != ErrQuotaExceeded {
+		t.Fatalf("expected %v, got %v", ErrQuotaExceeded, err)
+	}
+	res := s.apply(kv{Op: opTxn, Keyspace: "app", Txn: &api.TxnRequest{
+		Success: []api.Op{{Type: api.OpDelete, Key: "/foo"}, {Type: api.OpPut, Key: "/bar", Value: "x"}},
+	}})
+	if res.err != nil || !res.txn.Succeeded {
+		t.Fatalf("expected the txn to be admitted, got %+v, %v", res.txn, res.err)
+	}
+	want := []api.Keyspace{{Name: "", Size: 11, Keys: 1}, {Name: "app", Quota: 10, Size: 5, Keys: 1, Rev: 2}}
+	if got := s.Keyspaces(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected keyspaces %+v, got %+v", want, got)
+	}
+
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.Keyspaces(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected recovered keyspaces %+v, got %+v", want, got)
+	}
+
+	// deleting the keyspace ends its watches
+	if err := s.apply(kv{Op: opKeyspaceDelete, Keyspace: "app"}).err; err != nil {
+		t.Fatal(err)
+	}
+	for range events {
+	}
+	if err := s.apply(kv{Op: opPut, Keyspace: "app", Key: "/foo"}).err; err != ErrKeyspaceNotFound {
+		t.Fatalf("expected %v, got %v", ErrKeyspaceNotFound, err)
+	}
+}
+
+func Test_kvstore_applyCommit(t *testing.T) {
+	entry := func(index uint64, r kv) raftnode.Entry {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+			t.Fatal(err)
+		}
+		return raftnode.Entry{Index: index, Term: 1, Data: buf.Bytes()}
+	}
+	s := newTestKVStore(nil)
+	s.applyCommit(&raftnode.Commit{Entries: []raftnode.Entry{
+		entry(3, kv{Op: opPut, Key: "/a", Val: "1"}),
+		entry(4, kv{Op: opPut, Key: "/b", Val: "2"}),
+	}, Index: 5})
+
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	// entries up to index 5 are in the snapshot and are not applied again
+	restored.applyCommit(&raftnode.Commit{Entries: []raftnode.Entry{
+		entry(4, kv{Op: opPut, Key: "/b", Val: "2"}),
+		entry(6, kv{Op: opPut, Key: "/c", Val: "3"}),
+	}, Index: 6})
+	if restored.Rev() != 3 {
+		t.Fatalf("expected revision 3, got %d", restored.Rev())
+	}
+	if v, _ := restored.Lookup("/c"); v != "3" {
+		t.Fatalf("expected /c = 3, got %q", v)
+	}
+}
+
+func Test_kvstore_revisions(t *testing.T) {
+	s := newTestKVStore(map[string]string{"/old": "v"})
+	s.apply(kv{Op: opPut, Key: "/a", Val: "1"})
+	res := s.apply(kv{Op: opPut, Key: "/a", Val: "2"})
+	if want := (&api.KeyValue{Key: "/a", Value: "1", CreateRevision: 1, ModRevision: 1, Version: 1}); res.rev != 2 || !reflect.DeepEqual(res.prev, want) {
+		t.Fatalf("expected the put at 2 to replace %+v, got %+v at %d", want, res.prev, res.rev)
+	}
+	s.apply(kv{Op: opTxn, Txn: &api.TxnRequest{Success: []api.Op{
+		{Type: api.OpPut, Key: "/b", Value: "1"},
+		{Type: api.OpPut, Key: "/old", Value: "w"},
+	}}})
+	// a key deleted and put again starts over
+	s.apply(kv{Op: opDelete, Key: "/b"})
+	s.apply(kv{Op: opPut, Key: "/b", Val: "2"})
+	// JSON strings cannot carry the key in the snapshot
+	s.apply(kv{Op: opPut, Key: "\xff", Val: "x"})
+
+	// the revision a key restored without revisions was created at is unknown
+	want := map[string]*api.KeyValue{
+		"/a":   {Key: "/a", Value: "2", CreateRevision: 1, ModRevision: 2, Version: 2},
+		"/b":   {Key: "/b", Value: "2", CreateRevision: 5, ModRevision: 5, Version: 1},
+		"/old": {Key: "/old", Value: "w", ModRevision: 3, Version: 1},
+		"\xff": {Key: "\xff", Value: "x", CreateRevision: 6, ModRevision: 6, Version: 1},
+	}
+
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []*kvstore{s, restored} {
+		for k, kv := range want {
+			if got, rev, _ := st.GetIn("", k); rev != 6 || !reflect.DeepEqual(got, kv) {
+				t.Fatalf("expected %+v at 6, got %+v at %d", kv, got, rev)
+			}
+		}
+	}
+	if res := s.apply(kv{Op: opDelete, Key: "/missing"}); res.prev != nil || res.rev != 6 {
+		t.Fatalf("expected no pair deleted at 6, got %+v at %d", res.prev, res.rev)
+	}
+
+	// transactions compare the metadata, a missing key has none
+	for _, tt := range []struct {
+		c    api.Compare
+		want bool
+	}{
+		{api.Compare{Target: api.CompareMod, Result: api.CompareEqual, Key: "/a", Value: "2"}, true},
+		{api.Compare{Target: api.CompareMod, Result: api.CompareEqual, Key: "/a", Value: "1"}, false},
+		{api.Compare{Target: api.CompareCreate, Result: api.CompareLess, Key: "/b", Value: "6"}, true},
+		{api.Compare{Target: api.CompareVersion, Result: api.CompareGreater, Key: "/a", Value: "1"}, true},
+		{api.Compare{Target: api.CompareVersion, Result: api.CompareEqual, Key: "/missing", Value: "0"}, true},
+		{api.Compare{Target: api.CompareVersion, Result: api.CompareEqual, Key: "/a", Value: "x"}, false},
+	} {
+		res := s.apply(kv{Op: opTxn, Txn: &api.TxnRequest{Compare: []api.Compare{tt.c}}})
+		if res.txn.Succeeded != tt.want {
+			t.Fatalf("expected %+v to be %v", tt.c, tt.want)
+		}
+	}
+}
+
+func Test_kvstore_encryption(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, 32)
+	s := newTestKVStore(map[string]string{"/t/old": "plain"})
+	s.keyring, _ = encryption.NewKeyring(master)
+	apply := func(r kv) *applyResult {
+		if err := s.sealProposal(&r); err != nil {
+			t.Fatal(err)
+		}
+		return s.apply(r)
+	}
+	wrapped, err := s.keyring.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := apply(kv{Op: opDataKeyPut, Key: "/t/", Wrapped: wrapped}); res.err != nil || res.version != 1 {
+		t.Fatalf("expected version 1, got %d, %v", res.version, res.err)
+	}
+	apply(kv{Op: opPut, Key: "/t/a", Val: "secret"})
+	apply(kv{Op: opPut, Key: "/other", Val: "v"})
+	if v := s.kvStore["/t/a"]; !encryption.IsSealed(v) {
+		t.Fatalf("expected /t/a to be stored encrypted, got %q", v)
+	}
+	if v, ok := s.Lookup("/t/a"); !ok || v != "secret" {
+		t.Fatalf("expected secret, got %q", v)
+	}
+	// comparisons are against the decrypted values
+	res := apply(kv{Op: opTxn, Txn: &api.TxnRequest{
+		Compare: []api.Compare{{Key: "/t/a", Target: api.CompareValue, Result: api.CompareEqual, Value: "secret"}},
+		Success: []api.Op{{Type: api.OpPut, Key: "/t/b", Value: "b"}, {Type: api.OpGet, Key: "/t/a"}},
+	}})
+	if res.err != nil || !res.txn.Succeeded {
+		t.Fatalf("expected the comparison to hold, got %+v, %v", res.txn, res.err)
+	}
+	if txn, _ := s.openTxn(res.txn); txn.Responses[1].Value != "secret" {
+		t.Fatalf("expected the get to read secret, got %q", txn.Responses[1].Value)
+	}
+
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatal("expected the snapshot to hold no plaintext")
+	}
+	restored := newTestKVStore(nil)
+	restored.keyring, _ = encryption.NewKeyring(master)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := restored.Lookup("/t/b"); v != "b" {
+		t.Fatalf("expected b after restoring, got %q", v)
+	}
+	if err := newTestKVStore(nil).recoverFromSnapshot(data); err == nil {
+		t.Fatal("expected restoring the data keys without the master key to fail")
+	}
+
+	// destroying the key deletes the values it encrypted, in one revision
+	rev := s.Rev()
+	if res := apply(kv{Op: opDataKeyDestroy, Key: "/t/"}); res.err != nil || !res.found || res.rev != rev+1 {
+		t.Fatalf("expected the values to be deleted at %d, got %+v", rev+1, res)
+	}
+	want := map[string]string{"/t/old": "plain", "/other": "v"}
+	if !reflect.DeepEqual(s.kvStore, want) {
+		t.Fatalf("expected %v, got %v", want, s.kvStore)
+	}
+	if res := apply(kv{Op: opDataKeyDestroy, Key: "/t/"}); res.err != ErrDataKeyNotFound {
+		t.Fatalf("expected ErrDataKeyNotFound, got %v", res.err)
+	}
+	apply(kv{Op: opPut, Key: "/t/a", Val: "again"})
+	if v := s.kvStore["/t/a"]; v != "again" {
+		t.Fatalf("expected /t/a to be stored plain once the key is destroyed, got %q", v)
+	}
+}
+
+func Test_kvstore_compression(t *testing.T) {
+	valueCodec, _ = codec.Get(codec.Gzip)
+	snapshotCodec = valueCodec
+	defer func() { valueCodec, snapshotCodec = nil, nil }()
+	s := newTestKVStore(nil)
+	apply := func(r kv) *applyResult {
+		if err := s.sealProposal(&r); err != nil {
+			t.Fatal(err)
+		}
+		return s.apply(r)
+	}
+	large := strings.Repeat("x", valueCodecMinSize)
+	framed := "\x00metcd-z\x00 not compressed"
+	apply(kv{Op: opPut, Key: "/large", Val: large})
+	apply(kv{Op: opPut, Key: "/small", Val: "v"})
+	apply(kv{Op: opPut, Key: "/framed", Val: framed})
+	if v := s.kvStore["/large"]; !codec.IsEncoded([]byte(v)) || len(v) >= len(large) {
+		t.Fatalf("expected /large to be stored compressed, got %d bytes", len(v))
+	}
+	if v := s.kvStore["/small"]; v != "v" {
+		t.Fatalf("expected /small to be stored as is, got %q", v)
+	}
+	for k, want := range map[string]string{"/large": large, "/small": "v", "/framed": framed} {
+		if v, ok := s.Lookup(k); !ok || v != want {
+			t.Fatalf("expected %s to read back as written, got %q", k, v)
+		}
+	}
+	res := apply(kv{Op: opTxn, Txn: &api.TxnRequest{
+		Compare: []api.Compare{{Key: "/large", Target: api.CompareValue, Result: api.CompareEqual, Value: large}},
+	}})
+	if res.err != nil || !res.txn.Succeeded {
+		t.Fatalf("expected the comparison to hold, got %+v, %v", res.txn, res.err)
+	}
+
+	data, err := s.storedSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := codec.CodecOf(data); name != codec.Gzip {
+		t.Fatalf("expected a gzip snapshot, got %q", name)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := restored.Lookup("/large"); v != large {
+		t.Fatal("expected /large after restoring")
+	}
+}
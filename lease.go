@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// stalenessHeader carries the staleness bound of a ?leaseRead=true read.
+const stalenessHeader = "X-Metcd-Staleness"
+
+// defaultMaxStaleness bounds the staleness of ?leaseRead=true reads without
+// ?maxStaleness=.
+var defaultMaxStaleness = 100 * time.Millisecond
+
+var errInvalidStaleness = errors.New("metcd: invalid maxStaleness")
+
+// readBarrier waits until the GET r may be served from the local store:
+// right away with ?serializable=true, which may be arbitrarily stale; with
+// ?leaseRead=true once the member has every change committed more than
+// ?maxStaleness= ago, which a read index obtained within that time already
+// guarantees; and after a linearizable read otherwise. A lease read answers
+// its actual staleness bound in X-Metcd-Staleness.
+func (h *httpKVAPI) readBarrier(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if serializable, _ := strconv.ParseBool(q.Get("serializable")); serializable {
+		return nil
+	}
+	setPhase(r.Context(), phaseReadIndex)
+	if lease, _ := strconv.ParseBool(q.Get("leaseRead")); !lease {
+		return h.rc.LinearizableReadNotify(r.Context())
+	}
+	max := defaultMaxStaleness
+	if s := q.Get("maxStaleness"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return errInvalidStaleness
+		}
+		max = d
+	}
+	staleness, err := h.rc.LeaseReadNotify(r.Context(), max)
+	if err != nil {
+		return err
+	}
+	w.Header().Set(stalenessHeader, staleness.String())
+	return nil
+}
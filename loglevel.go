@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"metcd/api"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logLevels holds the levels of the structured loggers, which can be
+// changed at runtime through /admin/loglevel or SIGUSR1.
+type logLevels struct {
+	app  zap.AtomicLevel // metcd and the etcd libraries
+	raft zap.AtomicLevel // the raft library
+
+	mu sync.Mutex
+	// levels restored when a temporary change expires or debug is toggled off
+	base, raftBase zapcore.Level
+	revert         *time.Timer
+}
+
+// newLoggers returns the loggers of this member and of its raft library,
+// both starting at level.
+func newLoggers(level string) (lg, raftLg *zap.Logger, levels *logLevels, err error) {
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid --log-level %q", level)
+	}
+	levels = &logLevels{app: zap.NewAtomicLevelAt(l), raft: zap.NewAtomicLevelAt(l), base: l, raftBase: l}
+	if lg, err = newLogger(levels.app); err != nil {
+		return nil, nil, nil, err
+	}
+	if raftLg, err = newLogger(levels.raft); err != nil {
+		return nil, nil, nil, err
+	}
+	return lg, raftLg.Named("raft"), levels, nil
+}
+
+func newLogger(level zap.AtomicLevel) (*zap.Logger, error) {
+	cfg := zap.NewProductionConfig()
+	cfg.Level = level
+	cfg.Sampling = nil
+	return cfg.Build()
+}
+
+// set changes the levels. With d > 0 the previous levels are restored after
+// d, otherwise the change is permanent.
+func (l *logLevels) set(app, raft zapcore.Level, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setLocked(app, raft, d <= 0)
+	if d > 0 {
+		l.revert = time.AfterFunc(d, l.restore)
+	}
+}
+
+// toggleDebug switches both loggers to debug until it is called again.
+func (l *logLevels) toggleDebug() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.app.Level() == zapcore.DebugLevel && l.raft.Level() == zapcore.DebugLevel {
+		l.setLocked(l.base, l.raftBase, true)
+		log.Printf("log level restored to %s (raft %s)", l.base, l.raftBase)
+		return
+	}
+	l.setLocked(zapcore.DebugLevel, zapcore.DebugLevel, false)
+	log.Printf("log level raised to debug")
+}
+
+func (l *logLevels) restore() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setLocked(l.base, l.raftBase, true)
+	log.Printf("log level restored to %s (raft %s)", l.base, l.raftBase)
+}
+
+func (l *logLevels) setLocked(app, raft zapcore.Level, permanent bool) {
+	if l.revert != nil {
+		l.revert.Stop()
+		l.revert = nil
+	}
+	l.app.SetLevel(app)
+	l.raft.SetLevel(raft)
+	if permanent {
+		l.base, l.raftBase = app, raft
+	}
+}
+
+func (l *logLevels) get() api.LogLevel {
+	return api.LogLevel{Level: l.app.Level().String(), Raft: l.raft.Level().String()}
+}
+
+// serveLogLevel handles GET and PUT /admin/loglevel.
+func (h *httpKVAPI) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, h.logs.get())
+	case http.MethodPut:
+		var req api.LogLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to decode log level", http.StatusBadRequest)
+			return
+		}
+		cur := h.logs.get()
+		if req.Level == "" {
+			req.Level = cur.Level
+		}
+		if req.Raft == "" {
+			req.Raft = req.Level
+		}
+		var app, raft zapcore.Level
+		if err := app.UnmarshalText([]byte(req.Level)); err != nil {
+			http.Error(w, "Invalid log level", http.StatusBadRequest)
+			return
+		}
+		if err := raft.UnmarshalText([]byte(req.Raft)); err != nil {
+			http.Error(w, "Invalid raft log level", http.StatusBadRequest)
+			return
+		}
+		var d time.Duration
+		if req.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+				http.Error(w, "Invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+		h.logs.set(app, raft, d)
+		log.Printf("log level set to %s (raft %s) by %s", app, raft, r.RemoteAddr)
+		writeJSON(w, h.logs.get())
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPut)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
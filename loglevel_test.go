@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLogLevels(t *testing.T) {
+	_, _, logs, err := newLoggers("info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &httpKVAPI{logs: logs}
+	put := func(body string) int {
+		rec := httptest.NewRecorder()
+		h.serveLogLevel(rec, httptest.NewRequest(http.MethodPut, "/admin/loglevel", strings.NewReader(body)))
+		return rec.Code
+	}
+
+	if code := put(`{"level":"warn"}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if got := logs.get(); got.Level != "warn" || got.Raft != "warn" {
+		t.Fatalf("expected warn for both loggers, got %+v", got)
+	}
+	// raise only raft temporarily
+	if code := put(`{"raft":"debug","duration":"50ms"}`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if got := logs.get(); got.Level != "warn" || got.Raft != "debug" {
+		t.Fatalf("expected raft at debug, got %+v", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for logs.raft.Level() != zapcore.WarnLevel {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the raft level to be restored, got %v", logs.raft.Level())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	logs.toggleDebug()
+	if got := logs.get(); got.Level != "debug" || got.Raft != "debug" {
+		t.Fatalf("expected debug after toggling, got %+v", got)
+	}
+	logs.toggleDebug()
+	if got := logs.get(); got.Level != "warn" || got.Raft != "warn" {
+		t.Fatalf("expected warn after toggling back, got %+v", got)
+	}
+
+	if code := put(`{"level":"loud"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid level, got %d", code)
+	}
+}
@@ -0,0 +1,4 @@
+package main
+
+// watchLogSignal does nothing, there is no SIGUSR1 on windows.
+func (l *logLevels) watchLogSignal() {}
@@ -15,34 +15,631 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"log"
+	"metcd/api"
+	"metcd/client"
+	"metcd/codec"
+	"metcd/compactor"
+	"metcd/controller"
+	"metcd/discovery"
+	"metcd/dns"
+	"metcd/encryption"
+	"metcd/idgen"
+	"metcd/objstore"
 	"metcd/raftnode"
+	"metcd/resp"
+	"metcd/sink"
+	"metcd/tracing"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/wal"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate-datadir" {
+		if err := migrateDataDir(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt-datadir" {
+		if err := reencryptDataDir(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap" {
+		if err := bootstrap(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-from-etcd" {
+		if err := migrateFromEtcd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	cluster := flag.String("cluster", "http://127.0.0.1:9021", "comma separated cluster peers")
 	id := flag.Int("id", 1, "node ID")
 	kvport := flag.Int("port", 9121, "key-value server port")
-	join := flag.Bool("join", false, "join an existing cluster")
+	httpTuning := defaultHTTPServerConfig
+	flag.DurationVar(&httpTuning.ReadHeaderTimeout, "http-read-header-timeout", httpTuning.ReadHeaderTimeout, "longest time the client API and debug servers wait for the headers of a request, 0 waits forever")
+	flag.DurationVar(&httpTuning.ReadTimeout, "http-read-timeout", httpTuning.ReadTimeout, "longest time they read a whole request, body included; 0 does not bound long imports")
+	flag.DurationVar(&httpTuning.WriteTimeout, "http-write-timeout", httpTuning.WriteTimeout, "longest time they write a response; 0 does not bound streamed watches, which a timeout ends")
+	flag.DurationVar(&httpTuning.IdleTimeout, "http-idle-timeout", httpTuning.IdleTimeout, "close keep-alive connections without requests for this long, 0 uses --http-read-timeout")
+	flag.DurationVar(&httpTuning.KeepAlive, "http-tcp-keepalive", httpTuning.KeepAlive, "period of the TCP keep-alive probes of client connections, negative disables them")
+	flag.IntVar(&httpTuning.MaxHeaderBytes, "http-max-header-bytes", httpTuning.MaxHeaderBytes, "largest size in bytes of the headers of a request")
+	flag.IntVar(&httpTuning.MaxConnections, "http-max-connections", httpTuning.MaxConnections, "number of client connections served at once, more wait to be accepted; 0 does not limit them")
+	flag.StringVar(&httpTuning.CertFile, "cert-file", "", "certificate the client API and debug endpoints are served over HTTPS with, negotiating HTTP/2")
+	flag.StringVar(&httpTuning.KeyFile, "key-file", "", "private key of --cert-file")
+	flag.BoolVar(&httpTuning.DisableHTTP2, "http-disable-http2", false, "serve HTTPS as HTTP/1.1 only")
+	respPort := flag.Int("resp-port", 0, "port serving the Redis protocol (GET, SET, DEL, INCR, EXPIRE, SCAN, ...), 0 disables it")
+	grpcPort := flag.Int("grpc-port", 0, "port serving the grpc.health.v1 Health service and server reflection, 0 disables it")
+	join := flag.Bool("join", false, "join an existing cluster, same as --initial-cluster-state=existing")
+	forceNewCluster := flag.Bool("force-new-cluster", false, "start from the data directory of this member as the only member of the cluster, discarding its uncommitted entries and removing the others; recovers a cluster that lost its quorum")
+	clusterState := flag.String("initial-cluster-state", "new", "'new' to bootstrap a cluster, 'existing' to join one")
+	clusterToken := flag.String("initial-cluster-token", "", "token distinguishing this cluster from others during bootstrap")
+	joinEndpoint := flag.String("join-endpoint", "", "client URL of an existing member; adds this member as a learner and promotes it once caught up")
+	observer := flag.Bool("observer", false, "join with --join-endpoint as an observer, a learner serving serializable reads and watches that is never promoted")
+	compactionMode := flag.String("auto-compaction-mode", compactor.ModePeriodic, "interpret auto-compaction-retention as 'periodic' (duration) or 'revision' (count)")
+	compactionRetention := flag.String("auto-compaction-retention", "0", "history retention for auto compaction, 0 disables it")
+	compactionBatchLimit := flag.Int64("compaction-batch-limit", compactor.DefaultPacing.BatchLimit, "maximum number of revisions compacted by one proposal, 0 is unlimited")
+	compactionSleepInterval := flag.Duration("compaction-sleep-interval", compactor.DefaultPacing.BatchInterval, "pause between two compaction batches")
+	discoverySRV := flag.String("discovery-srv", "", "domain whose DNS SRV records list the cluster peers, instead of --cluster")
+	discoverySRVName := flag.String("discovery-srv-name", "", "suffix of the SRV service name queried with --discovery-srv")
+	deadMemberTimeout := flag.Duration("dead-member-timeout", 0, "raise an UNREACHABLE alarm for members the leader cannot reach for this long, 0 disables it")
+	deadMemberRemoval := flag.Bool("dead-member-removal", false, "also remove members unreachable for --dead-member-timeout")
+	onRemoval := flag.String("on-removal", onRemovalExit, "what this member does once removed from the cluster: '"+onRemovalExit+"' once the responses in flight are sent, or '"+onRemovalFence+"' its client API, answering 'member removed', until it is stopped")
+	removedStaleReads := flag.Bool("removed-stale-reads", false, "with --on-removal=fence, keep serving the reads from the local store, with a Warning header")
+	removedArchive := flag.Bool("removed-archive", false, "once removed from the cluster, move the WAL and snapshots of this member aside into <data-dir>/metcd-<id>.removed-<time>")
+	learnerAutoPromote := flag.Bool("learner-auto-promote", false, "promote learners that caught up with the leader")
+	learnerPromoteThreshold := flag.Uint64("learner-promote-threshold", 100, "maximum number of entries a learner may lag behind the leader to be promoted")
+	learnerPromoteAfter := flag.Duration("learner-promote-after", 30*time.Second, "how long a learner must stay within --learner-promote-threshold before it is promoted")
+	resizeGuardMode := flag.String("resize-guard", resizeGuardWarn, "membership changes leaving an even number of voters or less than --min-fault-tolerance: 'off', 'warn' or 'refuse' unless forced")
+	minFaultTolerance := flag.Int("min-fault-tolerance", 0, "minimum number of voter failures the cluster should tolerate")
+	walSync := flag.String("wal-sync", string(raftnode.WALSyncAlways), "when to fsync the WAL: 'always', 'interval' (group fsyncs, at most --wal-sync-interval apart) or 'none'")
+	walSyncInterval := flag.Duration("wal-sync-interval", raftnode.DefaultWALSyncInterval, "longest time between two fsyncs with --wal-sync=interval")
+	admissionLatency := flag.Duration("admission-latency", 0, "reject large proposals while the average WAL append takes longer than this, 0 disables it")
+	admissionPercentile := flag.Float64("admission-percentile", raftnode.DefaultAdmissionPercentile, "proposals larger than this percentile of the recent sizes are rejected while WAL appends are slow")
+	admissionMinSize := flag.Int("admission-min-size", 64*1024, "proposals up to this many bytes are always admitted")
+	applyThrottleLag := flag.Uint64("apply-throttle-lag", 1000, "delay client writes while this many committed entries are not applied yet, 0 never delays them")
+	applyRejectLag := flag.Uint64("apply-reject-lag", 5000, "reject client writes while this many committed entries are not applied yet, 0 never rejects them")
+	applyThrottleDelay := flag.Duration("apply-throttle-max-delay", raftnode.DefaultApplyThrottleDelay, "longest delay of a client write, as the apply lag nears --apply-reject-lag")
+	clockSkewBound := flag.Duration("clock-skew-bound", time.Second, "clock skew between members past which bounded staleness reads no longer use the lease of a recent read, 0 never stops using it")
+	snapshotTransferRate := flag.Int64("snapshot-transfer-rate", 0, "bytes per second the snapshot sent to each follower is limited to, 0 does not limit them")
+	walSegmentSize := flag.Int64("wal-segment-size", 64*1000*1000, "size in bytes of a WAL segment file, the next segment is preallocated in the background")
+	maxSnapshots := flag.Int("max-snapshots", 5, "number of snapshot files kept by the purger, 0 keeps them all")
+	maxWALs := flag.Int("max-wals", 5, "number of WAL segment files kept by the purger, the ones the WAL still needs are always kept; 0 keeps them all")
+	purgeMaxAge := flag.Duration("purge-max-age", 0, "age past which the purger removes snapshot and WAL segment files, the newest snapshot and the segments the WAL still needs are always kept; 0 keeps them")
+	purgeInterval := flag.Duration("purge-interval", raftnode.DefaultPurgeInterval, "interval between two runs of the purger")
+	diskMinFree := flag.Uint64("disk-min-free", 256*1024*1024, "bytes that must stay free on the file system of --data-dir, below it a NOSPACE alarm makes the cluster refuse writes; 0 disables the check")
+	logLevel := flag.String("log-level", "info", "level of the structured logs: debug, info, warn or error; changed at runtime with PUT /admin/loglevel or SIGUSR1")
+	dataDir := flag.String("data-dir", "", "directory holding the WAL and snapshot directories, the working directory by default")
+	auditLogDest := flag.String("audit-log", "", "file, syslog+udp://host:port, syslog+tcp://host:port or http(s) URL the mutating client operations are recorded to as JSON lines; empty disables the audit log")
+	auditLogMaxSize := flag.Int64("audit-log-max-size", 100*1000*1000, "size in bytes past which the --audit-log file is rotated, 0 never rotates it")
+	auditLogMaxBackups := flag.Int("audit-log-max-backups", 10, "number of rotated --audit-log files kept")
+	recordTraffic := flag.String("record-traffic", "", "file to record the served key-value operations to, anonymized, for metcdctl bench replay")
+	revisionFormat := flag.String("revision-format", idgen.FormatMonotonic, "how revisions are generated: 'monotonic' (1, 2, 3, ...) or 'snowflake' (proposal time, sequence and member ID); must be the same on every member")
+	kubernetes := flag.Bool("kubernetes", false, "derive --id, --cluster and --peer-url from the StatefulSet pod this runs in (POD_NAME or the hostname); pods past --kubernetes-replicas join as learners")
+	k8s := kubernetesConfig{dnsTimeout: 5 * time.Minute}
+	flag.IntVar(&k8s.replicas, "kubernetes-replicas", 3, "number of pods of the StatefulSet forming the initial cluster")
+	flag.StringVar(&k8s.set.Service, "kubernetes-service", "", "headless service of the StatefulSet, the name of the set by default")
+	flag.StringVar(&k8s.set.Namespace, "kubernetes-namespace", "", "namespace of the StatefulSet, POD_NAMESPACE or the namespace of the service account by default")
+	flag.StringVar(&k8s.set.ClusterDomain, "kubernetes-cluster-domain", "cluster.local", "DNS domain of the Kubernetes cluster")
+	flag.IntVar(&k8s.set.PeerPort, "kubernetes-peer-port", 2380, "peer port of the pods")
+	flag.DurationVar(&k8s.dnsTimeout, "kubernetes-dns-timeout", k8s.dnsTimeout, "how long to wait for the headless service to publish the name of the pod")
+	peerURL := flag.String("peer-url", "", "this member's peer URL, used to derive --id from the discovered peers or to --join-endpoint")
+	encryptionKeyFile := flag.String("encryption-key-file", "", "file holding the 32 byte master key, raw or hex, wrapping the data keys of encrypted prefixes; must be the same on every member")
+	encryptionAtRest := flag.String("encryption-at-rest", "", "KMS wrapping the keys encrypting the WAL and snapshots of this member, as <scheme>:<target>: "+strings.Join(encryption.KMSSchemes(), ", ")+"; empty stores them in plaintext")
+	valueCompression := flag.String("value-compression", "", "codec compressing values of at least --value-compression-min-size bytes before they are proposed: "+strings.Join(codec.Names(), ", ")+"; empty disables it")
+	valueCompressionMinSize := flag.Int("value-compression-min-size", valueCodecMinSize, "values smaller than this many bytes are not compressed")
+	snapshotCompression := flag.String("snapshot-compression", codec.Identity, "codec compressing the raft snapshots stored and sent to followers: "+strings.Join(codec.Names(), ", "))
+	historyMem := flag.Int("watch-history-size", watchHistorySize, "number of recent events per keyspace kept in memory for watches resuming with ?since=<rev>")
+	historyPath := flag.String("watch-history-dir", "", "directory the watch events are also logged to, so watches resume across restarts; empty keeps them in memory only")
+	historyDisk := flag.Int("watch-history-disk-size", watchHistoryDiskSize, "number of events per keyspace kept in --watch-history-dir")
+	initialData := flag.String("initial-data", "", "NDJSON file of keys and values the first leader of a new cluster puts once, as GET /snapshot?format=json exports them")
+	otlpEndpoint := flag.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "base URL of the OTLP/HTTP receiver the trace spans are exported to, e.g. http://127.0.0.1:4318; empty disables tracing")
+	otlpHeaders := flag.String("otlp-headers", os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), "comma separated key=value headers sent with the span exports")
+	traceSampleRatio := flag.Float64("trace-sample-ratio", 1, "fraction of the requests without a sampled traceparent that are traced")
+	memoryLimit := flag.Int64("memory-limit", 0, "soft memory limit of the Go runtime in bytes; 0 uses --memory-limit-ratio of the cgroup memory limit unless GOMEMLIMIT is set, -1 leaves it alone")
+	memoryLimitRatio := flag.Float64("memory-limit-ratio", 0.9, "fraction of the cgroup memory limit used as soft memory limit")
+	gogc := flag.Int("gogc", 0, "GC target percentage; 0 keeps GOGC, -1 only collects near the memory limit")
+	gomaxprocs := flag.Int("gomaxprocs", 0, "number of OS threads running Go code at once; 0 uses the CPU quota of the cgroup unless GOMAXPROCS is set")
+	debugAddr := flag.String("debug-listen-addr", "", "address serving /debug/pprof, /debug/vars, /debug/goroutines and /debug/storage, e.g. 127.0.0.1:6060; empty disables them")
+	debugTokenFile := flag.String("debug-token-file", "", "file holding the bearer token the requests to --debug-listen-addr must carry")
+	slowRequest := flag.Duration("slow-request-threshold", slowRequestThreshold, "log the requests taking longer than this with the time they spent in each phase, 0 disables it")
+	sinkURI := flag.String("sink", "", "datastore the leader also writes the applied changes to, as <scheme>:<target> with the schemes "+strings.Join(sink.Schemes(), ", ")+"; empty disables it")
+	sinkCheckpoint := flag.Duration("sink-checkpoint-interval", sinkCheckpointInterval, "how often the revision written to --sink is replicated, a new leader writes again the changes since")
+	snapshotBackupURI := flag.String("snapshot-backup", "", "object store the leader backs up snapshots to, as <scheme>:<target> with the schemes "+strings.Join(objstore.Schemes(), ", ")+"; empty disables it")
+	snapshotBackupInterval := flag.Duration("snapshot-backup-interval", time.Hour, "how often the leader backs up a snapshot to --snapshot-backup")
+	snapshotBackupRetention := flag.Int("snapshot-backup-retention", 24, "number of snapshots kept in --snapshot-backup, the oldest are removed")
+	snapshotRestore := flag.String("snapshot-restore", "", "backup of --snapshot-backup a new member with an empty data directory starts from, \"latest\" or the name of one")
+	walShipping := flag.Bool("wal-shipping", false, "the leader also ships its closed WAL segments to --snapshot-backup, for point-in-time restores")
+	walShipInterval := flag.Duration("wal-ship-interval", 10*time.Second, "how often the leader ships the WAL segments it closed to --snapshot-backup")
+	restoreTo := flag.String("restore-to", "", "replay the WAL shipped after the --snapshot-restore backup up to \"latest\", a raft index or an RFC 3339 time; empty restores the backup alone")
+	maxViews := flag.Int("max-snapshot-views", maxSnapshotViews, "number of read-only snapshot views POST /views may keep on the member at once, each a copy of a keyspace")
+	viewTTL := flag.Duration("snapshot-view-ttl", snapshotViewTTL, "how long a snapshot view is kept after it was last read")
+	raftGroups := flag.String("raft-groups", "", "comma separated names of raft groups run besides the default one, each with its own log and keys, served below /groups/<name>; must be the same on every member")
+	dnsPort := flag.Int("dns-port", 0, "port answering DNS queries over UDP and TCP for the services registered under --dns-prefix, 0 disables it")
+	dnsDomain := flag.String("dns-domain", "metcd.", "domain of the names answered on --dns-port, as <service>.service.<domain>")
+	dnsPrefix := flag.String("dns-prefix", "/services/", "prefix of the keys <prefix><service>/<host>:<port> registering the instances of services")
+	dnsTTL := flag.Duration("dns-ttl", 0, "TTL of the DNS records answered on --dns-port")
+	flag.String(configFileFlag, "", "JSON file of options keyed by flag name; command line flags and METCD_* environment variables take precedence")
 	flag.Parse()
+	if err := applyConfig(flag.CommandLine, os.Environ()); err != nil {
+		log.Fatal(err)
+	}
+
+	limit, err := tuneRuntime(runtimeTuning{MemoryLimit: *memoryLimit, Ratio: *memoryLimitRatio, GOGC: *gogc, GOMAXPROCS: *gomaxprocs})
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopMemory := make(chan struct{})
+	defer close(stopMemory)
+	go watchMemory(limit, stopMemory)
+
+	guard, err := newResizeGuard(*resizeGuardMode, *minFaultTolerance)
+	if err != nil {
+		log.Fatal(err)
+	}
+	walSyncMode, err := raftnode.ParseWALSyncMode(*walSync)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *onRemoval != onRemovalExit && *onRemoval != onRemovalFence {
+		log.Fatalf("invalid --on-removal %q (%s|%s)", *onRemoval, onRemovalExit, onRemovalFence)
+	}
+
+	if revisions, err = idgen.New(*revisionFormat); err != nil {
+		log.Fatal(err)
+	}
+	if *revisionFormat == idgen.FormatSnowflake && *compactionMode == compactor.ModeRevision {
+		log.Fatal("--auto-compaction-mode revision counts revisions, it does not work with --revision-format snowflake")
+	}
+
+	lg, raftLg, logs, err := newLoggers(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logs.watchLogSignal()
+	raftnode.SetWALSegmentSize(*walSegmentSize)
+	var recorder *trafficRecorder
+	if *recordTraffic != "" {
+		if recorder, err = newTrafficRecorder(*recordTraffic); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var master []byte
+	if *encryptionKeyFile != "" {
+		if master, err = encryption.LoadMasterKey(*encryptionKeyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	keyring, err := encryption.NewKeyring(master)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *encryptionAtRest != "" {
+		if atRest, err = openAtRest(*encryptionAtRest); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *valueCompression != "" {
+		if valueCodec, err = codec.Get(*valueCompression); err != nil {
+			log.Fatal(err)
+		}
+	}
+	valueCodecMinSize = *valueCompressionMinSize
+	watchHistorySize, watchHistoryDir, watchHistoryDiskSize = *historyMem, *historyPath, *historyDisk
+	if *viewTTL <= 0 {
+		log.Fatalf("invalid --snapshot-view-ttl %v", *viewTTL)
+	}
+	maxSnapshotViews, snapshotViewTTL = *maxViews, *viewTTL
+	if snapshotCodec, err = codec.Get(*snapshotCompression); err != nil {
+		log.Fatal(err)
+	}
+
+	var initialTxn *api.TxnRequest
+	if *initialData != "" {
+		if initialTxn, err = readInitialData(*initialData); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch *clusterState {
+	case "new":
+	case "existing":
+		*join = true
+	default:
+		log.Fatalf("invalid --initial-cluster-state %q", *clusterState)
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if *revisionFormat == idgen.FormatSnowflake && !set["compaction-batch-limit"] {
+		// snowflake revisions are sparse, a batch of revisions is a fraction of a millisecond
+		*compactionBatchLimit = 0
+	}
+
+	peers := strings.Split(*cluster, ",")
+	idSet := set["id"]
+	var joinEndpoints []string
+	if *joinEndpoint != "" {
+		joinEndpoints = []string{*joinEndpoint}
+	}
+	if *kubernetes {
+		for _, f := range []string{"cluster", "discovery-srv", "join-endpoint", "peer-url", "id"} {
+			if set[f] {
+				log.Fatalf("--kubernetes derives --%s, they are mutually exclusive", f)
+			}
+		}
+		k8s.pod, k8s.set.ClientPort = podName(), *kvport
+		if k8s.set.Namespace == "" {
+			k8s.set.Namespace = podNamespace()
+		}
+		m, err := k8s.member()
+		if err != nil {
+			log.Fatal(err)
+		}
+		*id, peers, *peerURL, joinEndpoints, idSet = m.id, m.peers, m.peerURL, m.join, true
+		if err := k8s.waitDNS(m.peerURL); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("kubernetes: pod %s is member %d of %v", k8s.pod, m.id, m.peers)
+	}
+	if *discoverySRV != "" {
+		if set["cluster"] {
+			log.Fatal("--cluster and --discovery-srv are mutually exclusive")
+		}
+		var err error
+		if peers, err = discovery.SRVPeers(*discoverySRV, *discoverySRVName); err != nil {
+			log.Fatal(err)
+		}
+		if *peerURL != "" {
+			if *id, err = discovery.MemberID(peers, *peerURL); err != nil {
+				log.Fatal(err)
+			}
+		}
+		log.Printf("discovered peers %v, this member is %d", peers, *id)
+	}
+
+	if *observer && len(joinEndpoints) == 0 {
+		log.Fatal("--observer needs --join-endpoint, an observer joins an existing cluster")
+	}
+	var joinClient *client.Client
+	if len(joinEndpoints) > 0 {
+		if set["initial-cluster-state"] && *clusterState == "new" {
+			log.Fatal("--join-endpoint joins an existing cluster, not a new one")
+		}
+		*join = true
+		if *peerURL == "" {
+			log.Fatal("--join-endpoint needs --peer-url")
+		}
+		var err error
+		if joinClient, err = client.New(client.Config{Endpoints: joinEndpoints, DialTimeout: 2 * time.Second}); err != nil {
+			log.Fatal(err)
+		}
+		var joinID uint64
+		if idSet {
+			joinID = uint64(*id)
+		}
+		// joining is idempotent, a restarted member finds itself by peer URL
+		joinID, joinPeers, err := joinCluster(joinClient, joinID, *peerURL, *observer)
+		switch {
+		case err == nil:
+			*id, peers = int(joinID), joinPeers
+		case idSet && wal.Exist(filepath.Join(*dataDir, raftnode.WALDir(*id))):
+			log.Printf("%v, restarting with the --cluster peers", err)
+		default:
+			log.Fatal(err)
+		}
+	}
+
+	if *otlpEndpoint != "" {
+		headers, err := tracing.ParseHeaders(*otlpHeaders)
+		if err != nil {
+			log.Fatal(err)
+		}
+		shutdown, err := tracing.Init(tracing.Config{
+			Endpoint:    *otlpEndpoint,
+			Headers:     headers,
+			Attributes:  map[string]string{"service.instance.id": strconv.Itoa(*id)},
+			SampleRatio: *traceSampleRatio,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), tracing.ExportTimeout)
+			defer cancel()
+			shutdown(ctx)
+		}()
+	}
+
+	groupNames, err := parseGroupNames(*raftGroups)
+	if err != nil {
+		log.Fatal(err)
+	}
+	activated, err := systemdListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, ln := range activated {
+		if name != "client" && name != "peer" {
+			log.Printf("Ignoring socket %q passed by systemd, expected client or peer\n", name)
+			ln.Close()
+		}
+	}
+	raftOpts := []raftnode.Option{
+		raftnode.WithClusterToken(*clusterToken), raftnode.WithWALSync(walSyncMode, *walSyncInterval),
+		raftnode.WithLogger(lg, raftLg),
+		raftnode.WithAdmission(raftnode.AdmissionConfig{Latency: *admissionLatency, Percentile: *admissionPercentile, MinSize: *admissionMinSize}),
+		raftnode.WithApplyThrottle(raftnode.ApplyThrottleConfig{Throttle: *applyThrottleLag, Reject: *applyRejectLag, MaxDelay: *applyThrottleDelay}),
+		raftnode.WithSnapshotTransferRate(*snapshotTransferRate),
+		raftnode.WithClockSkewBound(*clockSkewBound),
+		raftnode.WithPurge(raftnode.PurgeConfig{MaxSnapshots: *maxSnapshots, MaxWALs: *maxWALs, MaxAge: *purgeMaxAge, Interval: *purgeInterval}),
+		// a nil atRest still refuses to start from encrypted data
+		raftnode.WithSealer(atRest),
+		raftnode.WithProposalStamp(stampProposal),
+	}
+	if *removedArchive {
+		raftOpts = append(raftOpts, raftnode.WithRemovedArchive())
+	}
+	if *forceNewCluster {
+		if *join {
+			log.Fatal("--force-new-cluster restarts an existing member, it does not work with --join")
+		}
+		log.Printf("force new cluster: member %d starts as the only member of the cluster", *id)
+		raftOpts = append(raftOpts, raftnode.WithForceNewCluster())
+	}
+	if len(groupNames) > 0 {
+		switch {
+		case *join:
+			log.Fatal("--raft-groups does not work with --join, the groups cannot be joined yet")
+		case *historyPath != "":
+			log.Fatal("--raft-groups does not work with --watch-history-dir yet")
+		}
+		// the groups share the peer listener of the member
+		var host *raftnode.PeerHost
+		if ln := activated["peer"]; ln != nil {
+			host = raftnode.NewPeerHostListener(ln)
+		} else if host, err = raftnode.NewPeerHost(peers[*id-1]); err != nil {
+			log.Fatal(err)
+		}
+		defer host.Close()
+		raftOpts = append(raftOpts, raftnode.WithPeerHost(host))
+	} else if ln := activated["peer"]; ln != nil {
+		raftOpts = append(raftOpts, raftnode.WithPeerListener(ln))
+	}
 
-	proposePipe := &raftnode.ProposePipe{
-		ProposeC: make(chan string),
-		ErrorC:   make(chan error),
+	var backups objstore.ObjectStore
+	if *snapshotBackupURI != "" {
+		if backups, err = objstore.Open(*snapshotBackupURI); err != nil {
+			log.Fatal(err)
+		}
+	}
+	restoreAt, err := parseRestoreTarget(*restoreTo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *snapshotRestore != "" {
+		switch {
+		case backups == nil:
+			log.Fatal("--snapshot-restore needs --snapshot-backup")
+		case *join:
+			log.Fatal("--snapshot-restore starts a new cluster, it does not work with --join")
+		case len(groupNames) > 0:
+			log.Fatal("--snapshot-restore does not work with --raft-groups yet")
+		case wal.Exist(filepath.Join(*dataDir, raftnode.WALDir(*id))):
+			log.Printf("snapshot restore: member %d has a data directory already, ignoring --snapshot-restore", *id)
+		default:
+			voters := make([]uint64, len(peers))
+			for i := range peers {
+				voters[i] = uint64(i + 1)
+			}
+			name, err := restoreSnapshotBackup(backups, *snapshotRestore, restoreAt, *dataDir, *id, *clusterToken, voters, keyring)
+			if err != nil {
+				log.Fatalf("snapshot restore: %v", err)
+			}
+			log.Printf("snapshot restore: member %d starts from %s", *id, name)
+		}
 	}
+
+	proposePipe := raftnode.NewProposePipe()
 	defer proposePipe.Close()
 	confChangeC := make(chan raftpb.ConfChange)
 	defer close(confChangeC)
 
 	// raft provides a commit stream for the proposals from the http api
 	var kvs *kvstore
-	getSnapshot := func() ([]byte, error) { return kvs.getSnapshot() }
-	rc := raftnode.NewRaftNode(*id, strings.Split(*cluster, ","), *join, getSnapshot, proposePipe, confChangeC)
+	getSnapshot := func() ([]byte, error) { return kvs.storedSnapshot() }
+	rc := raftnode.NewRaftNode(*id, peers, *join, getSnapshot, proposePipe, confChangeC,
+		append(raftOpts, raftnode.WithDataDir(*dataDir))...)
 
-	kvs = newKVStore(<-rc.SnapshotterReady(), proposePipe, rc.CommitC(), rc.ErrorC())
+	kvs = newKVStore(rc.ID(), <-rc.SnapshotterReady(), proposePipe, rc.CommitC(), rc.ErrorC(), keyring)
 
-	serveHTTPKVAPI(kvs, *kvport, confChangeC, rc)
+	var audit *auditLog
+	if *auditLogDest != "" {
+		if audit, err = newAuditLog(*auditLogDest, rc.ID(), *auditLogMaxSize, *auditLogMaxBackups); err != nil {
+			log.Fatal(err)
+		}
+		defer audit.Close()
+	}
+
+	groups, err := startGroups(groupNames, groupConfig{id: *id, peers: peers, dataDir: *dataDir, master: master, opts: raftOpts})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer groups.stop()
+	groups.watchGroups()
+
+	if joinClient != nil && !*observer {
+		go promoteWhenCaughtUp(joinClient, rc)
+	}
+	if initialTxn != nil {
+		if *join {
+			log.Printf("initial data: joining an existing cluster, ignoring --initial-data")
+		} else {
+			go seedInitialData(kvs, rc, initialTxn)
+		}
+	}
+
+	if *sinkURI != "" {
+		if *sinkCheckpoint <= 0 {
+			log.Fatalf("invalid --sink-checkpoint-interval %v", *sinkCheckpoint)
+		}
+		sk, err := sink.Open(*sinkURI)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := newSinkWriter(kvs, sk, rc.IsLeader, *sinkCheckpoint)
+		w.Run()
+		defer w.Stop()
+	}
+
+	if backups != nil {
+		if *snapshotBackupInterval <= 0 || *snapshotBackupRetention <= 0 {
+			log.Fatalf("invalid --snapshot-backup-interval %v or --snapshot-backup-retention %d", *snapshotBackupInterval, *snapshotBackupRetention)
+		}
+		b := newSnapshotBackup(kvs, backups, rc.IsLeader, *snapshotBackupInterval, *snapshotBackupRetention)
+		b.Run()
+		defer b.Stop()
+	}
+	if *walShipping {
+		if backups == nil || *walShipInterval <= 0 {
+			log.Fatalf("--wal-shipping needs --snapshot-backup and a positive --wal-ship-interval")
+		}
+		w := newWALShipper(rc, backups, *walShipInterval)
+		w.Run()
+		defer w.Stop()
+	}
+
+	webhooks := newWebhookNotifier(kvs, rc.IsLeader)
+	webhooks.Run()
+	defer webhooks.Stop()
+
+	if *compactionRetention != "0" && *compactionRetention != "" {
+		c, err := compactor.New(*compactionMode, *compactionRetention,
+			compactor.Pacing{BatchLimit: *compactionBatchLimit, BatchInterval: *compactionSleepInterval}, kvs, kvs, rc.IsLeader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.Run()
+		defer c.Stop()
+	}
+
+	if *diskMinFree != 0 {
+		stores := []spaceGuard{kvs}
+		for _, name := range groups.names {
+			stores = append(stores, groups.groups[name].store)
+		}
+		m := newDiskMonitor(*dataDir, *diskMinFree, rc.ID(), stores...)
+		m.Run()
+		defer m.Stop()
+	}
+
+	if *deadMemberTimeout != 0 {
+		c, err := controller.NewDeadMember(*deadMemberTimeout, *deadMemberRemoval, raftCluster{rc, confChangeC}, kvs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.Run()
+		defer c.Stop()
+	}
+
+	if *learnerAutoPromote {
+		c, err := controller.NewLearnerPromotion(*learnerPromoteThreshold, *learnerPromoteAfter, raftCluster{rc, confChangeC}, kvs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.Run()
+		defer c.Stop()
+	}
+
+	if *respPort != 0 {
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(*respPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv := resp.NewServer(respStore{kvs, rc}, rc.IsLeader)
+		if audit != nil {
+			srv.Audit = audit.resp
+		}
+		go func() {
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+		defer srv.Close()
+	}
+
+	if *grpcPort != 0 {
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(*grpcPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv := newGRPCServer(rc.ID(), rc.LeaderID, rc.LinearizableReadNotify)
+		go func() {
+			if err := srv.Serve(ln); err != nil {
+				log.Fatal(err)
+			}
+		}()
+		defer srv.Stop()
+	}
+
+	if *dnsPort != 0 {
+		addr := ":" + strconv.Itoa(*dnsPort)
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv := dns.NewServer(dnsStore{kvs, *dnsPrefix}, *dnsDomain, *dnsTTL)
+		go func() {
+			if err := srv.ServeUDP(pc); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+		go func() {
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+		defer srv.Close()
+	}
+
+	if *debugAddr != "" {
+		if err := serveDebug(*debugAddr, *debugTokenFile, httpTuning, kvs, rc); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	requests := newRequestTracker()
+	if *slowRequest > 0 {
+		requests.logSlow(lg.Named("slow"), *slowRequest, rc.WALTime)
+	}
+	ln := activated["client"]
+	if ln != nil {
+		ln = httpTuning.limit(ln)
+	} else if ln, err = httpTuning.listen(":" + strconv.Itoa(*kvport)); err != nil {
+		log.Fatal(err)
+	}
+	go notifySystemd(rc)
+	serveHTTPKVAPI(kvs, ln, httpTuning, confChangeC, rc, guard, logs, recorder, audit, requests, groups,
+		removalConfig{mode: *onRemoval, staleReads: *removedStaleReads})
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// cgroupRoot is where the cgroup of the process is mounted.
+	cgroupRoot = "/sys/fs/cgroup"
+	// memoryCheckInterval is how often the memory use is compared with
+	// the limit.
+	memoryCheckInterval = 5 * time.Second
+	// memoryPressureRatios are the fractions of the memory limit from
+	// which the in-memory watch history is halved, then quartered; the
+	// pressure drops once the use is below memoryRelaxRatio.
+	memoryPressureRatios = [...]float64{0.8, 0.9}
+	memoryRelaxRatio     = 0.7
+)
+
+// memoryPressure is 0 with enough memory, and the number of times the
+// in-memory caches are halved under memory pressure.
+var memoryPressure atomic.Int32
+
+var (
+	memoryLimitGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metcd",
+		Subsystem: "memory",
+		Name:      "limit_bytes",
+		Help:      "Soft memory limit of the Go runtime, 0 if there is none.",
+	})
+
+	memoryUsedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metcd",
+		Subsystem: "memory",
+		Name:      "used_bytes",
+		Help:      "Memory mapped by the Go runtime and not released to the OS, what the memory limit bounds.",
+	})
+
+	memoryPressureGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metcd",
+		Subsystem: "memory",
+		Name:      "pressure",
+		Help:      "Number of times the in-memory caches are halved because the memory use nears the limit.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(memoryLimitGauge, memoryUsedGauge, memoryPressureGauge)
+}
+
+// runtimeTuning are the runtime options set from the command line.
+type runtimeTuning struct {
+	// MemoryLimit is the soft memory limit in bytes; 0 sets it to Ratio of
+	// the cgroup memory limit unless GOMEMLIMIT is set, -1 leaves it alone
+	MemoryLimit int64
+	Ratio       float64
+	// GOGC is the GC target percentage, 0 keeps GOGC and -1 only collects
+	// when nearing the memory limit
+	GOGC int
+	// GOMAXPROCS, if 0, is the CPU quota of the cgroup rounded up unless
+	// GOMAXPROCS is set
+	GOMAXPROCS int
+}
+
+// tuneRuntime applies t to the Go runtime and returns the memory limit in
+// effect, 0 if there is none.
+func tuneRuntime(t runtimeTuning) (int64, error) {
+	if t.Ratio <= 0 || t.Ratio > 1 {
+		return 0, errors.New("--memory-limit-ratio must be in (0, 1]")
+	}
+	switch {
+	case t.MemoryLimit > 0:
+		debug.SetMemoryLimit(t.MemoryLimit)
+		log.Printf("memory limit set to %d bytes", t.MemoryLimit)
+	case t.MemoryLimit == 0 && os.Getenv("GOMEMLIMIT") == "":
+		if limit, ok := cgroupMemoryLimit(); ok {
+			limit = int64(float64(limit) * t.Ratio)
+			debug.SetMemoryLimit(limit)
+			log.Printf("memory limit set to %d bytes, %g of the cgroup limit", limit, t.Ratio)
+		}
+	}
+	switch {
+	case t.GOGC == -1:
+		debug.SetGCPercent(-1)
+		log.Printf("garbage collection only runs near the memory limit")
+	case t.GOGC > 0:
+		debug.SetGCPercent(t.GOGC)
+	}
+	switch {
+	case t.GOMAXPROCS > 0:
+		runtime.GOMAXPROCS(t.GOMAXPROCS)
+	case os.Getenv("GOMAXPROCS") == "":
+		if quota, ok := cgroupCPUQuota(); ok {
+			if n := int(math.Ceil(quota)); n < runtime.NumCPU() {
+				runtime.GOMAXPROCS(n)
+				log.Printf("GOMAXPROCS set to %d, the CPU quota of the cgroup", n)
+			}
+		}
+	}
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		limit = 0
+	}
+	memoryLimitGauge.Set(float64(limit))
+	return limit, nil
+}
+
+// cgroupMemoryLimit returns the memory limit of the cgroup in bytes, if
+// any, from cgroup v2 or v1.
+func cgroupMemoryLimit() (int64, bool) {
+	for _, file := range []string{"memory.max", "memory/memory.limit_in_bytes"} {
+		b, err := os.ReadFile(filepath.Join(cgroupRoot, file))
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		// v1 reports no limit as a huge number
+		if err != nil || limit <= 0 || limit >= math.MaxInt64/2 {
+			return 0, false
+		}
+		return limit, true
+	}
+	return 0, false
+}
+
+// cgroupCPUQuota returns the number of CPUs the cgroup may use, if limited,
+// from cgroup v2 or v1.
+func cgroupCPUQuota() (float64, bool) {
+	var quota, period string
+	if b, err := os.ReadFile(filepath.Join(cgroupRoot, "cpu.max")); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) != 2 {
+			return 0, false
+		}
+		quota, period = fields[0], fields[1]
+	} else {
+		q, err := os.ReadFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us"))
+		if err != nil {
+			return 0, false
+		}
+		p, err := os.ReadFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_period_us"))
+		if err != nil {
+			return 0, false
+		}
+		quota, period = strings.TrimSpace(string(q)), strings.TrimSpace(string(p))
+	}
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		// "max" or -1: no quota
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
+
+// memoryUsed returns the memory the Go runtime holds, as the memory limit
+// counts it.
+func memoryUsed() int64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return int64(samples[0].Value.Uint64() - samples[1].Value.Uint64())
+}
+
+// updateMemoryPressure sets memoryPressure from the memory used out of
+// limit.
+func updateMemoryPressure(used, limit int64) {
+	memoryUsedGauge.Set(float64(used))
+	if limit <= 0 {
+		return
+	}
+	ratio := float64(used) / float64(limit)
+	level := memoryPressure.Load()
+	switch {
+	case int(level) < len(memoryPressureRatios) && ratio >= memoryPressureRatios[level]:
+		level++
+		log.Printf("memory use at %.0f%% of the limit, shrinking the in-memory watch history to 1/%d", ratio*100, 1<<level)
+	case level > 0 && ratio < memoryRelaxRatio:
+		level = 0
+		log.Printf("memory use back to %.0f%% of the limit, restoring the in-memory watch history", ratio*100)
+	default:
+		return
+	}
+	memoryPressure.Store(level)
+	memoryPressureGauge.Set(float64(level))
+}
+
+// watchMemory compares the memory use with limit until stopc is closed.
+func watchMemory(limit int64, stopc <-chan struct{}) {
+	t := time.NewTicker(memoryCheckInterval)
+	defer t.Stop()
+	for {
+		updateMemoryPressure(memoryUsed(), limit)
+		select {
+		case <-t.C:
+		case <-stopc:
+			return
+		}
+	}
+}
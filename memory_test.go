@@ -0,0 +1,109 @@
+package main
+
+import (
+	"metcd/api"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCgroupLimits(t *testing.T) {
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	write := func(file, content string) {
+		path := filepath.Join(cgroupRoot, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cgroupRoot = t.TempDir()
+	if _, ok := cgroupMemoryLimit(); ok {
+		t.Fatal("expected no memory limit without a cgroup")
+	}
+	write("memory.max", "max\n")
+	write("cpu.max", "max 100000\n")
+	if _, ok := cgroupMemoryLimit(); ok {
+		t.Fatal("expected no memory limit for max")
+	}
+	if _, ok := cgroupCPUQuota(); ok {
+		t.Fatal("expected no CPU quota for max")
+	}
+	write("memory.max", "1073741824\n")
+	write("cpu.max", "150000 100000\n")
+	if limit, ok := cgroupMemoryLimit(); !ok || limit != 1<<30 {
+		t.Fatalf("expected the v2 memory limit, got %d %v", limit, ok)
+	}
+	if quota, ok := cgroupCPUQuota(); !ok || quota != 1.5 {
+		t.Fatalf("expected the v2 CPU quota, got %v %v", quota, ok)
+	}
+
+	cgroupRoot = t.TempDir()
+	write("memory/memory.limit_in_bytes", "9223372036854771712\n")
+	write("cpu/cpu.cfs_quota_us", "-1\n")
+	write("cpu/cpu.cfs_period_us", "100000\n")
+	if _, ok := cgroupMemoryLimit(); ok {
+		t.Fatal("expected no memory limit for the v1 unlimited value")
+	}
+	if _, ok := cgroupCPUQuota(); ok {
+		t.Fatal("expected no CPU quota for -1")
+	}
+	write("memory/memory.limit_in_bytes", "536870912\n")
+	write("cpu/cpu.cfs_quota_us", "200000\n")
+	if limit, ok := cgroupMemoryLimit(); !ok || limit != 1<<29 {
+		t.Fatalf("expected the v1 memory limit, got %d %v", limit, ok)
+	}
+	if quota, ok := cgroupCPUQuota(); !ok || quota != 2 {
+		t.Fatalf("expected the v1 CPU quota, got %v %v", quota, ok)
+	}
+}
+
+func TestMemoryPressure(t *testing.T) {
+	defer func(n int) { watchHistorySize = n }(watchHistorySize)
+	defer memoryPressure.Store(0)
+	watchHistorySize = 8
+	h := newWatchHub()
+	record := func(n int) {
+		for i := 0; i < n; i++ {
+			h.history.record(api.Event{Type: api.EventPut, Key: "/k", ModRevision: h.history.last + 1})
+		}
+	}
+	record(10)
+	if len(h.history.events) != 8 {
+		t.Fatalf("expected 8 events, got %d", len(h.history.events))
+	}
+
+	updateMemoryPressure(50, 100)
+	if memoryPressure.Load() != 0 {
+		t.Fatal("expected no pressure at half the limit")
+	}
+	updateMemoryPressure(85, 100)
+	updateMemoryPressure(85, 100)
+	if memoryPressure.Load() != 1 {
+		t.Fatalf("expected the first pressure level, got %d", memoryPressure.Load())
+	}
+	record(1)
+	if len(h.history.events) != 4 {
+		t.Fatalf("expected the history halved, got %d events", len(h.history.events))
+	}
+	if _, err := h.history.since(h.history.last - 6); err == nil {
+		t.Fatal("expected the dropped events to be compacted")
+	}
+	updateMemoryPressure(95, 100)
+	if memoryPressure.Load() != 2 {
+		t.Fatalf("expected the second pressure level, got %d", memoryPressure.Load())
+	}
+	updateMemoryPressure(75, 100)
+	if memoryPressure.Load() != 2 {
+		t.Fatal("expected the pressure to hold above the relax ratio")
+	}
+	updateMemoryPressure(60, 100)
+	if memoryPressure.Load() != 0 {
+		t.Fatal("expected the pressure to drop below the relax ratio")
+	}
+	if updateMemoryPressure(200, 0); memoryPressure.Load() != 0 {
+		t.Fatal("expected no pressure without a limit")
+	}
+}
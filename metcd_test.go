@@ -16,16 +16,23 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"metcd/api"
+	"metcd/failpoint"
 	"metcd/raftnode"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
 	"go.etcd.io/etcd/raft/v3/raftpb"
 )
 
@@ -68,7 +75,7 @@ func newCluster(n int) *cluster {
 		clus.confChangeC[i] = make(chan raftpb.ConfChange, 1)
 		fn, snapshotTriggeredC := getSnapshotFn()
 		clus.snapshotTriggeredC[i] = snapshotTriggeredC
-		clus.proposePipe[i] = &raftnode.ProposePipe{ProposeC: make(chan string, 1)}
+		clus.proposePipe[i] = &raftnode.ProposePipe{ProposeC: make(chan []byte, 1)}
 		rc := raftnode.NewRaftNode(i+1, clus.peers, false, fn, clus.proposePipe[i], clus.confChangeC[i])
 		clus.commitC[i] = rc.CommitC()
 		clus.errorC[i] = rc.ErrorC()
@@ -114,7 +121,7 @@ func TestProposeOnCommit(t *testing.T) {
 	donec := make(chan struct{})
 	for i := range clus.peers {
 		// feedback for "n" committed entries, then update donec
-		go func(pC chan<- string, cC <-chan *raftnode.Commit, eC <-chan error) {
+		go func(pC chan<- []byte, cC <-chan *raftnode.Commit, eC <-chan error) {
 			for n := 0; n < 100; n++ {
 				c, ok := <-cC
 				if !ok {
@@ -136,7 +143,7 @@ func TestProposeOnCommit(t *testing.T) {
 
 		// one message feedback per node
 		go func(i int) {
-			clus.proposePipe[i].ProposeC <- "foo"
+			clus.proposePipe[i].ProposeC <- []byte("foo")
 		}(i)
 	}
 
@@ -164,12 +171,12 @@ func TestCloseProposerInflight(t *testing.T) {
 	// some inflight ops
 	go func() {
 		defer wg.Done()
-		clus.proposePipe[0].ProposeC <- "foo"
-		clus.proposePipe[0].ProposeC <- "bar"
+		clus.proposePipe[0].ProposeC <- []byte("foo")
+		clus.proposePipe[0].ProposeC <- []byte("bar")
 	}()
 
 	// wait for one message
-	if c, ok := <-clus.commitC[0]; !ok || c.Data[0] != "foo" {
+	if c, ok := <-clus.commitC[0]; !ok || string(c.Data[0]) != "foo" {
 		t.Fatalf("Commit failed")
 	}
 
@@ -180,7 +187,7 @@ func TestPutAndGetKeyValue(t *testing.T) {
 	clusters := []string{"http://127.0.0.1:9021"}
 
 	proposePipe := &raftnode.ProposePipe{
-		ProposeC: make(chan string),
+		ProposeC: make(chan []byte),
 	}
 	defer proposePipe.Close()
 
@@ -190,7 +197,7 @@ func TestPutAndGetKeyValue(t *testing.T) {
 	var kvs *kvstore
 	getSnapshot := func() ([]byte, error) { return kvs.getSnapshot() }
 	rc := raftnode.NewRaftNode(1, clusters, false, getSnapshot, proposePipe, confChangeC)
-	kvs = newKVStore(<-rc.SnapshotterReady(), proposePipe, rc.CommitC(), rc.ErrorC())
+	kvs = newKVStore(rc.ID(), <-rc.SnapshotterReady(), proposePipe, rc.CommitC(), rc.ErrorC(), nil)
 
 	srv := httptest.NewServer(&httpKVAPI{
 		store:       kvs,
@@ -256,7 +263,7 @@ func TestAddNewNode(t *testing.T) {
 	}
 
 	proposePipe := &raftnode.ProposePipe{
-		ProposeC: make(chan string),
+		ProposeC: make(chan []byte),
 	}
 	defer proposePipe.Close()
 
@@ -266,10 +273,10 @@ func TestAddNewNode(t *testing.T) {
 	raftnode.NewRaftNode(4, append(clus.peers, newNodeURL), true, nil, proposePipe, confChangeC)
 
 	go func() {
-		proposePipe.ProposeC <- "foo"
+		proposePipe.ProposeC <- []byte("foo")
 	}()
 
-	if c, ok := <-clus.commitC[0]; !ok || c.Data[0] != "foo" {
+	if c, ok := <-clus.commitC[0]; !ok || string(c.Data[0]) != "foo" {
 		t.Fatalf("Commit failed")
 	}
 }
@@ -288,7 +295,7 @@ func TestSnapshot(t *testing.T) {
 	defer clus.closeNoErrors(t)
 
 	go func() {
-		clus.proposePipe[0].ProposeC <- "foo"
+		clus.proposePipe[0].ProposeC <- []byte("foo")
 	}()
 
 	c := <-clus.commitC[0]
@@ -301,3 +308,193 @@ func TestSnapshot(t *testing.T) {
 	close(c.ApplyDoneC)
 	<-clus.snapshotTriggeredC[0]
 }
+
+// TestFailpointPartition partitions the third node of a cluster with the send
+// and receive failpoints: the other two keep committing, and the third
+// catches up once the partition heals.
+func TestFailpointPartition(t *testing.T) {
+	clus := newCluster(3)
+	defer clus.closeNoErrors(t)
+	defer failpoint.Disable(failpoint.Receive + "@3")
+	defer failpoint.Disable(failpoint.Send + "@3")
+
+	seen := make([]chan struct{}, len(clus.peers))
+	for i := range clus.peers {
+		seen[i] = make(chan struct{})
+		// each reader closes its own channel once, seen itself is not
+		// written after this loop
+		go func(commitC <-chan *raftnode.Commit, seen chan struct{}) {
+			closed := false
+			for c := range commitC {
+				for _, data := range c.Data {
+					if string(data) == "foo" && !closed {
+						close(seen)
+						closed = true
+					}
+				}
+				close(c.ApplyDoneC)
+			}
+		}(clus.commitC[i], seen[i])
+	}
+	// wait for a leader before the partition
+	clus.proposePipe[0].ProposeC <- []byte("bar")
+	time.Sleep(time.Second)
+
+	failpoint.Enable(failpoint.Send+"@3", "drop")
+	failpoint.Enable(failpoint.Receive+"@3", "drop")
+	committed := make(chan struct{})
+	go func() {
+		// proposals forwarded to a partitioned leader are lost, so retry
+		// until the two others elect a leader of their own
+		for {
+			select {
+			case clus.proposePipe[0].ProposeC <- []byte("foo"):
+			case <-committed:
+				return
+			}
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-committed:
+				return
+			}
+		}
+	}()
+	waitSeen := func(c chan struct{}, what string) {
+		t.Helper()
+		select {
+		case <-c:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+	waitSeen(seen[0], "node 1 to commit")
+	waitSeen(seen[1], "node 2 to commit")
+	close(committed)
+	select {
+	case <-seen[2]:
+		t.Fatal("expected the partitioned node not to commit")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	failpoint.Disable(failpoint.Send + "@3")
+	failpoint.Disable(failpoint.Receive + "@3")
+	waitSeen(seen[2], "node 3 to catch up")
+}
+
+// TestFailpointWALSave fails the WAL write of a proposal: the node stops with
+// the error, and restarts from the entries written before it.
+func TestFailpointWALSave(t *testing.T) {
+	defer failpoint.Disable(failpoint.WALSave)
+	peers := []string{"http://127.0.0.1:10000"}
+	start := func() (*raftnode.ProposePipe, *raftnode.RaftNode) {
+		fn, _ := getSnapshotFn()
+		pp := &raftnode.ProposePipe{ProposeC: make(chan []byte, 1)}
+		return pp, raftnode.NewRaftNode(1, peers, false, fn, pp, make(chan raftpb.ConfChange))
+	}
+	defer os.RemoveAll("metcd-1")
+	defer os.RemoveAll("metcd-1-snap")
+	os.RemoveAll("metcd-1")
+	os.RemoveAll("metcd-1-snap")
+
+	pp, rc := start()
+	pp.ProposeC <- []byte("foo")
+	if c, ok := <-rc.CommitC(); !ok || string(c.Data[0]) != "foo" {
+		t.Fatal("expected foo to commit")
+	}
+	failpoint.Enable(failpoint.WALSave, "error(disk full)")
+	pp.ProposeC <- []byte("bar")
+	// rc is replaced by the restarted node below
+	go func(commitC <-chan *raftnode.Commit) {
+		for range commitC { //revive:disable-line:empty-block
+		}
+	}(rc.CommitC())
+	select {
+	case err := <-rc.ErrorC():
+		if err == nil || !strings.Contains(err.Error(), "disk full") {
+			t.Fatalf("expected the failpoint error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the WAL write to fail")
+	}
+	failpoint.Disable(failpoint.WALSave)
+	// the raft loop closes the WAL after reporting the error
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		names, _ := filepath.Glob(filepath.Join("metcd-1", "*.wal"))
+		l, err := fileutil.TryLockFile(names[len(names)-1], os.O_WRONLY, fileutil.PrivateFileMode)
+		if err == nil {
+			l.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the WAL to be closed (%v)", err)
+		}
+	}
+
+	pp, rc = start()
+	defer func() {
+		pp.Close()
+		go func(commitC <-chan *raftnode.Commit) {
+			for range commitC { //revive:disable-line:empty-block
+			}
+		}(rc.CommitC())
+		if err := <-rc.ErrorC(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	var replayed []string
+	for len(replayed) == 0 || replayed[len(replayed)-1] != "foo" {
+		select {
+		case c := <-rc.CommitC():
+			for _, data := range c.Data {
+				replayed = append(replayed, string(data))
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out replaying the WAL, got %q", replayed)
+		}
+	}
+	select {
+	case c := <-rc.CommitC():
+		t.Fatalf("expected the failed write to be lost, got %q", c.Data)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	failed := errors.New("read timed out")
+	for _, c := range []struct {
+		service string
+		leader  uint64
+		err     error
+		status  string
+		reason  string
+	}{
+		{"", 1, nil, api.HealthServing, ""},
+		{"kv", 2, nil, api.HealthServing, ""},
+		{"", 0, nil, api.HealthNotServing, "no leader"},
+		{"kv", 2, failed, api.HealthNotServing, failed.Error()},
+		{"leader", 1, nil, api.HealthServing, ""},
+		{"leader", 2, nil, api.HealthNotServing, "not the leader"},
+		{"leader", 1, failed, api.HealthNotServing, failed.Error()},
+	} {
+		health := api.Health{Leader: c.leader}
+		checkHealth(&health, c.service, 1, func() error { return c.err })
+		if health.Status != c.status || health.Health != (c.status == api.HealthServing) || health.Reason != c.reason {
+			t.Fatalf("service %q, leader %d, read error %v: expected %s (%q), got %+v", c.service, c.leader, c.err, c.status, c.reason, health)
+		}
+	}
+
+	srv := httptest.NewServer(newHTTPHandler(&httpKVAPI{store: newTestKVStore(nil), requests: newRequestTracker()}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/health?service=nosuch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var health api.Health
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound || health.Status != api.HealthServiceUnknown {
+		t.Fatalf("expected an unknown service, got %d %+v", resp.StatusCode, health)
+	}
+}
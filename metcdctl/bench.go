@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"metcd/api"
+	"metcd/client"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchResult summarizes the replayed operations of one type.
+type benchResult struct {
+	Op     string        `json:"op"`
+	Count  int           `json:"count"`
+	Errors int           `json:"errors"`
+	P50    time.Duration `json:"p50"`
+	P90    time.Duration `json:"p90"`
+	P99    time.Duration `json:"p99"`
+	Max    time.Duration `json:"max"`
+
+	latencies []time.Duration
+}
+
+func benchReplayCommand() *command {
+	const usage = "bench replay <file> [--speed=1] [--max-inflight=100] [--prefix=/bench/]"
+	var (
+		speed       float64
+		maxInflight int
+		prefix      string
+	)
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.Float64Var(&speed, "speed", 1, "replay speed relative to the recording, 0 replays as fast as possible")
+			fs.IntVar(&maxInflight, "max-inflight", 100, "maximum number of concurrent requests")
+			fs.StringVar(&prefix, "prefix", "/bench/", "prefix of the keys written by the replay")
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			if speed < 0 || maxInflight < 1 {
+				exitWithError(exitBadArgs, errors.New("--speed must not be negative and --max-inflight must be positive"))
+			}
+			ops, err := readRecording(args[0])
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			c := g.newClient()
+			defer c.Close()
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			start := time.Now()
+			results := replay(ctx, g, c, ops, speed, maxInflight, prefix)
+			g.printer().BenchReplay(results, time.Since(start))
+		},
+	}
+}
+
+func readRecording(path string) ([]api.RecordedOp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ops []api.RecordedOp
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		var op api.RecordedOp
+		if err := json.Unmarshal(sc.Bytes(), &op); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, sc.Err()
+}
+
+// replay issues ops at their recorded offsets divided by speed, keeping at
+// most maxInflight requests in flight.
+func replay(ctx context.Context, g *globalFlags, c *client.Client, ops []api.RecordedOp, speed float64, maxInflight int, prefix string) []*benchResult {
+	var (
+		mu      sync.Mutex
+		results = make(map[string]*benchResult)
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, maxInflight)
+	)
+	start := time.Now()
+	for _, op := range ops {
+		if speed > 0 {
+			// the recording starts with the member, not with the first request
+			at := start.Add(time.Duration(float64(op.Offset-ops[0].Offset) / speed))
+			select {
+			case <-time.After(time.Until(at)):
+			case <-ctx.Done():
+			}
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(op api.RecordedOp) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			opCtx, cancel := context.WithTimeout(ctx, g.commandTimeout)
+			defer cancel()
+			t := time.Now()
+			err := replayOp(opCtx, c, op, prefix)
+			d := time.Since(t)
+
+			mu.Lock()
+			defer mu.Unlock()
+			r := results[op.Op]
+			if r == nil {
+				r = &benchResult{Op: op.Op}
+				results[op.Op] = r
+			}
+			r.Count++
+			if err != nil {
+				r.Errors++
+			}
+			r.latencies = append(r.latencies, d)
+		}(op)
+	}
+	wg.Wait()
+
+	out := make([]*benchResult, 0, len(results))
+	for _, r := range results {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+		r.P50, r.P90, r.P99 = percentile(r.latencies, 0.5), percentile(r.latencies, 0.9), percentile(r.latencies, 0.99)
+		r.Max = r.latencies[len(r.latencies)-1]
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Op < out[j].Op })
+	return out
+}
+
+func replayOp(ctx context.Context, c *client.Client, op api.RecordedOp, prefix string) error {
+	key := prefix + op.KeyHash
+	value := strings.Repeat("x", int(op.Size))
+	var err error
+	switch op.Op {
+	case "get":
+		_, err = c.Get(ctx, key)
+	case "put":
+		err = c.Put(ctx, key, value)
+	case "delete":
+		err = c.Delete(ctx, key)
+	case "append":
+		err = c.Append(ctx, key, value)
+	case "patch":
+		err = c.Patch(ctx, key, []byte(`{"v":"`+value+`"}`))
+	case "txn":
+		_, err = c.Txn(ctx, &api.TxnRequest{Success: []api.Op{{Type: api.OpPut, Key: prefix + "txn", Value: value}}})
+	default:
+		err = fmt.Errorf("unknown op %q", op.Op)
+	}
+	if errors.Is(err, client.ErrKeyNotFound) {
+		// a missing key is a normal answer, the recording may start with
+		// keys this cluster does not have
+		return nil
+	}
+	return err
+}
+
+// percentile returns the p-th percentile of the sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
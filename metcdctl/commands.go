@@ -0,0 +1,731 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"metcd/api"
+	"metcd/client"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func expectArgs(args []string, n int, usage string) {
+	if len(args) != n {
+		exitWithError(exitBadArgs, fmt.Errorf("usage: metcdctl %s", usage))
+	}
+}
+
+func getCommand() *command {
+	const usage = "get <key> [--consistency=l|s] [--min-rev=<rev>]"
+	var (
+		consistency string
+		minRev      int64
+	)
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&consistency, "consistency", "l", "linearizable (l) or serializable (s)")
+			fs.Int64Var(&minRev, "min-rev", 0, "wait until the endpoint applied this revision")
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			opts := g.kvOpts()
+			switch consistency {
+			case "l":
+			case "s":
+				opts = append(opts, client.WithSerializable())
+			default:
+				exitWithError(exitBadArgs, fmt.Errorf("unknown consistency %q", consistency))
+			}
+			if minRev > 0 {
+				opts = append(opts, client.WithMinRev(minRev))
+			}
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			v, err := c.Get(ctx, args[0], opts...)
+			if errors.Is(err, client.ErrKeyNotFound) {
+				return
+			}
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().Get(args[0], v)
+		},
+	}
+}
+
+func putCommand() *command {
+	const usage = "put <key> <value>"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 2, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			if err := c.Put(ctx, args[0], args[1], g.kvOpts()...); err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().Put()
+		},
+	}
+}
+
+func delCommand() *command {
+	const usage = "del <key>"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			deleted := 1
+			err := c.Delete(ctx, args[0], g.kvOpts()...)
+			if errors.Is(err, client.ErrKeyNotFound) {
+				deleted = 0
+			} else if err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().Del(deleted)
+		},
+	}
+}
+
+func watchCommand() *command {
+	const usage = "watch <key> [--prefix] [--since <rev>] [--keys-only] [--no-put] [--no-delete] [--rate <n>]"
+	var (
+		prefix, keysOnly, noPut, noDelete bool
+		since                             int64
+		rate                              float64
+	)
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&prefix, "prefix", false, "watch every key with the given prefix")
+			fs.Int64Var(&since, "since", -1, "start with the events after this revision, -1 starts with the next event")
+			fs.BoolVar(&keysOnly, "keys-only", false, "leave the values out of the events")
+			fs.BoolVar(&noPut, "no-put", false, "skip the put events")
+			fs.BoolVar(&noDelete, "no-delete", false, "skip the delete events")
+			fs.Float64Var(&rate, "rate", 0, "receive at most this many events per second, 0 is unlimited")
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			p := g.printer()
+			// the stream may end within the events of a revision, it
+			// resumes with that revision and skips the events seen
+			var last int64
+			seen, skip := 0, 0
+			for {
+				opts := append(g.kvOpts(), client.WithRateLimit(rate))
+				if keysOnly {
+					opts = append(opts, client.WithKeysOnly())
+				}
+				if noPut {
+					opts = append(opts, client.WithFilterPut())
+				}
+				if noDelete {
+					opts = append(opts, client.WithFilterDelete())
+				}
+				if since >= 0 {
+					opts = append(opts, client.WithSince(since))
+				}
+				events, err := c.Watch(ctx, args[0], prefix, opts...)
+				if err != nil {
+					exitWithError(exitError, err)
+				}
+				for ev := range events {
+					if ev.ModRevision == last && skip > 0 {
+						skip--
+						continue
+					}
+					if ev.ModRevision != last {
+						last, seen = ev.ModRevision, 0
+					}
+					seen++
+					p.Watch(ev)
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				if last == 0 && since < 0 {
+					exitWithError(exitError, errors.New("watch closed by server"))
+				}
+				if last != 0 {
+					since, skip = last-1, seen
+				}
+				fmt.Fprintf(os.Stderr, "Warning: watch closed, resuming after revision %d\n", since)
+			}
+		},
+	}
+}
+
+func txnCommand() *command {
+	const usage = "txn   (reads compares, success and failure requests from stdin)"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 0, usage)
+			txn, err := parseTxn(os.Stdin)
+			if err != nil {
+				exitWithError(exitBadArgs, err)
+			}
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			resp, err := c.Txn(ctx, txn, g.kvOpts()...)
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().Txn(resp)
+		},
+	}
+}
+
+func memberListCommand() *command {
+	const usage = "member list"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 0, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			members, err := c.MemberList(ctx)
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().MemberList(members)
+		},
+	}
+}
+
+func parseMemberID(s string) uint64 {
+	id, err := strconv.ParseUint(s, 0, 64)
+	if err != nil || id == 0 {
+		exitWithError(exitBadArgs, fmt.Errorf("invalid member ID %q", s))
+	}
+	return id
+}
+
+const forceUsage = "make the change even if it leaves an even number of voters or too little fault tolerance"
+
+// forceOpts returns the call options of a membership change.
+func forceOpts(force bool) []client.CallOption {
+	if force {
+		return []client.CallOption{client.WithForce()}
+	}
+	return nil
+}
+
+func memberAddCommand() *command {
+	const usage = "member add <id> --peer-url=<url> [--learner|--observer] [--force]"
+	var (
+		peerURL  string
+		learner  bool
+		observer bool
+		force    bool
+	)
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&peerURL, "peer-url", "", "peer URL of the new member")
+			fs.BoolVar(&learner, "learner", false, "add the member as a non-voting learner")
+			fs.BoolVar(&observer, "observer", false, "add the member as an observer, a learner that is never promoted")
+			fs.BoolVar(&force, "force", false, forceUsage)
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			id := parseMemberID(args[0])
+			if peerURL == "" {
+				exitWithError(exitBadArgs, errors.New("--peer-url is required"))
+			}
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			add := c.MemberAdd
+			if learner {
+				add = c.MemberAddLearner
+			}
+			if observer {
+				add = c.MemberAddObserver
+			}
+			if err := add(ctx, id, peerURL, forceOpts(force)...); err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().MemberAdd(id, peerURL)
+		},
+	}
+}
+
+func memberPromoteCommand() *command {
+	const usage = "member promote <id> [--force]"
+	var force bool
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&force, "force", false, forceUsage)
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			id := parseMemberID(args[0])
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			if err := c.MemberPromote(ctx, id, forceOpts(force)...); err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().MemberPromote(id)
+		},
+	}
+}
+
+func memberUpdateCommand() *command {
+	const usage = "member update <id> --peer-url=<url>"
+	var peerURL string
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&peerURL, "peer-url", "", "new peer URL of the member")
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			id := parseMemberID(args[0])
+			if peerURL == "" {
+				exitWithError(exitBadArgs, errors.New("--peer-url is required"))
+			}
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			if err := c.MemberUpdate(ctx, id, peerURL); err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().MemberUpdate(id, peerURL)
+		},
+	}
+}
+
+func endpointHealthCommand() *command {
+	const usage = "endpoint health"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 0, usage)
+			p := g.printer()
+			unhealthy := false
+			for _, ep := range strings.Split(g.endpoints, ",") {
+				h, err := endpointHealth(g, ep)
+				if err != nil {
+					h = &api.Health{Reason: err.Error()}
+				}
+				unhealthy = unhealthy || !h.Health
+				p.EndpointHealth(ep, h)
+			}
+			if unhealthy {
+				os.Exit(exitError)
+			}
+		},
+	}
+}
+
+// endpointHealth checks a single endpoint, unlike client.Health which
+// stops at the first reachable one.
+func endpointHealth(g *globalFlags, ep string) (*api.Health, error) {
+	eg := *g
+	eg.endpoints = ep
+	c := eg.newClient()
+	defer c.Close()
+	ctx, cancel := g.commandCtx()
+	defer cancel()
+	return c.Health(ctx)
+}
+
+func defragCommand() *command {
+	const usage = "defrag"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 0, usage)
+			p := g.printer()
+			failed := false
+			// like endpoint health, every endpoint is defragmented on its own
+			for _, ep := range strings.Split(g.endpoints, ",") {
+				eg := *g
+				eg.endpoints = ep
+				c := eg.newClient()
+				ctx, cancel := g.commandCtx()
+				resp, err := c.Defrag(ctx)
+				cancel()
+				c.Close()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to defragment %s: %v\n", ep, err)
+					failed = true
+					continue
+				}
+				p.Defrag(ep, resp)
+			}
+			if failed {
+				os.Exit(exitError)
+			}
+		},
+	}
+}
+
+func memberRemoveCommand() *command {
+	const usage = "member remove <id> [--force]"
+	var force bool
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&force, "force", false, forceUsage)
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			id := parseMemberID(args[0])
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			if err := c.MemberRemove(ctx, id, forceOpts(force)...); err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().MemberRemove(id)
+		},
+	}
+}
+
+func alarmListCommand() *command {
+	const usage = "alarm list"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 0, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			alarms, err := c.AlarmList(ctx)
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().AlarmList(alarms)
+		},
+	}
+}
+
+func alarmDisarmCommand() *command {
+	const usage = "alarm disarm [--member <id>] [--alarm <type>]"
+	var member uint64
+	var alarm string
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.Uint64Var(&member, "member", 0, "only disarm the alarms of this member")
+			fs.StringVar(&alarm, "alarm", "", "only disarm alarms of this type, e.g. UNREACHABLE")
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 0, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			alarms, err := c.AlarmList(ctx)
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			if err := c.AlarmDisarm(ctx, member, api.AlarmType(alarm)); err != nil {
+				exitWithError(exitError, err)
+			}
+			var disarmed []api.Alarm
+			for _, a := range alarms {
+				if (member == 0 || a.MemberID == member) && (alarm == "" || string(a.Alarm) == alarm) {
+					disarmed = append(disarmed, a)
+				}
+			}
+			g.printer().AlarmList(disarmed)
+		},
+	}
+}
+
+func snapshotSaveCommand() *command {
+	const usage = "snapshot save <file>"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			path := args[0]
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			if err := saveSnapshot(ctx, c, path); err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().SnapshotSave(path)
+		},
+	}
+}
+
+func snapshotExportCommand() *command {
+	const usage = "snapshot export <file> [--format json|proto]"
+	var format string
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&format, "format", client.ExportJSON, "json (one key-value object per line) or proto (length-delimited etcd mvccpb.KeyValue)")
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			path := args[0]
+			c := g.newClient()
+			defer c.Close()
+			// exports of large stores take longer than a short command
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			rc, rev, err := c.Export(ctx, format, g.kvOpts()...)
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			defer rc.Close()
+			if err := writeFile(path, rc); err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().SnapshotExport(path, rev)
+		},
+	}
+}
+
+func importCommand() *command {
+	const usage = "import <file|-> [--format json|proto]"
+	var format string
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&format, "format", client.ExportJSON, "format of the file, as written by snapshot export")
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			path := args[0]
+			var r io.Reader = os.Stdin
+			if path != "-" {
+				f, err := os.Open(path)
+				if err != nil {
+					exitWithError(exitError, err)
+				}
+				defer f.Close()
+				r = f
+			}
+			c := g.newClient()
+			defer c.Close()
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			res, err := c.Import(ctx, r, format, func(p api.ImportProgress) {
+				fmt.Fprintf(os.Stderr, "Imported %d keys (%d bytes)\n", p.Keys, p.Bytes)
+			}, g.kvOpts()...)
+			if err != nil {
+				if res != nil && res.Keys > 0 {
+					fmt.Fprintf(os.Stderr, "Imported %d keys before failing\n", res.Keys)
+				}
+				exitWithError(exitError, err)
+			}
+			g.printer().Import(path, res)
+		},
+	}
+}
+
+func verifyCommand() *command {
+	const usage = "verify <verifier-url>"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			resp, err := c.Verify(ctx, args[0], g.kvOpts()...)
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().Verify(resp)
+		},
+	}
+}
+
+// saveSnapshot downloads the snapshot to path.
+func saveSnapshot(ctx context.Context, c *client.Client, path string) error {
+	rc, err := c.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return writeFile(path, rc)
+}
+
+// writeFile copies r to a temporary file and renames it into place so path
+// never holds a partial download.
+func writeFile(path string, r io.Reader) error {
+	tmp := path + ".part"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func keyspaceListCommand() *command {
+	const usage = "keyspace list"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 0, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			spaces, err := c.KeyspaceList(ctx)
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().KeyspaceList(spaces)
+		},
+	}
+}
+
+func keyspaceCreateCommand() *command {
+	const usage = "keyspace create <name> [--quota <bytes>]"
+	var quota int64
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.Int64Var(&quota, "quota", 0, "maximum size of the keys and values in bytes, 0 is unlimited")
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			if err := c.KeyspacePut(ctx, args[0], quota); err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().KeyspaceCreate(args[0], quota)
+		},
+	}
+}
+
+func keyspaceDeleteCommand() *command {
+	const usage = "keyspace delete <name>"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			if err := c.KeyspaceDelete(ctx, args[0]); err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().KeyspaceDelete(args[0])
+		},
+	}
+}
+
+func encryptionListCommand() *command {
+	const usage = "encryption list"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 0, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			keys, err := c.EncryptionList(ctx, g.kvOpts()...)
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().EncryptionList(keys)
+		},
+	}
+}
+
+func encryptionRotateCommand() *command {
+	const usage = "encryption rotate <prefix>"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			key, err := c.EncryptionRotate(ctx, args[0], g.kvOpts()...)
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().EncryptionRotate(key)
+		},
+	}
+}
+
+func encryptionDestroyCommand() *command {
+	const usage = "encryption destroy <prefix>"
+	return &command{
+		usage: usage,
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, cancel := g.commandCtx()
+			defer cancel()
+			if err := c.EncryptionDestroy(ctx, args[0], g.kvOpts()...); err != nil {
+				exitWithError(exitError, err)
+			}
+			g.printer().EncryptionDestroy(args[0])
+		},
+	}
+}
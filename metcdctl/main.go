@@ -0,0 +1,260 @@
+// metcdctl is a command line client for metcd.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"metcd/client"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	exitError      = 1
+	exitBadArgs    = 2
+	exitBadConnect = 3
+)
+
+type globalFlags struct {
+	endpoints          string
+	writeOut           string
+	cacert             string
+	cert               string
+	key                string
+	insecureSkipVerify bool
+	dialTimeout        time.Duration
+	commandTimeout     time.Duration
+	keyspace           string
+}
+
+func (g *globalFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.endpoints, "endpoints", "http://127.0.0.1:9121", "comma separated client URLs of the cluster")
+	fs.StringVar(&g.writeOut, "write-out", "simple", "output format (simple, json, table)")
+	fs.StringVar(&g.writeOut, "w", "simple", "shorthand for --write-out")
+	fs.StringVar(&g.cacert, "cacert", "", "verify certificates of https servers using this CA bundle")
+	fs.StringVar(&g.cert, "cert", "", "identify the client using this TLS certificate file")
+	fs.StringVar(&g.key, "key", "", "identify the client using this TLS key file")
+	fs.BoolVar(&g.insecureSkipVerify, "insecure-skip-tls-verify", false, "skip server certificate verification")
+	fs.DurationVar(&g.dialTimeout, "dial-timeout", 2*time.Second, "dial timeout for client connections")
+	fs.DurationVar(&g.commandTimeout, "command-timeout", 5*time.Second, "timeout for short running commands (excluding watch)")
+	fs.StringVar(&g.keyspace, "keyspace", "", "keyspace of get, put, del, watch and txn (the default keyspace if empty)")
+}
+
+func (g *globalFlags) tlsConfig() (*tls.Config, error) {
+	if g.cacert == "" && g.cert == "" && g.key == "" && !g.insecureSkipVerify {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: g.insecureSkipVerify}
+	if g.cacert != "" {
+		pem, err := os.ReadFile(g.cacert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", g.cacert)
+		}
+		cfg.RootCAs = pool
+	}
+	if g.cert != "" || g.key != "" {
+		cert, err := tls.LoadX509KeyPair(g.cert, g.key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (g *globalFlags) newClient() *client.Client {
+	tlsCfg, err := g.tlsConfig()
+	if err != nil {
+		exitWithError(exitBadArgs, err)
+	}
+	c, err := client.New(client.Config{
+		Endpoints:   strings.Split(g.endpoints, ","),
+		TLS:         tlsCfg,
+		DialTimeout: g.dialTimeout,
+		OnWarning: func(warning string) {
+			fmt.Fprintln(os.Stderr, "Warning:", warning)
+		},
+	})
+	if err != nil {
+		exitWithError(exitBadConnect, err)
+	}
+	return c
+}
+
+func (g *globalFlags) printer() printer {
+	p, err := newPrinter(g.writeOut, os.Stdout)
+	if err != nil {
+		exitWithError(exitBadArgs, err)
+	}
+	return p
+}
+
+// kvOpts returns the call options selecting the keyspace of key-value
+// commands.
+func (g *globalFlags) kvOpts() []client.CallOption {
+	if g.keyspace == "" {
+		return nil
+	}
+	return []client.CallOption{client.WithKeyspace(g.keyspace)}
+}
+
+func (g *globalFlags) commandCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), g.commandTimeout)
+}
+
+type command struct {
+	usage string
+	// flags registers command specific flags.
+	flags func(fs *flag.FlagSet)
+	run   func(g *globalFlags, args []string)
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"get":                getCommand(),
+		"put":                putCommand(),
+		"del":                delCommand(),
+		"watch":              watchCommand(),
+		"txn":                txnCommand(),
+		"member list":        memberListCommand(),
+		"member add":         memberAddCommand(),
+		"member remove":      memberRemoveCommand(),
+		"member promote":     memberPromoteCommand(),
+		"member update":      memberUpdateCommand(),
+		"member replace":     memberReplaceCommand(),
+		"endpoint health":    endpointHealthCommand(),
+		"alarm list":         alarmListCommand(),
+		"alarm disarm":       alarmDisarmCommand(),
+		"snapshot save":      snapshotSaveCommand(),
+		"snapshot export":    snapshotExportCommand(),
+		"snapshot verify":    snapshotVerifyCommand(),
+		"import":             importCommand(),
+		"verify":             verifyCommand(),
+		"defrag":             defragCommand(),
+		"encryption list":    encryptionListCommand(),
+		"encryption rotate":  encryptionRotateCommand(),
+		"encryption destroy": encryptionDestroyCommand(),
+		"bench replay":       benchReplayCommand(),
+		"keyspace list":      keyspaceListCommand(),
+		"keyspace create":    keyspaceCreateCommand(),
+		"keyspace delete":    keyspaceDeleteCommand(),
+		"mount":              mountCommand(),
+		"make-mirror":        makeMirrorCommand(),
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: metcdctl [global flags] <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, name := range sortedCommandNames() {
+		fmt.Fprintf(os.Stderr, "  %-18s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nglobal flags:")
+	fs := flag.NewFlagSet("metcdctl", flag.ContinueOnError)
+	(&globalFlags{}).register(fs)
+	fs.SetOutput(os.Stderr)
+	fs.PrintDefaults()
+}
+
+func main() {
+	var g globalFlags
+	fs := flag.NewFlagSet("metcdctl", flag.ContinueOnError)
+	g.register(fs)
+	fs.Usage = usage
+
+	// global flags may come before the command; command flags are parsed
+	// together with the global ones so they may appear anywhere.
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(exitBadArgs)
+	}
+	args := fs.Args()
+	name, cmd, args := lookupCommand(args)
+	if cmd == nil {
+		usage()
+		os.Exit(exitBadArgs)
+	}
+
+	// registering on cfs resets g to the defaults, so remember the flags
+	// seen before the command and re-apply them afterwards
+	seen := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { seen[f.Name] = f.Value.String() })
+	cfs := flag.NewFlagSet("metcdctl "+name, flag.ContinueOnError)
+	g.register(cfs)
+	for name, value := range seen {
+		cfs.Set(name, value)
+	}
+	if cmd.flags != nil {
+		cmd.flags(cfs)
+	}
+	cfs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: metcdctl %s\n", cmd.usage)
+		cfs.PrintDefaults()
+	}
+	args, err := parseInterspersed(cfs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(exitBadArgs)
+	}
+	cmd.run(&g, args)
+}
+
+// lookupCommand finds the longest command name made of the leading args.
+func lookupCommand(args []string) (string, *command, []string) {
+	for n := 2; n >= 1; n-- {
+		if len(args) < n {
+			continue
+		}
+		name := strings.Join(args[:n], " ")
+		if cmd, ok := commands[name]; ok {
+			return name, cmd, args[n:]
+		}
+	}
+	return "", nil, args
+}
+
+// parseInterspersed parses flags that may be mixed with positional
+// arguments and returns the positional ones. Everything after "--" is
+// positional.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for i, a := range args {
+		if a == "--" {
+			args, rest = args[:i], args[i+1:]
+			break
+		}
+	}
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+	return append(pos, rest...), nil
+}
+
+func exitWithError(code int, err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(code)
+}
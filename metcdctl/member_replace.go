@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"metcd/api"
+	"metcd/client"
+	"os"
+	"time"
+)
+
+// memberAPI is the part of client.Client used by member replace.
+type memberAPI interface {
+	MemberList(ctx context.Context, opts ...client.CallOption) ([]api.Member, error)
+	MemberAdd(ctx context.Context, id uint64, peerURL string, opts ...client.CallOption) error
+	MemberAddLearner(ctx context.Context, id uint64, peerURL string, opts ...client.CallOption) error
+	MemberPromote(ctx context.Context, id uint64, opts ...client.CallOption) error
+	MemberRemove(ctx context.Context, id uint64, opts ...client.CallOption) error
+	Health(ctx context.Context, opts ...client.CallOption) (*api.Health, error)
+}
+
+// force is passed to every membership change: the replacement passes
+// through an even number of voters on purpose and ends with as many voters
+// as it started with.
+var force = client.WithForce()
+
+// replacer replaces member oldID with newID at newPeerURL, checking the
+// cluster health between every step.
+type replacer struct {
+	cluster memberAPI
+	// newMember checks the health of the new member once it is started.
+	// Nil skips that check.
+	newMember func(ctx context.Context) (*api.Health, error)
+
+	oldID, newID uint64
+	newPeerURL   string
+	learner      bool
+
+	pollInterval time.Duration
+	out          io.Writer
+}
+
+func (r *replacer) logf(format string, args ...interface{}) {
+	fmt.Fprintf(r.out, format+"\n", args...)
+}
+
+func (r *replacer) clusterHealth(ctx context.Context) (*api.Health, error) {
+	return r.cluster.Health(ctx)
+}
+
+func (r *replacer) run(ctx context.Context) error {
+	members, err := r.cluster.MemberList(ctx)
+	if err != nil {
+		return err
+	}
+	if err := r.preflight(members); err != nil {
+		return err
+	}
+	if err := r.waitHealthy(ctx, "cluster", r.clusterHealth); err != nil {
+		return err
+	}
+	if r.learner {
+		return r.learnerReplace(ctx)
+	}
+	return r.removeThenAdd(ctx)
+}
+
+func (r *replacer) preflight(members []api.Member) error {
+	voters := 0
+	var old, existing *api.Member
+	for i := range members {
+		if !members[i].IsLearner {
+			voters++
+		}
+		if members[i].ID == r.oldID {
+			old = &members[i]
+		}
+		if members[i].ID == r.newID {
+			existing = &members[i]
+		}
+	}
+	if old == nil {
+		return fmt.Errorf("member %d not found", r.oldID)
+	}
+	if r.learner {
+		if r.newID == r.oldID {
+			return errors.New("--learner needs a --new-id different from the replaced member")
+		}
+		if existing != nil {
+			return fmt.Errorf("member %d already exists", r.newID)
+		}
+		if r.newMember == nil {
+			return errors.New("--learner needs --new-endpoint to know when the learner caught up")
+		}
+		return nil
+	}
+	if existing != nil && existing.ID != r.oldID {
+		return fmt.Errorf("member %d already exists", r.newID)
+	}
+	if !old.IsLearner && voters <= 2 {
+		// removing one of two voters leaves a cluster that cannot commit the add
+		return fmt.Errorf("removing member %d from %d voters loses quorum; use --learner", r.oldID, voters)
+	}
+	return nil
+}
+
+func (r *replacer) removeThenAdd(ctx context.Context) error {
+	r.logf("removing member %d", r.oldID)
+	if err := r.cluster.MemberRemove(ctx, r.oldID, force); err != nil {
+		return err
+	}
+	if err := r.waitMembers(ctx, fmt.Sprintf("member %d to be removed", r.oldID), func(ms []api.Member) bool {
+		return findMember(ms, r.oldID) == nil
+	}); err != nil {
+		return err
+	}
+	if err := r.waitHealthy(ctx, "cluster", r.clusterHealth); err != nil {
+		return err
+	}
+
+	r.logf("adding member %d with peer URL %s", r.newID, r.newPeerURL)
+	if err := r.cluster.MemberAdd(ctx, r.newID, r.newPeerURL, force); err != nil {
+		return err
+	}
+	if err := r.waitMembers(ctx, fmt.Sprintf("member %d to be added", r.newID), func(ms []api.Member) bool {
+		return findMember(ms, r.newID) != nil
+	}); err != nil {
+		return err
+	}
+	r.logf("start the new member with --id %d --join", r.newID)
+	if r.newMember != nil {
+		if err := r.waitHealthy(ctx, "new member", r.newMember); err != nil {
+			return err
+		}
+	}
+	return r.waitHealthy(ctx, "cluster", r.clusterHealth)
+}
+
+func (r *replacer) learnerReplace(ctx context.Context) error {
+	r.logf("adding learner %d with peer URL %s", r.newID, r.newPeerURL)
+	if err := r.cluster.MemberAddLearner(ctx, r.newID, r.newPeerURL, force); err != nil {
+		return err
+	}
+	if err := r.waitMembers(ctx, fmt.Sprintf("learner %d to be added", r.newID), func(ms []api.Member) bool {
+		return findMember(ms, r.newID) != nil
+	}); err != nil {
+		return err
+	}
+	r.logf("start the new member with --id %d --join", r.newID)
+	// a learner answers a linearizable read once it caught up with the leader
+	if err := r.waitHealthy(ctx, "new member", r.newMember); err != nil {
+		return err
+	}
+
+	r.logf("promoting learner %d", r.newID)
+	if err := r.cluster.MemberPromote(ctx, r.newID, force); err != nil {
+		return err
+	}
+	if err := r.waitMembers(ctx, fmt.Sprintf("member %d to be promoted", r.newID), func(ms []api.Member) bool {
+		m := findMember(ms, r.newID)
+		return m != nil && !m.IsLearner
+	}); err != nil {
+		return err
+	}
+	if err := r.waitHealthy(ctx, "cluster", r.clusterHealth); err != nil {
+		return err
+	}
+
+	r.logf("removing member %d", r.oldID)
+	if err := r.cluster.MemberRemove(ctx, r.oldID, force); err != nil {
+		return err
+	}
+	if err := r.waitMembers(ctx, fmt.Sprintf("member %d to be removed", r.oldID), func(ms []api.Member) bool {
+		return findMember(ms, r.oldID) == nil
+	}); err != nil {
+		return err
+	}
+	return r.waitHealthy(ctx, "cluster", r.clusterHealth)
+}
+
+func (r *replacer) waitHealthy(ctx context.Context, what string, health func(context.Context) (*api.Health, error)) error {
+	return r.poll(ctx, what+" to be healthy", func() (bool, error) {
+		h, err := health(ctx)
+		if err != nil {
+			// the member may not be reachable yet
+			return false, nil
+		}
+		return h.Health, nil
+	})
+}
+
+func (r *replacer) waitMembers(ctx context.Context, what string, done func([]api.Member) bool) error {
+	return r.poll(ctx, what, func() (bool, error) {
+		ms, err := r.cluster.MemberList(ctx)
+		if err != nil {
+			return false, nil
+		}
+		return done(ms), nil
+	})
+}
+
+func (r *replacer) poll(ctx context.Context, what string, cond func() (bool, error)) error {
+	r.logf("waiting for %s", what)
+	for {
+		ok, err := cond()
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-time.After(r.pollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s (%v)", what, ctx.Err())
+		}
+	}
+}
+
+func findMember(ms []api.Member, id uint64) *api.Member {
+	for i := range ms {
+		if ms[i].ID == id {
+			return &ms[i]
+		}
+	}
+	return nil
+}
+
+func memberReplaceCommand() *command {
+	const usage = "member replace <old-id> --new-peer-url=<url> [--new-id=<id>] [--new-endpoint=<url>] [--learner]"
+	var (
+		newPeerURL  string
+		newID       uint64
+		newEndpoint string
+		learner     bool
+		timeout     time.Duration
+	)
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&newPeerURL, "new-peer-url", "", "peer URL of the replacement member")
+			fs.Uint64Var(&newID, "new-id", 0, "ID of the replacement member (default: the replaced member's ID)")
+			fs.StringVar(&newEndpoint, "new-endpoint", "", "client URL of the replacement member, used for health checks")
+			fs.BoolVar(&learner, "learner", false, "add the replacement as a learner and promote it before removing the old member")
+			fs.DurationVar(&timeout, "wait-timeout", 10*time.Minute, "timeout for the whole replacement")
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			oldID := parseMemberID(args[0])
+			if newPeerURL == "" {
+				exitWithError(exitBadArgs, errors.New("--new-peer-url is required"))
+			}
+			if newID == 0 {
+				newID = oldID
+			}
+			c := g.newClient()
+			defer c.Close()
+			r := &replacer{
+				cluster:      c,
+				oldID:        oldID,
+				newID:        newID,
+				newPeerURL:   newPeerURL,
+				learner:      learner,
+				pollInterval: 500 * time.Millisecond,
+				out:          os.Stdout,
+			}
+			if newEndpoint != "" {
+				r.newMember = func(ctx context.Context) (*api.Health, error) {
+					return endpointHealth(g, newEndpoint)
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := r.run(ctx); err != nil {
+				exitWithError(exitError, err)
+			}
+			r.logf("member %d replaced by member %d", oldID, newID)
+		},
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"metcd/api"
+	"metcd/client"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeCluster applies membership changes immediately and records them.
+type fakeCluster struct {
+	members []api.Member
+	calls   []string
+}
+
+func (f *fakeCluster) MemberList(context.Context, ...client.CallOption) ([]api.Member, error) {
+	return append([]api.Member(nil), f.members...), nil
+}
+
+func (f *fakeCluster) MemberAdd(_ context.Context, id uint64, url string, _ ...client.CallOption) error {
+	f.calls = append(f.calls, "add")
+	f.members = append(f.members, api.Member{ID: id, PeerURL: url})
+	return nil
+}
+
+func (f *fakeCluster) MemberAddLearner(_ context.Context, id uint64, url string, _ ...client.CallOption) error {
+	f.calls = append(f.calls, "add-learner")
+	f.members = append(f.members, api.Member{ID: id, PeerURL: url, IsLearner: true})
+	return nil
+}
+
+func (f *fakeCluster) MemberPromote(_ context.Context, id uint64, _ ...client.CallOption) error {
+	f.calls = append(f.calls, "promote")
+	findMember(f.members, id).IsLearner = false
+	return nil
+}
+
+func (f *fakeCluster) MemberRemove(_ context.Context, id uint64, _ ...client.CallOption) error {
+	f.calls = append(f.calls, "remove")
+	for i := range f.members {
+		if f.members[i].ID == id {
+			f.members = append(f.members[:i], f.members[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeCluster) Health(context.Context, ...client.CallOption) (*api.Health, error) {
+	return &api.Health{Health: true, Leader: 1}, nil
+}
+
+func threeMembers() []api.Member {
+	return []api.Member{{ID: 1, IsLeader: true}, {ID: 2}, {ID: 3}}
+}
+
+func TestMemberReplace(t *testing.T) {
+	healthy := func(context.Context) (*api.Health, error) { return &api.Health{Health: true}, nil }
+	cases := []struct {
+		name      string
+		r         replacer
+		wantCalls []string
+		wantIDs   []uint64
+	}{
+		{
+			name:      "remove then add",
+			r:         replacer{oldID: 3, newID: 3},
+			wantCalls: []string{"remove", "add"},
+			wantIDs:   []uint64{1, 2, 3},
+		},
+		{
+			name:      "learner",
+			r:         replacer{oldID: 3, newID: 4, learner: true, newMember: healthy},
+			wantCalls: []string{"add-learner", "promote", "remove"},
+			wantIDs:   []uint64{1, 2, 4},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeCluster{members: threeMembers()}
+			r := tc.r
+			r.cluster, r.newPeerURL, r.pollInterval, r.out = f, "http://127.0.0.1:42379", time.Millisecond, io.Discard
+			if err := r.run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(f.calls, tc.wantCalls) {
+				t.Fatalf("expected calls %v, got %v", tc.wantCalls, f.calls)
+			}
+			var ids []uint64
+			for _, m := range f.members {
+				if m.IsLearner {
+					t.Fatalf("member %d is still a learner", m.ID)
+				}
+				ids = append(ids, m.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.wantIDs) {
+				t.Fatalf("expected members %v, got %v", tc.wantIDs, ids)
+			}
+		})
+	}
+}
+
+func TestMemberReplacePreflight(t *testing.T) {
+	cases := []struct {
+		name    string
+		members []api.Member
+		r       replacer
+	}{
+		{"unknown member", threeMembers(), replacer{oldID: 5, newID: 5}},
+		{"quorum loss", []api.Member{{ID: 1}, {ID: 2}}, replacer{oldID: 2, newID: 2}},
+		{"learner reusing id", threeMembers(), replacer{oldID: 3, newID: 3, learner: true}},
+		{"learner without endpoint", threeMembers(), replacer{oldID: 3, newID: 4, learner: true}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeCluster{members: tc.members}
+			r := tc.r
+			r.cluster, r.pollInterval, r.out = f, time.Millisecond, io.Discard
+			if err := r.run(context.Background()); err == nil {
+				t.Fatal("expected preflight error")
+			}
+			if len(f.calls) != 0 {
+				t.Fatalf("expected no membership change, got %v", f.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"metcd/api"
+	"metcd/client"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mirrorSource is the part of client.Client the mirror reads from.
+type mirrorSource interface {
+	Export(ctx context.Context, format string, opts ...client.CallOption) (io.ReadCloser, int64, error)
+	Watch(ctx context.Context, key string, prefix bool, opts ...client.CallOption) (<-chan api.Event, error)
+}
+
+// mirrorDest is the part of client.Client the mirror writes to.
+type mirrorDest interface {
+	GetKV(ctx context.Context, key string, opts ...client.CallOption) (*api.KeyValue, error)
+	Txn(ctx context.Context, txn *api.TxnRequest, opts ...client.CallOption) (*api.TxnResponse, error)
+}
+
+// mirrorFlushDelay is how long the events of a revision are collected once
+// no more arrive before they are written.
+const mirrorFlushDelay = 10 * time.Millisecond
+
+// clusterMirror copies the keys with prefix of the source cluster to the
+// destination and then keeps applying their changes, one transaction per
+// revision. Every transaction also puts the source revision it is done
+// with in checkpointKey of the destination, so a restarted mirror resumes
+// there; without a checkpoint, or once the source compacted it, the keys
+// are copied again.
+type clusterMirror struct {
+	src mirrorSource
+	dst mirrorDest
+	// srcOpts and dstOpts select the keyspaces
+	srcOpts, dstOpts []client.CallOption
+
+	prefix string
+	// destPrefix replaces prefix in the keys written, unless it is empty
+	destPrefix    string
+	checkpointKey string
+	maxTxnOps     int
+
+	retryInterval time.Duration
+	out           io.Writer
+}
+
+func (m *clusterMirror) logf(format string, args ...interface{}) {
+	fmt.Fprintf(m.out, format+"\n", args...)
+}
+
+// destKey returns the key key of the source is written to, false if it is
+// not mirrored.
+func (m *clusterMirror) destKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, m.prefix) || key == m.checkpointKey {
+		// the checkpoint of a mirror of the source is not copied, it would
+		// overwrite this one's
+		return "", false
+	}
+	if m.destPrefix != "" {
+		key = m.destPrefix + strings.TrimPrefix(key, m.prefix)
+	}
+	return key, true
+}
+
+// checkpoint returns the revision of the source the destination has, 0 if
+// it has none.
+func (m *clusterMirror) checkpoint(ctx context.Context) (int64, error) {
+	kv, err := m.dst.GetKV(ctx, m.checkpointKey, m.dstOpts...)
+	if errors.Is(err, client.ErrKeyNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	rev, err := strconv.ParseInt(kv.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid checkpoint %q in %s", kv.Value, m.checkpointKey)
+	}
+	return rev, nil
+}
+
+// write applies ops to the destination and checkpoints rev.
+func (m *clusterMirror) write(ctx context.Context, ops []api.Op, rev int64) error {
+	ops = append(ops, api.Op{Type: api.OpPut, Key: m.checkpointKey, Value: strconv.FormatInt(rev, 10)})
+	_, err := m.dst.Txn(ctx, &api.TxnRequest{Success: ops}, m.dstOpts...)
+	return err
+}
+
+// sync copies the keys with prefix of the source and returns their
+// revision. Keys of the destination missing from the source are left
+// alone.
+func (m *clusterMirror) sync(ctx context.Context) (int64, error) {
+	r, rev, err := m.src.Export(ctx, client.ExportJSON, m.srcOpts...)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var ops []api.Op
+	keys := 0
+	for {
+		var kv api.KeyValue
+		if err := dec.Decode(&kv); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		key, ok := m.destKey(kv.Key)
+		if !ok {
+			continue
+		}
+		ops = append(ops, api.Op{Type: api.OpPut, Key: key, Value: kv.Value})
+		keys++
+		if len(ops) >= m.maxTxnOps {
+			// the checkpoint stays before the copy until its last batch
+			if _, err := m.dst.Txn(ctx, &api.TxnRequest{Success: ops}, m.dstOpts...); err != nil {
+				return 0, err
+			}
+			ops = nil
+		}
+	}
+	if err := m.write(ctx, ops, rev); err != nil {
+		return 0, err
+	}
+	m.logf("copied %d keys at revision %d", keys, rev)
+	return rev, nil
+}
+
+// run mirrors until ctx is done, retrying after the errors of either
+// cluster.
+func (m *clusterMirror) run(ctx context.Context) error {
+	rev, err := m.checkpoint(ctx)
+	for {
+		if err == nil {
+			if rev == 0 {
+				rev, err = m.sync(ctx)
+			}
+			if err == nil {
+				rev, err = m.tail(ctx, rev)
+			}
+			if errors.Is(err, client.ErrCompacted) {
+				m.logf("revision %d is compacted on the source, copying the keys again", rev)
+				rev, err = 0, nil
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			m.logf("mirroring failed at revision %d, retrying (%v)", rev, err)
+		}
+		select {
+		case <-time.After(m.retryInterval):
+		case <-ctx.Done():
+			return nil
+		}
+		if rev == 0 {
+			rev, err = m.checkpoint(ctx)
+		} else {
+			err = nil
+		}
+	}
+}
+
+// tail applies the changes of the source after rev until the watch ends,
+// and returns the revision the destination has.
+func (m *clusterMirror) tail(ctx context.Context, rev int64) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events, err := m.src.Watch(ctx, m.prefix, true, append([]client.CallOption{client.WithSince(rev)}, m.srcOpts...)...)
+	if err != nil {
+		return rev, err
+	}
+	var (
+		ops     []api.Op
+		opsRev  int64 // the revision of ops
+		written = rev
+		flush   = time.NewTimer(mirrorFlushDelay)
+	)
+	flush.Stop()
+	defer flush.Stop()
+	// send writes ops; with complete unset more changes of their revision
+	// may follow, so the checkpoint stays before it.
+	send := func(complete bool) error {
+		if len(ops) == 0 {
+			return nil
+		}
+		done := opsRev
+		if !complete {
+			done--
+		}
+		if err := m.write(ctx, ops, done); err != nil {
+			return err
+		}
+		written, ops = done, nil
+		return nil
+	}
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				if err := send(false); err != nil {
+					return written, err
+				}
+				return written, errors.New("watch of the source ended")
+			}
+			if ev.ModRevision != opsRev || len(ops) >= m.maxTxnOps {
+				if err := send(ev.ModRevision != opsRev); err != nil {
+					return written, err
+				}
+			}
+			opsRev = ev.ModRevision
+			key, ok := m.destKey(ev.Key)
+			if !ok {
+				continue
+			}
+			op := api.Op{Type: api.OpPut, Key: key, Value: ev.Value}
+			if ev.Type == api.EventDelete {
+				op = api.Op{Type: api.OpDelete, Key: key}
+			}
+			ops = append(ops, op)
+			flush.Reset(mirrorFlushDelay)
+		case <-flush.C:
+			if err := send(false); err != nil {
+				return written, err
+			}
+		case <-ctx.Done():
+			return written, ctx.Err()
+		}
+	}
+}
+
+func makeMirrorCommand() *command {
+	const usage = "make-mirror <destination> [--prefix=<prefix>] [--dest-prefix=<prefix>] [--checkpoint-key=<key>] [--max-txn-ops=<n>]"
+	var (
+		prefix, destPrefix string
+		checkpointKey      string
+		maxTxnOps          int
+	)
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&prefix, "prefix", "", "mirror only the keys with this prefix")
+			fs.StringVar(&destPrefix, "dest-prefix", "", "replace --prefix with this prefix in the destination")
+			fs.StringVar(&checkpointKey, "checkpoint-key", "/.metcd-mirror/revision", "key of the destination holding the source revision mirrored, to resume from")
+			fs.IntVar(&maxTxnOps, "max-txn-ops", 128, "maximum number of changes written in one transaction")
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			if maxTxnOps <= 0 {
+				exitWithError(exitBadArgs, errors.New("--max-txn-ops must be positive"))
+			}
+			tlsCfg, err := g.tlsConfig()
+			if err != nil {
+				exitWithError(exitBadArgs, err)
+			}
+			dst, err := client.New(client.Config{Endpoints: strings.Split(args[0], ","), TLS: tlsCfg, DialTimeout: g.dialTimeout})
+			if err != nil {
+				exitWithError(exitBadConnect, err)
+			}
+			defer dst.Close()
+			src := g.newClient()
+			defer src.Close()
+			m := &clusterMirror{
+				src:           src,
+				dst:           dst,
+				srcOpts:       g.kvOpts(),
+				dstOpts:       g.kvOpts(),
+				prefix:        prefix,
+				destPrefix:    destPrefix,
+				checkpointKey: checkpointKey,
+				maxTxnOps:     maxTxnOps,
+				retryInterval: time.Second,
+				out:           os.Stdout,
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer cancel()
+			if err := m.run(ctx); err != nil {
+				exitWithError(exitError, err)
+			}
+		},
+	}
+}
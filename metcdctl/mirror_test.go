@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"metcd/api"
+	"metcd/client"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSource struct {
+	kvs    []api.KeyValue
+	rev    int64
+	events chan api.Event
+	// compacted fails the next watch with ErrCompacted
+	compacted bool
+}
+
+func (f *fakeSource) Export(context.Context, string, ...client.CallOption) (io.ReadCloser, int64, error) {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	for _, kv := range f.kvs {
+		enc.Encode(kv)
+	}
+	return io.NopCloser(strings.NewReader(b.String())), f.rev, nil
+}
+
+func (f *fakeSource) Watch(ctx context.Context, key string, prefix bool, opts ...client.CallOption) (<-chan api.Event, error) {
+	if f.compacted {
+		f.compacted = false
+		return nil, client.ErrCompacted
+	}
+	return f.events, nil
+}
+
+type fakeDest struct {
+	mu  sync.Mutex
+	kvs map[string]string
+}
+
+func (f *fakeDest) GetKV(_ context.Context, key string, _ ...client.CallOption) (*api.KeyValue, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.kvs[key]
+	if !ok {
+		return nil, client.ErrKeyNotFound
+	}
+	return &api.KeyValue{Key: key, Value: v}, nil
+}
+
+func (f *fakeDest) Txn(_ context.Context, txn *api.TxnRequest, _ ...client.CallOption) (*api.TxnResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, op := range txn.Success {
+		if op.Type == api.OpDelete {
+			delete(f.kvs, op.Key)
+		} else {
+			f.kvs[op.Key] = op.Value
+		}
+	}
+	return &api.TxnResponse{Succeeded: true}, nil
+}
+
+func (f *fakeDest) get(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.kvs[key]
+}
+
+func TestMirror(t *testing.T) {
+	src := &fakeSource{
+		kvs:    []api.KeyValue{{Key: "/app/a", Value: "1"}, {Key: "/app/b", Value: "2"}, {Key: "/other", Value: "x"}},
+		rev:    5,
+		events: make(chan api.Event),
+	}
+	dst := &fakeDest{kvs: make(map[string]string)}
+	m := &clusterMirror{src: src, dst: dst, prefix: "/app/", destPrefix: "/dr/", checkpointKey: "/ckpt", maxTxnOps: 1, retryInterval: time.Millisecond, out: io.Discard}
+	ctx, cancel := context.WithCancel(context.Background())
+	donec := make(chan error)
+	go func() { donec <- m.run(ctx) }()
+
+	// a transaction of two keys, then a delete
+	src.events <- api.Event{Type: api.EventPut, Key: "/app/c", Value: "3", ModRevision: 6}
+	src.events <- api.Event{Type: api.EventPut, Key: "/app/d", Value: "4", ModRevision: 6}
+	src.events <- api.Event{Type: api.EventDelete, Key: "/app/a", ModRevision: 7}
+	// revision 7 may have more changes, so it is replayed after a restart
+	deadline := time.Now().Add(5 * time.Second)
+	for dst.get("/dr/a") != "" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-donec; err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/dr/b": "2", "/dr/c": "3", "/dr/d": "4", "/ckpt": "6"}
+	if len(dst.kvs) != len(want) {
+		t.Fatalf("expected %v, got %v", want, dst.kvs)
+	}
+	for k, v := range want {
+		if dst.kvs[k] != v {
+			t.Fatalf("expected %v, got %v", want, dst.kvs)
+		}
+	}
+
+	// a restarted mirror resumes from the checkpoint, copying the keys again
+	// would bring /dr/a back
+	src.events = make(chan api.Event)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { donec <- m.run(ctx) }()
+	src.events <- api.Event{Type: api.EventDelete, Key: "/app/a", ModRevision: 7}
+	src.events <- api.Event{Type: api.EventPut, Key: "/app/e", Value: "5", ModRevision: 8}
+	for dst.get("/dr/e") != "5" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-donec
+	if dst.get("/dr/e") != "5" || dst.get("/dr/a") != "" || dst.get("/ckpt") != "7" {
+		t.Fatalf("expected /dr/e put after the checkpoint, got %v", dst.kvs)
+	}
+}
+
+func TestMirrorCompacted(t *testing.T) {
+	src := &fakeSource{kvs: []api.KeyValue{{Key: "/a", Value: "1"}}, rev: 9, compacted: true}
+	dst := &fakeDest{kvs: map[string]string{"/ckpt": "2"}}
+	m := &clusterMirror{src: src, dst: dst, checkpointKey: "/ckpt", maxTxnOps: 10, retryInterval: time.Millisecond, out: io.Discard}
+	ctx, cancel := context.WithCancel(context.Background())
+	donec := make(chan error)
+	go func() { donec <- m.run(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for dst.get("/ckpt") != "9" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-donec
+	if dst.get("/a") != "1" || dst.get("/ckpt") != "9" {
+		t.Fatalf("expected the keys to be copied again at revision 9, got %v", dst.kvs)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"metcd/api"
+	"metcd/client"
+	"metcd/fusefs"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func mountCommand() *command {
+	const usage = "mount <dir> [--prefix <key>]"
+	var prefix string
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&prefix, "prefix", "/", "serve the keys with this prefix, without it, as files")
+		},
+		run: func(g *globalFlags, args []string) {
+			expectArgs(args, 1, usage)
+			c := g.newClient()
+			defer c.Close()
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			m := &mirror{c: c, tree: fusefs.NewTree(), prefix: prefix, keyspace: g.keyspace,
+				opts: g.kvOpts(), timeout: g.commandTimeout}
+			events, cancel, err := m.sync(ctx)
+			if err != nil {
+				exitWithError(exitError, err)
+			}
+			srv, err := fusefs.Mount(args[0], m.tree)
+			if err != nil {
+				cancel()
+				exitWithError(exitError, err)
+			}
+			go m.run(ctx, events, cancel)
+			select {
+			case <-ctx.Done():
+			case <-srv.Done():
+			}
+			if err := srv.Close(); err != nil {
+				exitWithError(exitError, err)
+			}
+		},
+	}
+}
+
+// mirror keeps a fusefs.Tree equal to the keys with a prefix.
+type mirror struct {
+	c        *client.Client
+	tree     *fusefs.Tree
+	prefix   string
+	keyspace string
+	opts     []client.CallOption
+	timeout  time.Duration
+}
+
+// mountSnapshot holds the fields of a store snapshot the mount needs.
+type mountSnapshot struct {
+	KVs       map[string]string `json:"kvs"`
+	Binary    []mountBinaryKV   `json:"binary"`
+	Keyspaces []struct {
+		Name   string            `json:"name"`
+		KVs    map[string]string `json:"kvs"`
+		Binary []mountBinaryKV   `json:"binary"`
+	} `json:"keyspaces"`
+}
+
+type mountBinaryKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// sync watches the prefix and then fills the tree from a snapshot, so the
+// events of the watch bring it up to date from there.
+func (m *mirror) sync(ctx context.Context) (<-chan api.Event, context.CancelFunc, error) {
+	wctx, cancel := context.WithCancel(ctx)
+	events, err := m.c.Watch(wctx, m.prefix, true, m.opts...)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	files, err := m.snapshot(ctx)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	m.tree.Reset(files)
+	return events, cancel, nil
+}
+
+func (m *mirror) snapshot(ctx context.Context) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	rc, err := m.c.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var st mountSnapshot
+	if err := json.NewDecoder(rc).Decode(&st); err != nil {
+		return nil, fmt.Errorf("decoding snapshot: %v", err)
+	}
+	kvs, binary := st.KVs, st.Binary
+	if m.keyspace != "" {
+		kvs, binary = nil, nil
+		found := false
+		for _, ks := range st.Keyspaces {
+			if ks.Name == m.keyspace {
+				kvs, binary, found = ks.KVs, ks.Binary, true
+			}
+		}
+		if !found {
+			return nil, client.ErrKeyspaceNotFound
+		}
+	}
+	files := make(map[string][]byte, len(kvs)+len(binary))
+	for k, v := range kvs {
+		if path, ok := m.path(k); ok {
+			files[path] = []byte(v)
+		}
+	}
+	for _, kv := range binary {
+		if path, ok := m.path(string(kv.Key)); ok {
+			files[path] = kv.Value
+		}
+	}
+	return files, nil
+}
+
+// path returns the file name of key.
+func (m *mirror) path(key string) (string, bool) {
+	if !strings.HasPrefix(key, m.prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(key, m.prefix), true
+}
+
+// run applies events to the tree, and syncs it again whenever the watch
+// ends, until ctx is done.
+func (m *mirror) run(ctx context.Context, events <-chan api.Event, cancel context.CancelFunc) {
+	for {
+		for ev := range events {
+			path, ok := m.path(ev.Key)
+			if !ok {
+				continue
+			}
+			switch ev.Type {
+			case api.EventPut:
+				if !m.tree.Put(path, []byte(ev.Value)) {
+					fmt.Fprintf(os.Stderr, "Warning: key %q is not a valid file name\n", ev.Key)
+				}
+			case api.EventDelete:
+				m.tree.Delete(path)
+			}
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "Warning: watch closed, syncing again")
+		for {
+			var err error
+			if events, cancel, err = m.sync(ctx); err == nil {
+				break
+			}
+			fmt.Fprintln(os.Stderr, "Warning:", err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"metcd/api"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type printer interface {
+	Get(key, value string)
+	Put()
+	Del(deleted int)
+	Watch(ev api.Event)
+	Txn(resp *api.TxnResponse)
+	MemberList(members []api.Member)
+	MemberAdd(id uint64, peerURL string)
+	MemberRemove(id uint64)
+	MemberPromote(id uint64)
+	MemberUpdate(id uint64, peerURL string)
+	EndpointHealth(endpoint string, h *api.Health)
+	AlarmList(alarms []api.Alarm)
+	SnapshotSave(path string)
+	SnapshotExport(path string, rev int64)
+	SnapshotVerify(statuses []*snapshotStatus, diff *snapshotDiff)
+	Import(path string, progress *api.ImportProgress)
+	Verify(resp *api.VerifyResponse)
+	Defrag(endpoint string, resp *api.DefragResponse)
+	BenchReplay(results []*benchResult, elapsed time.Duration)
+	KeyspaceList(spaces []api.Keyspace)
+	KeyspaceCreate(name string, quota int64)
+	KeyspaceDelete(name string)
+	EncryptionList(keys []api.EncryptionKey)
+	EncryptionRotate(key *api.EncryptionKey)
+	EncryptionDestroy(prefix string)
+}
+
+func newPrinter(format string, w io.Writer) (printer, error) {
+	switch format {
+	case "simple":
+		return &simplePrinter{w: w}, nil
+	case "json":
+		return &jsonPrinter{enc: json.NewEncoder(w)}, nil
+	case "table":
+		return &tablePrinter{simplePrinter{w: w}}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+type simplePrinter struct {
+	w io.Writer
+}
+
+func (p *simplePrinter) Get(key, value string) { fmt.Fprintf(p.w, "%s\n%s\n", key, value) }
+func (p *simplePrinter) Put()                  { fmt.Fprintln(p.w, "OK") }
+func (p *simplePrinter) Del(deleted int)       { fmt.Fprintln(p.w, deleted) }
+
+func (p *simplePrinter) Watch(ev api.Event) {
+	fmt.Fprintln(p.w, ev.Type)
+	fmt.Fprintln(p.w, ev.Key)
+	if ev.Type == api.EventPut {
+		fmt.Fprintln(p.w, ev.Value)
+	}
+}
+
+func (p *simplePrinter) Txn(resp *api.TxnResponse) {
+	if resp.Succeeded {
+		fmt.Fprintln(p.w, "SUCCESS")
+	} else {
+		fmt.Fprintln(p.w, "FAILURE")
+	}
+	for _, r := range resp.Responses {
+		fmt.Fprintln(p.w)
+		switch r.Type {
+		case api.OpGet:
+			if r.Found {
+				p.Get(r.Key, r.Value)
+			}
+		case api.OpPut:
+			p.Put()
+		case api.OpDelete:
+			if r.Found {
+				p.Del(1)
+			} else {
+				p.Del(0)
+			}
+		}
+	}
+}
+
+func (p *simplePrinter) MemberList(members []api.Member) {
+	for _, m := range members {
+		fmt.Fprintf(p.w, "%d, %s, %v, %v\n", m.ID, m.PeerURL, m.IsLeader, m.IsLearner)
+	}
+}
+
+func (p *simplePrinter) MemberAdd(id uint64, peerURL string) {
+	fmt.Fprintf(p.w, "Member %d added to cluster with peer URL %s\n", id, peerURL)
+}
+
+func (p *simplePrinter) MemberRemove(id uint64) {
+	fmt.Fprintf(p.w, "Member %d removed from cluster\n", id)
+}
+
+func (p *simplePrinter) MemberPromote(id uint64) {
+	fmt.Fprintf(p.w, "Member %d promoted in cluster\n", id)
+}
+
+func (p *simplePrinter) MemberUpdate(id uint64, peerURL string) {
+	fmt.Fprintf(p.w, "Member %d updated in cluster with peer URL %s\n", id, peerURL)
+}
+
+func (p *simplePrinter) EndpointHealth(endpoint string, h *api.Health) {
+	if h.Health {
+		fmt.Fprintf(p.w, "%s is healthy: leader is %d\n", endpoint, h.Leader)
+	} else {
+		fmt.Fprintf(p.w, "%s is unhealthy: %s\n", endpoint, h.Reason)
+	}
+}
+
+func (p *simplePrinter) AlarmList(alarms []api.Alarm) {
+	for _, a := range alarms {
+		fmt.Fprintf(p.w, "memberID:%d alarm:%s\n", a.MemberID, a.Alarm)
+	}
+}
+
+func (p *simplePrinter) SnapshotSave(path string) {
+	fmt.Fprintf(p.w, "Snapshot saved at %s\n", path)
+}
+
+func (p *simplePrinter) SnapshotExport(path string, rev int64) {
+	fmt.Fprintf(p.w, "Exported revision %d to %s\n", rev, path)
+}
+
+func (p *simplePrinter) SnapshotVerify(statuses []*snapshotStatus, diff *snapshotDiff) {
+	for _, st := range statuses {
+		fmt.Fprintf(p.w, "%s: %s snapshot, %d bytes, sha256 %s\n", st.Path, st.Kind, st.Size, st.SHA256)
+		fmt.Fprintf(p.w, "revision:%d compactRevision:%d raftIndex:%d raftTerm:%d keys:%d keysSize:%d\n",
+			st.Revision, st.CompactRevision, st.RaftIndex, st.RaftTerm, st.Keys, st.KeysSize)
+		for _, ks := range st.Keyspaces {
+			if ks.Name != "" {
+				fmt.Fprintf(p.w, "keyspace:%s revision:%d compactRevision:%d keys:%d keysSize:%d\n",
+					ks.Name, ks.Revision, ks.CompactRevision, ks.Keys, ks.KeysSize)
+			}
+		}
+		if len(st.Voters)+len(st.Learners)+len(st.Observers) > 0 {
+			fmt.Fprintf(p.w, "voters:%v learners:%v observers:%v\n", st.Voters, st.Learners, st.Observers)
+		}
+		for _, problem := range st.Problems {
+			fmt.Fprintf(p.w, "problem: %s\n", problem)
+		}
+	}
+	if diff == nil {
+		return
+	}
+	for _, d := range []struct {
+		mark string
+		keys []snapshotKey
+	}{{"+", diff.Added}, {"-", diff.Removed}, {"~", diff.Changed}} {
+		for _, k := range d.keys {
+			if k.Keyspace != "" {
+				fmt.Fprintf(p.w, "%s %s %s\n", d.mark, k.Keyspace, k.Key)
+			} else {
+				fmt.Fprintf(p.w, "%s %s\n", d.mark, k.Key)
+			}
+		}
+	}
+	fmt.Fprintf(p.w, "%d added, %d removed, %d changed\n", len(diff.Added), len(diff.Removed), len(diff.Changed))
+}
+
+func (p *simplePrinter) Import(path string, progress *api.ImportProgress) {
+	fmt.Fprintf(p.w, "Imported %d keys (%d bytes) from %s at revision %d\n", progress.Keys, progress.Bytes, path, progress.Rev)
+}
+
+func (p *simplePrinter) Verify(resp *api.VerifyResponse) {
+	fmt.Fprintf(p.w, "Sent %d keys at revision %d, digest %s\n", resp.Keys, resp.Rev, resp.Digest)
+	if resp.Response != "" {
+		fmt.Fprintln(p.w, strings.TrimSuffix(resp.Response, "\n"))
+	}
+}
+
+func (p *simplePrinter) Defrag(endpoint string, resp *api.DefragResponse) {
+	fmt.Fprintf(p.w, "Finished defragmenting %s: snapshot at %d, removed %d WAL segments and %d snapshots, reclaimed %d bytes\n",
+		endpoint, resp.SnapshotIndex, resp.RemovedWALs, resp.RemovedSnapshots, resp.ReclaimedBytes)
+}
+
+func (p *simplePrinter) BenchReplay(results []*benchResult, elapsed time.Duration) {
+	total := 0
+	for _, r := range results {
+		total += r.Count
+		fmt.Fprintf(p.w, "%s: %d requests, %d errors, p50 %v, p90 %v, p99 %v, max %v\n",
+			r.Op, r.Count, r.Errors, r.P50, r.P90, r.P99, r.Max)
+	}
+	fmt.Fprintf(p.w, "replayed %d requests in %v (%.1f requests/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+}
+
+func (p *simplePrinter) KeyspaceList(spaces []api.Keyspace) {
+	for _, ks := range spaces {
+		name := ks.Name
+		if name == "" {
+			name = "(default)"
+		}
+		fmt.Fprintf(p.w, "%s keys:%d size:%d quota:%d rev:%d\n", name, ks.Keys, ks.Size, ks.Quota, ks.Rev)
+	}
+}
+
+func (p *simplePrinter) KeyspaceCreate(name string, quota int64) {
+	fmt.Fprintf(p.w, "Keyspace %s created with quota %d\n", name, quota)
+}
+
+func (p *simplePrinter) KeyspaceDelete(name string) {
+	fmt.Fprintf(p.w, "Keyspace %s deleted\n", name)
+}
+
+func (p *simplePrinter) EncryptionList(keys []api.EncryptionKey) {
+	for _, k := range keys {
+		fmt.Fprintf(p.w, "%s version:%d\n", k.Prefix, k.Version)
+	}
+}
+
+func (p *simplePrinter) EncryptionRotate(key *api.EncryptionKey) {
+	fmt.Fprintf(p.w, "Data key of %s at version %d\n", key.Prefix, key.Version)
+}
+
+func (p *simplePrinter) EncryptionDestroy(prefix string) {
+	fmt.Fprintf(p.w, "Data key of %s destroyed\n", prefix)
+}
+
+type jsonPrinter struct {
+	enc *json.Encoder
+}
+
+func (p *jsonPrinter) print(v interface{}) { p.enc.Encode(v) }
+
+func (p *jsonPrinter) Get(key, value string) {
+	p.print(map[string]string{"key": key, "value": value})
+}
+func (p *jsonPrinter) Put()                      { p.print(map[string]bool{"ok": true}) }
+func (p *jsonPrinter) Del(deleted int)           { p.print(map[string]int{"deleted": deleted}) }
+func (p *jsonPrinter) Watch(ev api.Event)        { p.print(ev) }
+func (p *jsonPrinter) Txn(resp *api.TxnResponse) { p.print(resp) }
+func (p *jsonPrinter) MemberList(members []api.Member) {
+	p.print(map[string][]api.Member{"members": members})
+}
+func (p *jsonPrinter) MemberAdd(id uint64, peerURL string) {
+	p.print(api.Member{ID: id, PeerURL: peerURL})
+}
+func (p *jsonPrinter) MemberRemove(id uint64)  { p.print(map[string]uint64{"removed": id}) }
+func (p *jsonPrinter) MemberPromote(id uint64) { p.print(map[string]uint64{"promoted": id}) }
+func (p *jsonPrinter) MemberUpdate(id uint64, peerURL string) {
+	p.print(api.Member{ID: id, PeerURL: peerURL})
+}
+func (p *jsonPrinter) EndpointHealth(endpoint string, h *api.Health) {
+	p.print(struct {
+		Endpoint string `json:"endpoint"`
+		*api.Health
+	}{endpoint, h})
+}
+func (p *jsonPrinter) AlarmList(alarms []api.Alarm) {
+	p.print(map[string][]api.Alarm{"alarms": alarms})
+}
+func (p *jsonPrinter) SnapshotSave(path string) {
+	p.print(map[string]string{"path": path})
+}
+
+func (p *jsonPrinter) SnapshotExport(path string, rev int64) {
+	p.print(struct {
+		Path     string `json:"path"`
+		Revision int64  `json:"revision"`
+	}{path, rev})
+}
+
+func (p *jsonPrinter) SnapshotVerify(statuses []*snapshotStatus, diff *snapshotDiff) {
+	p.print(struct {
+		Snapshots []*snapshotStatus `json:"snapshots"`
+		Diff      *snapshotDiff     `json:"diff,omitempty"`
+	}{statuses, diff})
+}
+
+func (p *jsonPrinter) Import(path string, progress *api.ImportProgress) {
+	p.print(struct {
+		Path string `json:"path"`
+		*api.ImportProgress
+	}{path, progress})
+}
+
+func (p *jsonPrinter) Verify(resp *api.VerifyResponse) { p.print(resp) }
+
+func (p *jsonPrinter) Defrag(endpoint string, resp *api.DefragResponse) {
+	p.print(struct {
+		Endpoint string `json:"endpoint"`
+		*api.DefragResponse
+	}{endpoint, resp})
+}
+
+func (p *jsonPrinter) BenchReplay(results []*benchResult, elapsed time.Duration) {
+	p.print(struct {
+		Elapsed time.Duration  `json:"elapsed"`
+		Results []*benchResult `json:"results"`
+	}{elapsed, results})
+}
+
+func (p *jsonPrinter) KeyspaceList(spaces []api.Keyspace) {
+	p.print(map[string][]api.Keyspace{"keyspaces": spaces})
+}
+func (p *jsonPrinter) KeyspaceCreate(name string, quota int64) {
+	p.print(api.Keyspace{Name: name, Quota: quota})
+}
+func (p *jsonPrinter) KeyspaceDelete(name string) {
+	p.print(map[string]string{"deleted": name})
+}
+func (p *jsonPrinter) EncryptionList(keys []api.EncryptionKey) {
+	p.print(map[string][]api.EncryptionKey{"keys": keys})
+}
+func (p *jsonPrinter) EncryptionRotate(key *api.EncryptionKey) {
+	p.print(key)
+}
+func (p *jsonPrinter) EncryptionDestroy(prefix string) {
+	p.print(map[string]string{"destroyed": prefix})
+}
+
+// tablePrinter renders list-like results as tables and falls back to the
+// simple format for everything else.
+type tablePrinter struct {
+	simplePrinter
+}
+
+func (p *tablePrinter) table(header []string, rows [][]string) {
+	tw := tabwriter.NewWriter(p.w, 0, 0, 1, ' ', tabwriter.Debug)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+}
+
+func (p *tablePrinter) Get(key, value string) {
+	p.table([]string{"KEY", "VALUE"}, [][]string{{key, value}})
+}
+
+func (p *tablePrinter) MemberList(members []api.Member) {
+	rows := make([][]string, 0, len(members))
+	for _, m := range members {
+		rows = append(rows, []string{fmt.Sprint(m.ID), m.PeerURL, fmt.Sprint(m.IsLeader), fmt.Sprint(m.IsLearner)})
+	}
+	p.table([]string{"ID", "PEER URL", "IS LEADER", "IS LEARNER"}, rows)
+}
+
+func (p *tablePrinter) AlarmList(alarms []api.Alarm) {
+	rows := make([][]string, 0, len(alarms))
+	for _, a := range alarms {
+		rows = append(rows, []string{fmt.Sprint(a.MemberID), string(a.Alarm)})
+	}
+	p.table([]string{"MEMBER ID", "ALARM"}, rows)
+}
+
+func (p *tablePrinter) BenchReplay(results []*benchResult, elapsed time.Duration) {
+	rows := make([][]string, 0, len(results))
+	for _, r := range results {
+		rows = append(rows, []string{r.Op, fmt.Sprint(r.Count), fmt.Sprint(r.Errors),
+			r.P50.String(), r.P90.String(), r.P99.String(), r.Max.String()})
+	}
+	p.table([]string{"OP", "COUNT", "ERRORS", "P50", "P90", "P99", "MAX"}, rows)
+}
+
+func (p *tablePrinter) KeyspaceList(spaces []api.Keyspace) {
+	rows := make([][]string, 0, len(spaces))
+	for _, ks := range spaces {
+		rows = append(rows, []string{ks.Name, fmt.Sprint(ks.Keys), fmt.Sprint(ks.Size), fmt.Sprint(ks.Quota), fmt.Sprint(ks.Rev)})
+	}
+	p.table([]string{"NAME", "KEYS", "SIZE", "QUOTA", "REV"}, rows)
+}
+
+func (p *tablePrinter) EncryptionList(keys []api.EncryptionKey) {
+	rows := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		rows = append(rows, []string{k.Prefix, fmt.Sprint(k.Version)})
+	}
+	p.table([]string{"PREFIX", "VERSION"}, rows)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"metcd/codec"
+	"metcd/encryption"
+	"os"
+	"sort"
+	"strings"
+
+	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
+	"go.uber.org/zap"
+)
+
+func snapshotVerifyCommand() *command {
+	const usage = "snapshot verify <file> [<other file>] [--encryption-at-rest <kms>]"
+	var kms string
+	return &command{
+		usage: usage,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&kms, "encryption-at-rest", "", "KMS of the member that wrote the snapshot, as its --encryption-at-rest, for snapshots encrypted at rest")
+		},
+		run: func(g *globalFlags, args []string) {
+			if len(args) != 1 && len(args) != 2 {
+				exitWithError(exitBadArgs, fmt.Errorf("usage: metcdctl %s", usage))
+			}
+			var atRest *encryption.AtRest
+			if kms != "" {
+				k, err := encryption.OpenKMS(kms)
+				if err != nil {
+					exitWithError(exitError, err)
+				}
+				if atRest, err = encryption.NewAtRest(k); err != nil {
+					exitWithError(exitError, err)
+				}
+			}
+			var (
+				statuses []*snapshotStatus
+				keys     []map[string]map[string]string
+			)
+			for _, path := range args {
+				st, kvs, err := readSnapshot(path, atRest)
+				if err != nil {
+					exitWithError(exitError, fmt.Errorf("%s: %w", path, err))
+				}
+				statuses, keys = append(statuses, st), append(keys, kvs)
+			}
+			var diff *snapshotDiff
+			if len(keys) == 2 {
+				diff = diffSnapshots(keys[0], keys[1])
+			}
+			g.printer().SnapshotVerify(statuses, diff)
+			for _, st := range statuses {
+				if len(st.Problems) > 0 {
+					exitWithError(exitError, fmt.Errorf("%s is inconsistent", st.Path))
+				}
+			}
+		},
+	}
+}
+
+// Kinds of snapshot files snapshot verify reads.
+const (
+	// snapshotClient is the store snapshot of `snapshot save`, GET /snapshot
+	snapshotClient = "client"
+	// snapshotRaft is a snapshot file of the snapshot directory of a member,
+	// <term>-<index>.snap, with its raft metadata
+	snapshotRaft = "raft"
+	// snapshotBackup is a snapshot backed up by --snapshot-backup,
+	// compressed or encrypted like the raft snapshots
+	snapshotBackup = "backup"
+)
+
+// snapshotStatus is what snapshot verify reports about a snapshot file.
+type snapshotStatus struct {
+	Path            string                   `json:"path"`
+	Kind            string                   `json:"kind"`
+	SHA256          string                   `json:"sha256"`
+	Size            int64                    `json:"size"`
+	Revision        int64                    `json:"revision"`
+	CompactRevision int64                    `json:"compactRevision"`
+	RaftIndex       uint64                   `json:"raftIndex,omitempty"`
+	RaftTerm        uint64                   `json:"raftTerm,omitempty"`
+	Keys            int                      `json:"keys"`
+	KeysSize        int64                    `json:"keysSize"`
+	Keyspaces       []snapshotKeyspaceStatus `json:"keyspaces"`
+	Voters          []uint64                 `json:"voters,omitempty"`
+	Learners        []uint64                 `json:"learners,omitempty"`
+	Observers       []uint64                 `json:"observers,omitempty"`
+	// Problems are the inconsistencies found, the snapshot is sound if
+	// there are none
+	Problems []string `json:"problems,omitempty"`
+}
+
+type snapshotKeyspaceStatus struct {
+	Name            string `json:"name"`
+	Revision        int64  `json:"revision"`
+	CompactRevision int64  `json:"compactRevision"`
+	Keys            int    `json:"keys"`
+	KeysSize        int64  `json:"keysSize"`
+}
+
+// snapshotDiff is the difference between the keys of two snapshots.
+type snapshotDiff struct {
+	Added   []snapshotKey `json:"added,omitempty"`
+	Removed []snapshotKey `json:"removed,omitempty"`
+	Changed []snapshotKey `json:"changed,omitempty"`
+}
+
+type snapshotKey struct {
+	Keyspace string `json:"keyspace,omitempty"`
+	Key      string `json:"key"`
+}
+
+// verifySnapshot holds the fields of a store snapshot snapshot verify
+// reads, those of kvstore's storeSnapshot.
+type verifySnapshot struct {
+	verifyKeyspace
+	RaftIndex uint64           `json:"raftIndex"`
+	Observers []uint64         `json:"observers"`
+	Keyspaces []verifyKeyspace `json:"keyspaces"`
+}
+
+type verifyKeyspace struct {
+	Name       string                   `json:"name"`
+	Rev        int64                    `json:"rev"`
+	CompactRev int64                    `json:"compactRev"`
+	KVs        map[string]string        `json:"kvs"`
+	Revs       map[string]verifyKeyRevs `json:"revs"`
+	Binary     []mountBinaryKV          `json:"binary"`
+	BinaryRevs []struct {
+		Key []byte `json:"key"`
+		verifyKeyRevs
+	} `json:"binaryRevs"`
+}
+
+type verifyKeyRevs struct {
+	Create int64 `json:"create"`
+	Mod    int64 `json:"mod"`
+}
+
+// readSnapshot reads and checks the snapshot file at path, and returns its
+// keys by keyspace. Snapshots encrypted at rest need atRest.
+func readSnapshot(path string, atRest *encryption.AtRest) (*snapshotStatus, map[string]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(data)
+	st := &snapshotStatus{Path: path, Kind: snapshotClient, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	if strings.HasSuffix(path, ".snap") {
+		// checks the crc of the file
+		s, err := snap.Read(zap.NewNop(), path)
+		if err != nil {
+			return nil, nil, err
+		}
+		st.Kind, data = snapshotRaft, s.Data
+		st.RaftIndex, st.RaftTerm = s.Metadata.Index, s.Metadata.Term
+		st.Voters, st.Learners = s.Metadata.ConfState.Voters, s.Metadata.ConfState.Learners
+	}
+	if encryption.IsSealedAtRest(data) {
+		if atRest == nil {
+			return nil, nil, errors.New("the snapshot is encrypted at rest, verify it with --encryption-at-rest")
+		}
+		if data, err = atRest.Open(data); err != nil {
+			return nil, nil, err
+		}
+		if st.Kind == snapshotClient {
+			st.Kind = snapshotBackup
+		}
+	}
+	if codec.IsEncoded(data) {
+		if data, err = codec.Decode(data); err != nil {
+			return nil, nil, fmt.Errorf("cannot decode the snapshot: %w", err)
+		}
+		if st.Kind == snapshotClient {
+			st.Kind = snapshotBackup
+		}
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, nil, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	var vs verifySnapshot
+	if _, ok := fields["kvs"]; ok {
+		if err := json.Unmarshal(data, &vs); err != nil {
+			return nil, nil, fmt.Errorf("invalid snapshot: %w", err)
+		}
+	} else if err := json.Unmarshal(data, &vs.KVs); err != nil {
+		// the snapshots of the first versions only hold the pairs
+		return nil, nil, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	st.Revision, st.CompactRevision, st.Observers = vs.Rev, vs.CompactRev, vs.Observers
+	if st.RaftIndex == 0 {
+		st.RaftIndex = vs.RaftIndex
+	} else if vs.RaftIndex > st.RaftIndex {
+		st.Problems = append(st.Problems, fmt.Sprintf("the store applied raft index %d, past the snapshot at %d", vs.RaftIndex, st.RaftIndex))
+	}
+	vs.Name = ""
+	keys := make(map[string]map[string]string)
+	for _, ks := range append([]verifyKeyspace{vs.verifyKeyspace}, vs.Keyspaces...) {
+		kvs := ks.KVs
+		if kvs == nil {
+			kvs = make(map[string]string)
+		}
+		for _, kv := range ks.Binary {
+			kvs[string(kv.Key)] = string(kv.Value)
+		}
+		revs := ks.Revs
+		if revs == nil {
+			revs = make(map[string]verifyKeyRevs)
+		}
+		for _, r := range ks.BinaryRevs {
+			revs[string(r.Key)] = r.verifyKeyRevs
+		}
+		st.Problems = append(st.Problems, checkKeyspace(ks, kvs, revs)...)
+		kst := snapshotKeyspaceStatus{Name: ks.Name, Revision: ks.Rev, CompactRevision: ks.CompactRev, Keys: len(kvs)}
+		for k, v := range kvs {
+			kst.KeysSize += int64(len(k) + len(v))
+		}
+		st.Keys += kst.Keys
+		st.KeysSize += kst.KeysSize
+		st.Keyspaces = append(st.Keyspaces, kst)
+		keys[ks.Name] = kvs
+	}
+	return st, keys, nil
+}
+
+// checkKeyspace returns the inconsistencies of the revisions of ks.
+func checkKeyspace(ks verifyKeyspace, kvs map[string]string, revs map[string]verifyKeyRevs) []string {
+	name := ks.Name
+	if name == "" {
+		name = "(default)"
+	}
+	var problems []string
+	if ks.CompactRev > ks.Rev {
+		problems = append(problems, fmt.Sprintf("keyspace %s: compacted at %d, past its revision %d", name, ks.CompactRev, ks.Rev))
+	}
+	var bad []string
+	for k, r := range revs {
+		switch {
+		case r.Mod > ks.Rev || r.Create > r.Mod:
+			bad = append(bad, fmt.Sprintf("keyspace %s: key %q created at %d and modified at %d, its revision is %d", name, k, r.Create, r.Mod, ks.Rev))
+		default:
+			if _, ok := kvs[k]; !ok {
+				bad = append(bad, fmt.Sprintf("keyspace %s: revisions of the missing key %q", name, k))
+			}
+		}
+	}
+	sort.Strings(bad)
+	return append(problems, bad...)
+}
+
+// diffSnapshots returns the keys added, removed and changed from a to b.
+func diffSnapshots(a, b map[string]map[string]string) *snapshotDiff {
+	var d snapshotDiff
+	for name, akvs := range a {
+		for k, v := range akvs {
+			if bv, ok := b[name][k]; !ok {
+				d.Removed = append(d.Removed, snapshotKey{name, k})
+			} else if bv != v {
+				d.Changed = append(d.Changed, snapshotKey{name, k})
+			}
+		}
+	}
+	for name, bkvs := range b {
+		for k := range bkvs {
+			if _, ok := a[name][k]; !ok {
+				d.Added = append(d.Added, snapshotKey{name, k})
+			}
+		}
+	}
+	for _, keys := range [][]snapshotKey{d.Added, d.Removed, d.Changed} {
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].Keyspace != keys[j].Keyspace {
+				return keys[i].Keyspace < keys[j].Keyspace
+			}
+			return bytes.Compare([]byte(keys[i].Key), []byte(keys[j].Key)) < 0
+		})
+	}
+	return &d
+}
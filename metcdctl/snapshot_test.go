@@ -0,0 +1,116 @@
+package main
+
+import (
+	"metcd/codec"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
+	"go.uber.org/zap"
+)
+
+const testStoreSnapshot = `{"rev":5,"compactRev":2,"kvs":{"a":"1","b":"22"},` +
+	`"revs":{"a":{"create":1,"mod":3,"version":2},"b":{"create":4,"mod":4,"version":1}},` +
+	`"keyspaces":[{"name":"tenant","rev":1,"compactRev":0,"kvs":{"c":"3"}}],"raftIndex":9,"observers":[3]}`
+
+func TestReadSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	client := filepath.Join(dir, "client.db")
+	if err := os.WriteFile(client, []byte(testStoreSnapshot), 0600); err != nil {
+		t.Fatal(err)
+	}
+	st, keys, err := readSnapshot(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Kind != snapshotClient || st.Revision != 5 || st.CompactRevision != 2 || st.RaftIndex != 9 ||
+		st.Keys != 3 || st.KeysSize != 7 || len(st.Problems) != 0 || !reflect.DeepEqual(st.Observers, []uint64{3}) {
+		t.Fatalf("client snapshot: %+v", st)
+	}
+	want := map[string]map[string]string{"": {"a": "1", "b": "22"}, "tenant": {"c": "3"}}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("keys = %v, want %v", keys, want)
+	}
+
+	// the raft snapshots of a member, compressed
+	gz, err := codec.Get(codec.Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := codec.Encode(gz, []byte(testStoreSnapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapdir := filepath.Join(dir, "snap")
+	if err := os.Mkdir(snapdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = snap.New(zap.NewNop(), snapdir).SaveSnap(raftpb.Snapshot{Data: data, Metadata: raftpb.SnapshotMetadata{
+		Index: 9, Term: 2, ConfState: raftpb.ConfState{Voters: []uint64{1, 2}, Learners: []uint64{3}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raft := filepath.Join(snapdir, "0000000000000002-0000000000000009.snap")
+	if st, _, err = readSnapshot(raft, nil); err != nil {
+		t.Fatal(err)
+	}
+	if st.Kind != snapshotRaft || st.RaftIndex != 9 || st.RaftTerm != 2 || st.Keys != 3 ||
+		!reflect.DeepEqual(st.Voters, []uint64{1, 2}) || !reflect.DeepEqual(st.Learners, []uint64{3}) {
+		t.Fatalf("raft snapshot: %+v", st)
+	}
+
+	// a flipped byte fails the crc of a raft snapshot
+	b, err := os.ReadFile(raft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+	if err := os.WriteFile(raft, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readSnapshot(raft, nil); err == nil {
+		t.Fatal("read a corrupted raft snapshot")
+	}
+
+	legacy := filepath.Join(dir, "legacy.db")
+	if err := os.WriteFile(legacy, []byte(`{"a":"1"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if st, keys, err = readSnapshot(legacy, nil); err != nil {
+		t.Fatal(err)
+	}
+	if st.Keys != 1 || keys[""]["a"] != "1" {
+		t.Fatalf("legacy snapshot: %+v", st)
+	}
+
+	bad := filepath.Join(dir, "bad.db")
+	inconsistent := strings.Replace(testStoreSnapshot, `"mod":4`, `"mod":6`, 1)
+	if err := os.WriteFile(bad, []byte(inconsistent), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if st, _, err = readSnapshot(bad, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Problems) != 1 || !strings.Contains(st.Problems[0], `"b"`) {
+		t.Fatalf("problems = %q", st.Problems)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	a := map[string]map[string]string{"": {"a": "1", "b": "2"}, "tenant": {"c": "3"}}
+	b := map[string]map[string]string{"": {"a": "1", "b": "3", "d": "4"}}
+	got := diffSnapshots(a, b)
+	want := &snapshotDiff{
+		Added:   []snapshotKey{{"", "d"}},
+		Removed: []snapshotKey{{"tenant", "c"}},
+		Changed: []snapshotKey{{"", "b"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("diff = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"metcd/api"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// compareRe matches compares written like etcdctl, e.g. value("foo") = "bar"
+// or mod("foo") < 42.
+var compareRe = regexp.MustCompile(`^\s*(value|exists|create|mod|version)\("((?:[^"\\]|\\.)*)"\)\s*(=|!=|>|<)\s*(.+?)\s*$`)
+
+// parseTxn reads a txn as etcdctl does: compares, success requests and
+// failure requests, each section terminated by an empty line.
+func parseTxn(r io.Reader) (*api.TxnRequest, error) {
+	sc := bufio.NewScanner(r)
+	section := func() []string {
+		var lines []string
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" {
+				break
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+
+	txn := &api.TxnRequest{}
+	for _, line := range section() {
+		c, err := parseCompare(line)
+		if err != nil {
+			return nil, err
+		}
+		txn.Compare = append(txn.Compare, c)
+	}
+	var err error
+	if txn.Success, err = parseOps(section()); err != nil {
+		return nil, err
+	}
+	if txn.Failure, err = parseOps(section()); err != nil {
+		return nil, err
+	}
+	return txn, sc.Err()
+}
+
+func parseCompare(line string) (api.Compare, error) {
+	m := compareRe.FindStringSubmatch(line)
+	if m == nil {
+		return api.Compare{}, fmt.Errorf("malformed compare %q", line)
+	}
+	key, err := strconv.Unquote(`"` + m[2] + `"`)
+	if err != nil {
+		return api.Compare{}, fmt.Errorf("malformed compare %q (%v)", line, err)
+	}
+	value := m[4]
+	if strings.HasPrefix(value, `"`) {
+		if value, err = strconv.Unquote(value); err != nil {
+			return api.Compare{}, fmt.Errorf("malformed compare %q (%v)", line, err)
+		}
+	}
+	return api.Compare{
+		Target: api.CompareTarget(m[1]),
+		Result: api.CompareResult(m[3]),
+		Key:    normalizeKey(key),
+		Value:  value,
+	}, nil
+}
+
+func parseOps(lines []string) ([]api.Op, error) {
+	var ops []api.Op
+	for _, line := range lines {
+		args, err := splitArgs(line)
+		if err != nil {
+			return nil, fmt.Errorf("malformed request %q (%v)", line, err)
+		}
+		switch {
+		case len(args) == 2 && args[0] == "get":
+			ops = append(ops, api.Op{Type: api.OpGet, Key: normalizeKey(args[1])})
+		case len(args) == 2 && args[0] == "del":
+			ops = append(ops, api.Op{Type: api.OpDelete, Key: normalizeKey(args[1])})
+		case len(args) == 3 && args[0] == "put":
+			ops = append(ops, api.Op{Type: api.OpPut, Key: normalizeKey(args[1]), Value: args[2]})
+		default:
+			return nil, fmt.Errorf("malformed request %q", line)
+		}
+	}
+	return ops, nil
+}
+
+// splitArgs splits line on white space. Double quoted arguments may contain
+// spaces and Go escape sequences.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+			continue
+		}
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, err
+		}
+		arg, _ := strconv.Unquote(quoted)
+		args = append(args, arg)
+		line = line[len(quoted):]
+	}
+	return args, nil
+}
+
+// normalizeKey maps a key given on the command line to the stored key,
+// which always starts with "/".
+func normalizeKey(key string) string {
+	if strings.HasPrefix(key, "/") {
+		return key
+	}
+	return "/" + key
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"metcd/api"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTxn(t *testing.T) {
+	in := `value("foo") = "bar"
+exists("/lock") = false
+mod("/lock") < 42
+
+put foo "hello world"
+del /lock
+
+get foo
+`
+	want := &api.TxnRequest{
+		Compare: []api.Compare{
+			{Target: api.CompareValue, Result: api.CompareEqual, Key: "/foo", Value: "bar"},
+			{Target: api.CompareExists, Result: api.CompareEqual, Key: "/lock", Value: "false"},
+			{Target: api.CompareMod, Result: api.CompareLess, Key: "/lock", Value: "42"},
+		},
+		Success: []api.Op{
+			{Type: api.OpPut, Key: "/foo", Value: "hello world"},
+			{Type: api.OpDelete, Key: "/lock"},
+		},
+		Failure: []api.Op{
+			{Type: api.OpGet, Key: "/foo"},
+		},
+	}
+	got, err := parseTxn(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestParseTxnMalformed(t *testing.T) {
+	for _, in := range []string{
+		"lease(\"foo\") = 1\n",
+		"\nput foo\n",
+		"\n\nmove foo bar\n",
+	} {
+		if _, err := parseTxn(strings.NewReader(in)); err == nil {
+			t.Errorf("expected error parsing %q", in)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"metcd/api"
+	"metcd/resp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons keys are deleted for, the reason label of keysDeleted.
+const (
+	// deleteExplicit is a delete, a range delete or the delete of a txn
+	deleteExplicit = "delete"
+	// deleteExpired is the deletion of a key whose Redis expiry deadline
+	// passed, metcd's only kind of lease
+	deleteExpired = "expire"
+	// deleteKeyspace is the deletion of the keys of a deleted keyspace
+	deleteKeyspace = "keyspace"
+	// deleteMoved is the deletion of the keys of a shard from the raft
+	// group it migrated away from
+	deleteMoved = "shard_moved"
+)
+
+var (
+	keysDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "keys_deleted_total",
+		Help:      "Number of keys deleted by reason: delete, expire, keyspace or shard_moved.",
+	}, []string{"reason"})
+
+	quotaRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "quota_rejected_total",
+		Help:      "Number of writes refused because they exceeded the quota of their keyspace.",
+	})
+
+	compactions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "compactions_total",
+		Help:      "Number of compactions applied; they discard history, never current keys.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(keysDeleted, quotaRejected, compactions)
+}
+
+type deleteReasonCtx struct{}
+
+// withDeleteReason makes the keys deleted by the proposals of ctx count as
+// deleted for reason.
+func withDeleteReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, deleteReasonCtx{}, reason)
+}
+
+func deleteReason(ctx context.Context) string {
+	reason, _ := ctx.Value(deleteReasonCtx{}).(string)
+	return reason
+}
+
+// countApplied accounts for the applied proposal r, its result res and its
+// events.
+func countApplied(r kv, res *applyResult, events []api.Event) {
+	switch {
+	case errors.Is(res.err, ErrQuotaExceeded):
+		quotaRejected.Inc()
+	case r.Op == opCompact && res.err == nil:
+		compactions.Inc()
+	}
+	reason := r.Reason
+	if reason == "" {
+		reason = deleteExplicit
+	}
+	n := 0
+	for _, ev := range events {
+		// the expiry deadlines of the Redis protocol are bookkeeping of
+		// the keys they belong to
+		if ev.Type == api.EventDelete && !strings.HasPrefix(ev.Key, resp.TTLPrefix) {
+			n++
+		}
+	}
+	// the keys moved are renamed, not deleted
+	if n > 0 && r.Op != opMove {
+		keysDeleted.WithLabelValues(reason).Add(float64(n))
+	}
+}
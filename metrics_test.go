@@ -0,0 +1,37 @@
+package main
+
+import (
+	"metcd/api"
+	"metcd/resp"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestKeysDeleted(t *testing.T) {
+	deleted := func(reason string) float64 { return testutil.ToFloat64(keysDeleted.WithLabelValues(reason)) }
+	explicit, expired, keyspace := deleted(deleteExplicit), deleted(deleteExpired), deleted(deleteKeyspace)
+	rejected := testutil.ToFloat64(quotaRejected)
+
+	s := newTestKVStore(map[string]string{"/a": "1", "/b": "2", "/c": "3", resp.TTLPrefix + "/c": "0"})
+	s.apply(kv{Op: opDelete, Key: "/a"})
+	s.apply(kv{Op: opDelete, Key: "/missing"})
+	s.apply(kv{Op: opTxn, Reason: deleteExpired, Txn: &api.TxnRequest{
+		Success: []api.Op{{Type: api.OpDelete, Key: "/c"}, {Type: api.OpDelete, Key: resp.TTLPrefix + "/c"}},
+	}})
+	s.apply(kv{Op: opKeyspacePut, Keyspace: "app", Quota: 4})
+	s.apply(kv{Op: opPut, Keyspace: "app", Key: "/x", Val: "y"})
+	s.apply(kv{Op: opPut, Keyspace: "app", Key: "/too-large", Val: "y"})
+	s.apply(kv{Op: opKeyspaceDelete, Keyspace: "app"})
+
+	switch {
+	case deleted(deleteExplicit)-explicit != 1:
+		t.Fatalf("expected 1 explicit delete, got %v", deleted(deleteExplicit)-explicit)
+	case deleted(deleteExpired)-expired != 1:
+		t.Fatalf("expected 1 expired key, not counting its deadline, got %v", deleted(deleteExpired)-expired)
+	case deleted(deleteKeyspace)-keyspace != 1:
+		t.Fatalf("expected 1 key deleted with its keyspace, got %v", deleted(deleteKeyspace)-keyspace)
+	case testutil.ToFloat64(quotaRejected)-rejected != 1:
+		t.Fatalf("expected 1 write refused by the quota, got %v", testutil.ToFloat64(quotaRejected)-rejected)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"metcd/raftnode"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+	"go.etcd.io/etcd/server/v3/wal"
+)
+
+var walDirRE = regexp.MustCompile(`^metcd-(\d+)$`)
+
+// migrateDataDir implements `metcd migrate-datadir --from A --to B`: it
+// copies the WAL and snapshots of a stopped member to a new data directory,
+// fsyncs and verifies the copy. The source is left in place.
+func migrateDataDir(args []string) error {
+	fset := flag.NewFlagSet("migrate-datadir", flag.ExitOnError)
+	from := fset.String("from", ".", "current data directory")
+	to := fset.String("to", "", "new data directory")
+	id := fset.Int("id", 0, "member to migrate, needed when --from holds the data of several members")
+	fset.Parse(args)
+	if *to == "" {
+		return errors.New("migrate-datadir needs --to")
+	}
+	if filepath.Clean(*from) == filepath.Clean(*to) {
+		return errors.New("--from and --to are the same directory")
+	}
+	if *id == 0 {
+		var err error
+		if *id, err = findDataDirMember(*from); err != nil {
+			return err
+		}
+	}
+	dirs := []string{raftnode.WALDir(*id), raftnode.SnapDir(*id)}
+
+	if err := checkStopped(filepath.Join(*from, dirs[0])); err != nil {
+		return err
+	}
+	if err := raftnode.VerifyDataDir(*from, *id); err != nil {
+		return fmt.Errorf("source is damaged, not migrating: %v", err)
+	}
+	for _, d := range dirs {
+		if _, err := os.Stat(filepath.Join(*to, d)); err == nil {
+			return fmt.Errorf("%s already exists", filepath.Join(*to, d))
+		}
+	}
+	if err := os.MkdirAll(*to, 0750); err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		src, dst := filepath.Join(*from, d), filepath.Join(*to, d)
+		if _, err := os.Stat(src); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		// copy next to the destination and rename, so an interrupted
+		// migration never leaves a partial data directory behind
+		tmp := dst + ".tmp"
+		os.RemoveAll(tmp)
+		if err := copyDir(src, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		if err := compareDirs(src, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			return err
+		}
+	}
+	if err := fsyncDir(*to); err != nil {
+		return err
+	}
+	if err := raftnode.VerifyDataDir(*to, *id); err != nil {
+		return fmt.Errorf("copy is damaged: %v", err)
+	}
+	fmt.Printf("migrated member %d from %s to %s\n", *id, *from, *to)
+	fmt.Printf("start it with --data-dir %s, then remove %s\n", *to, strings.Join(prefixAll(*from, dirs), " "))
+	return nil
+}
+
+// findDataDirMember returns the ID of the only member with a WAL in dir.
+func findDataDirMember(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for _, e := range entries {
+		if m := walDirRE.FindStringSubmatch(e.Name()); m != nil && e.IsDir() && wal.Exist(filepath.Join(dir, e.Name())) {
+			id, _ := strconv.Atoi(m[1])
+			ids = append(ids, id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return 0, fmt.Errorf("no member data in %q", dir)
+	case 1:
+		return ids[0], nil
+	}
+	return 0, fmt.Errorf("%q holds the data of members %v, pick one with --id", dir, ids)
+}
+
+// checkStopped fails if a process holds the WAL files of waldir, which a
+// running member always does.
+func checkStopped(waldir string) error {
+	names, err := filepath.Glob(filepath.Join(waldir, "*.wal"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		f, err := fileutil.TryLockFile(name, os.O_WRONLY, fileutil.PrivateFileMode)
+		if errors.Is(err, fileutil.ErrLocked) {
+			return fmt.Errorf("%s is in use, stop the member first", name)
+		}
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// copyDir copies the regular files of src to the new directory dst and
+// fsyncs them.
+func copyDir(src, dst string) error {
+	if err := os.Mkdir(dst, 0750); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// *.tmp are preallocated WAL segments, recreated on start
+		if !e.Type().IsRegular() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	return fsyncDir(dst)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileutil.PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := fileutil.Fsync(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// compareDirs checks that every file copied to dst has the content of src.
+func compareDirs(src, dst string) error {
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		a, err := hashFile(filepath.Join(src, e.Name()))
+		if err != nil {
+			return err
+		}
+		b, err := hashFile(filepath.Join(dst, e.Name()))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(a, b) {
+			return fmt.Errorf("copy of %s differs from the source", filepath.Join(src, e.Name()))
+		}
+	}
+	return nil
+}
+
+func hashFile(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func fsyncDir(dir string) error {
+	d, err := fileutil.OpenDir(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return fileutil.Fsync(d)
+}
+
+func prefixAll(dir string, names []string) []string {
+	out := make([]string, len(names))
+	for i, n := range names {
+		out[i] = filepath.Join(dir, n)
+	}
+	return out
+}
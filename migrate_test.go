@@ -0,0 +1,48 @@
+package main
+
+import (
+	"metcd/raftnode"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/wal"
+	"go.uber.org/zap"
+)
+
+func TestMigrateDataDir(t *testing.T) {
+	from, to := t.TempDir(), filepath.Join(t.TempDir(), "new")
+	w, err := wal.Create(zap.NewNop(), filepath.Join(from, raftnode.WALDir(3)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Save(raftpb.HardState{Term: 1, Commit: 1}, []raftpb.Entry{{Term: 1, Index: 1, Data: []byte("x")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDataDir([]string{"--from", from, "--to", to}); err == nil {
+		t.Fatal("expected the migration of a running member to fail")
+	}
+	w.Close()
+
+	if err := migrateDataDir([]string{"--from", from, "--to", to}); err != nil {
+		t.Fatal(err)
+	}
+	if err := raftnode.VerifyDataDir(to, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDataDir([]string{"--from", from, "--to", to}); err == nil {
+		t.Fatal("expected an existing destination to be refused")
+	}
+
+	// with a second member the ID has to be given
+	if err := os.MkdirAll(filepath.Join(from, raftnode.WALDir(4)), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(from, raftnode.WALDir(4), "0000000000000000-0000000000000000.wal"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := findDataDirMember(from); err == nil {
+		t.Fatal("expected several members to be ambiguous")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"metcd/api"
+	"metcd/encryption"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidMove     = errors.New("metcd: invalid move")
+	ErrMoveNotFound    = errors.New("metcd: nothing to move")
+	ErrMoveConflict    = errors.New("metcd: destination of the move exists")
+	ErrMoveEncrypted   = errors.New("metcd: cannot move encrypted values")
+	ErrMoveTransformed = errors.New("metcd: cannot move to a transformed prefix")
+)
+
+// Move renames the key req.From to req.To in the keyspace of ctx, or every
+// key with the prefix req.From to the same key with the prefix req.To, in
+// one revision.
+func (s *kvstore) Move(ctx context.Context, req api.MoveRequest) (*api.MoveResponse, error) {
+	if err := checkMove(req); err != nil {
+		return nil, err
+	}
+	res, err := s.propose(ctx, kv{Op: opMove, Key: req.From, MoveTo: req.To, MovePrefix: req.Prefix, MoveOverwrite: req.Overwrite})
+	if err != nil {
+		return nil, err
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	return &api.MoveResponse{Revision: res.rev, Moved: len(res.prevs)}, nil
+}
+
+// checkMove refuses the moves of a key to itself, and of a prefix into
+// itself or to one of its own keys, which would move some keys twice.
+func checkMove(req api.MoveRequest) error {
+	switch {
+	case !strings.HasPrefix(req.From, "/") || !strings.HasPrefix(req.To, "/"):
+		return ErrInvalidMove
+	case req.Prefix && (strings.HasPrefix(req.From, req.To) || strings.HasPrefix(req.To, req.From)):
+		return ErrInvalidMove
+	case req.From == req.To:
+		return ErrInvalidMove
+	}
+	return nil
+}
+
+// applyMove applies opMove. The keys moved keep their value, create
+// revision and version, and are changed at the revision of the move: a
+// DELETE event of the source and a PUT event of the destination each. The
+// values must pass the schemas of their destination, and are refused under
+// transformed prefixes as they did not go through the transformer there.
+// It must be called with s.mu held.
+func (s *kvstore) applyMove(ks *keyspace, r kv, res *applyResult) ([]api.Event, error) {
+	if err := checkMove(api.MoveRequest{From: r.Key, To: r.MoveTo, Prefix: r.MovePrefix}); err != nil {
+		return nil, err
+	}
+	var from []string
+	if r.MovePrefix {
+		for k := range ks.kvStore {
+			if strings.HasPrefix(k, r.Key) {
+				from = append(from, k)
+			}
+		}
+		sort.Strings(from)
+	} else if _, ok := ks.kvStore[r.Key]; ok {
+		from = []string{r.Key}
+	}
+	if len(from) == 0 {
+		return nil, ErrMoveNotFound
+	}
+	to := make([]string, len(from))
+	ops := make([]api.Op, 0, 2*len(from))
+	for i, k := range from {
+		to[i] = r.MoveTo + strings.TrimPrefix(k, r.Key)
+		// sealed values are bound to their key, and resealing them here
+		// would not be deterministic
+		if _, encrypted := s.keyring.Encrypted(r.Keyspace, to[i]); encrypted || encryption.IsSealed(ks.kvStore[k]) {
+			return nil, ErrMoveEncrypted
+		}
+		if ks.transformed(to[i]) {
+			return nil, ErrMoveTransformed
+		}
+		if _, ok := ks.kvStore[to[i]]; ok && !r.MoveOverwrite {
+			return nil, ErrMoveConflict
+		}
+		if len(ks.schemas) > 0 {
+			v, err := s.openCompared(k, ks.kvStore[k])
+			if err != nil {
+				return nil, err
+			}
+			if err := ks.validate(to[i], v); err != nil {
+				return nil, err
+			}
+		}
+		ops = append(ops, api.Op{Type: api.OpDelete, Key: k}, api.Op{Type: api.OpPut, Key: to[i], Value: ks.kvStore[k]})
+	}
+	if !ks.admit(ops) {
+		return nil, ErrQuotaExceeded
+	}
+
+	var events []api.Event
+	for i, k := range from {
+		prev := ks.get(k)
+		res.prevs = append(res.prevs, prev)
+		_, ev := ks.del(k)
+		events = append(events, *ev)
+		overwritten := ks.get(to[i])
+		put := ks.put(to[i], prev.Value)
+		// an overwritten destination is deleted, buried after the put
+		// which drops the tombstone of the key
+		ks.bury(overwritten)
+		revs := ks.revs[to[i]]
+		revs.Create, revs.Version = prev.CreateRevision, prev.Version
+		ks.revs[to[i]] = revs
+		put.CreateRevision, put.Version = revs.Create, revs.Version
+		events = append(events, put)
+	}
+	return events, nil
+}
+
+// serveMove handles POST /move, the move of the api.MoveRequest of the
+// body in the keyspace of the request.
+func (h *httpKVAPI) serveMove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req api.MoveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode move (%v)\n", err)
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+	resp, err := h.store.Move(proposalCtx(r), req)
+	switch {
+	case errors.Is(err, ErrInvalidMove):
+		http.Error(w, "Invalid move", http.StatusBadRequest)
+	case errors.Is(err, ErrMoveNotFound):
+		http.Error(w, "Failed to move", http.StatusNotFound)
+	case errors.Is(err, ErrMoveConflict):
+		http.Error(w, "Destination exists", http.StatusConflict)
+	case errors.Is(err, ErrMoveEncrypted):
+		http.Error(w, "Cannot move encrypted values", http.StatusConflict)
+	case errors.Is(err, ErrMoveTransformed):
+		http.Error(w, "Cannot move to a transformed prefix", http.StatusConflict)
+	case keyspaceError(w, err) || proposalError(w, err):
+	case err != nil:
+		log.Printf("Failed to propose move (%v)\n", err)
+		http.Error(w, "Failed on POST", http.StatusInternalServerError)
+	default:
+		writeJSON(w, resp)
+	}
+}
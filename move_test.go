@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"metcd/api"
+	"metcd/transform"
+	"testing"
+)
+
+func TestMove(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.apply(kv{Op: opPut, Key: "/a", Val: "1"})
+	s.apply(kv{Op: opPut, Key: "/a", Val: "2"})
+	s.apply(kv{Op: opPut, Key: "/b", Val: "b"})
+	events, cancel := s.keyspace.watchers.watch("/", true)
+	defer cancel()
+
+	if res := s.apply(kv{Op: opMove, Key: "/a", MoveTo: "/b"}); !errors.Is(res.err, ErrMoveConflict) {
+		t.Fatalf("expected an existing destination to fail the move, got %v", res.err)
+	}
+	res := s.apply(kv{Op: opMove, Key: "/a", MoveTo: "/c"})
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	moved, _, _ := s.GetIn("", "/c")
+	if moved == nil || moved.Value != "2" || moved.CreateRevision != 1 || moved.Version != 2 || moved.ModRevision != res.rev {
+		t.Fatalf("expected the key moved with its create revision and version, got %+v", moved)
+	}
+	if kv, _, _ := s.GetIn("", "/a"); kv != nil {
+		t.Fatalf("expected the source to be gone, got %+v", kv)
+	}
+	del, put := <-events, <-events
+	if del.Type != api.EventDelete || del.Key != "/a" || put.Type != api.EventPut || put.Key != "/c" || put.ModRevision != del.ModRevision {
+		t.Fatalf("expected a delete and a put at the same revision, got %+v and %+v", del, put)
+	}
+	if res := s.apply(kv{Op: opMove, Key: "/c", MoveTo: "/b", MoveOverwrite: true}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if v, _ := s.Lookup("/b"); v != "2" {
+		t.Fatalf("expected the destination to be overwritten, got %q", v)
+	}
+
+	// an overwritten destination under a retained prefix leaves a tombstone
+	s.apply(kv{Op: opRetentionPut, Key: "/keep/"})
+	s.apply(kv{Op: opPut, Key: "/keep/a", Val: "old"})
+	s.apply(kv{Op: opPut, Key: "/src", Val: "new"})
+	res = s.apply(kv{Op: opMove, Key: "/src", MoveTo: "/keep/a", MoveOverwrite: true})
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if ts, _ := s.Tombstones("", "/keep/"); len(ts) != 1 || ts[0].Key != "/keep/a" || ts[0].DeleteRevision != res.rev {
+		t.Fatalf("expected the overwritten value buried, got %+v", ts)
+	}
+	s.apply(kv{Op: opDelete, Key: "/keep/a", Reason: deleteExpired})
+	if res := s.apply(kv{Op: opUndelete, Key: "/keep/a"}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if v, _ := s.Lookup("/keep/a"); v != "old" {
+		t.Fatalf("expected the overwritten value restored, got %q", v)
+	}
+
+	s.apply(kv{Op: opPut, Key: "/cfg/x", Val: "x"})
+	s.apply(kv{Op: opPut, Key: "/cfg/y/z", Val: "z"})
+	s.apply(kv{Op: opPut, Key: "/new/x", Val: "old"})
+	if res := s.apply(kv{Op: opMove, Key: "/cfg/", MoveTo: "/new/", MovePrefix: true}); !errors.Is(res.err, ErrMoveConflict) {
+		t.Fatalf("expected an existing destination to fail the whole move, got %v", res.err)
+	}
+	if v, _ := s.Lookup("/cfg/y/z"); v != "z" {
+		t.Fatalf("expected a failed move to leave the keys, got %q", v)
+	}
+	res = s.apply(kv{Op: opMove, Key: "/cfg/", MoveTo: "/new/", MovePrefix: true, MoveOverwrite: true})
+	if res.err != nil || len(res.prevs) != 2 {
+		t.Fatalf("expected two keys moved, got %d, %v", len(res.prevs), res.err)
+	}
+	if v, _ := s.Lookup("/new/y/z"); v != "z" {
+		t.Fatalf("expected the keys under the new prefix, got %q", v)
+	}
+
+	// the destination prefix applies its schemas and transformers
+	s.apply(kv{Op: opSchemaPut, Key: "/svc/", Val: `{"type":"object","required":["port"]}`})
+	s.apply(kv{Op: opTransformPut, Key: "/tmpl/", Val: transform.Template})
+	s.apply(kv{Op: opPut, Key: "/tmp/x", Val: `{"host":"a"}`})
+	if res := s.apply(kv{Op: opMove, Key: "/tmp/x", MoveTo: "/svc/x"}); !errors.Is(res.err, ErrValidationFailed) {
+		t.Fatalf("expected the moved value validated, got %v", res.err)
+	}
+	if res := s.apply(kv{Op: opMove, Key: "/tmp/x", MoveTo: "/tmpl/x"}); !errors.Is(res.err, ErrMoveTransformed) {
+		t.Fatalf("expected a move to a transformed prefix refused, got %v", res.err)
+	}
+	if v, _ := s.Lookup("/tmp/x"); v != `{"host":"a"}` {
+		t.Fatalf("expected a refused move to leave the key, got %q", v)
+	}
+
+	for _, r := range []kv{
+		{Op: opMove, Key: "/nosuch", MoveTo: "/d"},
+		{Op: opMove, Key: "/nosuch/", MoveTo: "/d/", MovePrefix: true},
+	} {
+		if res := s.apply(r); !errors.Is(res.err, ErrMoveNotFound) {
+			t.Fatalf("%+v: expected nothing to move, got %v", r, res.err)
+		}
+	}
+	for _, r := range []kv{
+		{Op: opMove, Key: "/b", MoveTo: "/b"},
+		{Op: opMove, Key: "/new/", MoveTo: "/new/sub/", MovePrefix: true},
+		{Op: opMove, Key: "b", MoveTo: "/d"},
+	} {
+		if res := s.apply(r); !errors.Is(res.err, ErrInvalidMove) {
+			t.Fatalf("%+v: expected an invalid move, got %v", r, res.err)
+		}
+	}
+}
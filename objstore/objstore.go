@@ -0,0 +1,94 @@
+// Package objstore keeps the snapshots metcd backs up in an object store,
+// so that a cluster whose disks are lost can be restored from outside its
+// hosts. Stores are opened from a URI, "<scheme>:<target>", by the opener
+// registered for the scheme; "file", "s3" and "gs" are built in.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Get for an object that does not exist.
+var ErrNotFound = errors.New("objstore: object not found")
+
+// Object is an object of a store.
+type Object struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+// ObjectStore holds objects by name under the prefix of its URI. Names are
+// relative to the prefix and may not contain "/".
+type ObjectStore interface {
+	Put(ctx context.Context, name string, data []byte) error
+	// Get returns the content of the object, ErrNotFound if there is none.
+	Get(ctx context.Context, name string) ([]byte, error)
+	// List returns the objects of the store sorted by name.
+	List(ctx context.Context) ([]Object, error)
+	// Delete removes the object, it is not an error if there is none.
+	Delete(ctx context.Context, name string) error
+}
+
+// Opener opens the store of target, the URI without its scheme.
+type Opener func(target string) (ObjectStore, error)
+
+var (
+	mu      sync.RWMutex
+	openers = make(map[string]Opener)
+)
+
+func init() {
+	Register("file", OpenFile)
+	Register("s3", OpenS3)
+	Register("gs", OpenGCS)
+}
+
+// Register makes the stores of scheme available to Open. It panics if the
+// scheme is already registered.
+func Register(scheme string, open Opener) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := openers[scheme]; ok {
+		panic("objstore: scheme " + scheme + " registered twice")
+	}
+	openers[scheme] = open
+}
+
+// Schemes returns the registered schemes, sorted.
+func Schemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	schemes := make([]string, 0, len(openers))
+	for s := range openers {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open opens the store of uri, "<scheme>:<target>".
+func Open(uri string) (ObjectStore, error) {
+	scheme, target, ok := strings.Cut(uri, ":")
+	mu.RLock()
+	open := openers[scheme]
+	mu.RUnlock()
+	if !ok || open == nil {
+		return nil, fmt.Errorf("objstore: unknown store %q, want one of %s followed by :<target>", uri, strings.Join(Schemes(), ", "))
+	}
+	return open(target)
+}
+
+// checkName refuses the names that are not one path element.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("objstore: invalid object name %q", name)
+	}
+	return nil
+}
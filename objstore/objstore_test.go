@@ -0,0 +1,72 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	if got := Schemes(); !reflect.DeepEqual(got, []string{"file", "gs", "s3"}) {
+		t.Fatalf("expected the built-in schemes, got %v", got)
+	}
+	for _, uri := range []string{"", "file", "file:", "nosuch:target", "s3:", "s3:bucket?region=%zz"} {
+		if _, err := Open(uri); err == nil {
+			t.Errorf("expected %q to fail", uri)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a scheme twice to panic")
+		}
+	}()
+	Register("file", OpenFile)
+}
+
+// testStore puts, lists, gets and deletes objects of s.
+func testStore(t *testing.T, s ObjectStore) {
+	ctx := context.Background()
+	for _, name := range []string{"b", "a", "c"} {
+		if err := s.Put(ctx, name, []byte("object "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put(ctx, "../x", nil); err == nil {
+		t.Fatal("expected a name with a slash to be refused")
+	}
+	objs, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range objs {
+		names = append(names, o.Name)
+		if o.Size != int64(len("object a")) {
+			t.Errorf("expected the size of %s, got %d", o.Name, o.Size)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b", "c"}) {
+		t.Fatalf("expected the objects sorted by name, got %v", names)
+	}
+	if data, err := s.Get(ctx, "b"); err != nil || string(data) != "object b" {
+		t.Fatalf("expected object b, got %q (%v)", data, err)
+	}
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatalf("expected deleting a missing object to succeed, got %v", err)
+	}
+	if _, err := s.Get(ctx, "b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	s, err := Open("file:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
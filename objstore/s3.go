@@ -0,0 +1,295 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Timeout bounds a request to an S3 store.
+var s3Timeout = 5 * time.Minute
+
+// s3Store keeps the objects in a bucket of an S3 compatible store: Amazon
+// S3, MinIO, or Google Cloud Storage through its XML API. Requests are
+// signed with AWS Signature Version 4.
+type s3Store struct {
+	client *http.Client
+	// endpoint is the URL of the bucket, objects are under it
+	endpoint *url.URL
+	prefix   string // the prefix of the object keys, "" or ending with "/"
+	region   string
+
+	accessKey, secretKey, sessionToken string
+}
+
+// OpenS3 opens the store "s3:<bucket>[/<prefix>][?endpoint=<url>&region=<region>]".
+// The credentials are the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables, the region that of the URI,
+// AWS_REGION or us-east-1. Without an endpoint the bucket is addressed on
+// Amazon S3, virtual hosted; with one, MinIO for instance, by path.
+func OpenS3(target string) (ObjectStore, error) {
+	return openS3(target, "", "")
+}
+
+// OpenGCS opens the store "gs:<bucket>[/<prefix>]" of Google Cloud Storage,
+// through its S3 compatible XML API with the HMAC key of a service account
+// in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func OpenGCS(target string) (ObjectStore, error) {
+	return openS3(target, "https://storage.googleapis.com", "auto")
+}
+
+func openS3(target, endpoint, region string) (ObjectStore, error) {
+	path, rawQuery, _ := strings.Cut(target, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("objstore: %q: %v", target, err)
+	}
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(path, "//"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("objstore: %q: no bucket, want <bucket>[/<prefix>]", target)
+	}
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	s := &s3Store{
+		client:       &http.Client{Timeout: s3Timeout},
+		prefix:       prefix,
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if r := query.Get("region"); r != "" {
+		s.region = r
+	}
+	if s.region == "" {
+		if s.region = os.Getenv("AWS_REGION"); s.region == "" {
+			s.region = "us-east-1"
+		}
+	}
+	if e := query.Get("endpoint"); e != "" {
+		endpoint = e
+	}
+	if endpoint == "" {
+		s.endpoint, err = url.Parse("https://" + bucket + ".s3." + s.region + ".amazonaws.com/")
+	} else {
+		s.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("objstore: %q: invalid endpoint (%v)", target, err)
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("objstore: " + target + " needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, name string, data []byte) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPut, s.prefix+name, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, name string) ([]byte, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.prefix+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// listResult is the response of ListObjectsV2.
+type listResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Store) List(ctx context.Context) ([]Object, error) {
+	var objs []Object
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("objstore: cannot decode the object list (%v)", err)
+		}
+		for _, c := range res.Contents {
+			// the objects of deeper prefixes are not ours
+			if name := strings.TrimPrefix(c.Key, s.prefix); checkName(name) == nil {
+				objs = append(objs, Object{Name: name, Size: c.Size, Modified: c.LastModified})
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Name < objs[j].Name })
+	return objs, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.prefix+name, nil, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Error is the body of a failed request.
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// do sends the signed request for key, the bucket itself if empty, and
+// returns the response if it succeeded.
+func (s *s3Store) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path += key
+	u.RawPath = s.endpoint.EscapedPath() + uriEncode(key, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+	sum := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	s.sign(req, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, ErrNotFound
+	}
+	var e s3Error
+	if b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096)); xml.Unmarshal(b, &e) != nil || e.Code == "" {
+		e.Code = resp.Status
+	}
+	return nil, fmt.Errorf("objstore: %s %s: %s %s", method, u.Redacted(), e.Code, e.Message)
+}
+
+// sign adds the AWS Signature Version 4 of req at now, covering its host and
+// headers. The X-Amz-Content-Sha256 header must be set.
+func (s *s3Store) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n" + req.URL.EscapedPath() + "\n" + req.URL.RawQuery + "\n")
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical.WriteString("\n" + signed + "\n" + req.Header.Get("X-Amz-Content-Sha256"))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, the form SigV4 signs.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), query[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes every byte of s but the unreserved characters,
+// and "/" unless slash is set.
+func uriEncode(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+)
+
+// MarkObserver marks member id as an observer, or unmarks it if observer
+// is false. An observer is a learner that is never promoted: it replicates
+// the log and serves serializable reads and watches without changing the
+// quorum. The promotions of the API and of the controller refuse them.
+func (s *kvstore) MarkObserver(ctx context.Context, id uint64, observer bool) error {
+	op := opObserverAdd
+	if !observer {
+		op = opObserverRemove
+	}
+	res, err := s.propose(ctx, kv{Op: op, Observer: id})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// IsObserver reports whether member id is an observer.
+func (s *kvstore) IsObserver(id uint64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.observers[id]
+	return ok
+}
+
+// observer applies opObserverAdd or opObserverRemove. It must be called
+// with s.mu held.
+func (s *kvstore) observer(r kv) {
+	if _, ok := s.observers[r.Observer]; ok == (r.Op == opObserverAdd) {
+		return
+	}
+	if r.Op == opObserverAdd {
+		s.observers[r.Observer] = struct{}{}
+		log.Printf("member %d is an observer", r.Observer)
+	} else {
+		delete(s.observers, r.Observer)
+		log.Printf("member %d is not an observer anymore", r.Observer)
+	}
+}
+
+// observerList must be called with s.mu held.
+func (s *kvstore) observerList() []uint64 {
+	ids := make([]uint64, 0, len(s.observers))
+	for id := range s.observers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
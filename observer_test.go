@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestObservers(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.apply(kv{Op: opObserverAdd, Observer: 4})
+	s.apply(kv{Op: opObserverAdd, Observer: 5})
+	s.apply(kv{Op: opObserverRemove, Observer: 5})
+	if !s.IsObserver(4) || s.IsObserver(5) {
+		t.Fatal("expected only 4 to be an observer")
+	}
+
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestKVStore(nil)
+	if err := r.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if !r.IsObserver(4) || r.IsObserver(5) {
+		t.Fatal("expected the observers to be restored")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var (
+	errInvalidLimit    = errors.New("invalid limit")
+	errInvalidContinue = errors.New("invalid continue token")
+)
+
+// pageToken is what a continue token of a paginated listing carries: the
+// revision the whole listing reads at, set by its first page, and where
+// the next page starts. Clients pass it back as is, ?continue=<token>.
+type pageToken struct {
+	Rev  int64  `json:"rev,omitempty"`
+	Next string `json:"next"`
+}
+
+func (t pageToken) String() string {
+	b, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parsePageToken(s string) (*pageToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidContinue
+	}
+	var t pageToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, errInvalidContinue
+	}
+	return &t, nil
+}
+
+// pageQuery returns the ?limit of a listing, 0 for no limit, and the token
+// of its ?continue, nil on the first page.
+func pageQuery(q url.Values) (int, *pageToken, error) {
+	var limit int
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			return 0, nil, errInvalidLimit
+		}
+	}
+	if c := q.Get("continue"); c != "" {
+		t, err := parsePageToken(c)
+		return limit, t, err
+	}
+	return limit, nil, nil
+}
+
+// pageError answers a request whose paging parameters are invalid,
+// reporting whether err was not nil.
+func pageError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, errInvalidLimit):
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+	default:
+		http.Error(w, "Invalid continue token", http.StatusBadRequest)
+	}
+	return true
+}
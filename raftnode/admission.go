@@ -0,0 +1,101 @@
+package raftnode
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	admissionSizeWindow = 1024 // 计算分位数的最近提案数
+	admissionWeight     = 0.2  // WAL 写入延迟的指数移动平均中新样本的权重
+	// admissionStale 内没有 WAL 写入时认为延迟已经恢复, 否则只剩大提案时平均值不会再更新
+	admissionStale = 5 * time.Second
+)
+
+// DefaultAdmissionPercentile 是 AdmissionConfig.Percentile 不在 (0, 1] 内时使用的分位数
+var DefaultAdmissionPercentile = 0.9
+
+// AdmissionConfig 配置按大小的提案准入: WAL 写入变慢时暂时拒绝最大的一部分提案,
+// 让小的写入和心跳不被大提案拖慢
+type AdmissionConfig struct {
+	// Latency 是 WAL 写入延迟的阈值, 平均延迟超过它时开始拒绝大提案, 0 关闭准入控制
+	Latency time.Duration
+	// Percentile 是最近提案大小的分位数, 例如 0.9, 大于它的提案在延迟超过阈值时被拒绝
+	Percentile float64
+	// MinSize 以内的提案总是被接受
+	MinSize int
+}
+
+// WithAdmission 开启按大小的提案准入, 被拒绝的 Propose 返回 ErrProposalDeferred.
+// 只作用于 ProposePipe.Propose 的 PriorityNormal 提案
+func WithAdmission(cfg AdmissionConfig) Option {
+	return func(rc *RaftNode) {
+		if cfg.Percentile <= 0 || cfg.Percentile > 1 {
+			cfg.Percentile = DefaultAdmissionPercentile
+		}
+		if cfg.Latency > 0 {
+			rc.admission = &admission{cfg: cfg}
+		}
+	}
+}
+
+// admission 在 raft 循环中记录 WAL 写入延迟, 在提案 goroutine 中检查提案
+type admission struct {
+	cfg AdmissionConfig
+
+	mu       sync.Mutex
+	latency  float64 // WAL 写入延迟的移动平均, 秒
+	lastSave time.Time
+	sizes    [admissionSizeWindow]int
+	next     int
+	full     bool
+}
+
+// observe 记录一次 WAL 写入的耗时
+func (a *admission) observe(d time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastSave.IsZero() || time.Since(a.lastSave) > admissionStale {
+		a.latency = d.Seconds()
+	} else {
+		a.latency += admissionWeight * (d.Seconds() - a.latency)
+	}
+	a.lastSave = time.Now()
+}
+
+// admit 记录提案的大小, WAL 写入变慢时拒绝大于分位数的提案
+func (a *admission) admit(size int) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sizes[a.next] = size
+	a.next = (a.next + 1) % len(a.sizes)
+	a.full = a.full || a.next == 0
+	if size <= a.cfg.MinSize || !a.degraded() || size <= a.percentile() {
+		return nil
+	}
+	proposalsDeferred.Inc()
+	return ErrProposalDeferred
+}
+
+// degraded 报告 WAL 写入是否变慢了, 必须持有 a.mu
+func (a *admission) degraded() bool {
+	return a.latency > a.cfg.Latency.Seconds() && time.Since(a.lastSave) <= admissionStale
+}
+
+// percentile 返回最近提案大小的 cfg.Percentile 分位数, 必须持有 a.mu
+func (a *admission) percentile() int {
+	n := a.next
+	if a.full {
+		n = len(a.sizes)
+	}
+	sizes := append([]int(nil), a.sizes[:n]...)
+	sort.Ints(sizes)
+	return sizes[int(a.cfg.Percentile*float64(n-1))]
+}
@@ -0,0 +1,51 @@
+package raftnode
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	var rc RaftNode
+	WithAdmission(AdmissionConfig{Latency: 10 * time.Millisecond, MinSize: 100})(&rc)
+	a := rc.admission
+	if a == nil || a.cfg.Percentile != DefaultAdmissionPercentile {
+		t.Fatalf("expected admission with the default percentile, got %+v", a)
+	}
+	for i := 1; i <= 100; i++ {
+		if err := a.admit(i * 10); err != nil {
+			t.Fatalf("expected every proposal to be admitted while appends are fast, got %v", err)
+		}
+	}
+
+	a.observe(50 * time.Millisecond)
+	if err := a.admit(5000); err != ErrProposalDeferred {
+		t.Fatalf("expected a large proposal to be deferred, got %v", err)
+	}
+	for _, size := range []int{50, 800} {
+		if err := a.admit(size); err != nil {
+			t.Fatalf("expected a proposal of %d bytes to be admitted, got %v", size, err)
+		}
+	}
+
+	// the average recovers with fast appends
+	for i := 0; i < 20; i++ {
+		a.observe(time.Millisecond)
+	}
+	if err := a.admit(5000); err != nil {
+		t.Fatalf("expected the proposal to be admitted after recovery, got %v", err)
+	}
+
+	// and when no append happened for a while
+	a.observe(time.Second)
+	a.lastSave = time.Now().Add(-2 * admissionStale)
+	if err := a.admit(5000); err != nil {
+		t.Fatalf("expected a stale latency to be ignored, got %v", err)
+	}
+
+	var off RaftNode
+	WithAdmission(AdmissionConfig{})(&off)
+	if err := off.admission.admit(1 << 30); err != nil {
+		t.Fatalf("expected disabled admission to admit everything, got %v", err)
+	}
+}
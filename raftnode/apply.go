@@ -0,0 +1,106 @@
+package raftnode
+
+import (
+	"log"
+	"metcd/failpoint"
+	"sync/atomic"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+// MaxApplyBacklog 是 raft 循环最多领先 apply 流水线的 Ready 批次数
+var MaxApplyBacklog = 1024
+
+// toApply 是一个 Ready 中需要交给状态机的内容
+type toApply struct {
+	snapshot  *raftpb.Snapshot // 需要状态机加载的快照
+	entries   []Entry          // 已提交的数据
+	index     uint64           // 应用完成后的 appliedIndex
+	term      uint64           // index 处日志的 term
+	confState raftpb.ConfState // 应用完成后的集群配置, 用于创建快照
+}
+
+// applyLoop 按顺序将日志交给状态机, 更新 appliedIndex 并按需创建快照
+func (rc *RaftNode) applyLoop() {
+	defer rc.recoverCrash()
+	defer close(rc.applyDonec)
+	for {
+		select {
+		case ap := <-rc.applyc:
+			rc.applyPhases.set(phaseCommit)
+			if !rc.apply(ap) {
+				return
+			}
+		case req := <-rc.defragc:
+			rc.applyPhases.set(phaseDefrag)
+			res, err := rc.defrag(req.ctx)
+			req.resc <- defragResponse{res, err}
+		case <-rc.applyStopc:
+			return
+		}
+	}
+}
+
+// ApplyLag 返回本节点已提交但状态机还没有应用的日志条数
+func (rc *RaftNode) ApplyLag() uint64 {
+	commit, applied := atomic.LoadUint64(&rc.commitIndex), rc.getAppliedIndex()
+	if commit <= applied {
+		return 0
+	}
+	return commit - applied
+}
+
+func (rc *RaftNode) apply(ap toApply) bool {
+	if err := failpoint.Inject(failpoint.Apply, uint64(rc.id)); err != nil {
+		panic(err)
+	}
+	if ap.snapshot != nil {
+		index := ap.snapshot.Metadata.Index
+		rc.applyPhases.set(phaseLoadSnapshot)
+		log.Printf("publishing snapshot at index %d", index)
+		// trigger kvstore to load snapshot
+		select {
+		case rc.commitC <- nil:
+		case <-rc.applyStopc:
+			return false
+		}
+		rc.setSnapshotIndex(index)
+		rc.setAppliedIndex(index)
+		rc.applyWait.Trigger(index)
+		log.Printf("finished publishing snapshot at index %d", index)
+		rc.events.add("loaded snapshot at index %d", index)
+		rc.applyPhases.set(phaseCommit)
+	}
+
+	var applyDoneC chan struct{}
+	if len(ap.entries) > 0 {
+		applyDoneC = make(chan struct{}, 1)
+		data := make([][]byte, len(ap.entries))
+		for i := range ap.entries {
+			data[i] = ap.entries[i].Data
+		}
+		commit := &Commit{Data: data, Entries: ap.entries, Index: ap.index, Term: ap.term, ApplyDoneC: applyDoneC}
+		select {
+		case rc.commitC <- commit:
+		case <-rc.applyStopc:
+			return false
+		}
+		rc.lastApplyDoneC = applyDoneC
+	}
+	rc.applyConfState = ap.confState
+
+	// after Commit, update appliedIndex
+	if ap.index > rc.getAppliedIndex() {
+		rc.setAppliedIndex(ap.index)
+		rc.applyWait.Trigger(ap.index)
+	}
+	rc.applyPhases.set(phaseCreateSnapshot)
+	rc.maybeTriggerSnapshot(applyDoneC, ap.confState)
+	return true
+}
+
+// stopApply 停止 apply 流水线并等待其退出, 之后才能关闭 commitC
+func (rc *RaftNode) stopApply() {
+	close(rc.applyStopc)
+	<-rc.applyDonec
+}
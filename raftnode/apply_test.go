@@ -0,0 +1,51 @@
+package raftnode
+
+import (
+	"metcd/wait"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+func TestApplyLoop(t *testing.T) {
+	rc := &RaftNode{
+		commitC:    make(chan *Commit),
+		applyc:     make(chan toApply, MaxApplyBacklog),
+		applyStopc: make(chan struct{}),
+		applyDonec: make(chan struct{}),
+		applyWait:  wait.NewTimeList(),
+		snapCount:  DefaultSnapshotCount,
+	}
+	go rc.applyLoop()
+
+	// the raft loop does not wait for the state machine
+	rc.applyc <- toApply{snapshot: &raftpb.Snapshot{Metadata: raftpb.SnapshotMetadata{Index: 10}}, index: 10}
+	rc.applyc <- toApply{entries: []Entry{{Index: 11, Term: 2, Data: []byte("a")}, {Index: 12, Term: 2, Data: []byte("b")}}, index: 12, term: 2}
+	rc.applyc <- toApply{index: 13, term: 3}
+	rc.applyc <- toApply{entries: []Entry{{Index: 14, Term: 3, Data: []byte("c")}}, index: 15, term: 3}
+
+	if c := <-rc.commitC; c != nil {
+		t.Fatalf("expected the snapshot first, got %v", c.Data)
+	}
+	for _, want := range []struct {
+		data         string
+		entry, index uint64
+	}{{"a", 11, 12}, {"c", 14, 15}} {
+		c := <-rc.commitC
+		if string(c.Data[0]) != want.data || c.Entries[0].Index != want.entry || c.Index != want.index {
+			t.Fatalf("expected %s at %d in a batch up to %d, got %v at %+v up to %d",
+				want.data, want.entry, want.index, c.Data, c.Entries, c.Index)
+		}
+		close(c.ApplyDoneC)
+	}
+	select {
+	case <-rc.applyWait.Wait(15):
+	case <-time.After(time.Second):
+		t.Fatalf("applied index did not reach 15, got %d", rc.getAppliedIndex())
+	}
+	if rc.getSnapshotIndex() != 10 {
+		t.Fatalf("expected snapshot index 10, got %d", rc.getSnapshotIndex())
+	}
+	rc.stopApply()
+}
@@ -0,0 +1,57 @@
+package raftnode
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
+	"go.etcd.io/etcd/server/v3/wal"
+	"go.etcd.io/etcd/server/v3/wal/walpb"
+	"go.uber.org/zap"
+)
+
+// BootstrapDataDir 在 dir 下为节点 id 创建数据目录: 一个内容为 data 的快照, 其配置中 voters 是投票成员,
+// 以及从该快照开始的 WAL. 以相同的 token, voters 和 data 初始化的节点组成一个集群,
+// 启动时从快照恢复而不是重新引导, 因此每次得到同样的初始状态. token 与 WithClusterToken 相同.
+func BootstrapDataDir(dir string, id int, token string, voters []uint64, data []byte) error {
+	lg := zap.NewNop()
+	waldir, snapdir := filepath.Join(dir, WALDir(id)), filepath.Join(dir, SnapDir(id))
+	if wal.Exist(waldir) {
+		return fmt.Errorf("%s already exists", waldir)
+	}
+	clusterID := uint64(defaultClusterID)
+	if token != "" {
+		clusterID = clusterIDFromToken(token)
+	}
+	if err := os.MkdirAll(snapdir, 0750); err != nil {
+		return err
+	}
+	snapshot := raftpb.Snapshot{
+		Data:     data,
+		Metadata: raftpb.SnapshotMetadata{Index: 1, Term: 1, ConfState: raftpb.ConfState{Voters: voters}},
+	}
+	if err := snap.New(lg, snapdir).SaveSnap(snapshot); err != nil {
+		return err
+	}
+	md, err := json.Marshal(walMetadata{NodeID: uint64(id), ClusterID: clusterID})
+	if err != nil {
+		return err
+	}
+	w, err := wal.Create(lg, waldir, md)
+	if err != nil {
+		return err
+	}
+	walsnap := walpb.Snapshot{Index: 1, Term: 1, ConfState: &snapshot.Metadata.ConfState}
+	if err := w.SaveSnapshot(walsnap); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Save(raftpb.HardState{Term: 1, Commit: 1}, nil); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,69 @@
+package raftnode
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type restoredStateMachine struct {
+	memStateMachine
+	restored chan string
+}
+
+func (m *restoredStateMachine) Restore(data []byte) error {
+	m.restored <- string(data)
+	return nil
+}
+
+func TestBootstrapDataDir(t *testing.T) {
+	dir := t.TempDir()
+	peers := []string{freePeerURL(t), freePeerURL(t)}
+	for id := 1; id <= 2; id++ {
+		if err := BootstrapDataDir(dir, id, "token", []uint64{1, 2}, []byte("seed")); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyDataDir(dir, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := BootstrapDataDir(dir, 1, "token", []uint64{1, 2}, []byte("seed")); err == nil {
+		t.Fatal("expected an existing data directory to be refused")
+	}
+
+	var nodes []*Node
+	var sms []*restoredStateMachine
+	for id := 1; id <= 2; id++ {
+		sm := &restoredStateMachine{memStateMachine{appliec: make(chan string, 16)}, make(chan string, 1)}
+		n, err := StartNode(id, peers, false, sm, WithDataDir(dir), WithClusterToken("token"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer n.Stop()
+		nodes, sms = append(nodes, n), append(sms, sm)
+	}
+	for _, sm := range sms {
+		select {
+		case data := <-sm.restored:
+			if data != "seed" {
+				t.Fatalf("expected the seed to be restored, got %q", data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the seed to be restored")
+		}
+	}
+	waitFor(t, "leadership", func() bool { return nodes[0].Status().Leader != 0 })
+	if m := nodes[0].Status().Members; len(m) != 2 {
+		t.Fatalf("expected 2 members, got %+v", m)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := nodes[1].Propose(ctx, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sm := range sms {
+		if got := <-sm.appliec; got != "foo" {
+			t.Fatalf("expected foo to be applied, got %q", got)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package raftnode
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockProbePath 是 peer url 上返回本节点时钟的路径
+const clockProbePath = "/raft/metcd/clock"
+
+// ClockProbeInterval 是两次探测各成员时钟的间隔, 也是一次探测的超时
+var ClockProbeInterval = 5 * time.Second
+
+// ClockSkew 是对一个成员时钟偏差的估计
+type ClockSkew struct {
+	ID     uint64
+	Offset time.Duration // 成员的时钟减去本节点的时钟
+	RTT    time.Duration // 探测的往返时间, 偏差的误差不超过它的一半
+	At     time.Time     // 探测的时间
+}
+
+// bound 返回确定存在的偏差: 偏差的绝对值减去往返时间的一半
+func (s ClockSkew) bound() time.Duration {
+	d := s.Offset
+	if d < 0 {
+		d = -d
+	}
+	if d -= s.RTT / 2; d < 0 {
+		return 0
+	}
+	return d
+}
+
+// clockSkews 记录最近一次探测各成员时钟的结果
+type clockSkews struct {
+	mu       sync.RWMutex
+	skews    map[uint64]ClockSkew
+	exceeded bool
+}
+
+// WithClockSkewBound 设置允许的成员之间的时钟偏差, 超过时不再用租约服务有界陈旧读,
+// 总是经过读索引. 0 只测量偏差
+func WithClockSkewBound(d time.Duration) Option {
+	return func(rc *RaftNode) {
+		rc.clockSkewBound = d
+	}
+}
+
+// ClockSkews 返回各成员相对本节点的时钟偏差, 按 ID 排序. 只有 rafthttp 传输会探测
+func (rc *RaftNode) ClockSkews() []ClockSkew {
+	rc.clocks.mu.RLock()
+	defer rc.clocks.mu.RUnlock()
+	skews := make([]ClockSkew, 0, len(rc.clocks.skews))
+	for _, s := range rc.clocks.skews {
+		skews = append(skews, s)
+	}
+	sort.Slice(skews, func(i, j int) bool { return skews[i].ID < skews[j].ID })
+	return skews
+}
+
+// ClockSkewExceeded 报告是否有成员的时钟偏差确定超过了 WithClockSkewBound
+func (rc *RaftNode) ClockSkewExceeded() bool {
+	rc.clocks.mu.RLock()
+	defer rc.clocks.mu.RUnlock()
+	return rc.clocks.exceeded
+}
+
+// serveClock 返回本节点时钟的 UnixNano
+func serveClock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	io.WriteString(w, strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+// probeClocks 每 ClockProbeInterval 探测一次各成员的时钟, 直到 HTTP 服务停止
+func (rc *RaftNode) probeClocks() {
+	client := &http.Client{Timeout: ClockProbeInterval}
+	ticker := time.NewTicker(ClockProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-rc.httpstopc:
+			return
+		}
+		members := rc.Members()
+		skews := make(map[uint64]ClockSkew, len(members))
+		for _, m := range members {
+			if m.ID == uint64(rc.id) || m.PeerURL == "" {
+				continue
+			}
+			s, err := probeClock(client, m.PeerURL)
+			if err != nil {
+				rc.logger.Sugar().Debugf("failed to probe the clock of member %d (%v)", m.ID, err)
+				// 保留上一次的结果, 直到成员被移除
+				if old, ok := rc.clocks.get(m.ID); ok {
+					skews[m.ID] = old
+				}
+				continue
+			}
+			s.ID = m.ID
+			skews[m.ID] = s
+		}
+		rc.setClockSkews(skews)
+	}
+}
+
+func (c *clockSkews) get(id uint64) (ClockSkew, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s, ok := c.skews[id]
+	return s, ok
+}
+
+func (rc *RaftNode) setClockSkews(skews map[uint64]ClockSkew) {
+	exceeded := false
+	var max time.Duration
+	for _, s := range skews {
+		if d := s.bound(); d > max {
+			max = d
+		}
+	}
+	if rc.clockSkewBound > 0 && max > rc.clockSkewBound {
+		exceeded = true
+	}
+	rc.clocks.mu.Lock()
+	was := rc.clocks.exceeded
+	rc.clocks.skews, rc.clocks.exceeded = skews, exceeded
+	rc.clocks.mu.Unlock()
+
+	if rc.group == "" {
+		peerClockSkew.Reset()
+		for id, s := range skews {
+			peerClockSkew.WithLabelValues(strconv.FormatUint(id, 10)).Set(s.Offset.Seconds())
+		}
+	}
+	switch {
+	case exceeded && !was:
+		rc.logger.Sugar().Warnf("clock skew of %v exceeds %v, serving bounded staleness reads through the read index", max, rc.clockSkewBound)
+	case !exceeded && was:
+		rc.logger.Sugar().Infof("clock skew back within %v, serving bounded staleness reads from the lease again", rc.clockSkewBound)
+	}
+}
+
+// probeClock 估计 peerURL 上成员的时钟偏差: 成员的时钟对应请求往返的中点
+func probeClock(client *http.Client, peerURL string) (ClockSkew, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, strings.TrimSuffix(peerURL, "/")+clockProbePath, nil)
+	if err != nil {
+		return ClockSkew{}, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return ClockSkew{}, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	end := time.Now()
+	if err != nil {
+		return ClockSkew{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ClockSkew{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	ns, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return ClockSkew{}, fmt.Errorf("invalid clock %q", b)
+	}
+	rtt := end.Sub(start)
+	// Round(0) 去掉单调时钟读数, 按墙上时钟比较
+	mid := start.Add(rtt / 2).Round(0)
+	return ClockSkew{Offset: time.Unix(0, ns).Sub(mid), RTT: rtt, At: end}, nil
+}
@@ -0,0 +1,57 @@
+package raftnode
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestProbeClock(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(serveClock))
+	defer srv.Close()
+	s, err := probeClock(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.bound() != 0 {
+		t.Fatalf("expected no skew with the same clock, got %+v", s)
+	}
+
+	ahead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.FormatInt(time.Now().Add(time.Hour).UnixNano(), 10)))
+	}))
+	defer ahead.Close()
+	if s, err = probeClock(ahead.Client(), ahead.URL+"/"); err != nil {
+		t.Fatal(err)
+	}
+	if d := s.Offset - time.Hour; d > s.RTT || d < -s.RTT {
+		t.Fatalf("expected an offset of 1h, got %+v", s)
+	}
+}
+
+func TestClockSkewExceeded(t *testing.T) {
+	rc := &RaftNode{clockSkewBound: time.Second, group: "test", logger: zap.NewNop()}
+	rc.setClockSkews(map[uint64]ClockSkew{
+		2: {ID: 2, Offset: -1500 * time.Millisecond, RTT: 2 * time.Second},
+		3: {ID: 3, Offset: 500 * time.Millisecond},
+	})
+	if rc.ClockSkewExceeded() {
+		t.Fatal("expected a skew within the uncertainty of the probe to be tolerated")
+	}
+	rc.setClockSkews(map[uint64]ClockSkew{2: {ID: 2, Offset: -1500 * time.Millisecond, RTT: 200 * time.Millisecond}})
+	if !rc.ClockSkewExceeded() {
+		t.Fatal("expected the skew to exceed the bound")
+	}
+	if skews := rc.ClockSkews(); len(skews) != 1 || skews[0].ID != 2 {
+		t.Fatalf("expected the skew of member 2, got %+v", skews)
+	}
+	rc.clockSkewBound = 0
+	rc.setClockSkews(map[uint64]ClockSkew{2: {ID: 2, Offset: time.Hour}})
+	if rc.ClockSkewExceeded() {
+		t.Fatal("expected no bound to be exceeded without one")
+	}
+}
@@ -0,0 +1,146 @@
+package raftnode
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/raft/v3"
+	"go.uber.org/zap"
+)
+
+// RecentEventsN 是崩溃报告中保留的最近事件数
+var RecentEventsN = 64
+
+// crashStatusTimeout 是崩溃报告等待 raft 状态的时限, raft 库在自己的 goroutine 中
+// panic 时无法再回答 Status
+const crashStatusTimeout = time.Second
+
+// eventRing 保存最近的节点事件: leader 变更, 成员变更, 快照和 WAL 的加载, 供崩溃报告使用
+type eventRing struct {
+	mu     sync.Mutex
+	events []string
+	next   int
+	full   bool
+}
+
+func newEventRing(n int) *eventRing {
+	if n < 1 {
+		n = 1
+	}
+	return &eventRing{events: make([]string, n)}
+}
+
+// add 记录一个事件, nil 的 eventRing 不记录
+func (r *eventRing) add(format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	e := time.Now().UTC().Format(time.RFC3339Nano) + " " + fmt.Sprintf(format, args...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	r.full = r.full || r.next == 0
+}
+
+// list 按发生顺序返回最近的事件
+func (r *eventRing) list() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]string(nil), r.events[:r.next]...)
+	}
+	return append(append([]string(nil), r.events[r.next:]...), r.events[:r.next]...)
+}
+
+// crashFields 返回崩溃报告的内容: raft 状态, 已应用, 已提交和已持久化的索引, 成员和最近的事件
+func (rc *RaftNode) crashFields(reason string) []zap.Field {
+	fields := []zap.Field{
+		zap.String("reason", reason),
+		zap.Int("id", rc.id),
+		zap.Uint64("applied-index", rc.getAppliedIndex()),
+		zap.Uint64("snapshot-index", rc.getSnapshotIndex()),
+		zap.Uint64("durable-index", rc.DurableIndex()),
+		zap.Uint64("leader", rc.getLead()),
+		zap.Strings("recent-events", rc.events.list()),
+	}
+	if rc.members != nil {
+		fields = append(fields, zap.Any("members", rc.Members()))
+	}
+	if node := rc.node; node != nil {
+		stc := make(chan raft.Status, 1)
+		go func() { stc <- node.Status() }()
+		select {
+		case st := <-stc:
+			fields = append(fields,
+				zap.Uint64("term", st.Term),
+				zap.Uint64("commit-index", st.Commit),
+				zap.String("raft-status", st.String()))
+		case <-time.After(crashStatusTimeout):
+			fields = append(fields, zap.String("raft-status", "unavailable"))
+		}
+	}
+	return fields
+}
+
+// logCrash 在节点因 reason 退出前把崩溃报告写入日志
+func (rc *RaftNode) logCrash(reason string) {
+	rc.logger.Error("raft node crashed", rc.crashFields(reason)...)
+	rc.logger.Sync()
+}
+
+// fatalf 写入崩溃报告后退出进程
+func (rc *RaftNode) fatalf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	rc.logCrash(msg)
+	log.Fatal(msg)
+}
+
+// recoverCrash 在 goroutine 退出时为 panic 写入崩溃报告, 然后继续 panic
+func (rc *RaftNode) recoverCrash() {
+	if r := recover(); r != nil {
+		rc.logCrash(fmt.Sprint(r))
+		panic(r)
+	}
+}
+
+// crashLogger 在 raft 库 Fatal 或 Panic 之前写入崩溃报告, 例如日志损坏或丢失时
+type crashLogger struct {
+	raft.Logger
+	rc *RaftNode
+}
+
+func (rc *RaftNode) newCrashLogger() raft.Logger {
+	lg := rc.raftLogger
+	if lg == nil {
+		// 与 raft 库的默认日志相同
+		lg = &raft.DefaultLogger{Logger: log.New(os.Stderr, "raft", log.LstdFlags)}
+	}
+	return &crashLogger{Logger: lg, rc: rc}
+}
+
+func (l *crashLogger) Fatal(v ...interface{}) {
+	l.rc.logCrash(fmt.Sprint(v...))
+	l.Logger.Fatal(v...)
+}
+
+func (l *crashLogger) Fatalf(format string, v ...interface{}) {
+	l.rc.logCrash(fmt.Sprintf(format, v...))
+	l.Logger.Fatalf(format, v...)
+}
+
+func (l *crashLogger) Panic(v ...interface{}) {
+	l.rc.logCrash(fmt.Sprint(v...))
+	l.Logger.Panic(v...)
+}
+
+func (l *crashLogger) Panicf(format string, v ...interface{}) {
+	l.rc.logCrash(fmt.Sprintf(format, v...))
+	l.Logger.Panicf(format, v...)
+}
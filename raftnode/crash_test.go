@@ -0,0 +1,60 @@
+package raftnode
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.etcd.io/etcd/raft/v3"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestEventRing(t *testing.T) {
+	r := newEventRing(3)
+	for i := 0; i < 5; i++ {
+		r.add("event %d", i)
+	}
+	events := r.list()
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %v", events)
+	}
+	for i, e := range events {
+		if want := fmt.Sprintf("event %d", i+2); !strings.HasSuffix(e, want) {
+			t.Fatalf("expected event %d to be %q, got %q", i, want, e)
+		}
+	}
+}
+
+func TestCrashLogger(t *testing.T) {
+	core, logs := observer.New(zap.ErrorLevel)
+	rc := &RaftNode{
+		id:      1,
+		logger:  zap.New(core),
+		members: newMembership([]string{"http://127.0.0.1:1"}),
+		events:  newEventRing(RecentEventsN),
+		// like the raft default, but silent
+		raftLogger: &raft.DefaultLogger{Logger: zap.NewStdLog(zap.NewNop())},
+	}
+	rc.setAppliedIndex(7)
+	rc.events.add("leader changed to 1")
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the raft logger to panic")
+			}
+		}()
+		rc.newCrashLogger().Panicf("tocommit(%d) is out of range", 9)
+	}()
+	if logs.Len() != 1 {
+		t.Fatalf("expected a crash report, got %v", logs.All())
+	}
+	fields := logs.All()[0].ContextMap()
+	if fields["reason"] != "tocommit(9) is out of range" || fields["applied-index"] != uint64(7) {
+		t.Fatalf("unexpected crash report %v", fields)
+	}
+	if events, ok := fields["recent-events"].([]interface{}); !ok || len(events) != 1 {
+		t.Fatalf("expected the recent events in the report, got %v", fields["recent-events"])
+	}
+}
@@ -0,0 +1,135 @@
+package raftnode
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
+	"go.etcd.io/etcd/server/v3/wal"
+	"go.etcd.io/etcd/server/v3/wal/walpb"
+	"go.uber.org/zap"
+)
+
+// SnapDir 返回节点 id 存放快照的目录
+func SnapDir(id int) string {
+	return fmt.Sprintf("metcd-%d-snap", id)
+}
+
+// WithDataDir 把 WAL 和快照目录放到 dir 下, 默认为当前目录
+func WithDataDir(dir string) Option {
+	return func(rc *RaftNode) {
+		rc.waldir = filepath.Join(dir, WALDir(rc.id))
+		rc.snapdir = filepath.Join(dir, SnapDir(rc.id))
+	}
+}
+
+// FileSize 是数据目录中一个文件的大小
+type FileSize struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// DataFiles 返回 WAL 目录和快照目录中的文件及其大小, 按文件名排序
+func (rc *RaftNode) DataFiles() (wal, snaps []FileSize, err error) {
+	if wal, err = dirFiles(rc.waldir); err != nil {
+		return nil, nil, err
+	}
+	if snaps, err = dirFiles(rc.snapdir); err != nil {
+		return nil, nil, err
+	}
+	return wal, snaps, nil
+}
+
+func dirFiles(dir string) ([]FileSize, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]FileSize, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// 文件可能刚被清理
+			continue
+		}
+		files = append(files, FileSize{Name: e.Name(), Size: info.Size()})
+	}
+	return files, nil
+}
+
+// walMetadata 在创建 WAL 时写入, 用于拒绝以错误的节点 ID 或集群启动一个数据目录.
+// 旧版本创建的 WAL 没有 metadata, 不做检查.
+type walMetadata struct {
+	NodeID    uint64 `json:"nodeID"`
+	ClusterID uint64 `json:"clusterID"`
+}
+
+func (rc *RaftNode) walMetadata() []byte {
+	b, err := json.Marshal(walMetadata{NodeID: uint64(rc.id), ClusterID: rc.clusterID})
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// checkWALMetadata 检查 WAL 是否属于节点 id, clusterID 不为 0 时同时检查集群
+func checkWALMetadata(b []byte, id, clusterID uint64) error {
+	if len(b) == 0 {
+		return nil
+	}
+	var md walMetadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return fmt.Errorf("invalid WAL metadata (%v)", err)
+	}
+	if md.NodeID != id {
+		return fmt.Errorf("WAL belongs to member %d, not %d", md.NodeID, id)
+	}
+	if clusterID != 0 && md.ClusterID != clusterID {
+		return fmt.Errorf("WAL belongs to cluster %x, not %x; check --initial-cluster-token", md.ClusterID, clusterID)
+	}
+	return nil
+}
+
+// VerifyDataDir 校验 dir 中节点 id 的 WAL 与快照: 读取最新的可用快照和其后的全部日志,
+// 检查 CRC 以及 WAL 是否属于该节点. 节点运行时也可以调用, 不会加锁.
+func VerifyDataDir(dir string, id int) error {
+	lg := zap.NewNop()
+	waldir, snapdir := filepath.Join(dir, WALDir(id)), filepath.Join(dir, SnapDir(id))
+	if !wal.Exist(waldir) {
+		return fmt.Errorf("no WAL of member %d in %q", id, dir)
+	}
+	walSnaps, err := wal.ValidSnapshotEntries(lg, waldir)
+	if err != nil {
+		return fmt.Errorf("listing snapshots (%v)", err)
+	}
+	var snapshot *raftpb.Snapshot
+	if fileutil.Exist(snapdir) {
+		snapshot, err = snap.New(lg, snapdir).LoadNewestAvailable(walSnaps)
+		if err != nil && err != snap.ErrNoSnapshot {
+			return fmt.Errorf("loading snapshots (%v)", err)
+		}
+	} else if n := len(walSnaps); n > 0 && walSnaps[n-1].Index > 0 {
+		return fmt.Errorf("snapshot directory %q is missing", snapdir)
+	}
+	var walsnap walpb.Snapshot
+	if snapshot != nil {
+		walsnap.Index, walsnap.Term = snapshot.Metadata.Index, snapshot.Metadata.Term
+	}
+	w, err := wal.OpenForRead(lg, waldir, walsnap)
+	if err != nil {
+		return fmt.Errorf("opening WAL (%v)", err)
+	}
+	defer w.Close()
+	md, _, _, err := w.ReadAll()
+	if err != nil {
+		return fmt.Errorf("reading WAL (%v)", err)
+	}
+	return checkWALMetadata(md, uint64(id), 0)
+}
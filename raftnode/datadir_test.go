@@ -0,0 +1,23 @@
+package raftnode
+
+import "testing"
+
+func TestCheckWALMetadata(t *testing.T) {
+	rc := &RaftNode{id: 2, clusterID: 0x1234}
+	md := rc.walMetadata()
+	if err := checkWALMetadata(md, 2, 0x1234); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWALMetadata(md, 2, 0); err != nil {
+		t.Fatalf("cluster 0 must match any cluster: %v", err)
+	}
+	if err := checkWALMetadata(md, 3, 0x1234); err == nil {
+		t.Fatal("expected a different member to be refused")
+	}
+	if err := checkWALMetadata(md, 2, 0x1000); err == nil {
+		t.Fatal("expected a different cluster to be refused")
+	}
+	if err := checkWALMetadata(nil, 5, 0x1000); err != nil {
+		t.Fatalf("WALs without metadata are not checked: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package raftnode
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RemovedMarker 返回节点 id 被移出集群后在数据目录中留下的标记文件名. 有标记的数据目录
+// 属于已经不是成员的节点, 重新加入集群时删除, 否则拒绝启动
+func RemovedMarker(id int) string {
+	return fmt.Sprintf("metcd-%d.removed", id)
+}
+
+func (rc *RaftNode) removedMarker() string {
+	return filepath.Join(filepath.Dir(rc.waldir), RemovedMarker(rc.id))
+}
+
+// markRemoved 在本节点被移出集群时标记数据目录并通知 Removed
+func (rc *RaftNode) markRemoved() {
+	if err := os.WriteFile(rc.removedMarker(), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0640); err != nil {
+		rc.logger.Sugar().Warnf("cannot mark the data directory of removed member %d (%v)", rc.id, err)
+	}
+	close(rc.removedc)
+}
+
+// Removed 返回一个在本节点应用了把自己移出集群的配置变更后关闭的 channel, 之后节点停止
+func (rc *RaftNode) Removed() <-chan struct{} {
+	return rc.removedc
+}
+
+// clearRemoved 在启动时处理被移出集群的节点留下的数据目录: 重新加入时删除旧的 WAL 和快照,
+// 否则旧的日志会让节点以已经不存在的成员身份启动
+func (rc *RaftNode) clearRemoved() {
+	marker := rc.removedMarker()
+	if _, err := os.Stat(marker); err != nil {
+		return
+	}
+	if !rc.join {
+		rc.fatalf("metcd:member %d was removed from the cluster, join it again or delete %s, %s and %s", rc.id, rc.waldir, rc.snapdir, marker)
+	}
+	rc.logger.Sugar().Infof("member %d was removed from the cluster, deleting its old WAL and snapshots to join again", rc.id)
+	for _, path := range []string{rc.waldir, rc.snapdir, marker} {
+		if err := os.RemoveAll(path); err != nil {
+			rc.fatalf("metcd:cannot delete %s (%v)", path, err)
+		}
+	}
+}
+
+// WithRemovedArchive 让被移出集群的节点在停止后把 WAL 和快照目录移到数据目录下的
+// metcd-<id>.removed-<时间> 中保留, 而不是留在原处. 标记文件保留, 节点仍然只能重新加入
+func WithRemovedArchive() Option {
+	return func(rc *RaftNode) {
+		rc.archiveRemoved = true
+	}
+}
+
+// archive 在 WAL 关闭后归档被移出集群的节点的数据目录
+func (rc *RaftNode) archive() {
+	select {
+	case <-rc.removedc:
+	default:
+		return
+	}
+	if !rc.archiveRemoved {
+		return
+	}
+	dir := filepath.Join(filepath.Dir(rc.waldir), fmt.Sprintf("%s-%s", RemovedMarker(rc.id), time.Now().UTC().Format("20060102T150405Z")))
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		rc.logger.Sugar().Warnf("cannot archive the data directory of removed member %d (%v)", rc.id, err)
+		return
+	}
+	for _, path := range []string{rc.waldir, rc.snapdir} {
+		if err := os.Rename(path, filepath.Join(dir, filepath.Base(path))); err != nil && !os.IsNotExist(err) {
+			rc.logger.Sugar().Warnf("cannot archive %s of removed member %d (%v)", path, rc.id, err)
+			return
+		}
+	}
+	rc.logger.Sugar().Infof("archived the WAL and snapshots of removed member %d to %s", rc.id, dir)
+}
+
+// TransferLeadership 把 leader 转移给 transferee, 等到 leader 不再是原来的节点或 ctx 结束
+func (rc *RaftNode) TransferLeadership(ctx context.Context, transferee uint64) error {
+	lead := rc.getLead()
+	if lead == transferee {
+		return nil
+	}
+	rc.node.TransferLeadership(ctx, lead, transferee)
+	for rc.getLead() == lead {
+		select {
+		case <-time.After(TickInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("transferring leadership from %x to %x (%v)", lead, transferee, ctx.Err())
+		}
+	}
+	return nil
+}
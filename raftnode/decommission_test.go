@@ -0,0 +1,107 @@
+package raftnode
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestTransferLeadership(t *testing.T) {
+	defer func(d time.Duration) { TickInterval = d }(TickInterval)
+	TickInterval = 10 * time.Millisecond
+	net, dir := NewMemoryNetwork(), t.TempDir()
+	peers := []string{"memory://1", "memory://2", "memory://3"}
+	var nodes []*Node
+	for id := 1; id <= 3; id++ {
+		n, err := StartNode(id, peers, false, &memStateMachine{appliec: make(chan string, 16)}, WithDataDir(dir), WithMemoryNetwork(net))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer n.Stop()
+		nodes = append(nodes, n)
+	}
+	waitFor(t, "leadership", func() bool { return nodes[0].Status().Leader != 0 })
+	old := nodes[0].Status().Leader
+	to := old%3 + 1
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// asked on the third member, a follower, the leader hands over
+	third := 6 - old - to
+	if err := nodes[third-1].RaftNode().TransferLeadership(ctx, to); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the new leader", func() bool { return nodes[0].Status().Leader == to })
+}
+
+func TestClearRemoved(t *testing.T) {
+	dir := t.TempDir()
+	rc := &RaftNode{id: 2, join: true, logger: zap.NewNop()}
+	WithDataDir(dir)(rc)
+	for _, d := range []string{rc.waldir, rc.snapdir} {
+		if err := os.MkdirAll(d, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// without a marker the data directory is left alone
+	rc.clearRemoved()
+	if _, err := os.Stat(rc.waldir); err != nil {
+		t.Fatalf("expected the WAL to be kept, got %v", err)
+	}
+
+	rc.removedc = make(chan struct{})
+	rc.markRemoved()
+	select {
+	case <-rc.Removed():
+	default:
+		t.Fatal("expected Removed to be closed")
+	}
+	marker := filepath.Join(dir, RemovedMarker(2))
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("expected the data directory to be marked, got %v", err)
+	}
+	rc.clearRemoved()
+	for _, path := range []string{rc.waldir, rc.snapdir, marker} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be deleted to join again, got %v", path, err)
+		}
+	}
+}
+
+func TestArchiveRemoved(t *testing.T) {
+	dir := t.TempDir()
+	rc := &RaftNode{id: 2, removedc: make(chan struct{}), logger: zap.NewNop()}
+	WithDataDir(dir)(rc)
+	WithRemovedArchive()(rc)
+	for _, d := range []string{rc.waldir, rc.snapdir} {
+		if err := os.MkdirAll(d, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a member still in the cluster keeps its data directory
+	rc.archive()
+	if _, err := os.Stat(rc.waldir); err != nil {
+		t.Fatalf("expected the WAL to be kept, got %v", err)
+	}
+
+	rc.markRemoved()
+	rc.archive()
+	archives, _ := filepath.Glob(filepath.Join(dir, RemovedMarker(2)+"-*"))
+	if len(archives) != 1 {
+		t.Fatalf("expected one archive, got %v", archives)
+	}
+	for _, d := range []string{rc.waldir, rc.snapdir} {
+		if _, err := os.Stat(d); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be moved, got %v", d, err)
+		}
+		if _, err := os.Stat(filepath.Join(archives[0], filepath.Base(d))); err != nil {
+			t.Fatalf("expected %s in the archive, got %v", d, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, RemovedMarker(2))); err != nil {
+		t.Fatalf("expected the marker to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package raftnode
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+)
+
+// DefragResult 是一次整理的结果
+type DefragResult struct {
+	SnapshotIndex    uint64 // 整理后最新快照的索引
+	CompactIndex     uint64 // 内存中保留的第一条日志之前的索引
+	RemovedWALs      int    // 删除的 WAL 段文件数
+	RemovedSnapshots int    // 删除的快照文件数
+	ReclaimedBytes   int64  // 删除的文件的总大小
+}
+
+type defragRequest struct {
+	ctx  context.Context
+	resc chan defragResponse
+}
+
+type defragResponse struct {
+	res DefragResult
+	err error
+}
+
+// Defrag 立即在已应用的位置创建快照, 把内存中的日志截断到 SnapshotCatchUpEntriesN 条,
+// 并删除快照之前的 WAL 段文件和过时的快照文件. 长时间运行的节点在两次快照之间会不断
+// 积累 WAL 段文件, 只影响本节点.
+func (rc *RaftNode) Defrag(ctx context.Context) (DefragResult, error) {
+	req := defragRequest{ctx: ctx, resc: make(chan defragResponse, 1)}
+	select {
+	case rc.defragc <- req:
+	case <-ctx.Done():
+		return DefragResult{}, ctx.Err()
+	case <-rc.applyDonec:
+		return DefragResult{}, ErrStopped
+	}
+	resp := <-req.resc
+	return resp.res, resp.err
+}
+
+// defrag 在 apply 流水线中执行, 与快照的创建和日志的应用互斥
+func (rc *RaftNode) defrag(ctx context.Context) (DefragResult, error) {
+	var res DefragResult
+	// 快照必须包含已交给状态机的全部日志
+	if done := rc.lastApplyDoneC; done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-rc.applyStopc:
+			return res, ErrStopped
+		}
+	}
+	if appliedIndex := rc.getAppliedIndex(); appliedIndex > rc.getSnapshotIndex() {
+		log.Printf("start snapshot for defrag [applied index: %d | last snapshot index: %d]", appliedIndex, rc.getSnapshotIndex())
+		rc.createSnapshot(appliedIndex, rc.applyConfState)
+	}
+	res.SnapshotIndex = rc.getSnapshotIndex()
+	first, err := rc.raftStorage.FirstIndex()
+	if err != nil {
+		return res, err
+	}
+	res.CompactIndex = first - 1
+
+	// 非 always 模式下快照记录可能还没有落盘, 删除旧文件前先刷盘
+	if rc.walSync != WALSyncAlways {
+		if err := syncWALDir(rc.waldir, time.Time{}); err != nil {
+			return res, err
+		}
+	}
+	rc.purgeMu.Lock()
+	defer rc.purgeMu.Unlock()
+	n, size, err := purgeWALs(rc.waldir, purgeAll)
+	res.RemovedWALs, res.ReclaimedBytes = n, size
+	purgedFiles.WithLabelValues(purgeWAL).Add(float64(n))
+	purgedBytes.WithLabelValues(purgeWAL).Add(float64(size))
+	if err != nil {
+		return res, err
+	}
+	n, size, err = purgeSnapshots(rc.snapdir, purgeAll)
+	res.RemovedSnapshots, res.ReclaimedBytes = n, res.ReclaimedBytes+size
+	purgedFiles.WithLabelValues(purgeSnap).Add(float64(n))
+	purgedBytes.WithLabelValues(purgeSnap).Add(float64(size))
+	if err != nil {
+		return res, err
+	}
+	log.Printf("defrag removed %d WAL segments and %d snapshots, reclaimed %d bytes",
+		res.RemovedWALs, res.RemovedSnapshots, res.ReclaimedBytes)
+	return res, nil
+}
+
+// purgeWALs 从最旧的段文件开始删除 WAL 已释放且 ok 的段文件. WAL 锁住了它仍需要的段文件,
+// 遇到第一个被锁住或不 ok 的段文件即停止, 最后一个段文件总是保留.
+func purgeWALs(dir string, ok purgeable) (int, int64, error) {
+	names, err := listFiles(dir, ".wal")
+	if err != nil {
+		return 0, 0, err
+	}
+	var size int64
+	for i, name := range names {
+		if i == len(names)-1 {
+			return i, size, nil
+		}
+		path := filepath.Join(dir, name)
+		l, err := fileutil.TryLockFile(path, os.O_WRONLY, fileutil.PrivateFileMode)
+		if errors.Is(err, fileutil.ErrLocked) {
+			return i, size, nil
+		}
+		if err != nil {
+			return i, size, err
+		}
+		info, err := l.Stat()
+		if err == nil && !ok(i, len(names), info) {
+			l.Close()
+			return i, size, nil
+		}
+		if err == nil {
+			err = os.Remove(path)
+		}
+		l.Close()
+		if err != nil {
+			return i, size, err
+		}
+		size += info.Size()
+	}
+	return len(names), size, nil
+}
+
+// purgeSnapshots 从最旧的快照文件开始删除 ok 的快照文件, 遇到第一个不 ok 的即停止,
+// 最新的快照总是保留
+func purgeSnapshots(dir string, ok purgeable) (int, int64, error) {
+	names, err := listFiles(dir, ".snap")
+	if err != nil || len(names) <= 1 {
+		return 0, 0, err
+	}
+	var size int64
+	for i, name := range names[:len(names)-1] {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err == nil && !ok(i, len(names), info) {
+			return i, size, nil
+		}
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			return i, size, err
+		}
+		size += info.Size()
+	}
+	return len(names) - 1, size, nil
+}
+
+// listFiles 返回 dir 中以 suffix 结尾的文件名, 按名字排序即按索引排序
+func listFiles(dir, suffix string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), suffix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,55 @@
+package raftnode
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+)
+
+func TestPurge(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int) {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("0000000000000000-0000000000000000.wal", 10)
+	write("0000000000000001-0000000000000010.wal", 20)
+	write("0000000000000002-0000000000000020.wal", 30)
+	write("0000000000000003-0000000000000030.wal", 40)
+	write("0.tmp", 50)
+	// the WAL still holds the third segment
+	l, err := fileutil.LockFile(filepath.Join(dir, "0000000000000002-0000000000000020.wal"), os.O_WRONLY, fileutil.PrivateFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	n, size, err := purgeWALs(dir, purgeAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || size != 30 {
+		t.Fatalf("expected 2 segments of 30 bytes removed, got %d of %d bytes", n, size)
+	}
+	names, _ := listFiles(dir, ".wal")
+	if len(names) != 2 {
+		t.Fatalf("expected the locked and the last segment to remain, got %v", names)
+	}
+
+	write("0000000000000001-0000000000000100.snap", 5)
+	write("0000000000000002-0000000000000200.snap", 6)
+	write("0000000000000002-0000000000000300.snap", 7)
+	n, size, err = purgeSnapshots(dir, purgeAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || size != 11 {
+		t.Fatalf("expected 2 snapshots of 11 bytes removed, got %d of %d bytes", n, size)
+	}
+	if names, _ := listFiles(dir, ".snap"); len(names) != 1 || names[0] != "0000000000000002-0000000000000300.snap" {
+		t.Fatalf("expected the newest snapshot to remain, got %v", names)
+	}
+}
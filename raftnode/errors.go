@@ -6,4 +6,8 @@ var (
 	ErrStopped       = errors.New("raft node:server stopped")
 	ErrLeaderChanged = errors.New("raft node:leader changed")
 	ErrTimeout       = errors.New("raft node:request timeout")
+	// ErrProposalDeferred 是 WAL 写入变慢时被准入控制拒绝的大提案的错误, 稍后可以重试
+	ErrProposalDeferred = errors.New("raft node:large proposal deferred while WAL appends are slow")
+	// ErrApplyBacklog 是状态机落后太多时被限流拒绝的提案的错误, 稍后可以重试
+	ErrApplyBacklog = errors.New("raft node:proposal rejected while the state machine lags behind")
 )
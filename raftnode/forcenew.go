@@ -0,0 +1,110 @@
+package raftnode
+
+import (
+	"sort"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/wal"
+)
+
+// WithForceNewCluster 让节点从已有的数据目录以单节点集群启动: 丢弃未提交的日志, 并在
+// WAL 中追加已提交的配置变更, 移除其他所有成员. 用于集群失去 quorum 后从一个幸存的成员
+// 恢复, 之后再让其他成员重新加入. 只应在一次启动中使用
+func WithForceNewCluster() Option {
+	return func(rc *RaftNode) {
+		rc.forceNewCluster = true
+	}
+}
+
+// forceNewClusterWAL 改写重放出的 WAL, 返回改写后的 HardState 和日志
+func (rc *RaftNode) forceNewClusterWAL(w *wal.WAL, snapshot *raftpb.Snapshot, st raftpb.HardState, ents []raftpb.Entry) (raftpb.HardState, []raftpb.Entry) {
+	// 未提交的日志可能永远不会被提交, 丢弃它们
+	for i := range ents {
+		if ents[i].Index > st.Commit {
+			rc.logger.Sugar().Warnf("force new cluster: discarding %d uncommitted entries", len(ents)-i)
+			ents = ents[:i]
+			break
+		}
+	}
+	last := st.Commit
+	if snapshot != nil && snapshot.Metadata.Index > last {
+		last = snapshot.Metadata.Index
+	}
+	self := uint64(rc.id)
+	voters, learners := memberIDs(snapshot, ents)
+	var ccs []raftpb.ConfChange
+	for _, id := range append(voters, learners...) {
+		if id != self {
+			ccs = append(ccs, raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: id})
+		}
+	}
+	if i := sort.Search(len(voters), func(i int) bool { return voters[i] >= self }); i == len(voters) || voters[i] != self {
+		// 不是投票成员时加入或提升自己
+		var url string
+		if rc.id <= len(rc.peers) {
+			url = rc.peers[rc.id-1]
+		}
+		ccs = append(ccs, raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: self, Context: []byte(url)})
+	}
+
+	forced := make([]raftpb.Entry, len(ccs))
+	for i, cc := range ccs {
+		data, err := cc.Marshal()
+		if err != nil {
+			rc.fatalf("metcd:force new cluster: cannot encode %s of member %d (%v)", cc.Type, cc.NodeID, err)
+		}
+		forced[i] = raftpb.Entry{Type: raftpb.EntryConfChange, Term: st.Term, Index: last + uint64(i) + 1, Data: data}
+	}
+	if len(forced) > 0 {
+		st.Commit = forced[len(forced)-1].Index
+	}
+	sealed, err := sealEntries(rc.sealer, forced)
+	if err != nil {
+		rc.fatalf("metcd:force new cluster: cannot encrypt the entries (%v)", err)
+	}
+	if err := w.Save(st, sealed); err != nil {
+		rc.fatalf("metcd:force new cluster: cannot write the WAL (%v)", err)
+	}
+	rc.logger.Sugar().Warnf("force new cluster: removing members %v, member %d is now the only voter", append(voters, learners...), rc.id)
+	return st, append(ents, forced...)
+}
+
+// memberIDs 返回快照和之后已提交的配置变更得出的投票成员和 learner, 按 ID 排序
+func memberIDs(snapshot *raftpb.Snapshot, ents []raftpb.Entry) (voters, learners []uint64) {
+	members := make(map[uint64]bool) // ID -> 是否是 learner
+	if snapshot != nil {
+		for _, id := range snapshot.Metadata.ConfState.Voters {
+			members[id] = false
+		}
+		for _, id := range snapshot.Metadata.ConfState.Learners {
+			members[id] = true
+		}
+	}
+	for _, e := range ents {
+		if e.Type != raftpb.EntryConfChange {
+			continue
+		}
+		var cc raftpb.ConfChange
+		if err := cc.Unmarshal(e.Data); err != nil {
+			continue
+		}
+		switch cc.Type {
+		case raftpb.ConfChangeAddNode:
+			members[cc.NodeID] = false
+		case raftpb.ConfChangeAddLearnerNode:
+			members[cc.NodeID] = true
+		case raftpb.ConfChangeRemoveNode:
+			delete(members, cc.NodeID)
+		}
+	}
+	for id, learner := range members {
+		if learner {
+			learners = append(learners, id)
+		} else {
+			voters = append(voters, id)
+		}
+	}
+	sort.Slice(voters, func(i, j int) bool { return voters[i] < voters[j] })
+	sort.Slice(learners, func(i, j int) bool { return learners[i] < learners[j] })
+	return voters, learners
+}
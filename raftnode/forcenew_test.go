@@ -0,0 +1,77 @@
+package raftnode
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+func TestForceNewCluster(t *testing.T) {
+	defer func(d time.Duration) { TickInterval = d }(TickInterval)
+	TickInterval = 10 * time.Millisecond
+	net, dir := NewMemoryNetwork(), t.TempDir()
+	peers := []string{"memory://1", "memory://2", "memory://3"}
+	var nodes []*Node
+	var sms []*memStateMachine
+	for id := 1; id <= 3; id++ {
+		sm := &memStateMachine{appliec: make(chan string, 16)}
+		n, err := StartNode(id, peers, false, sm, WithDataDir(dir), WithMemoryNetwork(net))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes, sms = append(nodes, n), append(sms, sm)
+	}
+	waitFor(t, "leadership", func() bool { return nodes[0].Status().Leader != 0 })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := nodes[0].Propose(ctx, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-sms[0].appliec; got != "foo" {
+		t.Fatalf("expected foo to be applied, got %q", got)
+	}
+	// the quorum is lost for good, member 1 survives
+	for _, n := range nodes {
+		n.Stop()
+	}
+
+	sm := &memStateMachine{appliec: make(chan string, 16)}
+	n, err := StartNode(1, peers, false, sm, WithDataDir(dir), WithMemoryNetwork(NewMemoryNetwork()), WithForceNewCluster())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	if got := <-sm.appliec; got != "foo" {
+		t.Fatalf("expected the committed entries to be kept, got %q", got)
+	}
+	waitFor(t, "leadership", func() bool { return n.Status().Leader == 1 })
+	if members := n.RaftNode().Members(); len(members) != 1 || members[0].ID != 1 {
+		t.Fatalf("expected member 1 alone, got %+v", members)
+	}
+	if err := n.Propose(ctx, []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-sm.appliec; got != "bar" {
+		t.Fatalf("expected bar to be applied by the new cluster, got %q", got)
+	}
+}
+
+func TestMemberIDs(t *testing.T) {
+	cc := func(typ raftpb.ConfChangeType, id uint64) raftpb.Entry {
+		data, _ := (&raftpb.ConfChange{Type: typ, NodeID: id}).Marshal()
+		return raftpb.Entry{Type: raftpb.EntryConfChange, Data: data}
+	}
+	snapshot := &raftpb.Snapshot{Metadata: raftpb.SnapshotMetadata{ConfState: raftpb.ConfState{Voters: []uint64{1, 2, 3}, Learners: []uint64{4}}}}
+	ents := []raftpb.Entry{
+		cc(raftpb.ConfChangeRemoveNode, 2),
+		{Type: raftpb.EntryNormal, Data: []byte("foo")},
+		cc(raftpb.ConfChangeAddLearnerNode, 5),
+		cc(raftpb.ConfChangeAddNode, 4),
+	}
+	voters, learners := memberIDs(snapshot, ents)
+	if len(voters) != 3 || voters[0] != 1 || voters[1] != 3 || voters[2] != 4 || len(learners) != 1 || learners[0] != 5 {
+		t.Fatalf("expected voters [1 3 4] and learners [5], got %v and %v", voters, learners)
+	}
+}
@@ -0,0 +1,121 @@
+package raftnode
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+
+	"go.etcd.io/etcd/client/pkg/v3/types"
+)
+
+// WithGroup 让节点成为 raft 组 name 的成员. 同一进程的多个组各自有数据目录 (见 GroupDir)
+// 和由集群 token 与组名生成的集群 ID, 通过 WithPeerHost 共用一个 peer url
+func WithGroup(name string) Option {
+	return func(rc *RaftNode) {
+		rc.group = name
+	}
+}
+
+// groupClusterID 返回组 name 的集群 ID, clusterID 是集群 token 的集群 ID
+func groupClusterID(clusterID uint64, name string) uint64 {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], clusterID)
+	return clusterIDFromToken(string(b[:]) + "/" + name)
+}
+
+// GroupDir 返回组 name 在数据目录 dataDir 下的数据目录
+func GroupDir(dataDir, name string) string {
+	return filepath.Join(dataDir, "groups", name)
+}
+
+// WithPeerHost 让节点的 rafthttp 在 h 上服务, 不再自己监听 peer url
+func WithPeerHost(h *PeerHost) Option {
+	return func(rc *RaftNode) {
+		rc.peerHost = h
+	}
+}
+
+// PeerHost 在一个 peer url 上服务一个进程内多个 raft 组的 rafthttp 请求. rafthttp
+// 的请求都带有 X-Etcd-Cluster-ID 头, 按它分发给集群 ID 相同的组; 没有这个头的探测请求
+// 交给任意一个组
+type PeerHost struct {
+	mu       sync.RWMutex
+	handlers map[types.ID]http.Handler
+	srv      *http.Server
+	donec    chan struct{}
+}
+
+// ErrDuplicateGroup 表示 PeerHost 上已经有集群 ID 相同的组
+var ErrDuplicateGroup = errors.New("raftnode: a group with the same cluster ID is already hosted")
+
+// NewPeerHost 监听 peerURL 并开始服务
+func NewPeerHost(peerURL string) (*PeerHost, error) {
+	u, err := url.Parse(peerURL)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return NewPeerHostListener(ln), nil
+}
+
+// NewPeerHostListener 在已经打开的 ln 上开始服务, 见 WithPeerListener
+func NewPeerHostListener(ln net.Listener) *PeerHost {
+	h := &PeerHost{handlers: make(map[types.ID]http.Handler), donec: make(chan struct{})}
+	h.srv = &http.Server{Handler: h}
+	go func() {
+		defer close(h.donec)
+		h.srv.Serve(ln)
+	}()
+	return h
+}
+
+func (h *PeerHost) add(cid types.ID, handler http.Handler) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.handlers[cid]; ok {
+		return ErrDuplicateGroup
+	}
+	h.handlers[cid] = handler
+	return nil
+}
+
+func (h *PeerHost) remove(cid types.ID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.handlers, cid)
+}
+
+func (h *PeerHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	var handler http.Handler
+	if cid := r.Header.Get("X-Etcd-Cluster-ID"); cid != "" {
+		if id, err := types.IDFromString(cid); err == nil {
+			handler = h.handlers[id]
+		}
+	} else {
+		for _, handler = range h.handlers {
+			break
+		}
+	}
+	h.mu.RUnlock()
+	if handler == nil {
+		// 与 rafthttp 拒绝其他集群的请求一致
+		http.Error(w, "cluster ID mismatch", http.StatusPreconditionFailed)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// Close 停止服务, 在所有组停止之后调用
+func (h *PeerHost) Close() error {
+	err := h.srv.Close()
+	<-h.donec
+	return err
+}
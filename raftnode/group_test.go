@@ -0,0 +1,53 @@
+package raftnode
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPeerHostGroups(t *testing.T) {
+	defer func(d time.Duration) { TickInterval = d }(TickInterval)
+	TickInterval = 10 * time.Millisecond
+	dir, peers := t.TempDir(), []string{freePeerURL(t), freePeerURL(t)}
+	var hosts []*PeerHost
+	for _, p := range peers {
+		h, err := NewPeerHost(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		hosts = append(hosts, h)
+	}
+	groups := map[string][]*memStateMachine{}
+	var first []*Node
+	for _, g := range []string{"a", "b"} {
+		var nodes []*Node
+		for id := 1; id <= 2; id++ {
+			sm := &memStateMachine{appliec: make(chan string, 16)}
+			n, err := StartNode(id, peers, false, sm, WithDataDir(GroupDir(dir, g)), WithGroup(g), WithPeerHost(hosts[id-1]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer n.Stop()
+			nodes, groups[g] = append(nodes, n), append(groups[g], sm)
+		}
+		waitFor(t, "leadership of group "+g, func() bool { return nodes[0].Status().Leader != 0 && nodes[1].Status().Leader != 0 })
+		first = append(first, nodes[0])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, g := range []string{"a", "b"} {
+		if err := first[i].Propose(ctx, []byte(g)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, g := range []string{"a", "b"} {
+		for _, sm := range groups[g] {
+			if got := <-sm.appliec; got != g {
+				t.Fatalf("expected %q to be applied in group %s, got %q", g, g, got)
+			}
+		}
+	}
+}
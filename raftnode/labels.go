@@ -0,0 +1,70 @@
+package raftnode
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+)
+
+// pprof 标签的键, CPU profile 可以按子系统、阶段和条目类型归类:
+//
+//	go tool pprof -tagfocus subsystem=raft -tagshow phase cpu.pprof
+const (
+	LabelMember    = "member"
+	LabelSubsystem = "subsystem"
+	LabelPhase     = "phase"
+	LabelEntry     = "entry"
+)
+
+// 子系统, transport 包括 rafthttp 发送和接收消息的 goroutine
+const (
+	SubsystemRaft      = "raft"
+	SubsystemPropose   = "propose"
+	SubsystemApply     = "apply"
+	SubsystemTransport = "transport"
+	SubsystemRead      = "read_index"
+)
+
+// raft 循环的阶段
+const (
+	phaseTick       = "tick"
+	phaseReady      = "ready"
+	phaseSaveSnap   = "save_snapshot"
+	phaseWALSave    = "wal_save"
+	phaseSend       = "send"
+	phasePublish    = "publish"
+	phaseConfChange = "conf_change"
+)
+
+// apply 循环的阶段
+const (
+	phaseLoadSnapshot   = "load_snapshot"
+	phaseCommit         = "commit"
+	phaseCreateSnapshot = "create_snapshot"
+	phaseDefrag         = "defrag"
+)
+
+// ProfileLabels 返回带有成员 id、子系统以及 kv 中额外标签的 context,
+// 交给 pprof.SetGoroutineLabels 使用; 新的 goroutine 继承创建者的标签
+func ProfileLabels(id uint64, subsystem string, kv ...string) context.Context {
+	labels := append([]string{LabelMember, strconv.FormatUint(id, 10), LabelSubsystem, subsystem}, kv...)
+	return pprof.WithLabels(context.Background(), pprof.Labels(labels...))
+}
+
+// profilePhases 预先创建一个子系统各阶段的标签, 切换阶段时不再分配内存
+type profilePhases map[string]context.Context
+
+func newProfilePhases(id uint64, subsystem string, phases ...string) profilePhases {
+	p := make(profilePhases, len(phases))
+	for _, phase := range phases {
+		p[phase] = ProfileLabels(id, subsystem, LabelPhase, phase)
+	}
+	return p
+}
+
+// set 将当前 goroutine 的标签切换到 phase, 未创建的标签 (如测试中) 被忽略
+func (p profilePhases) set(phase string) {
+	if ctx, ok := p[phase]; ok {
+		pprof.SetGoroutineLabels(ctx)
+	}
+}
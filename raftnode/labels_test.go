@@ -0,0 +1,25 @@
+package raftnode
+
+import (
+	"context"
+	"runtime/pprof"
+	"testing"
+)
+
+func TestProfileLabels(t *testing.T) {
+	ctx := ProfileLabels(3, SubsystemApply, LabelEntry, "put")
+	for k, want := range map[string]string{LabelMember: "3", LabelSubsystem: SubsystemApply, LabelEntry: "put"} {
+		if v, _ := pprof.Label(ctx, k); v != want {
+			t.Errorf("expected label %s=%s, got %q", k, want, v)
+		}
+	}
+
+	phases := newProfilePhases(3, SubsystemRaft, phaseTick, phaseWALSave)
+	if v, _ := pprof.Label(phases[phaseWALSave], LabelPhase); v != phaseWALSave {
+		t.Fatalf("expected the phase label, got %q", v)
+	}
+	// unknown phases and phases never created leave the labels alone
+	phases.set(phaseSend)
+	profilePhases(nil).set(phaseTick)
+	pprof.SetGoroutineLabels(context.Background())
+}
@@ -0,0 +1,36 @@
+package raftnode
+
+import (
+	"context"
+	"time"
+)
+
+// LeaseReadNotify 等待直到本地状态机包含 maxStaleness 之前已提交的所有日志, 返回实际的陈旧上界.
+// 最近一次线性一致读在 maxStaleness 之内开始时直接返回: 它完成时在 leader 上
+// quorum 确认了 leader 的租约, 在 follower 上得到并应用了 leader 的读索引, 本地状态机
+// 至少包含它开始之前提交的日志. 否则进行一次线性一致读, 上界是它的耗时.
+// 成员之间的时钟偏差超过 WithClockSkewBound 时不使用租约
+func (rc *RaftNode) LeaseReadNotify(ctx context.Context, maxStaleness time.Duration) (time.Duration, error) {
+	if at := rc.leaseAt.Load(); at != 0 && !rc.ClockSkewExceeded() {
+		if since := time.Since(time.Unix(0, at)); since <= maxStaleness {
+			leaseReads.WithLabelValues(leaseReadLocal).Inc()
+			return since, nil
+		}
+	}
+	leaseReads.WithLabelValues(leaseReadIndex).Inc()
+	start := time.Now()
+	if err := rc.linearizableReadNotify(ctx); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// renewLease 记录开始于 start 的线性一致读已完成
+func (rc *RaftNode) renewLease(start time.Time) {
+	for {
+		at := rc.leaseAt.Load()
+		if at >= start.UnixNano() || rc.leaseAt.CompareAndSwap(at, start.UnixNano()) {
+			return
+		}
+	}
+}
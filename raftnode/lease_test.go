@@ -0,0 +1,40 @@
+package raftnode
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeaseRead(t *testing.T) {
+	defer func(d time.Duration) { TickInterval = d }(TickInterval)
+	TickInterval = 10 * time.Millisecond
+	sm := &memStateMachine{appliec: make(chan string, 16)}
+	n, err := StartNode(1, []string{"memory://1"}, false, sm, WithDataDir(t.TempDir()), WithMemoryNetwork(NewMemoryNetwork()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	waitFor(t, "leadership", func() bool { return n.Status().Leader == 1 })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := n.LinearizableRead(ctx); err != nil {
+		t.Fatal(err)
+	}
+	at := n.rc.leaseAt.Load()
+	staleness, err := n.LeaseRead(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.rc.leaseAt.Load() != at || staleness <= 0 || staleness > time.Minute {
+		t.Fatalf("expected the read to be served from the lease, staleness %v", staleness)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := n.LeaseRead(ctx, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n.rc.leaseAt.Load() <= at {
+		t.Fatal("expected an expired lease to be renewed by a read index")
+	}
+}
@@ -16,6 +16,7 @@ package raftnode
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"time"
 )
@@ -35,6 +36,22 @@ func newStoppableListener(addr string, stopc <-chan struct{}) (*stoppableListene
 	return &stoppableListener{ln.(*net.TCPListener), stopc}, nil
 }
 
+// WithPeerListener 让 rafthttp 在已经打开的 ln 上服务而不是监听 peer url 的地址,
+// 例如 systemd 传入的 socket. ln 必须是 TCP 的
+func WithPeerListener(ln net.Listener) Option {
+	return func(rc *RaftNode) {
+		rc.peerListener = ln
+	}
+}
+
+func stoppable(ln net.Listener, stopc <-chan struct{}) (*stoppableListener, error) {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("peer listener on %s is not a TCP listener", ln.Addr())
+	}
+	return &stoppableListener{tl, stopc}, nil
+}
+
 func (ln stoppableListener) Accept() (c net.Conn, err error) {
 	connc := make(chan *net.TCPConn, 1)
 	errc := make(chan error, 1)
@@ -0,0 +1,34 @@
+package raftnode
+
+import (
+	"go.etcd.io/etcd/raft/v3"
+	"go.uber.org/zap"
+)
+
+// WithLogger 设置节点及其使用的 etcd 库 (WAL, 快照, 网络传输) 的日志. raftLg 用于 raft
+// 库本身, 可以单独调整级别, 为 nil 时 raft 库使用其默认日志.
+func WithLogger(lg, raftLg *zap.Logger) Option {
+	return func(rc *RaftNode) {
+		if lg != nil {
+			rc.logger = lg
+		}
+		if raftLg != nil {
+			rc.raftLogger = &zapRaftLogger{raftLg.WithOptions(zap.AddCallerSkip(1)).Sugar()}
+		}
+	}
+}
+
+// zapRaftLogger 把 zap 适配为 raft.Logger
+type zapRaftLogger struct {
+	*zap.SugaredLogger
+}
+
+var _ raft.Logger = (*zapRaftLogger)(nil)
+
+func (l *zapRaftLogger) Warning(v ...interface{}) {
+	l.Warn(v...)
+}
+
+func (l *zapRaftLogger) Warningf(format string, v ...interface{}) {
+	l.Warnf(format, v...)
+}
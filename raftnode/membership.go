@@ -0,0 +1,111 @@
+package raftnode
+
+import (
+	"sort"
+	"sync"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+// Member 是集群中的一个 raft 成员
+type Member struct {
+	ID        uint64
+	PeerURL   string
+	IsLearner bool
+}
+
+// membership 记录成员 ID 与 peer url 的映射, 可以被 raft 以外的 goroutine 读取
+type membership struct {
+	mu       sync.RWMutex
+	members  map[uint64]string
+	learners map[uint64]struct{}
+}
+
+func newMembership(peers []string) *membership {
+	m := &membership{
+		members:  make(map[uint64]string, len(peers)),
+		learners: make(map[uint64]struct{}),
+	}
+	for i := range peers {
+		if peers[i] != "" {
+			m.members[uint64(i+1)] = peers[i]
+		}
+	}
+	return m
+}
+
+// add 添加或更新一个成员, url 为空时保留已知的 url
+func (m *membership) add(id uint64, url string, learner bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if url != "" || m.members[id] == "" {
+		m.members[id] = url
+	}
+	if learner {
+		m.learners[id] = struct{}{}
+	} else {
+		delete(m.learners, id)
+	}
+}
+
+// update 修改已知成员的 url, 成员不存在时返回 false
+func (m *membership) update(id uint64, url string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.members[id]; !ok {
+		return false
+	}
+	m.members[id] = url
+	return true
+}
+
+// peerURL 返回成员的 peer url
+func (m *membership) peerURL(id uint64) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	url, ok := m.members[id]
+	return url, ok
+}
+
+func (m *membership) remove(id uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.members, id)
+	delete(m.learners, id)
+}
+
+// restrict 删除不在 confState 中的成员, 快照中的 confState 是权威的
+func (m *membership) restrict(cs raftpb.ConfState) {
+	ids := make(map[uint64]struct{})
+	for _, set := range [][]uint64{cs.Voters, cs.Learners, cs.VotersOutgoing, cs.LearnersNext} {
+		for _, id := range set {
+			ids[id] = struct{}{}
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id := range m.members {
+		if _, ok := ids[id]; !ok {
+			delete(m.members, id)
+		}
+	}
+	m.learners = make(map[uint64]struct{}, len(cs.Learners))
+	for _, id := range cs.Learners {
+		m.learners[id] = struct{}{}
+	}
+}
+
+func (m *membership) list() []Member {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ms := make([]Member, 0, len(m.members))
+	for id, url := range m.members {
+		_, learner := m.learners[id]
+		ms = append(ms, Member{ID: id, PeerURL: url, IsLearner: learner})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].ID < ms[j].ID })
+	return ms
+}
@@ -0,0 +1,220 @@
+package raftnode
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/types"
+	"go.etcd.io/etcd/raft/v3"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/rafthttp"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
+)
+
+// memoryInboxSize 是一个成员排队等待处理的消息数, 超过后的消息被丢弃, 如同拥塞的连接
+const memoryInboxSize = 4096
+
+// MemoryNetwork 在同一进程内连接一个集群的成员: 消息放进接收成员的 channel,
+// 不经过 HTTP, 也不监听端口. 用于测试, 以及在一个进程内运行多个 raft 组.
+// 成员的 peer url 没有意义, 只用于区分成员, 例如 memory://1
+type MemoryNetwork struct {
+	mu       sync.RWMutex
+	nodes    map[types.ID]*memoryTransport
+	isolated map[types.ID]bool
+}
+
+// NewMemoryNetwork 创建一个没有成员的内存网络
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: make(map[types.ID]*memoryTransport), isolated: make(map[types.ID]bool)}
+}
+
+// WithMemoryNetwork 让节点通过内存网络 n 与其他成员通信, 代替 rafthttp
+func WithMemoryNetwork(n *MemoryNetwork) Option {
+	return WithTransport(n.Transport)
+}
+
+// Isolate 把成员 id 与其他成员隔开, 发给它和它发出的消息都丢失, 直到 Heal
+func (n *MemoryNetwork) Isolate(id uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.isolated[types.ID(id)] = true
+}
+
+// Heal 恢复被 Isolate 隔开的成员
+func (n *MemoryNetwork) Heal(id uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.isolated, types.ID(id))
+}
+
+// Transport 是内存网络 n 的 NewTransport
+func (n *MemoryNetwork) Transport(id uint64, r rafthttp.Raft) rafthttp.Transporter {
+	return &memoryTransport{
+		net:   n,
+		id:    types.ID(id),
+		raft:  r,
+		inbox: make(chan raftpb.Message, memoryInboxSize),
+		peers: make(map[types.ID]time.Time),
+		stopc: make(chan struct{}),
+		donec: make(chan struct{}),
+	}
+}
+
+// link 返回消息从 from 到 to 的接收方, 不可达时为 nil
+func (n *MemoryNetwork) link(from, to types.ID) *memoryTransport {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.isolated[from] || n.isolated[to] {
+		return nil
+	}
+	return n.nodes[to]
+}
+
+// memoryTransport 是内存网络中一个成员的 rafthttp.Transporter
+type memoryTransport struct {
+	net   *MemoryNetwork
+	id    types.ID
+	raft  rafthttp.Raft
+	inbox chan raftpb.Message
+
+	mu    sync.RWMutex
+	peers map[types.ID]time.Time // 每个 peer 加入的时间
+
+	stopc chan struct{}
+	donec chan struct{}
+}
+
+var _ rafthttp.Transporter = (*memoryTransport)(nil)
+
+func (t *memoryTransport) Start() error {
+	t.net.mu.Lock()
+	t.net.nodes[t.id] = t
+	t.net.mu.Unlock()
+	go t.receive()
+	return nil
+}
+
+// receive 把 inbox 中的消息交给 raft, 直到 t 停止
+func (t *memoryTransport) receive() {
+	defer close(t.donec)
+	for {
+		select {
+		case m := <-t.inbox:
+			t.raft.Process(context.TODO(), m)
+		case <-t.stopc:
+			return
+		}
+	}
+}
+
+func (t *memoryTransport) Handler() http.Handler { return http.NotFoundHandler() }
+
+// Send 把 ms 放进接收成员的 inbox. 发给已停止, 被隔开或不是 peer 的成员的消息会丢失,
+// 并报告成员不可达
+func (t *memoryTransport) Send(ms []raftpb.Message) {
+	for _, m := range ms {
+		if m.To == 0 {
+			continue
+		}
+		ok := t.deliver(m)
+		if !ok {
+			t.raft.ReportUnreachable(m.To)
+		}
+		if m.Type == raftpb.MsgSnap {
+			status := raft.SnapshotFinish
+			if !ok {
+				status = raft.SnapshotFailure
+			}
+			t.raft.ReportSnapshot(m.To, status)
+		}
+	}
+}
+
+func (t *memoryTransport) deliver(m raftpb.Message) bool {
+	t.mu.RLock()
+	_, peer := t.peers[types.ID(m.To)]
+	t.mu.RUnlock()
+	to := t.net.link(t.id, types.ID(m.To))
+	if !peer || to == nil {
+		return false
+	}
+	// 复制一份, 如同接收方从网络上解码出的消息
+	data, err := m.Marshal()
+	if err != nil {
+		return false
+	}
+	var cp raftpb.Message
+	if err := cp.Unmarshal(data); err != nil {
+		return false
+	}
+	select {
+	case to.inbox <- cp:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *memoryTransport) SendSnapshot(m snap.Message) {
+	t.Send([]raftpb.Message{m.Message})
+	m.CloseWithError(nil)
+}
+
+func (t *memoryTransport) AddRemote(id types.ID, urls []string) {}
+
+func (t *memoryTransport) AddPeer(id types.ID, urls []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.peers[id]; !ok {
+		t.peers[id] = time.Now()
+	}
+}
+
+func (t *memoryTransport) RemovePeer(id types.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, id)
+}
+
+func (t *memoryTransport) RemoveAllPeers() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers = make(map[types.ID]time.Time)
+}
+
+func (t *memoryTransport) UpdatePeer(id types.ID, urls []string) {}
+
+// ActiveSince 返回 peer id 加入的时间, 它没有运行或不可达时为零值
+func (t *memoryTransport) ActiveSince(id types.ID) time.Time {
+	t.mu.RLock()
+	since := t.peers[id]
+	t.mu.RUnlock()
+	if t.net.link(t.id, id) == nil {
+		return time.Time{}
+	}
+	return since
+}
+
+func (t *memoryTransport) ActivePeers() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := 0
+	for id := range t.peers {
+		if t.net.link(t.id, id) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *memoryTransport) Stop() {
+	t.net.mu.Lock()
+	if t.net.nodes[t.id] == t {
+		delete(t.net.nodes, t.id)
+	}
+	t.net.mu.Unlock()
+	close(t.stopc)
+	<-t.donec
+}
@@ -0,0 +1,90 @@
+package raftnode
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryNetwork(t *testing.T) {
+	defer func(d time.Duration) { TickInterval = d }(TickInterval)
+	TickInterval = 10 * time.Millisecond
+	net, dir := NewMemoryNetwork(), t.TempDir()
+	peers := []string{"memory://1", "memory://2", "memory://3"}
+	var nodes []*Node
+	var sms []*memStateMachine
+	for id := 1; id <= 3; id++ {
+		sm := &memStateMachine{appliec: make(chan string, 16)}
+		n, err := StartNode(id, peers, false, sm, WithDataDir(dir), WithMemoryNetwork(net))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer n.Stop()
+		nodes, sms = append(nodes, n), append(sms, sm)
+	}
+	leader := func() uint64 {
+		lead := nodes[0].Status().Leader
+		for _, n := range nodes[1:] {
+			if n.Status().Leader != lead {
+				return 0
+			}
+		}
+		return lead
+	}
+	waitFor(t, "leadership", func() bool { return leader() != 0 })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := nodes[0].Propose(ctx, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sm := range sms {
+		if got := <-sm.appliec; got != "foo" {
+			t.Fatalf("expected foo to be applied, got %q", got)
+		}
+	}
+
+	// the others elect a new leader without the isolated one
+	old := leader()
+	net.Isolate(old)
+	var other *Node
+	for i, n := range nodes {
+		if uint64(i+1) != old {
+			other = n
+		}
+	}
+	waitFor(t, "a new leader", func() bool {
+		lead := other.Status().Leader
+		return lead != 0 && lead != old
+	})
+	if err := other.Propose(ctx, []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-sms[old-1].appliec:
+		t.Fatalf("expected the isolated member not to apply, got %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	net.Heal(old)
+	if got := <-sms[old-1].appliec; got != "bar" {
+		t.Fatalf("expected the healed member to catch up, got %q", got)
+	}
+}
+
+func TestMemoryNetworkRead(t *testing.T) {
+	defer func(d time.Duration) { TickInterval = d }(TickInterval)
+	TickInterval = 10 * time.Millisecond
+	sm := &memStateMachine{appliec: make(chan string, 16)}
+	n, err := StartNode(1, []string{"memory://1"}, false, sm, WithDataDir(t.TempDir()), WithMemoryNetwork(NewMemoryNetwork()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	waitFor(t, "leadership", func() bool { return n.Status().Leader == 1 })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		if err := n.LinearizableRead(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
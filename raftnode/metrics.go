@@ -0,0 +1,99 @@
+package raftnode
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	appliedIndexGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "applied_index",
+		Help:      "Index of the last entry applied to the state machine.",
+	})
+
+	durableIndexGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metcd",
+		Subsystem: "wal",
+		Name:      "durable_index",
+		Help:      "Index of the last entry known to be fsynced to the WAL.",
+	})
+
+	walFsyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "metcd",
+		Subsystem: "wal",
+		Name:      "interval_fsync_duration_seconds",
+		Help:      "Latency of the grouped fsyncs in interval WAL sync mode.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+
+	walSaveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "metcd",
+		Subsystem: "wal",
+		Name:      "save_duration_seconds",
+		Help:      "Latency of writing a batch of entries to the WAL, including its fsync.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+
+	walRotationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "metcd",
+		Subsystem: "wal",
+		Name:      "segment_rotation_duration_seconds",
+		Help:      "Latency of the WAL writes that rolled over to a new segment.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+
+	walSegmentsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metcd",
+		Subsystem: "wal",
+		Name:      "segments",
+		Help:      "Number of WAL segment files.",
+	})
+
+	proposalsDeferred = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "proposals_deferred_total",
+		Help:      "Number of large proposals rejected while WAL appends were slow.",
+	})
+
+	leaseReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "lease_reads_total",
+		Help:      "Number of bounded staleness reads by how they were served: from the lease of a recent read index ('lease') or after a new one ('read_index').",
+	}, []string{"path"})
+
+	peerClockSkew = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "peer_clock_skew_seconds",
+		Help:      "Estimated offset of the clock of each peer from the clock of this member.",
+	}, []string{"peer"})
+
+	purgedFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "purged_files_total",
+		Help:      "Number of WAL segment ('wal') and snapshot ('snap') files removed by the purger and defrags.",
+	}, []string{"type"})
+
+	purgedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "purged_bytes_total",
+		Help:      "Size of the WAL segment ('wal') and snapshot ('snap') files removed by the purger and defrags.",
+	}, []string{"type"})
+)
+
+const (
+	leaseReadLocal = "lease"
+	leaseReadIndex = "read_index"
+
+	purgeWAL  = "wal"
+	purgeSnap = "snap"
+)
+
+func init() {
+	prometheus.MustRegister(appliedIndexGauge, durableIndexGauge, walFsyncDuration,
+		walSaveDuration, walRotationDuration, walSegmentsGauge, proposalsDeferred, leaseReads,
+		peerClockSkew, purgedFiles, purgedBytes)
+}
@@ -0,0 +1,322 @@
+package raftnode
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
+	"go.uber.org/zap"
+)
+
+// StateMachine 是 Node 驱动的状态机
+type StateMachine interface {
+	// Apply 按提交顺序应用一批日志, data 与 raft 日志共享内存, 不能修改. 返回错误会停止节点
+	Apply(data [][]byte) error
+	// Snapshot 返回状态机当前内容的快照, 与 Apply 在同一个 goroutine 中调用
+	Snapshot() ([]byte, error)
+	// Restore 用快照替换状态机的内容, 在启动时和落后太多收到 leader 的快照时调用
+	Restore(snapshot []byte) error
+}
+
+// EntryStateMachine 是需要日志位置的 StateMachine, 例如把 appliedIndex 与数据一起持久化,
+// 重启后跳过已经应用的日志. Node 用 ApplyEntries 代替 Apply
+type EntryStateMachine interface {
+	StateMachine
+	// ApplyEntries 按提交顺序应用一批日志, index 是这一批最后一条日志的索引,
+	// 它可能是不交给状态机的配置变更. 返回错误会停止节点
+	ApplyEntries(entries []Entry, index uint64) error
+}
+
+// NodeStatus 是节点的当前状态
+type NodeStatus struct {
+	ID           uint64
+	Leader       uint64
+	Term         uint64
+	CommitIndex  uint64
+	AppliedIndex uint64
+	DurableIndex uint64
+	Members      []Member
+}
+
+// ShutdownTimeout 是 Stop 调用全部 shutdown hook 的总时限
+var ShutdownTimeout = 10 * time.Second
+
+// ShutdownHook 在节点停止时调用, 例如写回应用的缓存, 从服务发现中注销或关闭变更的发布者.
+// 调用时节点仍在运行, hook 可以提案和读取, 但不能调用 Stop. ctx 在 ShutdownTimeout 后结束
+type ShutdownHook func(ctx context.Context) error
+
+type namedHook struct {
+	name string
+	hook ShutdownHook
+}
+
+// Node 封装了 RaftNode 的 channel 交互: 提案, 成员变更, 应用已提交的日志和加载快照,
+// 供嵌入 raftnode 的应用使用. 所有方法都可以并发调用.
+type Node struct {
+	rc          *RaftNode
+	pipe        *ProposePipe
+	confChangeC chan raftpb.ConfChange
+	sm          StateMachine
+	snapshotter *snap.Snapshotter
+
+	sendMu   sync.RWMutex // 关闭 confChangeC 前等待正在发送的调用返回
+	hooksMu  sync.Mutex
+	hooks    []namedHook // nil 表示 Stop 已经开始调用 hook
+	stopOnce sync.Once
+	stopc    chan struct{} // Stop 被调用
+	donec    chan struct{} // 节点已停止
+	err      error         // 节点停止的原因, donec 关闭后可读
+}
+
+// StartNode 启动一个节点, 在重放 WAL 并用最新的快照恢复 sm 后返回.
+// 参数与 NewRaftNode 相同.
+func StartNode(id int, peers []string, join bool, sm StateMachine, opts ...Option) (*Node, error) {
+	n := &Node{
+		pipe:        NewProposePipe(),
+		confChangeC: make(chan raftpb.ConfChange),
+		sm:          sm,
+		hooks:       []namedHook{},
+		stopc:       make(chan struct{}),
+		donec:       make(chan struct{}),
+	}
+	n.rc = NewRaftNode(id, peers, join, sm.Snapshot, n.pipe, n.confChangeC, opts...)
+	n.snapshotter = <-n.rc.SnapshotterReady()
+	<-n.rc.startedc
+	restored := make(chan error, 1)
+	go n.run(restored)
+	if err := <-restored; err != nil {
+		n.Stop()
+		return nil, err
+	}
+	return n, nil
+}
+
+// Propose 提交 data, 在 raft 接受提案后返回. 提案之后仍可能因为 leader 变更而丢失,
+// 需要确认结果的应用应在 data 中携带 ID 并在 Apply 中确认. 优先级用 WithPriority 设置.
+func (n *Node) Propose(ctx context.Context, data []byte) error {
+	if err := n.checkSend(ctx); err != nil {
+		return err
+	}
+	return n.pipe.Propose(ctx, data)
+}
+
+// ProposeString 提交字符串 data
+//
+// Deprecated: 使用 Propose.
+func (n *Node) ProposeString(ctx context.Context, data string) error {
+	return n.Propose(ctx, []byte(data))
+}
+
+// AddMember 提议添加成员 m, m.IsLearner 为 true 时作为 learner 添加.
+// 添加一个已经是 learner 的成员会把它提升为 voter.
+func (n *Node) AddMember(ctx context.Context, m Member) error {
+	cc := raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: m.ID, Context: []byte(m.PeerURL)}
+	if m.IsLearner {
+		cc.Type = raftpb.ConfChangeAddLearnerNode
+	}
+	return n.proposeConfChange(ctx, cc)
+}
+
+// RemoveMember 提议移除成员 id
+func (n *Node) RemoveMember(ctx context.Context, id uint64) error {
+	return n.proposeConfChange(ctx, raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: id})
+}
+
+func (n *Node) proposeConfChange(ctx context.Context, cc raftpb.ConfChange) error {
+	if cc.NodeID == 0 {
+		return fmt.Errorf("raft node:invalid member ID 0")
+	}
+	n.sendMu.RLock()
+	defer n.sendMu.RUnlock()
+	if err := n.checkSend(ctx); err != nil {
+		return err
+	}
+	select {
+	case n.confChangeC <- cc:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.stopc:
+		return ErrStopped
+	case <-n.donec:
+		return n.stoppedErr()
+	}
+}
+
+// checkSend 在发送前检查 ctx 和节点是否已经停止, select 在多个分支
+// 都就绪时随机选择, 而 Stop 之后的 channel 已经关闭不能再发送
+func (n *Node) checkSend(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-n.stopc:
+		return ErrStopped
+	case <-n.donec:
+		return n.stoppedErr()
+	default:
+		return nil
+	}
+}
+
+// Snapshot 返回本节点最新保存的快照, 还没有快照时返回 nil
+func (n *Node) Snapshot() (*raftpb.Snapshot, error) {
+	s, err := n.snapshotter.Load()
+	if err == snap.ErrNoSnapshot {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, openSnapshot(n.rc.sealer, s)
+}
+
+// Status 返回节点的当前状态
+func (n *Node) Status() NodeStatus {
+	st := n.rc.node.Status()
+	return NodeStatus{
+		ID:           n.rc.ID(),
+		Leader:       n.rc.LeaderID(),
+		Term:         st.Term,
+		CommitIndex:  st.Commit,
+		AppliedIndex: n.rc.AppliedIndex(),
+		DurableIndex: n.rc.DurableIndex(),
+		Members:      n.rc.Members(),
+	}
+}
+
+// LinearizableRead 等待本节点应用了 leader 在调用时已提交的全部日志,
+// 之后读取状态机即可得到线性一致的结果
+func (n *Node) LinearizableRead(ctx context.Context) error {
+	return n.rc.LinearizableReadNotify(ctx)
+}
+
+// LeaseRead 等待本节点应用了 maxStaleness 之前已提交的全部日志, 返回实际的陈旧上界,
+// 见 RaftNode.LeaseReadNotify
+func (n *Node) LeaseRead(ctx context.Context, maxStaleness time.Duration) (time.Duration, error) {
+	return n.rc.LeaseReadNotify(ctx, maxStaleness)
+}
+
+// RaftNode 返回底层的 RaftNode, 用于 Node 没有封装的功能
+func (n *Node) RaftNode() *RaftNode {
+	return n.rc
+}
+
+// Done 返回一个在节点停止后关闭的 channel
+func (n *Node) Done() <-chan struct{} {
+	return n.donec
+}
+
+// Err 返回节点停止的原因, 节点仍在运行或通过 Stop 正常停止时返回 nil
+func (n *Node) Err() error {
+	select {
+	case <-n.donec:
+		return n.err
+	default:
+		return nil
+	}
+}
+
+// OnShutdown 注册一个 Stop 时调用的 hook, name 用于日志. hook 在关闭 WAL 之前按注册的
+// 相反顺序依次调用, 与 defer 相同, 先启动的组件最后停止. hook 返回的错误只记录日志,
+// 不会中止停止过程. Stop 开始之后注册的 hook 不会被调用, OnShutdown 返回 false
+func (n *Node) OnShutdown(name string, hook ShutdownHook) bool {
+	n.hooksMu.Lock()
+	defer n.hooksMu.Unlock()
+	if n.hooks == nil {
+		return false
+	}
+	n.hooks = append(n.hooks, namedHook{name: name, hook: hook})
+	return true
+}
+
+// runHooks 调用 OnShutdown 注册的 hook
+func (n *Node) runHooks() {
+	n.hooksMu.Lock()
+	hooks := n.hooks
+	n.hooks = nil
+	n.hooksMu.Unlock()
+	if len(hooks) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		start := time.Now()
+		if err := hooks[i].hook(ctx); err != nil {
+			n.rc.logger.Warn("shutdown hook failed", zap.String("hook", hooks[i].name), zap.Error(err))
+			continue
+		}
+		n.rc.logger.Info("ran shutdown hook", zap.String("hook", hooks[i].name), zap.Duration("took", time.Since(start)))
+	}
+}
+
+// Stop 调用 shutdown hook 后停止节点并等待其退出, 返回节点停止的原因
+func (n *Node) Stop() error {
+	n.stopOnce.Do(func() {
+		n.runHooks()
+		close(n.stopc)
+		n.sendMu.Lock()
+		n.pipe.Close()
+		close(n.confChangeC)
+		n.sendMu.Unlock()
+	})
+	<-n.donec
+	return n.err
+}
+
+func (n *Node) stoppedErr() error {
+	if n.err != nil {
+		return n.err
+	}
+	return ErrStopped
+}
+
+func (n *Node) restore() error {
+	s, err := n.Snapshot()
+	if err != nil || s == nil {
+		return err
+	}
+	return n.sm.Restore(s.Data)
+}
+
+func (n *Node) apply(commit *Commit) error {
+	if sm, ok := n.sm.(EntryStateMachine); ok {
+		return sm.ApplyEntries(commit.Entries, commit.Index)
+	}
+	return n.sm.Apply(commit.Data)
+}
+
+// run 用最新的快照恢复状态机, 并把之后提交的日志交给状态机, 直到 raft 停止
+func (n *Node) run(restored chan<- error) {
+	applyErr := n.restore()
+	restored <- applyErr
+	for commit := range n.rc.CommitC() {
+		if applyErr != nil {
+			// 状态机已经出错, 只需要让 raft 继续直到停止
+			if commit != nil {
+				close(commit.ApplyDoneC)
+			}
+			continue
+		}
+		if commit == nil {
+			applyErr = n.restore()
+		} else {
+			applyErr = n.apply(commit)
+			close(commit.ApplyDoneC)
+		}
+		if applyErr != nil {
+			go n.Stop()
+		}
+	}
+	if err, ok := <-n.rc.ErrorC(); ok {
+		n.err = err
+	} else if applyErr != nil {
+		n.err = applyErr
+	}
+	<-n.rc.stoppedc
+	close(n.donec)
+}
@@ -0,0 +1,128 @@
+package raftnode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memStateMachine struct {
+	mu      sync.Mutex
+	applied []string
+	appliec chan string
+}
+
+func (m *memStateMachine) Apply(data [][]byte) error {
+	for _, d := range data {
+		m.mu.Lock()
+		m.applied = append(m.applied, string(d))
+		m.mu.Unlock()
+		m.appliec <- string(d)
+	}
+	return nil
+}
+
+func (m *memStateMachine) Snapshot() ([]byte, error) { return nil, nil }
+func (m *memStateMachine) Restore([]byte) error      { return nil }
+
+func freePeerURL(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return fmt.Sprintf("http://%s", ln.Addr())
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNode(t *testing.T) {
+	dir, peers := t.TempDir(), []string{freePeerURL(t)}
+	sm := &memStateMachine{appliec: make(chan string, 16)}
+	n, err := StartNode(1, peers, false, sm, WithDataDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "leadership", func() bool { return n.Status().Leader == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Propose(ctx, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-sm.appliec; got != "foo" {
+		t.Fatalf("expected foo to be applied, got %q", got)
+	}
+	if err := n.LinearizableRead(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.AddMember(ctx, Member{ID: 2, PeerURL: freePeerURL(t), IsLearner: true}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the learner", func() bool { return len(n.Status().Members) == 2 })
+	if err := n.RemoveMember(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the removal", func() bool { return len(n.Status().Members) == 1 })
+
+	canceled, cancelNow := context.WithCancel(ctx)
+	cancelNow()
+	if err := n.AddMember(canceled, Member{ID: 3}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a canceled context to fail the call, got %v", err)
+	}
+
+	// hooks run in reverse order while the node still accepts proposals
+	var ran []string
+	n.OnShutdown("first", func(context.Context) error {
+		ran = append(ran, "first")
+		return nil
+	})
+	n.OnShutdown("second", func(ctx context.Context) error {
+		ran = append(ran, "second")
+		if err := n.Propose(ctx, []byte("last")); err != nil {
+			return err
+		}
+		if got := <-sm.appliec; got != "last" {
+			return fmt.Errorf("expected last to be applied, got %q", got)
+		}
+		return errors.New("failing hooks do not stop the others")
+	})
+	if err := n.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"second", "first"}; fmt.Sprint(ran) != fmt.Sprint(want) {
+		t.Fatalf("expected the hooks to run as %v, got %v", want, ran)
+	}
+	if n.OnShutdown("late", func(context.Context) error { return nil }) {
+		t.Fatal("expected a hook registered after Stop to be refused")
+	}
+	if err := n.ProposeString(ctx, "bar"); !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped after Stop, got %v", err)
+	}
+
+	// the WAL is replayed into a new state machine
+	sm = &memStateMachine{appliec: make(chan string, 16)}
+	n, err = StartNode(1, peers, false, sm, WithDataDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	for _, want := range []string{"foo", "last"} {
+		if got := <-sm.appliec; got != want {
+			t.Fatalf("expected %s to be replayed, got %q", want, got)
+		}
+	}
+}
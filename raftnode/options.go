@@ -0,0 +1,27 @@
+package raftnode
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// defaultClusterID 是未设置集群 token 时使用的集群 ID, 与旧版本兼容
+const defaultClusterID = 0x1000
+
+// Option 用于配置 RaftNode
+type Option func(rc *RaftNode)
+
+// WithClusterToken 根据 token 生成集群 ID. 不同 token 的集群之间的 raft 消息会被拒绝,
+// 避免新集群的节点误连到同名地址上的旧集群.
+func WithClusterToken(token string) Option {
+	return func(rc *RaftNode) {
+		if token != "" {
+			rc.clusterID = clusterIDFromToken(token)
+		}
+	}
+}
+
+func clusterIDFromToken(token string) uint64 {
+	sum := sha256.Sum256([]byte(token))
+	return binary.BigEndian.Uint64(sum[:8])
+}
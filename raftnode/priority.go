@@ -0,0 +1,90 @@
+package raftnode
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Priority 是 Propose 的提案排队的优先级. raft 处理不过来时等待的提案按优先级交给 raft:
+// 系统提案总是最先, 高优先级和普通提案同时等待时按 HighPriorityWeight 比 1 交替,
+// 大量普通写入时系统和高优先级的提案也不会一直排在后面
+type Priority int
+
+const (
+	PriorityNormal Priority = iota // 客户端的写入, 默认的优先级
+	PriorityHigh                   // 不应被批量写入拖慢的提案, 例如过期键的删除
+	PrioritySystem                 // 集群自身的提案, 例如告警和分片的变更
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"normal", "high", "system"}
+
+func (p Priority) String() string {
+	if p >= 0 && p < numPriorities {
+		return priorityNames[p]
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// HighPriorityWeight 是有普通提案等待时, 每个普通提案之前最多交给 raft 的高优先级提案数
+var HighPriorityWeight = 4
+
+var proposalsWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "metcd",
+	Subsystem: "server",
+	Name:      "proposals_waiting",
+	Help:      "Number of proposals waiting for raft to accept them, by priority: system, high or normal.",
+}, []string{"priority"})
+
+func init() {
+	prometheus.MustRegister(proposalsWaiting)
+}
+
+type priorityCtx struct{}
+
+// WithPriority 让 ctx 的 Propose 按 p 排队, 不在范围内的优先级按 PriorityNormal
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityCtx{}, p)
+}
+
+func priorityOf(ctx context.Context) Priority {
+	p, ok := ctx.Value(priorityCtx{}).(Priority)
+	if !ok || p < 0 || p >= numPriorities {
+		return PriorityNormal
+	}
+	return p
+}
+
+// poll 不阻塞地取出下一个等待的提案, 没有时返回 nil. 只能在 raft 的提案 goroutine 中调用
+func (p *ProposePipe) poll() *proposal {
+	select {
+	case prop := <-p.lanes[PrioritySystem]:
+		return prop
+	default:
+	}
+	order := [...]Priority{PriorityHigh, PriorityNormal}
+	if p.highServed >= HighPriorityWeight {
+		order[0], order[1] = order[1], order[0]
+	}
+	for _, pri := range order {
+		select {
+		case prop := <-p.lanes[pri]:
+			p.served(pri)
+			return prop
+		default:
+		}
+	}
+	return nil
+}
+
+// served 记录交给 raft 的提案的优先级, 用于高优先级和普通提案的交替
+func (p *ProposePipe) served(pri Priority) {
+	switch pri {
+	case PriorityHigh:
+		p.highServed++
+	case PriorityNormal:
+		p.highServed = 0
+	}
+}
@@ -0,0 +1,37 @@
+package raftnode
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestProposePriority(t *testing.T) {
+	p := &ProposePipe{}
+	for i := range p.lanes {
+		p.lanes[i] = make(chan *proposal, 16)
+	}
+	for _, c := range []struct {
+		priority Priority
+		n        int
+	}{{PriorityNormal, 3}, {PriorityHigh, 10}, {PrioritySystem, 1}} {
+		for i := 0; i < c.n; i++ {
+			p.lanes[c.priority] <- &proposal{priority: c.priority}
+		}
+	}
+	var got []string
+	for prop := p.poll(); prop != nil; prop = p.poll() {
+		got = append(got, prop.priority.String()[:1])
+	}
+	// the system proposal first, then 4 high ones for every normal one
+	if want := "shhhhnhhhhnhhn"; strings.Join(got, "") != want {
+		t.Fatalf("expected the proposals in the order %s, got %s", want, strings.Join(got, ""))
+	}
+
+	if pri := priorityOf(WithPriority(context.Background(), PrioritySystem)); pri != PrioritySystem {
+		t.Fatalf("expected the priority of the context, got %v", pri)
+	}
+	if pri := priorityOf(WithPriority(context.Background(), Priority(7))); pri != PriorityNormal {
+		t.Fatalf("expected an invalid priority to be normal, got %v", pri)
+	}
+}
@@ -0,0 +1,147 @@
+package raftnode
+
+import (
+	"context"
+	"sync"
+)
+
+// ProposePipe is a wrapper for the propose channel and error channel
+// If ErrorC is not nil, raft propose process will be blocked until the error is read.
+//
+// Propose 是 ProposeC 之外的另一种提案方式, 两者可以同时使用.
+type ProposePipe struct {
+	ProposeC chan []byte
+	ErrorC   chan error
+
+	initOnce sync.Once
+	// lanes 是 Propose 按优先级排队的提案, 不带缓冲, raft 不接受提案时 Propose 阻塞
+	lanes      [numPriorities]chan *proposal
+	highServed int // 上一个普通提案之后交给 raft 的高优先级提案数
+	stopOnce   sync.Once
+	stopc      chan struct{}  // pipe 已关闭或 raft 已停止
+	throttle   *applyThrottle // 按 apply 落后程度的限流, nil 表示关闭, 见 WithApplyThrottle
+	closeOnce  sync.Once
+
+	// stringC 是 ProposeStringC 返回的 channel, 由一个 goroutine 转发到 ProposeC,
+	// 转发结束时关闭 stringDone
+	stringMu   sync.Mutex
+	stringC    chan string
+	stringDone chan struct{}
+}
+
+// proposal 是 Propose 发给 raft 的提案, errc 带一个缓冲,
+// Propose 已经返回时 raft 也不会阻塞
+type proposal struct {
+	ctx      context.Context
+	data     []byte
+	priority Priority
+	errc     chan error
+}
+
+// NewProposePipe 返回一个只使用 Propose 提案的 pipe
+func NewProposePipe() *ProposePipe {
+	return &ProposePipe{ProposeC: make(chan []byte)}
+}
+
+func (p *ProposePipe) init() {
+	p.initOnce.Do(func() {
+		for i := range p.lanes {
+			p.lanes[i] = make(chan *proposal)
+		}
+		p.stopc = make(chan struct{})
+	})
+}
+
+// Propose 提交 data, 在 raft 接受提案后返回. raft 处理不过来时 Propose 阻塞
+// 直到 ctx 结束, pipe 关闭或 raft 停止后返回 ErrStopped.
+// 提案之后仍可能因为 leader 变更而丢失, 需要确认结果的应用应在 data 中携带 ID 并在应用时确认.
+// 提案按 WithPriority 设置的优先级排队, 默认是 PriorityNormal.
+func (p *ProposePipe) Propose(ctx context.Context, data []byte) error {
+	p.init()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-p.stopc:
+		return ErrStopped
+	default:
+	}
+	prop := &proposal{ctx: ctx, data: data, priority: priorityOf(ctx), errc: make(chan error, 1)}
+	if err := p.throttle.wait(ctx, prop.priority); err != nil {
+		return err
+	}
+	waiting := proposalsWaiting.WithLabelValues(prop.priority.String())
+	waiting.Inc()
+	defer waiting.Dec()
+	select {
+	case p.lanes[prop.priority] <- prop:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.stopc:
+		return ErrStopped
+	}
+	// raft 用 ctx 提案, ctx 结束时也会返回
+	return <-prop.errc
+}
+
+// ProposeStringC 返回提交字符串的 channel, 兼容 ProposeC 为 chan string 时的用法.
+// 发送的字符串转换为 []byte 后经 ProposeC 提交, 关闭返回的 channel 等同于 Close.
+//
+// Deprecated: 使用 ProposeC 或 Propose, 每个字符串都会被复制一次.
+func (p *ProposePipe) ProposeStringC() chan<- string {
+	p.init()
+	p.stringMu.Lock()
+	defer p.stringMu.Unlock()
+	if p.stringC == nil {
+		p.stringC = make(chan string)
+		p.stringDone = make(chan struct{})
+		go p.forwardStrings(p.stringC, p.stringDone)
+	}
+	return p.stringC
+}
+
+// forwardStrings 把 sc 的字符串转发到 ProposeC, 直到 sc 关闭或 pipe 停止
+func (p *ProposePipe) forwardStrings(sc <-chan string, done chan struct{}) {
+	for {
+		select {
+		case s, ok := <-sc:
+			if !ok {
+				close(done)
+				p.Close()
+				return
+			}
+			select {
+			case p.ProposeC <- []byte(s):
+				continue
+			case <-p.stopc:
+			}
+		case <-p.stopc:
+		}
+		close(done)
+		return
+	}
+}
+
+// Close 停止 pipe 并关闭 ProposeC 和 ErrorC, 重复调用没有作用
+func (p *ProposePipe) Close() {
+	p.stop()
+	p.closeOnce.Do(func() {
+		p.stringMu.Lock()
+		done := p.stringDone
+		p.stringMu.Unlock()
+		if done != nil {
+			// 转发的 goroutine 退出之后才能关闭 ProposeC
+			<-done
+		}
+		close(p.ProposeC)
+		if p.ErrorC != nil {
+			close(p.ErrorC)
+		}
+	})
+}
+
+// stop 让之后的 Propose 返回 ErrStopped
+func (p *ProposePipe) stop() {
+	p.init()
+	p.stopOnce.Do(func() { close(p.stopc) })
+}
@@ -0,0 +1,65 @@
+package raftnode
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProposePipe(t *testing.T) {
+	p := NewProposePipe()
+
+	// nothing reads the pipe, as when raft is down
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Propose(ctx, []byte("foo")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to end the proposal, got %v", err)
+	}
+
+	got := make(chan []byte, 1)
+	go func() {
+		p.init()
+		prop := <-p.lanes[PriorityNormal]
+		got <- prop.data
+		prop.errc <- nil
+	}()
+	if err := p.Propose(context.Background(), []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-got; string(data) != "bar" {
+		t.Fatalf("expected bar to be proposed, got %q", data)
+	}
+
+	p.Close()
+	if err := p.Propose(context.Background(), []byte("baz")); !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped after Close, got %v", err)
+	}
+}
+
+func TestProposeStringC(t *testing.T) {
+	p := NewProposePipe()
+	sc := p.ProposeStringC()
+	if p.ProposeStringC() != sc {
+		t.Fatal("expected the same channel every time")
+	}
+	go func() { sc <- "foo" }()
+	if data := <-p.ProposeC; string(data) != "foo" {
+		t.Fatalf("expected foo on ProposeC, got %q", data)
+	}
+
+	// closing the string channel closes the pipe, as closing ProposeC did
+	close(sc)
+	select {
+	case _, ok := <-p.ProposeC:
+		if ok {
+			t.Fatal("expected ProposeC to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ProposeC to be closed")
+	}
+	if err := p.Propose(context.Background(), []byte("bar")); !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped after the close, got %v", err)
+	}
+	p.Close()
+}
@@ -0,0 +1,95 @@
+package raftnode
+
+import (
+	"io/fs"
+	"time"
+)
+
+// DefaultPurgeInterval 是未设置 PurgeConfig.Interval 时两次清理的间隔
+var DefaultPurgeInterval = 30 * time.Second
+
+// PurgeConfig 配置在后台定期清理旧的 WAL 段文件和快照文件, 超出个数或时间的文件被删除.
+// 最新的快照和 WAL 仍需要的段文件总是保留, 每项为 0 时不按它清理.
+type PurgeConfig struct {
+	MaxSnapshots int           // 保留的最新快照文件数
+	MaxWALs      int           // 保留的最新 WAL 段文件数
+	MaxAge       time.Duration // 修改时间早于此的文件被删除
+	Interval     time.Duration // 两次清理的间隔
+}
+
+func (c PurgeConfig) enabled() bool {
+	return c.MaxSnapshots > 0 || c.MaxWALs > 0 || c.MaxAge > 0
+}
+
+// WithPurge 在后台按 cfg 清理数据目录. 否则只有 raft 日志被压缩, WAL 段文件和快照文件
+// 只在 Defrag 时删除, 数据目录会无限增长.
+func WithPurge(cfg PurgeConfig) Option {
+	return func(rc *RaftNode) {
+		if cfg.Interval <= 0 {
+			cfg.Interval = DefaultPurgeInterval
+		}
+		rc.purge = cfg
+	}
+}
+
+// purgeable 决定按名字排序的 n 个文件中的第 i 个 (最旧的为 0) 是否可以删除
+type purgeable func(i, n int, info fs.FileInfo) bool
+
+// purgeAll 删除所有可以删除的文件, 用于 Defrag
+func purgeAll(int, int, fs.FileInfo) bool { return true }
+
+// retention 返回超出最新的 max 个或修改时间早于 now-MaxAge 的文件
+func (c PurgeConfig) retention(max int, now time.Time) purgeable {
+	return func(i, n int, info fs.FileInfo) bool {
+		if max > 0 && i < n-max {
+			return true
+		}
+		return c.MaxAge > 0 && info.ModTime().Before(now.Add(-c.MaxAge))
+	}
+}
+
+// startPurge 按 rc.purge 启动清理的 goroutine, 返回的函数停止它, 必须在关闭 WAL 之前调用
+func (rc *RaftNode) startPurge() (stop func()) {
+	if !rc.purge.enabled() {
+		return func() {}
+	}
+	stopc, donec := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(donec)
+		ticker := time.NewTicker(rc.purge.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rc.purgeOnce(time.Now())
+			case <-stopc:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stopc)
+		<-donec
+	}
+}
+
+// purgeOnce 按保留策略清理一次 WAL 段文件和快照文件
+func (rc *RaftNode) purgeOnce(now time.Time) {
+	rc.purgeMu.Lock()
+	defer rc.purgeMu.Unlock()
+	n, size, err := purgeWALs(rc.waldir, rc.purge.retention(rc.purge.MaxWALs, now))
+	purgedFiles.WithLabelValues(purgeWAL).Add(float64(n))
+	purgedBytes.WithLabelValues(purgeWAL).Add(float64(size))
+	if err != nil {
+		rc.logger.Sugar().Warnf("failed to purge WAL segments (%v)", err)
+	}
+	m, msize, err := purgeSnapshots(rc.snapdir, rc.purge.retention(rc.purge.MaxSnapshots, now))
+	purgedFiles.WithLabelValues(purgeSnap).Add(float64(m))
+	purgedBytes.WithLabelValues(purgeSnap).Add(float64(msize))
+	if err != nil {
+		rc.logger.Sugar().Warnf("failed to purge snapshots (%v)", err)
+	}
+	if n > 0 || m > 0 {
+		rc.logger.Sugar().Infof("purged %d WAL segments and %d snapshots, reclaimed %d bytes", n, m, size+msize)
+	}
+}
@@ -0,0 +1,65 @@
+package raftnode
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestPurgeRetention(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		cfg        PurgeConfig
+		wals, snap int // files remaining of 6
+	}{
+		{PurgeConfig{MaxWALs: 2, MaxSnapshots: 3}, 2, 3},
+		{PurgeConfig{MaxWALs: 10, MaxSnapshots: 10}, 6, 6},
+		// the files are 1h to 6h old, the newest first
+		{PurgeConfig{MaxAge: 150 * time.Minute}, 2, 2},
+		{PurgeConfig{MaxWALs: 1, MaxAge: 7 * time.Hour}, 1, 6},
+		// the last segment and snapshot are always kept
+		{PurgeConfig{MaxAge: time.Minute}, 1, 1},
+	} {
+		dir := t.TempDir()
+		rc := &RaftNode{waldir: filepath.Join(dir, "wal"), snapdir: filepath.Join(dir, "snap"), purge: c.cfg, logger: zap.NewNop()}
+		for _, d := range []string{rc.waldir, rc.snapdir} {
+			if err := os.Mkdir(d, 0o750); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 6; i++ {
+			mtime := now.Add(-time.Duration(6-i) * time.Hour)
+			for _, path := range []string{
+				filepath.Join(rc.waldir, fmt.Sprintf("%016x-%016x.wal", i, i*10)),
+				filepath.Join(rc.snapdir, fmt.Sprintf("0000000000000001-%016x.snap", i*100)),
+			} {
+				if err := os.WriteFile(path, make([]byte, 10), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		purged := testutil.ToFloat64(purgedBytes.WithLabelValues(purgeWAL)) + testutil.ToFloat64(purgedBytes.WithLabelValues(purgeSnap))
+
+		rc.purgeOnce(now)
+		wals, _ := listFiles(rc.waldir, ".wal")
+		snaps, _ := listFiles(rc.snapdir, ".snap")
+		if len(wals) != c.wals || len(snaps) != c.snap {
+			t.Fatalf("%+v: expected %d segments and %d snapshots to remain, got %v and %v", c.cfg, c.wals, c.snap, wals, snaps)
+		}
+		if wals[len(wals)-1] != fmt.Sprintf("%016x-%016x.wal", 5, 50) || snaps[len(snaps)-1] != fmt.Sprintf("0000000000000001-%016x.snap", 500) {
+			t.Fatalf("%+v: expected the newest files to remain, got %v and %v", c.cfg, wals, snaps)
+		}
+		after := testutil.ToFloat64(purgedBytes.WithLabelValues(purgeWAL)) + testutil.ToFloat64(purgedBytes.WithLabelValues(purgeSnap))
+		if want := float64(10 * (12 - c.wals - c.snap)); after-purged != want {
+			t.Fatalf("%+v: expected %v purged bytes, got %v", c.cfg, want, after-purged)
+		}
+	}
+}
@@ -7,10 +7,13 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"metcd/failpoint"
 	"metcd/wait"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"runtime/pprof"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -33,25 +36,36 @@ const (
 	readIndexRetryTime = 500 * time.Millisecond
 )
 
-// ProposePipe is a wrapper for the propose channel and error channel
-// If ErrorC is not nil, raft propose process will be blocked until the error is read.
-type ProposePipe struct {
-	ProposeC chan string
-	ErrorC   chan error
-}
-
-func (p *ProposePipe) Close() {
-	close(p.ProposeC)
-	if p.ErrorC != nil {
-		close(p.ErrorC)
-	}
+// Entry 是交给状态机的一条已提交日志, Data 与 raft 日志共享内存, 不能修改
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte
 }
 
+// Commit 是一批已提交的数据, Data 与 raft 日志共享内存, 不能修改
 type Commit struct {
-	Data       []string
+	Data [][]byte
+	// Entries[i] 是 Data[i] 所在的日志, 带有它的 index 和 term
+	Entries []Entry
+	// Index 和 Term 是这一批中最后一条日志的位置, 包括不交给状态机的配置变更和空日志.
+	// 状态机应用完这一批后 appliedIndex 为 Index, 持久化它的状态机重启后可以跳过已应用的日志
+	Index      uint64
+	Term       uint64
 	ApplyDoneC chan<- struct{}
 }
 
+// Strings 返回字符串形式的 Data, 兼容 Data 为 []string 时的用法
+//
+// Deprecated: 直接使用 Data, Strings 会复制每一条数据.
+func (c *Commit) Strings() []string {
+	ss := make([]string, len(c.Data))
+	for i := range c.Data {
+		ss[i] = string(c.Data[i])
+	}
+	return ss
+}
+
 // RaftNode is a key-value stream backed by raft
 type RaftNode struct {
 	proposePipe *ProposePipe             // 用于接受数据变更提案, 并返回提案结果
@@ -60,13 +74,18 @@ type RaftNode struct {
 	errorC      chan error               // raft 会话返回的错误
 
 	id          int                    // raft 会话中的客户端 ID
-	peers       []string               // raft peer 的 url
+	peers       []string               // raft peer 的 url, 下标为 ID-1, 空字符串表示该 ID 不存在
+	clusterID   uint64                 // 集群 ID, 只有相同集群 ID 的节点之间才能通信
 	join        bool                   // 标志节点是加入一个已经存在的集群
 	waldir      string                 // 存放 WAL 日志的目录
 	snapdir     string                 // 存放快照的目录
 	getSnapshot func() ([]byte, error) // 获取快照的方法
 
-	leaderChanged *Notifier // leaderChanged is used to notify the linearizable read loop to drop the old read requests.
+	leaderChanged  *Notifier     // leaderChanged is used to notify the linearizable read loop to drop the old read requests.
+	removedc       chan struct{} // 本节点被移出集群后关闭, 见 Removed
+	archiveRemoved bool          // 被移出集群后归档数据目录, 见 WithRemovedArchive
+	// 以单节点集群启动, 见 WithForceNewCluster
+	forceNewCluster bool
 
 	applyWait wait.WaitTime
 
@@ -77,13 +96,28 @@ type RaftNode struct {
 	// when there is no error
 	readNotifier *ErrorNotifier
 
+	// leaseAt 是最近完成的线性一致读开始的时间 (UnixNano), 见 LeaseReadNotify
+	leaseAt atomic.Int64
+
 	readStateC chan raft.ReadState
 	idGen      *Generator
 
 	confState     raftpb.ConfState
+	members       *membership // 集群成员及其 peer url
 	snapshotIndex uint64
-	appliedIndex  uint64
-	lead          uint64 // 当前集群的 Leader ID
+	appliedIndex  uint64 // 状态机已应用的最后一条日志的索引
+	commitIndex   uint64 // 本节点已知提交的最后一条日志的索引
+	savedIndex    uint64 // 已写入 WAL 的最后一条日志的索引
+	durableIndex  uint64 // 已 fsync 到 WAL 的最后一条日志的索引
+	walNanos      int64  // 写入和 fsync WAL 累计花费的纳秒数
+	lastTick      int64  // 最近一次 tick 的 UnixNano
+
+	walSync         WALSyncMode   // WAL 的 fsync 模式
+	walSyncInterval time.Duration // interval 模式下的最长刷盘周期
+	// 已交给 apply 流水线的最后一条日志的索引和 term, 只在 raft 循环中使用
+	publishedIndex uint64
+	publishedTerm  uint64
+	lead           uint64 // 当前集群的 Leader ID
 
 	node        raft.Node
 	raftStorage *raft.MemoryStorage
@@ -91,22 +125,66 @@ type RaftNode struct {
 
 	snapshotter      *snap.Snapshotter
 	snapshotterReady chan *snap.Snapshotter // 通知 Snapshotter 已经就绪了
+	startedc         chan struct{}          // raft 实例和网络传输已经启动
+	stoppedc         chan struct{}          // raft 循环已经退出, wal 已经关闭
 
-	snapCount uint64
-	transport *rafthttp.Transport
-	stopc     chan struct{} // signals proposal channel closed
-	httpstopc chan struct{} // signals http server to shutdown
-	httpdonec chan struct{} // signals http server shutdown complete
+	applyc     chan toApply  // raft 循环交给 apply 流水线的日志
+	applyStopc chan struct{} // 通知 apply 流水线退出
+	applyDonec chan struct{} // apply 流水线已退出
+	defragc    chan defragRequest
+	purge      PurgeConfig // 后台清理旧文件的保留策略, 见 WithPurge
+	purgeMu    sync.Mutex  // 清理与 Defrag 互斥
 
-	logger *zap.Logger
+	// 以下字段只在 apply 流水线中使用
+	applyConfState raftpb.ConfState // 最后应用的日志之后的集群配置
+	lastApplyDoneC <-chan struct{}  // 最后交给状态机的日志的完成通知
+
+	snapCount uint64
+	transport rafthttp.Transporter
+	// transportErrorC 接收 rafthttp 的致命错误, 自定义传输时为 nil
+	transportErrorC chan error
+	newTransport    NewTransport     // nil 时使用 rafthttp
+	tickc           <-chan time.Time // nil 时每 TickInterval tick 一次
+	group           string           // 所属 raft 组的名字, 见 WithGroup
+	peerHost        *PeerHost        // 非 nil 时 rafthttp 在它上面服务, 见 WithPeerHost
+	peerListener    net.Listener     // 非 nil 时 rafthttp 在它上面服务, 见 WithPeerListener
+	stopc           chan struct{}    // signals proposal channel closed
+	httpstopc       chan struct{}    // signals http server to shutdown
+	httpdonec       chan struct{}    // signals http server shutdown complete
+
+	logger     *zap.Logger
+	raftLogger raft.Logger // raft 库的日志, nil 时使用 raft 的默认日志
+	events     *eventRing  // 最近的事件, 写入崩溃报告
+	admission  *admission  // 按大小的提案准入, nil 表示关闭
+	// 分块发送和接收快照, 自定义传输时为 nil, 见 snapxfer.go
+	snapshotRate     int64
+	snapshots        *snapshotSender
+	snapshotReceiver *snapshotReceiver
+	sealer           Sealer // 加密磁盘上的日志项和快照, nil 表示不加密
+	// leader 改写转发来的提案, 见 stamp.go
+	stampProposal func(data []byte) []byte
+	// 各成员的时钟偏差, 自定义传输时不探测, 见 clockskew.go
+	clocks         clockSkews
+	clockSkewBound time.Duration
+
+	// CPU 剖析标签, 见 labels.go
+	raftPhases      profilePhases
+	applyPhases     profilePhases
+	transportLabels context.Context
 }
 
 var DefaultSnapshotCount uint64 = 10000
 
+// WALDir 返回节点 id 存放 WAL 日志的目录
+func WALDir(id int) string {
+	return fmt.Sprintf("metcd-%d", id)
+}
+
 // NewRaftNode 实例化 RaftNode, 并开始运行实例. 通过关闭 ProposePipe.ProposeC 来停止实例
 // 通过 CommitC(), ErrorC(), SnapshotterReady() 获取提交的日志, 错误以及快照就绪信息.
+// opts 用于调整默认配置.
 func NewRaftNode(id int, peers []string, join bool, getSnapshot func() ([]byte, error), proposePipe *ProposePipe,
-	confChangeC <-chan raftpb.ConfChange) *RaftNode {
+	confChangeC <-chan raftpb.ConfChange, opts ...Option) *RaftNode {
 
 	commitC := make(chan *Commit)
 	errorC := make(chan error)
@@ -119,25 +197,44 @@ func NewRaftNode(id int, peers []string, join bool, getSnapshot func() ([]byte,
 		id:            id,
 		peers:         peers,
 		join:          join,
-		waldir:        fmt.Sprintf("metcd-%d", id),
-		snapdir:       fmt.Sprintf("metcd-%d-snap", id),
+		waldir:        WALDir(id),
+		snapdir:       SnapDir(id),
 		getSnapshot:   getSnapshot,
 		snapCount:     DefaultSnapshotCount,
+		walSync:       WALSyncAlways,
+		applyc:        make(chan toApply, MaxApplyBacklog),
+		applyStopc:    make(chan struct{}),
+		applyDonec:    make(chan struct{}),
+		defragc:       make(chan defragRequest),
 		stopc:         make(chan struct{}),
 		httpstopc:     make(chan struct{}),
 		httpdonec:     make(chan struct{}),
 		leaderChanged: NewNotifier(),
+		removedc:      make(chan struct{}),
 		readNotifier:  NewErrorNotifier(),
 		readwaitc:     make(chan struct{}, 1),
 		applyWait:     wait.NewTimeList(),
 		readStateC:    make(chan raft.ReadState, 1),
 		idGen:         NewGenerator(uint16(id), time.Now()),
+		members:       newMembership(peers),
+		clusterID:     defaultClusterID,
+		events:        newEventRing(RecentEventsN),
+
+		walSyncInterval: DefaultWALSyncInterval,
 
 		logger: zap.NewExample(),
 
 		snapshotterReady: make(chan *snap.Snapshotter, 1),
+		startedc:         make(chan struct{}),
+		stoppedc:         make(chan struct{}),
 		// rest of structure populated after WAL replay
 	}
+	for _, opt := range opts {
+		opt(rc)
+	}
+	if rc.group != "" {
+		rc.clusterID = groupClusterID(rc.clusterID, rc.group)
+	}
 	go rc.startRaft()
 	return rc
 }
@@ -165,10 +262,53 @@ func (rc *RaftNode) LeaderID() uint64 {
 	return rc.getLead()
 }
 
+// Members 返回当前已知的集群成员, 按 ID 排序
+func (rc *RaftNode) Members() []Member {
+	return rc.members.list()
+}
+
+// PeerURL 返回成员 id 的 peer url
+func (rc *RaftNode) PeerURL(id uint64) (string, bool) {
+	return rc.members.peerURL(id)
+}
+
+// ActiveSince 返回与成员 id 的连接建立的时间, 未连接时返回零值
+func (rc *RaftNode) ActiveSince(id uint64) time.Time {
+	return rc.transport.ActiveSince(types.ID(id))
+}
+
+// Progress 返回 leader 已知的各成员已复制的日志索引, 非 leader 返回 nil
+func (rc *RaftNode) Progress() map[uint64]uint64 {
+	st := rc.node.Status()
+	if st.RaftState != raft.StateLeader {
+		return nil
+	}
+	match := make(map[uint64]uint64, len(st.Progress))
+	for id, pr := range st.Progress {
+		match[id] = pr.Match
+	}
+	return match
+}
+
 func (rc *RaftNode) IsLeader() bool {
 	return rc.getLead() == uint64(rc.id)
 }
 
+// LastTick 返回 raft 循环最近一次 tick 的时间. 循环卡住时, 例如 WAL 的写入不返回,
+// 它不再前进; 还没有 tick 过时返回零值
+func (rc *RaftNode) LastTick() time.Time {
+	if ns := atomic.LoadInt64(&rc.lastTick); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// WALTime 返回本节点写入和 fsync WAL 累计花费的时间, 两次调用的差值是
+// 其间花在 WAL 上的时间
+func (rc *RaftNode) WALTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&rc.walNanos))
+}
+
 func (rc *RaftNode) setLead(v uint64) {
 	atomic.StoreUint64(&rc.lead, v)
 }
@@ -179,6 +319,8 @@ func (rc *RaftNode) getLead() uint64 {
 
 func (rc *RaftNode) setAppliedIndex(v uint64) {
 	atomic.StoreUint64(&rc.appliedIndex, v)
+	appliedIndexGauge.Set(float64(v))
+	applyLagGauge.Set(float64(rc.ApplyLag()))
 }
 
 func (rc *RaftNode) getAppliedIndex() uint64 {
@@ -199,9 +341,16 @@ func (rc *RaftNode) saveSnap(snap raftpb.Snapshot) error {
 		Term:      snap.Metadata.Term,
 		ConfState: &snap.Metadata.ConfState,
 	}
+	if err := failpoint.Inject(failpoint.SnapshotSave, uint64(rc.id)); err != nil {
+		return err
+	}
 	// 在写入 WAL 前保存快照, 可能会导致孤儿快照, 但是避免了日志项存在快照记录
 	// 实际没有快照文件的情况.
-	if err := rc.snapshotter.SaveSnap(snap); err != nil {
+	sealed, err := sealSnapshot(rc.sealer, snap)
+	if err != nil {
+		return err
+	}
+	if err := rc.snapshotter.SaveSnap(sealed); err != nil {
 		return err
 	}
 	if err := rc.wal.SaveSnapshot(walSnap); err != nil {
@@ -215,22 +364,22 @@ func (rc *RaftNode) entriesToApply(ents []raftpb.Entry) (nents []raftpb.Entry) {
 		return ents
 	}
 	firstIdx := ents[0].Index
-	if firstIdx > rc.getAppliedIndex()+1 {
-		log.Fatalf("first index of committed entry[%d] should <= progress.appliedIndex[%d]+1", firstIdx, rc.getAppliedIndex())
+	if firstIdx > rc.publishedIndex+1 {
+		rc.fatalf("first index of committed entry[%d] should <= progress.publishedIndex[%d]+1", firstIdx, rc.publishedIndex)
 	}
-	if rc.getAppliedIndex()-firstIdx+1 < uint64(len(ents)) {
-		nents = ents[rc.getAppliedIndex()-firstIdx+1:]
+	if rc.publishedIndex-firstIdx+1 < uint64(len(ents)) {
+		nents = ents[rc.publishedIndex-firstIdx+1:]
 	}
 	return nents
 }
 
-// publishEntries 将已提交的日志条目写入 Commit 通道,并返回是否能发布所有的条目
-func (rc *RaftNode) publishEntries(ents []raftpb.Entry) (<-chan struct{}, bool) {
+// publishEntries 应用已提交的配置变更, 并返回需要交给状态机的日志以及是否能发布所有的条目
+func (rc *RaftNode) publishEntries(ents []raftpb.Entry) ([]Entry, bool) {
 	if len(ents) == 0 {
 		return nil, true
 	}
 
-	data := make([]string, 0, len(ents))
+	data := make([]Entry, 0, len(ents))
 	for i := range ents {
 		switch ents[i].Type {
 		case raftpb.EntryNormal:
@@ -238,43 +387,46 @@ func (rc *RaftNode) publishEntries(ents []raftpb.Entry) (<-chan struct{}, bool)
 				// ignore empty messages
 				break
 			}
-			s := string(ents[i].Data)
-			data = append(data, s)
+			data = append(data, Entry{Index: ents[i].Index, Term: ents[i].Term, Data: ents[i].Data})
 		case raftpb.EntryConfChange:
 			var cc raftpb.ConfChange
 			cc.Unmarshal(ents[i].Data)
+			rc.raftPhases.set(phaseConfChange)
 			rc.confState = *rc.node.ApplyConfChange(cc)
+			rc.events.add("applied %s of member %x at index %d", cc.Type, cc.NodeID, ents[i].Index)
 			switch cc.Type {
-			case raftpb.ConfChangeAddNode:
+			case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode:
 				if len(cc.Context) > 0 {
+					pprof.SetGoroutineLabels(rc.transportLabels)
 					rc.transport.AddPeer(types.ID(cc.NodeID), []string{string(cc.Context)})
+					rc.raftPhases.set(phaseConfChange)
+				}
+				rc.members.add(cc.NodeID, string(cc.Context), cc.Type == raftpb.ConfChangeAddLearnerNode)
+			case raftpb.ConfChangeUpdateNode:
+				url := string(cc.Context)
+				if url == "" || !rc.members.update(cc.NodeID, url) {
+					break
+				}
+				// 本节点监听的地址在重启前不会改变
+				if cc.NodeID != uint64(rc.id) {
+					pprof.SetGoroutineLabels(rc.transportLabels)
+					rc.transport.UpdatePeer(types.ID(cc.NodeID), []string{url})
+					rc.raftPhases.set(phaseConfChange)
 				}
 			case raftpb.ConfChangeRemoveNode:
 				if cc.NodeID == uint64(rc.id) {
 					log.Println("I've been removed from the cluster! Shutting down.")
+					rc.markRemoved()
 					return nil, false
 				}
+				rc.members.remove(cc.NodeID)
 				rc.transport.RemovePeer(types.ID(cc.NodeID))
 			}
 		}
 	}
 
-	var applyDoneC chan struct{}
-
-	if len(data) > 0 {
-		applyDoneC = make(chan struct{}, 1)
-		select {
-		case rc.commitC <- &Commit{data, applyDoneC}:
-		case <-rc.stopc:
-			return nil, false
-		}
-	}
-
-	// after Commit, update appliedIndex
-	rc.setAppliedIndex(ents[len(ents)-1].Index)
-	rc.applyWait.Trigger(rc.getAppliedIndex())
-
-	return applyDoneC, true
+	rc.publishedIndex, rc.publishedTerm = ents[len(ents)-1].Index, ents[len(ents)-1].Term
+	return data, true
 }
 
 func (rc *RaftNode) loadSnapshot() *raftpb.Snapshot {
@@ -287,6 +439,9 @@ func (rc *RaftNode) loadSnapshot() *raftpb.Snapshot {
 		if err != nil && err != snap.ErrNoSnapshot {
 			panic(fmt.Sprintf("loading snapshots (%v)", err))
 		}
+		if err := openSnapshot(rc.sealer, snapshot); err != nil {
+			rc.fatalf("metcd:cannot decrypt %s (%v)", rc.snapdir, err)
+		}
 		return snapshot
 	}
 	return &raftpb.Snapshot{}
@@ -295,13 +450,13 @@ func (rc *RaftNode) loadSnapshot() *raftpb.Snapshot {
 // openWAL 返回一个用于读取的 WAL
 func (rc *RaftNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
 	if !wal.Exist(rc.waldir) {
-		if err := os.Mkdir(rc.waldir, 0750); err != nil {
-			log.Fatalf("metcd:cannot create dir for wal (%v)", err)
+		if err := os.MkdirAll(rc.waldir, 0750); err != nil {
+			rc.fatalf("metcd:cannot create dir for wal (%v)", err)
 		}
 
-		w, err := wal.Create(zap.NewExample(), rc.waldir, nil)
+		w, err := wal.Create(rc.logger, rc.waldir, rc.walMetadata())
 		if err != nil {
-			log.Fatalf("metcd:create wal error (%v)", err)
+			rc.fatalf("metcd:create wal error (%v)", err)
 		}
 		w.Close()
 	}
@@ -311,9 +466,9 @@ func (rc *RaftNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
 		walsnap.Index, walsnap.Term = snapshot.Metadata.Index, snapshot.Metadata.Term
 	}
 	log.Printf("loading WAL at term %d and index %d", walsnap.Term, walsnap.Index)
-	w, err := wal.Open(zap.NewExample(), rc.waldir, walsnap)
+	w, err := wal.Open(rc.logger, rc.waldir, walsnap)
 	if err != nil {
-		log.Fatalf("metcd:error loading wal (%v)", err)
+		rc.fatalf("metcd:error loading wal (%v)", err)
 	}
 
 	return w
@@ -324,9 +479,18 @@ func (rc *RaftNode) replayWAL() *wal.WAL {
 	log.Printf("replaying WAL of member %d", rc.id)
 	snapshot := rc.loadSnapshot()
 	w := rc.openWAL(snapshot)
-	_, st, ents, err := w.ReadAll()
+	md, st, ents, err := w.ReadAll()
 	if err != nil {
-		log.Fatalf("metcd:failed to read WAL (%v)", err)
+		rc.fatalf("metcd:failed to read WAL (%v)", err)
+	}
+	if err := checkWALMetadata(md, uint64(rc.id), rc.clusterID); err != nil {
+		rc.fatalf("metcd:refusing to start from %s (%v)", rc.waldir, err)
+	}
+	if err := openEntries(rc.sealer, ents); err != nil {
+		rc.fatalf("metcd:cannot decrypt %s (%v)", rc.waldir, err)
+	}
+	if rc.forceNewCluster {
+		st, ents = rc.forceNewClusterWAL(w, snapshot, st, ents)
 	}
 	rc.raftStorage = raft.NewMemoryStorage()
 	if snapshot != nil {
@@ -336,11 +500,20 @@ func (rc *RaftNode) replayWAL() *wal.WAL {
 
 	// append to storage so raft starts at the right place in log
 	rc.raftStorage.Append(ents)
+	rc.events.add("replayed WAL: %d entries, term %d, commit %d", len(ents), st.Term, st.Commit)
+	if n := len(ents); n > 0 {
+		rc.setSavedIndex(ents[n-1].Index)
+	} else if snapshot != nil {
+		rc.setSavedIndex(snapshot.Metadata.Index)
+	}
 
 	return w
 }
 
 func (rc *RaftNode) writeError(err error) {
+	rc.logCrash(err.Error())
+	rc.proposePipe.stop()
+	rc.stopApply()
 	rc.stopHTTP()
 	close(rc.commitC)
 	rc.errorC <- err
@@ -349,22 +522,33 @@ func (rc *RaftNode) writeError(err error) {
 }
 
 func (rc *RaftNode) startRaft() {
+	defer rc.recoverCrash()
+	id := uint64(rc.id)
+	rc.raftPhases = newProfilePhases(id, SubsystemRaft, phaseTick, phaseReady, phaseSaveSnap, phaseWALSave, phaseSend, phasePublish, phaseConfChange)
+	rc.applyPhases = newProfilePhases(id, SubsystemApply, phaseLoadSnapshot, phaseCommit, phaseCreateSnapshot, phaseDefrag)
+	rc.transportLabels = ProfileLabels(id, SubsystemTransport)
+	rc.clearRemoved()
 	if !fileutil.Exist(rc.snapdir) {
-		if err := os.Mkdir(rc.snapdir, 0750); err != nil {
-			log.Fatalf("metcd:cannot create dir for snapshot (%v)", err)
+		if err := os.MkdirAll(rc.snapdir, 0750); err != nil {
+			rc.fatalf("metcd:cannot create dir for snapshot (%v)", err)
 		}
 	}
-	rc.snapshotter = snap.New(zap.NewExample(), rc.snapdir)
+	rc.snapshotter = snap.New(rc.logger, rc.snapdir)
 
 	oldwal := wal.Exist(rc.waldir)
+	if rc.forceNewCluster && !oldwal {
+		rc.fatalf("metcd:force new cluster needs the WAL of an existing member in %s", rc.waldir)
+	}
 	rc.wal = rc.replayWAL()
 
 	// signal replay has finished
 	rc.snapshotterReady <- rc.snapshotter
 
-	rpeers := make([]raft.Peer, len(rc.peers))
-	for i := range rpeers {
-		rpeers[i] = raft.Peer{ID: uint64(i + 1)}
+	rpeers := make([]raft.Peer, 0, len(rc.peers))
+	for i := range rc.peers {
+		if rc.peers[i] != "" {
+			rpeers = append(rpeers, raft.Peer{ID: uint64(i + 1)})
+		}
 	}
 	c := &raft.Config{
 		ID:                        uint64(rc.id),
@@ -374,6 +558,7 @@ func (rc *RaftNode) startRaft() {
 		MaxSizePerMsg:             1024 * 1024,
 		MaxInflightMsgs:           256,
 		MaxUncommittedEntriesSize: 1 << 30,
+		Logger:                    rc.newCrashLogger(),
 	}
 
 	if oldwal || rc.join {
@@ -382,30 +567,64 @@ func (rc *RaftNode) startRaft() {
 		rc.node = raft.StartNode(c, rpeers)
 	}
 
-	rc.transport = &rafthttp.Transport{
-		Logger:      rc.logger,
-		ID:          types.ID(rc.id),
-		ClusterID:   0x1000,
-		Raft:        rc,
-		ServerStats: stats.NewServerStats("", ""),
-		LeaderStats: stats.NewLeaderStats(zap.NewExample(), strconv.Itoa(rc.id)),
-		ErrorC:      make(chan error),
+	if rc.newTransport != nil {
+		rc.transport = rc.newTransport(uint64(rc.id), rc)
+	} else {
+		rc.transportErrorC = make(chan error)
+		rc.transport = &rafthttp.Transport{
+			Logger:      rc.logger,
+			ID:          types.ID(rc.id),
+			ClusterID:   types.ID(rc.clusterID),
+			Raft:        rc,
+			ServerStats: stats.NewServerStats("", ""),
+			LeaderStats: stats.NewLeaderStats(rc.logger, strconv.Itoa(rc.id)),
+			ErrorC:      rc.transportErrorC,
+		}
+		rc.snapshots = newSnapshotSender(uint64(rc.id), rc.clusterID, rc.snapshotRate, rc.members.peerURL, rc.ReportSnapshot,
+			func(m raftpb.Message) { rc.transport.Send([]raftpb.Message{m}) })
+		rc.snapshotReceiver = newSnapshotReceiver(rc.clusterID, rc.Process)
 	}
 
+	// rafthttp 的 goroutine 继承 transport 标签
+	pprof.SetGoroutineLabels(rc.transportLabels)
 	rc.transport.Start()
 	for i := range rc.peers {
-		if i+1 != rc.id {
+		if i+1 != rc.id && rc.peers[i] != "" {
 			rc.transport.AddPeer(types.ID(i+1), []string{rc.peers[i]})
 		}
 	}
 
-	go rc.serveRaft()
+	if rc.newTransport != nil {
+		// 自定义传输不经过 peer url, httpdonec 仍然在停止时才关闭
+		go func() {
+			<-rc.httpstopc
+			close(rc.httpdonec)
+		}()
+	} else if rc.peerHost != nil {
+		cid := types.ID(rc.clusterID)
+		if err := rc.peerHost.add(cid, rc.peerHandler()); err != nil {
+			rc.fatalf("metcd:Failed to serve rafthttp (%v)", err)
+		}
+		go func() {
+			<-rc.httpstopc
+			rc.peerHost.remove(cid)
+			close(rc.httpdonec)
+		}()
+	} else {
+		go rc.serveRaft()
+	}
+	if rc.newTransport == nil {
+		go rc.probeClocks()
+	}
 	go rc.serveChannels()
 	go rc.linearizableReadLoop()
+	close(rc.startedc)
 }
 
 // stop closes http, closes all channels, and stops raft.
 func (rc *RaftNode) stop() {
+	rc.proposePipe.stop()
+	rc.stopApply()
 	rc.stopHTTP()
 	close(rc.commitC)
 	close(rc.errorC)
@@ -413,32 +632,29 @@ func (rc *RaftNode) stop() {
 }
 
 func (rc *RaftNode) stopHTTP() {
+	if rc.snapshots != nil {
+		rc.snapshots.stop()
+	}
 	rc.transport.Stop()
 	close(rc.httpstopc)
 	<-rc.httpdonec
 }
 
+// publishSnapshot 在 raft 循环中应用收到的快照, 状态机在 apply 流水线中加载快照
 func (rc *RaftNode) publishSnapshot(snapshotToSave raftpb.Snapshot) {
-	if raft.IsEmptySnap(snapshotToSave) {
-		return
-	}
-
-	log.Printf("publishing snapshot at index %d", rc.snapshotIndex)
-	defer log.Printf("finished publishing snapshot at index %d", rc.snapshotIndex)
-
-	if snapshotToSave.Metadata.Index <= rc.getAppliedIndex() {
-		panic(fmt.Sprintf("snapshot index [%d] should > progress.appliedIndex [%d]", snapshotToSave.Metadata.Index, rc.getAppliedIndex()))
+	if snapshotToSave.Metadata.Index <= rc.publishedIndex {
+		panic(fmt.Sprintf("snapshot index [%d] should > progress.publishedIndex [%d]", snapshotToSave.Metadata.Index, rc.publishedIndex))
 	}
-	rc.commitC <- nil // trigger kvstore to load snapshot
-
+	rc.events.add("received snapshot at index %d, term %d", snapshotToSave.Metadata.Index, snapshotToSave.Metadata.Term)
 	rc.confState = snapshotToSave.Metadata.ConfState
-	rc.setSnapshotIndex(snapshotToSave.Metadata.Index)
-	rc.setAppliedIndex(snapshotToSave.Metadata.Index)
+	rc.members.restrict(rc.confState)
+	rc.publishedIndex, rc.publishedTerm = snapshotToSave.Metadata.Index, snapshotToSave.Metadata.Term
 }
 
 var SnapshotCatchUpEntriesN uint64 = 10000
 
-func (rc *RaftNode) maybeTriggerSnapshot(applyDoneC <-chan struct{}) {
+// maybeTriggerSnapshot 在 apply 流水线中调用, confState 是已提交的日志应用后的集群配置
+func (rc *RaftNode) maybeTriggerSnapshot(applyDoneC <-chan struct{}, confState raftpb.ConfState) {
 	appliedIndex, snapshotIndex := rc.getAppliedIndex(), rc.getSnapshotIndex()
 	if appliedIndex-snapshotIndex <= rc.snapCount {
 		return
@@ -448,17 +664,23 @@ func (rc *RaftNode) maybeTriggerSnapshot(applyDoneC <-chan struct{}) {
 	if applyDoneC != nil {
 		select {
 		case <-applyDoneC:
-		case <-rc.stopc:
+		case <-rc.applyStopc:
 			return
 		}
 	}
 
 	log.Printf("start snapshot [applied index: %d | last snapshot index: %d]", appliedIndex, snapshotIndex)
+	rc.createSnapshot(appliedIndex, confState)
+}
+
+// createSnapshot 在 appliedIndex 处创建快照, 并压缩内存中的日志, 只保留
+// SnapshotCatchUpEntriesN 条供落后的 follower 追赶
+func (rc *RaftNode) createSnapshot(appliedIndex uint64, confState raftpb.ConfState) {
 	data, err := rc.getSnapshot()
 	if err != nil {
 		log.Panic(err)
 	}
-	snap, err := rc.raftStorage.CreateSnapshot(appliedIndex, &rc.confState, data)
+	snap, err := rc.raftStorage.CreateSnapshot(appliedIndex, &confState, data)
 	if err != nil {
 		panic(err)
 	}
@@ -477,49 +699,108 @@ func (rc *RaftNode) maybeTriggerSnapshot(applyDoneC <-chan struct{}) {
 	} else {
 		log.Printf("compacted log at index %d", compactIndex)
 	}
+	rc.events.add("created snapshot at index %d, compacted log at index %d", appliedIndex, compactIndex)
 
 	rc.setSnapshotIndex(appliedIndex)
 }
 
 func (rc *RaftNode) serveChannels() {
+	defer rc.recoverCrash()
 	snap, err := rc.raftStorage.Snapshot()
 	if err != nil {
 		panic(err)
 	}
 	rc.confState = snap.Metadata.ConfState
+	rc.members.restrict(rc.confState)
 	rc.setSnapshotIndex(snap.Metadata.Index)
 	rc.setAppliedIndex(snap.Metadata.Index)
+	rc.publishedIndex, rc.publishedTerm = snap.Metadata.Index, snap.Metadata.Term
 
+	defer close(rc.stoppedc)
+	defer rc.archive()
 	defer rc.wal.Close()
-
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+	stopWALSync := rc.startWALSync()
+	defer stopWALSync()
+	stopPurge := rc.startPurge()
+	defer stopPurge()
+	go rc.applyLoop()
+
+	rc.raftPhases.set(phaseTick)
+	segments := &walSegments{dir: rc.waldir}
+	tickc := rc.tickc
+	if tickc == nil {
+		ticker := time.NewTicker(TickInterval)
+		defer ticker.Stop()
+		tickc = ticker.C
+	}
 
 	// send proposals over raft
 	go func() {
+		defer rc.recoverCrash()
+		pprof.SetGoroutineLabels(ProfileLabels(uint64(rc.id), SubsystemPropose))
 		confChangeCount := uint64(0)
+		rc.proposePipe.init()
+
+		pipe := rc.proposePipe
+		propose := func(prop *proposal) {
+			var err error
+			// 准入控制只推迟普通提案
+			if prop.priority == PriorityNormal {
+				err = rc.admission.admit(len(prop.data))
+			}
+			if err == nil {
+				err = rc.node.Propose(prop.ctx, prop.data)
+			}
+			if err == raft.ErrStopped {
+				err = ErrStopped
+			}
+			prop.errc <- err
+		}
+		confChange := func(cc raftpb.ConfChange, ok bool) {
+			if !ok {
+				rc.confChangeC = nil
+			} else {
+				confChangeCount++
+				cc.ID = confChangeCount
+				rc.node.ProposeConfChange(context.TODO(), cc)
+			}
+		}
 
-		for rc.proposePipe.ProposeC != nil && rc.confChangeC != nil {
+		for pipe.ProposeC != nil && rc.confChangeC != nil {
+			// 配置变更先于所有提案, 等待的提案按优先级交给 raft
+			select {
+			case cc, ok := <-rc.confChangeC:
+				confChange(cc, ok)
+				continue
+			default:
+			}
+			if prop := pipe.poll(); prop != nil {
+				propose(prop)
+				continue
+			}
 			select {
+			case prop := <-pipe.lanes[PrioritySystem]:
+				propose(prop)
+			case prop := <-pipe.lanes[PriorityHigh]:
+				pipe.served(PriorityHigh)
+				propose(prop)
+			case prop := <-pipe.lanes[PriorityNormal]:
+				pipe.served(PriorityNormal)
+				propose(prop)
+
 			case prop, ok := <-rc.proposePipe.ProposeC:
 				if !ok {
 					rc.proposePipe.ProposeC = nil
 				} else {
 					// 阻塞直到 raft 状态机接受提案
-					err := rc.node.Propose(context.TODO(), []byte(prop))
+					err := rc.node.Propose(context.TODO(), prop)
 					if rc.proposePipe.ErrorC != nil {
 						rc.proposePipe.ErrorC <- err
 					}
 				}
 
 			case cc, ok := <-rc.confChangeC:
-				if !ok {
-					rc.confChangeC = nil
-				} else {
-					confChangeCount++
-					cc.ID = confChangeCount
-					rc.node.ProposeConfChange(context.TODO(), cc)
-				}
+				confChange(cc, ok)
 			}
 		}
 		// client closed channel; shutdown raft if not already
@@ -529,15 +810,19 @@ func (rc *RaftNode) serveChannels() {
 	// 处理 raft 状态机的更新事件
 	for {
 		select {
-		case <-ticker.C:
+		case <-tickc:
+			rc.raftPhases.set(phaseTick)
 			rc.node.Tick()
+			atomic.StoreInt64(&rc.lastTick, time.Now().UnixNano())
 
 		// 将 raft 的 entries 写入 wal，然后通过 Commit channel 发布
 		case rd := <-rc.node.Ready():
+			rc.raftPhases.set(phaseReady)
 			// 发送了当前的状态信息
 			if rd.SoftState != nil {
 				newLeader := rd.SoftState.Lead != raft.None && rc.getLead() != rd.SoftState.Lead
 				if newLeader {
+					rc.events.add("leader changed to %x, this member is %s", rd.SoftState.Lead, rd.SoftState.RaftState)
 					rc.setLead(rd.SoftState.Lead)
 					rc.leaderChanged.Notify() // 通知 leader 发生变更
 				}
@@ -558,24 +843,67 @@ func (rc *RaftNode) serveChannels() {
 			// 保存 snapshot 和 wal snapshot entry，然后再保存其他 entries 和 hardstate
 			// 以确保在 snapshot 恢复后可以恢复
 			if !raft.IsEmptySnap(rd.Snapshot) {
-				rc.saveSnap(rd.Snapshot)
+				rc.raftPhases.set(phaseSaveSnap)
+				if err := rc.saveSnap(rd.Snapshot); err != nil {
+					rc.writeError(err)
+					return
+				}
+			}
+			rc.raftPhases.set(phaseWALSave)
+			start := time.Now()
+			err := failpoint.Inject(failpoint.WALSave, uint64(rc.id))
+			var sealed []raftpb.Entry
+			if err == nil {
+				sealed, err = sealEntries(rc.sealer, rd.Entries)
+			}
+			if err == nil {
+				err = rc.wal.Save(rd.HardState, sealed)
+			}
+			if err != nil {
+				rc.writeError(err)
+				return
+			}
+			if !raft.IsEmptyHardState(rd.HardState) || len(rd.Entries) > 0 {
+				d := time.Since(start)
+				atomic.AddInt64(&rc.walNanos, int64(d))
+				segments.observeSave(d)
+				rc.admission.observe(d)
 			}
-			rc.wal.Save(rd.HardState, rd.Entries)
+			if n := len(rd.Entries); n > 0 {
+				rc.setSavedIndex(rd.Entries[n-1].Index)
+			}
+			if !raft.IsEmptyHardState(rd.HardState) {
+				rc.setCommitIndex(rd.HardState.Commit)
+			}
+			var ap toApply
 			if !raft.IsEmptySnap(rd.Snapshot) {
 				rc.raftStorage.ApplySnapshot(rd.Snapshot)
 				rc.publishSnapshot(rd.Snapshot)
+				ap.snapshot = &rd.Snapshot
 			}
 			rc.raftStorage.Append(rd.Entries)
-			rc.transport.Send(rc.processMessages(rd.Messages))
-			applyDoneC, ok := rc.publishEntries(rc.entriesToApply(rd.CommittedEntries))
+			rc.raftPhases.set(phaseSend)
+			rc.send(rc.processMessages(rd.Messages))
+			rc.raftPhases.set(phasePublish)
+			entries, ok := rc.publishEntries(rc.entriesToApply(rd.CommittedEntries))
 			if !ok {
 				rc.stop()
 				return
 			}
-			rc.maybeTriggerSnapshot(applyDoneC)
+			// 状态机在 apply 流水线中按顺序应用, 慢的 apply 不会阻塞心跳和快照发送,
+			// 只有积压超过 MaxApplyBacklog 时才会阻塞 raft 循环
+			if ap.snapshot != nil || len(rd.CommittedEntries) > 0 {
+				ap.entries, ap.index, ap.term, ap.confState = entries, rc.publishedIndex, rc.publishedTerm, rc.confState
+				select {
+				case rc.applyc <- ap:
+				case <-rc.stopc:
+					rc.stop()
+					return
+				}
+			}
 			rc.node.Advance()
 
-		case err := <-rc.transport.ErrorC:
+		case err := <-rc.transportErrorC:
 			rc.writeError(err)
 			return
 
@@ -586,6 +914,31 @@ func (rc *RaftNode) serveChannels() {
 	}
 }
 
+// send 发送 ms, Send 失败点生效时丢弃它们, 丢弃的快照报告为发送失败
+func (rc *RaftNode) send(ms []raftpb.Message) {
+	if err := failpoint.Inject(failpoint.Send, uint64(rc.id)); err != nil {
+		for _, m := range ms {
+			if m.Type == raftpb.MsgSnap {
+				rc.ReportSnapshot(m.To, raft.SnapshotFailure)
+			}
+		}
+		return
+	}
+	if rc.snapshots != nil {
+		// 快照分块限速发送, 其他消息照常交给 rafthttp
+		rest := ms[:0:0]
+		for _, m := range ms {
+			if m.Type == raftpb.MsgSnap {
+				rc.snapshots.send(m)
+			} else {
+				rest = append(rest, m)
+			}
+		}
+		ms = rest
+	}
+	rc.transport.Send(ms)
+}
+
 // 如果在创建快照之后有一个 “raftpb.EntryConfChange时“,
 // 快照中包含的 confState 就是过时的。
 // 所以在给 follower 发送快照之前,需要更新 confState.
@@ -603,6 +956,7 @@ func (rc *RaftNode) LinearizableReadNotify(ctx context.Context) error {
 }
 
 func (rc *RaftNode) linearizableReadNotify(ctx context.Context) error {
+	start := time.Now()
 	rc.readMu.RLock()
 	nc := rc.readNotifier
 	rc.readMu.RUnlock()
@@ -616,7 +970,11 @@ func (rc *RaftNode) linearizableReadNotify(ctx context.Context) error {
 	// wait for read state notification
 	select {
 	case <-nc.Receive():
-		return nc.Error()
+		err := nc.Error()
+		if err == nil {
+			rc.renewLease(start)
+		}
+		return err
 	case <-ctx.Done():
 		return ctx.Err()
 	case <-rc.httpdonec:
@@ -631,6 +989,7 @@ func uint64ToBigEndianBytes(number uint64) []byte {
 }
 
 func (rc *RaftNode) linearizableReadLoop() {
+	pprof.SetGoroutineLabels(ProfileLabels(uint64(rc.id), SubsystemRead))
 	for {
 		leaderChangedNotifier := rc.leaderChanged.Receive()
 		select {
@@ -729,24 +1088,34 @@ func (rc *RaftNode) sendReadIndex(requestId uint64) error {
 func (rc *RaftNode) serveRaft() {
 	url, err := url.Parse(rc.peers[rc.id-1])
 	if err != nil {
-		log.Fatalf("metcd:Failed parsing URL (%v)", err)
+		rc.fatalf("metcd:Failed parsing URL (%v)", err)
 	}
 
-	ln, err := newStoppableListener(url.Host, rc.httpstopc)
+	var ln *stoppableListener
+	if rc.peerListener != nil {
+		ln, err = stoppable(rc.peerListener, rc.httpstopc)
+	} else {
+		ln, err = newStoppableListener(url.Host, rc.httpstopc)
+	}
 	if err != nil {
-		log.Fatalf("metcd:Failed to listen rafthttp (%v)", err)
+		rc.fatalf("metcd:Failed to listen rafthttp (%v)", err)
 	}
 
-	err = (&http.Server{Handler: rc.transport.Handler()}).Serve(ln)
+	err = (&http.Server{Handler: rc.peerHandler()}).Serve(ln)
 	select {
 	case <-rc.httpstopc:
 	default:
-		log.Fatalf("metcd:Failed to serve rafthttp (%v)", err)
+		rc.fatalf("metcd:Failed to serve rafthttp (%v)", err)
 	}
 	close(rc.httpdonec)
 }
 
 func (rc *RaftNode) Process(ctx context.Context, m raftpb.Message) error {
+	if err := failpoint.Inject(failpoint.Receive, uint64(rc.id)); err != nil {
+		// 像网络丢包一样静默丢弃
+		return nil
+	}
+	rc.stampForwarded(&m)
 	return rc.node.Step(ctx, m)
 }
 func (rc *RaftNode) IsIDRemoved(_ uint64) bool   { return false }
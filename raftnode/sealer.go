@@ -0,0 +1,180 @@
+package raftnode
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
+	"go.etcd.io/etcd/server/v3/wal"
+	"go.etcd.io/etcd/server/v3/wal/walpb"
+	"go.uber.org/zap"
+)
+
+// Sealer 加密写入磁盘的日志项和快照内容. 只有磁盘上的数据是密文,
+// 内存中的日志, 交给状态机和发给其他节点的快照都是明文.
+type Sealer interface {
+	Seal(data []byte) ([]byte, error)
+	// Open 解密 Seal 的结果, 未加密的数据应原样返回, 以便读取开启加密前写入的数据
+	Open(data []byte) ([]byte, error)
+}
+
+// WithSealer 用 s 加密 WAL 中的日志项和快照文件, 见 ReencryptDataDir
+func WithSealer(s Sealer) Option {
+	return func(rc *RaftNode) {
+		rc.sealer = s
+	}
+}
+
+// sealEntries 返回写入 WAL 的日志项, ents 本身保持明文
+func sealEntries(s Sealer, ents []raftpb.Entry) ([]raftpb.Entry, error) {
+	if s == nil || len(ents) == 0 {
+		return ents, nil
+	}
+	sealed := make([]raftpb.Entry, len(ents))
+	for i, e := range ents {
+		data, err := s.Seal(e.Data)
+		if err != nil {
+			return nil, err
+		}
+		e.Data = data
+		sealed[i] = e
+	}
+	return sealed, nil
+}
+
+// openEntries 原地解密从 WAL 读出的日志项
+func openEntries(s Sealer, ents []raftpb.Entry) error {
+	if s == nil {
+		return nil
+	}
+	for i := range ents {
+		data, err := s.Open(ents[i].Data)
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", ents[i].Index, err)
+		}
+		ents[i].Data = data
+	}
+	return nil
+}
+
+// sealSnapshot 返回写入快照文件的快照, snapshot 本身保持明文
+func sealSnapshot(s Sealer, snapshot raftpb.Snapshot) (raftpb.Snapshot, error) {
+	if s == nil {
+		return snapshot, nil
+	}
+	data, err := s.Seal(snapshot.Data)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Data = data
+	return snapshot, nil
+}
+
+// openSnapshot 原地解密从快照文件读出的快照
+func openSnapshot(s Sealer, snapshot *raftpb.Snapshot) error {
+	if s == nil || snapshot == nil {
+		return nil
+	}
+	data, err := s.Open(snapshot.Data)
+	if err != nil {
+		return fmt.Errorf("snapshot at index %d: %w", snapshot.Metadata.Index, err)
+	}
+	snapshot.Data = data
+	return nil
+}
+
+// ReencryptDataDir 用 s 重新加密 dir 中已停止的节点 id 的数据: 用 s.Open 读出最新的可用快照
+// 和其后的全部日志, 再用 s.Seal 写成新的快照和 WAL 替换原来的目录. 更早的快照和 WAL 段
+// 不再保留, 之后只需要 s 当前的密钥即可读取. s.Seal 不加密时即为解密数据目录.
+func ReencryptDataDir(dir string, id int, s Sealer) error {
+	lg := zap.NewNop()
+	waldir, snapdir := filepath.Join(dir, WALDir(id)), filepath.Join(dir, SnapDir(id))
+	if !wal.Exist(waldir) {
+		return fmt.Errorf("no WAL of member %d in %q", id, dir)
+	}
+	walSnaps, err := wal.ValidSnapshotEntries(lg, waldir)
+	if err != nil {
+		return fmt.Errorf("listing snapshots (%v)", err)
+	}
+	var snapshot *raftpb.Snapshot
+	if fileutil.Exist(snapdir) {
+		snapshot, err = snap.New(lg, snapdir).LoadNewestAvailable(walSnaps)
+		if err != nil && err != snap.ErrNoSnapshot {
+			return fmt.Errorf("loading snapshots (%v)", err)
+		}
+	}
+	var walsnap walpb.Snapshot
+	if snapshot != nil {
+		walsnap.Index, walsnap.Term = snapshot.Metadata.Index, snapshot.Metadata.Term
+		walsnap.ConfState = &snapshot.Metadata.ConfState
+	}
+	r, err := wal.OpenForRead(lg, waldir, walsnap)
+	if err != nil {
+		return fmt.Errorf("opening WAL (%v)", err)
+	}
+	md, st, ents, err := r.ReadAll()
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("reading WAL (%v)", err)
+	}
+	if err := openSnapshot(s, snapshot); err != nil {
+		return err
+	}
+	if err := openEntries(s, ents); err != nil {
+		return err
+	}
+
+	// 先在旁边写出新的目录再替换, 中断时原来的数据目录保持不变
+	tmpwal, tmpsnap := waldir+".reencrypt", snapdir+".reencrypt"
+	os.RemoveAll(tmpwal)
+	os.RemoveAll(tmpsnap)
+	if err := os.MkdirAll(tmpsnap, 0750); err != nil {
+		return err
+	}
+	if snapshot != nil {
+		sealed, err := sealSnapshot(s, *snapshot)
+		if err != nil {
+			return err
+		}
+		if err := snap.New(lg, tmpsnap).SaveSnap(sealed); err != nil {
+			return err
+		}
+	}
+	sealed, err := sealEntries(s, ents)
+	if err != nil {
+		return err
+	}
+	w, err := wal.Create(lg, tmpwal, md)
+	if err != nil {
+		return err
+	}
+	if err := w.SaveSnapshot(walsnap); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Save(st, sealed); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	for _, d := range [][2]string{{waldir, tmpwal}, {snapdir, tmpsnap}} {
+		old := d[0] + ".old"
+		os.RemoveAll(old)
+		if err := os.Rename(d[0], old); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(d[1], d[0]); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package raftnode
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// xorSealer flips the bits of the data behind a prefix.
+type xorSealer struct{ plain bool }
+
+var xorPrefix = []byte("xor:")
+
+func (s xorSealer) Seal(data []byte) ([]byte, error) {
+	if s.plain {
+		return data, nil
+	}
+	out := append([]byte{}, xorPrefix...)
+	for _, b := range data {
+		out = append(out, ^b)
+	}
+	return out, nil
+}
+
+func (xorSealer) Open(data []byte) ([]byte, error) {
+	rest, ok := bytes.CutPrefix(data, xorPrefix)
+	if !ok {
+		return data, nil
+	}
+	out := make([]byte, len(rest))
+	for i, b := range rest {
+		out[i] = ^b
+	}
+	return out, nil
+}
+
+// dataDirContains reports whether a file of the WAL or snapshot directory
+// of member 1 in dir contains s.
+func dataDirContains(t *testing.T, dir, s string) bool {
+	for _, d := range []string{WALDir(1), SnapDir(1)} {
+		names, err := filepath.Glob(filepath.Join(dir, d, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(b, []byte(s)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestSealer(t *testing.T) {
+	dir, peers := t.TempDir(), []string{freePeerURL(t)}
+	if err := BootstrapDataDir(dir, 1, "", []uint64{1}, []byte("seed")); err != nil {
+		t.Fatal(err)
+	}
+	// the plaintext snapshot is encrypted
+	if err := ReencryptDataDir(dir, 1, xorSealer{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDataDir(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if dataDirContains(t, dir, "seed") {
+		t.Fatal("expected the snapshot to be encrypted")
+	}
+
+	start := func(opts ...Option) (*Node, *restoredStateMachine) {
+		sm := &restoredStateMachine{memStateMachine{appliec: make(chan string, 16)}, make(chan string, 1)}
+		n, err := StartNode(1, peers, false, sm, append(opts, WithDataDir(dir))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case data := <-sm.restored:
+			if data != "seed" {
+				t.Fatalf("expected the seed to be restored, got %q", data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the seed to be restored")
+		}
+		return n, sm
+	}
+	n, sm := start(WithSealer(xorSealer{}))
+	waitFor(t, "leadership", func() bool { return n.Status().Leader == 1 })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Propose(ctx, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-sm.appliec; got != "secret" {
+		t.Fatalf("expected secret to be applied, got %q", got)
+	}
+	if err := n.Stop(); err != nil && !errors.Is(err, ErrStopped) {
+		t.Fatal(err)
+	}
+	if dataDirContains(t, dir, "secret") {
+		t.Fatal("expected the WAL to be encrypted")
+	}
+
+	// decrypted, the data directory starts without a sealer
+	if err := ReencryptDataDir(dir, 1, xorSealer{plain: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !dataDirContains(t, dir, "secret") || !dataDirContains(t, dir, "seed") {
+		t.Fatal("expected the data directory to be decrypted")
+	}
+	n, sm = start()
+	defer n.Stop()
+	if got := <-sm.appliec; got != "secret" {
+		t.Fatalf("expected secret to be replayed, got %q", got)
+	}
+}
@@ -0,0 +1,453 @@
+package raftnode
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/etcd/client/pkg/v3/types"
+	"go.etcd.io/etcd/raft/v3"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+// snapshotTransferPath 是 peer url 上接收分块快照的路径, 后面是发送者的 ID 和传输 ID
+const snapshotTransferPath = "/raft/metcd/snapshot/"
+
+var (
+	// SnapshotChunkSize 是分块发送快照时每个请求的字节数, 中断后从最后一个完整的块继续
+	SnapshotChunkSize = 1 << 20
+	// snapshotTransferAttempts 是一次快照传输中断后最多尝试的次数, 每次从接收方已有的位置继续
+	snapshotTransferAttempts = 10
+	// snapshotTransferBackoff 是第一次重试前等待的时间, 之后每次加倍, 最多 snapshotTransferMaxBackoff
+	snapshotTransferBackoff    = 500 * time.Millisecond
+	snapshotTransferMaxBackoff = 10 * time.Second
+	// snapshotTransferTimeout 限制一个分块请求的时间
+	snapshotTransferTimeout = 30 * time.Second
+	// snapshotTransferIdle 内没有收到分块的未完成快照被丢弃
+	snapshotTransferIdle = 10 * time.Minute
+)
+
+var (
+	snapshotTransferBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "snapshot_transfer_bytes_total",
+		Help:      "Bytes of snapshots transferred to or from followers in chunks, by direction: sent or received.",
+	}, []string{"direction"})
+
+	snapshotTransfersResumed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "snapshot_transfers_resumed_total",
+		Help:      "Number of snapshot transfers resumed from the bytes the follower already had after a failure.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(snapshotTransferBytes, snapshotTransfersResumed)
+}
+
+// WithSnapshotTransferRate 限制发给每个 follower 的快照每秒的字节数, 0 表示不限制.
+// 多个 follower 同时需要快照时并行发送, 各自限速. 只作用于 rafthttp, 自定义传输按原样发送快照
+func WithSnapshotTransferRate(bytesPerSecond int64) Option {
+	return func(rc *RaftNode) {
+		rc.snapshotRate = bytesPerSecond
+	}
+}
+
+// errNoSnapshotTransfer 表示接收方不支持分块传输快照, 例如旧版本的成员
+var errNoSnapshotTransfer = errors.New("raftnode: peer does not accept snapshots in chunks")
+
+// rateLimiter 限制一次快照传输的速率
+type rateLimiter struct {
+	rate int64 // 每秒字节数, 0 表示不限制
+
+	mu   sync.Mutex
+	next time.Time // 下一个块可以发送的时间
+}
+
+// wait 等到可以发送 n 个字节
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	l.mu.Unlock()
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// snapshotSender 分块发送 MsgSnap, 网络中断后从 follower 已经收到的位置继续,
+// 发完或失败后向 raft 报告快照的状态
+type snapshotSender struct {
+	from      uint64
+	clusterID uint64
+	rate      int64
+	client    *http.Client
+	peerURL   func(id uint64) (string, bool)
+	report    func(id uint64, status raft.SnapshotStatus)
+	fallback  func(m raftpb.Message) // 接收方不支持分块时整体发送
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	active map[uint64]*outgoingSnapshot // 按 follower 正在进行的传输
+}
+
+// SnapshotTransfer 是发给一个 follower 的快照的进度
+type SnapshotTransfer struct {
+	Index    uint64    // 快照的日志索引
+	Size     int       // 快照的字节数
+	Sent     int       // follower 已经收到的字节数
+	Attempts int       // 尝试的次数, 大于 1 时是中断后继续的传输
+	Started  time.Time // 开始发送的时间
+}
+
+type outgoingSnapshot struct {
+	cancel   context.CancelFunc
+	progress SnapshotTransfer
+}
+
+func newSnapshotSender(from, clusterID uint64, rate int64, peerURL func(id uint64) (string, bool),
+	report func(id uint64, status raft.SnapshotStatus), fallback func(m raftpb.Message)) *snapshotSender {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &snapshotSender{
+		from:      from,
+		clusterID: clusterID,
+		rate:      rate,
+		client:    &http.Client{Timeout: snapshotTransferTimeout},
+		peerURL:   peerURL,
+		report:    report,
+		fallback:  fallback,
+		ctx:       ctx,
+		cancel:    cancel,
+		active:    make(map[uint64]*outgoingSnapshot),
+	}
+}
+
+// send 在后台发送 m, 代替给同一个 follower 的未完成传输. 给不同 follower 的传输互不等待
+func (s *snapshotSender) send(m raftpb.Message) {
+	data, err := m.Marshal()
+	if err != nil {
+		log.Printf("cannot marshal snapshot for %x (%v)", m.To, err)
+		s.report(m.To, raft.SnapshotFailure)
+		return
+	}
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:16])
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	out := &outgoingSnapshot{cancel: cancel, progress: SnapshotTransfer{Index: m.Snapshot.Metadata.Index, Size: len(data), Started: time.Now()}}
+	s.mu.Lock()
+	if prev, ok := s.active[m.To]; ok {
+		prev.cancel()
+	}
+	s.active[m.To] = out
+	s.mu.Unlock()
+
+	go func() {
+		err := s.transfer(ctx, m.To, id, data, out)
+		canceled := ctx.Err() != nil
+		cancel()
+		// 报告之前移除, 没有被新的传输代替时
+		s.mu.Lock()
+		if s.active[m.To] == out {
+			delete(s.active, m.To)
+		}
+		s.mu.Unlock()
+		switch {
+		case errors.Is(err, errNoSnapshotTransfer):
+			s.fallback(m)
+		case canceled:
+			// 被新的传输代替或节点已停止, raft 不再等待这次的结果
+		case err != nil:
+			log.Printf("failed to send snapshot at index %d to %x (%v)", m.Snapshot.Metadata.Index, m.To, err)
+			s.report(m.To, raft.SnapshotFailure)
+		default:
+			log.Printf("sent snapshot at index %d to %x, %d bytes", m.Snapshot.Metadata.Index, m.To, len(data))
+			s.report(m.To, raft.SnapshotFinish)
+		}
+	}()
+}
+
+// transfers 返回按 follower 正在进行的传输的进度
+func (s *snapshotSender) transfers() map[uint64]SnapshotTransfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[uint64]SnapshotTransfer, len(s.active))
+	for id, o := range s.active {
+		out[id] = o.progress
+	}
+	return out
+}
+
+func (s *snapshotSender) update(out *outgoingSnapshot, f func(p *SnapshotTransfer)) {
+	s.mu.Lock()
+	f(&out.progress)
+	s.mu.Unlock()
+}
+
+// stop 取消所有传输
+func (s *snapshotSender) stop() {
+	s.cancel()
+}
+
+// transfer 分块发送 data, 失败后从接收方已有的位置重试
+func (s *snapshotSender) transfer(ctx context.Context, to uint64, id string, data []byte, out *outgoingSnapshot) error {
+	base, ok := s.peerURL(to)
+	if !ok {
+		return fmt.Errorf("unknown peer %x", to)
+	}
+	base = strings.TrimSuffix(base, "/") + snapshotTransferPath + fmt.Sprintf("%x/%s", s.from, id)
+	limiter := &rateLimiter{rate: s.rate}
+	backoff := snapshotTransferBackoff
+	for attempt := 1; ; attempt++ {
+		offset, err := s.offset(ctx, base)
+		if errors.Is(err, errNoSnapshotTransfer) {
+			return err
+		}
+		if err == nil && attempt > 1 && offset > 0 {
+			snapshotTransfersResumed.Inc()
+		}
+		s.update(out, func(p *SnapshotTransfer) {
+			p.Attempts = attempt
+			if err == nil {
+				p.Sent = offset
+			}
+		})
+		for err == nil && offset < len(data) {
+			end := offset + SnapshotChunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+			if err = limiter.wait(ctx, end-offset); err == nil {
+				offset, err = s.put(ctx, base, offset, data[offset:end], len(data))
+			}
+			if err == nil {
+				s.update(out, func(p *SnapshotTransfer) { p.Sent = offset })
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt >= snapshotTransferAttempts || ctx.Err() != nil {
+			return err
+		}
+		log.Printf("snapshot transfer to %x interrupted, resuming in %v (%v)", to, backoff, err)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > snapshotTransferMaxBackoff {
+			backoff = snapshotTransferMaxBackoff
+		}
+	}
+}
+
+func (s *snapshotSender) request(ctx context.Context, method, url string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Etcd-Cluster-ID", types.ID(s.clusterID).String())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusConflict:
+		return strconv.Atoi(strings.TrimSpace(string(b)))
+	case http.StatusNotFound:
+		return 0, errNoSnapshotTransfer
+	}
+	return 0, fmt.Errorf("peer answered %s: %s", resp.Status, bytes.TrimSpace(b))
+}
+
+// offset 返回接收方已经收到的字节数
+func (s *snapshotSender) offset(ctx context.Context, url string) (int, error) {
+	return s.request(ctx, http.MethodGet, url, nil)
+}
+
+// put 发送从 offset 开始的 chunk, 返回接收方之后已有的字节数
+func (s *snapshotSender) put(ctx context.Context, url string, offset int, chunk []byte, size int) (int, error) {
+	n, err := s.request(ctx, http.MethodPut, fmt.Sprintf("%s?offset=%d&size=%d", url, offset, size), chunk)
+	if err == nil && n > offset {
+		snapshotTransferBytes.WithLabelValues("sent").Add(float64(n - offset))
+	}
+	return n, err
+}
+
+// snapshotReceiver 在内存中拼接分块收到的快照, 收完后交给 raft. 快照本来就整体在内存中,
+// 未完成的部分不写入磁盘, 也就不会绕过静态加密
+type snapshotReceiver struct {
+	clusterID uint64
+	process   func(ctx context.Context, m raftpb.Message) error
+
+	mu        sync.Mutex
+	transfers map[uint64]*incomingSnapshot // 按发送者, 每个发送者只保留最新的一个
+}
+
+type incomingSnapshot struct {
+	id      string
+	size    int
+	data    []byte
+	updated time.Time
+}
+
+func newSnapshotReceiver(clusterID uint64, process func(ctx context.Context, m raftpb.Message) error) *snapshotReceiver {
+	return &snapshotReceiver{clusterID: clusterID, process: process, transfers: make(map[uint64]*incomingSnapshot)}
+}
+
+// ServeHTTP 服务 GET 和 PUT /raft/metcd/snapshot/<from>/<id>: GET 返回已经收到的字节数,
+// PUT ?offset=<n>&size=<n> 追加一块, offset 不是已收到的字节数时返回 409 和已收到的字节数
+func (r *snapshotReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if cid := req.Header.Get("X-Etcd-Cluster-ID"); cid != types.ID(r.clusterID).String() {
+		http.Error(w, "cluster ID mismatch", http.StatusPreconditionFailed)
+		return
+	}
+	fromS, id, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, snapshotTransferPath), "/")
+	from, err := strconv.ParseUint(fromS, 16, 64)
+	if err != nil || len(id) != 32 {
+		http.Error(w, "invalid snapshot transfer", http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		r.mu.Lock()
+		n := 0
+		if in := r.transfers[from]; in != nil && in.id == id {
+			n = len(in.data)
+		}
+		r.mu.Unlock()
+		fmt.Fprintln(w, n)
+	case http.MethodPut:
+		r.put(w, req, from, id)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPut)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *snapshotReceiver) put(w http.ResponseWriter, req *http.Request, from uint64, id string) {
+	q := req.URL.Query()
+	offset, err1 := strconv.Atoi(q.Get("offset"))
+	size, err2 := strconv.Atoi(q.Get("size"))
+	if err1 != nil || err2 != nil || offset < 0 || size <= 0 || offset > size {
+		http.Error(w, "invalid offset or size", http.StatusBadRequest)
+		return
+	}
+	chunk, err := io.ReadAll(io.LimitReader(req.Body, int64(size-offset)+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	r.dropIdle()
+	in := r.transfers[from]
+	if in == nil || in.id != id {
+		if offset != 0 {
+			r.mu.Unlock()
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintln(w, 0)
+			return
+		}
+		in = &incomingSnapshot{id: id, size: size, updated: time.Now()}
+		r.transfers[from] = in
+	}
+	if offset != len(in.data) || size != in.size {
+		n := len(in.data)
+		r.mu.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, n)
+		return
+	}
+	if len(in.data)+len(chunk) > in.size {
+		delete(r.transfers, from)
+		r.mu.Unlock()
+		http.Error(w, "snapshot larger than its size", http.StatusBadRequest)
+		return
+	}
+	in.data = append(in.data, chunk...)
+	in.updated = time.Now()
+	snapshotTransferBytes.WithLabelValues("received").Add(float64(len(chunk)))
+	n := len(in.data)
+	if n < in.size {
+		r.mu.Unlock()
+		fmt.Fprintln(w, n)
+		return
+	}
+	delete(r.transfers, from)
+	r.mu.Unlock()
+
+	sum := sha256.Sum256(in.data)
+	var m raftpb.Message
+	if hex.EncodeToString(sum[:16]) != id || m.Unmarshal(in.data) != nil || m.Type != raftpb.MsgSnap {
+		http.Error(w, "corrupt snapshot", http.StatusBadRequest)
+		return
+	}
+	if err := r.process(req.Context(), m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, n)
+}
+
+// dropIdle 丢弃 snapshotTransferIdle 内没有进展的快照, 持有 r.mu 时调用
+func (r *snapshotReceiver) dropIdle() {
+	for from, in := range r.transfers {
+		if time.Since(in.updated) > snapshotTransferIdle {
+			delete(r.transfers, from)
+		}
+	}
+}
+
+// SnapshotTransfers 返回本节点正在分块发给各 follower 的快照的进度, 没有时返回空的 map
+func (rc *RaftNode) SnapshotTransfers() map[uint64]SnapshotTransfer {
+	if rc.snapshots == nil {
+		return map[uint64]SnapshotTransfer{}
+	}
+	return rc.snapshots.transfers()
+}
+
+// peerHandler 返回 peer url 上服务的 handler: rafthttp 和分块快照的接收
+func (rc *RaftNode) peerHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(snapshotTransferPath, rc.snapshotReceiver)
+	mux.HandleFunc(clockProbePath, serveClock)
+	mux.Handle("/", rc.transport.Handler())
+	return mux
+}
@@ -0,0 +1,152 @@
+package raftnode
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/raft/v3"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+func TestSnapshotTransfer(t *testing.T) {
+	defer func(chunk int, backoff time.Duration) {
+		SnapshotChunkSize, snapshotTransferBackoff = chunk, backoff
+	}(SnapshotChunkSize, snapshotTransferBackoff)
+	SnapshotChunkSize, snapshotTransferBackoff = 64, time.Millisecond
+
+	received := make(chan raftpb.Message, 1)
+	recv := newSnapshotReceiver(0x1000, func(ctx context.Context, m raftpb.Message) error {
+		received <- m
+		return nil
+	})
+	// the third chunk fails once, as if the connection dropped
+	var puts, putBytes atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			if puts.Add(1) == 3 {
+				http.Error(w, "connection reset", http.StatusBadGateway)
+				return
+			}
+			putBytes.Add(r.ContentLength)
+		}
+		recv.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	reports := make(chan raft.SnapshotStatus, 1)
+	s := newSnapshotSender(1, 0x1000, 0, func(uint64) (string, bool) { return srv.URL, true },
+		func(id uint64, status raft.SnapshotStatus) { reports <- status },
+		func(raftpb.Message) { t.Error("expected the snapshot to be sent in chunks") })
+	defer s.stop()
+
+	data := bytes.Repeat([]byte("snapshot"), 100)
+	m := raftpb.Message{Type: raftpb.MsgSnap, From: 1, To: 2, Snapshot: raftpb.Snapshot{Data: data, Metadata: raftpb.SnapshotMetadata{Index: 7, Term: 2}}}
+	size, _ := m.Marshal()
+	s.send(m)
+	select {
+	case status := <-reports:
+		if status != raft.SnapshotFinish {
+			t.Fatalf("expected the snapshot to be sent, got %v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out sending the snapshot")
+	}
+	got := <-received
+	if !bytes.Equal(got.Snapshot.Data, data) || got.Snapshot.Metadata.Index != 7 {
+		t.Fatalf("expected the snapshot at index 7, got %+v", got.Snapshot.Metadata)
+	}
+	// the failed chunk is sent again, the chunks before it are not
+	if n := putBytes.Load(); n != int64(len(size)) {
+		t.Fatalf("expected %d bytes to be accepted once each, got %d", len(size), n)
+	}
+}
+
+func TestSnapshotTransferConcurrent(t *testing.T) {
+	defer func(chunk int) { SnapshotChunkSize = chunk }(SnapshotChunkSize)
+	SnapshotChunkSize = 64
+
+	// every follower holds its second chunk until released, both transfers
+	// get there only if neither waits for the other
+	release := make(chan struct{})
+	var held sync.WaitGroup
+	held.Add(2)
+	urls := map[uint64]string{}
+	for _, id := range []uint64{2, 3} {
+		recv := newSnapshotReceiver(0x1000, func(context.Context, raftpb.Message) error { return nil })
+		var puts atomic.Int64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut && puts.Add(1) == 2 {
+				held.Done()
+				<-release
+			}
+			recv.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		urls[id] = srv.URL
+	}
+	reports := make(chan uint64, 2)
+	s := newSnapshotSender(1, 0x1000, 0, func(id uint64) (string, bool) { u, ok := urls[id]; return u, ok },
+		func(id uint64, status raft.SnapshotStatus) { reports <- id },
+		func(raftpb.Message) { t.Error("expected the snapshot to be sent in chunks") })
+	defer s.stop()
+
+	data := bytes.Repeat([]byte("snapshot"), 100)
+	for _, id := range []uint64{2, 3} {
+		s.send(raftpb.Message{Type: raftpb.MsgSnap, From: 1, To: id, Snapshot: raftpb.Snapshot{Data: data, Metadata: raftpb.SnapshotMetadata{Index: 9}}})
+	}
+	held.Wait()
+	transfers := s.transfers()
+	for _, id := range []uint64{2, 3} {
+		if st := transfers[id]; st.Index != 9 || st.Sent != 64 || st.Size <= len(data) || st.Attempts != 1 || st.Started.IsZero() {
+			t.Fatalf("expected the first chunk of the snapshot sent to %x, got %+v", id, st)
+		}
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-reports:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out sending the snapshots")
+		}
+	}
+	if transfers := s.transfers(); len(transfers) != 0 {
+		t.Fatalf("expected no transfers once sent, got %+v", transfers)
+	}
+}
+
+func TestSnapshotTransferFallback(t *testing.T) {
+	// a member without chunked transfers answers 404
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	fallback := make(chan raftpb.Message, 1)
+	s := newSnapshotSender(1, 0x1000, 0, func(uint64) (string, bool) { return srv.URL, true },
+		func(uint64, raft.SnapshotStatus) { t.Error("expected the fallback to report the snapshot") },
+		func(m raftpb.Message) { fallback <- m })
+	defer s.stop()
+	s.send(raftpb.Message{Type: raftpb.MsgSnap, To: 2})
+	select {
+	case <-fallback:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the snapshot to be sent whole")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{rate: 1000}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.wait(context.Background(), 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first 100 bytes go right away, the next ones 100ms apart
+	if d := time.Since(start); d < 180*time.Millisecond || d > time.Second {
+		t.Fatalf("expected 300 bytes at 1000 bytes/s to take 200ms, took %v", d)
+	}
+}
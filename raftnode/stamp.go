@@ -0,0 +1,24 @@
+package raftnode
+
+import "go.etcd.io/etcd/raft/v3/raftpb"
+
+// WithProposalStamp 让 leader 用 stamp 改写其他成员转发来的提案, 例如写入 leader 的时钟.
+// stamp 返回新的提案内容, 不能改变提案的含义以外的部分; leader 自己的提案不经过 stamp
+func WithProposalStamp(stamp func(data []byte) []byte) Option {
+	return func(rc *RaftNode) {
+		rc.stampProposal = stamp
+	}
+}
+
+// stampForwarded 用 stampProposal 改写 follower 转发给 leader 的提案.
+// 不再是 leader 时 raft 会继续转发, 由新的 leader 改写
+func (rc *RaftNode) stampForwarded(m *raftpb.Message) {
+	if m.Type != raftpb.MsgProp || rc.stampProposal == nil || !rc.IsLeader() {
+		return
+	}
+	for i, e := range m.Entries {
+		if e.Type == raftpb.EntryNormal && len(e.Data) > 0 {
+			m.Entries[i].Data = rc.stampProposal(e.Data)
+		}
+	}
+}
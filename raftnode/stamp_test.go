@@ -0,0 +1,38 @@
+package raftnode
+
+import (
+	"testing"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+func TestStampForwarded(t *testing.T) {
+	rc := &RaftNode{id: 1}
+	WithProposalStamp(func(data []byte) []byte { return append([]byte("stamped "), data...) })(rc)
+	prop := func() raftpb.Message {
+		return raftpb.Message{Type: raftpb.MsgProp, Entries: []raftpb.Entry{
+			{Type: raftpb.EntryNormal, Data: []byte("a")},
+			{Type: raftpb.EntryConfChange, Data: []byte("cc")},
+			{Type: raftpb.EntryNormal},
+		}}
+	}
+
+	// a follower leaves them to raft to forward
+	m := prop()
+	rc.stampForwarded(&m)
+	if string(m.Entries[0].Data) != "a" {
+		t.Fatalf("follower stamped %q", m.Entries[0].Data)
+	}
+
+	rc.lead = 1
+	m = prop()
+	rc.stampForwarded(&m)
+	if string(m.Entries[0].Data) != "stamped a" || string(m.Entries[1].Data) != "cc" || len(m.Entries[2].Data) != 0 {
+		t.Fatalf("unexpected entries %+v", m.Entries)
+	}
+	app := raftpb.Message{Type: raftpb.MsgApp, Entries: []raftpb.Entry{{Type: raftpb.EntryNormal, Data: []byte("a")}}}
+	rc.stampForwarded(&app)
+	if string(app.Entries[0].Data) != "a" {
+		t.Fatalf("stamped a %v", app.Type)
+	}
+}
@@ -0,0 +1,95 @@
+package raftnode
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ApplyThrottleConfig 配置按 apply 落后程度的写入限流: 状态机应用跟不上提交时,
+// 先推迟再拒绝新的普通提案, 避免没有应用的日志在内存中越积越多
+type ApplyThrottleConfig struct {
+	// Throttle 是开始推迟提案的落后条数, 0 表示不推迟
+	Throttle uint64
+	// Reject 是开始拒绝提案的落后条数, 0 表示不拒绝
+	Reject uint64
+	// MaxDelay 是落后接近 Reject 时推迟的时间, 落后在 Throttle 和 Reject 之间时按比例推迟
+	MaxDelay time.Duration
+}
+
+// DefaultApplyThrottleDelay 是 ApplyThrottleConfig.MaxDelay 为 0 时使用的最长推迟时间
+var DefaultApplyThrottleDelay = 100 * time.Millisecond
+
+var (
+	applyLagGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "apply_lag",
+		Help:      "Number of committed entries the state machine has not applied yet.",
+	})
+
+	proposalsThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "server",
+		Name:      "proposals_throttled_total",
+		Help:      "Number of proposals delayed or rejected because the state machine lagged behind the committed entries.",
+	}, []string{"action"})
+)
+
+func init() {
+	prometheus.MustRegister(applyLagGauge, proposalsThrottled)
+}
+
+// WithApplyThrottle 开启按 apply 落后程度的写入限流, 被拒绝的 Propose 返回 ErrApplyBacklog.
+// 只作用于 ProposePipe.Propose 的 PriorityNormal 提案
+func WithApplyThrottle(cfg ApplyThrottleConfig) Option {
+	return func(rc *RaftNode) {
+		if cfg.MaxDelay <= 0 {
+			cfg.MaxDelay = DefaultApplyThrottleDelay
+		}
+		if cfg.Throttle > 0 || cfg.Reject > 0 {
+			rc.proposePipe.throttle = &applyThrottle{cfg: cfg, lag: rc.ApplyLag}
+		}
+	}
+}
+
+// applyThrottle 在 Propose 的 goroutine 中推迟或拒绝提案, 不阻塞 raft 的提案 goroutine
+type applyThrottle struct {
+	cfg ApplyThrottleConfig
+	lag func() uint64
+}
+
+// wait 在落后不少于 Throttle 条时推迟 priority 的提案, 不少于 Reject 条时返回 ErrApplyBacklog
+func (t *applyThrottle) wait(ctx context.Context, priority Priority) error {
+	if t == nil || priority != PriorityNormal {
+		return nil
+	}
+	lag := t.lag()
+	if t.cfg.Reject > 0 && lag >= t.cfg.Reject {
+		proposalsThrottled.WithLabelValues("rejected").Inc()
+		return ErrApplyBacklog
+	}
+	if t.cfg.Throttle == 0 || lag < t.cfg.Throttle {
+		return nil
+	}
+	delay := t.cfg.MaxDelay
+	if t.cfg.Reject > t.cfg.Throttle {
+		delay = time.Duration(float64(delay) * float64(lag-t.cfg.Throttle+1) / float64(t.cfg.Reject-t.cfg.Throttle))
+	}
+	proposalsThrottled.WithLabelValues("delayed").Inc()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (rc *RaftNode) setCommitIndex(v uint64) {
+	atomic.StoreUint64(&rc.commitIndex, v)
+	applyLagGauge.Set(float64(rc.ApplyLag()))
+}
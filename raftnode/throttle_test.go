@@ -0,0 +1,42 @@
+package raftnode
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestApplyThrottle(t *testing.T) {
+	var lag uint64
+	th := &applyThrottle{cfg: ApplyThrottleConfig{Throttle: 10, Reject: 20, MaxDelay: 200 * time.Millisecond}, lag: func() uint64 { return lag }}
+	ctx := context.Background()
+
+	start := time.Now()
+	if err := th.wait(ctx, PriorityNormal); err != nil || time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("expected no delay without lag, got %v after %v", err, time.Since(start))
+	}
+	lag = 19
+	start = time.Now()
+	if err := th.wait(ctx, PriorityNormal); err != nil || time.Since(start) < 150*time.Millisecond {
+		t.Fatalf("expected a delay close to MaxDelay, got %v after %v", err, time.Since(start))
+	}
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := th.wait(short, PriorityNormal); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context to end the delay, got %v", err)
+	}
+	lag = 20
+	if err := th.wait(ctx, PriorityNormal); !errors.Is(err, ErrApplyBacklog) {
+		t.Fatalf("expected ErrApplyBacklog, got %v", err)
+	}
+	for _, p := range []Priority{PriorityHigh, PrioritySystem} {
+		if err := th.wait(ctx, p); err != nil {
+			t.Fatalf("expected %v proposals not to be throttled, got %v", p, err)
+		}
+	}
+	var none *applyThrottle
+	if err := none.wait(ctx, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,29 @@
+package raftnode
+
+import (
+	"time"
+
+	"go.etcd.io/etcd/server/v3/etcdserver/api/rafthttp"
+)
+
+// TickInterval 是 raft 循环 tick 的间隔, 选举超时是 10 个 tick, 心跳是 1 个
+var TickInterval = 100 * time.Millisecond
+
+// NewTransport 创建成员 id 的 raft 消息传输, 收到的消息交给 r
+type NewTransport func(id uint64, r rafthttp.Raft) rafthttp.Transporter
+
+// WithTransport 用 newTransport 创建的传输代替 rafthttp, 节点不再监听 peer url,
+// 例如在同一进程内运行多个成员而不占用端口
+func WithTransport(newTransport NewTransport) Option {
+	return func(rc *RaftNode) {
+		rc.newTransport = newTransport
+	}
+}
+
+// WithTicks 让 raft 循环在 tickc 每收到一个值时 tick, 代替每 TickInterval 一次的定时器,
+// 测试用假时钟驱动选举和心跳. tickc 之外的超时仍然使用真实时间
+func WithTicks(tickc <-chan time.Time) Option {
+	return func(rc *RaftNode) {
+		rc.tickc = tickc
+	}
+}
@@ -0,0 +1,51 @@
+package raftnode
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/wal"
+)
+
+// SetWALSegmentSize 设置 WAL 段文件的大小, 作用于进程内所有之后创建的段文件,
+// 必须在创建 RaftNode 之前调用. WAL 总是在后台预分配下一个段文件, 段文件越大,
+// 切换段文件的次数越少, 但每个文件占用的磁盘空间越多.
+func SetWALSegmentSize(bytes int64) {
+	if bytes > 0 {
+		wal.SegmentSizeBytes = bytes
+	}
+}
+
+// walSegments 统计 WAL 段文件的切换, 只在 raft 循环中使用
+type walSegments struct {
+	dir     string
+	modTime time.Time
+	count   int
+}
+
+// observeSave 记录一次 wal.Save 的耗时, 期间切换了段文件时同时记录为切换耗时.
+// 只有目录的修改时间变化时才重新统计段文件数量.
+func (s *walSegments) observeSave(d time.Duration) {
+	walSaveDuration.Observe(d.Seconds())
+	info, err := os.Stat(s.dir)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return
+	}
+	s.modTime = info.ModTime()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	count := 0
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".wal") {
+			count++
+		}
+	}
+	if s.count > 0 && count > s.count {
+		walRotationDuration.Observe(d.Seconds())
+	}
+	s.count = count
+	walSegmentsGauge.Set(float64(count))
+}
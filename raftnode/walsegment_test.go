@@ -0,0 +1,41 @@
+package raftnode
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWALSegmentsObserveSave(t *testing.T) {
+	dir := t.TempDir()
+	touch := func(name string, mtime time.Time) {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	touch("0000000000000000-0000000000000000.wal", now)
+	s := &walSegments{dir: dir}
+
+	s.observeSave(time.Millisecond)
+	if s.count != 1 {
+		t.Fatalf("expected 1 segment, got %d", s.count)
+	}
+	// the preallocated file is not a segment
+	touch("0.tmp", now.Add(time.Second))
+	s.observeSave(time.Millisecond)
+	touch("0000000000000001-0000000000000010.wal", now.Add(2*time.Second))
+	s.observeSave(time.Millisecond)
+	if s.count != 2 {
+		t.Fatalf("expected 2 segments, got %d", s.count)
+	}
+	if got := testutil.ToFloat64(walSegmentsGauge); got != 2 {
+		t.Fatalf("expected the segments gauge at 2, got %v", got)
+	}
+}
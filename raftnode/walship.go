@@ -0,0 +1,94 @@
+package raftnode
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/wal"
+	"go.etcd.io/etcd/server/v3/wal/walpb"
+)
+
+// WAL 记录的类型, 与 etcd wal 包一致
+const (
+	walEntryType = 2
+	walStateType = 3
+	walCRCType   = 4
+)
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ClosedWALSegments 返回 WAL 目录中已经写完的段的路径, 即最新的段以外的段, 按顺序排列.
+// 它们的内容不会再改变, 可以复制到数据目录之外; 清理可能随时删除它们
+func (rc *RaftNode) ClosedWALSegments() ([]string, error) {
+	names, err := listFiles(rc.waldir, ".wal")
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	paths := make([]string, len(names)-1)
+	for i, name := range names[:len(names)-1] {
+		paths[i] = filepath.Join(rc.waldir, name)
+	}
+	return paths, nil
+}
+
+// ReadWALSegment 解码一个 WAL 段的内容, 返回其中的日志项和最后一个 HardState.
+// 段单独校验 crc, 不需要之前的段. 同一个索引的日志项可能出现多次, 后面的覆盖前面的
+// 及其之后的日志项. 日志项用 s 解密, s 为 nil 时不解密
+func ReadWALSegment(data []byte, s Sealer) ([]raftpb.Entry, raftpb.HardState, error) {
+	var (
+		ents []raftpb.Entry
+		st   raftpb.HardState
+		crc  uint32
+	)
+	for len(data) >= 8 {
+		lenField := int64(binary.LittleEndian.Uint64(data))
+		if lenField == 0 {
+			// 预分配的空间
+			break
+		}
+		recBytes := int64(uint64(lenField) & ^(uint64(0xff) << 56))
+		var padBytes int64
+		if lenField < 0 {
+			padBytes = int64((uint64(lenField) >> 56) & 0x7)
+		}
+		if int64(len(data)-8) < recBytes+padBytes {
+			return nil, st, io.ErrUnexpectedEOF
+		}
+		var rec walpb.Record
+		if err := rec.Unmarshal(data[8 : 8+recBytes]); err != nil {
+			return nil, st, err
+		}
+		data = data[8+recBytes+padBytes:]
+
+		if rec.Type == walCRCType {
+			if crc != 0 && rec.Crc != crc {
+				return nil, st, wal.ErrCRCMismatch
+			}
+			crc = rec.Crc
+			continue
+		}
+		crc = crc32.Update(crc, walCRCTable, rec.Data)
+		if rec.Crc != crc {
+			return nil, st, wal.ErrCRCMismatch
+		}
+		switch rec.Type {
+		case walEntryType:
+			var e raftpb.Entry
+			if err := e.Unmarshal(rec.Data); err != nil {
+				return nil, st, err
+			}
+			ents = append(ents, e)
+		case walStateType:
+			if err := st.Unmarshal(rec.Data); err != nil {
+				return nil, st, err
+			}
+		}
+	}
+	if err := openEntries(s, ents); err != nil {
+		return nil, st, err
+	}
+	return ents, st, nil
+}
@@ -0,0 +1,74 @@
+package raftnode
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/wal"
+	"go.uber.org/zap"
+)
+
+func TestReadWALSegment(t *testing.T) {
+	defer func(size int64) { wal.SegmentSizeBytes = size }(wal.SegmentSizeBytes)
+	wal.SegmentSizeBytes = 4096
+
+	dir := t.TempDir()
+	w, err := wal.Create(zap.NewNop(), dir, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 300
+	for i := uint64(1); i <= n; i++ {
+		ents, err := sealEntries(xorSealer{}, []raftpb.Entry{{Term: 1, Index: i, Data: []byte(fmt.Sprintf("entry %d with some padding", i))}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Save(raftpb.HardState{Term: 1, Commit: i - 1}, ents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &RaftNode{waldir: dir}
+	paths, err := rc.ClosedWALSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := listFiles(dir, ".wal")
+	if len(paths) < 2 || len(paths) != len(all)-1 {
+		t.Fatalf("expected every segment but the last of %v, got %v", all, paths)
+	}
+	var next uint64 = 1
+	var commit uint64
+	for _, path := range append(paths, filepath.Join(dir, all[len(all)-1])) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents, st, err := ReadWALSegment(data, xorSealer{})
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		for _, e := range ents {
+			if want := fmt.Sprintf("entry %d with some padding", next); e.Index != next || string(e.Data) != want {
+				t.Fatalf("%s: expected %q at %d, got %q at %d", path, want, next, e.Data, e.Index)
+			}
+			next++
+		}
+		commit = st.Commit
+	}
+	if next != n+1 || commit != n-1 {
+		t.Fatalf("expected %d entries committed up to %d, got %d up to %d", n, n-1, next-1, commit)
+	}
+
+	data, _ := os.ReadFile(paths[0])
+	data[len(data)/2] ^= 0xff
+	if _, _, err := ReadWALSegment(data, nil); err == nil {
+		t.Fatal("expected a corrupted segment to fail")
+	}
+}
@@ -0,0 +1,164 @@
+package raftnode
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+)
+
+// WALSyncMode 决定 WAL 写入后何时 fsync
+type WALSyncMode string
+
+const (
+	// WALSyncAlways 每次写入 WAL 后都 fsync, 写入返回时即已持久化
+	WALSyncAlways WALSyncMode = "always"
+	// WALSyncInterval 每隔一段时间 fsync 一次, 合并多个批次的 fsync,
+	// 掉电时可能丢失最后一个周期内的写入
+	WALSyncInterval WALSyncMode = "interval"
+	// WALSyncNone 从不主动 fsync, 由操作系统决定何时落盘
+	WALSyncNone WALSyncMode = "none"
+)
+
+// DefaultWALSyncInterval 是 interval 模式默认的最长刷盘周期
+var DefaultWALSyncInterval = 100 * time.Millisecond
+
+// ParseWALSyncMode 解析 --wal-sync 的取值
+func ParseWALSyncMode(s string) (WALSyncMode, error) {
+	switch m := WALSyncMode(s); m {
+	case WALSyncAlways, WALSyncInterval, WALSyncNone:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid WAL sync mode %q (always|interval|none)", s)
+}
+
+// WithWALSync 设置 WAL 的 fsync 模式, interval 只在 WALSyncInterval 模式下使用.
+// 非 always 模式下 raft 在 fsync 之前就会发送消息和应用日志, 掉电后节点可能忘记
+// 已投出的票或已确认的日志, 只适合能接受这种风险的部署.
+func WithWALSync(mode WALSyncMode, interval time.Duration) Option {
+	return func(rc *RaftNode) {
+		rc.walSync = mode
+		if interval > 0 {
+			rc.walSyncInterval = interval
+		}
+	}
+}
+
+// DurableIndex 返回已确定 fsync 到磁盘的最后一条日志的索引, 可能落后于 AppliedIndex
+func (rc *RaftNode) DurableIndex() uint64 {
+	return atomic.LoadUint64(&rc.durableIndex)
+}
+
+// AppliedIndex 返回状态机已应用的最后一条日志的索引
+func (rc *RaftNode) AppliedIndex() uint64 {
+	return rc.getAppliedIndex()
+}
+
+func (rc *RaftNode) setDurableIndex(v uint64) {
+	atomic.StoreUint64(&rc.durableIndex, v)
+	durableIndexGauge.Set(float64(v))
+}
+
+// setSavedIndex 记录已写入 WAL 的最后一条日志的索引, 在 always 模式下它同时是持久化的索引
+func (rc *RaftNode) setSavedIndex(v uint64) {
+	atomic.StoreUint64(&rc.savedIndex, v)
+	if rc.walSync == WALSyncAlways {
+		rc.setDurableIndex(v)
+	}
+}
+
+// startWALSync 按模式配置 WAL, interval 模式下启动定时 fsync 的 goroutine.
+// 返回的函数停止该 goroutine 并做最后一次 fsync, 必须在关闭 WAL 之前调用.
+func (rc *RaftNode) startWALSync() (stop func()) {
+	if rc.walSync == WALSyncAlways {
+		return func() {}
+	}
+	rc.wal.SetUnsafeNoFsync()
+	if rc.walSync != WALSyncInterval {
+		return func() {}
+	}
+	stopc, donec := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(donec)
+		ticker := time.NewTicker(rc.walSyncInterval)
+		defer ticker.Stop()
+		var last time.Time
+		for {
+			select {
+			case <-ticker.C:
+				last = rc.syncWAL(last)
+			case <-stopc:
+				rc.syncWAL(last)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stopc)
+		<-donec
+	}
+}
+
+// syncWAL fsync 上次刷盘 (since) 之后修改过的 WAL 文件, 成功后推进 durableIndex.
+// WAL 在 unsafe 模式下跳过了自身的 fsync, 这里通过另外打开的文件描述符刷盘,
+// fsync 作用于文件本身, 与写入时使用的描述符无关.
+func (rc *RaftNode) syncWAL(since time.Time) time.Time {
+	index := atomic.LoadUint64(&rc.savedIndex)
+	if index <= rc.DurableIndex() && !since.IsZero() {
+		return since
+	}
+	start := time.Now()
+	if err := syncWALDir(rc.waldir, since); err != nil {
+		log.Printf("metcd: failed to sync WAL (%v)", err)
+		return since
+	}
+	d := time.Since(start)
+	atomic.AddInt64(&rc.walNanos, int64(d))
+	walFsyncDuration.Observe(d.Seconds())
+	rc.setDurableIndex(index)
+	return start
+}
+
+func syncWALDir(dir string, since time.Time) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".wal") {
+			continue
+		}
+		info, err := e.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// purged by a defrag
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !since.IsZero() && info.ModTime().Before(since) {
+			continue
+		}
+		if err := syncFile(filepath.Join(dir, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	// 新切分出的段文件需要目录项也落盘
+	return syncFile(dir)
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fileutil.Fdatasync(f)
+}
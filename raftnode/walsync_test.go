@@ -0,0 +1,52 @@
+package raftnode
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncWAL(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "0000000000000000-0000000000000000.wal"), []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rc := &RaftNode{waldir: dir, walSync: WALSyncInterval}
+
+	rc.setSavedIndex(5)
+	if got := rc.DurableIndex(); got != 0 {
+		t.Fatalf("interval mode must not report saved entries as durable, got %d", got)
+	}
+	last := rc.syncWAL(time.Time{})
+	if got := rc.DurableIndex(); got != 5 {
+		t.Fatalf("expected durable index 5 after sync, got %d", got)
+	}
+	if again := rc.syncWAL(last); !again.Equal(last) {
+		t.Fatal("expected no sync without new entries")
+	}
+
+	rc.waldir = filepath.Join(dir, "missing")
+	rc.setSavedIndex(7)
+	rc.syncWAL(last)
+	if got := rc.DurableIndex(); got != 5 {
+		t.Fatalf("a failed sync must keep the durable index, got %d", got)
+	}
+
+	always := &RaftNode{walSync: WALSyncAlways}
+	always.setSavedIndex(3)
+	if got := always.DurableIndex(); got != 3 {
+		t.Fatalf("always mode: expected durable index 3, got %d", got)
+	}
+}
+
+func TestParseWALSyncMode(t *testing.T) {
+	for _, s := range []string{"always", "interval", "none"} {
+		if _, err := ParseWALSyncMode(s); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+	if _, err := ParseWALSyncMode("sometimes"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"metcd/api"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trafficRecorder writes the client operations served by this member to a
+// file, for metcdctl bench replay. Keys and values are not recorded, only a
+// hash of the key and the size of the value.
+type trafficRecorder struct {
+	salt  []byte
+	start time.Time
+
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newTrafficRecorder(path string) (*trafficRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &trafficRecorder{salt: salt, start: time.Now(), f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// keyHash maps key to a hash that is the same for the whole recording but
+// cannot be reversed by trying likely keys without the salt.
+func (t *trafficRecorder) keyHash(key string) string {
+	h := sha256.New()
+	h.Write(t.salt)
+	h.Write([]byte(key))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// record wraps next, recording the requests to /kv/ and /txn.
+func (t *trafficRecorder) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := recordedOp(r)
+		if op == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		rec := api.RecordedOp{
+			Op:       op,
+			Size:     body.n,
+			Offset:   start.Sub(t.start),
+			Duration: time.Since(start),
+			Status:   rw.status,
+		}
+		if op == "get" {
+			rec.Size = 0
+			if rw.status == http.StatusOK {
+				rec.Size = rw.n
+			}
+		}
+		if op != "txn" {
+			rec.KeyHash = t.keyHash(strings.TrimPrefix(r.URL.Path, "/kv"))
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if err := t.enc.Encode(rec); err != nil {
+			log.Printf("Failed to record request (%v)\n", err)
+		}
+	})
+}
+
+func recordedOp(r *http.Request) string {
+	switch {
+	case r.URL.Path == "/txn" && r.Method == http.MethodPost:
+		return "txn"
+	case !strings.HasPrefix(r.URL.Path, "/kv/"):
+		return ""
+	case r.Method == http.MethodGet:
+		return "get"
+	case r.Method == http.MethodPut:
+		return "put"
+	case r.Method == http.MethodDelete:
+		return "delete"
+	case r.Method == http.MethodPatch && r.URL.Query().Get("append") == "true":
+		return "append"
+	case r.Method == http.MethodPatch:
+		return "patch"
+	}
+	return ""
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *recordingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
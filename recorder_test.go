@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"metcd/api"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTrafficRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rec.jsonl")
+	rec, err := newTrafficRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.f.Close()
+	h := rec.record(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte("value"))
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/kv/secret", strings.NewReader("0123456789")),
+		httptest.NewRequest(http.MethodGet, "/kv/secret", nil),
+		httptest.NewRequest(http.MethodGet, "/health", nil),
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ops []api.RecordedOp
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if strings.Contains(sc.Text(), "secret") {
+			t.Fatalf("expected the key to be anonymized, got %s", sc.Text())
+		}
+		var op api.RecordedOp
+		if err := json.Unmarshal(sc.Bytes(), &op); err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) != 2 {
+		t.Fatalf("expected the put and the get to be recorded, got %+v", ops)
+	}
+	if ops[0].Op != "put" || ops[0].Size != 10 || ops[0].Status != http.StatusNoContent {
+		t.Fatalf("unexpected put %+v", ops[0])
+	}
+	if ops[1].Op != "get" || ops[1].Size != 5 || ops[1].KeyHash != ops[0].KeyHash {
+		t.Fatalf("unexpected get %+v", ops[1])
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"metcd/api"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var ErrRedactionNotFound = errors.New("metcd: prefix is not redacted")
+
+// redactedValue replaces the values of the keys under a redacted prefix.
+const redactedValue = "[REDACTED]"
+
+// PutRedaction redacts the values of the keys with prefix in the keyspace
+// of ctx from the snapshots and exports of GET /snapshot.
+func (s *kvstore) PutRedaction(ctx context.Context, prefix string) error {
+	res, err := s.propose(ctx, kv{Op: opRedactionPut, Key: prefix})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// DeleteRedaction stops redacting prefix in the keyspace of ctx.
+func (s *kvstore) DeleteRedaction(ctx context.Context, prefix string) error {
+	res, err := s.propose(ctx, kv{Op: opRedactionDelete, Key: prefix})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// Redactions returns the redacted prefixes of the keyspace called name,
+// sorted.
+func (s *kvstore) Redactions(name string) ([]api.Redaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, err := s.space(name); err != nil {
+		return nil, err
+	}
+	out := []api.Redaction{}
+	for _, prefix := range s.redactedPrefixes(name) {
+		out = append(out, api.Redaction{Keyspace: name, Prefix: prefix})
+	}
+	return out, nil
+}
+
+// redactionList returns the redactions of every keyspace. It must be
+// called with s.mu held.
+func (s *kvstore) redactionList() []api.Redaction {
+	out := make([]api.Redaction, 0, len(s.redactions))
+	for rd := range s.redactions {
+		out = append(out, rd)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Keyspace != out[j].Keyspace {
+			return out[i].Keyspace < out[j].Keyspace
+		}
+		return out[i].Prefix < out[j].Prefix
+	})
+	return out
+}
+
+// redactedPrefixes returns the redacted prefixes of the keyspace called
+// name, sorted. It must be called with s.mu held.
+func (s *kvstore) redactedPrefixes(name string) []string {
+	var prefixes []string
+	for rd := range s.redactions {
+		if rd.Keyspace == name {
+			prefixes = append(prefixes, rd.Prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// redactedIf returns the redacted prefixes of the keyspace called name if
+// redact is set, none otherwise. It must be called with s.mu held.
+func (s *kvstore) redactedIf(name string, redact bool) []string {
+	if !redact {
+		return nil
+	}
+	return s.redactedPrefixes(name)
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactKVs returns kvs of the keyspace called name with the values under
+// its redacted prefixes replaced if redact is set, kvs itself when none
+// are. It must be called with s.mu held.
+func (s *kvstore) redactKVs(name string, kvs map[string]string, redact bool) map[string]string {
+	if !redact {
+		return kvs
+	}
+	prefixes := s.redactedPrefixes(name)
+	if len(prefixes) == 0 {
+		return kvs
+	}
+	out := make(map[string]string, len(kvs))
+	for k, v := range kvs {
+		if hasAnyPrefix(k, prefixes) {
+			v = redactedValue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// applyRedaction applies opRedactionPut or opRedactionDelete. It must be
+// called with s.mu held.
+func (s *kvstore) applyRedaction(r kv) error {
+	rd := api.Redaction{Keyspace: r.Keyspace, Prefix: r.Key}
+	if r.Op == opRedactionPut {
+		s.redactions[rd] = struct{}{}
+		return nil
+	}
+	if _, ok := s.redactions[rd]; !ok {
+		return ErrRedactionNotFound
+	}
+	delete(s.redactions, rd)
+	return nil
+}
+
+// serveRedaction handles /admin/redaction: GET lists the redacted prefixes
+// of the keyspace of the request, PUT ?prefix=<prefix> redacts a prefix
+// and DELETE ?prefix=<prefix> stops redacting it.
+func (h *httpKVAPI) serveRedaction(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if r.Method != http.MethodGet && (prefix == "" || !strings.HasPrefix(prefix, "/")) {
+		http.Error(w, "Invalid prefix", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rds, err := h.store.Redactions(keyspaceOf(r.Context()))
+		if keyspaceError(w, err) {
+			return
+		}
+		writeJSON(w, rds)
+	case http.MethodPut:
+		err := h.store.PutRedaction(r.Context(), prefix)
+		if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose redaction (%v)\n", err)
+			http.Error(w, "Failed on PUT", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		err := h.store.DeleteRedaction(r.Context(), prefix)
+		if errors.Is(err, ErrRedactionNotFound) {
+			http.Error(w, "Prefix is not redacted", http.StatusNotFound)
+			return
+		} else if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose redaction removal (%v)\n", err)
+			http.Error(w, "Failed on DELETE", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPut)
+		w.Header().Add("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
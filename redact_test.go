@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"metcd/api"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	s := newTestKVStore(map[string]string{"/secrets/db": "hunter2", "/config/db": "host"})
+	s.apply(kv{Op: opKeyspacePut, Keyspace: "app"})
+	s.apply(kv{Op: opPut, Keyspace: "app", Key: "/secrets/api", Val: "token"})
+	if res := s.apply(kv{Op: opRedactionPut, Key: "/secrets/"}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res := s.apply(kv{Op: opRedactionPut, Keyspace: "nosuch", Key: "/secrets/"}); !errors.Is(res.err, ErrKeyspaceNotFound) {
+		t.Fatalf("expected a redaction of a missing keyspace to fail, got %v", res.err)
+	}
+
+	kvs, _, err := s.Export("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []api.KeyValue{{Key: "/config/db", Value: "host"}, {Key: "/secrets/db", Value: redactedValue}}
+	if len(kvs) != 2 || kvs[0] != want[0] || kvs[1] != want[1] {
+		t.Fatalf("expected %+v, got %+v", want, kvs)
+	}
+	// the prefix is redacted in the default keyspace only
+	if kvs, _, err := s.Export("app"); err != nil || len(kvs) != 1 || kvs[0].Value != "token" {
+		t.Fatalf("expected the value of app to be exported, got %+v, %v", kvs, err)
+	}
+
+	data, err := s.snapshot(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") || !strings.Contains(string(data), "token") {
+		t.Fatalf("expected only the redacted value to be replaced, got %s", data)
+	}
+	// the snapshots raft takes keep the values, and the policy
+	data, err = s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := restored.Lookup("/secrets/db"); v != "hunter2" {
+		t.Fatalf("expected the value to be restored, got %q", v)
+	}
+	if rds, err := restored.Redactions(""); err != nil || len(rds) != 1 || rds[0].Prefix != "/secrets/" {
+		t.Fatalf("expected the redaction to be restored, got %+v, %v", rds, err)
+	}
+
+	if res := s.apply(kv{Op: opRedactionDelete, Key: "/nosuch/"}); !errors.Is(res.err, ErrRedactionNotFound) {
+		t.Fatalf("expected removing a missing redaction to fail, got %v", res.err)
+	}
+	if res := s.apply(kv{Op: opRedactionDelete, Key: "/secrets/"}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if kvs, _, _ := s.Export(""); kvs[1].Value != "hunter2" {
+		t.Fatalf("expected the value not to be redacted anymore, got %+v", kvs)
+	}
+}
+
+func TestServeRedaction(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.apply(kv{Op: opRedactionPut, Key: "/secrets/"})
+	srv := httptest.NewServer(newHTTPHandler(&httpKVAPI{store: s, requests: newRequestTracker()}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/admin/redaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rds []api.Redaction
+	if err := json.NewDecoder(resp.Body).Decode(&rds); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(rds) != 1 || rds[0] != (api.Redaction{Prefix: "/secrets/"}) {
+		t.Fatalf("expected /secrets/, got %+v", rds)
+	}
+	for _, c := range []struct {
+		method, query string
+		code          int
+	}{
+		{http.MethodPut, "?prefix=secrets", http.StatusBadRequest},
+		{http.MethodDelete, "", http.StatusBadRequest},
+		{http.MethodPost, "?prefix=/secrets/", http.StatusMethodNotAllowed},
+	} {
+		req, _ := http.NewRequest(c.method, srv.URL+"/admin/redaction"+c.query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.query, c.code, resp.StatusCode)
+		}
+	}
+}
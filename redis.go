@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"metcd/api"
+	"metcd/raftnode"
+	"metcd/resp"
+	"sort"
+	"strings"
+)
+
+// respStore serves the RESP front-end from the default keyspace.
+type respStore struct {
+	kvs *kvstore
+	rc  *raftnode.RaftNode
+}
+
+func (s respStore) Sync(ctx context.Context) error { return s.rc.LinearizableReadNotify(ctx) }
+
+func (s respStore) Lookup(key string) (string, bool) { return s.kvs.Lookup(key) }
+
+func (s respStore) Keys(prefix string) []string { return s.kvs.keys(prefix) }
+
+func (s respStore) Txn(ctx context.Context, txn *api.TxnRequest) (*api.TxnResponse, error) {
+	if resp.IsExpiry(ctx) {
+		ctx = withDeleteReason(ctx, deleteExpired)
+	}
+	return s.kvs.Txn(ctx, txn)
+}
+
+// keys returns the keys of the default keyspace with prefix, sorted.
+func (s *kvstore) keys(prefix string) []string {
+	s.mu.RLock()
+	var keys []string
+	for k := range s.kvStore {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
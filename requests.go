@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxTrackedKeyLen truncates the paths listed by /debug/requests, keys may
+// be long or sensitive and only their prefix helps telling requests apart.
+const maxTrackedKeyLen = 48
+
+// Request phases reported by /debug/requests.
+const (
+	phaseHandling  = "handling"
+	phaseReadIndex = "waiting for read index"
+	phaseWaitRev   = "waiting for revision"
+	phaseProposing = "proposing"
+	phaseWaitApply = "waiting for apply"
+	phaseStreaming = "streaming"
+)
+
+// slowRequestThreshold is the default of --slow-request-threshold.
+var slowRequestThreshold = time.Second
+
+// slowPhases are the phases logged for slow requests, by field name. The
+// time spent waiting for apply is split into commit and apply.
+var slowPhases = []struct{ phase, field string }{
+	{phaseHandling, "handling"},
+	{phaseReadIndex, "readIndex"},
+	{phaseWaitRev, "waitRevision"},
+	{phaseProposing, "queue"},
+}
+
+// trackedRequest is an in-flight client request.
+type trackedRequest struct {
+	id     uint64
+	method string
+	key    string
+	remote string
+	start  time.Time
+	phase  atomic.Value // string
+
+	mu      sync.Mutex
+	entered time.Time                // start of the current phase
+	took    map[string]time.Duration // time spent in the phases left
+	apply   time.Duration            // time this member spent applying its proposals
+}
+
+// enter records the end of the current phase and the start of phase.
+func (tr *trackedRequest) enter(phase string) {
+	now := time.Now()
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.took[tr.phase.Load().(string)] += now.Sub(tr.entered)
+	tr.entered = now
+	tr.phase.Store(phase)
+}
+
+// requestTracker lists the in-flight client requests, to find out what is
+// stuck right now, and logs the slow ones once they finish.
+type requestTracker struct {
+	mu   sync.Mutex
+	next uint64
+	reqs map[uint64]*trackedRequest
+
+	slow *slowLog // nil logs no slow requests
+}
+
+// slowLog logs the requests taking longer than threshold.
+type slowLog struct {
+	lg        *zap.Logger
+	threshold time.Duration
+	// walTime returns the time this member spent writing its WAL so far,
+	// nil if unknown
+	walTime func() time.Duration
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{reqs: make(map[uint64]*trackedRequest)}
+}
+
+type trackedRequestCtx struct{}
+
+// track registers the requests passed to next while they are served.
+func (t *requestTracker) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path
+		if len(key) > maxTrackedKeyLen {
+			key = key[:maxTrackedKeyLen] + "..."
+		}
+		tr := &trackedRequest{method: r.Method, key: key, remote: r.RemoteAddr, start: time.Now(), took: make(map[string]time.Duration)}
+		tr.entered = tr.start
+		tr.phase.Store(phaseHandling)
+		var walStart time.Duration
+		if t.slow != nil && t.slow.walTime != nil {
+			walStart = t.slow.walTime()
+		}
+
+		t.mu.Lock()
+		t.next++
+		tr.id = t.next
+		t.reqs[tr.id] = tr
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			delete(t.reqs, tr.id)
+			t.mu.Unlock()
+			if t.slow != nil {
+				t.slow.log(tr, walStart)
+			}
+		}()
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), trackedRequestCtx{}, tr)))
+	})
+}
+
+// setPhase records what the request of ctx is waiting for. It does nothing
+// for contexts not created by track.
+func setPhase(ctx context.Context, phase string) {
+	if tr, ok := ctx.Value(trackedRequestCtx{}).(*trackedRequest); ok {
+		tr.enter(phase)
+	}
+}
+
+// addApplyTime records that applying a proposal of the request of ctx took
+// d, part of its wait for apply.
+func addApplyTime(ctx context.Context, d time.Duration) {
+	if tr, ok := ctx.Value(trackedRequestCtx{}).(*trackedRequest); ok {
+		tr.mu.Lock()
+		tr.apply += d
+		tr.mu.Unlock()
+	}
+}
+
+// logSlow makes t log the requests taking longer than threshold, with the
+// time they spent in each phase and the time spent on the WAL meanwhile.
+func (t *requestTracker) logSlow(lg *zap.Logger, threshold time.Duration, walTime func() time.Duration) {
+	t.slow = &slowLog{lg: lg, threshold: threshold, walTime: walTime}
+}
+
+// log logs tr if it was slow. Streams last as long as their clients want,
+// they are never slow.
+func (l *slowLog) log(tr *trackedRequest, walStart time.Duration) {
+	took := time.Since(tr.start)
+	if took < l.threshold || tr.phase.Load() == phaseStreaming {
+		return
+	}
+	tr.enter(phaseHandling)
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	fields := []zap.Field{
+		zap.String("method", tr.method),
+		zap.String("key", tr.key),
+		zap.String("remote", tr.remote),
+		zap.Duration("took", took),
+	}
+	for _, p := range slowPhases {
+		if d := tr.took[p.phase]; d > 0 {
+			fields = append(fields, zap.Duration(p.field, d))
+		}
+	}
+	if d := tr.took[phaseWaitApply]; d > 0 {
+		fields = append(fields, zap.Duration("commit", d-tr.apply), zap.Duration("apply", tr.apply))
+	}
+	if l.walTime != nil {
+		fields = append(fields, zap.Duration("wal", l.walTime()-walStart))
+	}
+	l.lg.Warn("slow request", fields...)
+}
+
+// serveRequests handles GET /debug/requests, listing the in-flight requests
+// with the longest running first.
+func (t *requestTracker) serveRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	self, _ := r.Context().Value(trackedRequestCtx{}).(*trackedRequest)
+	t.mu.Lock()
+	reqs := make([]*trackedRequest, 0, len(t.reqs))
+	for _, tr := range t.reqs {
+		if tr != self {
+			reqs = append(reqs, tr)
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].start.Before(reqs[j].start) })
+
+	now := time.Now()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tMETHOD\tKEY\tPHASE\tELAPSED\tREMOTE")
+	for _, tr := range reqs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", tr.id, tr.method, tr.key, tr.phase.Load(),
+			now.Sub(tr.start).Round(time.Millisecond), tr.remote)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequestTracker(t *testing.T) {
+	tracker := newRequestTracker()
+	entered, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", func(w http.ResponseWriter, r *http.Request) {
+		setPhase(r.Context(), phaseWaitApply)
+		close(entered)
+		<-release
+	})
+	mux.HandleFunc("/debug/requests", tracker.serveRequests)
+	srv := httptest.NewServer(tracker.track(mux))
+	defer srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/kv/"+strings.Repeat("k", 100), nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-entered
+
+	list := func() string {
+		resp, err := http.Get(srv.URL + "/debug/requests")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	out := list()
+	if !strings.Contains(out, "PUT") || !strings.Contains(out, phaseWaitApply) {
+		t.Fatalf("expected the stuck PUT to be listed, got:\n%s", out)
+	}
+	if strings.Contains(out, strings.Repeat("k", maxTrackedKeyLen)) {
+		t.Fatalf("expected the key to be truncated, got:\n%s", out)
+	}
+	if strings.Contains(out, "/debug/requests") {
+		t.Fatalf("expected the listing itself to be omitted, got:\n%s", out)
+	}
+
+	close(release)
+	<-done
+	if out := list(); strings.Contains(out, "PUT") {
+		t.Fatalf("expected no request after it finished, got:\n%s", out)
+	}
+}
+
+func TestSlowRequests(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	tracker := newRequestTracker()
+	var wal time.Duration
+	tracker.logSlow(zap.New(core), 20*time.Millisecond, func() time.Duration { return wal })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			return
+		}
+		setPhase(r.Context(), phaseProposing)
+		time.Sleep(10 * time.Millisecond)
+		setPhase(r.Context(), phaseWaitApply)
+		time.Sleep(20 * time.Millisecond)
+		addApplyTime(r.Context(), 5*time.Millisecond)
+		wal += 3 * time.Millisecond
+	})
+	mux.HandleFunc("/watch/", func(w http.ResponseWriter, r *http.Request) {
+		setPhase(r.Context(), phaseStreaming)
+		time.Sleep(30 * time.Millisecond)
+	})
+	h := tracker.track(mux)
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/kv/fast", nil),
+		httptest.NewRequest(http.MethodGet, "/watch/stream", nil),
+		httptest.NewRequest(http.MethodPut, "/kv/slow", nil),
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected only the slow PUT to be logged, got %+v", entries)
+	}
+	fields := entries[0].ContextMap()
+	if fields["method"] != http.MethodPut || fields["key"] != "/kv/slow" {
+		t.Fatalf("expected the slow PUT, got %v", fields)
+	}
+	for name, min := range map[string]time.Duration{"took": 30 * time.Millisecond, "queue": 10 * time.Millisecond, "commit": 15 * time.Millisecond} {
+		if d, _ := fields[name].(time.Duration); d < min {
+			t.Errorf("expected %s to be at least %v, got %v", name, min, fields[name])
+		}
+	}
+	if fields["apply"] != 5*time.Millisecond || fields["wal"] != 3*time.Millisecond {
+		t.Fatalf("expected the apply and WAL times, got %v", fields)
+	}
+}
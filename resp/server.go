@@ -0,0 +1,749 @@
+// Package resp serves a subset of the Redis protocol (RESP2) on top of the
+// raft-backed store, so that Redis clients can use metcd.
+//
+// A Redis key k is stored as the metcd key "/"+k, the key of GET /k on the
+// HTTP API. Expiry deadlines set with EXPIRE or SET EX live in hidden keys
+// under TTLPrefix and are enforced by the leader: reads hide expired keys at
+// once and the leader deletes them within ExpireInterval.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"metcd/api"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// KeyPrefix is prepended to Redis keys to get metcd keys.
+	KeyPrefix = "/"
+	// TTLPrefix is prepended to Redis keys to get the key holding their
+	// expiry deadline, in zero padded unix milliseconds.
+	TTLPrefix = "\x00ttl/"
+)
+
+var (
+	// CommandTimeout bounds a single command.
+	CommandTimeout = 5 * time.Second
+	// ExpireInterval is how often the leader deletes expired keys.
+	ExpireInterval = time.Second
+)
+
+// Store is the part of the key-value store used by the server.
+type Store interface {
+	// Sync waits until the local store reflects every write committed
+	// before the call.
+	Sync(ctx context.Context) error
+	// Lookup returns the value of key in the local store.
+	Lookup(key string) (string, bool)
+	// Keys returns the keys with prefix in the local store, sorted.
+	Keys(prefix string) []string
+	// Txn applies txn atomically.
+	Txn(ctx context.Context, txn *api.TxnRequest) (*api.TxnResponse, error)
+}
+
+// errSyntax and errNotInteger are the messages of Redis for these errors.
+var (
+	errSyntax     = errors.New("ERR syntax error")
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+)
+
+// command is a Redis command. arity is the number of arguments including
+// the name, or its negation for the minimum of variadic commands.
+type command struct {
+	arity int
+	run   func(s *Server, ctx context.Context, w writer, args []string) error
+}
+
+var commands = map[string]command{
+	"PING":    {-1, ping},
+	"ECHO":    {2, echo},
+	"SELECT":  {2, selectDB},
+	"COMMAND": {-1, commandInfo},
+	"GET":     {2, get},
+	"SET":     {-3, set},
+	"DEL":     {-2, del},
+	"EXISTS":  {-2, exists},
+	"INCR":    {2, incr},
+	"INCRBY":  {3, incr},
+	"DECR":    {2, incr},
+	"DECRBY":  {3, incr},
+	"EXPIRE":  {3, expire},
+	"PEXPIRE": {3, expire},
+	"TTL":     {2, ttl},
+	"PTTL":    {2, ttl},
+	"SCAN":    {-2, scan},
+}
+
+// writeCommands are the commands that may write keys.
+var writeCommands = map[string]bool{
+	"SET": true, "DEL": true, "INCR": true, "INCRBY": true, "DECR": true, "DECRBY": true, "EXPIRE": true, "PEXPIRE": true,
+}
+
+// Server serves RESP connections.
+type Server struct {
+	store    Store
+	isLeader func() bool
+
+	// Audit, if set before Serve, is called after every command that may
+	// write keys with the address of the client, the command and its keys,
+	// and the error it failed with. The values are not passed.
+	Audit func(remote, command string, keys []string, err error)
+
+	mu     sync.Mutex
+	lns    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	closed bool
+
+	stopc chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewServer creates a server on store. Expired keys are deleted while
+// isLeader returns true.
+func NewServer(store Store, isLeader func() bool) *Server {
+	s := &Server{
+		store:    store,
+		isLeader: isLeader,
+		lns:      make(map[net.Listener]struct{}),
+		conns:    make(map[net.Conn]struct{}),
+		stopc:    make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.expireLoop()
+	return s
+}
+
+// Serve accepts connections on ln until the server is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	s.lns[ln] = struct{}{}
+	s.mu.Unlock()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.stopc:
+				return net.ErrClosed
+			default:
+			}
+			return err
+		}
+		if !s.track(c) {
+			c.Close()
+			return net.ErrClosed
+		}
+		s.wg.Add(1)
+		go s.serveConn(c)
+	}
+}
+
+// Close stops the listeners, the connections and the deletion of expired
+// keys, and waits for them.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stopc)
+	for ln := range s.lns {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) track(c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	w := writer{bufio.NewWriter(c)}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				w.error("ERR " + err.Error())
+				w.Flush()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("resp: failed to read from %s (%v)", c.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := strings.EqualFold(args[0], "QUIT")
+		if quit {
+			w.simple("OK")
+		} else {
+			s.exec(w, c.RemoteAddr().String(), args)
+		}
+		// pipelined commands are answered together
+		if quit || r.Buffered() == 0 {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// exec runs a command of the client at remote and writes its reply.
+func (s *Server) exec(w writer, remote string, args []string) {
+	name := strings.ToUpper(args[0])
+	cmd, ok := commands[name]
+	if !ok {
+		w.error(fmt.Sprintf("ERR unknown command '%.128s'", args[0]))
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	args[0] = name
+	ctx, cancel := context.WithTimeout(context.Background(), CommandTimeout)
+	defer cancel()
+	err := cmd.run(s, ctx, w, args)
+	if s.Audit != nil && writeCommands[name] {
+		keys := args[1:2]
+		if name == "DEL" {
+			keys = args[1:]
+		}
+		s.Audit(remote, name, keys, err)
+	}
+	if err != nil {
+		msg := err.Error()
+		if !strings.HasPrefix(msg, "ERR ") {
+			msg = "ERR " + msg
+		}
+		w.error(msg)
+	}
+}
+
+// entry is the state of a Redis key in the local store.
+type entry struct {
+	key    string
+	value  string
+	exists bool
+	ttl    int64 // expiry deadline in unix milliseconds
+	hasTTL bool
+	rawTTL string
+}
+
+func (s *Server) load(key string) entry {
+	e := entry{key: key}
+	e.value, e.exists = s.store.Lookup(KeyPrefix + key)
+	if e.rawTTL, e.hasTTL = s.store.Lookup(TTLPrefix + key); e.hasTTL {
+		e.ttl, _ = strconv.ParseInt(e.rawTTL, 10, 64)
+	}
+	return e
+}
+
+// live reports whether the key exists and has not expired.
+func (e entry) live() bool {
+	return e.exists && !(e.hasTTL && e.ttl <= time.Now().UnixMilli())
+}
+
+// guard returns the conditions of a Txn changing the key only if it still
+// is in the state e.
+func (e entry) guard() []api.Compare {
+	cmps := make([]api.Compare, 0, 2)
+	for _, k := range []struct {
+		key, value string
+		exists     bool
+	}{{KeyPrefix + e.key, e.value, e.exists}, {TTLPrefix + e.key, e.rawTTL, e.hasTTL}} {
+		if k.exists {
+			cmps = append(cmps, api.Compare{Target: api.CompareValue, Result: api.CompareEqual, Key: k.key, Value: k.value})
+		} else {
+			cmps = append(cmps, api.Compare{Target: api.CompareExists, Result: api.CompareEqual, Key: k.key, Value: "false"})
+		}
+	}
+	return cmps
+}
+
+// update applies the ops returned by change for the state of key, retrying
+// while the key is changed concurrently. change returns no ops to leave the
+// key as it is.
+func (s *Server) update(ctx context.Context, key string, change func(e entry) ([]api.Op, error)) error {
+	for {
+		if err := s.store.Sync(ctx); err != nil {
+			return err
+		}
+		e := s.load(key)
+		ops, err := change(e)
+		if err != nil || len(ops) == 0 {
+			return err
+		}
+		resp, err := s.store.Txn(ctx, &api.TxnRequest{Compare: e.guard(), Success: ops})
+		if err != nil || resp.Succeeded {
+			return err
+		}
+	}
+}
+
+func putTTL(key string, deadline int64) api.Op {
+	return api.Op{Type: api.OpPut, Key: TTLPrefix + key, Value: fmt.Sprintf("%016d", deadline)}
+}
+
+func deleteKey(key string) []api.Op {
+	return []api.Op{{Type: api.OpDelete, Key: KeyPrefix + key}, {Type: api.OpDelete, Key: TTLPrefix + key}}
+}
+
+func ping(s *Server, ctx context.Context, w writer, args []string) error {
+	switch len(args) {
+	case 1:
+		w.simple("PONG")
+	case 2:
+		w.bulk(args[1])
+	default:
+		return errors.New("ERR wrong number of arguments for 'ping' command")
+	}
+	return nil
+}
+
+func echo(s *Server, ctx context.Context, w writer, args []string) error {
+	w.bulk(args[1])
+	return nil
+}
+
+// selectDB only accepts the database 0, there is a single one.
+func selectDB(s *Server, ctx context.Context, w writer, args []string) error {
+	if args[1] != "0" {
+		return errors.New("ERR DB index is out of range")
+	}
+	w.simple("OK")
+	return nil
+}
+
+// commandInfo replies with no command documentation, which clients such
+// as redis-cli accept.
+func commandInfo(s *Server, ctx context.Context, w writer, args []string) error {
+	w.array(0)
+	return nil
+}
+
+func get(s *Server, ctx context.Context, w writer, args []string) error {
+	if err := s.store.Sync(ctx); err != nil {
+		return err
+	}
+	e := s.load(args[1])
+	if !e.live() {
+		w.null()
+	} else {
+		w.bulk(e.value)
+	}
+	return nil
+}
+
+// set handles SET key value [NX|XX] [EX seconds|PX milliseconds|KEEPTTL].
+func set(s *Server, ctx context.Context, w writer, args []string) error {
+	key, value := args[1], args[2]
+	var nx, xx, keepTTL bool
+	var deadline int64
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if i+1 == len(args) || deadline != 0 {
+				return errSyntax
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || n <= 0 || n > 1<<40 {
+				return errors.New("ERR invalid expire time in 'set' command")
+			}
+			if opt == "EX" {
+				n *= 1000
+			}
+			deadline = time.Now().UnixMilli() + n
+		default:
+			return errSyntax
+		}
+	}
+	if (nx && xx) || (keepTTL && deadline != 0) {
+		return errSyntax
+	}
+
+	put := api.Op{Type: api.OpPut, Key: KeyPrefix + key, Value: value}
+	ops := func(e entry) []api.Op {
+		switch {
+		case deadline != 0:
+			return []api.Op{put, putTTL(key, deadline)}
+		case keepTTL && e.live():
+			return []api.Op{put}
+		}
+		return []api.Op{put, {Type: api.OpDelete, Key: TTLPrefix + key}}
+	}
+	if !nx && !xx && !keepTTL {
+		if _, err := s.store.Txn(ctx, &api.TxnRequest{Success: ops(entry{})}); err != nil {
+			return err
+		}
+		w.simple("OK")
+		return nil
+	}
+	done := false
+	err := s.update(ctx, key, func(e entry) ([]api.Op, error) {
+		if (nx && e.live()) || (xx && !e.live()) {
+			return nil, nil
+		}
+		done = true
+		return ops(e), nil
+	})
+	if err != nil {
+		return err
+	}
+	if done {
+		w.simple("OK")
+	} else {
+		w.null()
+	}
+	return nil
+}
+
+func del(s *Server, ctx context.Context, w writer, args []string) error {
+	var n int64
+	for _, key := range args[1:] {
+		deleted := false
+		err := s.update(ctx, key, func(e entry) ([]api.Op, error) {
+			deleted = e.live()
+			if !e.exists && !e.hasTTL {
+				return nil, nil
+			}
+			return deleteKey(key), nil
+		})
+		if err != nil {
+			return err
+		}
+		if deleted {
+			n++
+		}
+	}
+	w.int(n)
+	return nil
+}
+
+func exists(s *Server, ctx context.Context, w writer, args []string) error {
+	if err := s.store.Sync(ctx); err != nil {
+		return err
+	}
+	var n int64
+	for _, key := range args[1:] {
+		if s.load(key).live() {
+			n++
+		}
+	}
+	w.int(n)
+	return nil
+}
+
+// incr handles INCR, INCRBY, DECR and DECRBY. The expiry of the key is
+// kept.
+func incr(s *Server, ctx context.Context, w writer, args []string) error {
+	delta := int64(1)
+	if len(args) == 3 {
+		var err error
+		if delta, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+			return errNotInteger
+		}
+	}
+	if strings.HasPrefix(args[0], "DECR") {
+		if delta == -1<<63 {
+			return errNotInteger
+		}
+		delta = -delta
+	}
+	var n int64
+	err := s.update(ctx, args[1], func(e entry) ([]api.Op, error) {
+		n = 0
+		ops := []api.Op{{Type: api.OpPut, Key: KeyPrefix + e.key}}
+		if e.live() {
+			var err error
+			if n, err = strconv.ParseInt(e.value, 10, 64); err != nil {
+				return nil, errNotInteger
+			}
+		} else if e.hasTTL {
+			ops = append(ops, api.Op{Type: api.OpDelete, Key: TTLPrefix + e.key})
+		}
+		if (delta > 0 && n > 1<<63-1-delta) || (delta < 0 && n < -1<<63-delta) {
+			return nil, errors.New("ERR increment or decrement would overflow")
+		}
+		n += delta
+		ops[0].Value = strconv.FormatInt(n, 10)
+		return ops, nil
+	})
+	if err != nil {
+		return err
+	}
+	w.int(n)
+	return nil
+}
+
+// expire handles EXPIRE and PEXPIRE. A deadline in the past deletes the
+// key.
+func expire(s *Server, ctx context.Context, w writer, args []string) error {
+	d, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || d > 1<<40 || d < -1<<40 {
+		return errNotInteger
+	}
+	if args[0] == "EXPIRE" {
+		d *= 1000
+	}
+	deadline := time.Now().UnixMilli() + d
+	found := false
+	err = s.update(ctx, args[1], func(e entry) ([]api.Op, error) {
+		if found = e.live(); !found {
+			return nil, nil
+		}
+		if d <= 0 {
+			return deleteKey(e.key), nil
+		}
+		return []api.Op{putTTL(e.key, deadline)}, nil
+	})
+	if err != nil {
+		return err
+	}
+	if found {
+		w.int(1)
+	} else {
+		w.int(0)
+	}
+	return nil
+}
+
+// ttl handles TTL and PTTL, replying -2 for a missing key and -1 for a key
+// without expiry.
+func ttl(s *Server, ctx context.Context, w writer, args []string) error {
+	if err := s.store.Sync(ctx); err != nil {
+		return err
+	}
+	e := s.load(args[1])
+	switch {
+	case !e.live():
+		w.int(-2)
+	case !e.hasTTL:
+		w.int(-1)
+	case args[0] == "TTL":
+		w.int((e.ttl - time.Now().UnixMilli() + 500) / 1000)
+	default:
+		w.int(e.ttl - time.Now().UnixMilli())
+	}
+	return nil
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count]. The cursor is
+// the position in the sorted keys, so keys deleted during a scan may make
+// it skip others.
+func scan(s *Server, ctx context.Context, w writer, args []string) error {
+	cursor, err := strconv.Atoi(args[1])
+	if err != nil || cursor < 0 {
+		return errors.New("ERR invalid cursor")
+	}
+	pattern, count := "*", 10
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return errSyntax
+			}
+		default:
+			return errSyntax
+		}
+	}
+	if err := s.store.Sync(ctx); err != nil {
+		return err
+	}
+	keys := s.store.Keys(KeyPrefix)
+	var found []string
+	next := cursor
+	for ; next < len(keys) && next-cursor < count; next++ {
+		key := strings.TrimPrefix(keys[next], KeyPrefix)
+		if matchGlob(pattern, key) && s.load(key).live() {
+			found = append(found, key)
+		}
+	}
+	if next >= len(keys) {
+		next = 0
+	}
+	w.array(2)
+	w.bulk(strconv.Itoa(next))
+	w.array(len(found))
+	for _, key := range found {
+		w.bulk(key)
+	}
+	return nil
+}
+
+// expireLoop deletes the expired keys while this member is the leader.
+func (s *Server) expireLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(ExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.isLeader() {
+				s.expire()
+			}
+		case <-s.stopc:
+			return
+		}
+	}
+}
+
+// expire deletes the keys whose deadline passed, unless their deadline
+// changed in the meantime.
+func (s *Server) expire() {
+	now := time.Now().UnixMilli()
+	for _, k := range s.store.Keys(TTLPrefix) {
+		raw, ok := s.store.Lookup(k)
+		if deadline, err := strconv.ParseInt(raw, 10, 64); !ok || (err == nil && deadline > now) {
+			continue
+		}
+		key := strings.TrimPrefix(k, TTLPrefix)
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), expiryCtx{}, true), CommandTimeout)
+		_, err := s.store.Txn(ctx, &api.TxnRequest{
+			Compare: []api.Compare{{Target: api.CompareValue, Result: api.CompareEqual, Key: k, Value: raw}},
+			Success: deleteKey(key),
+		})
+		cancel()
+		if err != nil {
+			log.Printf("resp: failed to delete expired key %q (%v)", key, err)
+			return
+		}
+		select {
+		case <-s.stopc:
+			return
+		default:
+		}
+	}
+}
+
+type expiryCtx struct{}
+
+// IsExpiry reports whether ctx is that of a Store.Txn deleting an expired
+// key, for stores accounting for expired keys.
+func IsExpiry(ctx context.Context) bool {
+	expiry, _ := ctx.Value(expiryCtx{}).(bool)
+	return expiry
+}
+
+// matchGlob reports whether s matches the Redis glob pattern: * matches
+// any string, ? any character, [abc], [^abc] and [a-z] a character of the
+// set, and \ escapes the next character.
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			var ok bool
+			if pattern, ok = matchClass(pattern[1:], s[0]); !ok {
+				return false
+			}
+			s = s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// matchClass matches c against the set at the start of pattern, after the
+// '[', and returns the rest of the pattern after the ']'.
+func matchClass(pattern string, c byte) (string, bool) {
+	negate := strings.HasPrefix(pattern, "^")
+	if negate {
+		pattern = pattern[1:]
+	}
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		lo := pattern[0]
+		if lo == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			lo = pattern[0]
+		}
+		pattern = pattern[1:]
+		hi := lo
+		if len(pattern) > 1 && pattern[0] == '-' && pattern[1] != ']' {
+			hi, pattern = pattern[1], pattern[2:]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		match = match || (lo <= c && c <= hi)
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return pattern, match != negate
+}
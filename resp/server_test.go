@@ -0,0 +1,303 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"metcd/api"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeStore struct {
+	mu  sync.Mutex
+	kvs map[string]string
+}
+
+func (f *fakeStore) Sync(context.Context) error { return nil }
+
+func (f *fakeStore) Lookup(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.kvs[key]
+	return v, ok
+}
+
+func (f *fakeStore) Keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.kvs {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeStore) Txn(_ context.Context, txn *api.TxnRequest) (*api.TxnResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &api.TxnResponse{Succeeded: true}
+	for _, c := range txn.Compare {
+		v, ok := f.kvs[c.Key]
+		if (c.Target == api.CompareExists && fmt.Sprint(ok) != c.Value) || (c.Target == api.CompareValue && (!ok || v != c.Value)) {
+			resp.Succeeded = false
+		}
+	}
+	ops := txn.Success
+	if !resp.Succeeded {
+		ops = txn.Failure
+	}
+	for _, op := range ops {
+		r := api.OpResponse{Type: op.Type, Key: op.Key}
+		switch op.Type {
+		case api.OpPut:
+			f.kvs[op.Key] = op.Value
+		case api.OpDelete:
+			_, r.Found = f.kvs[op.Key]
+			delete(f.kvs, op.Key)
+		}
+		resp.Responses = append(resp.Responses, r)
+	}
+	return resp, nil
+}
+
+// client sends commands as arrays of bulk strings and reads the replies
+// back in the RESP2 syntax.
+type client struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &client{t: t, c: c, r: bufio.NewReader(c)}
+}
+
+func (c *client) send(args ...string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.c.Write([]byte(b.String())); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// reply reads a reply: a string for simple strings, errors (with their
+// "-") and integers, nil for a null bulk string and a slice for arrays.
+func (c *client) reply() interface{} {
+	line, err := readLine(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:]
+	case '-':
+		return line
+	case '$':
+		if line == "$-1" {
+			return nil
+		}
+		v, err := readLine(c.r)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		return v
+	case '*':
+		var n int
+		fmt.Sscan(line[1:], &n)
+		arr := []interface{}{}
+		for i := 0; i < n; i++ {
+			arr = append(arr, c.reply())
+		}
+		return arr
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func (c *client) do(want interface{}, args ...string) {
+	c.t.Helper()
+	c.send(args...)
+	if got := c.reply(); !reflect.DeepEqual(got, want) {
+		c.t.Fatalf("%v: expected %#v, got %#v", args, want, got)
+	}
+}
+
+func startServer(t *testing.T, f *fakeStore, leader bool) (*Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(f, func() bool { return leader })
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return s, ln.Addr().String()
+}
+
+func TestServer(t *testing.T) {
+	f := &fakeStore{kvs: map[string]string{}}
+	_, addr := startServer(t, f, false)
+	c := dial(t, addr)
+
+	c.do("PONG", "PING")
+	c.do("OK", "set", "a", "1")
+	if v := f.kvs["/a"]; v != "1" {
+		t.Fatalf("expected a to be stored as /a, got %q", v)
+	}
+	c.do("1", "GET", "a")
+	c.do(nil, "GET", "missing")
+	c.do(nil, "SET", "a", "2", "NX")
+	c.do(nil, "SET", "b", "2", "XX", "EX", "10")
+	c.do(nil, "GET", "b")
+	c.do("OK", "SET", "b", "2", "NX", "EX", "10")
+	c.do("10", "TTL", "b")
+	c.do("-1", "TTL", "a")
+	c.do("-2", "TTL", "missing")
+	c.do("-ERR syntax error", "SET", "a", "1", "NX", "XX")
+
+	c.do("2", "INCR", "a")
+	c.do("-3", "DECRBY", "counter", "3")
+	c.do("-ERR value is not an integer or out of range", "INCRBY", "a", "x")
+	c.do("OK", "SET", "s", "x")
+	c.do("-ERR value is not an integer or out of range", "INCR", "s")
+	c.do("2", "EXISTS", "a", "b", "missing")
+
+	c.do("1", "EXPIRE", "a", "100")
+	c.do("3", "INCR", "a")
+	c.do("100", "TTL", "a")
+	c.do("0", "EXPIRE", "missing", "100")
+	c.do("1", "EXPIRE", "s", "0")
+	c.do(nil, "GET", "s")
+	c.do("2", "DEL", "a", "b", "missing")
+	if len(f.Keys(TTLPrefix)) != 0 {
+		t.Fatalf("expected the expiry of deleted keys to be deleted, got %v", f.Keys(TTLPrefix))
+	}
+
+	// a key whose deadline passed is gone before the leader deletes it
+	f.kvs["/old"], f.kvs[TTLPrefix+"old"] = "v", "0000000000000001"
+	c.do(nil, "GET", "old")
+	c.do("0", "DEL", "old")
+	c.do("OK", "SET", "old", "v", "NX")
+	c.do("-1", "TTL", "old")
+
+	c.do("-ERR wrong number of arguments for 'get' command", "GET")
+	c.do("-ERR unknown command 'FLUSHALL'", "FLUSHALL")
+
+	// pipelined commands are answered in order
+	c.send("SET", "p", "1")
+	c.send("GET", "p")
+	if r1, r2 := c.reply(), c.reply(); r1 != "OK" || r2 != "1" {
+		t.Fatalf("expected OK and 1, got %v and %v", r1, r2)
+	}
+
+	// inline commands
+	if _, err := c.c.Write([]byte("GET p\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.reply(); got != "1" {
+		t.Fatalf("expected 1 for an inline command, got %v", got)
+	}
+
+	c.do("OK", "QUIT")
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatal("expected the connection to be closed after QUIT")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audited []string
+	s := NewServer(&fakeStore{kvs: map[string]string{"/s": "x"}}, func() bool { return false })
+	s.Audit = func(remote, command string, keys []string, err error) {
+		audited = append(audited, fmt.Sprint(command, keys, err != nil))
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	c := dial(t, ln.Addr().String())
+
+	c.do("OK", "set", "a", "1")
+	c.do("1", "GET", "a")
+	c.do("-ERR value is not an integer or out of range", "INCR", "s")
+	c.do("2", "DEL", "a", "s", "missing")
+	want := []string{"SET[a] false", "INCR[s] true", "DEL[a s missing] false"}
+	if !reflect.DeepEqual(audited, want) {
+		t.Fatalf("expected %v, got %v", want, audited)
+	}
+}
+
+func TestScan(t *testing.T) {
+	f := &fakeStore{kvs: map[string]string{"/user:1": "", "/user:2": "", "/user:3": "", "/other": "", "other": ""}}
+	f.kvs[TTLPrefix+"user:2"] = "0000000000000001"
+	_, addr := startServer(t, f, false)
+	c := dial(t, addr)
+
+	c.do([]interface{}{"3", []interface{}{"other", "user:1"}}, "SCAN", "0", "COUNT", "3")
+	c.do([]interface{}{"0", []interface{}{"user:3"}}, "SCAN", "3", "COUNT", "3")
+	c.do([]interface{}{"0", []interface{}{"user:1", "user:3"}}, "SCAN", "0", "MATCH", "user:*")
+	c.do("-ERR invalid cursor", "SCAN", "x")
+}
+
+func TestExpire(t *testing.T) {
+	f := &fakeStore{kvs: map[string]string{
+		"/a": "1", TTLPrefix + "a": "0000000000000001",
+		"/b": "2", TTLPrefix + "b": "9999999999999999",
+	}}
+	s, _ := startServer(t, f, true)
+	s.expire()
+	if want := map[string]string{"/b": "2", TTLPrefix + "b": "9999999999999999"}; !reflect.DeepEqual(f.kvs, want) {
+		t.Fatalf("expected %v, got %v", want, f.kvs)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"a*", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbb", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"a/*", "a/b/c", true},
+	} {
+		if got := matchGlob(tt.pattern, tt.s); got != tt.match {
+			t.Errorf("matchGlob(%q, %q) = %v, expected %v", tt.pattern, tt.s, got, tt.match)
+		}
+	}
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	for _, in := range []string{"*x\r\n", "*1\r\n+a\r\n", "*1\r\n$-2\r\n", "*1\r\n$1\r\nab\r\n"} {
+		if _, err := readCommand(bufio.NewReader(strings.NewReader(in))); err == nil {
+			t.Errorf("expected an error reading %q", in)
+		}
+	}
+}
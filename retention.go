@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"metcd/api"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrRetentionNotFound = errors.New("metcd: prefix is not retained")
+	ErrTombstoneNotFound = errors.New("metcd: key has no tombstone")
+)
+
+// tombstone is a key deleted under a retained prefix, its last value as
+// stored and its revisions, kept until the history is compacted at or past
+// its deletion.
+type tombstone struct {
+	Value      string
+	Revs       keyRevs
+	DeleteRev  int64
+	DeleteTime int64
+}
+
+// buriedKV is a tombstone in a snapshot, the key and value encoded as
+// base64 by JSON since either may not be valid UTF-8.
+type buriedKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	keyRevs
+	DeleteRev  int64 `json:"deleteRev"`
+	DeleteTime int64 `json:"deleteTime,omitempty"`
+}
+
+// PutRetention keeps the keys deleted under prefix in the keyspace of ctx
+// as tombstones, which Undelete restores until they are compacted.
+func (s *kvstore) PutRetention(ctx context.Context, prefix string) error {
+	res, err := s.propose(ctx, kv{Op: opRetentionPut, Key: prefix})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// DeleteRetention stops retaining prefix in the keyspace of ctx, dropping
+// the tombstones no other retained prefix covers.
+func (s *kvstore) DeleteRetention(ctx context.Context, prefix string) error {
+	res, err := s.propose(ctx, kv{Op: opRetentionDelete, Key: prefix})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// Undelete restores the tombstone of key in the keyspace of ctx with its
+// last value, as a new key created at the returned revision.
+func (s *kvstore) Undelete(ctx context.Context, key string) (int64, error) {
+	res, err := s.propose(ctx, kv{Op: opUndelete, Key: key})
+	if err != nil {
+		return 0, err
+	}
+	return res.rev, res.err
+}
+
+// Retentions returns the retained prefixes of the keyspace called name,
+// sorted.
+func (s *kvstore) Retentions(name string) ([]api.Retention, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(name)
+	if err != nil {
+		return nil, err
+	}
+	out := []api.Retention{}
+	for _, prefix := range ks.retainedPrefixes() {
+		out = append(out, api.Retention{Keyspace: name, Prefix: prefix})
+	}
+	return out, nil
+}
+
+// Tombstones returns the tombstones of the keys with prefix in the keyspace
+// called name, sorted by key.
+func (s *kvstore) Tombstones(name, prefix string) ([]api.Tombstone, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(name)
+	if err != nil {
+		return nil, err
+	}
+	out := []api.Tombstone{}
+	for k, t := range ks.tombstones {
+		if strings.HasPrefix(k, prefix) {
+			out = append(out, api.Tombstone{Key: k, CreateRevision: t.Revs.Create, ModRevision: t.Revs.Mod, Version: t.Revs.Version,
+				DeleteRevision: t.DeleteRev, DeleteTime: changeTime(t.DeleteTime)})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, nil
+}
+
+// retainedPrefixes returns the retained prefixes of ks, sorted. It must be
+// called with s.mu held.
+func (ks *keyspace) retainedPrefixes() []string {
+	prefixes := make([]string, 0, len(ks.retain))
+	for prefix := range ks.retain {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// retains reports whether the deletion of k leaves a tombstone. It must be
+// called with s.mu held.
+func (ks *keyspace) retains(k string) bool {
+	for prefix := range ks.retain {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// bury keeps prev, the pair of a key just deleted, as a tombstone if its
+// key is retained. It must be called with s.mu held.
+func (ks *keyspace) bury(prev *api.KeyValue) {
+	if prev == nil || !ks.retains(prev.Key) {
+		return
+	}
+	ks.tombstones[prev.Key] = tombstone{Value: prev.Value, Revs: revsOf(prev), DeleteRev: ks.next, DeleteTime: ks.nextTime}
+}
+
+// revsOf returns the revisions of kv as the keyspace keeps them.
+func revsOf(kv *api.KeyValue) keyRevs {
+	r := keyRevs{Create: kv.CreateRevision, Mod: kv.ModRevision, Version: kv.Version}
+	if kv.ModTime != nil {
+		r.ModTime = kv.ModTime.UnixNano()
+	}
+	return r
+}
+
+// undelete puts the last value of the tombstone of k back. The key is
+// created again, so its version starts over. It must be called with s.mu
+// held.
+func (ks *keyspace) undelete(k string) (*api.Event, error) {
+	t, ok := ks.tombstones[k]
+	if !ok {
+		return nil, ErrTombstoneNotFound
+	}
+	if !ks.admit([]api.Op{{Type: api.OpPut, Key: k, Value: t.Value}}) {
+		return nil, ErrQuotaExceeded
+	}
+	ev := ks.put(k, t.Value)
+	return &ev, nil
+}
+
+// applyRetention applies opRetentionPut or opRetentionDelete. It must be
+// called with s.mu held.
+func (ks *keyspace) applyRetention(r kv) error {
+	if r.Op == opRetentionPut {
+		ks.retain[r.Key] = struct{}{}
+		return nil
+	}
+	if _, ok := ks.retain[r.Key]; !ok {
+		return ErrRetentionNotFound
+	}
+	delete(ks.retain, r.Key)
+	for k := range ks.tombstones {
+		if !ks.retains(k) {
+			delete(ks.tombstones, k)
+		}
+	}
+	return nil
+}
+
+// tombstoneList returns the tombstones of ks for a snapshot, sorted by key,
+// with the values under the redacted prefixes replaced. It must be called
+// with s.mu held.
+func (ks *keyspace) tombstoneList(redacted []string) []buriedKV {
+	out := make([]buriedKV, 0, len(ks.tombstones))
+	for k, t := range ks.tombstones {
+		v := t.Value
+		if hasAnyPrefix(k, redacted) {
+			v = redactedValue
+		}
+		out = append(out, buriedKV{Key: []byte(k), Value: []byte(v), keyRevs: t.Revs, DeleteRev: t.DeleteRev, DeleteTime: t.DeleteTime})
+	}
+	sort.Slice(out, func(i, j int) bool { return string(out[i].Key) < string(out[j].Key) })
+	return out
+}
+
+// restoreRetention replaces the retained prefixes and the tombstones of ks
+// by those of a snapshot. It must be called with s.mu held.
+func (ks *keyspace) restoreRetention(prefixes []string, buried []buriedKV) {
+	ks.retain = make(map[string]struct{}, len(prefixes))
+	for _, prefix := range prefixes {
+		ks.retain[prefix] = struct{}{}
+	}
+	ks.tombstones = make(map[string]tombstone, len(buried))
+	for _, b := range buried {
+		ks.tombstones[string(b.Key)] = tombstone{Value: string(b.Value), Revs: b.keyRevs, DeleteRev: b.DeleteRev, DeleteTime: b.DeleteTime}
+	}
+}
+
+// serveRetention handles /admin/retention: GET lists the retained prefixes
+// of the keyspace of the request, PUT ?prefix=<prefix> retains a prefix
+// and DELETE ?prefix=<prefix> stops retaining it.
+func (h *httpKVAPI) serveRetention(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if r.Method != http.MethodGet && (prefix == "" || !strings.HasPrefix(prefix, "/")) {
+		http.Error(w, "Invalid prefix", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rts, err := h.store.Retentions(keyspaceOf(r.Context()))
+		if keyspaceError(w, err) {
+			return
+		}
+		writeJSON(w, rts)
+	case http.MethodPut:
+		err := h.store.PutRetention(r.Context(), prefix)
+		if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose retention (%v)\n", err)
+			http.Error(w, "Failed on PUT", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		err := h.store.DeleteRetention(r.Context(), prefix)
+		if errors.Is(err, ErrRetentionNotFound) {
+			http.Error(w, "Prefix is not retained", http.StatusNotFound)
+			return
+		} else if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose retention removal (%v)\n", err)
+			http.Error(w, "Failed on DELETE", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPut)
+		w.Header().Add("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveTombstones handles /tombstones/<key>: GET lists the tombstones of
+// the keys with the prefix <key> and POST restores the key <key>, with the
+// revision it is restored at in the X-Metcd-Revision header.
+func (h *httpKVAPI) serveTombstones(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/tombstones")
+	switch r.Method {
+	case http.MethodGet:
+		if err := h.readBarrier(w, r); errors.Is(err, errInvalidStaleness) {
+			http.Error(w, "Invalid maxStaleness", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("Failed to read on GET (%v)\n", err)
+			http.Error(w, "Failed on GET", http.StatusBadRequest)
+			return
+		}
+		ts, err := h.store.Tombstones(keyspaceOf(r.Context()), key)
+		if keyspaceError(w, err) {
+			return
+		}
+		writeJSON(w, ts)
+	case http.MethodPost:
+		if key == "" || key == "/" {
+			http.Error(w, "Invalid key", http.StatusBadRequest)
+			return
+		}
+		rev, err := h.store.Undelete(proposalCtx(r), key)
+		if errors.Is(err, ErrTombstoneNotFound) {
+			http.Error(w, "Key has no tombstone", http.StatusNotFound)
+			return
+		} else if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose undelete (%v)\n", err)
+			http.Error(w, "Failed on POST", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Metcd-Revision", strconv.FormatInt(rev, 10))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"metcd/api"
+	"testing"
+)
+
+func TestRetention(t *testing.T) {
+	s := newTestKVStore(nil)
+	if res := s.apply(kv{Op: opRetentionPut, Key: "/config/"}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	s.apply(kv{Op: opPut, Key: "/config/a", Val: "1"})
+	s.apply(kv{Op: opPut, Key: "/config/a", Val: "2"})
+	s.apply(kv{Op: opPut, Key: "/config/b", Val: "b"})
+	s.apply(kv{Op: opPut, Key: "/tmp/a", Val: "x"})
+	s.apply(kv{Op: opDelete, Key: "/config/a"})
+	s.apply(kv{Op: opDelete, Key: "/tmp/a"})
+	s.apply(kv{Op: opTxn, Txn: &api.TxnRequest{Success: []api.Op{{Type: api.OpDelete, Key: "/config/b"}}}})
+
+	ts, err := s.Tombstones("", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 2 || ts[0].Key != "/config/a" || ts[0].Version != 2 || ts[0].DeleteRevision != 5 || ts[1].Key != "/config/b" {
+		t.Fatalf("expected the tombstones of the retained keys only, got %+v", ts)
+	}
+
+	// the tombstones are kept in the snapshots
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if ts, _ := restored.Tombstones("", "/config/a"); len(ts) != 1 || ts[0].DeleteRevision != 5 {
+		t.Fatalf("expected the tombstone to be restored, got %+v", ts)
+	}
+	if rts, _ := restored.Retentions(""); len(rts) != 1 || rts[0].Prefix != "/config/" {
+		t.Fatalf("expected the retention to be restored, got %+v", rts)
+	}
+
+	res := restored.apply(kv{Op: opUndelete, Key: "/config/a"})
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	kv1, _, _ := restored.GetIn("", "/config/a")
+	if kv1 == nil || kv1.Value != "2" || kv1.CreateRevision != res.rev || kv1.Version != 1 {
+		t.Fatalf("expected the last value restored as a new key, got %+v", kv1)
+	}
+	if res := restored.apply(kv{Op: opUndelete, Key: "/config/a"}); !errors.Is(res.err, ErrTombstoneNotFound) {
+		t.Fatalf("expected a restored key to have no tombstone, got %v", res.err)
+	}
+	if res := restored.apply(kv{Op: opUndelete, Key: "/tmp/a"}); !errors.Is(res.err, ErrTombstoneNotFound) {
+		t.Fatalf("expected a key deleted outside the retention to have no tombstone, got %v", res.err)
+	}
+
+	// compaction drops the tombstones of the deletions it passes
+	s.apply(kv{Op: opCompact, Rev: 5})
+	if ts, _ := s.Tombstones("", "/"); len(ts) != 1 || ts[0].Key != "/config/b" {
+		t.Fatalf("expected the compacted tombstone to be dropped, got %+v", ts)
+	}
+	if res := s.apply(kv{Op: opRetentionDelete, Key: "/nosuch/"}); !errors.Is(res.err, ErrRetentionNotFound) {
+		t.Fatalf("expected removing a missing retention to fail, got %v", res.err)
+	}
+	if res := s.apply(kv{Op: opRetentionDelete, Key: "/config/"}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if ts, _ := s.Tombstones("", "/"); len(ts) != 0 {
+		t.Fatalf("expected the tombstones to go with the retention, got %+v", ts)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"metcd/api"
+	"metcd/hashring"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxRingVNodes bounds the points per unit of weight a request may ask for.
+const maxRingVNodes = 10000
+
+// ringNodes are the nodes registered under a prefix by name, with their
+// weight.
+type ringNodes map[string]int
+
+// register adds or removes the node of a key under prefix. The value of a
+// node is empty or {"weight":<n>}.
+func (nodes ringNodes) register(prefix, key, value string, deleted bool) {
+	name := strings.TrimPrefix(key, prefix)
+	if name == "" {
+		return
+	}
+	if deleted {
+		delete(nodes, name)
+		return
+	}
+	var reg struct {
+		Weight int `json:"weight"`
+	}
+	if json.Unmarshal([]byte(value), &reg) != nil || reg.Weight <= 0 {
+		reg.Weight = 1
+	}
+	nodes[name] = reg.Weight
+}
+
+// ring returns the body of GET /ring/<prefix> at rev.
+func (nodes ringNodes) ring(prefix string, rev int64, vnodes int, key string, replicas int) api.Ring {
+	res := api.Ring{Prefix: prefix, Rev: rev, VNodes: vnodes, Nodes: make([]api.RingNode, 0, len(nodes))}
+	members := make([]hashring.Node, 0, len(nodes))
+	for name, weight := range nodes {
+		res.Nodes = append(res.Nodes, api.RingNode{Name: name, Weight: weight})
+		members = append(members, hashring.Node{Name: name, Weight: weight})
+	}
+	sort.Slice(res.Nodes, func(i, j int) bool { return res.Nodes[i].Name < res.Nodes[j].Name })
+	if key != "" {
+		res.Owners = hashring.New(members, vnodes).GetN(key, replicas)
+	}
+	return res
+}
+
+// serveRing handles GET /ring/<prefix>, the consistent hash ring of the
+// nodes registered as keys under <prefix>: a PUT of /kv/<prefix><name>
+// registers the node name, with a value of {"weight":<n>} for n times its
+// share of keys, and a DELETE removes it. ?key=<key> adds the owner of key,
+// ?replicas=<n> the n nodes replicating it, and ?vnodes=<n> sets the points
+// per unit of weight. With ?watch=true the ring is streamed as newline
+// delimited JSON, again after every change of its nodes.
+func (h *httpKVAPI) serveRing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := strings.TrimPrefix(r.URL.Path, "/ring")
+	q := r.URL.Query()
+	vnodes, replicas := hashring.DefaultVNodes, 1
+	if v := q.Get("vnodes"); v != "" {
+		var err error
+		if vnodes, err = strconv.Atoi(v); err != nil || vnodes <= 0 || vnodes > maxRingVNodes {
+			http.Error(w, "Invalid vnodes", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("replicas"); v != "" {
+		var err error
+		if replicas, err = strconv.Atoi(v); err != nil || replicas <= 0 {
+			http.Error(w, "Invalid replicas", http.StatusBadRequest)
+			return
+		}
+	}
+	key := q.Get("key")
+	watch, _ := strconv.ParseBool(q.Get("watch"))
+	space := keyspaceOf(r.Context())
+
+	var events <-chan api.Event
+	if watch {
+		// watch before reading the nodes, so no change is missed
+		var cancel func()
+		var err error
+		events, cancel, err = h.store.WatchIn(space, prefix, watchOptions{prefix: true, since: noSince})
+		if keyspaceError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to watch the ring (%v)\n", err)
+			http.Error(w, "Failed on GET", http.StatusInternalServerError)
+			return
+		}
+		defer cancel()
+	}
+	if serializable, _ := strconv.ParseBool(q.Get("serializable")); !serializable {
+		setPhase(r.Context(), phaseReadIndex)
+		if err := h.rc.LinearizableReadNotify(r.Context()); err != nil {
+			log.Printf("Failed to read on ring (%v)\n", err)
+			http.Error(w, "Failed on GET", http.StatusBadRequest)
+			return
+		}
+	}
+	kvs, _, rev, err := h.store.RangeIn(space, prefix, string(prefixEnd([]byte(prefix))), 0)
+	if keyspaceError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to read the ring (%v)\n", err)
+		http.Error(w, "Failed on GET", http.StatusInternalServerError)
+		return
+	}
+	nodes := make(ringNodes, len(kvs))
+	for _, kv := range kvs {
+		nodes.register(prefix, kv.Key, kv.Value, false)
+	}
+	if !watch {
+		writeJSON(w, nodes.ring(prefix, rev, vnodes, key, replicas))
+		return
+	}
+
+	setPhase(r.Context(), phaseStreaming)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	send := func() error {
+		if err := enc.Encode(nodes.ring(prefix, rev, vnodes, key, replicas)); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	if send() != nil {
+		return
+	}
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				// fallen behind or the keyspace was deleted
+				return
+			}
+			changed := false
+			for {
+				if ev.ModRevision > rev {
+					nodes.register(prefix, ev.Key, ev.Value, ev.Type == api.EventDelete)
+					rev, changed = ev.ModRevision, true
+				}
+				// a burst of changes is sent as one ring
+				select {
+				case ev, ok = <-events:
+					if !ok {
+						if changed {
+							send()
+						}
+						return
+					}
+					continue
+				default:
+				}
+				break
+			}
+			if changed && send() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"metcd/api"
+	"metcd/hashring"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeRing(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.apply(kv{Op: opPut, Key: "/svc/a", Val: ""})
+	s.apply(kv{Op: opPut, Key: "/svc/b", Val: `{"weight":2}`})
+	s.apply(kv{Op: opPut, Key: "/other", Val: ""})
+	srv := httptest.NewServer(newHTTPHandler(&httpKVAPI{store: s, requests: newRequestTracker()}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/ring/svc/?serializable=true&key=k&replicas=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ring api.Ring
+	err = json.NewDecoder(resp.Body).Decode(&ring)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := hashring.New([]hashring.Node{{Name: "a", Weight: 1}, {Name: "b", Weight: 2}}, 0).GetN("k", 2)
+	switch {
+	case ring.Prefix != "/svc/" || ring.Rev != 3 || ring.VNodes != hashring.DefaultVNodes:
+		t.Fatalf("unexpected ring %+v", ring)
+	case len(ring.Nodes) != 2 || ring.Nodes[0] != (api.RingNode{Name: "a", Weight: 1}) || ring.Nodes[1].Weight != 2:
+		t.Fatalf("expected nodes a and b, got %+v", ring.Nodes)
+	case len(ring.Owners) != 2 || ring.Owners[0] != want[0] || ring.Owners[1] != want[1]:
+		t.Fatalf("expected the owners %v, got %v", want, ring.Owners)
+	}
+	if resp, _ := http.Get(srv.URL + "/ring/svc/?vnodes=0"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected invalid vnodes to be rejected, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(srv.URL + "/ring/svc/?serializable=true&watch=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	next := func() api.Ring {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("expected a ring, got %v", lines.Err())
+		}
+		var ring api.Ring
+		if err := json.Unmarshal(lines.Bytes(), &ring); err != nil {
+			t.Fatal(err)
+		}
+		return ring
+	}
+	if ring := next(); len(ring.Nodes) != 2 {
+		t.Fatalf("expected the current ring first, got %+v", ring)
+	}
+	s.apply(kv{Op: opPut, Key: "/other", Val: "x"})
+	s.apply(kv{Op: opPut, Key: "/svc/c", Val: ""})
+	if ring := next(); ring.Rev != 5 || len(ring.Nodes) != 3 || ring.Nodes[2].Name != "c" {
+		t.Fatalf("expected c to join, got %+v", ring)
+	}
+	s.apply(kv{Op: opDelete, Key: "/svc/a"})
+	if ring := next(); ring.Rev != 6 || len(ring.Nodes) != 2 || ring.Nodes[0].Name != "b" {
+		t.Fatalf("expected a to leave, got %+v", ring)
+	}
+}
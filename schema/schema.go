@@ -0,0 +1,404 @@
+// Package schema validates JSON values against a JSON Schema. It supports
+// the keywords that constrain the shape of a configuration value: type,
+// enum, const, properties, required, additionalProperties, items,
+// minItems, maxItems, minLength, maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, allOf, anyOf, oneOf and not. The
+// other keywords, such as $schema, title or format, are ignored like
+// annotations, and references ($ref) are not resolved.
+//
+// Patterns are Go regular expressions, which accept the patterns of most
+// schemas but not the lookarounds and backreferences of ECMAScript.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrInvalid = errors.New("schema: invalid schema")
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	root *node
+}
+
+// ValidationError is a value that does not match a schema. Path is the
+// JSON pointer of the part of the value that does not, "" for the whole
+// value.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return "schema: value " + e.Message
+	}
+	return "schema: " + e.Path + " " + e.Message
+}
+
+type node struct {
+	always *bool // set for the schemas true and false
+
+	types      []string
+	enum       []interface{}
+	hasConst   bool
+	constValue interface{}
+
+	properties map[string]*node
+	required   []string
+	additional *node
+
+	items              *node
+	minItems, maxItems int
+
+	minLength, maxLength int
+	pattern              *regexp.Regexp
+
+	minimum, maximum, exclusiveMinimum, exclusiveMaximum *float64
+
+	allOf, anyOf, oneOf []*node
+	not                 *node
+}
+
+var typeNames = map[string]bool{"null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true, "string": true}
+
+// Compile parses a JSON Schema.
+func Compile(data []byte) (*Schema, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	root, err := compile(v, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{root: root}, nil
+}
+
+func invalid(path, format string, args ...interface{}) error {
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Errorf("%w: %s: %s", ErrInvalid, path, fmt.Sprintf(format, args...))
+}
+
+func compile(v interface{}, path string) (*node, error) {
+	if b, ok := v.(bool); ok {
+		return &node{always: &b}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, invalid(path, "a schema is an object or a boolean")
+	}
+	n := &node{minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}
+	var err error
+	if t, ok := m["type"]; ok {
+		switch t := t.(type) {
+		case string:
+			n.types = []string{t}
+		case []interface{}:
+			for _, e := range t {
+				s, ok := e.(string)
+				if !ok {
+					return nil, invalid(path+"/type", "types are strings")
+				}
+				n.types = append(n.types, s)
+			}
+		default:
+			return nil, invalid(path+"/type", "type is a string or an array")
+		}
+		for _, t := range n.types {
+			if !typeNames[t] {
+				return nil, invalid(path+"/type", "unknown type %q", t)
+			}
+		}
+	}
+	if e, ok := m["enum"]; ok {
+		if n.enum, ok = e.([]interface{}); !ok {
+			return nil, invalid(path+"/enum", "enum is an array")
+		}
+	}
+	n.constValue, n.hasConst = m["const"]
+	if p, ok := m["properties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, invalid(path+"/properties", "properties is an object")
+		}
+		n.properties = make(map[string]*node, len(props))
+		for name, s := range props {
+			if n.properties[name], err = compile(s, path+"/properties/"+escape(name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if r, ok := m["required"]; ok {
+		names, ok := r.([]interface{})
+		if !ok {
+			return nil, invalid(path+"/required", "required is an array")
+		}
+		for _, name := range names {
+			s, ok := name.(string)
+			if !ok {
+				return nil, invalid(path+"/required", "required properties are strings")
+			}
+			n.required = append(n.required, s)
+		}
+	}
+	if a, ok := m["additionalProperties"]; ok {
+		if n.additional, err = compile(a, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if i, ok := m["items"]; ok {
+		if n.items, err = compile(i, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range []struct {
+		name string
+		dst  *int
+	}{{"minItems", &n.minItems}, {"maxItems", &n.maxItems}, {"minLength", &n.minLength}, {"maxLength", &n.maxLength}} {
+		v, ok := m[c.name]
+		if !ok {
+			continue
+		}
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != math.Trunc(f) {
+			return nil, invalid(path+"/"+c.name, "%s is a non-negative integer", c.name)
+		}
+		*c.dst = int(f)
+	}
+	if p, ok := m["pattern"]; ok {
+		s, ok := p.(string)
+		if !ok {
+			return nil, invalid(path+"/pattern", "pattern is a string")
+		}
+		if n.pattern, err = regexp.Compile(s); err != nil {
+			return nil, invalid(path+"/pattern", "%v", err)
+		}
+	}
+	for _, c := range []struct {
+		name string
+		dst  **float64
+	}{{"minimum", &n.minimum}, {"maximum", &n.maximum}, {"exclusiveMinimum", &n.exclusiveMinimum}, {"exclusiveMaximum", &n.exclusiveMaximum}} {
+		v, ok := m[c.name]
+		if !ok {
+			continue
+		}
+		f, ok := v.(float64)
+		if !ok {
+			return nil, invalid(path+"/"+c.name, "%s is a number", c.name)
+		}
+		*c.dst = &f
+	}
+	for _, c := range []struct {
+		name string
+		dst  *[]*node
+	}{{"allOf", &n.allOf}, {"anyOf", &n.anyOf}, {"oneOf", &n.oneOf}} {
+		v, ok := m[c.name]
+		if !ok {
+			continue
+		}
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, invalid(path+"/"+c.name, "%s is a non-empty array", c.name)
+		}
+		for i, s := range list {
+			sub, err := compile(s, path+"/"+c.name+"/"+strconv.Itoa(i))
+			if err != nil {
+				return nil, err
+			}
+			*c.dst = append(*c.dst, sub)
+		}
+	}
+	if s, ok := m["not"]; ok {
+		if n.not, err = compile(s, path+"/not"); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// escape escapes a property name as a JSON pointer token.
+func escape(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
+
+// Validate reports whether value is JSON matching s, as a
+// *ValidationError if it does not.
+func (s *Schema) Validate(value []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return &ValidationError{Message: "is not JSON"}
+	}
+	if dec.More() {
+		return &ValidationError{Message: "is not a single JSON value"}
+	}
+	return s.root.validate(v, "")
+}
+
+func (n *node) validate(v interface{}, path string) error {
+	if n.always != nil {
+		if !*n.always {
+			return &ValidationError{Path: path, Message: "is not allowed"}
+		}
+		return nil
+	}
+	fail := func(format string, args ...interface{}) error {
+		return &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+	if len(n.types) > 0 && !hasType(v, n.types) {
+		return fail("is not of type %s", strings.Join(n.types, " or "))
+	}
+	if n.enum != nil && !contains(n.enum, v) {
+		return fail("is not one of the enumerated values")
+	}
+	if n.hasConst && !reflect.DeepEqual(n.constValue, v) {
+		return fail("is not the constant value")
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range n.required {
+			if _, ok := v[name]; !ok {
+				return fail("misses the required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names) // report the same property first every time
+		for _, name := range names {
+			sub, ok := n.properties[name]
+			if !ok {
+				sub = n.additional
+			}
+			if sub == nil {
+				continue
+			}
+			if err := sub.validate(v[name], path+"/"+escape(name)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if n.minItems >= 0 && len(v) < n.minItems {
+			return fail("has fewer than %d items", n.minItems)
+		}
+		if n.maxItems >= 0 && len(v) > n.maxItems {
+			return fail("has more than %d items", n.maxItems)
+		}
+		if n.items != nil {
+			for i, e := range v {
+				if err := n.items.validate(e, path+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		l := utf8.RuneCountInString(v)
+		if n.minLength >= 0 && l < n.minLength {
+			return fail("is shorter than %d characters", n.minLength)
+		}
+		if n.maxLength >= 0 && l > n.maxLength {
+			return fail("is longer than %d characters", n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(v) {
+			return fail("does not match the pattern %q", n.pattern.String())
+		}
+	case float64:
+		switch {
+		case n.minimum != nil && v < *n.minimum:
+			return fail("is less than %v", *n.minimum)
+		case n.maximum != nil && v > *n.maximum:
+			return fail("is greater than %v", *n.maximum)
+		case n.exclusiveMinimum != nil && v <= *n.exclusiveMinimum:
+			return fail("is not greater than %v", *n.exclusiveMinimum)
+		case n.exclusiveMaximum != nil && v >= *n.exclusiveMaximum:
+			return fail("is not less than %v", *n.exclusiveMaximum)
+		}
+	}
+	for _, sub := range n.allOf {
+		if err := sub.validate(v, path); err != nil {
+			return err
+		}
+	}
+	if n.anyOf != nil {
+		matched := false
+		for _, sub := range n.anyOf {
+			if sub.validate(v, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fail("matches none of the schemas of anyOf")
+		}
+	}
+	if n.oneOf != nil {
+		matched := 0
+		for _, sub := range n.oneOf {
+			if sub.validate(v, path) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fail("matches %d of the schemas of oneOf instead of one", matched)
+		}
+	}
+	if n.not != nil && n.not.validate(v, path) == nil {
+		return fail("matches the schema of not")
+	}
+	return nil
+}
+
+func hasType(v interface{}, types []string) bool {
+	for _, t := range types {
+		switch v := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case float64:
+			if t == "number" || t == "integer" && v == math.Trunc(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(values []interface{}, v interface{}) bool {
+	for _, e := range values {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package schema
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	s, err := Compile([]byte(`{
+		"type": "object",
+		"required": ["host", "port"],
+		"properties": {
+			"host": {"type": "string", "minLength": 1, "pattern": "^[a-z0-9.-]+$"},
+			"port": {"type": "integer", "minimum": 1, "maximum": 65535},
+			"mode": {"enum": ["dev", "prod"]},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+			"tls": {"oneOf": [{"type": "boolean"}, {"type": "object", "required": ["cert"]}]}
+		},
+		"additionalProperties": false
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		value string
+		path  string // of the error, "-" if the value is valid
+	}{
+		{`{"host": "db", "port": 5432}`, "-"},
+		{`{"host": "db", "port": 5432, "mode": "prod", "tags": ["a"], "tls": {"cert": "c"}}`, "-"},
+		{`{"host": "db"}`, ""},
+		{`{"host": "DB", "port": 5432}`, "/host"},
+		{`{"host": "db", "port": 5432.5}`, "/port"},
+		{`{"host": "db", "port": 0}`, "/port"},
+		{`{"host": "db", "port": 1, "mode": "test"}`, "/mode"},
+		{`{"host": "db", "port": 1, "tags": ["a", 1]}`, "/tags/1"},
+		{`{"host": "db", "port": 1, "tags": ["a", "b", "c"]}`, "/tags"},
+		{`{"host": "db", "port": 1, "tls": {}}`, "/tls"},
+		{`{"host": "db", "port": 1, "other": true}`, "/other"},
+		{`[]`, ""},
+		{`not json`, ""},
+		{`{} {}`, ""},
+	} {
+		err := s.Validate([]byte(tt.value))
+		var verr *ValidationError
+		switch {
+		case tt.path == "-" && err != nil:
+			t.Errorf("%s: expected the value to be valid, got %v", tt.value, err)
+		case tt.path != "-" && !errors.As(err, &verr):
+			t.Errorf("%s: expected a validation error, got %v", tt.value, err)
+		case tt.path != "-" && verr.Path != tt.path:
+			t.Errorf("%s: expected the error at %q, got %v", tt.value, tt.path, err)
+		}
+	}
+}
+
+func TestCompileInvalid(t *testing.T) {
+	for _, s := range []string{`{`, `"string"`, `{"type": "text"}`, `{"pattern": "("}`, `{"minLength": -1}`, `{"anyOf": []}`, `{"properties": {"a": 1}}`} {
+		if _, err := Compile([]byte(s)); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected an invalid schema, got %v", s, err)
+		}
+	}
+	if _, err := Compile([]byte(`true`)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// httpServerConfig is the tuning of the HTTP servers of the client API and
+// the debug endpoints, from the --http-* flags.
+type httpServerConfig struct {
+	// ReadHeaderTimeout bounds reading the headers of a request, so clients
+	// sending them slowly cannot hold connections; ReadTimeout and
+	// WriteTimeout bound the whole request and response, 0 leaves them
+	// unbounded for imports and streamed watches.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	// IdleTimeout closes keep-alive connections without requests for that
+	// long, KeepAlive is the period of the TCP keep-alive probes.
+	IdleTimeout time.Duration
+	KeepAlive   time.Duration
+	// MaxHeaderBytes limits the size of the headers of a request.
+	MaxHeaderBytes int
+	// MaxConnections is the number of connections served at once, the
+	// next ones wait to be accepted; 0 does not limit them.
+	MaxConnections int
+	// CertFile and KeyFile serve HTTPS, negotiating HTTP/2 unless
+	// DisableHTTP2 is set. Plain HTTP is served as HTTP/1.1.
+	CertFile, KeyFile string
+	DisableHTTP2      bool
+}
+
+// defaultHTTPServerConfig is the tuning of the servers without flags.
+var defaultHTTPServerConfig = httpServerConfig{
+	ReadHeaderTimeout: 10 * time.Second,
+	IdleTimeout:       2 * time.Minute,
+	KeepAlive:         3 * time.Minute,
+	MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+}
+
+// server returns an http.Server serving handler with the tuning of c.
+func (c httpServerConfig) server(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+	if c.DisableHTTP2 {
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return srv
+}
+
+// listen listens on addr, accepting up to c.MaxConnections connections at
+// once.
+func (c httpServerConfig) listen(addr string) (net.Listener, error) {
+	ln, err := (&net.ListenConfig{KeepAlive: c.KeepAlive}).Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.limit(ln), nil
+}
+
+// limit makes ln accept up to c.MaxConnections connections at once.
+func (c httpServerConfig) limit(ln net.Listener) net.Listener {
+	if c.MaxConnections > 0 {
+		ln = &limitListener{Listener: ln, sem: make(chan struct{}, c.MaxConnections)}
+	}
+	return ln
+}
+
+// serve serves srv on ln, with TLS if c has a certificate.
+func (c httpServerConfig) serve(srv *http.Server, ln net.Listener) error {
+	if c.CertFile != "" || c.KeyFile != "" {
+		return srv.ServeTLS(ln, c.CertFile, c.KeyFile)
+	}
+	return srv.Serve(ln)
+}
+
+// limitListener accepts a connection only while fewer than cap(sem) of the
+// connections it accepted are open.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.sem <- struct{}{}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"metcd/api"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrShardMoved    = errors.New("metcd: the keys are moving or moved to another raft group")
+	ErrShardNotFound = errors.New("metcd: shard not found")
+	ErrShardsChanged = errors.New("metcd: the shard placement changed concurrently")
+	ErrInvalidShards = errors.New("metcd: invalid shard placement")
+)
+
+// keyRange is the range of keys from Start up to End, to the last key if
+// End is empty.
+type keyRange struct {
+	Start string `json:"start"`
+	End   string `json:"end,omitempty"`
+}
+
+func (kr keyRange) contains(k string) bool {
+	return k >= kr.Start && (kr.End == "" || k < kr.End)
+}
+
+// endBefore reports whether the end a comes before the end b, an empty end
+// being after every key.
+func endBefore(a, b string) bool {
+	return a != "" && (b == "" || a < b)
+}
+
+// prefixRange returns the range of the keys with prefix.
+func prefixRange(prefix string) keyRange {
+	end := string(prefixEnd([]byte(prefix)))
+	if end == "\x00" {
+		end = ""
+	}
+	return keyRange{prefix, end}
+}
+
+func (kr keyRange) overlaps(o keyRange) bool {
+	return (kr.End == "" || o.Start < kr.End) && (o.End == "" || kr.Start < o.End)
+}
+
+// addRange returns the ranges of rs and kr, sorted and merged.
+func addRange(rs []keyRange, kr keyRange) []keyRange {
+	all := append(append([]keyRange{}, rs...), kr)
+	sort.Slice(all, func(i, j int) bool { return all[i].Start < all[j].Start })
+	merged := all[:1]
+	for _, r := range all[1:] {
+		last := &merged[len(merged)-1]
+		if last.End != "" && r.Start > last.End {
+			merged = append(merged, r)
+		} else if endBefore(last.End, r.End) {
+			last.End = r.End
+		}
+	}
+	return merged
+}
+
+// subRange returns the ranges of rs without the keys of kr.
+func subRange(rs []keyRange, kr keyRange) []keyRange {
+	var left []keyRange
+	for _, r := range rs {
+		if !r.overlaps(kr) {
+			left = append(left, r)
+			continue
+		}
+		if r.Start < kr.Start {
+			left = append(left, keyRange{r.Start, kr.Start})
+		}
+		if endBefore(kr.End, r.End) {
+			left = append(left, keyRange{kr.End, r.End})
+		}
+	}
+	return left
+}
+
+// placement maps the keys of the default keyspace to the raft groups
+// serving them, and fences the ranges whose writes a group refuses because
+// they moved away from it. The placement is replicated by the default
+// group; every group keeps its own fences.
+type placement struct {
+	shards  []api.Shard // sorted by Start, none until the first change
+	version int64       // number of changes of shards
+	fences  []keyRange
+}
+
+// defaultShards is the placement before any change: every key in the
+// default group.
+var defaultShards = []api.Shard{{ID: 1}}
+
+// apply applies opShards, opFence or opUnfence. It must be called with
+// s.mu held.
+func (p *placement) apply(r kv) error {
+	switch r.Op {
+	case opFence:
+		p.fences = addRange(p.fences, keyRange{r.Key, r.RangeEnd})
+	case opUnfence:
+		p.fences = subRange(p.fences, keyRange{r.Key, r.RangeEnd})
+	case opShards:
+		if r.Rev != p.version {
+			return ErrShardsChanged
+		}
+		if err := checkShards(r.Shards); err != nil {
+			return err
+		}
+		p.shards = r.Shards
+		p.version++
+	}
+	return nil
+}
+
+// checkShards checks that shards cover every key once, in order.
+func checkShards(shards []api.Shard) error {
+	ids := make(map[uint64]bool)
+	for i, sh := range shards {
+		switch {
+		case sh.ID == 0 || ids[sh.ID]:
+			return fmt.Errorf("%w: duplicate shard %d", ErrInvalidShards, sh.ID)
+		case i == 0 && sh.Start != "":
+			return fmt.Errorf("%w: the first shard starts at %q", ErrInvalidShards, sh.Start)
+		case i > 0 && sh.Start != shards[i-1].End:
+			return fmt.Errorf("%w: shard %d does not start where shard %d ends", ErrInvalidShards, sh.ID, shards[i-1].ID)
+		case i < len(shards)-1 && sh.End <= sh.Start:
+			return fmt.Errorf("%w: shard %d is empty", ErrInvalidShards, sh.ID)
+		case i == len(shards)-1 && sh.End != "":
+			return fmt.Errorf("%w: the last shard ends at %q", ErrInvalidShards, sh.End)
+		}
+		ids[sh.ID] = true
+	}
+	if len(shards) == 0 {
+		return fmt.Errorf("%w: no shard", ErrInvalidShards)
+	}
+	return nil
+}
+
+// fenced reports whether r writes a key of a fenced range. The deletion of
+// the keys of a shard that moved away is not. It must be called with s.mu
+// held.
+func (p *placement) fenced(r kv) bool {
+	if len(p.fences) == 0 {
+		return false
+	}
+	in := func(k string) bool {
+		for _, f := range p.fences {
+			if f.contains(k) {
+				return true
+			}
+		}
+		return false
+	}
+	switch r.Op {
+	case opPut, opDelete, opUndelete, opAppend, opPatch:
+		return in(r.Key)
+	case opMove:
+		if !r.MovePrefix {
+			return in(r.Key) || in(r.MoveTo)
+		}
+		for _, f := range p.fences {
+			if f.overlaps(prefixRange(r.Key)) || f.overlaps(prefixRange(r.MoveTo)) {
+				return true
+			}
+		}
+	case opDeleteRange:
+		if r.Reason == deleteMoved {
+			return false
+		}
+		end := r.RangeEnd
+		if end == "" {
+			return in(r.Key)
+		} else if end == "\x00" {
+			end = ""
+		}
+		kr := keyRange{r.Key, end}
+		if kr.Start == "\x00" {
+			kr.Start = ""
+		}
+		for _, f := range p.fences {
+			if f.overlaps(kr) {
+				return true
+			}
+		}
+	case opTxn:
+		for _, ops := range [][]api.Op{r.Txn.Success, r.Txn.Failure} {
+			for _, op := range ops {
+				if op.Type != api.OpGet && in(op.Key) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (p *placement) restore(shards []api.Shard, version int64, fences []keyRange) {
+	p.shards, p.version, p.fences = shards, version, fences
+}
+
+// Shards returns the placement of the default keyspace and its version.
+func (s *kvstore) Shards() ([]api.Shard, int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	shards := s.placement.shards
+	if len(shards) == 0 {
+		shards = defaultShards
+	}
+	return append([]api.Shard{}, shards...), s.placement.version
+}
+
+// ShardFor returns the shard of key.
+func (s *kvstore) ShardFor(key string) api.Shard {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	shards := s.placement.shards
+	if len(shards) == 0 {
+		return defaultShards[0]
+	}
+	i := sort.Search(len(shards), func(i int) bool { return shards[i].Start > key })
+	return shards[i-1]
+}
+
+// PutShards replaces the placement at version with shards.
+func (s *kvstore) PutShards(ctx context.Context, shards []api.Shard, version int64) error {
+	res, err := s.propose(ctx, kv{Op: opShards, Shards: shards, Rev: version})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// Fence makes the store refuse the writes to the keys of kr, or allow them
+// again if fence is false.
+func (s *kvstore) Fence(ctx context.Context, kr keyRange, fence bool) error {
+	op := opFence
+	if !fence {
+		op = opUnfence
+	}
+	res, err := s.propose(ctx, kv{Op: op, Key: kr.Start, RangeEnd: kr.End})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// shardRouter routes the requests for the keys of the default keyspace to
+// the raft groups of their shards.
+type shardRouter struct {
+	def    *raftGroup
+	groups *groupManager
+
+	mu       sync.Mutex
+	requests map[uint64]uint64 // requests routed by shard
+	moving   sync.Mutex        // serializes the placement changes of the member
+}
+
+func newShardRouter(def *raftGroup, groups *groupManager) *shardRouter {
+	return &shardRouter{def: def, groups: groups, requests: make(map[uint64]uint64)}
+}
+
+// route returns the raft group serving r, the default one unless r is a
+// /kv or /v1/kv request for a key of the default keyspace. It answers the
+// writes to a moving shard itself and returns false.
+func (sr *shardRouter) route(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Header.Get(keyspaceHeader) != "" {
+		return "", true
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/kv/")
+	if !ok {
+		if key, ok = strings.CutPrefix(r.URL.Path, "/v1/kv/"); !ok {
+			return "", true
+		}
+	}
+	key = "/" + key
+	sh := sr.def.store.ShardFor(key)
+	sr.mu.Lock()
+	sr.requests[sh.ID]++
+	sr.mu.Unlock()
+	if sh.MovingTo != "" && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Shard is moving", http.StatusServiceUnavailable)
+		return "", false
+	}
+	return sh.Group, true
+}
+
+// store returns the store of the raft group called name.
+func (sr *shardRouter) store(name string) (*kvstore, error) {
+	if name == "" {
+		return sr.def.store, nil
+	}
+	g, err := sr.groups.group(name)
+	if err != nil {
+		return nil, err
+	}
+	return g.store, nil
+}
+
+// split splits shard id at key, the new shard from key on staying in the
+// same group.
+func (sr *shardRouter) split(ctx context.Context, id uint64, key string) ([]api.Shard, error) {
+	sr.moving.Lock()
+	defer sr.moving.Unlock()
+	shards, version := sr.def.store.Shards()
+	next := uint64(0)
+	for _, sh := range shards {
+		if sh.ID > next {
+			next = sh.ID
+		}
+	}
+	for i, sh := range shards {
+		if sh.ID != id {
+			continue
+		}
+		if sh.MovingTo != "" {
+			return nil, ErrShardMoved
+		}
+		if key <= sh.Start || !endBefore(key, sh.End) {
+			return nil, fmt.Errorf("%w: %q is not inside shard %d", ErrInvalidShards, key, id)
+		}
+		upper := sh
+		upper.ID, upper.Start = next+1, key
+		shards[i].End = key
+		shards = append(shards[:i+1], append([]api.Shard{upper}, shards[i+1:]...)...)
+		if err := sr.def.store.PutShards(ctx, shards, version); err != nil {
+			return nil, err
+		}
+		return shards, nil
+	}
+	return nil, ErrShardNotFound
+}
+
+// move migrates shard id to the raft group dst: the shard is marked as
+// moving, which makes the routers refuse its writes; the source group
+// fences its keys, so no write routed before is applied after the copy;
+// the destination group drops the keys it may still have in the range and
+// gets a copy of those of the source, new revisions and all; then the
+// placement is cut over to dst and the source group drops its copy. The
+// fence stays, writes routed by a stale placement fail instead of being
+// lost. A move that failed midway is resumed by moving the shard to the
+// same group again.
+func (sr *shardRouter) move(ctx context.Context, id uint64, dst string) (api.Shard, error) {
+	sr.moving.Lock()
+	defer sr.moving.Unlock()
+	shards, version := sr.def.store.Shards()
+	var sh *api.Shard
+	for i := range shards {
+		if shards[i].ID == id {
+			sh = &shards[i]
+		}
+	}
+	if sh == nil {
+		return api.Shard{}, ErrShardNotFound
+	}
+	if sh.Group == dst {
+		return *sh, nil
+	}
+	if sh.MovingTo != "" && sh.MovingTo != dst {
+		return api.Shard{}, fmt.Errorf("%w: shard %d is moving to %q", ErrShardMoved, id, sh.MovingTo)
+	}
+	src, err := sr.store(sh.Group)
+	if err != nil {
+		return api.Shard{}, err
+	}
+	to, err := sr.store(dst)
+	if err != nil {
+		return api.Shard{}, err
+	}
+	if sh.MovingTo == "" {
+		sh.MovingTo = dst
+		if err := sr.def.store.PutShards(ctx, shards, version); err != nil {
+			return api.Shard{}, err
+		}
+		version++
+	}
+	kr := keyRange{sh.Start, sh.End}
+	if err := src.Fence(ctx, kr, true); err != nil {
+		return api.Shard{}, fmt.Errorf("fencing the source: %w", err)
+	}
+	if err := to.Fence(ctx, kr, false); err != nil {
+		return api.Shard{}, fmt.Errorf("unfencing the destination: %w", err)
+	}
+	end := kr.End
+	if end == "" {
+		end = "\x00"
+	}
+	moved := withDeleteReason(ctx, deleteMoved)
+	if _, _, err := to.DeleteRange(moved, kr.Start, end); err != nil {
+		return api.Shard{}, fmt.Errorf("clearing the destination: %w", err)
+	}
+	// the fence is applied, so this member's copy of the source has every
+	// write of the shard
+	kvs, _, _, err := src.RangeIn("", kr.Start, end, 0)
+	if err != nil {
+		return api.Shard{}, err
+	}
+	err = importBatches(func() (api.KeyValue, error) {
+		if len(kvs) == 0 {
+			return api.KeyValue{}, io.EOF
+		}
+		kv := kvs[0]
+		kvs = kvs[1:]
+		return *kv, nil
+	}, func(ops []api.Op, size int) error {
+		_, err := to.Txn(ctx, &api.TxnRequest{Success: ops})
+		return err
+	})
+	if err != nil {
+		return api.Shard{}, fmt.Errorf("copying the keys: %w", err)
+	}
+	sh.Group, sh.MovingTo = dst, ""
+	if err := sr.def.store.PutShards(ctx, shards, version); err != nil {
+		return api.Shard{}, err
+	}
+	if _, _, err := src.DeleteRange(moved, kr.Start, end); err != nil {
+		log.Printf("Failed to delete the keys of shard %d from its former group (%v)\n", id, err)
+	}
+	return *sh, nil
+}
+
+// serveShards handles GET /admin/shards, listing the placement with the
+// requests this member routed to each shard, POST
+// /admin/shards/<id>/split with an api.ShardSplit and POST
+// /admin/shards/<id>/move with an api.ShardMove.
+func (sr *shardRouter) serveShards(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/shards"), "/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		shards, _ := sr.def.store.Shards()
+		sr.mu.Lock()
+		for i := range shards {
+			shards[i].Requests = sr.requests[shards[i].ID]
+		}
+		sr.mu.Unlock()
+		writeJSON(w, shards)
+		return
+	}
+	idStr, action, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil || (action != "split" && action != "move") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var res interface{}
+	switch action {
+	case "split":
+		var req api.ShardSplit
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed on POST", http.StatusBadRequest)
+			return
+		}
+		res, err = sr.split(r.Context(), id, req.Key)
+	case "move":
+		var req api.ShardMove
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed on POST", http.StatusBadRequest)
+			return
+		}
+		res, err = sr.move(r.Context(), id, req.Group)
+	}
+	switch {
+	case errors.Is(err, ErrShardNotFound), errors.Is(err, ErrGroupNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvalidShards):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrShardsChanged), errors.Is(err, ErrShardMoved):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		log.Printf("Failed to %s shard %d (%v)\n", action, id, err)
+		http.Error(w, "Failed on POST", http.StatusInternalServerError)
+	default:
+		writeJSON(w, res)
+	}
+}
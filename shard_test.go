@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"metcd/api"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKeyRanges(t *testing.T) {
+	rs := addRange(nil, keyRange{"/b", "/c"})
+	rs = addRange(rs, keyRange{"/e", ""})
+	rs = addRange(rs, keyRange{"/a", "/b"})
+	if want := []keyRange{{"/a", "/c"}, {"/e", ""}}; !reflect.DeepEqual(rs, want) {
+		t.Fatalf("expected %v, got %v", want, rs)
+	}
+	rs = subRange(rs, keyRange{"/b", "/f"})
+	if want := []keyRange{{"/a", "/b"}, {"/f", ""}}; !reflect.DeepEqual(rs, want) {
+		t.Fatalf("expected %v, got %v", want, rs)
+	}
+	if rs = subRange(rs, keyRange{"", ""}); len(rs) != 0 {
+		t.Fatalf("expected no range left, got %v", rs)
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	s := newTestKVStore(nil)
+	if sh := s.ShardFor("/k"); sh.ID != 1 || sh.Group != "" {
+		t.Fatalf("expected the default shard, got %+v", sh)
+	}
+	shards := []api.Shard{{ID: 1, End: "/m"}, {ID: 2, Start: "/m", Group: "a"}}
+	for _, c := range []struct {
+		shards []api.Shard
+		rev    int64
+		err    error
+	}{
+		{[]api.Shard{{ID: 1, End: "/m"}}, 0, ErrInvalidShards},
+		{[]api.Shard{{ID: 1, End: "/m"}, {ID: 1, Start: "/m"}}, 0, ErrInvalidShards},
+		{[]api.Shard{{ID: 1, End: "/m"}, {ID: 2, Start: "/n"}}, 0, ErrInvalidShards},
+		{shards, 0, nil},
+		{shards, 0, ErrShardsChanged},
+	} {
+		if res := s.apply(kv{Op: opShards, Shards: c.shards, Rev: c.rev}); !errors.Is(res.err, c.err) {
+			t.Fatalf("%+v: expected %v, got %v", c.shards, c.err, res.err)
+		}
+	}
+	if sh := s.ShardFor("/z"); sh.ID != 2 || sh.Group != "a" {
+		t.Fatalf("expected shard 2 in a, got %+v", sh)
+	}
+	if sh := s.ShardFor("/a"); sh.ID != 1 {
+		t.Fatalf("expected shard 1, got %+v", sh)
+	}
+
+	s.apply(kv{Op: opPut, Key: "/z", Val: "v"})
+	s.apply(kv{Op: opFence, Key: "/m"})
+	if res := s.apply(kv{Op: opPut, Key: "/z", Val: "w"}); res.err != ErrShardMoved {
+		t.Fatalf("expected a fenced put to fail, got %v", res.err)
+	}
+	if res := s.apply(kv{Op: opDeleteRange, Key: "\x00", RangeEnd: "\x00"}); res.err != ErrShardMoved {
+		t.Fatalf("expected a fenced delete-range to fail, got %v", res.err)
+	}
+	if res := s.apply(kv{Op: opPut, Key: "/a", Val: "v"}); res.err != nil {
+		t.Fatalf("expected a put outside the fence to succeed, got %v", res.err)
+	}
+
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestKVStore(nil)
+	if err := r.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if got, version := r.Shards(); !reflect.DeepEqual(got, shards) || version != 1 {
+		t.Fatalf("expected %+v at version 1, got %+v at %d", shards, got, version)
+	}
+	if res := r.apply(kv{Op: opPut, Key: "/z", Val: "w"}); res.err != ErrShardMoved {
+		t.Fatalf("expected the fence to be restored, got %v", res.err)
+	}
+	if res := r.apply(kv{Op: opDeleteRange, Key: "/m", RangeEnd: "\x00", Reason: deleteMoved}); res.err != nil {
+		t.Fatalf("expected the moved keys to be deleted, got %v", res.err)
+	}
+	if _, ok := r.Lookup("/z"); ok {
+		t.Fatal("expected /z to be deleted")
+	}
+	r.apply(kv{Op: opUnfence, Key: "", RangeEnd: ""})
+	if res := r.apply(kv{Op: opPut, Key: "/z", Val: "w"}); res.err != nil {
+		t.Fatalf("expected the unfenced put to succeed, got %v", res.err)
+	}
+}
+
+func TestRouteShards(t *testing.T) {
+	def := newTestKVStore(nil)
+	def.apply(kv{Op: opPut, Key: "/k", Val: "default"})
+	def.apply(kv{Op: opShards, Shards: []api.Shard{{ID: 1, End: "/m"}, {ID: 2, Start: "/m", Group: "a", MovingTo: "b"}}})
+	a := newTestKVStore(nil)
+	a.apply(kv{Op: opPut, Key: "/z", Val: "in a"})
+	m := &groupManager{groups: map[string]*raftGroup{
+		"a": {name: "a", store: a, handler: newHTTPHandler(&httpKVAPI{store: a, requests: newRequestTracker()})},
+	}, names: []string{"a"}}
+	srv := httptest.NewServer(routeGroups(&raftGroup{store: def, handler: newHTTPHandler(&httpKVAPI{store: def, requests: newRequestTracker()})}, m))
+	defer srv.Close()
+
+	for path, want := range map[string]string{"/kv/k": "default", "/kv/z": "in a"} {
+		resp, err := http.Get(srv.URL + path + "?serializable=true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != want {
+			t.Fatalf("%s: expected %q, got %d %q", path, want, resp.StatusCode, b)
+		}
+	}
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/kv/z", strings.NewReader("w"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected a write to the moving shard to be refused, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"metcd/api"
+	"metcd/sink"
+	"sync"
+	"time"
+)
+
+var (
+	// sinkRetryInterval is how often the leader starts writing the
+	// keyspaces it does not write yet, and restarts after failed writes.
+	sinkRetryInterval = time.Second
+	// sinkFlushDelay is how long the changes of a revision are collected
+	// once no more arrive before they are written.
+	sinkFlushDelay = 10 * time.Millisecond
+	// sinkCheckpointInterval is the default of --sink-checkpoint-interval.
+	sinkCheckpointInterval = time.Second
+)
+
+// sinkWriter writes the changes applied to every keyspace to a sink while
+// this member leads, from the replicated checkpoint of the keyspace on. A
+// new leader writes again the changes after the last checkpoint.
+type sinkWriter struct {
+	s          *kvstore
+	sink       sink.Sink
+	isLeader   func() bool
+	checkpoint time.Duration
+
+	mu      sync.Mutex
+	writing map[string]bool // the keyspaces being written
+
+	stopc chan struct{}
+	donec chan struct{}
+}
+
+func newSinkWriter(s *kvstore, sk sink.Sink, isLeader func() bool, checkpoint time.Duration) *sinkWriter {
+	return &sinkWriter{
+		s:          s,
+		sink:       sk,
+		isLeader:   isLeader,
+		checkpoint: checkpoint,
+		writing:    make(map[string]bool),
+		stopc:      make(chan struct{}),
+		donec:      make(chan struct{}),
+	}
+}
+
+func (w *sinkWriter) Run() {
+	go func() {
+		defer close(w.donec)
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		t := time.NewTicker(sinkRetryInterval)
+		defer t.Stop()
+		for {
+			if w.isLeader() {
+				for _, ks := range w.s.Keyspaces() {
+					w.mu.Lock()
+					ok := w.writing[ks.Name]
+					w.writing[ks.Name] = true
+					w.mu.Unlock()
+					if !ok {
+						wg.Add(1)
+						go func(name string) {
+							defer wg.Done()
+							w.write(name)
+						}(ks.Name)
+					}
+				}
+			}
+			select {
+			case <-t.C:
+			case <-w.stopc:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops writing and closes the sink.
+func (w *sinkWriter) Stop() {
+	close(w.stopc)
+	<-w.donec
+	if err := w.sink.Close(); err != nil {
+		log.Printf("Failed to close the sink (%v)\n", err)
+	}
+}
+
+// write writes the changes of the keyspace called name until this member
+// no longer leads, a write fails or the keyspace is deleted.
+func (w *sinkWriter) write(name string) {
+	defer func() {
+		w.mu.Lock()
+		delete(w.writing, name)
+		w.mu.Unlock()
+	}()
+	checkpoint, err := w.s.SinkRevIn(name)
+	if err != nil {
+		return
+	}
+	rev := checkpoint
+	events, cancel, err := w.s.WatchIn(name, "", watchOptions{prefix: true, since: rev})
+	var compacted *compactedError
+	if errors.As(err, &compacted) {
+		// the changes since the checkpoint are gone, start from the keys
+		if rev, err = w.reset(name); err == nil {
+			events, cancel, err = w.s.WatchIn(name, "", watchOptions{prefix: true, since: rev})
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to write keyspace %q to the sink (%v)\n", name, err)
+		return
+	}
+	defer cancel()
+
+	var (
+		batch     = sink.Batch{Keyspace: name}
+		written   = rev // the changes up to written are in the sink
+		committed = checkpoint
+		flush     = time.NewTimer(sinkFlushDelay)
+		ticker    = time.NewTicker(w.checkpoint)
+	)
+	flush.Stop()
+	defer ticker.Stop()
+	// send writes the batch; with complete unset more changes of its
+	// revision may follow.
+	send := func(complete bool) bool {
+		if len(batch.Events) == 0 {
+			return true
+		}
+		if err := w.sink.Write(context.Background(), batch); err != nil {
+			log.Printf("Failed to write revision %d of keyspace %q to the sink (%v)\n", batch.Rev, name, err)
+			return false
+		}
+		written = batch.Rev
+		if !complete {
+			written--
+		}
+		batch.Events = nil
+		return true
+	}
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				if !send(false) || !w.deleted(name) {
+					return
+				}
+				if err := w.sink.Write(context.Background(), sink.Batch{Keyspace: name, Rev: written, Reset: true}); err != nil {
+					log.Printf("Failed to remove deleted keyspace %q from the sink (%v)\n", name, err)
+				}
+				return
+			}
+			if ev.ModRevision != batch.Rev && !send(true) {
+				return
+			}
+			batch.Rev = ev.ModRevision
+			batch.Events = append(batch.Events, ev)
+			flush.Reset(sinkFlushDelay)
+		case <-flush.C:
+			if !send(false) {
+				return
+			}
+		case <-ticker.C:
+			if !w.isLeader() {
+				return
+			}
+			if written > committed {
+				ctx, cancel := context.WithTimeout(context.Background(), w.checkpoint)
+				err := w.s.SinkCheckpoint(ctx, name, written)
+				cancel()
+				if err != nil {
+					log.Printf("Failed to checkpoint keyspace %q at revision %d (%v)\n", name, written, err)
+					continue
+				}
+				committed = written
+			}
+		case <-w.stopc:
+			return
+		}
+	}
+}
+
+// reset replaces the content of the keyspace called name in the sink with
+// its keys, and returns their revision.
+func (w *sinkWriter) reset(name string) (int64, error) {
+	kvs, rev, err := w.s.Export(name)
+	if err != nil {
+		return 0, err
+	}
+	b := sink.Batch{Keyspace: name, Rev: rev, Reset: true, Events: make([]api.Event, len(kvs))}
+	for i, kv := range kvs {
+		b.Events[i] = api.Event{Type: api.EventPut, Key: kv.Key, Value: kv.Value}
+	}
+	if err := w.sink.Write(context.Background(), b); err != nil {
+		return 0, err
+	}
+	log.Printf("sink: wrote the %d keys of keyspace %q at revision %d", len(kvs), name, rev)
+	return rev, nil
+}
+
+// deleted reports whether the keyspace called name no longer exists.
+func (w *sinkWriter) deleted(name string) bool {
+	_, err := w.s.RevIn(name)
+	return errors.Is(err, ErrKeyspaceNotFound)
+}
@@ -0,0 +1,43 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// fileSink appends the batches to a file, a JSON Batch per line.
+type fileSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenFile opens the sink "file:<path>", a log of batches appended to path
+// and fsynced one by one. Batches written again after a change of leader
+// are appended again: readers skip the changes of a keyspace at or below
+// the last revision they read.
+func OpenFile(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{f: f}, nil
+}
+
+func (s *fileSink) Write(ctx context.Context, b Batch) error {
+	line, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *fileSink) Close() error {
+	return s.f.Close()
+}
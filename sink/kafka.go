@@ -0,0 +1,394 @@
+package sink
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Kafka requests sent, in versions the brokers accept since Kafka 1.0.
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 4
+)
+
+// kafkaMaxBatchSize is the most records sent in one produce request, under
+// the default limit of the brokers.
+const kafkaMaxBatchSize = 512 << 10
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaErrors are the names of the errors a broker answers most.
+var kafkaErrors = map[int16]string{
+	2:  "corrupt message",
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader or follower",
+	7:  "request timed out",
+	10: "message too large",
+	19: "not enough replicas",
+	20: "not enough replicas after append",
+	29: "topic authorization failed",
+}
+
+func kafkaError(code int16) error {
+	if name, ok := kafkaErrors[code]; ok {
+		return fmt.Errorf("kafka error %d (%s)", code, name)
+	}
+	return fmt.Errorf("kafka error %d", code)
+}
+
+// kafkaSink produces every change as a JSON Change to a partition of a
+// Kafka topic.
+type kafkaSink struct {
+	brokers   []string
+	topic     string
+	partition int32
+	acks      int16
+
+	mu          sync.Mutex
+	conn        net.Conn // to the leader of the partition
+	correlation int32
+}
+
+// OpenKafka opens the sink "kafka://<broker>[,<broker>...]/<topic>", which
+// produces the changes to a partition of topic, one record per change with
+// the key as record key. Every change goes to the same partition,
+// ?partition=<n> (0), so that consumers see them in order. The replicas
+// in sync have the records of a batch when Write returns, or only the
+// leader with ?acks=1.
+func OpenKafka(target string) (Sink, error) {
+	u, err := url.Parse("kafka:" + target)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, errors.New("sink: want kafka://<broker>[,<broker>...]/<topic>")
+	}
+	s := &kafkaSink{topic: strings.Trim(u.Path, "/"), acks: -1}
+	for _, b := range strings.Split(u.Host, ",") {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			b = net.JoinHostPort(b, "9092")
+		}
+		s.brokers = append(s.brokers, b)
+	}
+	q := u.Query()
+	if v := q.Get("partition"); v != "" {
+		p, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || p < 0 {
+			return nil, fmt.Errorf("sink: invalid partition %q", v)
+		}
+		s.partition = int32(p)
+	}
+	switch v := q.Get("acks"); v {
+	case "", "all", "-1":
+	case "1":
+		s.acks = 1
+	default:
+		return nil, fmt.Errorf("sink: invalid acks %q, want all or 1", v)
+	}
+	return s, nil
+}
+
+// Write produces the changes of b, in as many requests as their size
+// takes. The leader of the partition is connected to on the first Write
+// and again after a failed one.
+func (s *kafkaSink) Write(ctx context.Context, b Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(ctx, b); err != nil {
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		return fmt.Errorf("sink: kafka: %v", err)
+	}
+	return nil
+}
+
+func (s *kafkaSink) write(ctx context.Context, b Batch) error {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+	var (
+		records []byte
+		n       int
+	)
+	for _, c := range changes(b) {
+		value, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		record := appendRecord(nil, n, []byte(c.Key), value)
+		if n > 0 && len(records)+len(record) > kafkaMaxBatchSize {
+			if err := s.produce(ctx, records, n); err != nil {
+				return err
+			}
+			records, n = nil, 0
+			record = appendRecord(nil, 0, []byte(c.Key), value)
+		}
+		records = append(records, record...)
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	return s.produce(ctx, records, n)
+}
+
+// dial connects to the leader of the partition, asking the brokers in turn
+// which one it is.
+func (s *kafkaSink) dial(ctx context.Context) error {
+	var err error
+	for _, broker := range s.brokers {
+		var leader string
+		if leader, err = s.leader(ctx, broker); err != nil {
+			continue
+		}
+		if leader != broker {
+			s.conn.Close()
+			d := net.Dialer{Timeout: BusTimeout}
+			if s.conn, err = d.DialContext(ctx, "tcp", leader); err != nil {
+				continue
+			}
+		}
+		return nil
+	}
+	s.conn = nil
+	return err
+}
+
+// leader connects to broker and returns the address of the leader of the
+// partition.
+func (s *kafkaSink) leader(ctx context.Context, broker string) (string, error) {
+	d := net.Dialer{Timeout: BusTimeout}
+	conn, err := d.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return "", err
+	}
+	s.conn = conn
+	req := binary.BigEndian.AppendUint32(nil, 1)
+	req = appendKafkaString(req, s.topic)
+	req = append(req, 0) // allow_auto_topic_creation
+	res, err := s.request(ctx, kafkaMetadata, kafkaMetadataVersion, req)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	r := &kafkaReader{b: res}
+	r.int32() // throttle_time_ms
+	brokers := make(map[int32]string)
+	for i := r.array(); i > 0; i-- {
+		id, host, port := r.int32(), r.string(), r.int32()
+		r.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.string() // cluster_id
+	r.int32()  // controller_id
+	leader := int32(-1)
+	for i := r.array(); i > 0; i-- {
+		code, name := r.int16(), r.string()
+		r.int8() // is_internal
+		for j := r.array(); j > 0; j-- {
+			pcode, index, id := r.int16(), r.int32(), r.int32()
+			r.skipArray(4) // replica_nodes
+			r.skipArray(4) // isr_nodes
+			if name != s.topic {
+				continue
+			}
+			if code != 0 {
+				err = kafkaError(code)
+			} else if index == s.partition {
+				if pcode != 0 {
+					err = kafkaError(pcode)
+				}
+				leader = id
+			}
+		}
+	}
+	if r.err != nil {
+		err = r.err
+	}
+	addr, ok := brokers[leader]
+	if err == nil && !ok {
+		err = kafkaError(3)
+	}
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	return addr, nil
+}
+
+// produce sends the n records to the partition and waits for the answer.
+func (s *kafkaSink) produce(ctx context.Context, records []byte, n int) error {
+	now := time.Now().UnixMilli()
+	batch := binary.BigEndian.AppendUint64(nil, 0)  // base_offset
+	batch = binary.BigEndian.AppendUint32(batch, 0) // batch_length
+	batch = appendInt32(batch, -1)                  // partition_leader_epoch
+	batch = append(batch, 2)                        // magic
+	batch = binary.BigEndian.AppendUint32(batch, 0) // crc
+	batch = binary.BigEndian.AppendUint16(batch, 0) // attributes
+	batch = appendInt32(batch, int32(n-1))          // last_offset_delta
+	batch = binary.BigEndian.AppendUint64(batch, uint64(now))
+	batch = binary.BigEndian.AppendUint64(batch, uint64(now))
+	batch = binary.BigEndian.AppendUint64(batch, ^uint64(0)) // producer_id
+	batch = binary.BigEndian.AppendUint16(batch, ^uint16(0)) // producer_epoch
+	batch = appendInt32(batch, -1)                           // base_sequence
+	batch = appendInt32(batch, int32(n))
+	batch = append(batch, records...)
+	binary.BigEndian.PutUint32(batch[8:], uint32(len(batch)-12))
+	binary.BigEndian.PutUint32(batch[17:], crc32.Checksum(batch[21:], castagnoli))
+
+	req := binary.BigEndian.AppendUint16(nil, ^uint16(0)) // transactional_id
+	req = binary.BigEndian.AppendUint16(req, uint16(s.acks))
+	req = appendInt32(req, int32(BusTimeout/time.Millisecond))
+	req = appendInt32(req, 1)
+	req = appendKafkaString(req, s.topic)
+	req = appendInt32(req, 1)
+	req = appendInt32(req, s.partition)
+	req = appendInt32(req, int32(len(batch)))
+	req = append(req, batch...)
+	res, err := s.request(ctx, kafkaProduce, kafkaProduceVersion, req)
+	if err != nil {
+		return err
+	}
+	r := &kafkaReader{b: res}
+	for i := r.array(); i > 0; i-- {
+		r.string() // name
+		for j := r.array(); j > 0; j-- {
+			r.int32() // index
+			if code := r.int16(); code != 0 && r.err == nil {
+				return kafkaError(code)
+			}
+			r.int64() // base_offset
+			r.int64() // log_append_time
+		}
+	}
+	return r.err
+}
+
+// request sends a request to the connected broker and returns the body of
+// its response.
+func (s *kafkaSink) request(ctx context.Context, key, version int16, body []byte) ([]byte, error) {
+	s.correlation++
+	req := make([]byte, 4, 4+14+len(body))
+	req = binary.BigEndian.AppendUint16(req, uint16(key))
+	req = binary.BigEndian.AppendUint16(req, uint16(version))
+	req = appendInt32(req, s.correlation)
+	req = appendKafkaString(req, "metcd") // client_id
+	req = append(req, body...)
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+	s.conn.SetDeadline(deadline(ctx))
+	if _, err := s.conn.Write(req); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(s.conn, size[:]); err != nil {
+		return nil, err
+	}
+	res := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(s.conn, res); err != nil {
+		return nil, err
+	}
+	if len(res) < 4 || int32(binary.BigEndian.Uint32(res)) != s.correlation {
+		return nil, errors.New("response out of order")
+	}
+	return res[4:], nil
+}
+
+func (s *kafkaSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// appendRecord appends the record of key and value at offset delta of its
+// batch, with a null key if key is empty.
+func appendRecord(b []byte, delta int, key, value []byte) []byte {
+	r := []byte{0}                // attributes
+	r = binary.AppendVarint(r, 0) // timestamp_delta
+	r = binary.AppendVarint(r, int64(delta))
+	if len(key) == 0 {
+		r = binary.AppendVarint(r, -1)
+	} else {
+		r = binary.AppendVarint(r, int64(len(key)))
+		r = append(r, key...)
+	}
+	r = binary.AppendVarint(r, int64(len(value)))
+	r = append(r, value...)
+	r = binary.AppendVarint(r, 0) // headers
+	b = binary.AppendVarint(b, int64(len(r)))
+	return append(b, r...)
+}
+
+func appendInt32(b []byte, v int32) []byte {
+	return binary.BigEndian.AppendUint32(b, uint32(v))
+}
+
+func appendKafkaString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+var errKafkaFormat = errors.New("malformed response")
+
+// kafkaReader decodes a response, keeping the first error.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = errKafkaFormat
+		return make([]byte, n)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.next(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+// string reads a string, "" if it is null.
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+// array reads the length of an array, 0 if it is null.
+func (r *kafkaReader) array() int {
+	n := r.int32()
+	if r.err != nil || n < 0 {
+		return 0
+	}
+	return int(n)
+}
+
+// skipArray skips an array of elements of size bytes.
+func (r *kafkaReader) skipArray(size int) {
+	r.next(r.array() * size)
+}
@@ -0,0 +1,164 @@
+package sink
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"metcd/api"
+)
+
+type kafkaRecord struct {
+	key    string
+	change Change
+}
+
+// fakeKafka is a broker leading partition 1 of topic changes. It sends the
+// records produced to it to records, and the number of produce requests to
+// requests.
+func fakeKafka(t *testing.T) (string, chan kafkaRecord, chan int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	records, requests := make(chan kafkaRecord, 100), make(chan int, 100)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			var size [4]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return
+			}
+			req := make([]byte, binary.BigEndian.Uint32(size[:]))
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+			r := &kafkaReader{b: req}
+			key, version, correlation := r.int16(), r.int16(), r.int32()
+			r.string() // client_id
+			res := appendInt32(nil, correlation)
+			switch {
+			case key == kafkaMetadata && version == kafkaMetadataVersion:
+				p, _ := strconv.Atoi(port)
+				res = appendInt32(res, 0)
+				res = appendInt32(res, 1)
+				res = appendInt32(res, 1)
+				res = appendKafkaString(res, host)
+				res = appendInt32(res, int32(p))
+				res = append(res, 0xff, 0xff) // rack
+				res = append(res, 0xff, 0xff) // cluster_id
+				res = appendInt32(res, 1)
+				res = appendInt32(res, 1)
+				res = append(res, 0, 0)
+				res = appendKafkaString(res, "changes")
+				res = append(res, 0)
+				res = appendInt32(res, 2)
+				for i := int32(0); i < 2; i++ {
+					res = append(res, 0, 0)
+					res = appendInt32(res, i)
+					res = appendInt32(res, i) // partition 1 is led by broker 1
+					res = appendInt32(res, 0)
+					res = appendInt32(res, 0)
+				}
+			case key == kafkaProduce && version == kafkaProduceVersion:
+				r.int16() // transactional_id
+				if acks := r.int16(); acks != -1 {
+					t.Errorf("expected acks from all the replicas, got %d", acks)
+				}
+				r.int32()
+				r.array()
+				r.string()
+				r.array()
+				partition := r.int32()
+				batch := r.next(int(r.int32()))
+				if r.err != nil || partition != 1 || batch[16] != 2 || binary.BigEndian.Uint32(batch[17:]) != crc32.Checksum(batch[21:], castagnoli) {
+					t.Errorf("expected a valid batch for partition 1, got %d %x", partition, batch)
+					return
+				}
+				br := &kafkaReader{b: batch[61:]}
+				for n := binary.BigEndian.Uint32(batch[57:]); n > 0; n-- {
+					varint := func() int64 {
+						v, n := binary.Varint(br.b)
+						br.b = br.b[n:]
+						return v
+					}
+					varint()  // length
+					br.int8() // attributes
+					varint()  // timestamp_delta
+					varint()  // offset_delta
+					var rec kafkaRecord
+					if n := varint(); n > 0 {
+						rec.key = string(br.next(int(n)))
+					}
+					json.Unmarshal(br.next(int(varint())), &rec.change)
+					varint() // headers
+					records <- rec
+				}
+				requests <- 1
+				res = appendInt32(res, 1)
+				res = appendKafkaString(res, "changes")
+				res = appendInt32(res, 1)
+				res = appendInt32(res, partition)
+				res = append(res, 0, 0)
+				res = binary.BigEndian.AppendUint64(res, 0)
+				res = binary.BigEndian.AppendUint64(res, 0)
+				res = appendInt32(res, 0)
+			default:
+				t.Errorf("unexpected request %d version %d", key, version)
+				return
+			}
+			conn.Write(append(appendInt32(nil, int32(len(res))), res...))
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String(), records, requests
+}
+
+func TestKafka(t *testing.T) {
+	addr, records, requests := fakeKafka(t)
+	// the first broker is down
+	s, err := Open("kafka://127.0.0.1:1," + addr + "/changes?partition=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	big := strings.Repeat("x", kafkaMaxBatchSize/2)
+	b := Batch{Rev: 7, Reset: true, Events: []api.Event{
+		{Type: api.EventPut, Key: "/a", Value: big},
+		{Type: api.EventPut, Key: "/b", Value: big},
+		{Type: api.EventPut, Key: "/c", Value: "3"},
+	}}
+	if err := s.Write(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range []string{"", "/a", "/b", "/c"} {
+		rec := <-records
+		if rec.key != key || rec.change.Rev != 7 || (i == 0) != (rec.change.Type == ChangeReset) || (key == "/c" && rec.change.Value != "3") {
+			t.Fatalf("expected the change of %q, got %q %+v", key, rec.key, rec.change.Type)
+		}
+	}
+	if n := len(requests); n != 2 {
+		t.Fatalf("expected the batch to be split in 2 requests, got %d", n)
+	}
+	for _, uri := range []string{"kafka://127.0.0.1", "kafka://127.0.0.1/changes?partition=-1", "kafka://127.0.0.1/changes?acks=0"} {
+		if _, err := Open(uri); err == nil {
+			t.Errorf("expected %q to fail", uri)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BusTimeout is how long the message bus sinks wait for their broker to
+// connect or to acknowledge a batch.
+var BusTimeout = 10 * time.Second
+
+// natsSink publishes every change as a JSON Change on a NATS subject.
+type natsSink struct {
+	addr    string
+	subject string
+	connect []byte // the CONNECT message, with the credentials of the URI
+	// jetStream waits for the acknowledgement of the stream of the subject
+	// of each message, not only for the server to have received them
+	jetStream bool
+
+	mu    sync.Mutex
+	conn  net.Conn
+	r     *bufio.Reader
+	inbox string
+}
+
+// OpenNATS opens the sink "nats://[user:password@]<host>[:port]/<subject>",
+// which publishes the changes to subject, one message per change. The
+// server has received the messages of a batch when Write returns; with
+// ?jetstream=true, a JetStream stream capturing subject has stored them.
+func OpenNATS(target string) (Sink, error) {
+	u, err := url.Parse("nats:" + target)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, errors.New("sink: want nats://<host>[:port]/<subject>")
+	}
+	s := &natsSink{addr: u.Host, subject: strings.Trim(u.Path, "/")}
+	if _, _, err := net.SplitHostPort(s.addr); err != nil {
+		s.addr = net.JoinHostPort(s.addr, "4222")
+	}
+	if s.jetStream, err = parseBool(u.Query().Get("jetstream")); err != nil {
+		return nil, fmt.Errorf("sink: invalid jetstream %q", u.Query().Get("jetstream"))
+	}
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "metcd", "lang": "go", "version": "metcd", "protocol": 1}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			opts["user"], opts["pass"] = u.User.Username(), pass
+		} else {
+			opts["auth_token"] = u.User.Username()
+		}
+	}
+	connect, _ := json.Marshal(opts)
+	s.connect = append(append([]byte("CONNECT "), connect...), "\r\n"...)
+	return s, nil
+}
+
+func parseBool(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// Write publishes the changes of b and waits for the server to have them.
+// The server is connected to on the first Write and again after a failed
+// one.
+func (s *natsSink) Write(ctx context.Context, b Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(ctx, b); err != nil {
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		return fmt.Errorf("sink: nats: %v", err)
+	}
+	return nil
+}
+
+func (s *natsSink) write(ctx context.Context, b Batch) error {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+	s.conn.SetDeadline(deadline(ctx))
+	var msgs []byte
+	cs := changes(b)
+	for i, c := range cs {
+		payload, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if s.jetStream {
+			msgs = fmt.Appendf(msgs, "PUB %s %s.%d %d\r\n", s.subject, s.inbox, i, len(payload))
+		} else {
+			msgs = fmt.Appendf(msgs, "PUB %s %d\r\n", s.subject, len(payload))
+		}
+		msgs = append(append(msgs, payload...), "\r\n"...)
+	}
+	if !s.jetStream {
+		// the server answers in order, the PONG follows the messages
+		msgs = append(msgs, "PING\r\n"...)
+	}
+	if _, err := s.conn.Write(msgs); err != nil {
+		return err
+	}
+	if !s.jetStream {
+		return s.waitPong()
+	}
+	for acked := 0; acked < len(cs); {
+		op, payload, err := s.next()
+		if err != nil {
+			return err
+		}
+		if op != "MSG" {
+			continue
+		}
+		var ack struct {
+			Error *struct {
+				Code        int    `json:"code"`
+				Description string `json:"description"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(payload, &ack); err != nil {
+			return fmt.Errorf("invalid JetStream acknowledgement %q", payload)
+		}
+		if ack.Error != nil {
+			return fmt.Errorf("JetStream error %d (%s)", ack.Error.Code, ack.Error.Description)
+		}
+		acked++
+	}
+	return nil
+}
+
+// dial connects to the server and subscribes to the acknowledgements.
+func (s *natsSink) dial(ctx context.Context) error {
+	d := net.Dialer{Timeout: BusTimeout}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline(ctx))
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	if line, err := s.r.ReadString('\n'); err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("%s is not a NATS server", s.addr)
+	}
+	msgs := append([]byte{}, s.connect...)
+	if s.jetStream {
+		var id [8]byte
+		rand.Read(id[:])
+		s.inbox = "_INBOX.metcd." + hex.EncodeToString(id[:])
+		msgs = fmt.Appendf(msgs, "SUB %s.* 1\r\n", s.inbox)
+	}
+	if _, err := conn.Write(append(msgs, "PING\r\n"...)); err != nil {
+		return err
+	}
+	return s.waitPong()
+}
+
+func (s *natsSink) waitPong() error {
+	for {
+		op, _, err := s.next()
+		if err != nil || op == "PONG" {
+			return err
+		}
+	}
+}
+
+// next reads the next message of the server, answering its PINGs, and
+// returns its operation and the payload of a MSG.
+func (s *natsSink) next() (string, []byte, error) {
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch op := strings.ToUpper(fields[0]); op {
+		case "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return "", nil, err
+			}
+		case "-ERR":
+			return "", nil, errors.New(strings.TrimSpace(strings.TrimPrefix(line, fields[0])))
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || len(fields) < 4 {
+				return "", nil, fmt.Errorf("invalid message %q", line)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(s.r, payload); err != nil {
+				return "", nil, err
+			}
+			return op, payload[:size], nil
+		default:
+			return op, nil, nil
+		}
+	}
+}
+
+func (s *natsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// deadline returns the deadline of ctx, at most BusTimeout from now.
+func deadline(ctx context.Context) time.Time {
+	d := time.Now().Add(BusTimeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(d) {
+		return dl
+	}
+	return d
+}
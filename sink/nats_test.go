@@ -0,0 +1,118 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"metcd/api"
+)
+
+// fakeNATS serves the NATS protocol on a local port and sends the payloads
+// published to published. JetStream fails the messages of the key /fail.
+func fakeNATS(t *testing.T) (string, chan Change) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	published := make(chan Change, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("INFO {\"server_id\":\"fake\"}\r\n"))
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					switch fields[0] {
+					case "PING":
+						conn.Write([]byte("PONG\r\n"))
+					case "PUB":
+						size, _ := strconv.Atoi(fields[len(fields)-1])
+						payload := make([]byte, size+2)
+						if _, err := io.ReadFull(r, payload); err != nil {
+							return
+						}
+						var c Change
+						json.Unmarshal(payload[:size], &c)
+						if len(fields) == 4 {
+							ack := `{"stream":"METCD","seq":1}`
+							if c.Key == "/fail" {
+								ack = `{"error":{"code":503,"description":"stream unavailable"}}`
+							} else {
+								published <- c
+							}
+							fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", fields[2], len(ack), ack)
+						} else {
+							published <- c
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), published
+}
+
+func TestNATS(t *testing.T) {
+	for _, jetStream := range []bool{false, true} {
+		addr, published := fakeNATS(t)
+		s, err := Open(fmt.Sprintf("nats://%s/metcd.changes?jetstream=%t", addr, jetStream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := Batch{Keyspace: "app", Rev: 3, Reset: true, Events: []api.Event{
+			{Type: api.EventPut, Key: "/a", Value: "1", CreateRevision: 2, ModRevision: 3, Version: 1},
+			{Type: api.EventPut, Key: "/b", Value: "2"},
+		}}
+		if err := s.Write(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+		want := []Change{
+			{Keyspace: "app", Rev: 3, Type: ChangeReset},
+			{Keyspace: "app", Rev: 3, Type: api.EventPut, Key: "/a", Value: "1", CreateRevision: 2, Version: 1},
+			{Keyspace: "app", Rev: 3, Type: api.EventPut, Key: "/b", Value: "2"},
+		}
+		for _, w := range want {
+			if c := <-published; !reflect.DeepEqual(c, w) {
+				t.Fatalf("expected %+v, got %+v", w, c)
+			}
+		}
+		if !jetStream {
+			s.Close()
+			continue
+		}
+		if err := s.Write(context.Background(), Batch{Rev: 4, Events: []api.Event{{Type: api.EventDelete, Key: "/fail"}}}); err == nil || !strings.Contains(err.Error(), "stream unavailable") {
+			t.Fatalf("expected the error of the stream, got %v", err)
+		}
+		// the next write connects again
+		if err := s.Write(context.Background(), Batch{Rev: 5, Events: []api.Event{{Type: api.EventDelete, Key: "/a"}}}); err != nil {
+			t.Fatal(err)
+		}
+		if c := <-published; c.Rev != 5 || c.Type != api.EventDelete {
+			t.Fatalf("expected the delete, got %+v", c)
+		}
+		s.Close()
+	}
+	for _, uri := range []string{"nats:", "nats://127.0.0.1", "nats://127.0.0.1/subject?jetstream=maybe"} {
+		if _, err := Open(uri); err == nil {
+			t.Errorf("expected %q to fail", uri)
+		}
+	}
+}
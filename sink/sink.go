@@ -0,0 +1,123 @@
+// Package sink writes the changes applied by metcd to an external
+// datastore, so that metcd can be the consensus front of a database it keeps
+// up to date, or publishes them to a message bus. Sinks are opened from a
+// URI, "<scheme>:<target>", by the opener registered for the scheme;
+// "file", "sql", "nats" and "kafka" are built in.
+package sink
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"metcd/api"
+)
+
+// Batch is the changes of one revision of a keyspace, "" is the default
+// one. With Reset, Events are puts of every key of the keyspace at Rev
+// and replace its content; an empty reset batch is a deleted keyspace.
+type Batch struct {
+	Keyspace string      `json:"keyspace,omitempty"`
+	Rev      int64       `json:"rev"`
+	Reset    bool        `json:"reset,omitempty"`
+	Events   []api.Event `json:"events,omitempty"`
+}
+
+// ChangeReset is the type of the change starting a reset batch in the
+// message bus sinks: the keys of the keyspace are replaced by the puts of
+// the same revision following it.
+const ChangeReset api.EventType = "RESET"
+
+// Change is a message of the message bus sinks, one change of a key. The
+// changes of a batch are published in order.
+type Change struct {
+	Keyspace       string        `json:"keyspace,omitempty"`
+	Rev            int64         `json:"rev"`
+	Type           api.EventType `json:"type"`
+	Key            string        `json:"key,omitempty"`
+	Value          string        `json:"value,omitempty"`
+	CreateRevision int64         `json:"createRevision,omitempty"`
+	Version        int64         `json:"version,omitempty"`
+}
+
+// changes returns the messages of b.
+func changes(b Batch) []Change {
+	var cs []Change
+	if b.Reset {
+		cs = append(cs, Change{Keyspace: b.Keyspace, Rev: b.Rev, Type: ChangeReset})
+	}
+	for _, ev := range b.Events {
+		cs = append(cs, Change{
+			Keyspace:       b.Keyspace,
+			Rev:            b.Rev,
+			Type:           ev.Type,
+			Key:            ev.Key,
+			Value:          ev.Value,
+			CreateRevision: ev.CreateRevision,
+			Version:        ev.Version,
+		})
+	}
+	return cs
+}
+
+// Sink is a datastore written by the leader, one batch at a time per
+// keyspace and in revision order. After a failed Write or a change of
+// leader the batches since the last replicated checkpoint are written
+// again, and a revision may be split across batches, so Write must be
+// idempotent: skip changes of a key older than those it has.
+type Sink interface {
+	Write(ctx context.Context, b Batch) error
+	Close() error
+}
+
+// Opener opens the sink of target, the URI without its scheme.
+type Opener func(target string) (Sink, error)
+
+var (
+	mu      sync.RWMutex
+	openers = make(map[string]Opener)
+)
+
+func init() {
+	Register("file", OpenFile)
+	Register("sql", OpenSQL)
+	Register("nats", OpenNATS)
+	Register("kafka", OpenKafka)
+}
+
+// Register makes the sinks of scheme available to Open. It panics if the
+// scheme is already registered.
+func Register(scheme string, open Opener) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := openers[scheme]; ok {
+		panic("sink: scheme " + scheme + " registered twice")
+	}
+	openers[scheme] = open
+}
+
+// Schemes returns the registered schemes, sorted.
+func Schemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	schemes := make([]string, 0, len(openers))
+	for s := range openers {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open opens the sink of uri, "<scheme>:<target>".
+func Open(uri string) (Sink, error) {
+	scheme, target, ok := strings.Cut(uri, ":")
+	mu.RLock()
+	open := openers[scheme]
+	mu.RUnlock()
+	if !ok || open == nil {
+		return nil, fmt.Errorf("sink: unknown sink %q, want one of %s followed by :<target>", uri, strings.Join(Schemes(), ", "))
+	}
+	return open(target)
+}
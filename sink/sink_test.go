@@ -0,0 +1,76 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"metcd/api"
+)
+
+func TestOpen(t *testing.T) {
+	if got := Schemes(); !reflect.DeepEqual(got, []string{"file", "kafka", "nats", "sql"}) {
+		t.Fatalf("expected the built-in schemes, got %v", got)
+	}
+	for _, uri := range []string{"", "file", "nosuch:target", "sql:", "sql:nosuchdriver:dsn"} {
+		if _, err := Open(uri); err == nil {
+			t.Errorf("expected %q to fail", uri)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a scheme twice to panic")
+		}
+	}()
+	Register("file", OpenFile)
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changes.ndjson")
+	s, err := Open("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := []Batch{
+		{Rev: 2, Events: []api.Event{{Type: api.EventPut, Key: "/a", Value: "1", ModRevision: 2}}},
+		{Keyspace: "app", Rev: 5, Reset: true},
+	}
+	for _, b := range batches {
+		if err := s.Write(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []Batch
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var b Batch
+		if err := json.Unmarshal(sc.Bytes(), &b); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b)
+	}
+	if !reflect.DeepEqual(got, batches) {
+		t.Fatalf("expected %+v, got %+v", batches, got)
+	}
+}
+
+func TestSQLPlaceholders(t *testing.T) {
+	if q := (&sqlSink{}).query("k = ? AND v = ?"); q != "k = ? AND v = ?" {
+		t.Fatalf("expected the query unchanged, got %q", q)
+	}
+	if q := (&sqlSink{dollar: true}).query("k = ? AND v = ?"); q != "k = $1 AND v = $2" {
+		t.Fatalf("expected numbered placeholders, got %q", q)
+	}
+}
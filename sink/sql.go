@@ -0,0 +1,121 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"metcd/api"
+)
+
+// SQLTable is the table written by the sql sinks, created if missing:
+//
+//	CREATE TABLE metcd_kv (keyspace VARCHAR(255) NOT NULL, k VARCHAR(512) NOT NULL,
+//		value TEXT NOT NULL, mod_revision BIGINT NOT NULL, PRIMARY KEY (keyspace, k))
+var SQLTable = "metcd_kv"
+
+// sqlSink keeps the current keys of every keyspace in SQLTable.
+type sqlSink struct {
+	db *sql.DB
+	// dollar drivers number their placeholders, $1, $2, ...
+	dollar bool
+}
+
+// OpenSQL opens the sink "sql:<driver>:<dsn>" with database/sql. The
+// driver must be linked into the binary, by a blank import of its package
+// next to the main package.
+func OpenSQL(target string) (Sink, error) {
+	driver, dsn, ok := strings.Cut(target, ":")
+	if !ok || driver == "" {
+		return nil, errors.New("sink: want sql:<driver>:<dsn>")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sink: %v (drivers: %s)", err, strings.Join(sql.Drivers(), ", "))
+	}
+	return NewSQL(db, driver == "postgres" || driver == "pgx")
+}
+
+// NewSQL returns the sink writing to db, whose driver numbers its
+// placeholders if dollar is set. It creates SQLTable if missing.
+func NewSQL(db *sql.DB, dollar bool) (Sink, error) {
+	s := &sqlSink{db: db, dollar: dollar}
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + SQLTable + " (keyspace VARCHAR(255) NOT NULL, k VARCHAR(512) NOT NULL, " +
+		"value TEXT NOT NULL, mod_revision BIGINT NOT NULL, PRIMARY KEY (keyspace, k))")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// query replaces the ? placeholders of q for the driver.
+func (s *sqlSink) query(q string) string {
+	if !s.dollar {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// Write applies b in one transaction; changes older than the revision of
+// their key in the table are skipped.
+func (s *sqlSink) Write(ctx context.Context, b Batch) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if b.Reset {
+		if _, err := tx.ExecContext(ctx, s.query("DELETE FROM "+SQLTable+" WHERE keyspace = ?"), b.Keyspace); err != nil {
+			return err
+		}
+	}
+	for _, ev := range b.Events {
+		if err := s.apply(ctx, tx, b, ev); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlSink) apply(ctx context.Context, tx *sql.Tx, b Batch, ev api.Event) error {
+	rev := ev.ModRevision
+	if rev == 0 {
+		rev = b.Rev
+	}
+	var stored int64
+	err := tx.QueryRowContext(ctx, s.query("SELECT mod_revision FROM "+SQLTable+" WHERE keyspace = ? AND k = ?"), b.Keyspace, ev.Key).Scan(&stored)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return err
+	case stored > rev:
+		return nil
+	default:
+		if _, err := tx.ExecContext(ctx, s.query("DELETE FROM "+SQLTable+" WHERE keyspace = ? AND k = ?"), b.Keyspace, ev.Key); err != nil {
+			return err
+		}
+	}
+	if ev.Type == api.EventDelete {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, s.query("INSERT INTO "+SQLTable+" (keyspace, k, value, mod_revision) VALUES (?, ?, ?, ?)"),
+		b.Keyspace, ev.Key, ev.Value, rev)
+	return err
+}
+
+func (s *sqlSink) Close() error {
+	return s.db.Close()
+}
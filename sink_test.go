@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"metcd/api"
+	"metcd/sink"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// chanSink hands the written batches to the test.
+type chanSink chan sink.Batch
+
+func (c chanSink) Write(ctx context.Context, b sink.Batch) error {
+	c <- b
+	return nil
+}
+
+func (c chanSink) Close() error { return nil }
+
+func (c chanSink) next(t *testing.T) sink.Batch {
+	t.Helper()
+	select {
+	case b := <-c:
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a batch")
+		return sink.Batch{}
+	}
+}
+
+func TestSinkWriter(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.apply(kv{Op: opPut, Key: "/a", Val: "1"})
+	s.apply(kv{Op: opTxn, Txn: &api.TxnRequest{Success: []api.Op{
+		{Type: api.OpPut, Key: "/b", Value: "2"},
+		{Type: api.OpDelete, Key: "/a"},
+	}}})
+	s.apply(kv{Op: opSinkCheckpoint, Rev: 1})
+	s.apply(kv{Op: opSinkCheckpoint, Rev: 0})
+	if rev, _ := s.SinkRevIn(""); rev != 1 {
+		t.Fatalf("expected the checkpoint at revision 1, got %d", rev)
+	}
+
+	c := make(chanSink, 8)
+	w := newSinkWriter(s, c, func() bool { return true }, time.Hour)
+	go w.write("")
+	b := c.next(t)
+	want := []api.Event{
+		{Type: api.EventPut, Key: "/b", Value: "2", CreateRevision: 2, ModRevision: 2, Version: 1},
+		{Type: api.EventDelete, Key: "/a", ModRevision: 2},
+	}
+	if b.Rev != 2 || b.Reset || !reflect.DeepEqual(b.Events, want) {
+		t.Fatalf("expected the changes after the checkpoint, got %+v", b)
+	}
+	s.apply(kv{Op: opPut, Key: "/c", Val: "3"})
+	if b := c.next(t); b.Rev != 3 || len(b.Events) != 1 || b.Events[0].Key != "/c" {
+		t.Fatalf("expected the put of /c, got %+v", b)
+	}
+	close(w.stopc)
+
+	// a checkpoint older than the history writes the whole keyspace
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if rev, _ := restored.SinkRevIn(""); rev != 1 {
+		t.Fatalf("expected the checkpoint in the snapshot, got %d", rev)
+	}
+	w = newSinkWriter(restored, c, func() bool { return true }, time.Hour)
+	go w.write("")
+	b = c.next(t)
+	if b.Rev != 3 || !b.Reset || len(b.Events) != 2 {
+		t.Fatalf("expected a reset to /b and /c at revision 3, got %+v", b)
+	}
+	close(w.stopc)
+}
+
+func TestSinkWriterKeyspace(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.apply(kv{Op: opKeyspacePut, Keyspace: "app"})
+	c := make(chanSink, 8)
+	w := newSinkWriter(s, c, func() bool { return true }, time.Hour)
+	w.Run()
+	defer w.Stop()
+
+	s.apply(kv{Op: opPut, Keyspace: "app", Key: "/x", Val: "y"})
+	if b := c.next(t); b.Keyspace != "app" || b.Rev != 1 || len(b.Events) != 1 {
+		t.Fatalf("expected the put of /x in app, got %+v", b)
+	}
+	s.apply(kv{Op: opKeyspaceDelete, Keyspace: "app"})
+	if b := c.next(t); b.Keyspace != "app" || !b.Reset || len(b.Events) != 0 {
+		t.Fatalf("expected app to be emptied, got %+v", b)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+)
+
+// stampProposal sets the Time of the proposal data, forwarded to this
+// member while it leads, to its clock, so the times of the changes come
+// from one clock as long as the leader does not change. Data that does not
+// decode is returned as is and fails on apply like before.
+func stampProposal(data []byte) []byte {
+	var r kv
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&r); err != nil {
+		return data
+	}
+	r.Time = time.Now()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// nextChangeTime returns the time of the change proposed at t applied after
+// the one at prev, both in Unix nanoseconds: t, or prev if t is before it,
+// a new leader's clock being behind, or unknown. The times of a keyspace
+// never go back, and every member derives the same one.
+func nextChangeTime(prev int64, t time.Time) int64 {
+	if t.IsZero() {
+		return prev
+	}
+	if n := t.UnixNano(); n > prev {
+		return n
+	}
+	return prev
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+)
+
+func TestChangeTimes(t *testing.T) {
+	s := newTestKVStore(nil)
+	t0 := time.Date(2026, 10, 14, 9, 30, 0, 0, time.UTC)
+	s.apply(kv{Op: opPut, Key: "/a", Val: "1", Time: t0})
+	// a new leader whose clock is behind, and a proposal older than times
+	s.apply(kv{Op: opPut, Key: "/b", Val: "2", Time: t0.Add(-time.Minute)})
+	s.apply(kv{Op: opPut, Key: "/c", Val: "3"})
+	s.apply(kv{Op: opPut, Key: "/a", Val: "4", Time: t0.Add(time.Second)})
+
+	for key, want := range map[string]time.Time{"/a": t0.Add(time.Second), "/b": t0, "/c": t0} {
+		kv, _, err := s.GetIn("", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kv.ModTime == nil || !kv.ModTime.Equal(want) {
+			t.Fatalf("%s: expected the time %v, got %v", key, want, kv.ModTime)
+		}
+	}
+
+	// the times survive a snapshot, and keep increasing after it
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	restored.apply(kv{Op: opPut, Key: "/d", Val: "5", Time: t0})
+	for key, want := range map[string]time.Time{"/b": t0, "/d": t0.Add(time.Second)} {
+		kv, _, _ := restored.GetIn("", key)
+		if kv.ModTime == nil || !kv.ModTime.Equal(want) {
+			t.Fatalf("%s: expected the time %v after the snapshot, got %v", key, want, kv.ModTime)
+		}
+	}
+}
+
+func TestStampProposal(t *testing.T) {
+	var buf bytes.Buffer
+	proposed := kv{Op: opPut, Key: "/a", Val: "1", ID: 7, Member: 2, Time: time.Now().Add(-time.Hour)}
+	if err := gob.NewEncoder(&buf).Encode(proposed); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	var stamped kv
+	if err := gob.NewDecoder(bytes.NewReader(stampProposal(buf.Bytes()))).Decode(&stamped); err != nil {
+		t.Fatal(err)
+	}
+	if stamped.Time.Before(before) {
+		t.Fatalf("expected the time of the leader, got %v", stamped.Time)
+	}
+	if stamped.Key != proposed.Key || stamped.Val != proposed.Val || stamped.ID != proposed.ID || stamped.Member != proposed.Member {
+		t.Fatalf("expected the proposal unchanged but its time, got %+v", stamped)
+	}
+	if garbage := []byte("not a proposal"); !bytes.Equal(stampProposal(garbage), garbage) {
+		t.Fatal("expected undecodable data to be kept")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"metcd/api"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// prefixStats are the number and size of the keys of a top-level prefix.
+type prefixStats struct {
+	keys int
+	size int64
+}
+
+// countPrefix adds keys and size to the statistics of the top-level prefix
+// of k, its first path segment. It must be called with s.mu held.
+func (ks *keyspace) countPrefix(k string, keys int, size int64) {
+	prefix, ok := keyPrefix(k, 1)
+	if !ok {
+		return
+	}
+	st := ks.prefixes[prefix]
+	st.keys += keys
+	st.size += size
+	if st.keys == 0 {
+		delete(ks.prefixes, prefix)
+		return
+	}
+	ks.prefixes[prefix] = st
+}
+
+// stats returns the statistics of ks with its limit top-level prefixes
+// holding the most keys. It must be called with s.mu held.
+func (ks *keyspace) stats(name string, limit int) api.KeyspaceStats {
+	st := api.KeyspaceStats{Name: name, Keys: len(ks.kvStore), Size: ks.size, Rev: ks.rev, CompactRevision: ks.compactRev}
+	st.Watchers, st.HistoryRevision = ks.watchers.stats()
+	for prefix, p := range ks.prefixes {
+		st.Prefixes = append(st.Prefixes, api.PrefixStats{Prefix: prefix, Keys: p.keys, Size: p.size})
+	}
+	sort.Slice(st.Prefixes, func(i, j int) bool {
+		if st.Prefixes[i].Keys != st.Prefixes[j].Keys {
+			return st.Prefixes[i].Keys > st.Prefixes[j].Keys
+		}
+		return st.Prefixes[i].Prefix < st.Prefixes[j].Prefix
+	})
+	if limit < len(st.Prefixes) {
+		st.Prefixes = st.Prefixes[:limit]
+	}
+	return st
+}
+
+// Stats returns the statistics of the store and of each keyspace, the
+// default one first, with the limit top-level prefixes of each holding the
+// most keys. They are kept up to date as changes are applied, so this
+// does not scan the keys.
+func (s *kvstore) Stats(limit int) *api.Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := &api.Stats{Keyspaces: []api.KeyspaceStats{s.keyspace.stats("", limit)}}
+	names := make([]string, 0, len(s.keyspaces))
+	for name := range s.keyspaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		st.Keyspaces = append(st.Keyspaces, s.keyspaces[name].stats(name, limit))
+	}
+	for _, ks := range st.Keyspaces {
+		st.Keys += ks.Keys
+		st.Size += ks.Size
+		st.Watchers += ks.Watchers
+	}
+	return st
+}
+
+// serveStats handles GET /admin/stats, the statistics of this member's
+// store, with the first ?limit=<n> (100) top-level prefixes of each
+// keyspace.
+func (h *httpKVAPI) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, h.store.Stats(limit))
+}
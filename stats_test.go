@@ -0,0 +1,42 @@
+package main
+
+import (
+	"metcd/api"
+	"reflect"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	s := newTestKVStore(map[string]string{"/users/1": "a"})
+	s.apply(kv{Op: opPut, Key: "/users/2", Val: "bb"})
+	s.apply(kv{Op: opPut, Key: "/users/1", Val: "ccc"})
+	s.apply(kv{Op: opPut, Key: "/config/mode", Val: "dev"})
+	s.apply(kv{Op: opPut, Key: "/flat", Val: "x"})
+	s.apply(kv{Op: opDelete, Key: "/config/mode"})
+	s.apply(kv{Op: opCompact, Rev: 2})
+	_, cancel := s.keyspace.watchers.watch("/users/", true)
+	defer cancel()
+
+	st := s.Stats(10)
+	want := api.KeyspaceStats{Keys: 3, Size: 27, Watchers: 1, Rev: 5, CompactRevision: 2,
+		Prefixes: []api.PrefixStats{{Prefix: "/users/", Keys: 2, Size: 21}}}
+	if st.Keys != 3 || st.Size != 27 || st.Watchers != 1 || len(st.Keyspaces) != 1 || !reflect.DeepEqual(st.Keyspaces[0], want) {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	// the statistics are rebuilt from a snapshot
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.Stats(10).Keyspaces[0].Prefixes; !reflect.DeepEqual(got, want.Prefixes) {
+		t.Fatalf("expected the prefixes %+v after the snapshot, got %+v", want.Prefixes, got)
+	}
+	if got := s.Stats(0).Keyspaces[0].Prefixes; len(got) != 0 {
+		t.Fatalf("expected no prefixes with a limit of 0, got %+v", got)
+	}
+}
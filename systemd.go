@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"metcd/raftnode"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes to an
+// activated service.
+const sdListenFDsStart = 3
+
+// systemdListeners returns the sockets systemd passed to the process by
+// socket activation, by name: the FileDescriptorName= of their .socket
+// unit, or "client" for the first and "peer" for the second unnamed one.
+// It returns nil without socket activation, and unsets LISTEN_* so that
+// children do not inherit them.
+func systemdListeners() (map[string]net.Listener, error) {
+	names, err := parseListenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || names == nil {
+		return nil, err
+	}
+	listeners := make(map[string]net.Listener, len(names))
+	for i, name := range names {
+		f := os.NewFile(uintptr(sdListenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %q passed by systemd: %v", name, err)
+		}
+		if _, ok := listeners[name]; ok {
+			return nil, fmt.Errorf("systemd passed more than one socket named %q", name)
+		}
+		listeners[name] = ln
+	}
+	return listeners, nil
+}
+
+// parseListenFDs returns the names of the LISTEN_FDS sockets passed to the
+// process pid, nil if they were passed to another process or none were.
+func parseListenFDs(pidEnv, fdsEnv, namesEnv string, pid int) ([]string, error) {
+	if pidEnv == "" || fdsEnv == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(pidEnv); err != nil || p != pid {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fdsEnv)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fdsEnv)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	var given []string
+	if namesEnv != "" {
+		given = strings.Split(namesEnv, ":")
+	}
+	names := make([]string, n)
+	unnamed := []string{"client", "peer"}
+	for i := range names {
+		if i < len(given) && given[i] != "" && given[i] != "unknown" {
+			names[i] = given[i]
+		} else if len(unnamed) > 0 {
+			names[i], unnamed = unnamed[0], unnamed[1:]
+		} else {
+			names[i] = "fd" + strconv.Itoa(sdListenFDsStart+i)
+		}
+	}
+	return names, nil
+}
+
+// sdNotify sends state to the NOTIFY_SOCKET of systemd, doing nothing when
+// the process was not started by systemd with Type=notify.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		// abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the WatchdogSec= of the service, 0 if systemd
+// does not watch this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifySystemd tells systemd the member is ready once its WAL is replayed
+// and it knows a leader, then pings the watchdog every half WatchdogSec=
+// while the raft loop keeps ticking, so that a member stuck on its disk is
+// restarted.
+func notifySystemd(rc *raftnode.RaftNode) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	for rc.LeaderID() == 0 {
+		time.Sleep(raftnode.TickInterval)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Failed to notify systemd (%v)\n", err)
+		return
+	}
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	for range time.Tick(interval / 2) {
+		if last := rc.LastTick(); time.Since(last) > interval/2 {
+			log.Printf("raft has not ticked since %v, not pinging the systemd watchdog", last)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("Failed to ping the systemd watchdog (%v)\n", err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseListenFDs(t *testing.T) {
+	for _, c := range []struct {
+		pid, fds, names string
+		want            []string
+		err             bool
+	}{
+		{"", "", "", nil, false},
+		{"42", "2", "", []string{"client", "peer"}, false},
+		{"41", "2", "", nil, false},
+		{"42", "0", "", nil, false},
+		{"42", "x", "", nil, true},
+		{"42", "2", "peer:client", []string{"peer", "client"}, false},
+		{"42", "3", "unknown:peer", []string{"client", "peer", "peer"}, false},
+		{"42", "3", "", []string{"client", "peer", "fd5"}, false},
+	} {
+		got, err := parseListenFDs(c.pid, c.fds, c.names, 42)
+		if (err != nil) != c.err || !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("LISTEN_PID=%s LISTEN_FDS=%s LISTEN_FDNAMES=%s: expected %q (error %v), got %q (%v)", c.pid, c.fds, c.names, c.want, c.err, got, err)
+		}
+	}
+}
+
+func TestSDNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("expected no notification outside systemd, got %v", err)
+	}
+
+	addr := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unix datagram sockets unavailable (%v)", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", addr)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 64)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "READY=1" {
+		t.Fatalf("expected READY=1, got %q", b[:n])
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if d := watchdogInterval(); d != 0 {
+		t.Fatalf("expected no watchdog, got %v", d)
+	}
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if d := watchdogInterval(); d != 30*time.Second {
+		t.Fatalf("expected a 30s watchdog, got %v", d)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if d := watchdogInterval(); d != 0 {
+		t.Fatalf("expected the watchdog of another process to be ignored, got %v", d)
+	}
+}
@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"net/http"
+)
+
+// Handler traces the requests served by next, as children of the span of
+// their traceparent header if any. The span context is in the context of
+// the request, and its traceparent in the traceparent response header.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if loadExporter() == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if parent, ok := ParseTraceParent(r.Header.Get("traceparent")); ok {
+			ctx = ContextWithSpanContext(ctx, parent)
+		}
+		ctx, span := StartKind(ctx, "HTTP "+r.Method, KindServer)
+		defer span.End()
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+		w.Header().Set("traceparent", span.SpanContext().TraceParent())
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttr("http.response.status_code", sw.status)
+		if sw.status >= 500 {
+			span.SetError(errStatus(sw.status))
+		}
+	})
+}
+
+type errStatus int
+
+func (e errStatus) Error() string { return http.StatusText(int(e)) }
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streamed responses flushing.
+func (w *statusWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,298 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config configures the export of the spans.
+type Config struct {
+	// Endpoint is the base URL of the OTLP/HTTP receiver of the collector,
+	// e.g. http://127.0.0.1:4318; spans are posted to <Endpoint>/v1/traces.
+	Endpoint string
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string
+	// ServiceName and Attributes describe the process, e.g. its
+	// service.instance.id.
+	ServiceName string
+	Attributes  map[string]string
+	// SampleRatio is the fraction of new traces recorded; traces started by
+	// a caller follow its decision.
+	SampleRatio float64
+}
+
+var (
+	// ExportInterval is the longest time an ended span waits for its
+	// export, ExportBatch the most spans exported at once.
+	ExportInterval = 5 * time.Second
+	ExportBatch    = 512
+	// ExportTimeout bounds an export request.
+	ExportTimeout = 10 * time.Second
+)
+
+// maxQueued bounds the spans waiting for their export, later ones are
+// dropped while the collector is slow.
+const maxQueued = 8192
+
+var current atomic.Value // *otlpExporter
+
+func loadExporter() *otlpExporter {
+	e, _ := current.Load().(*otlpExporter)
+	return e
+}
+
+// Init starts exporting the spans as cfg says, and returns the function
+// exporting the remaining spans and stopping.
+func Init(cfg Config) (shutdown func(context.Context) error, err error) {
+	if !strings.HasPrefix(cfg.Endpoint, "http://") && !strings.HasPrefix(cfg.Endpoint, "https://") {
+		return nil, fmt.Errorf("tracing: invalid OTLP endpoint %q", cfg.Endpoint)
+	}
+	if err := setSampleRatio(cfg.SampleRatio); err != nil {
+		return nil, err
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "metcd"
+	}
+	e := &otlpExporter{
+		url:     strings.TrimSuffix(cfg.Endpoint, "/") + "/v1/traces",
+		headers: cfg.Headers,
+		client:  &http.Client{Timeout: ExportTimeout},
+		spans:   make(chan *Span, maxQueued),
+		flushc:  make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	attrs := map[string]interface{}{"service.name": cfg.ServiceName}
+	for k, v := range cfg.Attributes {
+		attrs[k] = v
+	}
+	e.resource = encodeAttrs(attrs)
+	go e.run()
+	current.Store(e)
+	return e.shutdown, nil
+}
+
+// ParseHeaders parses the comma separated key=value pairs of the
+// OTEL_EXPORTER_OTLP_HEADERS format.
+func ParseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("tracing: invalid header %q, want key=value", pair)
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers, nil
+}
+
+type otlpExporter struct {
+	url      string
+	headers  map[string]string
+	client   *http.Client
+	resource []jsonAttr
+
+	spans   chan *Span
+	flushc  chan chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	dropped atomic.Int64
+}
+
+func (e *otlpExporter) export(s *Span) {
+	select {
+	case e.spans <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(ExportInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	send := func() {
+		if len(batch) > 0 {
+			if err := e.post(batch); err != nil {
+				log.Printf("tracing: failed to export %d spans (%v)", len(batch), err)
+			}
+			batch = nil
+		}
+		if n := e.dropped.Swap(0); n > 0 {
+			log.Printf("tracing: dropped %d spans, the collector is too slow", n)
+		}
+	}
+	for {
+		select {
+		case s := <-e.spans:
+			if batch = append(batch, s); len(batch) >= ExportBatch {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-e.flushc:
+			for n := len(e.spans); n > 0; n-- {
+				batch = append(batch, <-e.spans)
+			}
+			send()
+			close(flushed)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// shutdown exports the queued spans and stops e.
+func (e *otlpExporter) shutdown(ctx context.Context) error {
+	if loadExporter() == e {
+		current.Store((*otlpExporter)(nil))
+	}
+	flushed := make(chan struct{})
+	select {
+	case e.flushc <- flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	e.once.Do(func() { close(e.done) })
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of spans: IDs are hex, times decimal
+// strings of nanoseconds.
+type (
+	jsonTraces struct {
+		ResourceSpans []jsonResourceSpans `json:"resourceSpans"`
+	}
+	jsonResourceSpans struct {
+		Resource   jsonResource     `json:"resource"`
+		ScopeSpans []jsonScopeSpans `json:"scopeSpans"`
+	}
+	jsonResource struct {
+		Attributes []jsonAttr `json:"attributes"`
+	}
+	jsonScopeSpans struct {
+		Scope jsonScope  `json:"scope"`
+		Spans []jsonSpan `json:"spans"`
+	}
+	jsonScope struct {
+		Name string `json:"name"`
+	}
+	jsonSpan struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []jsonAttr `json:"attributes,omitempty"`
+		Status            jsonStatus `json:"status"`
+	}
+	jsonStatus struct {
+		// Code is 0 unset, 2 error
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	jsonAttr struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+)
+
+func (e *otlpExporter) post(batch []*Span) error {
+	spans := make([]jsonSpan, len(batch))
+	for i, s := range batch {
+		js := jsonSpan{
+			TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			js.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		attrs := make(map[string]interface{}, len(s.attrs))
+		for _, a := range s.attrs {
+			attrs[a.key] = a.value
+		}
+		js.Attributes = encodeAttrs(attrs)
+		if s.err != "" {
+			js.Status = jsonStatus{Code: 2, Message: s.err}
+		}
+		spans[i] = js
+	}
+	body, err := json.Marshal(jsonTraces{ResourceSpans: []jsonResourceSpans{{
+		Resource:   jsonResource{Attributes: e.resource},
+		ScopeSpans: []jsonScopeSpans{{Scope: jsonScope{Name: "metcd"}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status + ": " + strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// encodeAttrs encodes attrs as OTLP key-values, sorted by key.
+func encodeAttrs(attrs map[string]interface{}) []jsonAttr {
+	encoded := make([]jsonAttr, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case uint64:
+			value = map[string]interface{}{"intValue": strconv.FormatUint(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, jsonAttr{Key: k, Value: value})
+	}
+	sort.Slice(encoded, func(i, j int) bool { return encoded[i].Key < encoded[j].Key })
+	return encoded
+}
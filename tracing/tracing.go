@@ -0,0 +1,189 @@
+// Package tracing records spans of the lifecycle of requests and exports
+// them to an OpenTelemetry collector over OTLP/HTTP, in its JSON encoding.
+// Trace context travels between processes in the W3C traceparent format,
+// in the traceparent HTTP header and in the proposals replicated by raft,
+// so that the spans of the members applying a proposal join the trace of
+// the request that made it.
+//
+// Tracing is off until Init is called: Start then returns nil spans, whose
+// methods do nothing.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SpanContext identifies a span and its trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether sc identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent returns sc in the W3C traceparent format, "" if it is
+// invalid.
+func (sc SpanContext) TraceParent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceParent parses a W3C traceparent, reporting whether it is
+// valid. Versions after 00 may append fields.
+func ParseTraceParent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	var flags [1]byte
+	for _, f := range []struct {
+		dst []byte
+		src string
+	}{{sc.TraceID[:], parts[1]}, {sc.SpanID[:], parts[2]}, {flags[:], parts[3]}} {
+		if _, err := hex.Decode(f.dst, []byte(f.src)); err != nil {
+			return SpanContext{}, false
+		}
+	}
+	sc.Sampled = flags[0]&1 != 0
+	return sc, sc.IsValid()
+}
+
+// Span kinds of OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+)
+
+// Span is an operation of a trace. The methods of a nil Span do nothing.
+type Span struct {
+	name   string
+	kind   int
+	sc     SpanContext
+	parent [8]byte
+	start  time.Time
+	end    time.Time
+	attrs  []attribute
+	err    string
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// SpanContext returns the identity of s, the zero one for a nil span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttr records an attribute of s, value is a string, a bool, an
+// integer or a float.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s != nil {
+		s.attrs = append(s.attrs, attribute{key, value})
+	}
+}
+
+// SetError marks s as failed with err, if not nil.
+func (s *Span) SetError(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+// End ends s and hands it to the exporter, if sampled.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if e := loadExporter(); e != nil && s.sc.Sampled {
+		e.export(s)
+	}
+}
+
+type spanCtx struct{}
+
+// ContextWithSpanContext returns ctx carrying sc, the parent of the spans
+// started from it.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanCtx{}, sc)
+}
+
+// SpanContextFromContext returns the span context carried by ctx.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanCtx{}).(SpanContext)
+	return sc
+}
+
+// Start starts a span called name, a child of the span of ctx or a new
+// trace, and returns it with the context carrying it. It returns ctx and a
+// nil span while tracing is off.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal)
+}
+
+// StartKind is Start for a span of kind, KindServer for the handling of a
+// request.
+func StartKind(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if loadExporter() == nil {
+		return ctx, nil
+	}
+	parent := SpanContextFromContext(ctx)
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	if parent.IsValid() {
+		s.sc.TraceID, s.sc.Sampled, s.parent = parent.TraceID, parent.Sampled, parent.SpanID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = sampled(s.sc.TraceID)
+	}
+	rand.Read(s.sc.SpanID[:])
+	return ContextWithSpanContext(ctx, s.sc), s
+}
+
+// sampleBound is the sampled fraction of new traces, scaled to the range
+// of the low 8 bytes of their ID.
+var sampleBound atomic.Uint64
+
+func sampled(id [16]byte) bool {
+	var low uint64
+	for _, b := range id[8:] {
+		low = low<<8 | uint64(b)
+	}
+	// the IDs are random, so are their low bytes
+	return low < sampleBound.Load() || sampleBound.Load() == math.MaxUint64
+}
+
+func setSampleRatio(ratio float64) error {
+	switch {
+	case ratio < 0 || ratio > 1 || math.IsNaN(ratio):
+		return fmt.Errorf("tracing: sample ratio %v is not in [0, 1]", ratio)
+	case ratio == 1:
+		sampleBound.Store(math.MaxUint64)
+	default:
+		sampleBound.Store(uint64(ratio * math.MaxUint64))
+	}
+	return nil
+}
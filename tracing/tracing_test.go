@@ -0,0 +1,101 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestTraceParent(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceParent(tp)
+	if !ok || !sc.Sampled || sc.TraceParent() != tp {
+		t.Fatalf("expected %s to round trip, got %+v %v", tp, sc, ok)
+	}
+	for _, tp := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceParent(tp); ok {
+			t.Errorf("expected %q to be invalid", tp)
+		}
+	}
+	if _, span := Start(context.Background(), "off"); span != nil {
+		t.Fatal("expected no span while tracing is off")
+	}
+}
+
+type collector struct {
+	mu    sync.Mutex
+	spans []jsonSpan
+	auth  string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var traces jsonTraces
+	if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&traces) != nil {
+		http.Error(w, "bad export", http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.auth = r.Header.Get("Authorization")
+	for _, rs := range traces.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	shutdown, err := Init(Config{Endpoint: srv.URL, Headers: map[string]string{"Authorization": "Bearer x"}, SampleRatio: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "propose")
+		span.SetAttr("metcd.op", "put")
+		span.End()
+	}))
+	// new traces are not sampled at ratio 0, sampled callers are followed
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/kv/unsampled", nil))
+	req := httptest.NewRequest(http.MethodPut, "/kv/a", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, span := Start(context.Background(), "stopped"); span != nil {
+		t.Fatal("expected no span after shutdown")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.spans) != 2 || c.auth != "Bearer x" {
+		t.Fatalf("expected 2 spans exported with the headers, got %+v with %q", c.spans, c.auth)
+	}
+	propose, server := c.spans[0], c.spans[1]
+	switch {
+	case server.Name != "HTTP PUT" || server.Kind != KindServer || server.ParentSpanID != "00f067aa0ba902b7":
+		t.Fatalf("expected the server span to be a child of the caller, got %+v", server)
+	case propose.ParentSpanID != server.SpanID || propose.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736":
+		t.Fatalf("expected the propose span to be a child of the server span, got %+v", propose)
+	case len(propose.Attributes) != 1 || propose.Attributes[0].Value["stringValue"] != "put":
+		t.Fatalf("expected the attribute of the propose span, got %+v", propose.Attributes)
+	}
+	if sc, ok := ParseTraceParent(rec.Header().Get("traceparent")); !ok || sc.TraceParent() != "00-"+server.TraceID+"-"+server.SpanID+"-01" {
+		t.Fatalf("expected the traceparent of the server span in the response, got %q", rec.Header().Get("traceparent"))
+	}
+}
@@ -0,0 +1,171 @@
+// Package transform is the registry of the transformers that rewrite the
+// values of a prefix: on a write, before the value is proposed, and on a
+// read of the key, before it is served. A transformer attached to a prefix
+// with /admin/transform runs on the member a request is sent to. The
+// members apply the value a write transformer returned as is, so it may
+// depend on the time or on randomness without the replicas diverging.
+//
+// Template and json are built in. Others, such as one encrypting some
+// fields of a JSON value, are added by a package registering them from its
+// init function; every member must then be built with it, or the writes and
+// reads of its prefixes fail on the members without it.
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	Template = "template"
+	JSON     = "json"
+)
+
+var (
+	ErrUnknown = errors.New("transform: unknown transformer")
+	// ErrRejected wraps the errors of the writes a transformer refuses.
+	ErrRejected = errors.New("transform: value rejected")
+)
+
+// Lookup returns the value served for a key of the keyspace being read,
+// without transforming it, and whether it exists.
+type Lookup func(key string) ([]byte, bool)
+
+// Transformer rewrites the values of the prefixes it is attached to.
+type Transformer interface {
+	// Name is the name the transformer is attached to prefixes by.
+	Name() string
+	// Write returns the value to propose for a write of value to key. An
+	// error wrapping ErrRejected fails the write.
+	Write(key string, value []byte) ([]byte, error)
+	// Read returns the value to serve for a read of key whose value is
+	// value, reading the other keys of the keyspace with lookup.
+	Read(key string, value []byte, lookup Lookup) ([]byte, error)
+}
+
+var (
+	mu           sync.RWMutex
+	transformers = make(map[string]Transformer)
+)
+
+func init() {
+	Register(template{})
+	Register(jsonTransformer{})
+}
+
+// Register makes t available by its name. It panics if a transformer with
+// that name is registered already.
+func Register(t Transformer) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := transformers[t.Name()]; dup {
+		panic("transform: Register called twice for " + t.Name())
+	}
+	transformers[t.Name()] = t
+}
+
+// Get returns the transformer called name.
+func Get(name string) (Transformer, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	t, ok := transformers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q, registered are %s", ErrUnknown, name, strings.Join(names(), ", "))
+	}
+	return t, nil
+}
+
+// Names returns the names of the registered transformers, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return names()
+}
+
+func names() []string {
+	var ns []string
+	for n := range transformers {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// template expands the references ${<key>} of a value to the values of
+// the keys of the same keyspace when it is read, "" for a missing key. $$
+// is a literal $. The values referenced are not expanded in turn. Writes
+// with a reference that is not closed or that is not to an absolute key
+// are rejected.
+type template struct{}
+
+func (template) Name() string { return Template }
+
+func (template) Write(key string, value []byte) ([]byte, error) {
+	if _, err := expand(value, func(string) ([]byte, bool) { return nil, false }); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (template) Read(key string, value []byte, lookup Lookup) ([]byte, error) {
+	return expand(value, lookup)
+}
+
+func expand(value []byte, lookup Lookup) ([]byte, error) {
+	if !bytes.Contains(value, []byte("$")) {
+		return value, nil
+	}
+	var out bytes.Buffer
+	for {
+		i := bytes.IndexByte(value, '$')
+		if i < 0 || i == len(value)-1 {
+			out.Write(value)
+			return out.Bytes(), nil
+		}
+		out.Write(value[:i])
+		switch value[i+1] {
+		case '$':
+			out.WriteByte('$')
+			value = value[i+2:]
+		case '{':
+			end := bytes.IndexByte(value[i+2:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: reference at %d is not closed", ErrRejected, i)
+			}
+			ref := string(value[i+2 : i+2+end])
+			if !strings.HasPrefix(ref, "/") {
+				return nil, fmt.Errorf("%w: reference ${%s} is not to a key", ErrRejected, ref)
+			}
+			v, _ := lookup(ref)
+			out.Write(v)
+			value = value[i+3+end:]
+		default:
+			out.WriteByte('$')
+			value = value[i+1:]
+		}
+	}
+}
+
+// jsonTransformer rejects the writes of a value that is not JSON and
+// compacts the others, so the values are stored without insignificant
+// whitespace.
+type jsonTransformer struct{}
+
+func (jsonTransformer) Name() string { return JSON }
+
+func (jsonTransformer) Write(key string, value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, value); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (jsonTransformer) Read(key string, value []byte, lookup Lookup) ([]byte, error) {
+	return value, nil
+}
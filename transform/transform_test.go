@@ -0,0 +1,53 @@
+package transform
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	tr, err := Get(Template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{"/db/host": "db.internal", "/db/port": "5432"}
+	lookup := func(key string) ([]byte, bool) {
+		v, ok := values[key]
+		return []byte(v), ok
+	}
+	for value, want := range map[string]string{
+		"postgres://${/db/host}:${/db/port}/app": "postgres://db.internal:5432/app",
+		"none":                                   "none",
+		"cost: $$5, ${/missing}":                 "cost: $5, ",
+		"a $ b $":                                "a $ b $",
+	} {
+		got, err := tr.Read("/app/dsn", []byte(value), lookup)
+		if err != nil || string(got) != want {
+			t.Errorf("%q: expected %q, got %q, %v", value, want, got, err)
+		}
+	}
+	for _, value := range []string{"${/db/host", "${db}"} {
+		if _, err := tr.Write("/app/dsn", []byte(value)); !errors.Is(err, ErrRejected) {
+			t.Errorf("%q: expected the write to be rejected, got %v", value, err)
+		}
+	}
+	if got, err := tr.Write("/app/dsn", []byte("${/db/host}")); err != nil || string(got) != "${/db/host}" {
+		t.Fatalf("expected the template to be stored as is, got %q, %v", got, err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	tr, err := Get(JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tr.Write("/a", []byte("{ \"a\": [1, 2] }\n")); err != nil || string(got) != `{"a":[1,2]}` {
+		t.Fatalf("expected the value compacted, got %q, %v", got, err)
+	}
+	if _, err := tr.Write("/a", []byte("{")); !errors.Is(err, ErrRejected) {
+		t.Fatalf("expected the write to be rejected, got %v", err)
+	}
+	if _, err := Get("nosuch"); !errors.Is(err, ErrUnknown) {
+		t.Fatalf("expected an unknown transformer, got %v", err)
+	}
+}
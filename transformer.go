@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"metcd/api"
+	"metcd/transform"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var ErrTransformNotFound = errors.New("metcd: prefix has no transformer")
+
+// PutTransform attaches the transformer called name to prefix in the
+// keyspace of ctx. It must be registered on this member.
+func (s *kvstore) PutTransform(ctx context.Context, prefix, name string) error {
+	if _, err := transform.Get(name); err != nil {
+		return err
+	}
+	res, err := s.propose(ctx, kv{Op: opTransformPut, Key: prefix, Val: name})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// DeleteTransform detaches the transformer of prefix in the keyspace of
+// ctx.
+func (s *kvstore) DeleteTransform(ctx context.Context, prefix string) error {
+	res, err := s.propose(ctx, kv{Op: opTransformDelete, Key: prefix})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// Transforms returns the transformers of the keyspace called name, sorted
+// by prefix.
+func (s *kvstore) Transforms(name string) ([]api.Transform, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(name)
+	if err != nil {
+		return nil, err
+	}
+	out := []api.Transform{}
+	for prefix, t := range ks.transforms {
+		out = append(out, api.Transform{Keyspace: name, Prefix: prefix, Transformer: t})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Prefix < out[j].Prefix })
+	return out, nil
+}
+
+// transformer returns the transformer of the longest prefix of k that has
+// one, nil if none has. It must be called with s.mu held.
+func (ks *keyspace) transformer(k string) (transform.Transformer, error) {
+	var best string
+	found := false
+	for prefix := range ks.transforms {
+		if strings.HasPrefix(k, prefix) && (!found || len(prefix) > len(best)) {
+			best, found = prefix, true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return transform.Get(ks.transforms[best])
+}
+
+// transformed reports whether a transformer applies to k. Unlike
+// transformer it does not need the transformer to be registered. It must
+// be called with s.mu held.
+func (ks *keyspace) transformed(k string) bool {
+	for prefix := range ks.transforms {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// transformProposal replaces the values r writes by those the transformers
+// of their prefixes return, so the members apply the transformed values
+// without running the transformers themselves.
+func (s *kvstore) transformProposal(r *kv) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(r.Keyspace)
+	if err != nil || len(ks.transforms) == 0 {
+		// a missing keyspace fails when the proposal is applied
+		return nil
+	}
+	write := func(k, v string) (string, error) {
+		t, err := ks.transformer(k)
+		if err != nil || t == nil {
+			return v, err
+		}
+		out, err := t.Write(k, []byte(v))
+		return string(out), err
+	}
+	switch r.Op {
+	case opPut:
+		r.Val, err = write(r.Key, r.Val)
+	case opTxn:
+		if r.Txn == nil {
+			return nil
+		}
+		txn := *r.Txn
+		for _, ops := range []*[]api.Op{&txn.Success, &txn.Failure} {
+			written := append([]api.Op(nil), *ops...)
+			for i := range written {
+				if written[i].Type != api.OpPut {
+					continue
+				}
+				if written[i].Value, err = write(written[i].Key, written[i].Value); err != nil {
+					return err
+				}
+			}
+			*ops = written
+		}
+		r.Txn = &txn
+	}
+	return err
+}
+
+// transformRead returns the value to serve for a read of k whose opened
+// value is v. It must be called with s.mu held.
+func (s *kvstore) transformRead(ks *keyspace, k, v string) (string, error) {
+	t, err := ks.transformer(k)
+	if err != nil || t == nil {
+		return v, err
+	}
+	lookup := func(key string) ([]byte, bool) {
+		stored, ok := ks.kvStore[key]
+		if !ok {
+			return nil, false
+		}
+		opened, err := s.open(key, stored)
+		if err != nil {
+			return nil, false
+		}
+		return []byte(opened), true
+	}
+	out, err := t.Read(k, []byte(v), lookup)
+	if err != nil {
+		return "", fmt.Errorf("cannot transform %s for a read: %w", k, err)
+	}
+	return string(out), nil
+}
+
+// applyTransform applies opTransformPut or opTransformDelete. The
+// transformer is not looked up, the members without it apply the change
+// all the same. It must be called with s.mu held.
+func (ks *keyspace) applyTransform(r kv) error {
+	if r.Op == opTransformPut {
+		ks.transforms[r.Key] = r.Val
+		return nil
+	}
+	if _, ok := ks.transforms[r.Key]; !ok {
+		return ErrTransformNotFound
+	}
+	delete(ks.transforms, r.Key)
+	return nil
+}
+
+// transformList returns the transformers of ks for a snapshot, by prefix.
+// It must be called with s.mu held.
+func (ks *keyspace) transformList() map[string]string {
+	if len(ks.transforms) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(ks.transforms))
+	for prefix, t := range ks.transforms {
+		out[prefix] = t
+	}
+	return out
+}
+
+// restoreTransforms replaces the transformers of ks by those of a snapshot.
+// It must be called with s.mu held.
+func (ks *keyspace) restoreTransforms(transforms map[string]string) {
+	ks.transforms = make(map[string]string, len(transforms))
+	for prefix, t := range transforms {
+		ks.transforms[prefix] = t
+	}
+}
+
+// serveTransform handles /admin/transform: GET lists the transformers of
+// the keyspace of the request, PUT ?prefix=<prefix>&name=<transformer>
+// attaches a transformer to a prefix and DELETE ?prefix=<prefix> detaches
+// it.
+func (h *httpKVAPI) serveTransform(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if r.Method != http.MethodGet && (prefix == "" || !strings.HasPrefix(prefix, "/")) {
+		http.Error(w, "Invalid prefix", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		ts, err := h.store.Transforms(keyspaceOf(r.Context()))
+		if keyspaceError(w, err) {
+			return
+		}
+		writeJSON(w, ts)
+	case http.MethodPut:
+		err := h.store.PutTransform(r.Context(), prefix, r.URL.Query().Get("name"))
+		if errors.Is(err, transform.ErrUnknown) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose transformer (%v)\n", err)
+			http.Error(w, "Failed on PUT", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		err := h.store.DeleteTransform(r.Context(), prefix)
+		if errors.Is(err, ErrTransformNotFound) {
+			http.Error(w, "Prefix has no transformer", http.StatusNotFound)
+			return
+		} else if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose transformer removal (%v)\n", err)
+			http.Error(w, "Failed on DELETE", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPut)
+		w.Header().Add("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
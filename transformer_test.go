@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"metcd/api"
+	"metcd/transform"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	s := newTestKVStore(map[string]string{"/db/host": "db.internal"})
+	s.apply(kv{Op: opTransformPut, Key: "/app/", Val: transform.Template})
+	s.apply(kv{Op: opTransformPut, Key: "/app/json/", Val: transform.JSON})
+
+	// the longest prefix wins
+	r := kv{Op: opPut, Key: "/app/json/a", Val: "{ \"a\": 1 }"}
+	if err := s.transformProposal(&r); err != nil || r.Val != `{"a":1}` {
+		t.Fatalf("expected the value compacted before it is proposed, got %q, %v", r.Val, err)
+	}
+	r = kv{Op: opTxn, Txn: &api.TxnRequest{Success: []api.Op{{Type: api.OpPut, Key: "/app/dsn", Value: "${db/host}"}}}}
+	if err := s.transformProposal(&r); !errors.Is(err, transform.ErrRejected) {
+		t.Fatalf("expected the txn put to be rejected, got %v", err)
+	}
+
+	s.apply(kv{Op: opPut, Key: "/app/dsn", Val: "postgres://${/db/host}/app"})
+	if kv, _, err := s.GetIn("", "/app/dsn"); err != nil || kv.Value != "postgres://db.internal/app" {
+		t.Fatalf("expected the read to be expanded, got %+v, %v", kv, err)
+	}
+	if v, _ := s.Lookup("/app/dsn"); v != "postgres://db.internal/app" {
+		t.Fatalf("expected the lookup to be expanded, got %q", v)
+	}
+	if h, err := s.HistoryIn("", "/app/dsn", 0, 0, 0); err != nil || h.Revisions[0].Value != "postgres://db.internal/app" {
+		t.Fatalf("expected the history to be expanded, got %+v, %v", h, err)
+	}
+	// the stored value is left as written
+	if kvs, _, _ := s.Export(""); kvs[0].Key != "/app/dsn" || kvs[0].Value != "postgres://${/db/host}/app" {
+		t.Fatalf("expected the export to hold the template, got %+v", kvs)
+	}
+
+	// the transformers are kept in the snapshots
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if ts, _ := restored.Transforms(""); len(ts) != 2 || ts[0] != (api.Transform{Prefix: "/app/", Transformer: transform.Template}) {
+		t.Fatalf("expected the transformers to be restored, got %+v", ts)
+	}
+
+	if res := s.apply(kv{Op: opTransformDelete, Key: "/nosuch/"}); !errors.Is(res.err, ErrTransformNotFound) {
+		t.Fatalf("expected removing a missing transformer to fail, got %v", res.err)
+	}
+	s.apply(kv{Op: opTransformDelete, Key: "/app/"})
+	if kv, _, _ := s.GetIn("", "/app/dsn"); kv.Value != "postgres://${/db/host}/app" {
+		t.Fatalf("expected the value served as stored without the transformer, got %q", kv.Value)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"metcd/api"
+	"strconv"
+)
+
+// applyTxn evaluates txn against the keyspace, comparing with the values
+// decrypted by open. It must be called with s.mu held.
+func (ks *keyspace) applyTxn(txn *api.TxnRequest, open func(key, value string) (string, error)) (*api.TxnResponse, []api.Event, error) {
+	if txn == nil {
+		return &api.TxnResponse{}, nil, nil
+	}
+	resp := &api.TxnResponse{Succeeded: true}
+	for _, c := range txn.Compare {
+		if !ks.compare(c, open) {
+			resp.Succeeded = false
+			break
+		}
+	}
+	ops := txn.Success
+	if !resp.Succeeded {
+		ops = txn.Failure
+	}
+	if !ks.admit(ops) {
+		return nil, nil, ErrQuotaExceeded
+	}
+
+	var events []api.Event
+	for _, op := range ops {
+		r := api.OpResponse{Type: op.Type, Key: op.Key}
+		switch op.Type {
+		case api.OpGet:
+			r.Value, r.Found = ks.kvStore[op.Key]
+		case api.OpPut:
+			events = append(events, ks.put(op.Key, op.Value))
+		case api.OpDelete:
+			var ev *api.Event
+			prev := ks.get(op.Key)
+			r.Found, ev = ks.del(op.Key)
+			if ev != nil {
+				events = append(events, *ev)
+			}
+			ks.bury(prev)
+		default:
+			log.Printf("ignoring txn op with unknown type %q", op.Type)
+		}
+		resp.Responses = append(resp.Responses, r)
+	}
+	return resp, events, nil
+}
+
+// compare must be called with s.mu held. A value comparison against a
+// missing key, or a value that cannot be decrypted, never holds.
+func (ks *keyspace) compare(c api.Compare, open func(key, value string) (string, error)) bool {
+	v, ok := ks.kvStore[c.Key]
+	switch c.Target {
+	case api.CompareExists:
+		want, err := strconv.ParseBool(c.Value)
+		if err != nil {
+			return false
+		}
+		return compareOrdered(strconv.FormatBool(ok), strconv.FormatBool(want), c.Result)
+	case api.CompareCreate, api.CompareMod, api.CompareVersion:
+		want, err := strconv.ParseInt(c.Value, 10, 64)
+		if err != nil {
+			return false
+		}
+		revs := ks.revs[c.Key]
+		got := revs.Create
+		if c.Target == api.CompareMod {
+			got = revs.Mod
+		} else if c.Target == api.CompareVersion {
+			got = revs.Version
+		}
+		return compareInts(got, want, c.Result)
+	case api.CompareValue:
+		if !ok {
+			return false
+		}
+		v, err := open(c.Key, v)
+		if err != nil {
+			return false
+		}
+		return compareOrdered(v, c.Value, c.Result)
+	default:
+		return false
+	}
+}
+
+func compareInts(a, b int64, result api.CompareResult) bool {
+	switch result {
+	case api.CompareEqual:
+		return a == b
+	case api.CompareNotEqual:
+		return a != b
+	case api.CompareGreater:
+		return a > b
+	case api.CompareLess:
+		return a < b
+	default:
+		return false
+	}
+}
+
+func compareOrdered(a, b string, result api.CompareResult) bool {
+	switch result {
+	case api.CompareEqual:
+		return a == b
+	case api.CompareNotEqual:
+		return a != b
+	case api.CompareGreater:
+		return a > b
+	case api.CompareLess:
+		return a < b
+	default:
+		return false
+	}
+}
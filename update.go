@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"metcd/api"
+	"metcd/encryption"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidPatch      = errors.New("metcd: invalid merge patch")
+	ErrNotJSON           = errors.New("metcd: value is not JSON")
+	ErrUpdateUnsupported = errors.New("metcd: cannot append to or patch encrypted or transformed values")
+)
+
+// Append appends v to the value of k, creating k if it does not exist, and
+// returns the written pair.
+func (s *kvstore) Append(ctx context.Context, k, v string) (*api.KeyValue, error) {
+	return s.update(ctx, kv{Op: opAppend, Key: k, Val: v})
+}
+
+// Patch applies the JSON merge patch of RFC 7396 patch to the value of k,
+// a missing k being null, and returns the written pair.
+func (s *kvstore) Patch(ctx context.Context, k, patch string) (*api.KeyValue, error) {
+	if !json.Valid([]byte(patch)) {
+		return nil, ErrInvalidPatch
+	}
+	return s.update(ctx, kv{Op: opPatch, Key: k, Val: patch})
+}
+
+func (s *kvstore) update(ctx context.Context, r kv) (*api.KeyValue, error) {
+	res, err := s.propose(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	return res.put, nil
+}
+
+// applyUpdate applies opAppend or opPatch to the value stored when the
+// proposal is applied, so that concurrent updates of a key all take effect.
+// The values proposed are the fragment appended and the patch, not the new
+// value: it is stored uncompressed, as the codec of the proposing member is
+// not that of every member, and is refused under encrypted prefixes, which
+// cannot be sealed the same way by every member, and under transformed
+// ones, whose transformers run before proposing. It must be called with
+// s.mu held.
+func (s *kvstore) applyUpdate(ks *keyspace, r kv, res *applyResult) ([]api.Event, error) {
+	if _, encrypted := s.keyring.Encrypted(r.Keyspace, r.Key); encrypted || ks.transformed(r.Key) {
+		return nil, ErrUpdateUnsupported
+	}
+	stored, exists := ks.kvStore[r.Key]
+	var cur string
+	if exists {
+		if encryption.IsSealed(stored) {
+			return nil, ErrUpdateUnsupported
+		}
+		var err error
+		if cur, err = s.openCompared(r.Key, stored); err != nil {
+			return nil, err
+		}
+	}
+	v := cur + r.Val
+	if r.Op == opPatch {
+		var err error
+		if v, err = mergePatch(cur, exists, r.Val); err != nil {
+			return nil, err
+		}
+	}
+	if err := ks.validate(r.Key, v); err != nil {
+		return nil, err
+	}
+	framed, err := frameValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if !ks.admit([]api.Op{{Type: api.OpPut, Key: r.Key, Value: framed}}) {
+		return nil, ErrQuotaExceeded
+	}
+	res.prev = ks.get(r.Key)
+	ev := ks.put(r.Key, framed)
+	res.put = &api.KeyValue{Key: r.Key, Value: v, CreateRevision: ev.CreateRevision, ModRevision: ev.ModRevision, Version: ev.Version, ModTime: ev.Time}
+	return []api.Event{ev}, nil
+}
+
+// mergePatch returns doc, null if it does not exist, with patch merged into
+// it. The objects of the result have their members sorted by name.
+func mergePatch(doc string, exists bool, patch string) (string, error) {
+	var target, p interface{}
+	if exists {
+		if err := decodeJSON(doc, &target); err != nil {
+			return "", ErrNotJSON
+		}
+	}
+	if err := decodeJSON(patch, &p); err != nil {
+		return "", ErrInvalidPatch
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(mergeJSON(target, p)); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// decodeJSON decodes the single JSON value of s into v, keeping the numbers
+// as written.
+func decodeJSON(s string, v interface{}) error {
+	if !json.Valid([]byte(s)) {
+		return ErrNotJSON
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// mergeJSON is the MergePatch function of RFC 7396.
+func mergeJSON(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{}, len(p))
+	}
+	for name, v := range p {
+		if v == nil {
+			delete(t, name)
+		} else {
+			t[name] = mergeJSON(t[name], v)
+		}
+	}
+	return t
+}
+
+// serveUpdate handles PATCH /kv/<key>, merging the JSON merge patch of the
+// body into the value of the key, or with ?append=true appending the body
+// to it. It answers the revision, the version and the entity tag of the new
+// value.
+func (h *httpKVAPI) serveUpdate(w http.ResponseWriter, r *http.Request, key string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Failed to read on %s (%v)\n", r.Method, err)
+		http.Error(w, "Failed on "+r.Method, http.StatusBadRequest)
+		return
+	}
+	var kv *api.KeyValue
+	if r.URL.Query().Get("append") == "true" {
+		kv, err = h.store.Append(proposalCtx(r), key, string(body))
+	} else {
+		kv, err = h.store.Patch(proposalCtx(r), key, string(body))
+	}
+	switch {
+	case errors.Is(err, ErrInvalidPatch):
+		http.Error(w, "Invalid merge patch", http.StatusBadRequest)
+	case errors.Is(err, ErrNotJSON):
+		http.Error(w, "Value is not JSON", http.StatusConflict)
+	case errors.Is(err, ErrUpdateUnsupported):
+		http.Error(w, "Cannot update encrypted or transformed values", http.StatusConflict)
+	case keyspaceError(w, err) || proposalError(w, err):
+	case err != nil:
+		log.Printf("Failed to propose on %s (%v)\n", r.Method, err)
+		http.Error(w, "Failed on "+r.Method, http.StatusInternalServerError)
+	default:
+		w.Header().Set("X-Metcd-Revision", strconv.FormatInt(kv.ModRevision, 10))
+		w.Header().Set("X-Metcd-Version", strconv.FormatInt(kv.Version, 10))
+		w.Header().Set("ETag", etag(kv.ModRevision))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
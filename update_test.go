@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"metcd/codec"
+	"metcd/encryption"
+	"metcd/transform"
+	"strings"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	s := newTestKVStore(nil)
+	valueCodec, _ = codec.Get(codec.Gzip)
+	defer func() { valueCodec = nil }()
+
+	res := s.apply(kv{Op: opAppend, Key: "/log", Val: "a\n"})
+	if res.err != nil || res.put.Value != "a\n" || res.put.Version != 1 || res.prev != nil {
+		t.Fatalf("expected the append to create the key, got %+v, %v", res.put, res.err)
+	}
+	// a compressed value is appended to once opened
+	large := kv{Op: opPut, Key: "/log", Val: strings.Repeat("x", valueCodecMinSize)}
+	if err := s.sealProposal(&large); err != nil || !codec.IsEncoded([]byte(large.Val)) {
+		t.Fatalf("expected the value compressed, got %v", err)
+	}
+	s.apply(large)
+	res = s.apply(kv{Op: opAppend, Key: "/log", Val: "b\n"})
+	if res.err != nil || res.put.Version != 3 || res.put.CreateRevision != 1 || res.put.ModRevision != res.rev {
+		t.Fatalf("expected the append to change the key, got %+v, %v", res.put, res.err)
+	}
+	if kv, _, err := s.GetIn("", "/log"); err != nil || kv.Value != strings.Repeat("x", valueCodecMinSize)+"b\n" {
+		t.Fatalf("expected the fragment appended, got %v", err)
+	}
+	// a value that would read as compressed is framed
+	s.apply(kv{Op: opDelete, Key: "/log"})
+	s.apply(kv{Op: opAppend, Key: "/log", Val: large.Val})
+	if v, _ := s.Lookup("/log"); v != large.Val {
+		t.Fatal("expected the value read back as appended")
+	}
+}
+
+func TestPatch(t *testing.T) {
+	s := newTestKVStore(map[string]string{"/cfg": `{"a":1,"b":{"c":"<x>","d":2.50},"e":[1]}`, "/text": "plain"})
+	res := s.apply(kv{Op: opPatch, Key: "/cfg", Val: `{"b":{"c":null,"f":true},"e":{"g":null},"a":null}`})
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if want := `{"b":{"d":2.50,"f":true},"e":{}}`; res.put.Value != want {
+		t.Fatalf("expected %s, got %s", want, res.put.Value)
+	}
+	if res := s.apply(kv{Op: opPatch, Key: "/new", Val: `{"a":{"b":null,"c":1}}`}); res.err != nil || res.put.Value != `{"a":{"c":1}}` {
+		t.Fatalf("expected a missing key patched as null, got %+v, %v", res.put, res.err)
+	}
+	if res := s.apply(kv{Op: opPatch, Key: "/cfg", Val: `"<replaced>"`}); res.err != nil || res.put.Value != `"<replaced>"` {
+		t.Fatalf("expected a patch that is not an object to replace the value, got %+v, %v", res.put, res.err)
+	}
+	if res := s.apply(kv{Op: opPatch, Key: "/text", Val: `{"a":1}`}); !errors.Is(res.err, ErrNotJSON) {
+		t.Fatalf("expected a value that is not JSON to fail the patch, got %v", res.err)
+	}
+	if _, err := s.Patch(context.Background(), "/cfg", "{"); !errors.Is(err, ErrInvalidPatch) {
+		t.Fatalf("expected an invalid patch to fail before it is proposed, got %v", err)
+	}
+
+	// the schemas hold for the patched value
+	s.apply(kv{Op: opSchemaPut, Key: "/svc/", Val: `{"type":"object","required":["port"]}`})
+	s.apply(kv{Op: opPut, Key: "/svc/a", Val: `{"port":80}`})
+	if res := s.apply(kv{Op: opPatch, Key: "/svc/a", Val: `{"port":null}`}); !errors.Is(res.err, ErrValidationFailed) {
+		t.Fatalf("expected the patched value validated, got %v", res.err)
+	}
+	if v, _ := s.Lookup("/svc/a"); v != `{"port":80}` {
+		t.Fatalf("expected a failed patch to leave the value, got %s", v)
+	}
+}
+
+func TestUpdateIdempotency(t *testing.T) {
+	s := newTestKVStore(nil)
+	for _, r := range []kv{
+		{Op: opAppend, Key: "/log", Val: "a", IdempotencyKey: "append"},
+		{Op: opPatch, Key: "/doc", Val: `{"a":1}`, IdempotencyKey: "patch"},
+	} {
+		first := s.apply(r)
+		if first.err != nil || first.put == nil {
+			t.Fatalf("%+v: expected the pair written, got %+v, %v", r, first.put, first.err)
+		}
+		// the retry returns the pair of the first update, also after recovery
+		data, err := s.getSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := newTestKVStore(nil)
+		if err := restored.recoverFromSnapshot(data); err != nil {
+			t.Fatal(err)
+		}
+		for _, store := range []*kvstore{s, restored} {
+			retry := store.apply(r)
+			if retry.err != nil || retry.put == nil || *retry.put != *first.put || retry.time != first.time {
+				t.Fatalf("%+v: expected the result of the first update, got %+v, %v", r, retry.put, retry.err)
+			}
+		}
+	}
+	if v, _ := s.Lookup("/log"); v != "a" {
+		t.Fatalf("retried append was applied, /log = %q", v)
+	}
+}
+
+func TestUpdateUnsupported(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.keyring, _ = encryption.NewKeyring(bytes.Repeat([]byte{1}, 32))
+	wrapped, err := s.keyring.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apply(kv{Op: opDataKeyPut, Key: "/secret/", Wrapped: wrapped})
+	s.apply(kv{Op: opTransformPut, Key: "/tmpl/", Val: transform.Template})
+	for _, r := range []kv{
+		{Op: opAppend, Key: "/secret/a", Val: "x"},
+		{Op: opPatch, Key: "/secret/a", Val: "{}"},
+		{Op: opAppend, Key: "/tmpl/a", Val: "x"},
+	} {
+		if res := s.apply(r); !errors.Is(res.err, ErrUpdateUnsupported) {
+			t.Fatalf("%+v: expected the update refused, got %v", r, res.err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"metcd/api"
+	"metcd/raftnode"
+	"metcd/transform"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxV1Body bounds the body of a PUT /v1/kv/<key>.
+const maxV1Body = 64 << 20
+
+// writeV1 writes resp with status.
+func writeV1(w http.ResponseWriter, status int, resp *api.KVResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Failed to write response (%v)\n", err)
+	}
+}
+
+// v1Error answers a failed /v1 request with the code of the error.
+func v1Error(w http.ResponseWriter, status int, code, message string) {
+	writeV1(w, status, &api.KVResponse{Error: &api.Error{Code: code, Message: message}})
+}
+
+// v1StoreError answers a request a store error failed, logging the errors
+// that are not the client's doing. It reports whether err was not nil.
+func v1StoreError(w http.ResponseWriter, method string, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrKeyspaceNotFound):
+		v1Error(w, http.StatusNotFound, api.ErrCodeKeyspaceNotFound, "keyspace not found")
+	case errors.Is(err, ErrInvalidKeyspace):
+		v1Error(w, http.StatusBadRequest, api.ErrCodeInvalidArgument, "invalid keyspace")
+	case errors.Is(err, ErrQuotaExceeded):
+		v1Error(w, http.StatusInsufficientStorage, api.ErrCodeQuotaExceeded, "keyspace quota exceeded")
+	case errors.Is(err, ErrNoSpace):
+		v1Error(w, http.StatusInsufficientStorage, api.ErrCodeNoSpace, "no space left on the data directory of a member")
+	case errors.Is(err, raftnode.ErrProposalDeferred):
+		w.Header().Set("Retry-After", "1")
+		v1Error(w, http.StatusServiceUnavailable, api.ErrCodeUnavailable, "proposal deferred, WAL appends are slow")
+	case errors.Is(err, raftnode.ErrApplyBacklog):
+		w.Header().Set("Retry-After", "1")
+		v1Error(w, http.StatusServiceUnavailable, api.ErrCodeUnavailable, "proposal rejected, applying the committed entries lags behind")
+	case errors.Is(err, ErrShardMoved):
+		w.Header().Set("Retry-After", "1")
+		v1Error(w, http.StatusServiceUnavailable, api.ErrCodeUnavailable, "shard moved to another raft group")
+	case errors.Is(err, ErrValidationFailed), errors.Is(err, transform.ErrRejected):
+		v1Error(w, http.StatusUnprocessableEntity, api.ErrCodeValidationFailed, err.Error())
+	default:
+		log.Printf("Failed on %s (%v)\n", method, err)
+		v1Error(w, http.StatusInternalServerError, api.ErrCodeInternal, "failed on "+method)
+	}
+	return true
+}
+
+// serveV1KV handles /v1/kv/<key>. Unlike the legacy endpoints the key is
+// the unescaped path after /v1/kv, without the query, and the requests and
+// responses are JSON api.KVResponse envelopes.
+func (h *httpKVAPI) serveV1KV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv")
+	space := keyspaceOf(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		if err := h.readBarrier(w, r); errors.Is(err, errInvalidStaleness) {
+			v1Error(w, http.StatusBadRequest, api.ErrCodeInvalidArgument, "invalid maxStaleness")
+			return
+		} else if err != nil {
+			log.Printf("Failed to read on GET (%v)\n", err)
+			v1Error(w, http.StatusServiceUnavailable, api.ErrCodeUnavailable, "linearizable read failed")
+			return
+		}
+		kv, rev, err := h.store.GetIn(space, key)
+		if v1StoreError(w, r.Method, err) {
+			return
+		}
+		resp := &api.KVResponse{Header: api.ResponseHeader{Revision: rev}, KV: kv}
+		if kv == nil {
+			resp.Error = &api.Error{Code: api.ErrCodeKeyNotFound, Message: "key not found"}
+			writeV1(w, http.StatusNotFound, resp)
+			return
+		}
+		writeV1(w, http.StatusOK, resp)
+	case http.MethodPut:
+		var req api.KVPutRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxV1Body)).Decode(&req); err != nil {
+			v1Error(w, http.StatusBadRequest, api.ErrCodeInvalidArgument, "invalid body: "+err.Error())
+			return
+		}
+		kv, prev, err := h.store.PutKV(proposalCtx(r), key, req.Value)
+		if v1StoreError(w, r.Method, err) {
+			return
+		}
+		resp := &api.KVResponse{Header: api.ResponseHeader{Revision: kv.ModRevision}, KV: kv}
+		if req.PrevKV {
+			resp.PrevKV = prev
+		}
+		writeV1(w, http.StatusOK, resp)
+	case http.MethodDelete:
+		prev, rev, err := h.store.DeleteKV(proposalCtx(r), key)
+		if v1StoreError(w, r.Method, err) {
+			return
+		}
+		resp := &api.KVResponse{Header: api.ResponseHeader{Revision: rev}}
+		if prev == nil {
+			resp.Error = &api.Error{Code: api.ErrCodeKeyNotFound, Message: "key not found"}
+			writeV1(w, http.StatusNotFound, resp)
+			return
+		}
+		resp.Deleted = 1
+		if withPrev, _ := strconv.ParseBool(r.URL.Query().Get("prevKv")); withPrev {
+			resp.PrevKV = prev
+		}
+		writeV1(w, http.StatusOK, resp)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPut)
+		w.Header().Add("Allow", http.MethodDelete)
+		v1Error(w, http.StatusMethodNotAllowed, api.ErrCodeMethodNotAllowed, "method not allowed")
+	}
+}
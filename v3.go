@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"metcd/api"
+	"metcd/raftnode"
+	"metcd/transform"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// The /v3 endpoints speak the JSON of the etcd v3 gateway, so tools written
+// against etcd's /v3/kv/* work unchanged. metcd has no gRPC services behind
+// them, the requests are served from the store like the other endpoints.
+// The messages follow the proto3 JSON mapping: keys and values are base64,
+// 64 bit integers are strings and fields at their zero value are omitted.
+
+// maxV3Body bounds the body of a /v3 request.
+const maxV3Body = 64 << 20
+
+// ErrRevisionUnavailable is returned for a read at an older revision of keys
+// that changed since.
+var ErrRevisionUnavailable = errors.New("metcd: the keys changed after the revision")
+
+// gRPC status codes of the errors of /v3 requests.
+const (
+	v3CodeInvalidArgument   = 3
+	v3CodeNotFound          = 5
+	v3CodeResourceExhausted = 8
+	v3CodeOutOfRange        = 11
+	v3CodeUnimplemented     = 12
+	v3CodeInternal          = 13
+	v3CodeUnavailable       = 14
+)
+
+// v3Int is an int64 in the proto3 JSON mapping: written as a string, read
+// from a string or a number.
+type v3Int int64
+
+func (i v3Int) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(strconv.FormatInt(int64(i), 10))), nil
+}
+
+func (i *v3Int) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid int64 %s", b)
+	}
+	*i = v3Int(n)
+	return nil
+}
+
+type v3Header struct {
+	MemberID v3Int `json:"member_id,omitempty"`
+	Revision v3Int `json:"revision,omitempty"`
+}
+
+type v3KeyValue struct {
+	Key            []byte `json:"key,omitempty"`
+	CreateRevision v3Int  `json:"create_revision,omitempty"`
+	ModRevision    v3Int  `json:"mod_revision,omitempty"`
+	Version        v3Int  `json:"version,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+}
+
+// v3RangeRequest is etcd's RangeRequest. Continue, which etcd does not
+// have, is the token of the next page a limited response returned.
+type v3RangeRequest struct {
+	Key          []byte `json:"key"`
+	RangeEnd     []byte `json:"range_end"`
+	Limit        v3Int  `json:"limit"`
+	Revision     v3Int  `json:"revision"`
+	Serializable bool   `json:"serializable"`
+	KeysOnly     bool   `json:"keys_only"`
+	CountOnly    bool   `json:"count_only"`
+	Continue     string `json:"continue,omitempty"`
+}
+
+type v3RangeResponse struct {
+	Header   v3Header      `json:"header"`
+	Kvs      []*v3KeyValue `json:"kvs,omitempty"`
+	More     bool          `json:"more,omitempty"`
+	Count    v3Int         `json:"count,omitempty"`
+	Continue string        `json:"continue,omitempty"`
+}
+
+type v3PutRequest struct {
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value"`
+	PrevKv bool   `json:"prev_kv"`
+}
+
+type v3PutResponse struct {
+	Header v3Header    `json:"header"`
+	PrevKv *v3KeyValue `json:"prev_kv,omitempty"`
+}
+
+type v3DeleteRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+	PrevKv   bool   `json:"prev_kv"`
+}
+
+type v3DeleteRangeResponse struct {
+	Header  v3Header      `json:"header"`
+	Deleted v3Int         `json:"deleted,omitempty"`
+	PrevKvs []*v3KeyValue `json:"prev_kvs,omitempty"`
+}
+
+// v3Compare is a compare of a txn. The zero result is EQUAL and the zero
+// target VERSION, as in proto3.
+type v3Compare struct {
+	Result         string `json:"result"`
+	Target         string `json:"target"`
+	Key            []byte `json:"key"`
+	Version        v3Int  `json:"version"`
+	CreateRevision v3Int  `json:"create_revision"`
+	ModRevision    v3Int  `json:"mod_revision"`
+	Value          []byte `json:"value"`
+	RangeEnd       []byte `json:"range_end"`
+}
+
+type v3RequestOp struct {
+	RequestRange       *v3RangeRequest       `json:"request_range,omitempty"`
+	RequestPut         *v3PutRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *v3DeleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type v3TxnRequest struct {
+	Compare []v3Compare   `json:"compare"`
+	Success []v3RequestOp `json:"success"`
+	Failure []v3RequestOp `json:"failure"`
+}
+
+type v3ResponseOp struct {
+	ResponseRange       *v3RangeResponse       `json:"response_range,omitempty"`
+	ResponsePut         *v3PutResponse         `json:"response_put,omitempty"`
+	ResponseDeleteRange *v3DeleteRangeResponse `json:"response_delete_range,omitempty"`
+}
+
+type v3TxnResponse struct {
+	Header    v3Header       `json:"header"`
+	Succeeded bool           `json:"succeeded,omitempty"`
+	Responses []v3ResponseOp `json:"responses,omitempty"`
+}
+
+// v3Error is the body of a failed /v3 request, as the gateway writes it.
+type v3Error struct {
+	Error   string `json:"error"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// inRange reports whether k is in the range of key and end, as etcd
+// defines it: key itself if end is empty, every key from key on if end is
+// "\x00", and the keys from key up to end otherwise. A key of "\x00" starts
+// at the first key.
+func inRange(k, key, end string) bool {
+	switch {
+	case end == "":
+		return k == key
+	case key == "\x00" && end == "\x00":
+		return true
+	case end == "\x00":
+		return k >= key
+	case key == "\x00":
+		return k < end
+	default:
+		return k >= key && k < end
+	}
+}
+
+// rangeKeys returns the keys in the range of key and end, sorted. It must
+// be called with s.mu held.
+func (ks *keyspace) rangeKeys(key, end string) []string {
+	if end == "" {
+		if _, ok := ks.kvStore[key]; ok {
+			return []string{key}
+		}
+		return nil
+	}
+	var keys []string
+	for k := range ks.kvStore {
+		if inRange(k, key, end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RangeIn returns the first limit pairs, all if limit is 0, in the range of
+// key and end in the keyspace called name, with the number of pairs in the
+// range and the revision of the keyspace.
+func (s *kvstore) RangeIn(name, key, end string, limit int) ([]*api.KeyValue, int, int64, error) {
+	return s.RangeAt(name, key, end, 0, "", limit)
+}
+
+// RangeAt is RangeIn at the revision rev, the current one if 0, for the
+// keys of the range from the key from on. The count is that of the whole
+// range at rev. There is no history of the values, so an older revision is
+// read from the current pairs, leaving out the keys created after it: it
+// fails with ErrRevisionUnavailable if one of the keys read changed after
+// rev, and with a *compactedError if the changes after rev are no longer
+// kept to tell.
+func (s *kvstore) RangeAt(name, key, end string, rev int64, from string, limit int) ([]*api.KeyValue, int, int64, error) {
+	s.mu.RLock()
+	ks, err := s.space(name)
+	if err != nil {
+		s.mu.RUnlock()
+		return nil, 0, 0, err
+	}
+	var changed map[string]bool
+	switch {
+	case rev == 0 || rev == ks.rev:
+		rev = ks.rev
+	case rev > ks.rev:
+		s.mu.RUnlock()
+		return nil, 0, 0, ErrFutureRev
+	case rev < ks.compactRev:
+		s.mu.RUnlock()
+		return nil, 0, 0, &compactedError{rev: ks.compactRev}
+	default:
+		changed, err = ks.watchers.changedSince(rev, func(k string) bool { return inRange(k, key, end) })
+		for k, existed := range changed {
+			if existed && k >= from {
+				err = ErrRevisionUnavailable
+			}
+		}
+		if err != nil {
+			s.mu.RUnlock()
+			return nil, 0, 0, err
+		}
+	}
+	// the keys before from count as they were at rev
+	count := 0
+	for _, existed := range changed {
+		if existed {
+			count++
+		}
+	}
+	var keys []string
+	for _, k := range ks.rangeKeys(key, end) {
+		if _, ok := changed[k]; ok {
+			continue
+		}
+		count++
+		if k >= from {
+			keys = append(keys, k)
+		}
+	}
+	if limit > 0 && limit < len(keys) {
+		keys = keys[:limit]
+	}
+	kvs := make([]*api.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, ks.get(k))
+	}
+	s.mu.RUnlock()
+	for _, kv := range kvs {
+		s.hotKeys.read(name, kv.Key, len(kv.Value))
+	}
+	for i, kv := range kvs {
+		if kvs[i], err = s.openKV(kv); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return kvs, count, rev, nil
+}
+
+// DeleteRange removes the keys in the range of key and end at once, and
+// returns the removed pairs and the revision of the keyspace after.
+func (s *kvstore) DeleteRange(ctx context.Context, key, end string) ([]*api.KeyValue, int64, error) {
+	res, err := s.propose(ctx, kv{Op: opDeleteRange, Key: key, RangeEnd: end})
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.err != nil {
+		return nil, 0, res.err
+	}
+	prevs := make([]*api.KeyValue, len(res.prevs))
+	for i, kv := range res.prevs {
+		if prevs[i], err = s.openKV(kv); err != nil {
+			return nil, 0, err
+		}
+	}
+	return prevs, res.rev, nil
+}
+
+func toV3KV(kv *api.KeyValue, keysOnly bool) *v3KeyValue {
+	out := &v3KeyValue{Key: []byte(kv.Key), CreateRevision: v3Int(kv.CreateRevision),
+		ModRevision: v3Int(kv.ModRevision), Version: v3Int(kv.Version)}
+	if !keysOnly {
+		out.Value = []byte(kv.Value)
+	}
+	return out
+}
+
+// writeV3Error answers a failed /v3 request with the gRPC code of the error.
+func writeV3Error(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v3Error{Error: message, Code: code, Message: message})
+}
+
+// v3StoreError answers a request a store error failed, reporting whether err
+// was not nil.
+func v3StoreError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrKeyspaceNotFound):
+		writeV3Error(w, http.StatusNotFound, v3CodeNotFound, "keyspace not found")
+	case errors.Is(err, ErrInvalidKeyspace):
+		writeV3Error(w, http.StatusBadRequest, v3CodeInvalidArgument, "invalid keyspace")
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrNoSpace):
+		writeV3Error(w, http.StatusInsufficientStorage, v3CodeResourceExhausted, "etcdserver: mvcc: database space exceeded")
+	case errors.Is(err, raftnode.ErrProposalDeferred), errors.Is(err, raftnode.ErrApplyBacklog):
+		w.Header().Set("Retry-After", "1")
+		writeV3Error(w, http.StatusServiceUnavailable, v3CodeUnavailable, "etcdserver: too many requests")
+	case errors.Is(err, ErrValidationFailed), errors.Is(err, transform.ErrRejected):
+		writeV3Error(w, http.StatusBadRequest, v3CodeInvalidArgument, err.Error())
+	case errors.Is(err, ErrRevisionUnavailable), errors.Is(err, ErrCompacted):
+		// what etcd answers for a compacted revision, so clients start over
+		writeV3Error(w, http.StatusBadRequest, v3CodeOutOfRange, "etcdserver: mvcc: required revision has been compacted")
+	case errors.Is(err, ErrFutureRev):
+		writeV3Error(w, http.StatusBadRequest, v3CodeOutOfRange, "etcdserver: mvcc: required revision is a future revision")
+	default:
+		log.Printf("Failed on /v3 (%v)\n", err)
+		writeV3Error(w, http.StatusInternalServerError, v3CodeInternal, err.Error())
+	}
+	return true
+}
+
+// serveV3 handles POST /v3/kv/range, /v3/kv/put, /v3/kv/deleterange and
+// /v3/kv/txn.
+func (h *httpKVAPI) serveV3(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeV3Error(w, http.StatusMethodNotAllowed, v3CodeUnimplemented, "Method Not Allowed")
+		return
+	}
+	var req interface{}
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		req = &v3RangeRequest{}
+	case "/v3/kv/put":
+		req = &v3PutRequest{}
+	case "/v3/kv/deleterange":
+		req = &v3DeleteRangeRequest{}
+	case "/v3/kv/txn":
+		req = &v3TxnRequest{}
+	default:
+		writeV3Error(w, http.StatusNotFound, v3CodeNotFound, "Not Found")
+		return
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxV3Body)).Decode(req); err != nil {
+		writeV3Error(w, http.StatusBadRequest, v3CodeInvalidArgument, err.Error())
+		return
+	}
+	var (
+		resp interface{}
+		err  error
+	)
+	switch req := req.(type) {
+	case *v3RangeRequest:
+		resp, err = h.v3Range(r, req)
+	case *v3PutRequest:
+		resp, err = h.v3Put(r, req)
+	case *v3DeleteRangeRequest:
+		resp, err = h.v3DeleteRange(r, req)
+	case *v3TxnRequest:
+		resp, err = h.v3Txn(r, req)
+	}
+	var status v3Status
+	if errors.As(err, &status) {
+		writeV3Error(w, status.status, status.code, status.msg)
+		return
+	} else if v3StoreError(w, err) {
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// v3Status fails a /v3 request with an HTTP status and a gRPC code.
+type v3Status struct {
+	status, code int
+	msg          string
+}
+
+func (e v3Status) Error() string { return e.msg }
+
+func invalidV3(msg string) error { return v3Status{http.StatusBadRequest, v3CodeInvalidArgument, msg} }
+
+func unimplementedV3(msg string) error {
+	return v3Status{http.StatusNotImplemented, v3CodeUnimplemented, msg}
+}
+
+func (h *httpKVAPI) header(rev int64) v3Header {
+	return v3Header{MemberID: v3Int(h.rc.ID()), Revision: v3Int(rev)}
+}
+
+func (h *httpKVAPI) v3Range(r *http.Request, req *v3RangeRequest) (*v3RangeResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, invalidV3("etcdserver: key is not provided")
+	}
+	space := keyspaceOf(r.Context())
+	if !req.Serializable {
+		setPhase(r.Context(), phaseReadIndex)
+		if err := h.rc.LinearizableReadNotify(r.Context()); err != nil {
+			log.Printf("Failed to read on range (%v)\n", err)
+			return nil, v3Status{http.StatusServiceUnavailable, v3CodeUnavailable, "etcdserver: leader changed"}
+		}
+	}
+	// the pages after the first read at its revision, from the key after
+	// the last one it returned
+	rev, from := int64(req.Revision), ""
+	if req.Continue != "" {
+		token, err := parsePageToken(req.Continue)
+		var next []byte
+		if err == nil {
+			next, err = base64.StdEncoding.DecodeString(token.Next)
+		}
+		if err != nil || (rev != 0 && rev != token.Rev) {
+			return nil, invalidV3("metcd: invalid continue token")
+		}
+		rev, from = token.Rev, string(next)
+	}
+	// one more pair than the limit tells whether there are more
+	limit := int(req.Limit)
+	if limit > 0 {
+		limit++
+	}
+	kvs, count, rev, err := h.store.RangeAt(space, string(req.Key), string(req.RangeEnd), rev, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	resp := &v3RangeResponse{Header: h.header(rev), Count: v3Int(count)}
+	if req.Limit > 0 && len(kvs) > int(req.Limit) {
+		kvs, resp.More = kvs[:req.Limit], true
+	}
+	if !req.CountOnly {
+		for _, kv := range kvs {
+			resp.Kvs = append(resp.Kvs, toV3KV(kv, req.KeysOnly))
+		}
+		if resp.More {
+			next := kvs[len(kvs)-1].Key + "\x00"
+			resp.Continue = pageToken{Rev: rev, Next: base64.StdEncoding.EncodeToString([]byte(next))}.String()
+		}
+	}
+	return resp, nil
+}
+
+func (h *httpKVAPI) v3Put(r *http.Request, req *v3PutRequest) (*v3PutResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, invalidV3("etcdserver: key is not provided")
+	}
+	kv, prev, err := h.store.PutKV(proposalCtx(r), string(req.Key), string(req.Value))
+	if err != nil {
+		return nil, err
+	}
+	resp := &v3PutResponse{Header: h.header(kv.ModRevision)}
+	if req.PrevKv && prev != nil {
+		resp.PrevKv = toV3KV(prev, false)
+	}
+	return resp, nil
+}
+
+func (h *httpKVAPI) v3DeleteRange(r *http.Request, req *v3DeleteRangeRequest) (*v3DeleteRangeResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, invalidV3("etcdserver: key is not provided")
+	}
+	prevs, rev, err := h.store.DeleteRange(proposalCtx(r), string(req.Key), string(req.RangeEnd))
+	if err != nil {
+		return nil, err
+	}
+	resp := &v3DeleteRangeResponse{Header: h.header(rev), Deleted: v3Int(len(prevs))}
+	if req.PrevKv {
+		for _, kv := range prevs {
+			resp.PrevKvs = append(resp.PrevKvs, toV3KV(kv, false))
+		}
+	}
+	return resp, nil
+}
+
+// v3Results maps the v3 compare results to metcd's.
+var v3Results = map[string]api.CompareResult{
+	"": api.CompareEqual, "EQUAL": api.CompareEqual, "NOT_EQUAL": api.CompareNotEqual,
+	"GREATER": api.CompareGreater, "LESS": api.CompareLess,
+}
+
+// toTxn converts a v3 txn into a metcd one. Its compares and operations
+// address single keys, ranges are not supported inside transactions.
+func toTxn(req *v3TxnRequest) (*api.TxnRequest, error) {
+	unsupported := unimplementedV3("metcd: ranges are not supported in transactions")
+	txn := &api.TxnRequest{}
+	for _, c := range req.Compare {
+		result, ok := v3Results[c.Result]
+		if !ok {
+			return nil, invalidV3(fmt.Sprintf("invalid compare result %q", c.Result))
+		}
+		if len(c.RangeEnd) > 0 {
+			return nil, unsupported
+		}
+		cmp := api.Compare{Result: result, Key: string(c.Key)}
+		switch c.Target {
+		case "", "VERSION":
+			cmp.Target, cmp.Value = api.CompareVersion, strconv.FormatInt(int64(c.Version), 10)
+		case "CREATE":
+			cmp.Target, cmp.Value = api.CompareCreate, strconv.FormatInt(int64(c.CreateRevision), 10)
+		case "MOD":
+			cmp.Target, cmp.Value = api.CompareMod, strconv.FormatInt(int64(c.ModRevision), 10)
+		case "VALUE":
+			cmp.Target, cmp.Value = api.CompareValue, string(c.Value)
+		default:
+			return nil, invalidV3(fmt.Sprintf("invalid compare target %q", c.Target))
+		}
+		txn.Compare = append(txn.Compare, cmp)
+	}
+	for _, branch := range []struct {
+		in  []v3RequestOp
+		out *[]api.Op
+	}{{req.Success, &txn.Success}, {req.Failure, &txn.Failure}} {
+		for _, op := range branch.in {
+			switch {
+			case op.RequestRange != nil && len(op.RequestRange.RangeEnd) == 0:
+				*branch.out = append(*branch.out, api.Op{Type: api.OpGet, Key: string(op.RequestRange.Key)})
+			case op.RequestPut != nil:
+				*branch.out = append(*branch.out, api.Op{Type: api.OpPut, Key: string(op.RequestPut.Key), Value: string(op.RequestPut.Value)})
+			case op.RequestDeleteRange != nil && len(op.RequestDeleteRange.RangeEnd) == 0:
+				*branch.out = append(*branch.out, api.Op{Type: api.OpDelete, Key: string(op.RequestDeleteRange.Key)})
+			case op.RequestRange != nil || op.RequestDeleteRange != nil:
+				return nil, unsupported
+			default:
+				return nil, invalidV3("etcdserver: requested operation is empty")
+			}
+		}
+	}
+	return txn, nil
+}
+
+func (h *httpKVAPI) v3Txn(r *http.Request, req *v3TxnRequest) (*v3TxnResponse, error) {
+	txn, err := toTxn(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.store.Txn(proposalCtx(r), txn)
+	if err != nil {
+		return nil, err
+	}
+	// the revision of the keyspace once the txn is applied, later writes
+	// may have bumped it already
+	rev, err := h.store.RevIn(keyspaceOf(r.Context()))
+	if err != nil {
+		return nil, err
+	}
+	header := h.header(rev)
+	out := &v3TxnResponse{Header: header, Succeeded: resp.Succeeded}
+	for _, op := range resp.Responses {
+		switch op.Type {
+		case api.OpGet:
+			rr := &v3RangeResponse{Header: header}
+			if op.Found {
+				rr.Kvs, rr.Count = []*v3KeyValue{{Key: []byte(op.Key), Value: []byte(op.Value)}}, 1
+			}
+			out.Responses = append(out.Responses, v3ResponseOp{ResponseRange: rr})
+		case api.OpPut:
+			out.Responses = append(out.Responses, v3ResponseOp{ResponsePut: &v3PutResponse{Header: header}})
+		case api.OpDelete:
+			dr := &v3DeleteRangeResponse{Header: header}
+			if op.Found {
+				dr.Deleted = 1
+			}
+			out.Responses = append(out.Responses, v3ResponseOp{ResponseDeleteRange: dr})
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"metcd/api"
+	"reflect"
+	"testing"
+)
+
+func TestInRange(t *testing.T) {
+	for _, tt := range []struct {
+		k, key, end string
+		in          bool
+	}{
+		{"/a", "/a", "", true},
+		{"/ab", "/a", "", false},
+		{"/ab", "/a", "/b", true},
+		{"/b", "/a", "/b", false},
+		{"/z", "/a", "\x00", true},
+		{"/", "/a", "\x00", false},
+		{"/", "\x00", "/b", true},
+		{"/z", "\x00", "\x00", true},
+	} {
+		if got := inRange(tt.k, tt.key, tt.end); got != tt.in {
+			t.Errorf("inRange(%q, %q, %q) = %v, expected %v", tt.k, tt.key, tt.end, got, tt.in)
+		}
+	}
+}
+
+func TestV3Int(t *testing.T) {
+	var req v3RangeRequest
+	if err := json.Unmarshal([]byte(`{"limit":10,"revision":"42"}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Limit != 10 || req.Revision != 42 {
+		t.Fatalf("expected 10 and 42, got %d and %d", req.Limit, req.Revision)
+	}
+	if err := json.Unmarshal([]byte(`{"limit":"x"}`), &req); err == nil {
+		t.Fatal("expected an error for a non-integer limit")
+	}
+	b, _ := json.Marshal(v3Header{MemberID: 1, Revision: 1 << 60})
+	if want := `{"member_id":"1","revision":"1152921504606846976"}`; string(b) != want {
+		t.Fatalf("expected %s, got %s", want, b)
+	}
+}
+
+func TestToTxn(t *testing.T) {
+	var req v3TxnRequest
+	in := `{"compare":[{"key":"L2E=","mod_revision":"3","target":"MOD","result":"LESS"},{"key":"L2E="}],
+		"success":[{"request_put":{"key":"L2E=","value":"MQ=="}},{"request_delete_range":{"key":"L2I="}}],
+		"failure":[{"request_range":{"key":"L2E="}}]}`
+	if err := json.Unmarshal([]byte(in), &req); err != nil {
+		t.Fatal(err)
+	}
+	txn, err := toTxn(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &api.TxnRequest{
+		Compare: []api.Compare{
+			{Target: api.CompareMod, Result: api.CompareLess, Key: "/a", Value: "3"},
+			// the zero compare is version = 0, the key does not exist
+			{Target: api.CompareVersion, Result: api.CompareEqual, Key: "/a", Value: "0"},
+		},
+		Success: []api.Op{{Type: api.OpPut, Key: "/a", Value: "1"}, {Type: api.OpDelete, Key: "/b"}},
+		Failure: []api.Op{{Type: api.OpGet, Key: "/a"}},
+	}
+	if !reflect.DeepEqual(txn, want) {
+		t.Fatalf("expected %+v, got %+v", want, txn)
+	}
+
+	for _, in := range []string{
+		`{"compare":[{"key":"L2E=","result":"ABOUT"}]}`,
+		`{"success":[{"request_range":{"key":"L2E=","range_end":"L2I="}}]}`,
+		`{"success":[{}]}`,
+	} {
+		var req v3TxnRequest
+		json.Unmarshal([]byte(in), &req)
+		if _, err := toTxn(&req); err == nil {
+			t.Errorf("expected an error converting %s", in)
+		}
+	}
+}
+
+func Test_kvstore_deleteRange(t *testing.T) {
+	s := newTestKVStore(map[string]string{"/a": "1", "/b/1": "2", "/b/2": "3", "/c": "4"})
+	events, cancel := s.watchers.watch("/", true)
+	defer cancel()
+
+	res := s.apply(kv{Op: opDeleteRange, Key: "/b/", RangeEnd: "/b0"})
+	want := []*api.KeyValue{{Key: "/b/1", Value: "2"}, {Key: "/b/2", Value: "3"}}
+	if !reflect.DeepEqual(res.prevs, want) || res.rev != 1 {
+		t.Fatalf("expected %+v deleted at 1, got %+v at %d", want, res.prevs, res.rev)
+	}
+	for _, k := range []string{"/b/1", "/b/2"} {
+		if ev := <-events; ev != (api.Event{Type: api.EventDelete, Key: k, ModRevision: 1}) {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	}
+	kvs, count, rev, _ := s.RangeIn("", "\x00", "\x00", 1)
+	if count != 2 || rev != 1 || !reflect.DeepEqual(kvs, []*api.KeyValue{{Key: "/a", Value: "1"}}) {
+		t.Fatalf("expected /a of 2 keys at 1, got %+v of %d at %d", kvs, count, rev)
+	}
+	// deleting nothing is no revision
+	if res := s.apply(kv{Op: opDeleteRange, Key: "/x", RangeEnd: "\x00"}); len(res.prevs) != 0 || res.rev != 1 {
+		t.Fatalf("expected nothing deleted at 1, got %+v at %d", res.prevs, res.rev)
+	}
+}
+
+func Test_kvstore_RangeAt(t *testing.T) {
+	s := newTestKVStore(nil)
+	for _, k := range []string{"/a", "/b", "/c", "/d"} {
+		s.apply(kv{Op: opPut, Key: k, Val: k})
+	}
+	kvs, count, rev, err := s.RangeAt("", "/", "\x00", 0, "", 2)
+	if err != nil || count != 4 || rev != 4 || len(kvs) != 2 || kvs[1].Key != "/b" {
+		t.Fatalf("expected the first 2 of 4 keys at 4, got %+v of %d at %d, %v", kvs, count, rev, err)
+	}
+	// changes before the next page leave it at the revision of the first,
+	// counting the whole range as it was then
+	s.apply(kv{Op: opPut, Key: "/a", Val: "changed"})
+	s.apply(kv{Op: opDelete, Key: "/b"})
+	s.apply(kv{Op: opPut, Key: "/a0", Val: "new"})
+	kvs, count, rev, err = s.RangeAt("", "/", "\x00", 4, "/b\x00", 2)
+	if err != nil || count != 4 || rev != 4 || len(kvs) != 2 || kvs[0].Key != "/c" {
+		t.Fatalf("expected the last 2 of 4 keys at 4, got %+v of %d at %d, %v", kvs, count, rev, err)
+	}
+	s.apply(kv{Op: opDelete, Key: "/d"})
+	if _, _, _, err := s.RangeAt("", "/", "\x00", 4, "/b\x00", 2); !errors.Is(err, ErrRevisionUnavailable) {
+		t.Fatalf("expected a key not listed yet changed since, got %v", err)
+	}
+	if _, _, _, err := s.RangeAt("", "/", "\x00", 9, "", 0); !errors.Is(err, ErrFutureRev) {
+		t.Fatalf("expected a future revision, got %v", err)
+	}
+}
+
+func Test_kvstore_RangeAtCompacted(t *testing.T) {
+	defer func(size int) { watchHistorySize = size }(watchHistorySize)
+	watchHistorySize = 3
+	s := newTestKVStore(nil)
+	for _, k := range []string{"/a", "/b", "/c", "/d"} {
+		s.apply(kv{Op: opPut, Key: k, Val: k})
+	}
+	// an older revision reads the keys unchanged since, without those
+	// created after it
+	s.apply(kv{Op: opPut, Key: "/z", Val: "z"})
+	kvs, count, rev, err := s.RangeAt("", "/a", "/e", 3, "", 0)
+	if err != nil || count != 3 || rev != 3 || len(kvs) != 3 || kvs[2].Key != "/c" {
+		t.Fatalf("expected the 3 keys at 3, got %+v of %d at %d, %v", kvs, count, rev, err)
+	}
+	// the changes after 1 are no longer all kept to tell
+	if _, _, _, err := s.RangeAt("", "/a", "/e", 1, "", 0); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected a revision older than the watch history compacted, got %v", err)
+	}
+	if err := s.apply(kv{Op: opCompact, Rev: 4}).err; err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.RangeAt("", "/a", "/e", 3, "", 0); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected a compacted revision, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"metcd/api"
+	"metcd/schema"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrSchemaNotFound   = errors.New("metcd: prefix has no schema")
+	ErrValidationFailed = errors.New("metcd: value does not match the schema")
+)
+
+// keySchema is the JSON Schema the values under a prefix are validated
+// against, as written and compiled.
+type keySchema struct {
+	raw      string
+	compiled *schema.Schema
+}
+
+// PutSchema makes the values written under prefix in the keyspace of ctx
+// be validated against the JSON Schema doc before they are proposed.
+func (s *kvstore) PutSchema(ctx context.Context, prefix string, doc []byte) error {
+	if _, err := schema.Compile(doc); err != nil {
+		return err
+	}
+	res, err := s.propose(ctx, kv{Op: opSchemaPut, Key: prefix, Val: string(doc)})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// DeleteSchema stops validating the values under prefix in the keyspace of
+// ctx.
+func (s *kvstore) DeleteSchema(ctx context.Context, prefix string) error {
+	res, err := s.propose(ctx, kv{Op: opSchemaDelete, Key: prefix})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// Schemas returns the schemas of the keyspace called name, sorted by
+// prefix.
+func (s *kvstore) Schemas(name string) ([]api.Schema, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(name)
+	if err != nil {
+		return nil, err
+	}
+	out := []api.Schema{}
+	for prefix, sc := range ks.schemas {
+		out = append(out, api.Schema{Keyspace: name, Prefix: prefix, Schema: json.RawMessage(sc.raw)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Prefix < out[j].Prefix })
+	return out, nil
+}
+
+// validateProposal checks the values r writes against the schemas of their
+// prefixes, every one that matches. The values already stored are not, so
+// a schema only applies to the writes proposed after it.
+func (s *kvstore) validateProposal(r kv) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ks, err := s.space(r.Keyspace)
+	if err != nil || len(ks.schemas) == 0 {
+		// a missing keyspace fails when the proposal is applied
+		return nil
+	}
+	switch r.Op {
+	case opPut:
+		return ks.validate(r.Key, r.Val)
+	case opTxn:
+		if r.Txn == nil {
+			return nil
+		}
+		for _, ops := range [][]api.Op{r.Txn.Success, r.Txn.Failure} {
+			for _, op := range ops {
+				if op.Type != api.OpPut {
+					continue
+				}
+				if err := ks.validate(op.Key, op.Value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validate must be called with s.mu held.
+func (ks *keyspace) validate(k, v string) error {
+	for prefix, sc := range ks.schemas {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if err := sc.compiled.Validate([]byte(v)); err != nil {
+			return fmt.Errorf("%w of %s for %s: %v", ErrValidationFailed, prefix, k, err)
+		}
+	}
+	return nil
+}
+
+// applySchema applies opSchemaPut or opSchemaDelete. It must be called with
+// s.mu held.
+func (ks *keyspace) applySchema(r kv) error {
+	if r.Op == opSchemaDelete {
+		if _, ok := ks.schemas[r.Key]; !ok {
+			return ErrSchemaNotFound
+		}
+		delete(ks.schemas, r.Key)
+		return nil
+	}
+	compiled, err := schema.Compile([]byte(r.Val))
+	if err != nil {
+		return err
+	}
+	ks.schemas[r.Key] = keySchema{raw: r.Val, compiled: compiled}
+	return nil
+}
+
+// schemaList returns the schemas of ks for a snapshot, by prefix. It must
+// be called with s.mu held.
+func (ks *keyspace) schemaList() map[string]string {
+	if len(ks.schemas) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(ks.schemas))
+	for prefix, sc := range ks.schemas {
+		out[prefix] = sc.raw
+	}
+	return out
+}
+
+// restoreSchemas replaces the schemas of ks by those of a snapshot. It must
+// be called with s.mu held.
+func (ks *keyspace) restoreSchemas(schemas map[string]string) error {
+	ks.schemas = make(map[string]keySchema, len(schemas))
+	for prefix, raw := range schemas {
+		compiled, err := schema.Compile([]byte(raw))
+		if err != nil {
+			return fmt.Errorf("cannot compile the schema of %s: %w", prefix, err)
+		}
+		ks.schemas[prefix] = keySchema{raw: raw, compiled: compiled}
+	}
+	return nil
+}
+
+// serveSchema handles /admin/schema: GET lists the schemas of the keyspace
+// of the request, PUT ?prefix=<prefix> sets the JSON Schema of the body
+// for a prefix and DELETE ?prefix=<prefix> removes it.
+func (h *httpKVAPI) serveSchema(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if r.Method != http.MethodGet && (prefix == "" || !strings.HasPrefix(prefix, "/")) {
+		http.Error(w, "Invalid prefix", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		schemas, err := h.store.Schemas(keyspaceOf(r.Context()))
+		if keyspaceError(w, err) {
+			return
+		}
+		writeJSON(w, schemas)
+	case http.MethodPut:
+		doc, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("Failed to read on PUT (%v)\n", err)
+			http.Error(w, "Failed on PUT", http.StatusBadRequest)
+			return
+		}
+		err = h.store.PutSchema(r.Context(), prefix, doc)
+		if errors.Is(err, schema.ErrInvalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose schema (%v)\n", err)
+			http.Error(w, "Failed on PUT", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		err := h.store.DeleteSchema(r.Context(), prefix)
+		if errors.Is(err, ErrSchemaNotFound) {
+			http.Error(w, "Prefix has no schema", http.StatusNotFound)
+			return
+		} else if keyspaceError(w, err) || proposalError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose schema removal (%v)\n", err)
+			http.Error(w, "Failed on DELETE", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPut)
+		w.Header().Add("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"metcd/api"
+	"metcd/schema"
+	"testing"
+)
+
+func TestValidateProposal(t *testing.T) {
+	s := newTestKVStore(nil)
+	doc := `{"type": "object", "required": ["port"], "properties": {"port": {"type": "integer"}}}`
+	if res := s.apply(kv{Op: opSchemaPut, Key: "/config/", Val: doc}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res := s.apply(kv{Op: opSchemaPut, Key: "/bad/", Val: `{"type": "text"}`}); !errors.Is(res.err, schema.ErrInvalid) {
+		t.Fatalf("expected an invalid schema to be refused, got %v", res.err)
+	}
+
+	if err := s.validateProposal(kv{Op: opPut, Key: "/config/db", Val: `{"port": 5432}`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.validateProposal(kv{Op: opPut, Key: "/config/db", Val: `{"port": "5432"}`}); !errors.Is(err, ErrValidationFailed) {
+		t.Fatalf("expected the value to be refused, got %v", err)
+	}
+	if err := s.validateProposal(kv{Op: opPut, Key: "/other", Val: "not json"}); err != nil {
+		t.Fatalf("expected the values outside the prefix not to be validated, got %v", err)
+	}
+	txn := &api.TxnRequest{Success: []api.Op{{Type: api.OpDelete, Key: "/config/a"}}, Failure: []api.Op{{Type: api.OpPut, Key: "/config/b", Value: "{}"}}}
+	if err := s.validateProposal(kv{Op: opTxn, Txn: txn}); !errors.Is(err, ErrValidationFailed) {
+		t.Fatalf("expected the puts of both branches to be validated, got %v", err)
+	}
+
+	// the schemas are kept in the snapshots
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if schemas, _ := restored.Schemas(""); len(schemas) != 1 || schemas[0].Prefix != "/config/" || string(schemas[0].Schema) != doc {
+		t.Fatalf("expected the schema to be restored, got %+v", schemas)
+	}
+	if err := restored.validateProposal(kv{Op: opPut, Key: "/config/db", Val: `{}`}); !errors.Is(err, ErrValidationFailed) {
+		t.Fatalf("expected the restored schema to be enforced, got %v", err)
+	}
+
+	if res := s.apply(kv{Op: opSchemaDelete, Key: "/nosuch/"}); !errors.Is(res.err, ErrSchemaNotFound) {
+		t.Fatalf("expected removing a missing schema to fail, got %v", res.err)
+	}
+	s.apply(kv{Op: opSchemaDelete, Key: "/config/"})
+	if err := s.validateProposal(kv{Op: opPut, Key: "/config/db", Val: `{}`}); err != nil {
+		t.Fatalf("expected the value to be accepted without the schema, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"metcd/api"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// maxVerifierResponse bounds the part of the response of a verifier passed
+// back to the caller of POST /admin/verify.
+const maxVerifierResponse = 64 << 10
+
+// verifyClient sends the state dumps of POST /admin/verify.
+var verifyClient = http.DefaultClient
+
+// writeKeyHashes writes a line of api.KeyHash per pair of kvs to w and
+// returns the hex SHA-256 of what it wrote.
+func writeKeyHashes(w io.Writer, kvs []api.KeyValue) (string, error) {
+	digest := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, digest))
+	enc := json.NewEncoder(bw)
+	for _, kv := range kvs {
+		sum := sha256.Sum256([]byte(kv.Value))
+		if err := enc.Encode(api.KeyHash{Key: kv.Key, Hash: hex.EncodeToString(sum[:])}); err != nil {
+			return "", err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// serveVerify handles POST /admin/verify?url=<verifier>, posting the keys
+// of the keyspace of the request with the hashes of their values, at a
+// single revision, to the verifier. Nothing is changed in the store.
+func (h *httpKVAPI) serveVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "Invalid verifier url", http.StatusBadRequest)
+		return
+	}
+	setPhase(r.Context(), phaseReadIndex)
+	if err := h.rc.LinearizableReadNotify(r.Context()); err != nil {
+		log.Printf("Failed to read on verify (%v)\n", err)
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+	name := keyspaceOf(r.Context())
+	kvs, rev, err := h.store.Export(name)
+	if keyspaceError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to export on verify (%v)\n", err)
+		http.Error(w, "Failed on POST", http.StatusInternalServerError)
+		return
+	}
+
+	pr, pw := io.Pipe()
+	digest := make(chan string, 1)
+	go func() {
+		sum, err := writeKeyHashes(pw, kvs)
+		digest <- sum
+		pw.CloseWithError(err)
+	}()
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, target.String(), pr)
+	if err != nil {
+		pr.Close()
+		http.Error(w, "Invalid verifier url", http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("X-Metcd-Revision", strconv.FormatInt(rev, 10))
+	if name != "" {
+		req.Header.Set("X-Metcd-Keyspace", name)
+	}
+	setPhase(r.Context(), phaseStreaming)
+	resp, err := verifyClient.Do(req)
+	// the verifier may answer before reading the whole dump
+	pr.Close()
+	if err != nil {
+		log.Printf("Failed to send the state to the verifier (%v)\n", err)
+		http.Error(w, "Failed to reach the verifier", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxVerifierResponse))
+	if err != nil {
+		log.Printf("Failed to read the response of the verifier (%v)\n", err)
+		http.Error(w, "Failed to reach the verifier", http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		http.Error(w, fmt.Sprintf("Verifier rejected revision %d with %s: %s", rev, resp.Status, bytes.TrimSpace(body)), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, api.VerifyResponse{Rev: rev, Keys: int64(len(kvs)), Digest: <-digest, Response: string(body)})
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"metcd/api"
+	"testing"
+)
+
+func TestWriteKeyHashes(t *testing.T) {
+	var buf bytes.Buffer
+	digest, err := writeKeyHashes(&buf, []api.KeyValue{{Key: "/a", Value: "1"}, {Key: "/b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"key":"/a","hash":"6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"}` + "\n" +
+		`{"key":"/b","hash":"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}` + "\n"
+	if buf.String() != want {
+		t.Fatalf("expected %s, got %s", want, buf.String())
+	}
+	if sum := sha256.Sum256(buf.Bytes()); digest != hex.EncodeToString(sum[:]) {
+		t.Fatalf("expected the digest of the lines, got %s", digest)
+	}
+}
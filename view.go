@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"metcd/api"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// snapshotViewTTL is how long a snapshot view is kept after it was last
+	// read.
+	snapshotViewTTL = 10 * time.Minute
+	// maxSnapshotViews bounds the snapshot views of a member, each a copy
+	// of a keyspace.
+	maxSnapshotViews = 4
+)
+
+var (
+	ErrViewNotFound = errors.New("metcd: snapshot view not found")
+	ErrTooManyViews = errors.New("metcd: too many snapshot views")
+)
+
+// snapshotView is a read-only copy of a keyspace frozen at a revision. Full
+// scans and large range listings run against it without holding the lock
+// of the store, so they do not hold up the apply loop.
+type snapshotView struct {
+	id       string
+	keyspace string
+	rev      int64
+	created  time.Time
+	kvs      map[string]string
+	revs     map[string]keyRevs
+	keys     []string // the keys of kvs, sorted
+	size     int64
+	expire   *time.Timer
+}
+
+// viewRegistry holds the snapshot views of a member.
+type viewRegistry struct {
+	mu    sync.Mutex
+	views map[string]*snapshotView
+	last  uint64 // id of the last view created
+}
+
+// CreateView freezes a copy of the keyspace called name. The store is
+// locked only while the pairs are copied.
+func (s *kvstore) CreateView(name string) (*snapshotView, error) {
+	s.views.mu.Lock()
+	full := len(s.views.views) >= maxSnapshotViews
+	s.views.mu.Unlock()
+	if full {
+		return nil, ErrTooManyViews
+	}
+	s.mu.RLock()
+	ks, err := s.space(name)
+	if err != nil {
+		s.mu.RUnlock()
+		return nil, err
+	}
+	v := &snapshotView{
+		keyspace: name,
+		rev:      ks.rev,
+		created:  time.Now(),
+		kvs:      make(map[string]string, len(ks.kvStore)),
+		revs:     make(map[string]keyRevs, len(ks.revs)),
+		size:     ks.size,
+	}
+	for k, val := range ks.kvStore {
+		v.kvs[k] = val
+	}
+	for k, revs := range ks.revs {
+		v.revs[k] = revs
+	}
+	s.mu.RUnlock()
+	v.keys = make([]string, 0, len(v.kvs))
+	for k := range v.kvs {
+		v.keys = append(v.keys, k)
+	}
+	sort.Strings(v.keys)
+
+	s.views.mu.Lock()
+	defer s.views.mu.Unlock()
+	if len(s.views.views) >= maxSnapshotViews {
+		return nil, ErrTooManyViews
+	}
+	if s.views.views == nil {
+		s.views.views = make(map[string]*snapshotView)
+	}
+	s.views.last++
+	v.id = strconv.FormatUint(s.views.last, 10)
+	s.views.views[v.id] = v
+	v.expire = time.AfterFunc(snapshotViewTTL, func() {
+		if s.DropView(v.id) {
+			log.Printf("snapshot view %s of keyspace %q expired", v.id, v.keyspace)
+		}
+	})
+	return v, nil
+}
+
+// View returns the snapshot view id and keeps it for another
+// snapshotViewTTL.
+func (s *kvstore) View(id string) (*snapshotView, error) {
+	s.views.mu.Lock()
+	defer s.views.mu.Unlock()
+	v, ok := s.views.views[id]
+	if !ok {
+		return nil, ErrViewNotFound
+	}
+	v.expire.Reset(snapshotViewTTL)
+	return v, nil
+}
+
+// Views returns the snapshot views sorted by creation.
+func (s *kvstore) Views() []api.View {
+	s.views.mu.Lock()
+	defer s.views.mu.Unlock()
+	views := make([]*snapshotView, 0, len(s.views.views))
+	for _, v := range s.views.views {
+		views = append(views, v)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].created.Before(views[j].created) })
+	infos := make([]api.View, len(views))
+	for i, v := range views {
+		infos[i] = v.info()
+	}
+	return infos
+}
+
+// DropView releases the snapshot view id, reporting whether it existed.
+func (s *kvstore) DropView(id string) bool {
+	s.views.mu.Lock()
+	defer s.views.mu.Unlock()
+	v, ok := s.views.views[id]
+	if ok {
+		v.expire.Stop()
+		delete(s.views.views, id)
+	}
+	return ok
+}
+
+func (v *snapshotView) info() api.View {
+	return api.View{ID: v.id, Keyspace: v.keyspace, Rev: v.rev, Keys: len(v.keys), Size: v.size, Created: v.created}
+}
+
+// rangeKeys returns the keys of v in the range of key and end, as
+// keyspace.rangeKeys does.
+func (v *snapshotView) rangeKeys(key, end string) []string {
+	if end == "" {
+		if _, ok := v.kvs[key]; ok {
+			return []string{key}
+		}
+		return nil
+	}
+	lo, hi := 0, len(v.keys)
+	if key != "\x00" {
+		lo = sort.SearchStrings(v.keys, key)
+	}
+	if end != "\x00" {
+		hi = sort.SearchStrings(v.keys, end)
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return v.keys[lo:hi]
+}
+
+// RangeView returns the first limit pairs, all if limit is 0, in the range
+// of key and end in view v from the key from on, with the number of pairs
+// in the range and the first key the limit left out, "" if none.
+func (s *kvstore) RangeView(v *snapshotView, key, end, from string, limit int) ([]*api.KeyValue, int, string, error) {
+	keys := v.rangeKeys(key, end)
+	count := len(keys)
+	keys = keys[sort.SearchStrings(keys, from):]
+	var next string
+	if limit > 0 && limit < len(keys) {
+		keys, next = keys[:limit], keys[limit]
+	}
+	kvs := make([]*api.KeyValue, len(keys))
+	for i, k := range keys {
+		revs := v.revs[k]
+		val, err := s.open(k, v.kvs[k])
+		if err != nil {
+			return nil, 0, "", err
+		}
+		kvs[i] = &api.KeyValue{Key: k, Value: val, CreateRevision: revs.Create, ModRevision: revs.Mod, Version: revs.Version,
+			ModTime: changeTime(revs.ModTime)}
+	}
+	return kvs, count, next, nil
+}
+
+// serveViews lists the snapshot views of the member on GET /views and
+// creates one of the keyspace of the request on POST /views. GET
+// /views/<id> describes a view and DELETE /views/<id> releases it;
+// GET /views/<id>/kv/<key> reads it, see serveViewRange.
+func (h *httpKVAPI) serveViews(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/views"), "/"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, h.store.Views())
+	case id == "" && r.Method == http.MethodPost:
+		// like /snapshot, the view has every change committed before the
+		// request
+		setPhase(r.Context(), phaseReadIndex)
+		if err := h.rc.LinearizableReadNotify(r.Context()); err != nil {
+			log.Printf("Failed to read on view creation (%v)\n", err)
+			http.Error(w, "Failed on POST", http.StatusBadRequest)
+			return
+		}
+		v, err := h.store.CreateView(keyspaceOf(r.Context()))
+		if keyspaceError(w, err) {
+			return
+		} else if errors.Is(err, ErrTooManyViews) {
+			http.Error(w, "Too many snapshot views", http.StatusTooManyRequests)
+			return
+		} else if err != nil {
+			log.Printf("Failed to create snapshot view (%v)\n", err)
+			http.Error(w, "Failed on POST", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", "/views/"+v.id)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, v.info())
+	case id != "" && rest == "" && r.Method == http.MethodGet:
+		v, err := h.store.View(id)
+		if err != nil {
+			http.Error(w, "Snapshot view not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, v.info())
+	case id != "" && rest == "" && r.Method == http.MethodDelete:
+		if !h.store.DropView(id) {
+			http.Error(w, "Snapshot view not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case id != "" && (rest == "kv" || strings.HasPrefix(rest, "kv/")) && r.Method == http.MethodGet:
+		h.serveViewRange(w, r, id, strings.TrimPrefix(rest, "kv"))
+	case rest != "" && rest != "kv" && !strings.HasPrefix(rest, "kv/"):
+		http.NotFound(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveViewRange handles GET /views/<id>/kv/<key>, the pair of key in the
+// view or, with ?prefix=true, the pairs of every key with that prefix; with
+// ?end=<key> the pairs from key up to end. ?limit= caps the number of pairs
+// and ?keysOnly=true leaves out the values. A limited range returns a
+// continue token, ?continue=<token> reads the next page from the same view.
+func (h *httpKVAPI) serveViewRange(w http.ResponseWriter, r *http.Request, id, key string) {
+	q := r.URL.Query()
+	limit, token, err := pageQuery(q)
+	if pageError(w, err) {
+		return
+	}
+	v, err := h.store.View(id)
+	if err != nil && token != nil {
+		// the view expired between two pages, the scan has to restart
+		http.Error(w, "Snapshot view expired", http.StatusGone)
+		return
+	} else if err != nil {
+		http.Error(w, "Snapshot view not found", http.StatusNotFound)
+		return
+	}
+	var from string
+	if token != nil {
+		if token.Rev != v.rev {
+			http.Error(w, "Invalid continue token", http.StatusBadRequest)
+			return
+		}
+		from = token.Next
+	}
+	end := q.Get("end")
+	if prefix, _ := strconv.ParseBool(q.Get("prefix")); prefix {
+		end = string(prefixEnd([]byte(key)))
+	}
+	kvs, count, next, err := h.store.RangeView(v, key, end, from, limit)
+	if err != nil {
+		log.Printf("Failed to read snapshot view %s (%v)\n", id, err)
+		http.Error(w, "Failed on GET", http.StatusInternalServerError)
+		return
+	}
+	keysOnly, _ := strconv.ParseBool(q.Get("keysOnly"))
+	res := api.ViewRange{Rev: v.rev, KVs: make([]api.KeyValue, len(kvs)), Count: count, More: next != ""}
+	if next != "" {
+		res.Continue = pageToken{Rev: v.rev, Next: next}.String()
+	}
+	for i, kv := range kvs {
+		if keysOnly {
+			kv.Value = ""
+		}
+		res.KVs[i] = *kv
+	}
+	writeJSON(w, res)
+}
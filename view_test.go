@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"metcd/api"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSnapshotView(t *testing.T) {
+	defer func(n int) { maxSnapshotViews = n }(maxSnapshotViews)
+	maxSnapshotViews = 2
+	s := newTestKVStore(nil)
+	for _, k := range []string{"/a", "/b/1", "/b/2", "/b/3", "/c"} {
+		s.apply(kv{Op: opPut, Key: k, Val: "v" + k})
+	}
+	v, err := s.CreateView("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apply(kv{Op: opPut, Key: "/b/4", Val: "new"})
+	s.apply(kv{Op: opDelete, Key: "/a"})
+
+	kvs, count, _, err := s.RangeView(v, "/b/", string(prefixEnd([]byte("/b/"))), "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || len(kvs) != 2 || kvs[0].Key != "/b/1" || kvs[1].Value != "v/b/2" || kvs[0].ModRevision == 0 {
+		t.Fatalf("expected the first 2 of 3 frozen keys, got %d %+v", count, kvs)
+	}
+	if kvs, _, _, _ := s.RangeView(v, "/a", "", "", 0); len(kvs) != 1 {
+		t.Fatal("expected the deleted key to stay in the view")
+	}
+	if _, count, _, _ := s.RangeView(v, "\x00", "\x00", "", 0); count != 5 {
+		t.Fatalf("expected 5 keys in the view, got %d", count)
+	}
+	if _, count, _, _ := s.RangeView(v, "/c", "/b", "", 0); count != 0 {
+		t.Fatalf("expected an empty range, got %d", count)
+	}
+	if v.rev != 5 || len(s.kvStore) != 5 || s.rev != 7 {
+		t.Fatalf("expected the view at revision 5, got %d", v.rev)
+	}
+
+	if _, err := s.CreateView("missing"); err != ErrKeyspaceNotFound {
+		t.Fatalf("expected a missing keyspace, got %v", err)
+	}
+	if _, err := s.CreateView(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateView(""); err != ErrTooManyViews {
+		t.Fatalf("expected too many views, got %v", err)
+	}
+	if views := s.Views(); len(views) != 2 || views[0].ID != v.id || views[1].Rev != 7 {
+		t.Fatalf("expected 2 views, got %+v", views)
+	}
+	if !s.DropView(v.id) || s.DropView(v.id) {
+		t.Fatal("expected the view to be dropped once")
+	}
+	if _, err := s.View(v.id); err != ErrViewNotFound {
+		t.Fatalf("expected the view to be gone, got %v", err)
+	}
+}
+
+func TestSnapshotViewExpiry(t *testing.T) {
+	defer func(d time.Duration) { snapshotViewTTL = d }(snapshotViewTTL)
+	snapshotViewTTL = 300 * time.Millisecond
+	s := newTestKVStore(map[string]string{"/a": "1"})
+	v, err := s.CreateView("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := s.View(v.id); err != nil {
+			t.Fatal("expected reads to keep the view")
+		}
+	}
+	time.Sleep(600 * time.Millisecond)
+	if len(s.Views()) != 0 {
+		t.Fatal("expected the view to expire")
+	}
+}
+
+func TestServeViews(t *testing.T) {
+	s := newTestKVStore(nil)
+	for _, k := range []string{"/a", "/b/1", "/b/2"} {
+		s.apply(kv{Op: opPut, Key: k, Val: "v" + k})
+	}
+	v, err := s.CreateView("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newHTTPHandler(&httpKVAPI{store: s, requests: newRequestTracker()}))
+	defer srv.Close()
+
+	get := func(path string, status int, body interface{}) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("GET %s: expected %d, got %d", path, status, resp.StatusCode)
+		}
+		if body != nil {
+			if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var res api.ViewRange
+	get("/views/"+v.id+"/kv/b/?prefix=true&limit=1&keysOnly=true", http.StatusOK, &res)
+	if res.Rev != 3 || res.Count != 2 || !res.More || len(res.KVs) != 1 || res.KVs[0].Key != "/b/1" || res.KVs[0].Value != "" {
+		t.Fatalf("expected the first key of the prefix, got %+v", res)
+	}
+	next := "/views/" + v.id + "/kv/b/?prefix=true&limit=1&keysOnly=true&continue=" + res.Continue
+	res = api.ViewRange{}
+	get(next, http.StatusOK, &res)
+	if res.Count != 2 || res.More || res.Continue != "" || len(res.KVs) != 1 || res.KVs[0].Key != "/b/2" {
+		t.Fatalf("expected the last key of the prefix, got %+v", res)
+	}
+	get("/views/"+v.id+"/kv/b/?prefix=true&continue=bad", http.StatusBadRequest, nil)
+	get("/views/"+v.id+"/kv/a", http.StatusOK, &res)
+	if res.Count != 1 || res.KVs[0].Value != "v/a" {
+		t.Fatalf("expected /a, got %+v", res)
+	}
+	get("/views/"+v.id+"/kv/b/1?end=/c", http.StatusOK, &res)
+	if res.Count != 2 {
+		t.Fatalf("expected 2 keys up to /c, got %+v", res)
+	}
+	var views []api.View
+	get("/views", http.StatusOK, &views)
+	if len(views) != 1 || views[0].Keys != 3 {
+		t.Fatalf("expected the view, got %+v", views)
+	}
+	get("/views/"+v.id+"/kv/a?limit=-1", http.StatusBadRequest, nil)
+	get("/views/"+v.id+"/other", http.StatusNotFound, nil)
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/views/"+v.id, nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected the view released, got %v %v", resp, err)
+	}
+	get("/views/"+v.id+"/kv/a", http.StatusNotFound, nil)
+	get(next, http.StatusGone, nil)
+}
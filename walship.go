@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"metcd/objstore"
+	"metcd/raftnode"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+// walShipPrefix starts the names of the shipped WAL segments,
+// metcd-wal-<member>-<segment>, the segment named as in the WAL directory.
+const walShipPrefix = "metcd-wal-"
+
+var walSegmentsShipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "metcd",
+	Subsystem: "server",
+	Name:      "wal_segments_shipped_total",
+	Help:      "Number of closed WAL segments shipped to --snapshot-backup by result: success or failure.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(walSegmentsShipped)
+}
+
+// shippedSegment is a WAL segment of a member in the object store.
+type shippedSegment struct {
+	name   string
+	member uint64
+	// seq and index are those of the segment name: its rank in the WAL and
+	// the raft index of its first entry
+	seq, index uint64
+}
+
+func shippedSegmentName(member uint64, segment string) string {
+	return fmt.Sprintf("%s%d-%s", walShipPrefix, member, segment)
+}
+
+// parseShippedSegment parses the name of a shipped segment, ok is false if
+// it is not one.
+func parseShippedSegment(name string) (seg shippedSegment, ok bool) {
+	rest, found := strings.CutPrefix(name, walShipPrefix)
+	if !found || !strings.HasSuffix(rest, ".wal") {
+		return seg, false
+	}
+	if _, err := fmt.Sscanf(rest, "%d-%016x-%016x.wal", &seg.member, &seg.seq, &seg.index); err != nil {
+		return seg, false
+	}
+	seg.name = name
+	return seg, true
+}
+
+// shippedSegments returns the shipped segments of store by member, in the
+// order of their WAL.
+func shippedSegments(ctx context.Context, store objstore.ObjectStore) (map[uint64][]shippedSegment, error) {
+	objs, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	segs := make(map[uint64][]shippedSegment)
+	for _, o := range objs {
+		if seg, ok := parseShippedSegment(o.Name); ok {
+			segs[seg.member] = append(segs[seg.member], seg)
+		}
+	}
+	for _, s := range segs {
+		sort.Slice(s, func(i, j int) bool { return s[i].seq < s[j].seq })
+	}
+	return segs, nil
+}
+
+// walShipper copies the closed WAL segments of this member to an object
+// store while it leads, for the point-in-time restores replaying them
+// after a snapshot backup. A new leader ships the closed segments of its
+// own WAL it did not ship yet, so the segments of members overlap.
+type walShipper struct {
+	segments func() ([]string, error)
+	store    objstore.ObjectStore
+	isLeader func() bool
+	member   uint64
+	interval time.Duration
+
+	leading bool
+	shipped map[string]bool // the names of the segments in the store
+
+	stopc chan struct{}
+	donec chan struct{}
+}
+
+func newWALShipper(rc *raftnode.RaftNode, store objstore.ObjectStore, interval time.Duration) *walShipper {
+	return &walShipper{
+		segments: rc.ClosedWALSegments,
+		store:    store,
+		isLeader: rc.IsLeader,
+		member:   rc.ID(),
+		interval: interval,
+		stopc:    make(chan struct{}),
+		donec:    make(chan struct{}),
+	}
+}
+
+func (w *walShipper) Run() {
+	go func() {
+		defer close(w.donec)
+		t := time.NewTicker(w.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-w.stopc:
+				return
+			}
+			if !w.isLeader() {
+				w.leading = false
+				continue
+			}
+			if err := w.ship(); err != nil {
+				walSegmentsShipped.WithLabelValues("failure").Inc()
+				log.Printf("Failed to ship the WAL (%v)\n", err)
+			}
+		}
+	}()
+}
+
+func (w *walShipper) Stop() {
+	close(w.stopc)
+	<-w.donec
+}
+
+// ship uploads the closed segments not in the store yet, listed again
+// when this member becomes the leader.
+func (w *walShipper) ship() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*w.interval)
+	defer cancel()
+	if !w.leading {
+		segs, err := shippedSegments(ctx, w.store)
+		if err != nil {
+			return err
+		}
+		w.shipped = make(map[string]bool)
+		for _, seg := range segs[w.member] {
+			w.shipped[seg.name] = true
+		}
+		w.leading = true
+	}
+	paths, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		name := shippedSegmentName(w.member, filepath.Base(path))
+		if w.shipped[name] {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			log.Printf("WAL segment %s purged before it was shipped, point-in-time restores stop before it", path)
+			w.shipped[name] = true
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := w.store.Put(ctx, name, data); err != nil {
+			return err
+		}
+		walSegmentsShipped.WithLabelValues("success").Inc()
+		w.shipped[name] = true
+	}
+	return nil
+}
+
+// pruneShippedWAL removes the shipped segments holding only entries up to
+// raft index, which the snapshot backed up at that index replaces. The
+// last segment of a member is kept, its end is not known.
+func pruneShippedWAL(ctx context.Context, store objstore.ObjectStore, index uint64) error {
+	segs, err := shippedSegments(ctx, store)
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		for i := 0; i+1 < len(s) && s[i+1].index <= index+1; i++ {
+			if err := store.Delete(ctx, s[i].name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shippedEntries returns the committed entries of the shipped WAL after
+// raft index, up to the first one missing. Each member's segments are read
+// in order, the entries written again replacing the previous ones from
+// their index on, and only the entries up to the commit index recorded in
+// its WAL are kept; the committed entries of the members are the same.
+func shippedEntries(ctx context.Context, store objstore.ObjectStore, index uint64) ([]raftpb.Entry, error) {
+	segs, err := shippedSegments(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	committed := make(map[uint64]raftpb.Entry)
+	for _, s := range segs {
+		var (
+			ents   []raftpb.Entry
+			commit uint64
+		)
+		for i, seg := range s {
+			if i+1 < len(s) && s[i+1].index <= index+1 {
+				// all its entries are in the snapshot
+				continue
+			}
+			data, err := store.Get(ctx, seg.name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", seg.name, err)
+			}
+			read, st, err := raftnode.ReadWALSegment(data, atRest)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", seg.name, err)
+			}
+			for _, e := range read {
+				j := sort.Search(len(ents), func(j int) bool { return ents[j].Index >= e.Index })
+				ents = append(ents[:j], e)
+			}
+			if st.Commit > commit {
+				commit = st.Commit
+			}
+		}
+		for _, e := range ents {
+			if e.Index > index && e.Index <= commit {
+				committed[e.Index] = e
+			}
+		}
+	}
+	var ents []raftpb.Entry
+	for i := index + 1; ; i++ {
+		e, ok := committed[i]
+		if !ok {
+			return ents, nil
+		}
+		ents = append(ents, e)
+	}
+}
+
+// replay applies the proposals of ents, committed entries following the
+// store, up to to, and returns the number of entries applied.
+func (s *kvstore) replay(ents []raftpb.Entry, to restoreTarget) (int, error) {
+	n := 0
+	for _, e := range ents {
+		if to.index > 0 && e.Index > to.index {
+			break
+		}
+		if e.Type == raftpb.EntryNormal && len(e.Data) > 0 {
+			var r kv
+			if err := gob.NewDecoder(bytes.NewReader(e.Data)).Decode(&r); err != nil {
+				return n, fmt.Errorf("entry %d: %w", e.Index, err)
+			}
+			if !to.time.IsZero() && r.Time.After(to.time) {
+				break
+			}
+			s.apply(r)
+		}
+		s.raftIndex = e.Index
+		n++
+	}
+	return n, nil
+}
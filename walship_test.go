@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"metcd/encryption"
+	"metcd/objstore"
+	"metcd/raftnode"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
+	"go.etcd.io/etcd/server/v3/wal"
+	"go.uber.org/zap"
+)
+
+// writeTestWAL writes to dir a WAL of n puts of /k, the value of entry i
+// being i proposed i seconds after start, committed up to the one before.
+func writeTestWAL(t *testing.T, dir string, n int, start time.Time) {
+	w, err := wal.Create(zap.NewNop(), dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := 1; i <= n; i++ {
+		var buf bytes.Buffer
+		r := kv{Op: opPut, Key: "/k", Val: strconv.Itoa(i), Time: start.Add(time.Duration(i) * time.Second)}
+		if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+			t.Fatal(err)
+		}
+		ents := []raftpb.Entry{{Term: 1, Index: uint64(i), Data: buf.Bytes()}}
+		if err := w.Save(raftpb.HardState{Term: 1, Commit: uint64(i - 1)}, ents); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// restoredValue restores store up to to and returns the value of /k.
+func restoredValue(t *testing.T, store objstore.ObjectStore, to restoreTarget) string {
+	keyring, _ := encryption.NewKeyring(nil)
+	dir := t.TempDir()
+	if _, err := restoreSnapshotBackup(store, snapshotRestoreLatest, to, dir, 1, "", []uint64{1}, keyring); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := snap.New(zap.NewNop(), filepath.Join(dir, raftnode.SnapDir(1))).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st storeSnapshot
+	if err := json.Unmarshal(snapshot.Data, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.RaftIndex != 1 {
+		t.Fatalf("expected the restored snapshot at raft index 1, got %d", st.RaftIndex)
+	}
+	return st.KVs["/k"]
+}
+
+func TestWALShipping(t *testing.T) {
+	defer func(size int64) { wal.SegmentSizeBytes = size }(wal.SegmentSizeBytes)
+	wal.SegmentSizeBytes = 8192
+
+	store, err := objstore.Open("file:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	b := newSnapshotBackup(newTestKVStore(nil), store, func() bool { return true }, time.Minute, 2)
+	if err := b.backup(start); err != nil {
+		t.Fatal(err)
+	}
+
+	waldir := t.TempDir()
+	writeTestWAL(t, waldir, 200, start)
+	w := &walShipper{
+		segments: func() ([]string, error) {
+			paths, err := filepath.Glob(filepath.Join(waldir, "*.wal"))
+			return paths[:len(paths)-1], err
+		},
+		store:    store,
+		isLeader: func() bool { return true },
+		member:   1,
+		interval: time.Second,
+	}
+	shipped := func() int { return int(testutil.ToFloat64(walSegmentsShipped.WithLabelValues("success"))) }
+	before := shipped()
+	if err := w.ship(); err != nil {
+		t.Fatal(err)
+	}
+	segs, err := shippedSegments(context.Background(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs[1]) < 3 {
+		t.Fatalf("expected several segments shipped, got %v", segs)
+	}
+	if err := w.ship(); err != nil || shipped()-before != len(segs[1]) {
+		t.Fatalf("expected the segments shipped once, got %d (%v)", shipped()-before, err)
+	}
+
+	if got := restoredValue(t, store, restoreTarget{}); got != "" {
+		t.Fatalf("expected the backup alone without a target, got /k=%q", got)
+	}
+	if got := restoredValue(t, store, restoreTarget{index: 20}); got != "20" {
+		t.Fatalf("expected /k=20 at index 20, got %q", got)
+	}
+	if got := restoredValue(t, store, restoreTarget{time: start.Add(30 * time.Second)}); got != "30" {
+		t.Fatalf("expected /k=30 at 30s, got %q", got)
+	}
+	// the entries of the open segment are not shipped yet, nor the commit
+	// of the last entry before it
+	paths, _ := filepath.Glob(filepath.Join(waldir, "*.wal"))
+	var seq, open int
+	fmt.Sscanf(filepath.Base(paths[len(paths)-1]), "%016x-%016x.wal", &seq, &open)
+	if got, _ := strconv.Atoi(restoredValue(t, store, restoreTarget{latest: true})); got != open-2 {
+		t.Fatalf("expected the entries committed in the closed segments, %d, got /k=%d", open-2, got)
+	}
+
+	if err := pruneShippedWAL(context.Background(), store, segs[1][2].index-1); err != nil {
+		t.Fatal(err)
+	}
+	pruned, _ := shippedSegments(context.Background(), store)
+	if len(pruned[1]) != len(segs[1])-2 || pruned[1][0] != segs[1][2] {
+		t.Fatalf("expected the first 2 segments pruned, got %v", pruned[1])
+	}
+}
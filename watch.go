@@ -0,0 +1,234 @@
+package main
+
+import (
+	"log"
+	"metcd/api"
+	"os"
+	"strings"
+	"sync"
+)
+
+// watcherBufferSize is the number of events a watcher may fall behind by
+// before it is cancelled.
+const watcherBufferSize = 128
+
+// watchOptions select the events of a watch.
+type watchOptions struct {
+	prefix bool  // watch every key starting with the key
+	since  int64 // start with the events after this revision, or noSince
+	// keysOnly leaves the values out, noPut and noDelete drop the events
+	// of that type before they are queued
+	keysOnly bool
+	noPut    bool
+	noDelete bool
+}
+
+type watcher struct {
+	key  string
+	opts watchOptions
+	ch   chan api.Event
+}
+
+func (w *watcher) matches(ev api.Event) bool {
+	switch {
+	case w.opts.noPut && ev.Type == api.EventPut, w.opts.noDelete && ev.Type == api.EventDelete:
+		return false
+	case w.opts.prefix:
+		return strings.HasPrefix(ev.Key, w.key)
+	}
+	return w.key == ev.Key
+}
+
+// watchHub fans applied events out to the registered watchers, and keeps
+// the recent ones for the watchers resuming after a revision.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+	history  watchHistory
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]struct{})}
+}
+
+// watch registers a watcher on key (or on every key with that prefix). The
+// returned channel is closed when cancel is called or when the watcher
+// cannot keep up with the apply rate.
+func (h *watchHub) watch(key string, prefix bool) (<-chan api.Event, func()) {
+	events, cancel, _ := h.watchWith(key, watchOptions{prefix: prefix, since: noSince}, nil)
+	return events, cancel
+}
+
+// watchWith is watch with opts, the values decoded by open. Starting after
+// a revision fails with a *compactedError if its events are no longer kept.
+func (h *watchHub) watchWith(key string, opts watchOptions, open func(key, value string) (string, error)) (<-chan api.Event, func(), error) {
+	w := &watcher{key: key, opts: opts}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var missed []api.Event
+	if opts.since != noSince {
+		evs, err := h.history.since(opts.since)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ev := range evs {
+			if !w.matches(ev) {
+				continue
+			}
+			if opts.keysOnly {
+				ev.Value = ""
+			} else {
+				ev.Value = openEvent(ev.Key, ev.Value, open)
+			}
+			missed = append(missed, ev)
+		}
+	}
+	w.ch = make(chan api.Event, len(missed)+watcherBufferSize)
+	for _, ev := range missed {
+		w.ch <- ev
+	}
+	h.watchers[w] = struct{}{}
+	return w.ch, func() { h.cancel(w) }, nil
+}
+
+// openEvent returns the value of key decoded by open.
+func openEvent(key, value string, open func(key, value string) (string, error)) string {
+	if open == nil {
+		return value
+	}
+	v, err := open(key, value)
+	if err != nil {
+		log.Printf("cannot decrypt the value of %q for watchers (%v)", key, err)
+	}
+	return v
+}
+
+func (h *watchHub) cancel(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
+
+// notify records ev, its value as stored, and delivers it decoded by open
+// without blocking the apply loop. Slow watchers are dropped instead.
+func (h *watchHub) notify(ev api.Event, open func(key, value string) (string, error)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.history.record(ev)
+	// deletions carry no value to decode
+	value, decoded := ev.Value, ev.Type == api.EventDelete
+	for w := range h.watchers {
+		if !w.matches(ev) {
+			continue
+		}
+		if w.opts.keysOnly {
+			ev.Value = ""
+		} else {
+			// decoded once, for the watchers that want the value
+			if !decoded {
+				value, decoded = openEvent(ev.Key, value, open), true
+			}
+			ev.Value = value
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			delete(h.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+// keyHistory returns the recorded events of key after revision rev, or
+// after the oldest event kept, and the revision they start after.
+func (h *watchHub) keyHistory(key string, rev int64) ([]api.Event, int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if rev < h.history.floor {
+		rev = h.history.floor
+	}
+	evs, err := h.history.since(rev)
+	if err != nil {
+		return nil, 0, err
+	}
+	var keyEvs []api.Event
+	for _, ev := range evs {
+		if ev.Key == key {
+			keyEvs = append(keyEvs, ev)
+		}
+	}
+	return keyEvs, rev, nil
+}
+
+// changedSince returns the keys that in reports true for changed after rev,
+// each with whether it existed at rev. It fails with a *compactedError if
+// those changes are no longer kept.
+func (h *watchHub) changedSince(rev int64, in func(string) bool) (map[string]bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	evs, err := h.history.since(rev)
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]bool)
+	for _, ev := range evs {
+		if _, ok := changed[ev.Key]; ok || !in(ev.Key) {
+			continue
+		}
+		// the first change tells: a delete or a put of a key created
+		// before rev
+		changed[ev.Key] = ev.Type == api.EventDelete || ev.CreateRevision <= rev
+	}
+	return changed, nil
+}
+
+// stats returns the number of watchers and the revision the events kept
+// start after.
+func (h *watchHub) stats() (int, int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.watchers), h.history.floor
+}
+
+// closeAll cancels every watcher.
+func (h *watchHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
+
+// loadHistory logs the events to the directory dir too, see
+// watchHistory.load.
+func (h *watchHub) loadHistory(dir string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.history.load(dir)
+}
+
+// resetHistory forgets the events if the keyspace was restored from a
+// snapshot at a revision after the newest of them.
+func (h *watchHub) resetHistory(rev int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.history.reset(rev)
+}
+
+// dropHistory stops logging the events and removes their directory, for a
+// deleted keyspace.
+func (h *watchHub) dropHistory() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if l := h.history.disk; l != nil {
+		l.close()
+		h.history.disk = nil
+		if err := os.RemoveAll(l.dir); err != nil {
+			log.Printf("cannot remove the watch events of %s (%v)", l.dir, err)
+		}
+	}
+}
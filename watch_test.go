@@ -0,0 +1,48 @@
+package main
+
+import (
+	"metcd/api"
+	"testing"
+)
+
+func TestWatchOptions(t *testing.T) {
+	h := newWatchHub()
+	opened := 0
+	open := func(key, value string) (string, error) {
+		opened++
+		return "opened " + value, nil
+	}
+	keys, cancelKeys, _ := h.watchWith("/", watchOptions{prefix: true, since: noSince, keysOnly: true}, open)
+	defer cancelKeys()
+	deletes, cancelDeletes, _ := h.watchWith("/", watchOptions{prefix: true, since: noSince, noPut: true}, open)
+	defer cancelDeletes()
+	puts, cancelPuts, _ := h.watchWith("/a", watchOptions{since: noSince, noDelete: true}, open)
+	defer cancelPuts()
+
+	h.notify(putEvent("/a", 1), open)
+	h.notify(api.Event{Type: api.EventDelete, Key: "/a", ModRevision: 2}, open)
+	if opened != 1 {
+		t.Fatalf("expected the value to be decoded once, for the watcher wanting it, got %d", opened)
+	}
+	for _, ev := range []api.Event{<-keys, <-keys} {
+		if ev.Value != "" {
+			t.Fatalf("expected no value, got %+v", ev)
+		}
+	}
+	if ev := <-deletes; ev.Type != api.EventDelete || len(deletes) != 0 {
+		t.Fatalf("expected the delete only, got %+v", ev)
+	}
+	if ev := <-puts; ev.Type != api.EventPut || ev.Value != "opened v" || len(puts) != 0 {
+		t.Fatalf("expected the opened put only, got %+v", ev)
+	}
+
+	// the history is filtered too
+	replayed, cancel, err := h.watchWith("/a", watchOptions{since: 0, noPut: true, keysOnly: true}, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if ev := <-replayed; ev.Type != api.EventDelete || len(replayed) != 0 {
+		t.Fatalf("expected the replayed delete only, got %+v", ev)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"metcd/api"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// watchHistorySize is the number of recent events a keyspace keeps in
+	// memory for the watchers resuming with ?since=<rev>.
+	watchHistorySize = 4096
+	// watchHistoryDir, if set, is the directory the events are also
+	// logged to, up to watchHistoryDiskSize events per keyspace, so they
+	// survive restarts.
+	watchHistoryDir      string
+	watchHistoryDiskSize = 1 << 20
+)
+
+// noSince watches from the next event on.
+const noSince = -1
+
+// compactedError is returned for a watch resuming after a revision whose
+// events are no longer kept.
+type compactedError struct {
+	rev int64 // the events after rev are kept
+}
+
+func (e *compactedError) Error() string {
+	return fmt.Sprintf("%v, the events after revision %d are kept", ErrCompacted, e.rev)
+}
+
+func (e *compactedError) Unwrap() error { return ErrCompacted }
+
+// watchHistory holds the recent events of a keyspace, with their values as
+// stored: the events of destroyed data keys cannot be decrypted anymore,
+// and it logs no plaintext to disk. It must be used with the mutex of its
+// watch hub held.
+type watchHistory struct {
+	events   []api.Event // oldest first
+	memFloor int64       // the events after memFloor are in events
+	floor    int64       // the events after floor are in events or on disk
+	last     int64       // revision of the newest event
+	skip     int64       // the events up to skip are on disk already
+	disk     *historyLog
+}
+
+// record appends ev, the events of a revision in a row.
+func (h *watchHistory) record(ev api.Event) {
+	if ev.ModRevision <= h.skip {
+		// replayed from the WAL after a restart
+		return
+	}
+	if h.disk != nil {
+		dropped, err := h.disk.append(ev)
+		if err != nil {
+			log.Printf("cannot log watch events to %s, keeping them in memory only (%v)", h.disk.dir, err)
+			h.disk.close()
+			h.disk = nil
+			h.floor = h.memFloor
+		} else if dropped > h.floor {
+			h.floor = dropped
+		}
+	}
+	h.events = append(h.events, ev)
+	h.last = ev.ModRevision
+	// the history shrinks under memory pressure
+	for limit := watchHistorySize >> memoryPressure.Load(); len(h.events) > limit; {
+		h.memFloor = h.events[0].ModRevision
+		h.events = h.events[1:]
+		if h.disk == nil {
+			h.floor = h.memFloor
+		}
+	}
+}
+
+// since returns the events after revision rev.
+func (h *watchHistory) since(rev int64) ([]api.Event, error) {
+	if rev < h.floor {
+		return nil, &compactedError{rev: h.floor}
+	}
+	if rev < h.memFloor && h.disk != nil {
+		return h.disk.since(rev)
+	}
+	var evs []api.Event
+	for _, ev := range h.events {
+		if ev.ModRevision > rev {
+			evs = append(evs, ev)
+		}
+	}
+	return evs, nil
+}
+
+// reset forgets the events if the keyspace, restored from a snapshot at
+// revision rev, may have changed after the newest of them.
+func (h *watchHistory) reset(rev int64) {
+	if h.last >= rev {
+		return
+	}
+	h.events = nil
+	h.memFloor, h.floor, h.last, h.skip = rev, rev, rev, rev
+	if h.disk != nil {
+		if err := h.disk.truncate(); err != nil {
+			log.Printf("cannot clear the watch events of %s (%v)", h.disk.dir, err)
+			h.disk.close()
+			h.disk = nil
+		}
+	}
+}
+
+// load logs the events to the directory dir, and reads the events it
+// already holds.
+func (h *watchHistory) load(dir string) error {
+	l, err := openHistoryLog(dir)
+	if err != nil {
+		return err
+	}
+	evs, err := l.since(noSince)
+	if err != nil {
+		l.close()
+		return err
+	}
+	h.disk = l
+	if len(evs) > 0 {
+		// whether older events were logged is unknown
+		h.floor = evs[0].ModRevision - 1
+		h.last = evs[len(evs)-1].ModRevision
+		h.memFloor, h.skip = h.last, h.last
+	}
+	return nil
+}
+
+// historyLog keeps the events of a keyspace on disk in two files of
+// newline delimited JSON, the current one and the previous one, dropped
+// once the current one holds half of watchHistoryDiskSize events.
+type historyLog struct {
+	dir       string
+	cur       *os.File
+	curEvents int
+	curLast   int64
+	prevLast  int64 // 0 without a previous file
+}
+
+const (
+	historyPrev = "0.ndjson"
+	historyCur  = "1.ndjson"
+)
+
+// historyEvent is an event as logged, its key and value may be binary.
+type historyEvent struct {
+	Type           api.EventType `json:"type"`
+	Key            []byte        `json:"key"`
+	Value          []byte        `json:"value,omitempty"`
+	CreateRevision int64         `json:"createRevision,omitempty"`
+	ModRevision    int64         `json:"modRevision"`
+	Version        int64         `json:"version,omitempty"`
+	// Time is the time of the change in Unix nanoseconds, 0 if not known
+	Time int64 `json:"time,omitempty"`
+}
+
+func openHistoryLog(dir string) (*historyLog, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	l := &historyLog{dir: dir}
+	prev, _, err := readHistory(filepath.Join(dir, historyPrev))
+	if err != nil {
+		return nil, err
+	}
+	if len(prev) > 0 {
+		l.prevLast = prev[len(prev)-1].ModRevision
+	}
+	cur, size, err := readHistory(filepath.Join(dir, historyCur))
+	if err != nil {
+		return nil, err
+	}
+	if l.cur, err = os.OpenFile(filepath.Join(dir, historyCur), os.O_RDWR|os.O_CREATE, 0640); err != nil {
+		return nil, err
+	}
+	// drop a line torn by a crash
+	if err := l.cur.Truncate(size); err != nil {
+		l.cur.Close()
+		return nil, err
+	}
+	if _, err := l.cur.Seek(size, io.SeekStart); err != nil {
+		l.cur.Close()
+		return nil, err
+	}
+	l.curEvents = len(cur)
+	if len(cur) > 0 {
+		l.curLast = cur[len(cur)-1].ModRevision
+	}
+	return l, nil
+}
+
+// readHistory returns the events of the file at path and the size of its
+// complete lines.
+func readHistory(path string) ([]api.Event, int64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	size := int64(bytes.LastIndexByte(data, '\n') + 1)
+	var evs []api.Event
+	sc := bufio.NewScanner(bytes.NewReader(data[:size]))
+	sc.Buffer(nil, len(data)+1)
+	for sc.Scan() {
+		var he historyEvent
+		if err := json.Unmarshal(sc.Bytes(), &he); err != nil {
+			return nil, 0, fmt.Errorf("cannot read %s: %w", path, err)
+		}
+		evs = append(evs, api.Event{
+			Type:           he.Type,
+			Key:            string(he.Key),
+			Value:          string(he.Value),
+			CreateRevision: he.CreateRevision,
+			ModRevision:    he.ModRevision,
+			Version:        he.Version,
+			Time:           changeTime(he.Time),
+		})
+	}
+	return evs, size, sc.Err()
+}
+
+// append logs ev and returns the revision of the newest event it dropped,
+// 0 if none.
+func (l *historyLog) append(ev api.Event) (dropped int64, err error) {
+	// rotate between revisions only, so the oldest revision is whole
+	if l.curEvents >= watchHistoryDiskSize/2 && ev.ModRevision != l.curLast {
+		dropped = l.prevLast
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	he := historyEvent{
+		Type:           ev.Type,
+		Key:            []byte(ev.Key),
+		Value:          []byte(ev.Value),
+		CreateRevision: ev.CreateRevision,
+		ModRevision:    ev.ModRevision,
+		Version:        ev.Version,
+	}
+	if ev.Time != nil {
+		he.Time = ev.Time.UnixNano()
+	}
+	b, err := json.Marshal(he)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := l.cur.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	l.curEvents++
+	l.curLast = ev.ModRevision
+	return dropped, nil
+}
+
+func (l *historyLog) rotate() error {
+	if err := l.cur.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(l.dir, historyCur), filepath.Join(l.dir, historyPrev)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(l.dir, historyCur), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	l.cur, l.prevLast, l.curEvents = f, l.curLast, 0
+	return nil
+}
+
+// since returns the logged events after revision rev.
+func (l *historyLog) since(rev int64) ([]api.Event, error) {
+	var evs []api.Event
+	for _, name := range []string{historyPrev, historyCur} {
+		logged, _, err := readHistory(filepath.Join(l.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range logged {
+			if ev.ModRevision > rev {
+				evs = append(evs, ev)
+			}
+		}
+	}
+	return evs, nil
+}
+
+func (l *historyLog) truncate() error {
+	if err := os.Remove(filepath.Join(l.dir, historyPrev)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := l.cur.Truncate(0); err != nil {
+		return err
+	}
+	_, err := l.cur.Seek(0, io.SeekStart)
+	l.curEvents, l.prevLast = 0, 0
+	return err
+}
+
+func (l *historyLog) close() { l.cur.Close() }
+
+// historyDir returns the directory logging the events of the keyspace
+// called name, "" unless watchHistoryDir is set.
+func historyDir(name string) string {
+	if watchHistoryDir == "" {
+		return ""
+	}
+	if name == "" {
+		return filepath.Join(watchHistoryDir, "default")
+	}
+	return filepath.Join(watchHistoryDir, "keyspaces", name)
+}
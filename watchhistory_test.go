@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"metcd/api"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func putEvent(key string, rev int64) api.Event {
+	return api.Event{Type: api.EventPut, Key: key, Value: "v", ModRevision: rev}
+}
+
+func eventRevs(evs []api.Event) []int64 {
+	var revs []int64
+	for _, ev := range evs {
+		revs = append(revs, ev.ModRevision)
+	}
+	return revs
+}
+
+func TestWatchHistory(t *testing.T) {
+	defer func(size int) { watchHistorySize = size }(watchHistorySize)
+	watchHistorySize = 3
+	var h watchHistory
+	for _, rev := range []int64{1, 2, 2, 3, 4} {
+		h.record(putEvent("/k", rev))
+	}
+	evs, err := h.since(2)
+	if err != nil || !reflect.DeepEqual(eventRevs(evs), []int64{3, 4}) {
+		t.Fatalf("expected the events of 3 and 4, got %v, %v", eventRevs(evs), err)
+	}
+	// one event of revision 2 is gone
+	var compacted *compactedError
+	if _, err := h.since(1); !errors.As(err, &compacted) || compacted.rev != 2 {
+		t.Fatalf("expected the history to be compacted at 2, got %v", err)
+	}
+	if evs, _ := h.since(4); len(evs) != 0 {
+		t.Fatalf("expected no events after 4, got %v", evs)
+	}
+
+	// a snapshot at a later revision may hide changes
+	h.reset(4)
+	if evs, err := h.since(2); err != nil || len(evs) != 2 {
+		t.Fatalf("expected the history to be kept, got %v, %v", evs, err)
+	}
+	h.reset(10)
+	if _, err := h.since(4); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected ErrCompacted after a reset, got %v", err)
+	}
+	if evs, err := h.since(10); err != nil || len(evs) != 0 {
+		t.Fatalf("expected no events after 10, got %v, %v", evs, err)
+	}
+}
+
+func TestWatchSince(t *testing.T) {
+	h := newWatchHub()
+	open := func(key, value string) (string, error) { return "opened " + value, nil }
+	h.notify(putEvent("/a", 1), open)
+	h.notify(putEvent("/b", 2), open)
+	h.notify(putEvent("/a", 3), open)
+
+	events, cancel, err := h.watchWith("/a", watchOptions{since: 1}, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	h.notify(putEvent("/a", 4), open)
+	for _, rev := range []int64{3, 4} {
+		if ev := <-events; ev.ModRevision != rev || ev.Value != "opened v" {
+			t.Fatalf("expected the opened event of %d, got %+v", rev, ev)
+		}
+	}
+}
+
+func TestWatchHistoryDisk(t *testing.T) {
+	defer func(size, disk int) { watchHistorySize, watchHistoryDiskSize = size, disk }(watchHistorySize, watchHistoryDiskSize)
+	watchHistorySize, watchHistoryDiskSize = 1, 4
+	dir := t.TempDir()
+	var h watchHistory
+	if err := h.load(dir); err != nil {
+		t.Fatal(err)
+	}
+	bin := api.Event{Type: api.EventPut, Key: "\xff", Value: "\x00\xfe", ModRevision: 3}
+	for rev := int64(1); rev <= 5; rev++ {
+		if rev == bin.ModRevision {
+			h.record(bin)
+		} else {
+			h.record(putEvent("/k", rev))
+		}
+	}
+	// older than memory, read from disk
+	evs, err := h.since(2)
+	if err != nil || !reflect.DeepEqual(eventRevs(evs), []int64{3, 4, 5}) {
+		t.Fatalf("expected the events of 3 to 5, got %v, %v", eventRevs(evs), err)
+	}
+	if evs[0] != bin {
+		t.Fatalf("expected %+v, got %+v", bin, evs[0])
+	}
+	// rotating dropped the oldest file
+	if _, err := h.since(1); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected ErrCompacted, got %v", err)
+	}
+	h.record(putEvent("/k", 6))
+	h.record(putEvent("/k", 7))
+	h.disk.close()
+
+	// a torn line is dropped on restart, and the replayed events are not
+	// logged twice
+	f, _ := os.OpenFile(filepath.Join(dir, historyCur), os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"type":"PUT","ke`)
+	f.Close()
+	var restarted watchHistory
+	if err := restarted.load(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.disk.close()
+	for rev := int64(5); rev <= 8; rev++ {
+		restarted.record(putEvent("/k", rev))
+	}
+	evs, err = restarted.since(4)
+	if err != nil || !reflect.DeepEqual(eventRevs(evs), []int64{5, 6, 7, 8}) {
+		t.Fatalf("expected the events of 5 to 8, got %v, %v", eventRevs(evs), err)
+	}
+	if _, err := restarted.since(3); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected ErrCompacted, got %v", err)
+	}
+}
+
+func TestKeyHistory(t *testing.T) {
+	s := newTestKVStore(nil)
+	t0 := time.Date(2026, 10, 14, 9, 30, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time { t := t0.Add(d); return &t }
+	s.apply(kv{Op: opPut, Key: "/a", Val: "1", Time: t0})
+	s.apply(kv{Op: opPut, Key: "/b", Val: "x", Time: t0.Add(time.Second)})
+	s.apply(kv{Op: opPut, Key: "/a", Val: "2", Time: t0.Add(2 * time.Second)})
+	s.apply(kv{Op: opDelete, Key: "/a", Time: t0.Add(3 * time.Second)})
+	s.apply(kv{Op: opPut, Key: "/a", Val: "3", Time: t0.Add(4 * time.Second)})
+
+	resp, err := s.HistoryIn("", "/a", 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []api.Event{
+		{Type: api.EventPut, Key: "/a", Value: "1", CreateRevision: 1, ModRevision: 1, Version: 1, Time: at(0)},
+		{Type: api.EventPut, Key: "/a", Value: "2", CreateRevision: 1, ModRevision: 3, Version: 2, Time: at(2 * time.Second)},
+		{Type: api.EventDelete, Key: "/a", ModRevision: 4, Time: at(3 * time.Second)},
+		{Type: api.EventPut, Key: "/a", Value: "3", CreateRevision: 5, ModRevision: 5, Version: 1, Time: at(4 * time.Second)},
+	}
+	if resp.Header.Revision != 5 || resp.CompactRevision != 0 || !reflect.DeepEqual(resp.Revisions, want) {
+		t.Fatalf("unexpected history %+v", resp)
+	}
+
+	// the compacted changes are not listed
+	s.apply(kv{Op: opCompact, Rev: 3})
+	if resp, err = s.HistoryIn("", "/a", 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if resp.CompactRevision != 3 || !reflect.DeepEqual(resp.Revisions, want[2:]) {
+		t.Fatalf("expected the changes after 3, got %+v", resp)
+	}
+
+	// the pages of a listing end at the revision of the first one
+	if resp, err = s.HistoryIn("", "/a", 0, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.More || resp.Header.Revision != 5 || !reflect.DeepEqual(resp.Revisions, want[2:3]) {
+		t.Fatalf("expected the first page, got %+v", resp)
+	}
+	s.apply(kv{Op: opPut, Key: "/a", Val: "4", Time: t0.Add(5 * time.Second)})
+	if resp, err = s.HistoryIn("", "/a", 4, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+	if resp.More || !reflect.DeepEqual(resp.Revisions, want[3:]) {
+		t.Fatalf("expected the last page, got %+v", resp)
+	}
+	var compacted *compactedError
+	if _, err := s.HistoryIn("", "/a", 2, 5, 1); !errors.As(err, &compacted) || compacted.rev != 3 {
+		t.Fatalf("expected the page after a compaction to fail, got %v", err)
+	}
+	if _, err := s.HistoryIn("missing", "/a", 0, 0, 0); !errors.Is(err, ErrKeyspaceNotFound) {
+		t.Fatalf("expected ErrKeyspaceNotFound, got %v", err)
+	}
+
+	// /kv/<key>?history=true is /history/<key>, /kv/<key>/history a key
+	srv := httptest.NewServer(newHTTPHandler(&httpKVAPI{store: s, requests: newRequestTracker()}))
+	defer srv.Close()
+	res, err := srv.Client().Get(srv.URL + "/kv/a?history=true&serializable=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var listed api.HistoryResponse
+	if err := json.NewDecoder(res.Body).Decode(&listed); err != nil || listed.Key != "/a" || len(listed.Revisions) != 3 {
+		t.Fatalf("expected the history of /a, got %+v, %v", listed, err)
+	}
+	s.apply(kv{Op: opPut, Key: "/a/history", Val: "h"})
+	res, err = srv.Client().Get(srv.URL + "/kv/a/history?serializable=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := io.ReadAll(res.Body); string(body) != "h" {
+		t.Fatalf("expected the key /a/history, got %q", body)
+	}
+}
+
+func TestWatchHistoryDiskTimes(t *testing.T) {
+	dir := t.TempDir()
+	var h watchHistory
+	if err := h.load(dir); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 10, 14, 9, 30, 0, 123, time.UTC)
+	ev := putEvent("/k", 1)
+	ev.Time = &at
+	h.record(ev)
+	h.record(putEvent("/k", 2))
+	h.disk.close()
+
+	var restarted watchHistory
+	if err := restarted.load(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.disk.close()
+	evs, err := restarted.since(0)
+	if err != nil || !reflect.DeepEqual(evs, []api.Event{ev, putEvent("/k", 2)}) {
+		t.Fatalf("expected the events with their times, got %+v, %v", evs, err)
+	}
+}
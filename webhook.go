@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"metcd/api"
+	"metcd/sink"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrWebhookNotFound = errors.New("metcd: webhook not found")
+	ErrInvalidWebhook  = errors.New("metcd: invalid webhook")
+)
+
+var (
+	// webhookInterval is how often the leader starts notifying the
+	// webhooks it does not notify yet.
+	webhookInterval = time.Second
+	// webhookTimeout is the timeout of a request to a webhook.
+	webhookTimeout = 10 * time.Second
+	// webhookBackoff is the delay before the first retry of a failed
+	// request, doubled after every retry up to webhookMaxBackoff.
+	webhookBackoff    = 100 * time.Millisecond
+	webhookMaxBackoff = 30 * time.Second
+	// webhookAttempts is how many times a revision is sent before it is
+	// dropped.
+	webhookAttempts = 10
+)
+
+// PutWebhook registers wh, replacing the webhook with its ID.
+func (s *kvstore) PutWebhook(ctx context.Context, wh api.Webhook) error {
+	if !keyspaceName.MatchString(wh.ID) {
+		return fmt.Errorf("%w: the ID must be 1 to 64 letters, digits, - or _", ErrInvalidWebhook)
+	}
+	if u, err := url.Parse(wh.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: the URL must be http or https", ErrInvalidWebhook)
+	}
+	if strings.ContainsAny(wh.Authorization, "\r\n") {
+		return fmt.Errorf("%w: invalid authorization", ErrInvalidWebhook)
+	}
+	res, err := s.propose(ctx, kv{Op: opWebhookPut, Webhook: &wh})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// DeleteWebhook removes the webhook id.
+func (s *kvstore) DeleteWebhook(ctx context.Context, id string) error {
+	res, err := s.propose(ctx, kv{Op: opWebhookDelete, Key: id})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// Webhooks returns the webhooks sorted by ID.
+func (s *kvstore) Webhooks() []api.Webhook {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.webhookList()
+}
+
+// webhookList must be called with s.mu held.
+func (s *kvstore) webhookList() []api.Webhook {
+	hooks := make([]api.Webhook, 0, len(s.webhooks))
+	for _, wh := range s.webhooks {
+		hooks = append(hooks, wh)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks
+}
+
+// applyWebhook applies opWebhookPut or opWebhookDelete. It must be called
+// with s.mu held.
+func (s *kvstore) applyWebhook(r kv) error {
+	if r.Op == opWebhookDelete {
+		if _, ok := s.webhooks[r.Key]; !ok {
+			return ErrWebhookNotFound
+		}
+		delete(s.webhooks, r.Key)
+		return nil
+	}
+	if _, err := s.space(r.Webhook.Keyspace); err != nil {
+		return err
+	}
+	s.webhooks[r.Webhook.ID] = *r.Webhook
+	return nil
+}
+
+// webhookNotifier POSTs the changes to the webhooks while this member
+// leads. Notifications start with the changes after the leader starts,
+// the changes committed during a change of leader are not sent.
+type webhookNotifier struct {
+	s        *kvstore
+	isLeader func() bool
+	client   *http.Client
+
+	stopc chan struct{}
+	donec chan struct{}
+}
+
+// webhookDelivery is the notification of a webhook in progress.
+type webhookDelivery struct {
+	hook   api.Webhook
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newWebhookNotifier(s *kvstore, isLeader func() bool) *webhookNotifier {
+	return &webhookNotifier{
+		s:        s,
+		isLeader: isLeader,
+		client:   &http.Client{Timeout: webhookTimeout},
+		stopc:    make(chan struct{}),
+		donec:    make(chan struct{}),
+	}
+}
+
+func (n *webhookNotifier) Run() {
+	go func() {
+		defer close(n.donec)
+		running := make(map[string]*webhookDelivery)
+		defer func() {
+			for _, d := range running {
+				d.cancel()
+				<-d.done
+			}
+		}()
+		t := time.NewTicker(webhookInterval)
+		defer t.Stop()
+		for {
+			hooks := make(map[string]api.Webhook)
+			if n.isLeader() {
+				for _, wh := range n.s.Webhooks() {
+					hooks[wh.ID] = wh
+				}
+			}
+			for id, d := range running {
+				select {
+				case <-d.done:
+					// restarted below
+					delete(running, id)
+					continue
+				default:
+				}
+				if wh, ok := hooks[id]; !ok || wh != d.hook {
+					d.cancel()
+					delete(running, id)
+				}
+			}
+			for id, wh := range hooks {
+				if _, ok := running[id]; ok {
+					continue
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				d := &webhookDelivery{hook: wh, cancel: cancel, done: make(chan struct{})}
+				running[id] = d
+				go func() {
+					defer close(d.done)
+					n.notify(ctx, d.hook)
+				}()
+			}
+			select {
+			case <-t.C:
+			case <-n.stopc:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops notifying.
+func (n *webhookNotifier) Stop() {
+	close(n.stopc)
+	<-n.donec
+}
+
+// notify sends the changes of wh, one request per revision, until ctx is
+// done or the watch ends.
+func (n *webhookNotifier) notify(ctx context.Context, wh api.Webhook) {
+	events, cancel, err := n.s.WatchIn(wh.Keyspace, wh.Prefix, watchOptions{prefix: true, since: noSince})
+	if err != nil {
+		log.Printf("Failed to watch the changes of webhook %q (%v)\n", wh.ID, err)
+		return
+	}
+	defer cancel()
+	var (
+		batch = sink.Batch{Keyspace: wh.Keyspace}
+		// like the sinks, the changes of a revision are collected for
+		// sinkFlushDelay once no more arrive
+		flush = time.NewTimer(sinkFlushDelay)
+	)
+	flush.Stop()
+	defer flush.Stop()
+	send := func() {
+		if len(batch.Events) == 0 {
+			return
+		}
+		if err := n.post(ctx, wh, batch); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to notify webhook %q of revision %d, dropping it (%v)\n", wh.ID, batch.Rev, err)
+		}
+		batch.Events = nil
+	}
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				send()
+				return
+			}
+			if ev.ModRevision != batch.Rev {
+				send()
+			}
+			batch.Rev = ev.ModRevision
+			batch.Events = append(batch.Events, ev)
+			flush.Reset(sinkFlushDelay)
+		case <-flush.C:
+			send()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// post sends b to wh, retrying with exponential backoff up to
+// webhookAttempts times until it answers 2xx.
+func (n *webhookNotifier) post(ctx context.Context, wh api.Webhook, b sink.Batch) error {
+	body, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		if err = n.postOnce(ctx, wh, body); err == nil || attempt == webhookAttempts {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+func (n *webhookNotifier) postOnce(ctx context.Context, wh api.Webhook, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Metcd-Webhook", wh.ID)
+	if wh.Authorization != "" {
+		req.Header.Set("Authorization", wh.Authorization)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// serveWebhooks lists the webhooks on GET /webhooks, without their
+// authorization. PUT /webhooks/<id> registers a webhook, GET returns it
+// and DELETE removes it.
+func (h *httpKVAPI) serveWebhooks(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/webhooks"), "/")
+	switch {
+	case r.Method == http.MethodGet:
+		hooks := h.store.Webhooks()
+		for i := range hooks {
+			hooks[i].Authorization = ""
+		}
+		if id == "" {
+			writeJSON(w, hooks)
+			return
+		}
+		for _, wh := range hooks {
+			if wh.ID == id {
+				writeJSON(w, wh)
+				return
+			}
+		}
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+	case id != "" && r.Method == http.MethodPut:
+		var wh api.Webhook
+		if err := json.NewDecoder(r.Body).Decode(&wh); err != nil || (wh.ID != "" && wh.ID != id) {
+			http.Error(w, "Failed on PUT", http.StatusBadRequest)
+			return
+		}
+		wh.ID = id
+		if err := h.store.PutWebhook(r.Context(), wh); errors.Is(err, ErrInvalidWebhook) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if keyspaceError(w, err) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose webhook (%v)\n", err)
+			http.Error(w, "Failed on PUT", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case id != "" && r.Method == http.MethodDelete:
+		if err := h.store.DeleteWebhook(r.Context(), id); errors.Is(err, ErrWebhookNotFound) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Failed to propose webhook deletion (%v)\n", err)
+			http.Error(w, "Failed on DELETE", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
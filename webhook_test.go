@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"metcd/api"
+	"metcd/sink"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookState(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.apply(kv{Op: opKeyspacePut, Keyspace: "app"})
+	hook := api.Webhook{ID: "deploy", URL: "http://ci.example.com/hook", Keyspace: "app", Prefix: "/releases/", Authorization: "Bearer x"}
+	if res := s.apply(kv{Op: opWebhookPut, Webhook: &hook}); res.err != nil {
+		t.Fatal(res.err)
+	}
+	missing := api.Webhook{ID: "other", URL: "http://ci.example.com/hook", Keyspace: "nosuch"}
+	if res := s.apply(kv{Op: opWebhookPut, Webhook: &missing}); !errors.Is(res.err, ErrKeyspaceNotFound) {
+		t.Fatalf("expected a webhook of a missing keyspace to fail, got %v", res.err)
+	}
+
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestKVStore(nil)
+	if err := restored.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if hooks := restored.Webhooks(); len(hooks) != 1 || hooks[0] != hook {
+		t.Fatalf("expected the webhook to be restored, got %+v", hooks)
+	}
+
+	if res := s.apply(kv{Op: opWebhookDelete, Key: "nosuch"}); !errors.Is(res.err, ErrWebhookNotFound) {
+		t.Fatalf("expected deleting a missing webhook to fail, got %v", res.err)
+	}
+	// deleting the keyspace removes its webhooks
+	s.apply(kv{Op: opKeyspaceDelete, Keyspace: "app"})
+	if hooks := s.Webhooks(); len(hooks) != 0 {
+		t.Fatalf("expected no webhooks, got %+v", hooks)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	defer func(backoff time.Duration, interval time.Duration) {
+		webhookBackoff, webhookInterval = backoff, interval
+	}(webhookBackoff, webhookInterval)
+	webhookBackoff, webhookInterval = time.Millisecond, 10*time.Millisecond
+
+	var failures atomic.Int32
+	failures.Store(2)
+	batches := make(chan sink.Batch, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer x" || r.Header.Get("X-Metcd-Webhook") != "deploy" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		if failures.Add(-1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var b sink.Batch
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			t.Error(err)
+		}
+		batches <- b
+	}))
+	defer srv.Close()
+
+	s := newTestKVStore(nil)
+	s.apply(kv{Op: opWebhookPut, Webhook: &api.Webhook{ID: "deploy", URL: srv.URL, Prefix: "/releases/", Authorization: "Bearer x"}})
+	n := newWebhookNotifier(s, func() bool { return true })
+	n.Run()
+	defer n.Stop()
+	// the watch starts with the notifier
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hub := s.keyspace.watchers
+		hub.mu.Lock()
+		watching := len(hub.watchers) > 0
+		hub.mu.Unlock()
+		if watching || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	s.apply(kv{Op: opPut, Key: "/other", Val: "x"})
+	s.apply(kv{Op: opTxn, Txn: &api.TxnRequest{Success: []api.Op{
+		{Type: api.OpPut, Key: "/releases/a", Value: "v1"},
+		{Type: api.OpPut, Key: "/releases/b", Value: "v2"},
+	}}})
+	select {
+	case b := <-batches:
+		if b.Rev != 2 || len(b.Events) != 2 || !strings.HasPrefix(b.Events[0].Key, "/releases/") {
+			t.Fatalf("expected the changes of revision 2 after 2 retries, got %+v", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the webhook")
+	}
+}
+
+func TestServeWebhooks(t *testing.T) {
+	s := newTestKVStore(nil)
+	s.apply(kv{Op: opWebhookPut, Webhook: &api.Webhook{ID: "deploy", URL: "http://ci.example.com/hook", Authorization: "Bearer x"}})
+	srv := httptest.NewServer(newHTTPHandler(&httpKVAPI{store: s, requests: newRequestTracker()}))
+	defer srv.Close()
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+		want               string
+	}{
+		{http.MethodGet, "/webhooks", "", http.StatusOK, `[{"id":"deploy","url":"http://ci.example.com/hook"}]`},
+		{http.MethodGet, "/webhooks/deploy", "", http.StatusOK, `{"id":"deploy","url":"http://ci.example.com/hook"}`},
+		{http.MethodGet, "/webhooks/nosuch", "", http.StatusNotFound, ""},
+		{http.MethodPut, "/webhooks/deploy", `{"url":"ftp://ci.example.com"}`, http.StatusBadRequest, ""},
+		{http.MethodPut, "/webhooks/deploy", `{"id":"other","url":"http://ci.example.com"}`, http.StatusBadRequest, ""},
+		{http.MethodPost, "/webhooks", "", http.StatusMethodNotAllowed, ""},
+	} {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, strings.NewReader(c.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.code || (c.want != "" && strings.TrimSpace(string(body)) != c.want) {
+			t.Fatalf("%s %s: expected %d %s, got %d %s", c.method, c.path, c.code, c.want, resp.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func echoServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestEcho(t *testing.T) {
+	srv := echoServer(t)
+	c, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the three encodings of the payload length
+	for _, msg := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("a"), 1000), bytes.Repeat([]byte("b"), 70000)} {
+		if err := c.WriteMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("expected %d bytes echoed, got %d", len(msg), len(got))
+		}
+	}
+	if err := c.writeFrame(opPing, []byte("p")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeFrame(opClose, []byte{closeNormal >> 8, closeNormal & 0xff}); err != nil {
+		t.Fatal(err)
+	}
+	// the pong is skipped, the close answered
+	if _, err := c.ReadMessage(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	defer func(size int64) { MaxMessageSize = size }(MaxMessageSize)
+	MaxMessageSize = 10
+	srv := echoServer(t)
+	c, err := Dial(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.WriteMessage([]byte("more than ten bytes")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadMessage(); err != io.EOF {
+		t.Fatalf("expected the server to close the connection, got %v", err)
+	}
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	srv := echoServer(t)
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a plain GET, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"metcd/api"
+	"metcd/raftnode"
+	"metcd/websocket"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serveWS handles /ws, a WebSocket carrying api.WSRequest and
+// api.WSResponse messages: gets, puts, deletes and txns of the keyspace of
+// the request, pipelined and executed in order, and watches streaming
+// their events until canceled or the connection closes.
+func (h *httpKVAPI) serveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		log.Printf("Failed to upgrade to WebSocket (%v)\n", err)
+		return
+	}
+	setPhase(r.Context(), phaseStreaming)
+	ctx, cancel := context.WithCancel(r.Context())
+	s := &wsSession{h: h, conn: conn, ctx: ctx, space: keyspaceOf(r.Context()), watches: make(map[int64]func())}
+	defer func() {
+		cancel()
+		s.cancelWatches()
+		conn.Close()
+	}()
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req api.WSRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			s.send(api.WSResponse{ID: req.ID, Error: "invalid request: " + err.Error()})
+			continue
+		}
+		if res := s.do(req); res != nil {
+			s.send(*res)
+		}
+	}
+}
+
+// wsSession is a /ws connection.
+type wsSession struct {
+	h     *httpKVAPI
+	conn  *websocket.Conn
+	ctx   context.Context
+	space string
+
+	mu      sync.Mutex
+	watches map[int64]func()
+}
+
+func (s *wsSession) send(res api.WSResponse) {
+	data, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("Failed to encode WebSocket response (%v)\n", err)
+		return
+	}
+	if err := s.conn.WriteMessage(data); err != nil {
+		s.conn.Close()
+	}
+}
+
+// do executes req and returns its response, nil for a watch started or
+// canceled: its events and cancellation are sent by the watch.
+func (s *wsSession) do(req api.WSRequest) *api.WSResponse {
+	res := &api.WSResponse{ID: req.ID}
+	var err error
+	if s.h.audit != nil && (req.Op == api.WSPut || req.Op == api.WSDelete || req.Op == api.WSTxn) {
+		defer func(start time.Time) { s.h.audit.ws(s.ctx, s.space, req, start, err) }(time.Now())
+	}
+	switch req.Op {
+	case api.WSGet:
+		if !req.Serializable {
+			err = s.h.rc.LinearizableReadNotify(s.ctx)
+		}
+		if err == nil {
+			res.KV, res.Rev, err = s.h.store.GetIn(s.space, req.Key)
+		}
+	case api.WSPut:
+		res.KV, _, err = s.h.store.PutKV(s.ctx, req.Key, req.Value)
+	case api.WSDelete:
+		res.Found, err = s.h.store.Delete(s.ctx, req.Key)
+	case api.WSTxn:
+		if req.Txn == nil {
+			err = errors.New("txn missing")
+		} else {
+			res.Txn, err = s.h.store.Txn(s.ctx, req.Txn)
+		}
+	case api.WSWatch:
+		return s.watch(req)
+	case api.WSCancel:
+		s.mu.Lock()
+		cancel, ok := s.watches[req.ID]
+		delete(s.watches, req.ID)
+		s.mu.Unlock()
+		if !ok {
+			err = errors.New("no such watch")
+		} else {
+			cancel()
+			return nil
+		}
+	default:
+		err = errors.New("unknown op")
+	}
+	if errors.Is(err, raftnode.ErrProposalDeferred) {
+		res.Error = "proposal deferred, WAL appends are slow"
+	} else if errors.Is(err, raftnode.ErrApplyBacklog) {
+		res.Error = "proposal rejected, applying the committed entries lags behind"
+	} else if errors.Is(err, ErrNoSpace) {
+		res.Error = "no space left on the data directory of a member"
+	} else if err != nil {
+		log.Printf("Failed on WebSocket %s (%v)\n", req.Op, err)
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// watch starts the watch of req, streaming its events from a goroutine.
+func (s *wsSession) watch(req api.WSRequest) *api.WSResponse {
+	opts := watchOptions{prefix: req.Prefix, since: noSince, keysOnly: req.KeysOnly, noPut: req.NoPut, noDelete: req.NoDelete}
+	if req.Since != nil {
+		if *req.Since < 0 {
+			return &api.WSResponse{ID: req.ID, Canceled: true, Error: "invalid since"}
+		}
+		opts.since = *req.Since
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.watches[req.ID]; ok {
+		return &api.WSResponse{ID: req.ID, Error: "watch ID in use"}
+	}
+	events, cancel, err := s.h.store.WatchIn(s.space, req.Key, opts)
+	var compacted *compactedError
+	if errors.As(err, &compacted) {
+		return &api.WSResponse{ID: req.ID, Canceled: true, CompactRevision: compacted.rev, Error: "revision compacted"}
+	} else if err != nil {
+		log.Printf("Failed to watch on WebSocket (%v)\n", err)
+		return &api.WSResponse{ID: req.ID, Canceled: true, Error: err.Error()}
+	}
+	stop := make(chan struct{})
+	var once sync.Once
+	s.watches[req.ID] = func() { once.Do(func() { close(stop) }) }
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					// fell behind and was dropped, the client resumes
+					// with Since
+					s.mu.Lock()
+					delete(s.watches, req.ID)
+					s.mu.Unlock()
+					s.send(api.WSResponse{ID: req.ID, Canceled: true, Error: "watch fell behind"})
+					return
+				}
+				s.send(api.WSResponse{ID: req.ID, Event: &ev})
+			case <-stop:
+				s.send(api.WSResponse{ID: req.ID, Canceled: true})
+				return
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// cancelWatches stops the watches of the closed connection.
+func (s *wsSession) cancelWatches() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, cancel := range s.watches {
+		cancel()
+		delete(s.watches, id)
+	}
+}